@@ -0,0 +1,173 @@
+// Package bot is a small framework for chat bots. A bot connects with the
+// API key an admin got from POST /admin/bots, the server only sends it the
+// !commands it was granted, and handlers answer them:
+//
+//	b := bot.New("ws://localhost:6969/ws", os.Getenv("BOT_KEY"))
+//	b.Command("roll", func(m *bot.Message) {
+//		m.Reply(fmt.Sprint(rand.Intn(6) + 1))
+//	})
+//	log.Fatal(b.Run(ctx))
+//
+// Run reconnects on its own and picks the session back up, so a restarting
+// server doesn't move the bot back to the lobby. The connection itself is a
+// client.Client.
+package bot
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+
+	"go-chat-app/client"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrBadKey is returned by Run when the server refuses the API key. There
+// is no point in trying again with the same key.
+var ErrBadKey = client.ErrUnauthorized
+
+var errNotConnected = errors.New("bot: not connected")
+
+// Handler answers one message. Each runs in its own goroutine.
+type Handler func(m *Message)
+
+// ######################################################################
+// struct: Message
+// ######################################################################
+// A chat line. For commands, Command is the name without the ! and Args
+// the rest of the line.
+type Message struct {
+	ID      int64
+	Room    string
+	From    string
+	Text    string
+	Command string
+	Args    string
+
+	bot *Bot
+}
+
+// ######################################################################
+// function: Reply()
+// ######################################################################
+// Answers in the message's room, threaded under it.
+func (m *Message) Reply(text string) error {
+	c := m.bot.client()
+	if c == nil {
+		return errNotConnected
+	}
+	return c.Reply(m.ID, text)
+}
+
+// ######################################################################
+// struct: Bot
+// ######################################################################
+// Set the exported fields before calling Run.
+type Bot struct {
+	URL    string // the server's WebSocket endpoint, ws://host/ws
+	Key    string
+	Room   string            // joined on the first connect, "" = the lobby
+	Dialer *websocket.Dialer // nil = websocket.DefaultDialer
+
+	mu        sync.Mutex
+	commands  map[string]Handler
+	onMessage Handler
+	conn      *client.Client
+}
+
+// ######################################################################
+// function: New()
+// ######################################################################
+func New(url, key string) *Bot {
+	return &Bot{URL: url, Key: key, commands: make(map[string]Handler)}
+}
+
+// ######################################################################
+// function: Command()
+// ######################################################################
+// Calls h for lines starting with !name. The server decides what the bot
+// hears, so name has to be one of the commands it was granted.
+func (b *Bot) Command(name string, h Handler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.commands[strings.ToLower(strings.TrimPrefix(name, "!"))] = h
+}
+
+// ######################################################################
+// function: OnMessage()
+// ######################################################################
+// Calls h for every other line the server sends. That is everything in the
+// room for a bot without commands, and nothing for one that has some.
+func (b *Bot) OnMessage(h Handler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.onMessage = h
+}
+
+// ######################################################################
+// function: Name()
+// ######################################################################
+// The bot's username, once connected.
+func (b *Bot) Name() string {
+	if c := b.client(); c != nil {
+		return c.Username()
+	}
+	return ""
+}
+
+// ######################################################################
+// function: Send()
+// ######################################################################
+// Posts text in the bot's room.
+func (b *Bot) Send(text string) error {
+	c := b.client()
+	if c == nil {
+		return errNotConnected
+	}
+	return c.Send(text)
+}
+
+func (b *Bot) client() *client.Client {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.conn
+}
+
+// ######################################################################
+// function: Run()
+// ######################################################################
+// Connects and handles messages until ctx is done, reconnecting whenever
+// the connection drops. Only returns early on ErrBadKey.
+func (b *Bot) Run(ctx context.Context) error {
+	c := client.New(b.URL)
+	c.BotKey = b.Key
+	c.Dialer = b.Dialer
+	if b.Room != "" {
+		c.Join(b.Room, "")
+	}
+	c.OnMessage(b.handle)
+	b.mu.Lock()
+	b.conn = c
+	b.mu.Unlock()
+	return c.Run(ctx)
+}
+
+func (b *Bot) handle(cm client.Message) {
+	if cm.Direct || cm.From == b.Name() {
+		return // our own line echoed back
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	m := &Message{ID: cm.ID, Room: cm.Room, From: cm.From, Text: cm.Text, bot: b}
+	h := b.onMessage
+	if first, rest, _ := strings.Cut(cm.Text, " "); strings.HasPrefix(first, "!") {
+		if ch, ok := b.commands[strings.ToLower(first[1:])]; ok {
+			m.Command, m.Args, h = strings.ToLower(first[1:]), strings.TrimSpace(rest), ch
+		}
+	}
+	if h != nil {
+		go h(m)
+	}
+}
@@ -0,0 +1,98 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"go-chat-app/internal/hub"
+	"go-chat-app/internal/protocol"
+)
+
+// ######################################################################
+// function: handleAccount()
+// ######################################################################
+// For the logged in user's own data. GET /api/account/export downloads
+// everything stored about the account as JSON, DELETE /api/account deletes
+// the account and scrubs its history. GET and PUT /api/account/profile
+// read and replace the profile others see with /whois and on presence.
+// PUT /api/account/email {"email": "..."} sets the address password
+// resets go to, once the link mailed to it is opened.
+func (s *Server) handleAccount(w http.ResponseWriter, r *http.Request) {
+	a, ok := s.hub.LoginAccount(loginToken(r))
+	if !ok {
+		http.Error(w, "not logged in", http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/api/account/export" && r.Method == http.MethodGet:
+		export, err := s.hub.ExportData(a.ID)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Disposition", `attachment; filename="chat-export.json"`)
+		writeJSON(w, http.StatusOK, export)
+
+	case r.URL.Path == "/api/account/profile" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, a.Profile())
+
+	case r.URL.Path == "/api/account/profile" && r.Method == http.MethodPut:
+		var p protocol.Profile
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			http.Error(w, "bad request body", http.StatusBadRequest)
+			return
+		}
+		p, err := s.hub.SetProfile(a.ID, p)
+		switch {
+		case errors.Is(err, hub.ErrNoAccount):
+			http.NotFound(w, r)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			writeJSON(w, http.StatusOK, p)
+		}
+
+	case r.URL.Path == "/api/account/email" && r.Method == http.MethodPut:
+		var req struct {
+			Email string `json:"email"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad request body", http.StatusBadRequest)
+			return
+		}
+		err := s.hub.SetEmail(a.ID, req.Email)
+		switch {
+		case errors.Is(err, hub.ErrNoAccount):
+			http.NotFound(w, r)
+		case errors.Is(err, hub.ErrBadEmail):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, hub.ErrNoMailer):
+			http.Error(w, err.Error(), http.StatusNotImplemented)
+		case err != nil:
+			log.Printf("Error mailing address check for %s: %v", a.Name, err)
+			http.Error(w, "could not send the mail, try again later", http.StatusBadGateway)
+		default:
+			w.WriteHeader(http.StatusAccepted)
+		}
+
+	case r.URL.Path == "/api/account" && r.Method == http.MethodDelete:
+		err := s.hub.DeleteAccount(a.ID)
+		switch {
+		case errors.Is(err, hub.ErrNoAccount):
+			http.NotFound(w, r)
+			return
+		case err != nil:
+			log.Printf("Error deleting account %s: %v", a.ID, err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: loginCookie, Path: "/", MaxAge: -1})
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "not found or method not allowed", http.StatusNotFound)
+	}
+}
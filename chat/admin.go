@@ -0,0 +1,678 @@
+package chat
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+	"strings"
+	"time"
+
+	"go-chat-app/internal/hub"
+)
+
+// Required with basic auth on anything but GET, see requireAdmin
+const adminHeader = "X-Chat-Admin"
+
+// ######################################################################
+// function: requireAdmin()
+// ######################################################################
+// Wraps an admin handler with bearer token auth. No token configured = no admin API.
+// Browsers can use basic auth with the token as password instead, which is
+// how the dashboard page and its requests get in. A browser sends that on
+// its own, from other sites' forms too, so changes made with it also need
+// the X-Chat-Admin header, which another site can't add without asking.
+func (s *Server) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.cfg.AdminToken == "" {
+			http.NotFound(w, r)
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		_, password, basic := r.BasicAuth()
+		if basic {
+			token = password
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.AdminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="chat admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		change := r.Method != http.MethodGet && r.Method != http.MethodHead
+		if basic && change && r.Header.Get(adminHeader) == "" {
+			http.Error(w, "missing "+adminHeader+" header", http.StatusForbidden)
+			return
+		}
+		// every change made through the API, reads aren't worth the noise
+		if change {
+			s.hub.Audit(hub.AuditEntry{Actor: "admin", Action: "admin_api", Target: r.Method + " " + r.URL.Path, IP: s.clientIP(r)})
+		}
+		next(w, r)
+	}
+}
+
+// ######################################################################
+// function: writeJSON()
+// ######################################################################
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
+
+// ######################################################################
+// function: handleAdminBans()
+// ######################################################################
+// GET lists active bans, POST {"ip": "...", "duration": "1h", "reason": "..."} adds one,
+// DELETE ?ip=... lifts one.
+func (s *Server) handleAdminBans(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.hub.Bans())
+
+	case http.MethodPost:
+		var req struct {
+			IP       string `json:"ip"`
+			Duration string `json:"duration"`
+			Reason   string `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad request body", http.StatusBadRequest)
+			return
+		}
+		if net.ParseIP(req.IP) == nil {
+			http.Error(w, "invalid ip", http.StatusBadRequest)
+			return
+		}
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil || d <= 0 {
+			http.Error(w, "invalid duration", http.StatusBadRequest)
+			return
+		}
+		if err := s.hub.BanIP(req.IP, d, req.Reason); err != nil {
+			log.Printf("Error persisting bans: %v", err)
+		}
+		s.hub.Audit(hub.AuditEntry{Actor: "admin", Action: "ban", Target: req.IP, Reason: req.Reason, IP: s.clientIP(r)})
+		writeJSON(w, http.StatusCreated, map[string]any{"ip": req.IP, "until": time.Now().Add(d)})
+
+	case http.MethodDelete:
+		ip := r.URL.Query().Get("ip")
+		if ip == "" {
+			http.Error(w, "missing ip", http.StatusBadRequest)
+			return
+		}
+		if err := s.hub.UnbanIP(ip); err != nil {
+			log.Printf("Error persisting bans: %v", err)
+		}
+		s.hub.Audit(hub.AuditEntry{Actor: "admin", Action: "unban", Target: ip, IP: s.clientIP(r)})
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// ######################################################################
+// function: handleAdminShadowBans()
+// ######################################################################
+// GET lists shadow bans, POST {"name": "..."} shadow bans a user and
+// DELETE ?name=... (or the key from the list) lifts it.
+func (s *Server) handleAdminShadowBans(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.hub.ShadowBans())
+
+	case http.MethodPost:
+		var req struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+			http.Error(w, "bad request body", http.StatusBadRequest)
+			return
+		}
+		keys, err := s.hub.ShadowBanUser(req.Name, "admin")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusCreated, map[string]any{"name": req.Name, "keys": keys})
+
+	case http.MethodDelete:
+		if err := s.hub.LiftShadowBan(r.URL.Query().Get("name"), "admin"); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// ######################################################################
+// function: handleAdminStats()
+// ######################################################################
+// Connection counts broken down by user agent and declared client version.
+func (s *Server) handleAdminStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.hub.Stats())
+}
+
+// ######################################################################
+// function: handleMetrics()
+// ######################################################################
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.hub.WriteMetrics(w)
+}
+
+// ######################################################################
+// function: handleAdminDebug()
+// ######################################################################
+// GET dumps the hub's insides: goroutines, rooms, send buffers.
+func (s *Server) handleAdminDebug(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.hub.Debug())
+}
+
+// ######################################################################
+// function: pprofHandler()
+// ######################################################################
+// net/http/pprof under /admin/debug/pprof/. Its handlers expect to be at
+// /debug/pprof/, so they get the path without /admin. Importing it also
+// puts them on http.DefaultServeMux, which a program embedding the chat
+// shouldn't serve to the world.
+func pprofHandler() http.HandlerFunc {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return http.StripPrefix("/admin", mux).ServeHTTP
+}
+
+// ######################################################################
+// function: handleAdminAnnounce()
+// ######################################################################
+// POST {"text": "...", "from": "optional sender name"}
+func (s *Server) handleAdminAnnounce(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		From string `json:"from"`
+		Text string `json:"text"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Text) == "" {
+		http.Error(w, "bad request body", http.StatusBadRequest)
+		return
+	}
+	if req.From == "" {
+		req.From = "admin"
+	}
+	s.hub.Announce(req.From, strings.TrimSpace(req.Text))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ######################################################################
+// function: handleAdminScheduled()
+// ######################################################################
+// GET lists pending messages, POST {"room", "text", "from", "at" or "delay"}
+// schedules one and DELETE ?id=... cancels one.
+func (s *Server) handleAdminScheduled(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.hub.ScheduledMessages())
+
+	case http.MethodPost:
+		var req struct {
+			Room  string    `json:"room"`
+			From  string    `json:"from"`
+			Text  string    `json:"text"`
+			At    time.Time `json:"at"`
+			Delay string    `json:"delay"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Text) == "" {
+			http.Error(w, "bad request body", http.StatusBadRequest)
+			return
+		}
+		if req.Room == "" {
+			req.Room = hub.DefaultRoom
+		}
+		if req.From == "" {
+			req.From = "admin"
+		}
+		if req.Delay != "" {
+			d, err := time.ParseDuration(req.Delay)
+			if err != nil {
+				http.Error(w, "invalid delay", http.StatusBadRequest)
+				return
+			}
+			req.At = time.Now().Add(d)
+		}
+		m, err := s.hub.Schedule(strings.ToLower(req.Room), req.From, "", "", strings.TrimSpace(req.Text), req.At)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusCreated, m)
+
+	case http.MethodDelete:
+		if !s.hub.Unschedule(r.URL.Query().Get("id")) {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// ######################################################################
+// function: handleAdminRecurring()
+// ######################################################################
+// GET lists recurring announcements, POST {"spec": "0 9 * * 1-5",
+// "time_zone": "Europe/Oslo", "text", "texts": {"no": ...}, "room", "from"}
+// sets one up and DELETE ?id=... removes one. No room = everyone.
+func (s *Server) handleAdminRecurring(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.hub.RecurringAnnouncements())
+
+	case http.MethodPost:
+		var req hub.RecurringAnnouncement
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Text) == "" {
+			http.Error(w, "bad request body", http.StatusBadRequest)
+			return
+		}
+		if req.From == "" {
+			req.From = "admin"
+		}
+		req.Room = strings.ToLower(req.Room)
+		req.Text = strings.TrimSpace(req.Text)
+		a, err := s.hub.AddRecurring(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusCreated, a)
+
+	case http.MethodDelete:
+		if !s.hub.RemoveRecurring(r.URL.Query().Get("id")) {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// ######################################################################
+// function: handleAdminAccounts()
+// ######################################################################
+// GET /admin/accounts lists accounts, GET /admin/accounts/<id> shows one,
+// POST /admin/accounts/<id>/merge {"from": "<other id>"} folds another
+// account into it, DELETE /admin/accounts/<id>/identities?provider=&subject=
+// unlinks an identity and DELETE /admin/accounts/<id>/logins signs the
+// account out everywhere, closing its connections. Secrets are never
+// returned.
+func (s *Server) handleAdminAccounts(w http.ResponseWriter, r *http.Request) {
+	id, sub, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/accounts"), "/"), "/")
+
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, s.hub.Accounts())
+
+	case id != "" && sub == "" && r.Method == http.MethodGet:
+		a, ok := s.hub.Account(id)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, http.StatusOK, a)
+
+	case id != "" && sub == "merge" && r.Method == http.MethodPost:
+		var req struct {
+			From string `json:"from"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.From == "" {
+			http.Error(w, "bad request body", http.StatusBadRequest)
+			return
+		}
+		a, err := s.hub.MergeAccounts(id, req.From)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, a)
+
+	case id != "" && sub == "identities" && r.Method == http.MethodDelete:
+		q := r.URL.Query()
+		err := s.hub.UnlinkIdentity(id, q.Get("provider"), q.Get("subject"))
+		switch {
+		case errors.Is(err, hub.ErrNoAccount), errors.Is(err, hub.ErrNotFound):
+			http.NotFound(w, r)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+
+	case id != "" && sub == "logins" && r.Method == http.MethodDelete:
+		tokens, conns, err := s.hub.RevokeLogins(id, "admin")
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"logins": tokens, "connections": conns})
+
+	default:
+		http.Error(w, "not found or method not allowed", http.StatusNotFound)
+	}
+}
+
+// ######################################################################
+// function: handleAdminBots()
+// ######################################################################
+// GET /admin/bots lists bot accounts, POST /admin/bots {"name", "commands":
+// ["weather"]} creates one, PUT /admin/bots/<id> {"commands"} changes its
+// commands, POST /admin/bots/<id>/key gives it a new API key and DELETE
+// /admin/bots/<id> deletes it. API keys are only ever in the reply that
+// made them.
+func (s *Server) handleAdminBots(w http.ResponseWriter, r *http.Request) {
+	id, sub, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/bots"), "/"), "/")
+	var req struct {
+		Name     string   `json:"name"`
+		Commands []string `json:"commands"`
+	}
+	if (r.Method == http.MethodPost && sub == "") || r.Method == http.MethodPut {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, s.hub.Bots())
+
+	case id == "" && r.Method == http.MethodPost:
+		a, key, err := s.hub.CreateBot(req.Name, req.Commands)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.hub.Audit(hub.AuditEntry{Actor: "admin", Action: "create_bot", Target: a.ID, IP: s.clientIP(r)})
+		writeJSON(w, http.StatusCreated, map[string]any{"account": a, "key": key})
+
+	case id != "" && sub == "" && r.Method == http.MethodPut:
+		a, err := s.hub.SetBotCommands(id, req.Commands)
+		switch {
+		case errors.Is(err, hub.ErrNotBot):
+			http.NotFound(w, r)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			writeJSON(w, http.StatusOK, a)
+		}
+
+	case id != "" && sub == "key" && r.Method == http.MethodPost:
+		key, err := s.hub.RotateBotKey(id)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		s.hub.Audit(hub.AuditEntry{Actor: "admin", Action: "rotate_bot_key", Target: id, IP: s.clientIP(r)})
+		writeJSON(w, http.StatusOK, map[string]string{"key": key})
+
+	case id != "" && sub == "" && r.Method == http.MethodDelete:
+		if a, ok := s.hub.Account(id); !ok || !a.Bot {
+			http.NotFound(w, r)
+			return
+		}
+		if err := s.hub.DeleteAccount(id); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "not found or method not allowed", http.StatusNotFound)
+	}
+}
+
+// ######################################################################
+// function: handleAdminWebhooks()
+// ######################################################################
+// GET lists webhooks, POST {"url", "events": ["message", "join", "leave",
+// "moderation", "ban"], "rooms": [...]} adds one and DELETE ?id=... removes
+// one. No events or rooms = all of them. The reply has the signing secret.
+func (s *Server) handleAdminWebhooks(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.hub.Webhooks())
+
+	case http.MethodPost:
+		var req hub.Webhook
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad request body", http.StatusBadRequest)
+			return
+		}
+		for i, room := range req.Rooms {
+			req.Rooms[i] = strings.ToLower(strings.TrimPrefix(room, "#"))
+		}
+		hook, err := s.hub.AddWebhook(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusCreated, hook)
+
+	case http.MethodDelete:
+		if !s.hub.RemoveWebhook(r.URL.Query().Get("id")) {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// ######################################################################
+// function: handleAdminHooks()
+// ######################################################################
+// Incoming hooks: GET lists them, POST {"room", "name"} adds one and replies
+// with its token (POST /hooks/<token> to use it), DELETE ?id=... removes one.
+func (s *Server) handleAdminHooks(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.hub.IncomingHooks())
+
+	case http.MethodPost:
+		var req struct {
+			Room string `json:"room"`
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad request body", http.StatusBadRequest)
+			return
+		}
+		hook, err := s.hub.AddIncomingHook(strings.ToLower(strings.TrimPrefix(req.Room, "#")), strings.TrimSpace(req.Name))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.hub.Audit(hub.AuditEntry{Actor: "admin", Action: "add_hook", Target: hook.ID, Room: hook.Room, IP: s.clientIP(r)})
+		writeJSON(w, http.StatusCreated, hook)
+
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		if !s.hub.RemoveIncomingHook(id) {
+			http.NotFound(w, r)
+			return
+		}
+		s.hub.Audit(hub.AuditEntry{Actor: "admin", Action: "remove_hook", Target: id, IP: s.clientIP(r)})
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// ######################################################################
+// function: handleAdminPage()
+// ######################################################################
+// The dashboard itself, admin.html from the web client files. It only
+// talks to the admin API, the page has nothing secret in it.
+func (s *Server) handleAdminPage(w http.ResponseWriter, r *http.Request) {
+	if s.cfg.Public == nil {
+		http.NotFound(w, r)
+		return
+	}
+	page, err := fs.ReadFile(s.cfg.Public, "admin.html")
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeContent(w, r, "admin.html", time.Time{}, bytes.NewReader(page))
+}
+
+// ######################################################################
+// function: handleAdminConnections()
+// ######################################################################
+// GET lists open connections, DELETE ?id=...&reason=... kicks one.
+func (s *Server) handleAdminConnections(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.hub.Connections())
+
+	case http.MethodDelete:
+		id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+		if err != nil || !s.hub.Kick(id, r.URL.Query().Get("reason")) {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// ######################################################################
+// function: handleAdminRefresh()
+// ######################################################################
+// POST {"max_delay": "2m"} makes every web client reload once a random
+// part of max_delay has passed, after a deployment. Defaults to a minute.
+func (s *Server) handleAdminRefresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		MaxDelay string `json:"max_delay"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "bad request body", http.StatusBadRequest)
+		return
+	}
+	maxDelay := time.Minute
+	if req.MaxDelay != "" {
+		d, err := time.ParseDuration(req.MaxDelay)
+		if err != nil || d < 0 {
+			http.Error(w, "invalid max_delay", http.StatusBadRequest)
+			return
+		}
+		maxDelay = d
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"clients": s.hub.RequestRefresh(maxDelay)})
+}
+
+// ######################################################################
+// function: handleAdminReload()
+// ######################################################################
+// POST reloads the config file, word list, MOTD and ban lists, like a
+// SIGHUP. A config file that doesn't load is a 422 and changes nothing.
+func (s *Server) handleAdminReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := s.Reload("admin"); err != nil {
+		log.Printf("Error reloading config: %v", err)
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ######################################################################
+// function: handleAdminAudit()
+// ######################################################################
+// GET ?actor=&action=&target=&since=<RFC 3339>&limit= returns audit log
+// entries, newest first. limit defaults to 100.
+func (s *Server) handleAdminAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	filter := hub.AuditFilter{Actor: q.Get("actor"), Action: q.Get("action"), Target: q.Get("target"), Limit: 100}
+	if v := q.Get("since"); v != "" {
+		since, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, "invalid since", http.StatusBadRequest)
+			return
+		}
+		filter.Since = since
+	}
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		filter.Limit = limit
+	}
+	entries, err := s.hub.AuditLog(filter)
+	if err != nil {
+		log.Printf("Error reading audit log: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// ######################################################################
+// function: handleAdminBandwidth()
+// ######################################################################
+// GET returns today's traffic per user, biggest first.
+func (s *Server) handleAdminBandwidth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.hub.BandwidthUsage())
+}
@@ -0,0 +1,305 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"go-chat-app/internal/hub"
+	"go-chat-app/internal/protocol"
+)
+
+// ######################################################################
+// function: handleRooms()
+// ######################################################################
+// GET /api/rooms lists every room, GET /api/rooms/<name> returns one and
+// GET /api/rooms/<name>/history returns its recent messages.
+func (s *Server) handleRooms(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name, sub, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/rooms"), "/"), "/")
+
+	if sub == "history" {
+		s.handleRoomHistory(w, r, name)
+		return
+	}
+	if sub != "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	if name != "" {
+		info, ok := s.hub.Room(name)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, http.StatusOK, info)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.hub.Rooms())
+}
+
+// ######################################################################
+// function: handleAdminRooms()
+// ######################################################################
+// PATCH /admin/rooms/<name> with any of description, tags, icon, welcome, policy.
+// The room is created if it does not exist yet.
+// /admin/rooms/<name>/mail manages the room's digest mailing list,
+// /admin/rooms/<name>/banner its banner, /admin/rooms/<name>/retention what
+// it keeps, /admin/rooms/<name>/export downloads its transcript and
+// /admin/rooms/<name>/insights returns its community stats.
+func (s *Server) handleAdminRooms(w http.ResponseWriter, r *http.Request) {
+	name, sub, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/rooms"), "/"), "/")
+	name = strings.ToLower(name)
+	if name == "" {
+		http.Error(w, "missing room name", http.StatusBadRequest)
+		return
+	}
+	if sub == "mail" {
+		s.handleAdminRoomMail(w, r, name)
+		return
+	}
+	if sub == "insights" {
+		s.handleAdminRoomInsights(w, r, name)
+		return
+	}
+	if sub == "banner" {
+		s.handleAdminRoomBanner(w, r, name)
+		return
+	}
+	if sub == "retention" {
+		s.handleAdminRoomRetention(w, r, name)
+		return
+	}
+	if sub == "export" {
+		s.handleAdminRoomExport(w, r, name)
+		return
+	}
+	if sub != "" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPatch {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Description *string              `json:"description"`
+		Tags        *[]string            `json:"tags"`
+		Icon        *string              `json:"icon"`
+		Welcome     *string              `json:"welcome"`
+		Policy      *protocol.RoomPolicy `json:"policy"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad request body", http.StatusBadRequest)
+		return
+	}
+
+	meta := s.hub.UpdateRoomMeta(name, func(m *protocol.RoomMeta) {
+		if req.Description != nil {
+			m.Description = *req.Description
+		}
+		if req.Tags != nil {
+			m.Tags = *req.Tags
+		}
+		if req.Icon != nil {
+			m.Icon = *req.Icon
+		}
+		if req.Welcome != nil {
+			m.Welcome = *req.Welcome
+		}
+		if req.Policy != nil {
+			m.Policy = *req.Policy
+		}
+	})
+	writeJSON(w, http.StatusOK, meta)
+}
+
+// ######################################################################
+// function: handleRoomHistory()
+// ######################################################################
+// ?limit=N caps the number of messages, ?thread=<id> returns that message
+// and all replies below it, ?key= is the password or invite of a locked room.
+func (s *Server) handleRoomHistory(w http.ResponseWriter, r *http.Request, name string) {
+	var thread int64
+	if t := r.URL.Query().Get("thread"); t != "" {
+		id, err := strconv.ParseInt(t, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid thread id", http.StatusBadRequest)
+			return
+		}
+		thread = id
+	}
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+
+	messages, err := s.hub.History(name, r.URL.Query().Get("key"), thread, limit)
+	switch {
+	case errors.Is(err, hub.ErrNoRoom), errors.Is(err, hub.ErrNotFound):
+		http.NotFound(w, r)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		writeJSON(w, http.StatusOK, messages)
+	}
+}
+
+// ######################################################################
+// function: handleAdminRoomMail()
+// ######################################################################
+// GET shows the mailing list of a room, PUT {"address", "frequency",
+// "subscribers"} sets it and DELETE removes it.
+func (s *Server) handleAdminRoomMail(w http.ResponseWriter, r *http.Request, name string) {
+	switch r.Method {
+	case http.MethodGet:
+		list, ok := s.hub.MailList(name)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, http.StatusOK, list)
+
+	case http.MethodPut:
+		var list hub.MailList
+		if err := json.NewDecoder(r.Body).Decode(&list); err != nil {
+			http.Error(w, "bad request body", http.StatusBadRequest)
+			return
+		}
+		if _, err := mail.ParseAddress(list.Address); err != nil {
+			http.Error(w, "invalid list address", http.StatusBadRequest)
+			return
+		}
+		if list.Frequency != "daily" && list.Frequency != "weekly" {
+			http.Error(w, `frequency must be "daily" or "weekly"`, http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, s.hub.SetMailList(name, list))
+
+	case http.MethodDelete:
+		s.hub.RemoveMailList(name)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// ######################################################################
+// function: handleAdminRoomBanner()
+// ######################################################################
+// PUT {"text", "level", "by"} sets the banner, e.g. from incident tooling,
+// DELETE clears it. Members see the change right away.
+func (s *Server) handleAdminRoomBanner(w http.ResponseWriter, r *http.Request, name string) {
+	switch r.Method {
+	case http.MethodPut:
+		var req struct {
+			Text  string `json:"text"`
+			Level string `json:"level"`
+			By    string `json:"by"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Text == "" {
+			http.Error(w, "bad request body", http.StatusBadRequest)
+			return
+		}
+		banner, err := s.hub.SetRoomBanner(name, req.Text, req.Level, req.By)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, banner)
+
+	case http.MethodDelete:
+		s.hub.SetRoomBanner(name, "", "", "")
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// ######################################################################
+// function: handleAdminRoomRetention()
+// ######################################################################
+// PUT {"max_age": "24h", "max_count": 1000, "by": "..."} sets what the room
+// keeps, either limit left out or 0 is none. DELETE goes back to the
+// server's default. Both answer with what applies now.
+func (s *Server) handleAdminRoomRetention(w http.ResponseWriter, r *http.Request, name string) {
+	switch r.Method {
+	case http.MethodPut:
+		var req struct {
+			MaxAge   string `json:"max_age"`
+			MaxCount int    `json:"max_count"`
+			By       string `json:"by"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.MaxCount < 0 {
+			http.Error(w, "bad request body", http.StatusBadRequest)
+			return
+		}
+		rt := hub.Retention{MaxCount: req.MaxCount}
+		if req.MaxAge != "" {
+			d, err := time.ParseDuration(req.MaxAge)
+			if err != nil || d < 0 {
+				http.Error(w, "invalid max_age", http.StatusBadRequest)
+				return
+			}
+			rt.MaxAge = d
+		}
+		if req.By == "" {
+			req.By = "admin"
+		}
+		writeJSON(w, http.StatusOK, retentionJSON(s.hub.SetRoomRetention(name, &rt, req.By)))
+
+	case http.MethodDelete:
+		writeJSON(w, http.StatusOK, retentionJSON(s.hub.SetRoomRetention(name, nil, "admin")))
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Durations as "24h" like they went in, not nanoseconds
+func retentionJSON(rt hub.Retention) map[string]any {
+	out := map[string]any{"max_count": rt.MaxCount, "max_age": ""}
+	if rt.MaxAge > 0 {
+		out["max_age"] = rt.MaxAge.String()
+	}
+	return out
+}
+
+// ######################################################################
+// function: handleAdminRoomInsights()
+// ######################################################################
+// ?period=24h (default 7 days) and ?top=N (default 10).
+func (s *Server) handleAdminRoomInsights(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	period := 7 * 24 * time.Hour
+	if p := r.URL.Query().Get("period"); p != "" {
+		d, err := time.ParseDuration(p)
+		if err != nil || d <= 0 {
+			http.Error(w, "invalid period", http.StatusBadRequest)
+			return
+		}
+		period = d
+	}
+	top := 10
+	if t, err := strconv.Atoi(r.URL.Query().Get("top")); err == nil && t > 0 {
+		top = t
+	}
+
+	insights, ok := s.hub.Insights(name, time.Now().Add(-period), top)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, http.StatusOK, insights)
+}
@@ -0,0 +1,147 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"go-chat-app/internal/hub"
+)
+
+// Browsers get the login token as a cookie, which the WebSocket upgrade
+// carries along by itself. Other clients pass it as ?login= on /ws.
+const loginCookie = "chat_login"
+
+// ######################################################################
+// function: handleRegister()
+// ######################################################################
+// POST {"username": "...", "password": "..."} creates an account owning the
+// name and logs it in, answering {"account": ..., "token": ...}. An
+// "email" is optional, it's mailed a link to check it.
+func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
+	s.handleCredentials(w, r, s.hub.Register, http.StatusCreated)
+}
+
+// ######################################################################
+// function: handleLogin()
+// ######################################################################
+// POST {"username": "...", "password": "..."}, answered like /api/register.
+func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	login := func(name, password, _ string) (hub.Account, string, error) { return s.hub.Login(name, password) }
+	s.handleCredentials(w, r, login, http.StatusOK)
+}
+
+func (s *Server) handleCredentials(w http.ResponseWriter, r *http.Request, check func(name, password, email string) (hub.Account, string, error), status int) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// bcrypt is slow on purpose, guessing passwords should be slower still
+	if !s.authLimiter.allow(s.clientIP(r)) {
+		http.Error(w, "too many attempts, try again later", http.StatusTooManyRequests)
+		return
+	}
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Email    string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad request body", http.StatusBadRequest)
+		return
+	}
+
+	a, token, err := check(strings.TrimSpace(req.Username), req.Password, req.Email)
+	switch {
+	case errors.Is(err, hub.ErrBadLogin):
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	case errors.Is(err, hub.ErrNameTaken), errors.Is(err, hub.ErrReserved), errors.Is(err, hub.ErrGuestName):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, hub.ErrBadName), errors.Is(err, hub.ErrBadPassword), errors.Is(err, hub.ErrBadEmail):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		log.Printf("Error checking credentials: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	s.setLoginCookie(w, r, token)
+	writeJSON(w, status, map[string]any{"account": a, "token": token})
+}
+
+// Lax, not strict, so the cookie survives the redirect back from an OAuth provider
+func (s *Server) setLoginCookie(w http.ResponseWriter, r *http.Request, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  time.Now().Add(s.hub.LoginTTL()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// ######################################################################
+// function: handleLogout()
+// ######################################################################
+// POST forgets the login token. Connections already open stay signed in.
+// POST ?all=1 signs the account out everywhere instead: every login token
+// goes and its connections are closed.
+func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token := loginToken(r)
+	if r.URL.Query().Get("all") != "" {
+		a, ok := s.hub.LoginAccount(token)
+		if !ok {
+			http.Error(w, "not logged in", http.StatusUnauthorized)
+			return
+		}
+		if _, _, err := s.hub.RevokeLogins(a.ID, a.Name); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+	} else if token != "" {
+		s.hub.Logout(token)
+	}
+	http.SetCookie(w, &http.Cookie{Name: loginCookie, Path: "/", MaxAge: -1})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ######################################################################
+// function: loginToken()
+// ######################################################################
+// The login token a request carries, from ?login=, a bearer header or the
+// cookie, in that order.
+func loginToken(r *http.Request) string {
+	if token := r.URL.Query().Get("login"); token != "" {
+		return token
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	if c, err := r.Cookie(loginCookie); err == nil {
+		return c.Value
+	}
+	return ""
+}
+
+// ######################################################################
+// function: botKey()
+// ######################################################################
+// Bots send their API key as "Authorization: Bot <key>", or ?api_key= for
+// WebSocket libraries that can't set headers.
+func botKey(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bot ") {
+		return strings.TrimPrefix(auth, "Bot ")
+	}
+	return r.URL.Query().Get("api_key")
+}
@@ -0,0 +1,229 @@
+package chat
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/bits"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Guests, connections without a login or bot key, can be made to show
+// they aren't a script before they get in: a captcha (hCaptcha or
+// Cloudflare Turnstile), or a proof of work that costs a browser a second
+// or two and a flood of bots a lot more.
+//
+//	GET  /api/challenge -> {"type":"pow","challenge":"...","difficulty":18}
+//	                       {"type":"turnstile","site_key":"..."}
+//	                       {"type":"none"}
+//	POST /api/challenge {"challenge":"...","nonce":"..."} or {"response":"<captcha token>"}
+//	                    -> {"pass":"...","expires":"..."}
+//
+// A proof of work is a nonce that makes sha256(challenge + nonce) start
+// with difficulty zero bits. The pass goes along as ?pass= (Chat-Pass on
+// gRPC) and is good for any number of connections from the same address
+// until it expires. Challenges and passes are signed with a key made at
+// start, so they don't survive a restart and only work on this server.
+
+// Kinds of challenge
+const (
+	ChallengePoW       = "pow"
+	ChallengeHCaptcha  = "hcaptcha"
+	ChallengeTurnstile = "turnstile"
+)
+
+// DefaultPowDifficulty is a second or two in a browser
+const DefaultPowDifficulty = 18
+
+const (
+	challengeTTL = 5 * time.Minute
+	passTTL      = 10 * time.Minute
+	maxNonce     = 64
+)
+
+// Where captcha answers are checked
+var captchaVerifyURLs = map[string]string{
+	ChallengeHCaptcha:  "https://api.hcaptcha.com/siteverify",
+	ChallengeTurnstile: "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+}
+
+var captchaClient = &http.Client{Timeout: 10 * time.Second}
+
+var (
+	errBadChallenge = errors.New("challenge expired or not ours, get a new one")
+	errBadProof     = errors.New("nonce does not solve the challenge")
+	errCaptcha      = errors.New("captcha not solved")
+)
+
+// ######################################################################
+// function: handleChallenge()
+// ######################################################################
+func (s *Server) handleChallenge(w http.ResponseWriter, r *http.Request) {
+	ip := s.clientIP(r)
+	switch r.Method {
+	case http.MethodGet:
+		switch s.cfg.Challenge {
+		case "":
+			writeJSON(w, http.StatusOK, map[string]any{"type": "none"})
+		case ChallengePoW:
+			writeJSON(w, http.StatusOK, map[string]any{"type": ChallengePoW, "challenge": s.newChallenge(ip), "difficulty": s.cfg.PowDifficulty})
+		default:
+			writeJSON(w, http.StatusOK, map[string]any{"type": s.cfg.Challenge, "site_key": s.cfg.ChallengeSiteKey})
+		}
+	case http.MethodPost:
+		if s.cfg.Challenge == "" {
+			http.Error(w, "no challenge to solve", http.StatusNotFound)
+			return
+		}
+		if !s.authLimiter.allow(ip) {
+			http.Error(w, "too many attempts, try again later", http.StatusTooManyRequests)
+			return
+		}
+		var req struct {
+			Challenge string `json:"challenge"`
+			Nonce     string `json:"nonce"`
+			Response  string `json:"response"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 8<<10)).Decode(&req); err != nil {
+			http.Error(w, "bad request body", http.StatusBadRequest)
+			return
+		}
+		var err error
+		if s.cfg.Challenge == ChallengePoW {
+			err = s.checkProof(ip, req.Challenge, req.Nonce)
+		} else {
+			err = s.verifyCaptcha(r.Context(), ip, req.Response)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		expires := time.Now().Add(passTTL)
+		writeJSON(w, http.StatusOK, map[string]any{"pass": s.newPass(ip, expires), "expires": expires.UTC()})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// ######################################################################
+// function: guestAllowed()
+// ######################################################################
+// Whether a connection may go ahead: no challenge is set, it's signed in,
+// or it has a pass for its address.
+func (s *Server) guestAllowed(r *http.Request, ip, accountID string) bool {
+	if s.cfg.Challenge == "" || accountID != "" {
+		return true
+	}
+	pass := r.URL.Query().Get("pass")
+	if pass == "" {
+		pass = r.Header.Get("Chat-Pass")
+	}
+	expiry, mac, ok := strings.Cut(pass, ".")
+	if !ok || !hmac.Equal([]byte(mac), []byte(s.sign("pass", ip, expiry))) {
+		return false
+	}
+	unix, err := strconv.ParseInt(expiry, 10, 64)
+	return err == nil && time.Now().Unix() < unix
+}
+
+func (s *Server) newPass(ip string, expires time.Time) string {
+	expiry := strconv.FormatInt(expires.Unix(), 10)
+	return expiry + "." + s.sign("pass", ip, expiry)
+}
+
+// ######################################################################
+// function: newChallenge()
+// ######################################################################
+// expiry.random.mac, for ip only.
+func (s *Server) newChallenge(ip string) string {
+	expiry := strconv.FormatInt(time.Now().Add(challengeTTL).Unix(), 10)
+	random := randomState()
+	return expiry + "." + random + "." + s.sign("challenge", ip, expiry, random)
+}
+
+// ######################################################################
+// function: checkProof()
+// ######################################################################
+func (s *Server) checkProof(ip, challenge, nonce string) error {
+	parts := strings.Split(challenge, ".")
+	if len(parts) != 3 || !hmac.Equal([]byte(parts[2]), []byte(s.sign("challenge", ip, parts[0], parts[1]))) {
+		return errBadChallenge
+	}
+	if unix, err := strconv.ParseInt(parts[0], 10, 64); err != nil || time.Now().Unix() >= unix {
+		return errBadChallenge
+	}
+	if nonce == "" || len(nonce) > maxNonce || zeroBits(sha256.Sum256([]byte(challenge+nonce))) < s.cfg.PowDifficulty {
+		return errBadProof
+	}
+	return nil
+}
+
+// Leading zero bits of a hash
+func zeroBits(sum [sha256.Size]byte) int {
+	n := 0
+	for _, b := range sum {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return n
+}
+
+// ######################################################################
+// function: verifyCaptcha()
+// ######################################################################
+// hCaptcha and Turnstile answer the same form with the same JSON.
+func (s *Server) verifyCaptcha(ctx context.Context, ip, response string) error {
+	if response == "" {
+		return errCaptcha
+	}
+	form := url.Values{"secret": {s.cfg.ChallengeSecret}, "response": {response}, "remoteip": {ip}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, captchaVerifyURLs[s.cfg.Challenge], strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := captchaClient.Do(req)
+	if err != nil {
+		log.Printf("Error verifying %s: %v", s.cfg.Challenge, err)
+		return fmt.Errorf("%w: could not reach %s", errCaptcha, s.cfg.Challenge)
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Success bool     `json:"success"`
+		Errors  []string `json:"error-codes"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		log.Printf("Error verifying %s: %v", s.cfg.Challenge, err)
+		return errCaptcha
+	}
+	if !result.Success {
+		return fmt.Errorf("%w: %s", errCaptcha, strings.Join(result.Errors, ", "))
+	}
+	return nil
+}
+
+func (s *Server) sign(parts ...string) string {
+	mac := hmac.New(sha256.New, s.challengeKey)
+	mac.Write([]byte(strings.Join(parts, "|")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func newChallengeKey() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err) // crypto/rand never fails on supported platforms
+	}
+	return key
+}
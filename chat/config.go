@@ -0,0 +1,264 @@
+package chat
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/netip"
+	"os"
+	"time"
+
+	"go-chat-app/internal/client"
+	"go-chat-app/internal/hub"
+	"go-chat-app/internal/kafka"
+	"go-chat-app/internal/matrix"
+	"go-chat-app/internal/preview"
+	"go-chat-app/internal/store"
+)
+
+// ######################################################################
+// struct: Config
+// ######################################################################
+// Everything the server can be told. Start from DefaultConfig(), the zero
+// value is not useful.
+type Config struct {
+	ConfigFile    string           // the -config file, read again by Reload
+	Listeners     []ListenerConfig // addresses to serve on, nil = defaultListeners, empty = none
+	Public        fs.FS            // static files for the web client, nil = none
+	DataDir       string           // audit log, and bans and other state unless Store says otherwise
+	AdminToken    string           // bearer token for /admin endpoints, empty disables them
+	BehindProxy   bool             // trust X-Forwarded-For from loopback and private addresses, see TrustedProxies for others
+	MaxConnsPerIP int              // simultaneous connections allowed per IP, 0 = unlimited, unless RateLimits says
+	MaxMessage    int              // bytes in one client frame, transports cut the connection at twice this
+	PublicURL     string           // how browsers reach us, for OAuth redirects, "" = the request's host
+
+	TrustedProxies []netip.Prefix // proxies whose X-Forwarded-For and X-Real-IP are believed, BehindProxy is ignored if set
+
+	AllowedOrigins []string    // pages that may open WebSockets, like "https://chat.example.com", empty = any
+	RateLimits     *RateLimits // nil = the defaults
+
+	OAuth map[string]OAuthApp // "github" and "google" sign in, by provider
+
+	BlockedVersions map[string]bool // client versions refused with an upgrade-required close
+
+	LegacyWait  time.Duration // how long a client has to send its hello before it gets plain text lines, 0 = no fallback
+	LegacyUntil time.Time     // legacy clients are refused from then on, zero = never
+
+	Compression        bool // offer permessage-deflate to clients that ask for it
+	CompressionLevel   int  // flate level, 1 (fastest) to 9 (smallest)
+	CompressionMinSize int  // frames smaller than this many bytes go out uncompressed
+
+	SendBuffer  int    // frames queued for a slow client before SlowClients applies
+	SlowClients string // client.Disconnect, client.DropOldest or client.DropNewest
+
+	FanoutWorkers int // goroutines delivering broadcasts to big rooms, 0 = one per CPU
+
+	WordList   string        // file with banned words, one per line
+	MaxStrikes int           // strikes before a chatter is removed
+	StrikeBan  time.Duration // IP ban handed out on the last strike, 0 = just kick
+
+	Challenge        string // guests must pass ChallengePoW, ChallengeHCaptcha or ChallengeTurnstile to connect, "" = no challenge
+	ChallengeSiteKey string // captcha site key, handed to clients
+	ChallengeSecret  string // captcha secret key, for checking their answers
+	PowDifficulty    int    // leading zero bits a proof of work needs
+
+	Filters []hub.MessageFilter // moderation rules of your own, run on every chat line
+
+	LinkBlocklist []string // domains links in chat lines may not point to, subdomains included
+	LinkAllowlist []string // if set, the only domains links may point to
+	StripLinks    bool     // take such links out instead of refusing the line with a strike
+
+	Spam hub.SpamRules // what counts as spam unless a room says otherwise
+
+	AckSampleRate float64       // fraction of broadcast deliveries that ask for an ack
+	AckTimeout    time.Duration // unacked samples after this count as lost
+
+	SnapshotInterval time.Duration // how often volatile hub state is written to disk
+	SnapshotGrace    time.Duration // how long restored sessions wait for their client
+	ResumeWindow     time.Duration // how long a dropped client can resume its session, 0 = not at all
+	LoginTTL         time.Duration // how long a login stays good, the cookie included
+
+	HistorySize int           // messages kept per room for replies and history queries
+	Retention   hub.Retention // what rooms keep unless they say otherwise, the zero value keeps everything
+
+	SMTPAddr     string // outgoing mail server for room digests and account mail, host:port
+	SMTPUser     string
+	SMTPPassword string
+	Mailer       hub.Mailer // sends the mail instead of SMTPAddr, if set
+	MailFrom     string     // sender of address checks and password resets, "" = noreply@ the PublicURL host
+	MailIngest   string     // address for the SMTP listener taking digest replies, "" = off
+
+	IRCAddr string // address for the IRC gateway, "" = off
+
+	Matrix *matrix.Config // appservice bridge to Matrix rooms, nil = off
+	Kafka  *kafka.Config  // event export to a Kafka topic, nil = off
+
+	LinkPreviews *preview.Config // OpenGraph cards for links in chat lines, nil = off
+
+	OTLPEndpoint string // OpenTelemetry collector for traces and metrics, http://host:4318, "" = off
+
+	MOTDFile string // message of the day, "" = built in welcome text
+
+	HeartbeatTimeout time.Duration // no app heartbeat for this long = idle
+	AutoAway         time.Duration // no chat lines or commands for this long = away, 0 = never
+
+	UserCountInterval time.Duration // user_count frames go out at most this often
+
+	DuplicateWindow time.Duration // the same text again in the same room within this is refused, 0 = allowed
+	RenameCooldown  time.Duration // time between renames of a connection, the first one is free
+
+	MaxEmbedsPerIP int // open read-only embed streams per IP
+
+	BandwidthCap        int64 // payload bytes per user and day, 0 = unlimited
+	BandwidthDisconnect bool  // drop users over the cap instead of throttling them
+
+	Store       store.Store   // where state and room history are kept, nil = JSON files in DataDir
+	StoragePool int           // loads and saves of the store running at once, 0 = unlimited
+	StorageSlow time.Duration // loads and saves taking this long get logged, 0 = never
+}
+
+// ######################################################################
+// struct: OAuthApp
+// ######################################################################
+// The app registered with an OAuth2 provider. Its callback URL is
+// PublicURL + /auth/<provider>/callback.
+type OAuthApp struct {
+	ClientID     string
+	ClientSecret string
+}
+
+// ######################################################################
+// function: DefaultConfig()
+// ######################################################################
+func DefaultConfig() Config {
+	return Config{
+		DataDir:            "data",
+		MaxConnsPerIP:      5,
+		MaxMessage:         64 << 10,
+		LegacyWait:         2 * time.Second,
+		CompressionLevel:   1,
+		CompressionMinSize: 256,
+		SendBuffer:         client.DefaultSendBuffer,
+		SlowClients:        client.Disconnect,
+		MaxStrikes:         3,
+		StrikeBan:          10 * time.Minute,
+		AckSampleRate:      0.01,
+		AckTimeout:         10 * time.Second,
+		SnapshotInterval:   30 * time.Second,
+		SnapshotGrace:      2 * time.Minute,
+		ResumeWindow:       2 * time.Minute,
+		LoginTTL:           hub.LoginTokenTTL,
+		HistorySize:        500,
+		SMTPAddr:           "localhost:25",
+		HeartbeatTimeout:   time.Minute,
+		AutoAway:           10 * time.Minute,
+		UserCountInterval:  time.Second,
+		DuplicateWindow:    30 * time.Second,
+		RenameCooldown:     5 * time.Minute,
+		MaxEmbedsPerIP:     10,
+		StoragePool:        4,
+		StorageSlow:        100 * time.Millisecond,
+		PowDifficulty:      DefaultPowDifficulty,
+		Spam:               hub.SpamRules{Repeats: 3, Window: time.Minute, CapsPercent: 80, Mentions: 5},
+	}
+}
+
+func (cfg Config) hubConfig() hub.Config {
+	var previews *preview.Fetcher
+	if cfg.LinkPreviews != nil {
+		previews = preview.New(*cfg.LinkPreviews)
+	}
+	return hub.Config{
+		DataDir:             cfg.DataDir,
+		AdminToken:          cfg.AdminToken,
+		MaxConnsPerIP:       cfg.RateLimits.maxConnsPerIP(cfg.MaxConnsPerIP),
+		MaxMessageSize:      cfg.MaxMessage,
+		SendBuffer:          cfg.SendBuffer,
+		SlowClients:         cfg.SlowClients,
+		FanoutWorkers:       cfg.FanoutWorkers,
+		WordList:            cfg.WordList,
+		Filters:             cfg.Filters,
+		MaxStrikes:          cfg.MaxStrikes,
+		StrikeBan:           cfg.StrikeBan,
+		AckSampleRate:       cfg.AckSampleRate,
+		AckTimeout:          cfg.AckTimeout,
+		SnapshotInterval:    cfg.SnapshotInterval,
+		SnapshotGrace:       cfg.SnapshotGrace,
+		ResumeWindow:        cfg.ResumeWindow,
+		LoginTTL:            cfg.LoginTTL,
+		HistorySize:         cfg.HistorySize,
+		Retention:           cfg.Retention,
+		SMTPAddr:            cfg.SMTPAddr,
+		SMTPUser:            cfg.SMTPUser,
+		SMTPPassword:        cfg.SMTPPassword,
+		Mailer:              cfg.Mailer,
+		MailFrom:            cfg.MailFrom,
+		PublicURL:           cfg.PublicURL,
+		MailIngest:          cfg.MailIngest,
+		MOTDFile:            cfg.MOTDFile,
+		HeartbeatTimeout:    cfg.HeartbeatTimeout,
+		AutoAway:            cfg.AutoAway,
+		UserCountInterval:   cfg.UserCountInterval,
+		DuplicateWindow:     cfg.DuplicateWindow,
+		RenameCooldown:      cfg.RenameCooldown,
+		BandwidthCap:        cfg.BandwidthCap,
+		BandwidthDisconnect: cfg.BandwidthDisconnect,
+		Store:               cfg.Store,
+		StoragePool:         cfg.StoragePool,
+		StorageSlow:         cfg.StorageSlow,
+		Previews:            previews,
+		LinkBlocklist:       cfg.LinkBlocklist,
+		LinkAllowlist:       cfg.LinkAllowlist,
+		StripLinks:          cfg.StripLinks,
+		Spam:                cfg.Spam,
+	}
+}
+
+// ######################################################################
+// struct: FileConfig
+// ######################################################################
+// Settings that only make sense in the -config file. The origins and
+// rate limits can change with a reload, the rest needs a restart.
+type FileConfig struct {
+	Listeners []ListenerConfig `json:"listeners"`
+	Matrix    *matrix.Config   `json:"matrix"`
+	Kafka     *kafka.Config    `json:"kafka"`
+
+	LinkPreviews *preview.Config `json:"link_previews"`
+
+	AllowedOrigins []string    `json:"allowed_origins"`
+	RateLimits     *RateLimits `json:"rate_limits"`
+}
+
+// ######################################################################
+// function: LoadFileConfig()
+// ######################################################################
+func LoadFileConfig(path string) (FileConfig, error) {
+	var fc FileConfig
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fc, err
+		}
+		if err := json.Unmarshal(data, &fc); err != nil {
+			return fc, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if len(fc.Listeners) == 0 {
+		fc.Listeners = defaultListeners
+	}
+	if fc.Matrix != nil {
+		if err := fc.Matrix.Validate(); err != nil {
+			return fc, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if fc.Kafka != nil {
+		if err := fc.Kafka.Validate(); err != nil {
+			return fc, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if err := fc.RateLimits.validate(); err != nil {
+		return fc, fmt.Errorf("%s: %w", path, err)
+	}
+	return fc, validateListeners(fc.Listeners)
+}
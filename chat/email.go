@@ -0,0 +1,144 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+
+	"go-chat-app/internal/hub"
+)
+
+// The links in account mail land here: /api/email/verify checks the
+// address, /api/password/reset is a small form for the new password that
+// posts back to itself. Apps can post JSON to it instead and get logged in
+// like /api/login.
+
+var resetPage = template.Must(template.New("reset").Parse(`<!DOCTYPE html>
+<html>
+<head>
+    <meta charset="utf-8">
+    <title>New password - kihle's tempChat</title>
+    <style>
+        body { font: 14px sans-serif; margin: 2em auto; max-width: 20em; }
+        input { display: block; width: 100%; margin-bottom: 8px; }
+    </style>
+</head>
+<body>
+    <form method="post" action="/api/password/reset">
+        <input type="hidden" name="token" value="{{.}}">
+        <label for="password">New password, 8 to 72 characters</label>
+        <input type="password" id="password" name="password" minlength="8" maxlength="72" required autofocus>
+        <input type="submit" value="Set password">
+    </form>
+</body>
+</html>
+`))
+
+// ######################################################################
+// function: handleVerifyEmail()
+// ######################################################################
+// GET ?token=... from the address check mail.
+func (s *Server) handleVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	a, err := s.hub.VerifyEmail(r.URL.Query().Get("token"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "Thanks, %s is confirmed for %s.\n", a.Email, a.Name)
+}
+
+// ######################################################################
+// function: handleForgotPassword()
+// ######################################################################
+// POST {"login": "<username or email>"} mails a reset link if there is an
+// account to send one to. The answer is 202 either way.
+func (s *Server) handleForgotPassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// every one of these can be a mail, nobody gets to flood an inbox
+	if !s.authLimiter.allow(s.clientIP(r)) {
+		http.Error(w, "too many attempts, try again later", http.StatusTooManyRequests)
+		return
+	}
+	var req struct {
+		Login string `json:"login"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 8<<10)).Decode(&req); err != nil || req.Login == "" {
+		http.Error(w, "bad request body", http.StatusBadRequest)
+		return
+	}
+	if err := s.hub.RequestPasswordReset(req.Login); errors.Is(err, hub.ErrNoMailer) {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// ######################################################################
+// function: handleResetPassword()
+// ######################################################################
+// GET ?token=... shows the form, POST sets the password: the form's
+// fields, or {"token": "...", "password": "..."} answered like /api/login.
+// Either way every other login of the account is signed out.
+func (s *Server) handleResetPassword(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := resetPage.Execute(w, r.URL.Query().Get("token")); err != nil {
+			log.Printf("Error rendering password reset: %v", err)
+		}
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authLimiter.allow(s.clientIP(r)) {
+		http.Error(w, "too many attempts, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	isJSON := strings.HasPrefix(r.Header.Get("Content-Type"), "application/json")
+	var req struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 8<<10)
+	if isJSON {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad request body", http.StatusBadRequest)
+			return
+		}
+	} else {
+		req.Token, req.Password = r.PostFormValue("token"), r.PostFormValue("password")
+	}
+
+	a, token, err := s.hub.ResetPassword(req.Token, req.Password)
+	switch {
+	case errors.Is(err, hub.ErrMailToken), errors.Is(err, hub.ErrBadPassword):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		log.Printf("Error resetting password: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	s.setLoginCookie(w, r, token)
+	if isJSON {
+		writeJSON(w, http.StatusOK, map[string]any{"account": a, "token": token})
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "Your password is changed, %s. You are logged in on this browser and out everywhere else.\n", a.Name)
+}
@@ -0,0 +1,159 @@
+package chat
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"go-chat-app/internal/protocol"
+)
+
+var embedPage = template.Must(template.New("embed").Parse(`<!DOCTYPE html>
+<html>
+<head>
+    <meta charset="utf-8">
+    <title>#{{.}} - kihle's tempChat</title>
+    <style>
+        body { font: 14px sans-serif; margin: 0; padding: 8px; }
+        #topic { color: #0aa; margin-bottom: 6px; }
+        .from { font-weight: bold; }
+    </style>
+</head>
+<body>
+    <div id="topic"></div>
+    <div id="messages"></div>
+    <script>
+        let messages = document.querySelector("#messages");
+        let events = new EventSource("/embed/{{.}}/events");
+        events.onmessage = function(event) {
+            let frame = JSON.parse(event.data);
+            if (frame.type === "message") {
+                let line = document.createElement("div");
+                let from = document.createElement("span");
+                from.className = "from";
+                from.textContent = frame.from + ": ";
+                line.appendChild(from);
+                line.appendChild(document.createTextNode(frame.text));
+                line.dataset.id = frame.id;
+                messages.appendChild(line);
+                window.scrollTo(0, document.body.scrollHeight);
+            } else if (frame.type === "deleted") {
+                for (let el of document.querySelectorAll('[data-id="' + frame.id + '"]')) {
+                    el.remove();
+                }
+            } else if (frame.type === "topic_changed") {
+                document.querySelector("#topic").textContent = frame.text;
+            }
+        };
+    </script>
+</body>
+</html>
+`))
+
+// ######################################################################
+// function: handleEmbed()
+// ######################################################################
+// GET /embed/<room> is a read-only live view of a public room meant for
+// iframes, GET /embed/<room>/events is the SSE stream behind it.
+func (s *Server) handleEmbed(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ip := s.clientIP(r)
+	if !s.embedLimiter.allow(ip) {
+		http.Error(w, "slow down", http.StatusTooManyRequests)
+		return
+	}
+	name, sub, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/embed/"), "/"), "/")
+	name = strings.ToLower(name)
+
+	if !s.hub.PublicRoom(name) {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Meant to be framed by other sites
+	w.Header().Set("Content-Security-Policy", "frame-ancestors *")
+	switch sub {
+	case "":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := embedPage.Execute(w, name); err != nil {
+			log.Printf("Error rendering embed: %v", err)
+		}
+	case "events":
+		s.streamEmbed(w, r, name, ip)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// ######################################################################
+// function: streamEmbed()
+// ######################################################################
+// Sends the recent history and topic, then follows the room until the
+// viewer goes away.
+func (s *Server) streamEmbed(w http.ResponseWriter, r *http.Request, name, ip string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	s.embedMutex.Lock()
+	if s.embedStreams[ip] >= s.cfg.MaxEmbedsPerIP {
+		s.embedMutex.Unlock()
+		http.Error(w, "too many open embeds", http.StatusTooManyRequests)
+		return
+	}
+	s.embedStreams[ip]++
+	s.embedMutex.Unlock()
+	defer func() {
+		s.embedMutex.Lock()
+		if s.embedStreams[ip]--; s.embedStreams[ip] <= 0 {
+			delete(s.embedStreams, ip)
+		}
+		s.embedMutex.Unlock()
+	}()
+
+	frames, backlog, stop, ok := s.hub.Watch(name, 50)
+	if !ok {
+		http.NotFound(w, r) // locked or gone since the check
+		return
+	}
+	defer stop()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	for _, f := range backlog {
+		writeEvent(w, f)
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(25 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case f := <-frames:
+			writeEvent(w, f)
+			flusher.Flush()
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, f protocol.Frame) {
+	f.Ack, f.Reactions = false, nil
+	data, err := json.Marshal(protocol.Stamp(f))
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "data: %s\n\n", data)
+}
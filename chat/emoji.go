@@ -0,0 +1,82 @@
+package chat
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"go-chat-app/internal/hub"
+)
+
+// Custom emoji: GET /emoji/<name> is the image, for anyone. Admins manage
+// them under /admin/emoji.
+
+// Uploads are cut off past this, the hub has the real (smaller) limit
+const maxEmojiUpload = 1 << 20
+
+// ######################################################################
+// function: handleEmoji()
+// ######################################################################
+// Images change under the same name only with a new ?v= in the catalog,
+// so they can be cached for long.
+func (s *Server) handleEmoji(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	e, ok := s.hub.Emoji(strings.TrimPrefix(r.URL.Path, "/emoji/"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", e.ContentType)
+	w.Header().Set("ETag", `"`+e.Hash+`"`)
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, "", e.Added, bytes.NewReader(e.Image))
+}
+
+// ######################################################################
+// function: handleAdminEmoji()
+// ######################################################################
+// GET /admin/emoji lists the catalog, PUT /admin/emoji/<name> with the
+// image as the body adds or replaces one and DELETE /admin/emoji/<name>
+// removes it.
+func (s *Server) handleAdminEmoji(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/emoji"), "/")
+	switch {
+	case name == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, s.hub.EmojiCatalog())
+
+	case name != "" && (r.Method == http.MethodPut || r.Method == http.MethodPost):
+		image, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxEmojiUpload))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "image too large", http.StatusRequestEntityTooLarge)
+			return
+		} else if err != nil {
+			http.Error(w, "bad request body", http.StatusBadRequest)
+			return
+		}
+		e, err := s.hub.AddEmoji(name, image)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.hub.Audit(hub.AuditEntry{Actor: "admin", Action: "add_emoji", Target: name, IP: s.clientIP(r)})
+		writeJSON(w, http.StatusCreated, e)
+
+	case name != "" && r.Method == http.MethodDelete:
+		if !s.hub.RemoveEmoji(name) {
+			http.NotFound(w, r)
+			return
+		}
+		s.hub.Audit(hub.AuditEntry{Actor: "admin", Action: "remove_emoji", Target: name, IP: s.clientIP(r)})
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "not found or method not allowed", http.StatusNotFound)
+	}
+}
@@ -0,0 +1,266 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go-chat-app/internal/client"
+	"go-chat-app/internal/hub"
+	"go-chat-app/internal/i18n"
+	"go-chat-app/internal/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+var errStreamClosed = errors.New("event stream closed")
+
+// ######################################################################
+// function: handleEvents()
+// ######################################################################
+// For clients behind proxies that kill WebSockets. GET /events is a
+// Server-Sent Events stream of the frames a WebSocket client would get, and
+// takes the same ?room=, ?sid=, ?key= and ?last= (or Last-Event-ID). Its
+// first event is "stream" with an ID, and POST /events?stream=<id> sends
+// what a WebSocket client would write: a JSON client frame or plain text.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.streamEvents(w, r)
+	case http.MethodPost:
+		s.postEvent(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// ######################################################################
+// function: streamEvents()
+// ######################################################################
+func (s *Server) streamEvents(w http.ResponseWriter, r *http.Request) {
+	if _, ok := w.(http.Flusher); !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	ip := s.clientIP(r)
+	if until, banned := s.hub.IsBanned(ip); banned {
+		http.Error(w, "banned until "+until.Format(time.RFC3339), http.StatusForbidden)
+		return
+	}
+	if !s.hub.AcquireIP(ip) {
+		http.Error(w, "too many connections from your address", http.StatusTooManyRequests)
+		return
+	}
+	defer s.hub.ReleaseIP(ip)
+
+	// Same sign in as the WebSocket, EventSource can only use the cookie or ?login=
+	var account hub.Account
+	if key := botKey(r); key != "" {
+		var ok bool
+		if account, ok = s.hub.BotAccount(key); !ok {
+			http.Error(w, "invalid api key", http.StatusUnauthorized)
+			return
+		}
+	} else if token := loginToken(r); token != "" {
+		var ok bool
+		if account, ok = s.hub.LoginAccount(token); !ok {
+			http.Error(w, "login expired", http.StatusUnauthorized)
+			return
+		}
+	}
+	if !s.guestAllowed(r, ip, account.ID) {
+		http.Error(w, "solve the challenge at /api/challenge first", http.StatusPreconditionRequired)
+		return
+	}
+
+	query := r.URL.Query()
+	subprotocol := query.Get("protocol")
+	if subprotocol != "" && subprotocol != protocol.SubprotocolV1 && subprotocol != protocol.SubprotocolV2 {
+		http.Error(w, "event streams are JSON, chat.v1 or chat.v2", http.StatusBadRequest)
+		return
+	}
+	clientVersion := query.Get("v")
+	if s.cfg.BlockedVersions[clientVersion] {
+		http.Error(w, "client version "+clientVersion+" is no longer supported, please upgrade", http.StatusUpgradeRequired)
+		return
+	}
+
+	stream := newEventConn(w, subprotocol)
+	id := randomState()
+	s.eventMutex.Lock()
+	s.eventStreams[id] = stream
+	s.eventMutex.Unlock()
+	defer func() {
+		s.eventMutex.Lock()
+		delete(s.eventStreams, id)
+		s.eventMutex.Unlock()
+		stream.finish()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // nginx would hold the events back
+	if err := stream.event("stream", id); err != nil {
+		return
+	}
+	stop := context.AfterFunc(r.Context(), func() { stream.Close() })
+	defer stop()
+	go stream.keepalive()
+
+	lastID, _ := strconv.ParseInt(query.Get("last"), 10, 64)
+	if resumed, err := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64); err == nil {
+		lastID = max(lastID, resumed)
+	}
+	locale := i18n.Negotiate(query.Get("lang"), r.Header.Get("Accept-Language"))
+	c := client.New(stream, ip, r.UserAgent(), clientVersion, locale)
+	s.hub.Serve(c, query.Get("sid"), query.Get("room"), query.Get("key"), account, lastID)
+}
+
+// ######################################################################
+// function: postEvent()
+// ######################################################################
+func (s *Server) postEvent(w http.ResponseWriter, r *http.Request) {
+	s.eventMutex.Lock()
+	stream := s.eventStreams[r.URL.Query().Get("stream")]
+	s.eventMutex.Unlock()
+	if stream == nil {
+		http.Error(w, "no such stream", http.StatusNotFound)
+		return
+	}
+	// the same limit as a WebSocket frame
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, readLimit(s.cfg.MaxMessage)))
+	if err != nil {
+		http.Error(w, "too big", http.StatusRequestEntityTooLarge)
+		return
+	}
+	select {
+	case stream.in <- data:
+		w.WriteHeader(http.StatusAccepted)
+	case <-stream.done:
+		http.Error(w, "stream closed", http.StatusGone)
+	case <-r.Context().Done():
+	}
+}
+
+// ######################################################################
+// struct: eventConn
+// ######################################################################
+// Turns an SSE response plus the POSTs that go with it into something the
+// hub can serve like a WebSocket.
+type eventConn struct {
+	w           http.ResponseWriter
+	rc          *http.ResponseController
+	subprotocol string
+
+	in        chan []byte   // POSTed frames for the hub
+	done      chan struct{} // the stream has gone
+	closeOnce sync.Once
+
+	writeMu  sync.Mutex
+	finished bool // the handler returned, w must not be touched
+}
+
+func newEventConn(w http.ResponseWriter, subprotocol string) *eventConn {
+	return &eventConn{
+		w:           w,
+		rc:          http.NewResponseController(w),
+		subprotocol: subprotocol,
+		in:          make(chan []byte, 16),
+		done:        make(chan struct{}),
+	}
+}
+
+// event writes one named SSE event
+func (c *eventConn) event(name, data string) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.finished {
+		return errStreamClosed
+	}
+	fmt.Fprintf(c.w, "event: %s\ndata: %s\n\n", name, data)
+	return c.rc.Flush()
+}
+
+// keepalive stops proxies from timing out a quiet stream
+func (c *eventConn) keepalive() {
+	ticker := time.NewTicker(25 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			c.writeMu.Lock()
+			if !c.finished {
+				fmt.Fprint(c.w, ": keepalive\n\n")
+				c.rc.Flush()
+			}
+			c.writeMu.Unlock()
+		}
+	}
+}
+
+// finish is called as the handler returns, nothing gets written after it
+func (c *eventConn) finish() {
+	c.Close()
+	c.writeMu.Lock()
+	c.finished = true
+	c.writeMu.Unlock()
+}
+
+func (c *eventConn) ReadMessage() (int, []byte, error) {
+	select {
+	case data := <-c.in:
+		return websocket.TextMessage, data, nil
+	case <-c.done:
+		return 0, nil, errStreamClosed
+	}
+}
+
+// WriteMessage sends the frame as an SSE message, chat lines with their ID
+// so a reconnecting EventSource picks up where it left off.
+func (c *eventConn) WriteMessage(messageType int, data []byte) error {
+	var f struct {
+		Type string `json:"type"`
+		ID   int64  `json:"id"`
+	}
+	if err := json.Unmarshal(data, &f); err != nil {
+		log.Printf("Error reading frame for event stream: %v", err)
+		return nil
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.finished {
+		return errStreamClosed
+	}
+	if f.Type == protocol.FrameMessage && f.ID != 0 {
+		fmt.Fprintf(c.w, "id: %d\n", f.ID)
+	}
+	fmt.Fprintf(c.w, "data: %s\n\n", data)
+	return c.rc.Flush()
+}
+
+func (c *eventConn) SetWriteDeadline(t time.Time) error {
+	if err := c.rc.SetWriteDeadline(t); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	return nil
+}
+
+func (c *eventConn) EnableWriteCompression(bool) {}
+
+func (c *eventConn) SetCompressionLevel(int) error { return nil }
+
+func (c *eventConn) Subprotocol() string { return c.subprotocol }
+
+func (c *eventConn) Close() error {
+	c.closeOnce.Do(func() { close(c.done) })
+	return nil
+}
@@ -0,0 +1,113 @@
+package chat
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go-chat-app/internal/hub"
+	"go-chat-app/internal/protocol"
+)
+
+// Room transcripts as downloads: GET /api/export?token=... for the links
+// /export hands out, GET /admin/rooms/<name>/export?format=&from=&to= for
+// admins.
+
+// ######################################################################
+// function: handleExport()
+// ######################################################################
+func (s *Server) handleExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	room, format, messages, err := s.hub.ExportTranscript(r.URL.Query().Get("token"))
+	switch {
+	case errors.Is(err, hub.ErrExportToken):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, hub.ErrNoRoom):
+		http.NotFound(w, r)
+	case err != nil:
+		log.Printf("Error exporting #%s: %v", room, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+	default:
+		writeTranscript(w, room, format, messages)
+	}
+}
+
+// ######################################################################
+// function: handleAdminRoomExport()
+// ######################################################################
+// ?format=json|csv|text (default json), ?from= and ?to= as dates or
+// RFC 3339 times.
+func (s *Server) handleAdminRoomExport(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	format := q.Get("format")
+	switch format {
+	case "":
+		format = hub.TranscriptJSON
+	case hub.TranscriptJSON, hub.TranscriptCSV, hub.TranscriptText:
+	default:
+		http.Error(w, "format is json, csv or text", http.StatusBadRequest)
+		return
+	}
+	from, to, err := hub.ParseTranscriptRange(q.Get("from"), q.Get("to"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	messages, err := s.hub.Transcript(name, from, to)
+	switch {
+	case errors.Is(err, hub.ErrNoRoom):
+		http.NotFound(w, r)
+	case err != nil:
+		log.Printf("Error exporting #%s: %v", name, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+	default:
+		s.hub.Audit(hub.AuditEntry{Actor: "admin", Action: "export", Room: name, IP: s.clientIP(r)})
+		writeTranscript(w, name, format, messages)
+	}
+}
+
+// ######################################################################
+// function: writeTranscript()
+// ######################################################################
+func writeTranscript(w http.ResponseWriter, room, format string, messages []protocol.Frame) {
+	ext := map[string]string{hub.TranscriptJSON: "json", hub.TranscriptCSV: "csv", hub.TranscriptText: "txt"}[format]
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-transcript.%s"`, room, ext))
+	switch format {
+	case hub.TranscriptJSON:
+		if messages == nil {
+			messages = []protocol.Frame{}
+		}
+		writeJSON(w, http.StatusOK, messages)
+
+	case hub.TranscriptCSV:
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"id", "time", "from", "text", "reply_to"})
+		for _, f := range messages {
+			replyTo := ""
+			if f.ReplyTo != 0 {
+				replyTo = strconv.FormatInt(f.ReplyTo, 10)
+			}
+			cw.Write([]string{strconv.FormatInt(f.ID, 10), f.SentAt.UTC().Format(time.RFC3339), f.From, f.Text, replyTo})
+		}
+		cw.Flush()
+
+	default:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "Transcript of #%s, %d messages\n\n", room, len(messages))
+		for _, f := range messages {
+			fmt.Fprintf(w, "[%s] <%s> %s\n", f.SentAt.UTC().Format(time.DateTime), f.From, f.Text)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package chat
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go-chat-app/internal/client"
+	"go-chat-app/internal/hub"
+	"go-chat-app/internal/i18n"
+	"go-chat-app/internal/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+// The one RPC, rpc Connect(stream ClientFrame) returns (stream Frame) of
+// service Chat in frame.proto
+const grpcConnect = "/chat.Chat/Connect"
+
+// gRPC status codes we answer with
+const (
+	grpcOK                = 0
+	grpcInvalidArgument   = 3
+	grpcPermissionDenied  = 7
+	grpcResourceExhausted = 8
+	grpcUnimplemented     = 12
+	grpcUnauthenticated   = 16
+)
+
+var errGRPCCompressed = errors.New("compressed grpc messages are not supported")
+
+// ######################################################################
+// function: handleGRPC()
+// ######################################################################
+// The chat as a gRPC bidirectional stream for native clients and services,
+// served on the same listeners over HTTP/2 (h2c without TLS). The client
+// sends ClientFrames and gets the same Frames a chat.proto WebSocket gets.
+// Where a WebSocket client uses the query string, a gRPC client sends
+// metadata: chat-room, chat-sid, chat-key, chat-last and chat-lang, and
+// authorization "Bearer <login token>" or "Bot <api key>".
+func (s *Server) handleGRPC(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor != 2 || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "gRPC needs HTTP/2 and application/grpc", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	if r.URL.Path != grpcConnect {
+		grpcStatus(w, grpcUnimplemented, "unknown method "+r.URL.Path)
+		return
+	}
+
+	ip := s.clientIP(r)
+	if until, banned := s.hub.IsBanned(ip); banned {
+		grpcStatus(w, grpcPermissionDenied, "banned until "+until.Format(time.RFC3339))
+		return
+	}
+	if !s.hub.AcquireIP(ip) {
+		grpcStatus(w, grpcResourceExhausted, "too many connections from your address")
+		return
+	}
+	defer s.hub.ReleaseIP(ip)
+
+	var account hub.Account
+	if key := botKey(r); key != "" {
+		var ok bool
+		if account, ok = s.hub.BotAccount(key); !ok {
+			grpcStatus(w, grpcUnauthenticated, "invalid api key")
+			return
+		}
+	} else if token := loginToken(r); token != "" {
+		var ok bool
+		if account, ok = s.hub.LoginAccount(token); !ok {
+			grpcStatus(w, grpcUnauthenticated, "login expired")
+			return
+		}
+	}
+	if !s.guestAllowed(r, ip, account.ID) {
+		grpcStatus(w, grpcPermissionDenied, "solve the challenge at /api/challenge first")
+		return
+	}
+
+	// Trailers have to be announced before the first write
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+	stream := newGRPCConn(w, r.Body, readLimit(s.cfg.MaxMessage))
+	go stream.readLoop()
+	stop := context.AfterFunc(r.Context(), func() { stream.Close() })
+	defer stop()
+
+	lastID, _ := strconv.ParseInt(r.Header.Get("Chat-Last"), 10, 64)
+	locale := i18n.Negotiate(r.Header.Get("Chat-Lang"), r.Header.Get("Accept-Language"))
+	c := client.New(stream, ip, r.UserAgent(), "", locale)
+	s.hub.Serve(c, r.Header.Get("Chat-Sid"), r.Header.Get("Chat-Room"), r.Header.Get("Chat-Key"), account, lastID)
+
+	stream.finish()
+	if err := stream.failed; err != nil && !errors.Is(err, io.EOF) {
+		w.Header().Set("Grpc-Status", strconv.Itoa(grpcInvalidArgument))
+		w.Header().Set("Grpc-Message", err.Error())
+		return
+	}
+	w.Header().Set("Grpc-Status", strconv.Itoa(grpcOK))
+}
+
+// A reply without messages, the status goes in the headers
+func grpcStatus(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	w.Header().Set("Grpc-Message", msg)
+	w.WriteHeader(http.StatusOK)
+}
+
+// ######################################################################
+// struct: grpcConn
+// ######################################################################
+// One Connect call made to look like a chat.proto WebSocket for the hub.
+type grpcConn struct {
+	w     http.ResponseWriter
+	rc    *http.ResponseController
+	body  io.Reader
+	limit int64 // biggest message the client may send, the same as a WebSocket frame
+
+	in        chan []byte   // ClientFrames for the hub
+	done      chan struct{} // the call is over
+	closeOnce sync.Once
+	err       error // why the client side ended, once in is closed
+	failed    error // err as seen by the hub's reader
+
+	writeMu  sync.Mutex
+	finished bool // the handler returned, w must not be touched
+}
+
+func newGRPCConn(w http.ResponseWriter, body io.Reader, limit int64) *grpcConn {
+	return &grpcConn{
+		w:     w,
+		rc:    http.NewResponseController(w),
+		body:  body,
+		limit: limit,
+		in:    make(chan []byte, 16),
+		done:  make(chan struct{}),
+	}
+}
+
+// readLoop unwraps the length prefixed messages the client streams
+func (c *grpcConn) readLoop() {
+	defer close(c.in)
+	var header [5]byte
+	for {
+		if _, err := io.ReadFull(c.body, header[:]); err != nil {
+			c.err = err
+			return
+		}
+		if header[0] != 0 {
+			c.err = errGRPCCompressed
+			return
+		}
+		size := binary.BigEndian.Uint32(header[1:])
+		if int64(size) > c.limit {
+			c.err = errors.New("message too big")
+			return
+		}
+		msg := make([]byte, size)
+		if _, err := io.ReadFull(c.body, msg); err != nil {
+			c.err = err
+			return
+		}
+		select {
+		case c.in <- msg:
+		case <-c.done:
+			c.err = io.EOF
+			return
+		}
+	}
+}
+
+// finish is called as the handler returns, nothing gets written after it
+func (c *grpcConn) finish() {
+	c.Close()
+	c.writeMu.Lock()
+	c.finished = true
+	c.writeMu.Unlock()
+}
+
+func (c *grpcConn) ReadMessage() (int, []byte, error) {
+	select {
+	case msg, ok := <-c.in:
+		if !ok && c.err == io.EOF {
+			// the client is done sending but still listening, until it
+			// cancels the call
+			<-c.done
+			return 0, nil, io.EOF
+		}
+		if !ok {
+			c.failed = c.err
+			return 0, nil, c.err
+		}
+		return websocket.BinaryMessage, msg, nil
+	case <-c.done:
+		return 0, nil, io.EOF
+	}
+}
+
+func (c *grpcConn) WriteMessage(messageType int, data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.finished {
+		return errStreamClosed
+	}
+	var header [5]byte
+	binary.BigEndian.PutUint32(header[1:], uint32(len(data)))
+	if _, err := c.w.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := c.w.Write(data); err != nil {
+		return err
+	}
+	return c.rc.Flush()
+}
+
+func (c *grpcConn) SetWriteDeadline(t time.Time) error {
+	if err := c.rc.SetWriteDeadline(t); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	return nil
+}
+
+func (c *grpcConn) EnableWriteCompression(bool) {}
+
+func (c *grpcConn) SetCompressionLevel(int) error { return nil }
+
+func (c *grpcConn) Subprotocol() string { return protocol.SubprotocolProto }
+
+func (c *grpcConn) Close() error {
+	c.closeOnce.Do(func() { close(c.done) })
+	return nil
+}
@@ -0,0 +1,44 @@
+package chat
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+const healthTimeout = 2 * time.Second
+
+// ######################################################################
+// function: handleHealthz()
+// ######################################################################
+// Liveness: 200 as long as the hub is not deadlocked.
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), healthTimeout)
+	defer cancel()
+	if err := s.hub.Alive(ctx); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// ######################################################################
+// function: handleReadyz()
+// ######################################################################
+// Readiness: 503 until Run has started the hub, while shutting down and
+// whenever a backend check fails, with every check's result in the body.
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), healthTimeout)
+	defer cancel()
+
+	status, code := "ok", http.StatusOK
+	checks := make(map[string]string)
+	for name, err := range s.hub.Ready(ctx) {
+		checks[name] = "ok"
+		if err != nil {
+			checks[name] = err.Error()
+			status, code = "unavailable", http.StatusServiceUnavailable
+		}
+	}
+	writeJSON(w, code, map[string]any{"status": status, "checks": checks})
+}
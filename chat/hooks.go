@@ -0,0 +1,56 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"go-chat-app/internal/hub"
+)
+
+// Biggest body an incoming hook takes
+const maxHookBody = 64 << 10
+
+// ######################################################################
+// function: handleHook()
+// ######################################################################
+// POST /hooks/<token> with {"text": "...", "username": "..."} posts into
+// the hook's room. Slack style form posts with a payload field work too, so
+// tools that already speak to Slack only need the URL changed.
+func (s *Server) handleHook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token := strings.TrimPrefix(r.URL.Path, "/hooks/")
+	if token == "" || !s.hookLimiter.allow(token) {
+		http.Error(w, "slow down", http.StatusTooManyRequests)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxHookBody)
+
+	var req struct {
+		Text     string `json:"text"`
+		Username string `json:"username"`
+	}
+	var err error
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		err = json.Unmarshal([]byte(r.FormValue("payload")), &req)
+	} else {
+		err = json.NewDecoder(r.Body).Decode(&req)
+	}
+	if err != nil {
+		http.Error(w, "bad request body", http.StatusBadRequest)
+		return
+	}
+
+	switch err := s.hub.PostIncoming(token, req.Username, req.Text); {
+	case errors.Is(err, hub.ErrNoHook):
+		http.NotFound(w, r)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		w.Write([]byte("ok"))
+	}
+}
@@ -0,0 +1,714 @@
+package chat
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"go-chat-app/internal/client"
+	"go-chat-app/internal/hub"
+	"go-chat-app/internal/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+// The IRC gateway lets irssi, weechat and friends in. Every IRC connection
+// is an ordinary chatter speaking chat.v2 JSON, ircConn translates in both
+// directions. Chatters are in one room at a time, so an IRC user is on one
+// channel at a time too: JOIN moves them, PART takes them back to the lobby.
+const (
+	ircServerName = "tempchat"
+	ircIdle       = 3 * time.Minute // without a line from the client we PING, then give up
+	ircMaxLine    = 8192            // IRCv3 tags can make lines longer than 512
+	ircMaxText    = 400             // bytes of text per PRIVMSG, the rest of 512 is prefix
+)
+
+// Numerics we send
+const (
+	rplWelcome        = "001"
+	rplYourHost       = "002"
+	rplCreated        = "003"
+	rplMyInfo         = "004"
+	rplISupport       = "005"
+	rplUnAway         = "305"
+	rplNowAway        = "306"
+	rplEndOfWho       = "315"
+	rplListStart      = "321"
+	rplList           = "322"
+	rplListEnd        = "323"
+	rplChannelModeIs  = "324"
+	rplNoTopic        = "331"
+	rplTopic          = "332"
+	rplNamReply       = "353"
+	rplEndOfNames     = "366"
+	rplMOTD           = "372"
+	rplMOTDStart      = "375"
+	rplEndOfMOTD      = "376"
+	errNoSuchChannel  = "403"
+	errCannotSendTo   = "404"
+	errUnknownCommand = "421"
+	errNoNickGiven    = "431"
+	errNicknameInUse  = "433"
+	errNotRegistered  = "451"
+	errNeedMoreParams = "461"
+	errAlreadyReg     = "462"
+	errPasswdMismatch = "464"
+)
+
+// names from outside (hooks, mail) can have spaces, IRC nicks can't, and
+// a line break would end the line and start a command of its own
+var ircNickReplacer = strings.NewReplacer(" ", "_", "!", "_", "@", "_", ",", "_", "\r", "_", "\n", "_")
+
+// Same for text that has to stay on one line, like a topic.
+// Longer text goes through ircChunks instead.
+var ircLineReplacer = strings.NewReplacer("\r", "", "\n", " ")
+
+// ######################################################################
+// function: serveIRC()
+// ######################################################################
+// Accepts IRC connections on cfg.IRCAddr until ctx is done.
+func (s *Server) serveIRC(ctx context.Context) {
+	ln, err := net.Listen("tcp", s.cfg.IRCAddr)
+	if err != nil {
+		log.Printf("IRC gateway disabled: %v", err)
+		return
+	}
+	log.Printf("IRC gateway listening on %s", ln.Addr())
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	for {
+		conn, err := ln.Accept()
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("IRC accept error: %v", err)
+			continue
+		}
+		go s.handleIRC(conn)
+	}
+}
+
+// ######################################################################
+// function: handleIRC()
+// ######################################################################
+func (s *Server) handleIRC(conn net.Conn) {
+	defer conn.Close()
+	ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		ip = conn.RemoteAddr().String()
+	}
+	irc := newIRCConn(conn, s.hub)
+	if until, banned := s.hub.IsBanned(ip); banned {
+		irc.line("ERROR :Banned until %s", until.Format(time.RFC3339))
+		return
+	}
+	if !s.hub.AcquireIP(ip) {
+		irc.line("ERROR :Too many connections from your address")
+		return
+	}
+	defer s.hub.ReleaseIP(ip)
+
+	account, ok := s.registerIRC(irc, ip)
+	if !ok {
+		return
+	}
+	irc.welcome(account)
+	go irc.readLoop()
+
+	// the hub translates into English, IRC has no way to ask for more
+	c := client.New(irc, ip, "irc", "", "en")
+	s.hub.Serve(c, "", hub.DefaultRoom, "", account, 0)
+}
+
+// ######################################################################
+// function: registerIRC()
+// ######################################################################
+// Reads lines until the client has sent NICK and USER. PASS can be a login
+// token, "name:password" or a bot's API key, without it the user is a guest
+// called whatever they asked for.
+func (s *Server) registerIRC(irc *ircConn, ip string) (hub.Account, bool) {
+	var pass, nick string
+	user := false
+	for nick == "" || !user {
+		cmd, params, err := irc.next()
+		if err != nil {
+			return hub.Account{}, false
+		}
+		switch cmd {
+		case "CAP":
+			if len(params) > 0 && strings.ToUpper(params[0]) == "LS" {
+				irc.line(":%s CAP * LS :", ircServerName) // nothing on offer
+			}
+		case "PASS":
+			if len(params) > 0 {
+				pass = params[0]
+			}
+		case "NICK":
+			if len(params) == 0 {
+				irc.reply(errNoNickGiven, ":No nickname given")
+				continue
+			}
+			nick = params[0]
+		case "USER":
+			user = true
+		case "PING":
+			irc.line(":%s PONG %s :%s", ircServerName, ircServerName, strings.Join(params, " "))
+		case "QUIT":
+			return hub.Account{}, false
+		default:
+			irc.reply(errNotRegistered, ":You have not registered")
+		}
+	}
+	irc.nick = nick
+	if pass == "" {
+		if s.cfg.Challenge != "" {
+			// no way to show an IRC client a captcha, guests use the web
+			irc.reply(errPasswdMismatch, ":Sign in with PASS, guests can't connect over IRC here")
+			irc.line("ERROR :Closing link: guests must pass a challenge")
+			return hub.Account{}, false
+		}
+		return hub.Account{}, true
+	}
+
+	var account hub.Account
+	ok := false
+	switch name, password, isPassword := strings.Cut(pass, ":"); {
+	case isPassword:
+		if !s.authLimiter.allow(ip) {
+			break
+		}
+		a, err := s.hub.Authenticate(name, password)
+		account, ok = a, err == nil
+	case strings.Contains(pass, "."):
+		account, ok = s.hub.BotAccount(pass)
+	default:
+		account, ok = s.hub.LoginAccount(pass)
+	}
+	if !ok {
+		irc.reply(errPasswdMismatch, ":Password incorrect")
+		irc.line("ERROR :Closing link: bad password")
+		return hub.Account{}, false
+	}
+	return account, true
+}
+
+// ######################################################################
+// struct: ircConn
+// ######################################################################
+// One IRC connection, looking like a WebSocket to the hub: ReadMessage
+// hands over chat lines and slash commands made from what the IRC client
+// sent, WriteMessage turns frames into IRC lines.
+type ircConn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	writeMu sync.Mutex
+
+	in   chan string   // chat lines and commands for the hub
+	done chan struct{} // the IRC side has gone
+	err  error         // why, once done is closed
+
+	mu           sync.Mutex
+	nick         string // what the IRC client thinks it is called
+	serverNick   string // what the hub calls it, from the session frame
+	pendingNick  string // asked the hub for this name, no answer yet
+	room         string
+	pendingTopic string
+
+	hub *hub.Hub
+}
+
+func newIRCConn(conn net.Conn, h *hub.Hub) *ircConn {
+	return &ircConn{
+		conn:   conn,
+		reader: bufio.NewReaderSize(conn, ircMaxLine),
+		in:     make(chan string, 16),
+		done:   make(chan struct{}),
+		room:   hub.DefaultRoom,
+		hub:    h,
+	}
+}
+
+// line writes one line to the IRC client
+func (irc *ircConn) line(format string, args ...any) error {
+	irc.writeMu.Lock()
+	defer irc.writeMu.Unlock()
+	irc.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := fmt.Fprintf(irc.conn, format+"\r\n", args...)
+	return err
+}
+
+// reply sends a numeric addressed to the client
+func (irc *ircConn) reply(numeric, format string, args ...any) error {
+	irc.mu.Lock()
+	nick := irc.nick
+	irc.mu.Unlock()
+	if nick == "" {
+		nick = "*"
+	}
+	return irc.line(":%s %s %s "+format, append([]any{ircServerName, numeric, nick}, args...)...)
+}
+
+// next reads and parses the client's next line, dropping tags and prefix.
+// A client that goes quiet gets one PING before it is given up on.
+func (irc *ircConn) next() (string, []string, error) {
+	pinged := false
+	for {
+		irc.conn.SetReadDeadline(time.Now().Add(ircIdle))
+		line, err := irc.reader.ReadSlice('\n')
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && !pinged {
+			pinged = true
+			irc.line("PING :%s", ircServerName)
+			continue
+		}
+		if err == bufio.ErrBufferFull {
+			for err == bufio.ErrBufferFull {
+				_, err = irc.reader.ReadSlice('\n') // too long, skip the rest
+			}
+			continue
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		pinged = false
+		if cmd, params := parseIRC(string(line)); cmd != "" {
+			return cmd, params, nil
+		}
+	}
+}
+
+func parseIRC(line string) (string, []string) {
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, "@") {
+		_, line, _ = strings.Cut(line, " ")
+	}
+	if strings.HasPrefix(line, ":") {
+		_, line, _ = strings.Cut(line, " ")
+	}
+	line, trailing, hasTrailing := strings.Cut(line, " :")
+	params := strings.Fields(line)
+	if len(params) == 0 {
+		return "", nil
+	}
+	if hasTrailing {
+		params = append(params, trailing)
+	} else if strings.HasPrefix(line, ":") {
+		params = append(params, "") // "TOPIC #x :" clears the topic
+	}
+	return strings.ToUpper(params[0]), params[1:]
+}
+
+// ######################################################################
+// function: welcome()
+// ######################################################################
+// The registration burst, then the lobby the hub is about to put them in.
+func (irc *ircConn) welcome(account hub.Account) {
+	irc.mu.Lock()
+	asked := irc.nick
+	if account.ID != "" {
+		irc.nick = account.Name
+	}
+	irc.mu.Unlock()
+
+	irc.reply(rplWelcome, ":Welcome to tempChat, %s", irc.nick)
+	irc.reply(rplYourHost, ":Your host is %s, a gateway into the web chat", ircServerName)
+	irc.reply(rplCreated, ":This server has rooms, not channels, you are in one at a time")
+	irc.reply(rplMyInfo, "%s go-chat-app o t", ircServerName)
+	irc.reply(rplISupport, "CHANTYPES=# NICKLEN=32 CHANNELLEN=64 :are supported by this server")
+	if account.ID == "" {
+		irc.mu.Lock()
+		irc.pendingNick = asked
+		irc.mu.Unlock()
+		irc.in <- "/u " + asked
+	}
+	irc.joined(hub.DefaultRoom)
+}
+
+// joined tells the IRC client it is on channel room now
+func (irc *ircConn) joined(room string) {
+	irc.mu.Lock()
+	nick := irc.nick
+	irc.mu.Unlock()
+	irc.line(":%s!%s@%s JOIN #%s", nick, nick, ircServerName, room)
+	if info, _ := irc.hub.Room(room); info.Topic != "" {
+		irc.reply(rplTopic, "#%s :%s", room, ircLineReplacer.Replace(info.Topic))
+	} else {
+		irc.reply(rplNoTopic, "#%s :No topic is set", room)
+	}
+	irc.names(room)
+}
+
+func (irc *ircConn) names(room string) {
+	irc.mu.Lock()
+	nick := irc.nick
+	irc.mu.Unlock()
+	names := []string{nick}
+	for _, name := range irc.hub.Members(room) {
+		if name = ircNickReplacer.Replace(name); name != nick {
+			names = append(names, name)
+		}
+	}
+	irc.reply(rplNamReply, "= #%s :%s", room, strings.Join(names, " "))
+	irc.reply(rplEndOfNames, "#%s :End of /NAMES list", room)
+}
+
+// ######################################################################
+// function: readLoop()
+// ######################################################################
+// Turns what the IRC client sends into lines for the hub, answering what
+// the hub has no say in (PING, NAMES, LIST, ...) right here.
+func (irc *ircConn) readLoop() {
+	defer close(irc.done)
+	for {
+		cmd, params, err := irc.next()
+		if err != nil {
+			irc.err = err
+			return
+		}
+		irc.mu.Lock()
+		room := irc.room
+		irc.mu.Unlock()
+		arg := func(i int) string {
+			if i < len(params) {
+				return params[i]
+			}
+			return ""
+		}
+
+		var out string
+		switch cmd {
+		case "PING":
+			irc.line(":%s PONG %s :%s", ircServerName, ircServerName, arg(0))
+		case "PONG", "CAP", "NOTICE", "USERHOST", "ISON":
+		case "PASS", "USER":
+			irc.reply(errAlreadyReg, ":You may not reregister")
+		case "QUIT":
+			irc.err = io.EOF
+			irc.line("ERROR :Closing link")
+			return
+
+		case "PRIVMSG":
+			if len(params) < 2 {
+				irc.reply(errNeedMoreParams, "PRIVMSG :Not enough parameters")
+				continue
+			}
+			text := params[1]
+			if strings.HasPrefix(text, "\x01ACTION ") {
+				text = "* " + strings.TrimSuffix(strings.TrimPrefix(text, "\x01ACTION "), "\x01")
+			} else if strings.HasPrefix(text, "\x01") {
+				continue // VERSION and friends, nobody on the other side can answer
+			}
+			switch target := params[0]; {
+			case !strings.HasPrefix(target, "#"):
+				out = "/msg " + target + " " + text
+			case strings.ToLower(target[1:]) != room:
+				irc.reply(errCannotSendTo, "%s :You are on #%s, JOIN %s first", target, room, target)
+			default:
+				out = text
+			}
+
+		case "JOIN":
+			target, _, _ := strings.Cut(arg(0), ",")
+			key, _, _ := strings.Cut(arg(1), ",")
+			switch name := strings.ToLower(strings.TrimPrefix(target, "#")); {
+			case target == "" || target == "0":
+				irc.reply(errNeedMoreParams, "JOIN :Not enough parameters")
+			case !strings.HasPrefix(target, "#"):
+				irc.reply(errNoSuchChannel, "%s :No such channel", target)
+			case name != room:
+				out = strings.TrimSpace("/join " + name + " " + key)
+			}
+		case "PART":
+			if room != hub.DefaultRoom {
+				out = "/join " + hub.DefaultRoom
+			}
+		case "NICK":
+			if arg(0) == "" {
+				irc.reply(errNoNickGiven, ":No nickname given")
+				continue
+			}
+			irc.mu.Lock()
+			irc.pendingNick = arg(0)
+			irc.mu.Unlock()
+			out = "/u " + arg(0)
+		case "TOPIC":
+			switch {
+			case len(params) < 2:
+				out = "/topic"
+			case params[1] == "":
+				out = "/topic -"
+			default:
+				out = "/topic " + params[1]
+			}
+		case "AWAY":
+			if arg(0) == "" {
+				out = "/back"
+				irc.reply(rplUnAway, ":You are no longer marked as being away")
+			} else {
+				out = "/away " + arg(0)
+				irc.reply(rplNowAway, ":You have been marked as being away")
+			}
+		case "WHOIS":
+			out = "/whois " + arg(len(params)-1)
+		case "NAMES":
+			irc.names(room)
+		case "MODE":
+			if strings.HasPrefix(arg(0), "#") && len(params) == 1 {
+				irc.reply(rplChannelModeIs, "%s +t", arg(0))
+			}
+		case "WHO":
+			irc.reply(rplEndOfWho, "%s :End of /WHO list", arg(0))
+		case "LIST":
+			irc.reply(rplListStart, "Channel :Users  Name")
+			for _, info := range irc.hub.Rooms() {
+				if !info.Locked && !info.Invite {
+					irc.reply(rplList, "#%s %d :%s", info.Name, info.Members, ircLineReplacer.Replace(info.Topic))
+				}
+			}
+			irc.reply(rplListEnd, ":End of /LIST")
+		default:
+			irc.reply(errUnknownCommand, "%s :Unknown command", cmd)
+		}
+
+		if out != "" {
+			select {
+			case irc.in <- out:
+			case <-irc.done:
+				return
+			}
+		}
+	}
+}
+
+// ReadMessage hands the hub the next line, like a WebSocket text message.
+func (irc *ircConn) ReadMessage() (int, []byte, error) {
+	select {
+	case line := <-irc.in:
+		return websocket.TextMessage, []byte(line), nil
+	case <-irc.done:
+		return 0, nil, irc.err
+	}
+}
+
+// ######################################################################
+// function: WriteMessage()
+// ######################################################################
+// Renders a frame from the hub as IRC lines.
+func (irc *ircConn) WriteMessage(_ int, data []byte) error {
+	var f protocol.Frame
+	if err := json.Unmarshal(data, &f); err != nil {
+		return err
+	}
+	if f.Ack {
+		// IRC clients can't ack, don't let them count as lost deliveries
+		if ack, err := json.Marshal(protocol.ClientFrame{Type: protocol.ClientAck, ID: f.ID}); err == nil {
+			select {
+			case irc.in <- string(ack):
+			default:
+			}
+		}
+	}
+
+	irc.mu.Lock()
+	nick, room := irc.nick, irc.room
+	irc.mu.Unlock()
+	from := ircNickReplacer.Replace(f.From)
+	prefix := from + "!" + from + "@" + ircServerName
+	channel := "#" + f.Room
+	notice := func(text string) error {
+		target := nick
+		if f.Room != "" && f.Room == room {
+			target = channel
+		}
+		for _, chunk := range ircChunks(text) {
+			if err := irc.line(":%s NOTICE %s :%s", ircServerName, target, chunk); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	switch f.Type {
+	case protocol.FrameMessage, protocol.FrameDirect:
+		target := channel
+		if f.Type == protocol.FrameDirect {
+			target = nick
+		}
+		if from == nick {
+			return nil // IRC clients show their own lines already
+		}
+		for _, chunk := range ircChunks(f.Text) {
+			if err := irc.line(":%s PRIVMSG %s :%s", prefix, target, chunk); err != nil {
+				return err
+			}
+		}
+
+	case protocol.FrameMissedMessages:
+		for _, m := range f.Messages {
+			notice(fmt.Sprintf("<%s> %s", m.From, m.Text))
+		}
+
+	case protocol.FrameSession:
+		irc.mu.Lock()
+		irc.serverNick = f.From
+		pending := irc.pendingNick
+		irc.mu.Unlock()
+		if pending == "" && f.From != nick {
+			return irc.nickChange(nick, f.From)
+		}
+
+	case protocol.FrameRename:
+		return irc.line(":%s NICK :%s", prefix, ircNickReplacer.Replace(f.Text))
+
+	case protocol.FrameTopic:
+		if f.Room != room {
+			irc.mu.Lock()
+			irc.pendingTopic = f.Text // we are on the way in, see switched
+			irc.mu.Unlock()
+			return nil
+		}
+		return irc.reply(rplTopic, "%s :%s", channel, ircLineReplacer.Replace(f.Text))
+	case protocol.FrameTopicChanged:
+		return irc.line(":%s TOPIC %s :%s", prefix, channel, ircLineReplacer.Replace(f.Text))
+
+	case protocol.FrameMOTD:
+		irc.reply(rplMOTDStart, ":- %s message of the day -", ircServerName)
+		for _, l := range strings.Split(f.Text, "\n") {
+			irc.reply(rplMOTD, ":- %s", ircLineReplacer.Replace(l))
+		}
+		return irc.reply(rplEndOfMOTD, ":End of /MOTD command")
+
+	case protocol.FrameBanner:
+		if f.Banner != nil {
+			return notice(fmt.Sprintf("[%s] %s", f.Banner.Level, f.Banner.Text))
+		}
+
+	case protocol.FrameSystem:
+		return irc.system(f, notice)
+
+	case protocol.FrameError:
+		irc.mu.Lock()
+		pending, serverNick := irc.pendingNick, irc.serverNick
+		irc.pendingNick = ""
+		irc.mu.Unlock()
+		var err error
+		if pending != "" && f.Code == protocol.CodeNameTaken {
+			err = irc.reply(errNicknameInUse, "%s :%s", pending, f.Text)
+		} else {
+			err = notice(f.Text)
+		}
+		if err != nil {
+			return err
+		}
+		if pending != "" && serverNick != "" && serverNick != nick {
+			return irc.nickChange(nick, serverNick) // the rename didn't happen
+		}
+
+	case protocol.FrameStrike, protocol.FrameSlowMode, protocol.FrameAnnouncement, protocol.FrameInvite:
+		text := f.Text
+		if f.Type == protocol.FrameAnnouncement {
+			text = "[announcement] " + f.From + ": " + text
+		}
+		if f.Type == protocol.FrameInvite {
+			text = fmt.Sprintf("Invite for #%s: %s", f.Room, f.Token)
+		}
+		return notice(text)
+	}
+	return nil
+}
+
+// system frames that are really joins, parts and renames become those
+func (irc *ircConn) system(f protocol.Frame, notice func(string) error) error {
+	irc.mu.Lock()
+	nick, room := irc.nick, irc.room
+	irc.mu.Unlock()
+	channel := "#" + f.Room
+	who := func(suffix string) string {
+		name, _ := strings.CutSuffix(f.Text, suffix)
+		name = ircNickReplacer.Replace(name)
+		return name + "!" + name + "@" + ircServerName
+	}
+
+	switch f.Key {
+	case "%s joined #%s.":
+		return irc.line(":%s JOIN %s", who(" joined #"+f.Room+"."), channel)
+	case "%s left #%s.":
+		return irc.line(":%s PART %s", who(" left #"+f.Room+"."), channel)
+	case "%s has left the chat.":
+		return irc.line(":%s QUIT :Quit", who(" has left the chat."))
+
+	case "You are now in #%s":
+		irc.switched(room, f.Room)
+		return nil
+
+	case "Username set to %s":
+		name := strings.TrimPrefix(f.Text, "Username set to ")
+		irc.mu.Lock()
+		irc.pendingNick, irc.serverNick = "", name
+		irc.mu.Unlock()
+		if name != nick {
+			return irc.nickChange(nick, name)
+		}
+		return nil
+	}
+	return notice(f.Text)
+}
+
+// After a /join the hub has sent the topic before saying where we are,
+// it goes out now. NAMES has to ask the hub, which may be holding its
+// mutex while it writes to us, so that happens on the side.
+func (irc *ircConn) switched(old, room string) {
+	irc.mu.Lock()
+	nick, topic := irc.nick, irc.pendingTopic
+	irc.room, irc.pendingTopic = room, ""
+	irc.mu.Unlock()
+	irc.line(":%s!%s@%s PART #%s", nick, nick, ircServerName, old)
+	irc.line(":%s!%s@%s JOIN #%s", nick, nick, ircServerName, room)
+	if topic != "" {
+		irc.reply(rplTopic, "#%s :%s", room, ircLineReplacer.Replace(topic))
+	}
+	go irc.names(room)
+}
+
+func (irc *ircConn) nickChange(old, name string) error {
+	name = ircNickReplacer.Replace(name)
+	irc.mu.Lock()
+	irc.nick = name
+	irc.mu.Unlock()
+	return irc.line(":%s!%s@%s NICK :%s", old, old, ircServerName, name)
+}
+
+// ircChunks splits text into lines that fit in a PRIVMSG
+func ircChunks(text string) []string {
+	var chunks []string
+	for _, line := range strings.Split(strings.ReplaceAll(text, "\r", ""), "\n") {
+		for len(line) > ircMaxText {
+			cut := ircMaxText
+			for cut > 0 && !utf8.RuneStart(line[cut]) {
+				cut--
+			}
+			chunks = append(chunks, line[:cut])
+			line = line[cut:]
+		}
+		if line != "" {
+			chunks = append(chunks, line)
+		}
+	}
+	return chunks
+}
+
+func (irc *ircConn) SetWriteDeadline(t time.Time) error { return nil } // line sets its own
+func (irc *ircConn) EnableWriteCompression(bool)        {}
+func (irc *ircConn) SetCompressionLevel(int) error      { return nil }
+func (irc *ircConn) Subprotocol() string                { return protocol.SubprotocolV2 }
+func (irc *ircConn) Close() error                       { return irc.conn.Close() }
@@ -0,0 +1,43 @@
+package chat
+
+import (
+	"log"
+	"net/url"
+	"time"
+
+	"go-chat-app/internal/client"
+	"go-chat-app/internal/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+// ######################################################################
+// function: negotiateLegacy()
+// ######################################################################
+// The first web client knew nothing about JSON frames, and cached copies of
+// it are still around. JSON clients open with a hello frame (or any other
+// JSON frame), or give themselves away by asking for a subprotocol or
+// sending ?v=. Anyone who sends a plain line first, or nothing at all for
+// LegacyWait, gets the old plain text lines instead. Returns false if the
+// client was turned away because the cutoff has passed.
+func (s *Server) negotiateLegacy(c *client.Client, ws *websocket.Conn, query url.Values) bool {
+	if s.cfg.LegacyWait <= 0 || ws.Subprotocol() != "" || query.Get("v") != "" {
+		return true
+	}
+	data, arrived := c.AwaitFirst(s.cfg.LegacyWait)
+	if arrived && data == nil {
+		return true // gone, or sent something the read loop deals with
+	}
+	if _, ok := protocol.ParseClientFrame(data); ok {
+		return true
+	}
+
+	if !s.cfg.LegacyUntil.IsZero() && !time.Now().Before(s.cfg.LegacyUntil) {
+		log.Printf("Refusing legacy client from %s", c.IP)
+		msg := websocket.FormatCloseMessage(protocol.CloseUpgradeRequired, "this client is too old, please reload the page")
+		ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+		return false
+	}
+	c.Downgrade()
+	return true
+}
@@ -0,0 +1,227 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ######################################################################
+// struct: ListenerConfig
+// ######################################################################
+// One address the server binds, from the "listeners" list of the config file.
+type ListenerConfig struct {
+	Network    string   `json:"network,omitempty"` // "tcp" (default) or "unix"
+	Addr       string   `json:"addr"`              // host:port or socket path
+	TLSCert    string   `json:"tls_cert,omitempty"`
+	TLSKey     string   `json:"tls_key,omitempty"`
+	Middleware []string `json:"middleware,omitempty"` // outermost first, see middlewares
+	Mode       string   `json:"mode,omitempty"`       // permissions of a unix socket, "0660", "" = as the umask has it
+}
+
+var defaultListeners = []ListenerConfig{{Addr: ":6969"}}
+
+var middlewares = map[string]func(*Server, http.Handler) http.Handler{
+	"log":              (*Server).logRequests,
+	"localhost-only":   (*Server).localhostOnly,
+	"admin-only":       (*Server).adminOnly,
+	"no-admin":         (*Server).noAdmin,
+	"security-headers": (*Server).securityHeaders,
+}
+
+// ######################################################################
+// function: ParseListen()
+// ######################################################################
+// A -listen flag: "host:port", ":port", a bare port or "unix:<path>".
+func ParseListen(v string) (ListenerConfig, error) {
+	if path, ok := strings.CutPrefix(v, "unix:"); ok {
+		if path == "" {
+			return ListenerConfig{}, fmt.Errorf("listen %q: no socket path", v)
+		}
+		return ListenerConfig{Network: "unix", Addr: path}, nil
+	}
+	if _, err := strconv.Atoi(v); err == nil {
+		v = ":" + v
+	}
+	if _, port, err := net.SplitHostPort(v); err != nil || port == "" {
+		return ListenerConfig{}, fmt.Errorf("listen %q: want host:port, :port or unix:<path>", v)
+	}
+	return ListenerConfig{Addr: v}, nil
+}
+
+// ######################################################################
+// function: validateListeners()
+// ######################################################################
+func validateListeners(listeners []ListenerConfig) error {
+	for _, l := range listeners {
+		if l.Network != "" && l.Network != "tcp" && l.Network != "unix" {
+			return fmt.Errorf("listener %s: network is tcp or unix, not %q", l.Addr, l.Network)
+		}
+		if l.Mode != "" {
+			if _, err := strconv.ParseUint(l.Mode, 8, 32); err != nil || l.Network != "unix" {
+				return fmt.Errorf("listener %s: mode is an octal permission like \"0660\", for unix sockets", l.Addr)
+			}
+		}
+		for _, name := range l.Middleware {
+			if middlewares[name] == nil {
+				return fmt.Errorf("listener %s: unknown middleware %q", l.Addr, name)
+			}
+		}
+		if (l.TLSCert == "") != (l.TLSKey == "") {
+			return fmt.Errorf("listener %s: tls_cert and tls_key go together", l.Addr)
+		}
+	}
+	return nil
+}
+
+// ######################################################################
+// function: serveListeners()
+// ######################################################################
+// Binds every listener and serves handler on it through the listener's own
+// middleware chain until ctx is done or one of them fails, then shuts the
+// rest down. Returns the first error a listener stopped with.
+func (s *Server) serveListeners(ctx context.Context, listeners []ListenerConfig, handler http.Handler) error {
+	var servers []*http.Server
+	defer func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		for _, srv := range servers {
+			srv.Shutdown(shutdownCtx)
+		}
+	}()
+
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		network := l.Network
+		if network == "" {
+			network = "tcp"
+		}
+		if network == "unix" {
+			// a socket left behind by an unclean shutdown blocks the bind
+			if err := os.Remove(l.Addr); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		}
+		ln, err := net.Listen(network, l.Addr)
+		if err != nil {
+			return err
+		}
+		if l.Mode != "" {
+			// so a proxy running as another user can connect, checked in validateListeners
+			mode, _ := strconv.ParseUint(l.Mode, 8, 32)
+			if err := os.Chmod(l.Addr, fs.FileMode(mode)); err != nil {
+				ln.Close()
+				return err
+			}
+		}
+
+		h := handler
+		for i := len(l.Middleware) - 1; i >= 0; i-- {
+			h = middlewares[l.Middleware[i]](s, h)
+		}
+		srv := &http.Server{Handler: h, ReadHeaderTimeout: 10 * time.Second}
+		servers = append(servers, srv)
+
+		tls := l.TLSCert != ""
+		fmt.Printf("WebSocket server listening on %s %s (tls: %v, middleware: %s)\n", network, ln.Addr(), tls, strings.Join(l.Middleware, ","))
+		go func(l ListenerConfig) {
+			if tls {
+				errs <- srv.ServeTLS(ln, l.TLSCert, l.TLSKey)
+			} else {
+				errs <- srv.Serve(ln)
+			}
+		}(l)
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil
+	case err := <-errs:
+		return err
+	}
+}
+
+// ######################################################################
+// function: logRequests()
+// ######################################################################
+func (s *Server) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		next.ServeHTTP(w, r)
+		log.Printf("%s %s %s (%s)", s.clientIP(r), r.Method, r.URL.Path, time.Since(start))
+	})
+}
+
+// ######################################################################
+// function: localhostOnly()
+// ######################################################################
+// Refuses anything not coming from the loopback interface. Unix socket
+// peers have no address and are let through.
+func (s *Server) localhostOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err == nil {
+			if ip := net.ParseIP(host); ip != nil && !ip.IsLoopback() {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func isAdminPath(path string) bool {
+	return strings.HasPrefix(path, "/admin/") || path == "/metrics"
+}
+
+// ######################################################################
+// function: adminOnly()
+// ######################################################################
+// Only serves the admin API, e.g. on a Unix socket.
+func (s *Server) adminOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isAdminPath(r.URL.Path) {
+			http.NotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ######################################################################
+// function: noAdmin()
+// ######################################################################
+// Hides the admin API, e.g. on the public listener.
+func (s *Server) noAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isAdminPath(r.URL.Path) {
+			http.NotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ######################################################################
+// function: securityHeaders()
+// ######################################################################
+func (s *Server) securityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("Strict-Transport-Security", "max-age=31536000")
+		h.Set("X-Content-Type-Options", "nosniff")
+		if !strings.HasPrefix(r.URL.Path, "/embed/") {
+			h.Set("X-Frame-Options", "DENY")
+		}
+		h.Set("Referrer-Policy", "no-referrer")
+		next.ServeHTTP(w, r)
+	})
+}
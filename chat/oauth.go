@@ -0,0 +1,260 @@
+package chat
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go-chat-app/internal/hub"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/endpoints"
+)
+
+const (
+	oauthStateTTL    = 10 * time.Minute
+	oauthStateCookie = "chat_oauth_state" // the state again, so only the browser that set off can come back with it
+)
+
+// ######################################################################
+// struct: oauthProvider
+// ######################################################################
+// What we need to know about a provider besides the app credentials: where
+// to ask who the user is, and how to read the answer.
+type oauthProvider struct {
+	endpoint oauth2.Endpoint
+	scopes   []string
+	userURL  string
+	user     func(body []byte) (subject, name string, err error)
+}
+
+var oauthProviders = map[string]oauthProvider{
+	hub.ProviderGitHub: {
+		endpoint: endpoints.GitHub,
+		userURL:  "https://api.github.com/user",
+		user: func(body []byte) (string, string, error) {
+			var u struct {
+				ID    int64  `json:"id"`
+				Login string `json:"login"`
+			}
+			err := json.Unmarshal(body, &u)
+			if u.ID == 0 && err == nil {
+				err = errors.New("no user id")
+			}
+			return strconv.FormatInt(u.ID, 10), u.Login, err // logins can be renamed, ids can't
+		},
+	},
+	hub.ProviderGoogle: {
+		endpoint: endpoints.Google,
+		scopes:   []string{"openid", "email"},
+		userURL:  "https://openidconnect.googleapis.com/v1/userinfo",
+		user: func(body []byte) (string, string, error) {
+			var u struct {
+				Sub   string `json:"sub"`
+				Email string `json:"email"`
+			}
+			err := json.Unmarshal(body, &u)
+			if u.Sub == "" && err == nil {
+				err = errors.New("no subject")
+			}
+			name, _, _ := strings.Cut(u.Email, "@")
+			return u.Sub, name, err
+		},
+	},
+}
+
+// A login on its way through the provider, keyed by the state parameter.
+type oauthState struct {
+	provider string
+	link     string // link token if the browser was already logged in
+	expires  time.Time
+}
+
+// ######################################################################
+// function: oauthConfig()
+// ######################################################################
+// The OAuth2 app for a provider, if one is configured. Without a PublicURL
+// the redirect goes back to the host the request came in on.
+func (s *Server) oauthConfig(r *http.Request, provider string) (*oauth2.Config, oauthProvider, bool) {
+	p, ok := oauthProviders[provider]
+	creds := s.cfg.OAuth[provider]
+	if !ok || creds.ClientID == "" {
+		return nil, oauthProvider{}, false
+	}
+	return &oauth2.Config{
+		ClientID:     creds.ClientID,
+		ClientSecret: creds.ClientSecret,
+		Endpoint:     p.endpoint,
+		Scopes:       p.scopes,
+		RedirectURL:  s.publicURL(r) + "/auth/" + provider + "/callback",
+	}, p, true
+}
+
+// ######################################################################
+// function: handleOAuth()
+// ######################################################################
+// GET /auth/<provider> sends the browser off to sign in with the provider,
+// which sends it back to /auth/<provider>/callback. A browser that is
+// already logged in gets the identity linked to its account instead. The
+// state goes in a cookie as well, or anyone could finish their own sign in
+// in someone else's browser, logging them in as the attacker or linking
+// the attacker's identity to their account.
+func (s *Server) handleOAuth(w http.ResponseWriter, r *http.Request) {
+	provider, sub, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/auth"), "/"), "/")
+	conf, p, ok := s.oauthConfig(r, provider)
+	if !ok || r.Method != http.MethodGet || (sub != "" && sub != "callback") {
+		http.NotFound(w, r)
+		return
+	}
+	if sub == "callback" {
+		s.handleOAuthCallback(w, r, provider, conf, p)
+		return
+	}
+
+	st := oauthState{provider: provider, expires: time.Now().Add(oauthStateTTL)}
+	if a, ok := s.hub.LoginAccount(loginToken(r)); ok {
+		if st.link, ok = s.startLink(a.ID); !ok {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+	}
+	state := randomState()
+	s.oauthMutex.Lock()
+	now := time.Now()
+	for key, old := range s.oauthStates {
+		if now.After(old.expires) {
+			delete(s.oauthStates, key)
+		}
+	}
+	s.oauthStates[state] = st
+	s.oauthMutex.Unlock()
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookie,
+		Value:    state,
+		Path:     "/auth/",
+		MaxAge:   int(oauthStateTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode, // the provider's redirect back is a top level GET, so it comes along
+	})
+	http.Redirect(w, r, conf.AuthCodeURL(state), http.StatusFound)
+}
+
+func (s *Server) startLink(account string) (string, bool) {
+	token, err := s.hub.StartLink(account)
+	if err != nil {
+		log.Printf("Error starting account link: %v", err)
+		return "", false
+	}
+	return token, true
+}
+
+// ######################################################################
+// function: handleOAuthCallback()
+// ######################################################################
+func (s *Server) handleOAuthCallback(w http.ResponseWriter, r *http.Request, provider string, conf *oauth2.Config, p oauthProvider) {
+	q := r.URL.Query()
+	http.SetCookie(w, &http.Cookie{Name: oauthStateCookie, Path: "/auth/", MaxAge: -1})
+	if c, err := r.Cookie(oauthStateCookie); err != nil || subtle.ConstantTimeCompare([]byte(c.Value), []byte(q.Get("state"))) != 1 {
+		http.Error(w, "login expired, please try again", http.StatusBadRequest)
+		return
+	}
+	s.oauthMutex.Lock()
+	st, ok := s.oauthStates[q.Get("state")]
+	delete(s.oauthStates, q.Get("state"))
+	s.oauthMutex.Unlock()
+	if !ok || st.provider != provider || time.Now().After(st.expires) {
+		http.Error(w, "login expired, please try again", http.StatusBadRequest)
+		return
+	}
+	if e := q.Get("error"); e != "" {
+		http.Error(w, "sign in was cancelled: "+e, http.StatusUnauthorized)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	subject, name, err := s.oauthUser(ctx, conf, p, q.Get("code"))
+	if err != nil {
+		log.Printf("Error signing in with %s: %v", provider, err)
+		http.Error(w, "could not sign in with "+provider, http.StatusBadGateway)
+		return
+	}
+	ident := hub.Identity{Provider: provider, Subject: subject}
+
+	if st.link != "" {
+		_, err := s.hub.CompleteLink(st.link, ident, false)
+		switch {
+		case errors.Is(err, hub.ErrIdentityTaken):
+			http.Error(w, "that "+provider+" account already belongs to another chat account", http.StatusConflict)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			http.Redirect(w, r, "/", http.StatusFound)
+		}
+		return
+	}
+
+	_, token, err := s.hub.LoginWith(ident, name)
+	if err != nil {
+		log.Printf("Error signing in with %s: %v", provider, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	s.setLoginCookie(w, r, token)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// ######################################################################
+// function: oauthUser()
+// ######################################################################
+// Trades the code for a token and asks the provider who it belongs to.
+func (s *Server) oauthUser(ctx context.Context, conf *oauth2.Config, p oauthProvider, code string) (string, string, error) {
+	tok, err := conf.Exchange(ctx, code)
+	if err != nil {
+		return "", "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.userURL, nil)
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := conf.Client(ctx, tok).Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("user info: %s", resp.Status)
+	}
+	var body json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", "", err
+	}
+	return p.user(body)
+}
+
+func (s *Server) publicURL(r *http.Request) string {
+	if s.cfg.PublicURL != "" {
+		return strings.TrimSuffix(s.cfg.PublicURL, "/")
+	}
+	if r.TLS != nil {
+		return "https://" + r.Host
+	}
+	return "http://" + r.Host
+}
+
+func randomState() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
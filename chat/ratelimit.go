@@ -0,0 +1,146 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ######################################################################
+// struct: rateLimiter
+// ######################################################################
+// Token bucket per key (usually an IP): rate tokens a second, up to burst.
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(r Rate) *rateLimiter {
+	return &rateLimiter{rate: r.PerSecond, burst: float64(r.Burst), buckets: make(map[string]*bucket)}
+}
+
+// ######################################################################
+// function: allow()
+// ######################################################################
+func (rl *rateLimiter) allow(key string) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	now := time.Now()
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &bucket{tokens: rl.burst, last: now}
+		rl.buckets[key] = b
+	}
+	b.tokens = min(rl.burst, b.tokens+now.Sub(b.last).Seconds()*rl.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// ######################################################################
+// function: cleanup()
+// ######################################################################
+// Forgets buckets that have been full for a while so the map stays small.
+// Runs until ctx is done.
+func (rl *rateLimiter) cleanup(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		rl.mu.Lock()
+		for key, b := range rl.buckets {
+			if time.Since(b.last).Seconds()*rl.rate >= rl.burst {
+				delete(rl.buckets, key)
+			}
+		}
+		rl.mu.Unlock()
+	}
+}
+
+// ######################################################################
+// function: set()
+// ######################################################################
+// Takes a new rate and burst, for a reload. Buckets keep their tokens.
+func (rl *rateLimiter) set(r Rate) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.rate, rl.burst = r.PerSecond, float64(r.Burst)
+}
+
+// ######################################################################
+// struct: RateLimits
+// ######################################################################
+// The "rate_limits" of the -config file. Left out means the default.
+type RateLimits struct {
+	MaxConnsPerIP *int  `json:"max_conns_per_ip"` // instead of -max-conns-per-ip, 0 = unlimited
+	Auth          *Rate `json:"auth"`             // register, login, challenge and reset attempts per IP
+	Embed         *Rate `json:"embed"`            // embed page loads and stream (re)connects per IP
+	Hooks         *Rate `json:"hooks"`            // incoming hook posts per token
+}
+
+// Rate is a token bucket: PerSecond tokens a second, up to Burst.
+type Rate struct {
+	PerSecond float64 `json:"per_second"`
+	Burst     int     `json:"burst"`
+}
+
+var (
+	defaultAuthRate  = Rate{PerSecond: 0.2, Burst: 10}
+	defaultEmbedRate = Rate{PerSecond: 1, Burst: 10}
+	defaultHookRate  = Rate{PerSecond: 1, Burst: 20}
+)
+
+func (l *RateLimits) validate() error {
+	if l == nil {
+		return nil
+	}
+	if l.MaxConnsPerIP != nil && *l.MaxConnsPerIP < 0 {
+		return errors.New("rate_limits: max_conns_per_ip can't be negative")
+	}
+	for name, r := range map[string]*Rate{"auth": l.Auth, "embed": l.Embed, "hooks": l.Hooks} {
+		if r != nil && (r.PerSecond <= 0 || r.Burst < 1) {
+			return fmt.Errorf("rate_limits: %s needs a per_second over 0 and a burst of at least 1", name)
+		}
+	}
+	return nil
+}
+
+func (l *RateLimits) maxConnsPerIP(flag int) int {
+	if l == nil || l.MaxConnsPerIP == nil {
+		return flag
+	}
+	return *l.MaxConnsPerIP
+}
+
+func (l *RateLimits) rates() (auth, embed, hooks Rate) {
+	auth, embed, hooks = defaultAuthRate, defaultEmbedRate, defaultHookRate
+	if l == nil {
+		return
+	}
+	if l.Auth != nil {
+		auth = *l.Auth
+	}
+	if l.Embed != nil {
+		embed = *l.Embed
+	}
+	if l.Hooks != nil {
+		hooks = *l.Hooks
+	}
+	return
+}
@@ -0,0 +1,59 @@
+package chat
+
+import (
+	"log"
+	"net/http"
+	"strings"
+)
+
+// A reload, on SIGHUP or POST /admin/reload, reads the -config file again
+// for the origins and rate limits, and has the hub read its word list,
+// MOTD and ban lists again. Nobody gets disconnected. Listeners, bridges
+// and everything from flags stay as they were until a restart.
+
+// ######################################################################
+// function: Reload()
+// ######################################################################
+// A config file that doesn't load changes nothing. by is who asked, for
+// the audit log.
+func (s *Server) Reload(by string) error {
+	fc, err := LoadFileConfig(s.cfg.ConfigFile)
+	if err != nil {
+		return err
+	}
+	auth, embed, hooks := fc.RateLimits.rates()
+	s.authLimiter.set(auth)
+	s.embedLimiter.set(embed)
+	s.hookLimiter.set(hooks)
+
+	s.reloadMu.Lock()
+	s.origins = fc.AllowedOrigins
+	s.reloadMu.Unlock()
+
+	s.hub.Reload(fc.RateLimits.maxConnsPerIP(s.cfg.MaxConnsPerIP), by)
+	return nil
+}
+
+// ######################################################################
+// function: checkOrigin()
+// ######################################################################
+// Lets the upgrade through if the page it comes from is allowed. Clients
+// that aren't browsers send no Origin and always get through.
+func (s *Server) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	if len(s.origins) == 0 {
+		return true
+	}
+	for _, allowed := range s.origins {
+		if strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	log.Printf("Refused WebSocket from origin %s", origin)
+	return false
+}
@@ -0,0 +1,238 @@
+// Package chat is the embeddable chat server: the hub plus its WebSocket,
+// room directory, embed and admin endpoints.
+package chat
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"go-chat-app/internal/hub"
+	"go-chat-app/internal/kafka"
+	"go-chat-app/internal/matrix"
+	"go-chat-app/internal/telemetry"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// ######################################################################
+// struct: Server
+// ######################################################################
+type Server struct {
+	cfg Config
+	hub *hub.Hub
+	mux *http.ServeMux
+
+	handler http.Handler // mux, also speaking cleartext HTTP/2
+
+	upgrader websocket.Upgrader
+
+	embedLimiter *rateLimiter   // page loads and stream (re)connects per IP
+	authLimiter  *rateLimiter   // register, login and challenge attempts per IP
+	hookLimiter  *rateLimiter   // incoming hook posts per token
+	embedStreams map[string]int // open streams per IP
+	embedMutex   sync.Mutex
+
+	eventStreams map[string]*eventConn // open SSE clients by stream ID, for their POSTs
+	eventMutex   sync.Mutex
+
+	oauthStates map[string]oauthState // logins out at a provider
+	oauthMutex  sync.Mutex
+
+	challengeKey []byte // signs challenges and passes, see challenge.go
+
+	origins  []string // cfg.AllowedOrigins until a reload
+	reloadMu sync.Mutex
+
+	matrix *matrix.Bridge  // nil = not bridged
+	kafka  *kafka.Exporter // nil = no event export
+}
+
+// ######################################################################
+// function: New()
+// ######################################################################
+// Creates a server and loads its state from cfg.DataDir. Nothing is served
+// until Run.
+func New(cfg Config) *Server {
+	if cfg.Listeners == nil {
+		cfg.Listeners = defaultListeners
+	}
+	authRate, embedRate, hookRate := cfg.RateLimits.rates()
+	s := &Server{
+		cfg:          cfg,
+		hub:          hub.New(cfg.hubConfig()),
+		mux:          http.NewServeMux(),
+		embedLimiter: newRateLimiter(embedRate),
+		authLimiter:  newRateLimiter(authRate),
+		hookLimiter:  newRateLimiter(hookRate),
+		origins:      cfg.AllowedOrigins,
+		embedStreams: make(map[string]int),
+		eventStreams: make(map[string]*eventConn),
+		oauthStates:  make(map[string]oauthState),
+		challengeKey: newChallengeKey(),
+	}
+	s.upgrader = upgrader
+	s.handler = h2c.NewHandler(s.mux, &http2.Server{}) // gRPC without TLS
+	s.upgrader.EnableCompression = cfg.Compression
+	s.upgrader.CheckOrigin = s.checkOrigin
+
+	// Set up WebSocket route
+	s.mux.HandleFunc("/ws", s.handleConnection)
+	s.mux.HandleFunc("/events", s.handleEvents) // for when WebSockets don't get through
+	s.mux.HandleFunc("/chat.Chat/", s.handleGRPC)
+
+	// Room directory
+	s.mux.HandleFunc("/api/rooms", s.handleRooms)
+	s.mux.HandleFunc("/api/rooms/", s.handleRooms)
+	s.mux.HandleFunc("/api/sync", s.handleSync)
+	s.mux.HandleFunc("/api/export", s.handleExport)
+
+	// Accounts
+	s.mux.HandleFunc("/api/register", s.handleRegister)
+	s.mux.HandleFunc("/api/login", s.handleLogin)
+	s.mux.HandleFunc("/api/logout", s.handleLogout)
+	s.mux.HandleFunc("/api/email/verify", s.handleVerifyEmail)
+	s.mux.HandleFunc("/api/password/forgot", s.handleForgotPassword)
+	s.mux.HandleFunc("/api/password/reset", s.handleResetPassword)
+	s.mux.HandleFunc("/api/account", s.handleAccount)
+	s.mux.HandleFunc("/api/account/", s.handleAccount)
+	s.mux.HandleFunc("/auth/", s.handleOAuth)
+	s.mux.HandleFunc("/api/challenge", s.handleChallenge)
+	s.mux.HandleFunc("/hooks/", s.handleHook)
+
+	// Homeserver pushing Matrix events
+	if cfg.Matrix != nil {
+		s.matrix = matrix.New(*cfg.Matrix, s.hub)
+		s.mux.Handle("/_matrix/app/", s.matrix)
+	}
+	if cfg.Kafka != nil {
+		s.kafka = kafka.New(*cfg.Kafka, s.hub)
+	}
+
+	// Probes for load balancers and Kubernetes
+	s.mux.HandleFunc("/healthz", s.handleHealthz)
+	s.mux.HandleFunc("/readyz", s.handleReadyz)
+
+	// Read-only embeds of public rooms
+	s.mux.HandleFunc("/embed/", s.handleEmbed)
+
+	// Custom emoji images
+	s.mux.HandleFunc("/emoji/", s.handleEmoji)
+
+	// Admin API
+	s.mux.HandleFunc("/admin", s.requireAdmin(s.handleAdminPage))
+	s.mux.HandleFunc("/admin/connections", s.requireAdmin(s.handleAdminConnections))
+	s.mux.HandleFunc("/admin/bans", s.requireAdmin(s.handleAdminBans))
+	s.mux.HandleFunc("/admin/shadowbans", s.requireAdmin(s.handleAdminShadowBans))
+	s.mux.HandleFunc("/admin/stats", s.requireAdmin(s.handleAdminStats))
+	s.mux.HandleFunc("/admin/audit", s.requireAdmin(s.handleAdminAudit))
+	s.mux.HandleFunc("/admin/bandwidth", s.requireAdmin(s.handleAdminBandwidth))
+	s.mux.HandleFunc("/admin/rooms/", s.requireAdmin(s.handleAdminRooms))
+	s.mux.HandleFunc("/admin/announce", s.requireAdmin(s.handleAdminAnnounce))
+	s.mux.HandleFunc("/admin/refresh", s.requireAdmin(s.handleAdminRefresh))
+	s.mux.HandleFunc("/admin/reload", s.requireAdmin(s.handleAdminReload))
+	s.mux.HandleFunc("/admin/scheduled", s.requireAdmin(s.handleAdminScheduled))
+	s.mux.HandleFunc("/admin/recurring", s.requireAdmin(s.handleAdminRecurring))
+	s.mux.HandleFunc("/admin/webhooks", s.requireAdmin(s.handleAdminWebhooks))
+	s.mux.HandleFunc("/admin/hooks", s.requireAdmin(s.handleAdminHooks))
+	s.mux.HandleFunc("/admin/accounts", s.requireAdmin(s.handleAdminAccounts))
+	s.mux.HandleFunc("/admin/accounts/", s.requireAdmin(s.handleAdminAccounts))
+	s.mux.HandleFunc("/admin/bots", s.requireAdmin(s.handleAdminBots))
+	s.mux.HandleFunc("/admin/bots/", s.requireAdmin(s.handleAdminBots))
+	s.mux.HandleFunc("/admin/emoji", s.requireAdmin(s.handleAdminEmoji))
+	s.mux.HandleFunc("/admin/emoji/", s.requireAdmin(s.handleAdminEmoji))
+	s.mux.HandleFunc("/metrics", s.requireAdmin(s.handleMetrics))
+	s.mux.HandleFunc("/admin/debug/hub", s.requireAdmin(s.handleAdminDebug))
+	s.mux.HandleFunc("/admin/debug/pprof/", s.requireAdmin(pprofHandler()))
+
+	// Serve the web client, built in or from -public
+	if cfg.Public != nil {
+		s.mux.Handle("/", http.FileServer(http.FS(cfg.Public)))
+	}
+	return s
+}
+
+// ######################################################################
+// function: ServeHTTP()
+// ######################################################################
+// All endpoints, without any listener middleware, for mounting the chat in
+// another program's HTTP server. Run still has to be running, with an
+// empty Listeners list if nothing else should be served.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
+}
+
+// ######################################################################
+// function: Run()
+// ######################################################################
+// Serves the configured listeners and runs the hub's background jobs until
+// ctx is done or a listener fails. On the way out the hub writes a last
+// snapshot and disconnects everyone.
+func (s *Server) Run(ctx context.Context) error {
+	if s.cfg.OTLPEndpoint != "" {
+		shutdown, err := telemetry.Start(ctx, s.cfg.OTLPEndpoint)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			// ctx is done by now, flushing gets its own deadline
+			flush, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := shutdown(flush); err != nil {
+				log.Printf("Error flushing telemetry: %v", err)
+			}
+		}()
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	wg.Add(4)
+	go func() {
+		defer wg.Done()
+		s.hub.Run(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		s.embedLimiter.cleanup(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		s.authLimiter.cleanup(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		s.hookLimiter.cleanup(ctx)
+	}()
+	if s.cfg.IRCAddr != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.serveIRC(ctx)
+		}()
+	}
+	if s.matrix != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.matrix.Run(ctx)
+		}()
+	}
+	if s.kafka != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.kafka.Run(ctx)
+		}()
+	}
+
+	err := s.serveListeners(ctx, s.cfg.Listeners, s)
+	cancel()
+	wg.Wait()
+	return err
+}
@@ -0,0 +1,3371 @@
+package chat_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go-chat-app/bot"
+	"go-chat-app/chat"
+	chatclient "go-chat-app/client"
+	"go-chat-app/internal/hub"
+	"go-chat-app/internal/matrix"
+	"go-chat-app/internal/preview"
+	"go-chat-app/internal/protocol"
+	"go-chat-app/internal/store"
+
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"golang.org/x/net/http2"
+)
+
+// Run with -race too, TestConcurrentClients is there to give the detector
+// something to chew on.
+
+// ######################################################################
+// function: startServer()
+// ######################################################################
+// Runs a server with its own data dir behind an httptest server on an
+// ephemeral port and returns the base URL. Everything is torn down when
+// the test ends. configure can change the config first.
+func startServer(t *testing.T, configure ...func(*chat.Config)) string {
+	t.Helper()
+	cfg := chat.DefaultConfig()
+	cfg.Listeners = []chat.ListenerConfig{} // httptest does the listening
+	cfg.DataDir = t.TempDir()
+	cfg.MaxConnsPerIP = 0
+	cfg.AckSampleRate = 0
+	cfg.UserCountInterval = 20 * time.Millisecond
+	cfg.LegacyWait = 0 // test clients don't say hello
+	for _, fn := range configure {
+		fn(&cfg)
+	}
+
+	srv := chat.New(cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- srv.Run(ctx) }()
+	ts := httptest.NewServer(srv)
+
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("Run: %v", err)
+		}
+		ts.Close()
+	})
+	return ts.URL
+}
+
+// ######################################################################
+// struct: testClient
+// ######################################################################
+type testClient struct {
+	t    *testing.T
+	conn *websocket.Conn
+}
+
+// ######################################################################
+// function: dial()
+// ######################################################################
+// Connects to the server's WebSocket, query is appended as is ("room=dev").
+func dial(t *testing.T, base, query string) *testClient {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(base, "http") + "/ws?" + query
+	conn, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial %s: %v", url, err)
+	}
+	resp.Body.Close()
+	t.Cleanup(func() { conn.Close() })
+	return &testClient{t: t, conn: conn}
+}
+
+func (c *testClient) send(text string) {
+	c.t.Helper()
+	if err := c.conn.WriteMessage(websocket.TextMessage, []byte(text)); err != nil {
+		c.t.Fatalf("send %q: %v", text, err)
+	}
+}
+
+// ######################################################################
+// function: expect()
+// ######################################################################
+// Reads frames until one matches, skipping the rest. Fails the test if none
+// does within a few seconds.
+func (c *testClient) expect(what string, match func(protocol.Frame) bool) protocol.Frame {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	defer c.conn.SetReadDeadline(time.Time{})
+	var seen []string
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			c.t.Fatalf("waiting for %s: %v (got %s)", what, err, strings.Join(seen, ", "))
+		}
+		var f protocol.Frame
+		if err := json.Unmarshal(data, &f); err != nil {
+			c.t.Fatalf("bad frame %s: %v", data, err)
+		}
+		if match(f) {
+			return f
+		}
+		seen = append(seen, string(data))
+	}
+}
+
+func isType(typ string) func(protocol.Frame) bool {
+	return func(f protocol.Frame) bool { return f.Type == typ }
+}
+
+func isCount(n int) func(protocol.Frame) bool {
+	return func(f protocol.Frame) bool { return f.Type == protocol.FrameUserCount && f.Count == n }
+}
+
+func isText(typ, text string) func(protocol.Frame) bool {
+	return func(f protocol.Frame) bool { return f.Type == typ && f.Text == text }
+}
+
+// ######################################################################
+// function: rename()
+// ######################################################################
+func (c *testClient) rename(name string) {
+	c.t.Helper()
+	c.send("/u " + name)
+	c.expect("rename to "+name, isText(protocol.FrameSystem, "Username set to "+name))
+}
+
+func TestBroadcastDelivery(t *testing.T) {
+	base := startServer(t)
+	alice := dial(t, base, "")
+	alice.expect("own join", isCount(1))
+	bob := dial(t, base, "")
+	alice.expect("bob joining", isCount(2))
+	alice.rename("alice")
+
+	alice.send("hello everyone")
+	got := bob.expect("alice's message", isType(protocol.FrameMessage))
+	if got.From != "alice" || got.Text != "hello everyone" || got.Room != "lobby" || got.ID == 0 {
+		t.Errorf("bob got %+v", got)
+	}
+	// the sender gets its own message back as confirmation, with the same ID
+	echo := alice.expect("own message", isType(protocol.FrameMessage))
+	if echo.ID != got.ID {
+		t.Errorf("echo has ID %d, bob saw %d", echo.ID, got.ID)
+	}
+}
+
+func TestRoomsAreSeparate(t *testing.T) {
+	base := startServer(t)
+	alice := dial(t, base, "room=dev")
+	bob := dial(t, base, "")
+	carol := dial(t, base, "room=dev")
+	name := carol.expect("session", isType(protocol.FrameSession)).From
+	alice.expect("carol joining", isText(protocol.FrameSystem, name+" joined #dev."))
+
+	bob.send("lobby only")
+	carol.send("dev only")
+	if f := alice.expect("carol's message", isType(protocol.FrameMessage)); f.Text != "dev only" {
+		t.Errorf("alice in #dev got %+v", f)
+	}
+	if f := bob.expect("own message", isType(protocol.FrameMessage)); f.Text != "lobby only" {
+		t.Errorf("bob in the lobby got %+v", f)
+	}
+}
+
+func TestUsernameChange(t *testing.T) {
+	base := startServer(t, func(cfg *chat.Config) { cfg.RenameCooldown = 0 }) // renames back to back
+	alice := dial(t, base, "")
+	bob := dial(t, base, "")
+	alice.expect("bob joining", isCount(2))
+
+	alice.rename("alice")
+	alice.send("first")
+	alice.rename("alicia")
+	alice.send("second")
+
+	if f := bob.expect("first message", isType(protocol.FrameMessage)); f.From != "alice" {
+		t.Errorf("first message from %q, want alice", f.From)
+	}
+	if f := bob.expect("second message", isType(protocol.FrameMessage)); f.From != "alicia" {
+		t.Errorf("second message from %q, want alicia", f.From)
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	base := startServer(t)
+	alice := dial(t, base, "")
+	bob := dial(t, base, "")
+	alice.expect("bob joining", isCount(2))
+	bob.rename("bob")
+
+	bob.send("/q")
+	alice.expect("bob leaving", isText(protocol.FrameSystem, "bob has left the chat."))
+	alice.expect("bob going offline", func(f protocol.Frame) bool {
+		return f.Type == protocol.FramePresence && f.From == "bob" && f.Text == "offline"
+	})
+	alice.expect("count going down", isCount(1))
+
+	// dropping the connection without /q is cleaned up the same way
+	carol := dial(t, base, "")
+	alice.expect("carol joining", isCount(2))
+	carol.conn.Close()
+	alice.expect("carol gone", isCount(1))
+}
+
+func TestUserCount(t *testing.T) {
+	base := startServer(t)
+	clients := []*testClient{dial(t, base, "")}
+	clients[0].expect("first count", isCount(1))
+	for n := 2; n <= 5; n++ {
+		clients = append(clients, dial(t, base, "room=elsewhere"))
+		for _, c := range clients {
+			c.expect(fmt.Sprintf("count %d", n), isCount(n)) // the count is server wide
+		}
+	}
+	clients[0].send("/join elsewhere")
+	f := clients[1].expect("room counts", func(f protocol.Frame) bool {
+		return f.Type == protocol.FrameUserCount && f.Rooms["elsewhere"] == 5
+	})
+	if f.Count != 5 || len(f.Rooms) != 1 {
+		t.Errorf("after everyone moved: %+v", f)
+	}
+	for n := 4; n >= 1; n-- {
+		clients[n].conn.Close()
+		clients = clients[:n]
+		for _, c := range clients {
+			c.expect(fmt.Sprintf("count %d", n), isCount(n))
+		}
+	}
+}
+
+func TestUserCountCoalesced(t *testing.T) {
+	base := startServer(t)
+	first := dial(t, base, "")
+	first.expect("own join", isCount(1))
+
+	// a reconnect storm should not mean one frame per connection
+	for i := 0; i < 10; i++ {
+		dial(t, base, "")
+	}
+	frames := 0
+	f := first.expect("count after the storm", func(f protocol.Frame) bool {
+		if f.Type == protocol.FrameUserCount {
+			frames++
+		}
+		return f.Type == protocol.FrameUserCount && f.Count == 11
+	})
+	if frames >= 10 {
+		t.Errorf("got %d user_count frames for 10 connects", frames)
+	}
+	if f.Rooms["lobby"] != 11 {
+		t.Errorf("lobby count %d, want 11", f.Rooms["lobby"])
+	}
+}
+
+func TestConcurrentClients(t *testing.T) {
+	base := startServer(t)
+	const n = 20
+	rooms := []string{"lobby", "dev", "random"}
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		url := "ws" + strings.TrimPrefix(base, "http") + "/ws?room=" + rooms[i%len(rooms)]
+		conn, resp, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		resp.Body.Close()
+
+		// drain whatever the server sends so no write ever blocks on us
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer conn.Close()
+			lines := []string{
+				fmt.Sprintf("/u user%d", i),
+				"hello from " + fmt.Sprint(i),
+				"/join " + rooms[(i+1)%len(rooms)],
+				`{"type":"heartbeat","state":"focused"}`,
+				"/reply 1 a reply",
+				"/react 1 👍",
+				"/topic",
+				"/lang no",
+				"bye",
+				"/q",
+			}
+			for _, line := range lines {
+				if err := conn.WriteMessage(websocket.TextMessage, []byte(line)); err != nil {
+					return
+				}
+			}
+		}(i)
+	}
+
+	// the HTTP side reads the same state while all of that goes on
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			resp, err := http.Get(base + "/api/rooms")
+			if err != nil {
+				t.Errorf("GET /api/rooms: %v", err)
+				return
+			}
+			resp.Body.Close()
+		}
+	}()
+
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(10 * time.Second):
+		t.Fatal("clients did not finish, hub deadlocked?")
+	}
+}
+
+func TestHealthAndReadiness(t *testing.T) {
+	cfg := chat.DefaultConfig()
+	cfg.Listeners = []chat.ListenerConfig{}
+	cfg.DataDir = t.TempDir()
+	srv := chat.New(cfg)
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	get := func(path string) int {
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := get("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("readyz before Run = %d", code)
+	}
+	if code := get("/healthz"); code != http.StatusOK {
+		t.Errorf("healthz = %d", code)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- srv.Run(ctx) }()
+	deadline := time.Now().Add(3 * time.Second)
+	for get("/readyz") != http.StatusOK {
+		if time.Now().After(deadline) {
+			t.Fatal("never became ready")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	<-done
+	if code := get("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("readyz after shutdown = %d", code)
+	}
+}
+
+func TestListeners(t *testing.T) {
+	for v, want := range map[string]chat.ListenerConfig{
+		"127.0.0.1:8080":      {Addr: "127.0.0.1:8080"},
+		"8080":                {Addr: ":8080"},
+		"[::1]:80":            {Addr: "[::1]:80"},
+		"unix:/run/chat.sock": {Network: "unix", Addr: "/run/chat.sock"},
+	} {
+		if got, err := chat.ParseListen(v); err != nil || got.Network != want.Network || got.Addr != want.Addr {
+			t.Errorf("ParseListen(%q) = %+v, %v", v, got, err)
+		}
+	}
+	for _, v := range []string{"localhost", "unix:", "host:"} {
+		if _, err := chat.ParseListen(v); err == nil {
+			t.Errorf("ParseListen(%q) took it", v)
+		}
+	}
+
+	// a socket and a port at once, like behind nginx with a local port for checks
+	sock := filepath.Join(t.TempDir(), "chat.sock")
+	cfg := chat.DefaultConfig()
+	cfg.Listeners = []chat.ListenerConfig{{Network: "unix", Addr: sock, Mode: "0660"}, {Addr: "127.0.0.1:0"}}
+	cfg.DataDir = t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- chat.New(cfg).Run(ctx) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	client := &http.Client{Transport: &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+	}}}
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		resp, err := client.Get("http://chat/healthz")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("healthz over the socket = %d", resp.StatusCode)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("socket never answered: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if fi, err := os.Stat(sock); err != nil {
+		t.Error(err)
+	} else if fi.Mode().Perm() != 0o660 {
+		t.Errorf("socket mode = %v", fi.Mode().Perm())
+	}
+}
+
+func TestCompression(t *testing.T) {
+	base := startServer(t, func(cfg *chat.Config) { cfg.Compression = true })
+	dialer := websocket.Dialer{EnableCompression: true}
+	conn, resp, err := dialer.Dial("ws"+strings.TrimPrefix(base, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	resp.Body.Close()
+	defer conn.Close()
+	if ext := resp.Header.Get("Sec-Websocket-Extensions"); !strings.Contains(ext, "permessage-deflate") {
+		t.Fatalf("deflate not negotiated: %q", ext)
+	}
+
+	c := &testClient{t: t, conn: conn}
+	long := strings.Repeat("compress me ", 100) + "!" // well over the threshold
+	c.send(long)
+	if f := c.expect("own message", isType(protocol.FrameMessage)); f.Text != long {
+		t.Errorf("message came back as %d bytes", len(f.Text))
+	}
+	c.send("short")
+	c.expect("short message", isText(protocol.FrameMessage, "short"))
+}
+
+func TestProtobufClient(t *testing.T) {
+	base := startServer(t)
+	dialer := websocket.Dialer{Subprotocols: []string{protocol.SubprotocolProto}}
+	conn, resp, err := dialer.Dial("ws"+strings.TrimPrefix(base, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	resp.Body.Close()
+	defer conn.Close()
+	if conn.Subprotocol() != protocol.SubprotocolProto {
+		t.Fatalf("negotiated %q", conn.Subprotocol())
+	}
+	jsonClient := dial(t, base, "")
+
+	next := func(want, text string) protocol.Frame {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		for {
+			typ, data, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatalf("waiting for %s: %v", want, err)
+			}
+			if typ != websocket.BinaryMessage {
+				t.Fatalf("got a text frame: %s", data)
+			}
+			f, err := protocol.UnmarshalFrameProto(data)
+			if err != nil {
+				t.Fatalf("bad frame: %v", err)
+			}
+			if f.Type == want && (text == "" || f.Text == text) {
+				return f
+			}
+		}
+	}
+
+	// commands still work as text, structured frames go binary
+	conn.WriteMessage(websocket.TextMessage, []byte("/u native"))
+	next(protocol.FrameSystem, "Username set to native")
+	cf := protocol.ClientFrame{Type: protocol.ClientMessage, Text: "sent as protobuf"}
+	conn.WriteMessage(websocket.BinaryMessage, cf.MarshalProto())
+	if f := next(protocol.FrameMessage, ""); f.Text != cf.Text || f.From != "native" {
+		t.Errorf("echo %+v", f)
+	}
+	// and JSON clients in the same room see it as usual
+	if f := jsonClient.expect("the message", isType(protocol.FrameMessage)); f.Text != cf.Text {
+		t.Errorf("json client got %+v", f)
+	}
+}
+
+func TestProtocolVersions(t *testing.T) {
+	base := startServer(t)
+	connect := func(subprotocols ...string) (*testClient, string) {
+		t.Helper()
+		dialer := websocket.Dialer{Subprotocols: subprotocols}
+		conn, resp, err := dialer.Dial("ws"+strings.TrimPrefix(base, "http")+"/ws", nil)
+		if err != nil {
+			t.Fatalf("dial %v: %v", subprotocols, err)
+		}
+		resp.Body.Close()
+		t.Cleanup(func() { conn.Close() })
+		return &testClient{t: t, conn: conn}, conn.Subprotocol()
+	}
+
+	// the client's preference wins, unknown versions are skipped
+	v2, got := connect("chat.v9", protocol.SubprotocolV2, protocol.SubprotocolV1)
+	if got != protocol.SubprotocolV2 {
+		t.Fatalf("negotiated %q, want %q", got, protocol.SubprotocolV2)
+	}
+	v2.send("/u newbot")
+	if f := v2.expect("rename", isText(protocol.FrameSystem, "Username set to newbot")); f.Key != "Username set to %s" {
+		t.Errorf("v2 frame has key %q", f.Key)
+	}
+
+	// old clients ask for nothing, or for something we never spoke
+	for _, offer := range [][]string{nil, {"chat.v0"}} {
+		v1, got := connect(offer...)
+		if got != "" {
+			t.Fatalf("negotiated %q for %v", got, offer)
+		}
+		v1.send("/u oldie")
+		if f := v1.expect("rename", isText(protocol.FrameSystem, "Username set to oldie")); f.Key != "" {
+			t.Errorf("v1 frame has key %q", f.Key)
+		}
+	}
+}
+
+func TestRoomBanner(t *testing.T) {
+	base := startServer(t)
+	mod := dial(t, base, "room=ops") // creating the room makes you its moderator
+	mod.expect("own join", isCount(1))
+	mod.rename("mod")
+	mod.send("/banner incident payments are down")
+	got := mod.expect("banner", isType(protocol.FrameBanner))
+	if b := got.Banner; b == nil || b.Text != "payments are down" || b.Level != protocol.BannerIncident || b.SetBy != "mod" {
+		t.Fatalf("banner frame %+v", got)
+	}
+
+	// late joiners get it right away, but can't change it
+	member := dial(t, base, "room=ops")
+	if got := member.expect("banner on join", isType(protocol.FrameBanner)); got.Banner == nil || got.Banner.Text != "payments are down" {
+		t.Errorf("joined with banner %+v", got.Banner)
+	}
+	member.send("/banner -")
+	member.expect("refusal", isText(protocol.FrameError, "Only moderators can change the banner."))
+
+	mod.send("/banner -")
+	if got := member.expect("cleared banner", isType(protocol.FrameBanner)); got.Banner != nil {
+		t.Errorf("banner not cleared: %+v", got.Banner)
+	}
+}
+
+func TestSessionResume(t *testing.T) {
+	base := startServer(t)
+	alice := dial(t, base, "room=dev")
+	sid := alice.expect("session", isType(protocol.FrameSession)).Token
+	alice.rename("alice")
+	bob := dial(t, base, "room=dev")
+	alice.expect("bob joining", isCount(2))
+
+	bob.send("before the blip")
+	seen := alice.expect("first message", isType(protocol.FrameMessage))
+	alice.conn.Close() // no close frame, like a dead network
+
+	bob.send("missed one")
+	bob.send("missed two")
+	bob.expect("own echo", isText(protocol.FrameMessage, "missed two"))
+
+	back := dial(t, base, fmt.Sprintf("sid=%s&last=%d", sid, seen.ID))
+	if got := back.expect("session", isType(protocol.FrameSession)).Token; got != sid {
+		t.Errorf("resumed with session %q, want %q", got, sid)
+	}
+	for _, text := range []string{"missed one", "missed two"} {
+		if f := back.expect(text, isType(protocol.FrameMessage)); f.Text != text || f.Room != "dev" {
+			t.Errorf("replayed %+v, want %q in dev", f, text)
+		}
+	}
+	// still alice, no /u needed
+	back.send("I'm back")
+	if f := bob.expect("alice's message", isText(protocol.FrameMessage, "I'm back")); f.From != "alice" {
+		t.Errorf("message from %q after resume", f.From)
+	}
+}
+
+func TestLegacyClient(t *testing.T) {
+	base := startServer(t, func(cfg *chat.Config) { cfg.LegacyWait = 100 * time.Millisecond })
+	legacy, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(base, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer legacy.Close()
+	line := func(want string) {
+		t.Helper()
+		legacy.SetReadDeadline(time.Now().Add(3 * time.Second))
+		var seen []string
+		for {
+			_, data, err := legacy.ReadMessage()
+			if err != nil {
+				t.Fatalf("waiting for %q: %v (got %q)", want, err, seen)
+			}
+			if string(data) == want {
+				return
+			}
+			seen = append(seen, string(data))
+		}
+	}
+	line("UC1") // silent for LegacyWait, so plain text it is
+
+	// a JSON client says hello right away and keeps its frames
+	modern := dial(t, base, "")
+	modern.send(`{"type":"hello"}`)
+	modern.expect("count", isCount(2))
+	line("UC2")
+
+	legacy.WriteMessage(websocket.TextMessage, []byte("hi from 2019"))
+	f := modern.expect("legacy message", isText(protocol.FrameMessage, "hi from 2019"))
+	line(f.From + ": hi from 2019")
+}
+
+func TestLegacyCutoff(t *testing.T) {
+	base := startServer(t, func(cfg *chat.Config) {
+		cfg.LegacyWait = time.Second
+		cfg.LegacyUntil = time.Now().Add(-time.Hour)
+	})
+	legacy, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(base, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer legacy.Close()
+	legacy.WriteMessage(websocket.TextMessage, []byte("/u oldtimer")) // a plain line first gives it away too
+	legacy.SetReadDeadline(time.Now().Add(3 * time.Second))
+	_, _, err = legacy.ReadMessage()
+	if !websocket.IsCloseError(err, protocol.CloseUpgradeRequired) {
+		t.Errorf("got %v, want close %d", err, protocol.CloseUpgradeRequired)
+	}
+}
+
+func TestBotSubscriptions(t *testing.T) {
+	base := startServer(t)
+	bot := dial(t, base, "")
+	human := dial(t, base, "")
+	bot.expect("human joining", isCount(2))
+
+	bot.send(`{"type":"subscribe","commands":["weather"],"patterns":["(?i)incident"]}`)
+	bot.expect("confirmation", isText(protocol.FrameSystem, "Subscribed to 1 commands and 1 patterns."))
+
+	for _, line := range []string{"just chatting", "!weather oslo", "nothing here", "INCIDENT in prod"} {
+		human.send(line)
+	}
+	for _, want := range []string{"!weather oslo", "INCIDENT in prod"} {
+		if f := bot.expect(want, isType(protocol.FrameMessage)); f.Text != want {
+			t.Errorf("bot got %q, want %q", f.Text, want)
+		}
+	}
+
+	bot.send("/unsubscribe")
+	bot.expect("unsubscribed", isText(protocol.FrameSystem, "Subscription removed, you get every message again."))
+	human.send("still just chatting")
+	bot.expect("everything again", isText(protocol.FrameMessage, "still just chatting"))
+}
+
+func TestDuplicateMessages(t *testing.T) {
+	base := startServer(t)
+	spammer := dial(t, base, "")
+	spammer.expect("joined", isCount(1))
+
+	spammer.send("buy cheap stuff")
+	spammer.expect("first copy", isText(protocol.FrameMessage, "buy cheap stuff"))
+	spammer.send("buy cheap stuff")
+	spammer.expect("duplicate", isText(protocol.FrameError, "duplicate message"))
+
+	// the same line is fine in another room
+	spammer.send("/join elsewhere")
+	spammer.send("buy cheap stuff")
+	spammer.expect("other room", isText(protocol.FrameMessage, "buy cheap stuff"))
+}
+
+func TestPasswordAccounts(t *testing.T) {
+	base := startServer(t)
+	post := func(path, body string) (*http.Response, map[string]any) {
+		t.Helper()
+		resp, err := http.Post(base+path, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("POST %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		var out map[string]any
+		json.NewDecoder(resp.Body).Decode(&out)
+		return resp, out
+	}
+
+	if resp, _ := post("/api/register", `{"username":"kari","password":"hunter22"}`); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("register: %s", resp.Status)
+	}
+	if resp, _ := post("/api/register", `{"username":"kari","password":"something"}`); resp.StatusCode != http.StatusConflict {
+		t.Errorf("register taken name: %s", resp.Status)
+	}
+	if resp, _ := post("/api/login", `{"username":"kari","password":"wrong one"}`); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("login with wrong password: %s", resp.Status)
+	}
+	resp, out := post("/api/login", `{"username":"kari","password":"hunter22"}`)
+	token, _ := out["token"].(string)
+	if resp.StatusCode != http.StatusOK || token == "" {
+		t.Fatalf("login: %s %v", resp.Status, out)
+	}
+
+	guest := dial(t, base, "")
+	guest.expect("joined", isCount(1))
+	guest.send("/u kari")
+	guest.expect("name refused", isText(protocol.FrameError, "that name is registered, log in to use it"))
+
+	kari := dial(t, base, "login="+token)
+	kari.expect("joined", isCount(2))
+	kari.send("hei")
+	if f := guest.expect("kari's message", isType(protocol.FrameMessage)); f.From != "kari" {
+		t.Errorf("message from %q, want kari", f.From)
+	}
+
+	url := "ws" + strings.TrimPrefix(base, "http") + "/ws?login=bogus"
+	if _, resp, err := websocket.DefaultDialer.Dial(url, nil); err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("dial with a bad token: %v", err)
+	}
+}
+
+func TestOAuthStart(t *testing.T) {
+	base := startServer(t, func(cfg *chat.Config) {
+		cfg.OAuth = map[string]chat.OAuthApp{"github": {ClientID: "app123", ClientSecret: "secret"}}
+	})
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	get := func(path string) *http.Response {
+		t.Helper()
+		resp, err := client.Get(base + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := get("/auth/github")
+	loc := resp.Header.Get("Location")
+	if resp.StatusCode != http.StatusFound || !strings.HasPrefix(loc, "https://github.com/login/oauth/authorize?") ||
+		!strings.Contains(loc, "client_id=app123") || !strings.Contains(loc, "state=") {
+		t.Errorf("start: %s to %s", resp.Status, loc)
+	}
+	if resp := get("/auth/google"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unconfigured provider: %s", resp.Status)
+	}
+	if resp := get("/auth/github/callback?state=forged&code=x"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("callback with a forged state: %s", resp.Status)
+	}
+
+	// a real state, but in a browser that didn't start the sign in
+	u, _ := url.Parse(loc)
+	state := u.Query().Get("state")
+	var cookie *http.Cookie
+	for _, c := range resp.Cookies() {
+		if c.Name == "chat_oauth_state" {
+			cookie = c
+		}
+	}
+	if cookie == nil || cookie.Value != state || !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode {
+		t.Fatalf("state cookie %+v for state %q", cookie, state)
+	}
+	if resp := get("/auth/github/callback?state=" + state + "&code=x"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("callback without the state cookie: %s", resp.Status)
+	}
+	req, _ := http.NewRequest(http.MethodGet, base+"/auth/github/callback?state="+state+"&code=x", nil)
+	req.AddCookie(&http.Cookie{Name: "chat_oauth_state", Value: "someone-elses"})
+	if resp, err := client.Do(req); err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("callback with another state cookie: %v %v", err, resp.Status)
+	}
+}
+
+func TestWebhookFilters(t *testing.T) {
+	received := make(chan string, 16) // "<path> <type> <room> <text>"
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev struct{ Type, Room, Text string }
+		json.NewDecoder(r.Body).Decode(&ev)
+		received <- strings.TrimSpace(fmt.Sprintf("%s %s %s %s", r.URL.Path, ev.Type, ev.Room, ev.Text))
+	}))
+	defer receiver.Close()
+
+	base := startServer(t, func(cfg *chat.Config) { cfg.AdminToken = "secret" })
+	addHook := func(body string) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, base+"/admin/webhooks", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil || resp.StatusCode != http.StatusCreated {
+			t.Fatalf("adding webhook %s: %v %v", body, err, resp.Status)
+		}
+		resp.Body.Close()
+	}
+	addHook(`{"url":"` + receiver.URL + `/dev-messages","events":["message"],"rooms":["#Dev"]}`)
+	addHook(`{"url":"` + receiver.URL + `/joins","events":["join"]}`)
+	addHook(`{"url":"` + receiver.URL + `/renames","events":["rename"]}`)
+
+	alice := dial(t, base, "room=dev")
+	alice.expect("joined", isCount(1))
+	bob := dial(t, base, "")
+	alice.expect("bob joining", isCount(2))
+	bob.send("hello lobby")
+	bob.expect("own message", isType(protocol.FrameMessage))
+	alice.send("hello dev")
+	alice.expect("own message", isType(protocol.FrameMessage))
+	bob.rename("bob")
+
+	want := map[string]bool{"/joins join dev": true, "/joins join lobby": true, "/dev-messages message dev hello dev": true, "/renames rename lobby bob": true}
+	deadline := time.After(3 * time.Second)
+	for len(want) > 0 {
+		select {
+		case got := <-received:
+			if !want[got] {
+				t.Errorf("unexpected delivery %q", got)
+			}
+			delete(want, got)
+		case <-deadline:
+			t.Fatalf("never got %v", want)
+		}
+	}
+	select {
+	case got := <-received:
+		t.Errorf("unexpected delivery %q", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWebhookSignedRetries(t *testing.T) {
+	type delivery struct {
+		id, ts, sig string
+		body        []byte
+	}
+	received := make(chan delivery, 4)
+	var failed atomic.Bool
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- delivery{r.Header.Get("X-Chat-Delivery"), r.Header.Get("X-Chat-Timestamp"), r.Header.Get("X-Chat-Signature"), body}
+		if !failed.Swap(true) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer receiver.Close()
+
+	base := startServer(t, func(cfg *chat.Config) { cfg.AdminToken = "secret" })
+	post := func(path, body string, out any) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, base+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil || resp.StatusCode != http.StatusCreated {
+			t.Fatalf("POST %s: %v %v", path, err, resp.Status)
+		}
+		defer resp.Body.Close()
+		if out != nil {
+			json.NewDecoder(resp.Body).Decode(out)
+		}
+	}
+	var hook struct{ Secret string }
+	post("/admin/webhooks", `{"url":"`+receiver.URL+`","events":["ban"]}`, &hook)
+	if len(hook.Secret) < 32 {
+		t.Fatalf("secret %q", hook.Secret)
+	}
+	post("/admin/bans", `{"ip":"192.0.2.7","duration":"1h","reason":"spam"}`, nil)
+
+	var got []delivery
+	for len(got) < 2 {
+		select {
+		case d := <-received:
+			got = append(got, d)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %d deliveries, want a failed one and a retry", len(got))
+		}
+	}
+	if got[0].id == "" || got[0].id != got[1].id || !bytes.Equal(got[0].body, got[1].body) {
+		t.Errorf("retry isn't the same delivery: %q %q", got[0].id, got[1].id)
+	}
+	for _, d := range got {
+		mac := hmac.New(sha256.New, []byte(hook.Secret))
+		mac.Write([]byte(d.ts + "."))
+		mac.Write(d.body)
+		if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); d.sig != want {
+			t.Errorf("signature %q, want %q", d.sig, want)
+		}
+	}
+	var ev struct{ Type, Action, IP, Text string }
+	json.Unmarshal(got[1].body, &ev)
+	if ev.Type != "ban" || ev.Action != "admin" || ev.IP != "192.0.2.7" || ev.Text != "spam" {
+		t.Errorf("event %+v", ev)
+	}
+}
+
+func TestIncomingHook(t *testing.T) {
+	base := startServer(t, func(cfg *chat.Config) { cfg.AdminToken = "secret" })
+	req, _ := http.NewRequest(http.MethodPost, base+"/admin/hooks", strings.NewReader(`{"room":"#Ops","name":"ci"}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("adding hook: %v %v", err, resp.Status)
+	}
+	var hook struct{ Token, Room string }
+	json.NewDecoder(resp.Body).Decode(&hook)
+	resp.Body.Close()
+	if hook.Token == "" || hook.Room != "ops" {
+		t.Fatalf("hook %+v", hook)
+	}
+
+	alice := dial(t, base, "room=ops")
+	alice.expect("joined", isCount(1))
+	post := func(token, contentType, body string) int {
+		t.Helper()
+		resp, err := http.Post(base+"/hooks/"+token, contentType, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("posting to hook: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := post(hook.Token, "application/json", `{"text":"build 42 passed"}`); code != http.StatusOK {
+		t.Fatalf("json post: %d", code)
+	}
+	f := alice.expect("hook message", isText(protocol.FrameMessage, "build 42 passed"))
+	if f.From != "ci (hook)" || f.ID == 0 {
+		t.Errorf("posted as %q with id %d", f.From, f.ID)
+	}
+	form := "payload=" + url.QueryEscape(`{"text":"disk full","username":"alerts"}`)
+	if code := post(hook.Token, "application/x-www-form-urlencoded", form); code != http.StatusOK {
+		t.Fatalf("form post: %d", code)
+	}
+	if f := alice.expect("form message", isText(protocol.FrameMessage, "disk full")); f.From != "alerts (hook)" {
+		t.Errorf("form post from %q", f.From)
+	}
+	if code := post("nope", "application/json", `{"text":"hi"}`); code != http.StatusNotFound {
+		t.Errorf("unknown token: %d", code)
+	}
+	if code := post(hook.Token, "application/json", `{"text":"  "}`); code != http.StatusBadRequest {
+		t.Errorf("empty text: %d", code)
+	}
+}
+
+func TestBotAPI(t *testing.T) {
+	base := startServer(t, func(cfg *chat.Config) { cfg.AdminToken = "secret" })
+	createBot := func(body string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, base+"/admin/bots", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("creating bot: %v", err)
+		}
+		defer resp.Body.Close()
+		var out struct{ Key string }
+		json.NewDecoder(resp.Body).Decode(&out)
+		return resp.StatusCode, out.Key
+	}
+	code, key := createBot(`{"name":"dicebot","commands":["!Roll"]}`)
+	if code != http.StatusCreated || key == "" {
+		t.Fatalf("create: %d %q", code, key)
+	}
+	if code, _ := createBot(`{"name":"otherbot","commands":["roll"]}`); code != http.StatusBadRequest {
+		t.Errorf("second bot for !roll: %d", code)
+	}
+
+	alice := dial(t, base, "room=dev")
+	alice.expect("joined", isCount(1))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wsURL := "ws" + strings.TrimPrefix(base, "http") + "/ws"
+	b := bot.New(wsURL, key)
+	b.Room = "dev"
+	heard := make(chan string, 4)
+	b.Command("roll", func(m *bot.Message) {
+		heard <- m.Text
+		m.Reply("you rolled 4")
+	})
+	b.OnMessage(func(m *bot.Message) { heard <- m.Text })
+	go b.Run(ctx)
+	alice.expect("bot joining", isCount(2))
+
+	alice.send("hello bot")
+	alice.send("!roll 20")
+	f := alice.expect("bot reply", isText(protocol.FrameMessage, "you rolled 4"))
+	if f.From != "dicebot" || f.ReplyTo == 0 {
+		t.Errorf("reply from %q to %d", f.From, f.ReplyTo)
+	}
+	if got := <-heard; got != "!roll 20" {
+		t.Errorf("bot heard %q, only its command should reach it", got)
+	}
+
+	alice.send("/help")
+	alice.expect("bot commands in help", isText(protocol.FrameSystem, "!roll - answered by dicebot"))
+
+	if err := bot.New(wsURL, "nope.nope").Run(ctx); !errors.Is(err, bot.ErrBadKey) {
+		t.Errorf("bad key: %v", err)
+	}
+}
+
+func TestIRCGateway(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	base := startServer(t, func(cfg *chat.Config) { cfg.IRCAddr = addr })
+
+	var conn net.Conn
+	for start := time.Now(); conn == nil; time.Sleep(10 * time.Millisecond) {
+		if conn, err = net.Dial("tcp", addr); err != nil && time.Since(start) > 3*time.Second {
+			t.Fatalf("dial irc: %v", err)
+		}
+	}
+	defer conn.Close()
+	lines := bufio.NewReader(conn)
+	expectLine := func(what, want string) {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		var seen []string
+		for {
+			line, err := lines.ReadString('\n')
+			if err != nil {
+				t.Fatalf("waiting for %s: %v (got %q)", what, err, seen)
+			}
+			if strings.Contains(line, want) {
+				return
+			}
+			seen = append(seen, strings.TrimSpace(line))
+		}
+	}
+
+	alice := dial(t, base, "")
+	alice.rename("alice")
+	fmt.Fprintf(conn, "NICK kari\r\nUSER kari 0 * :Kari\r\n")
+	expectLine("welcome", " 001 kari ")
+	expectLine("lobby", ":kari!kari@tempchat JOIN #lobby")
+	alice.expect("rename to kari", func(f protocol.Frame) bool { return f.Type == protocol.FrameRename && f.Text == "kari" })
+
+	fmt.Fprintf(conn, "PRIVMSG #lobby :hei fra irc\r\n")
+	if f := alice.expect("irc line", isText(protocol.FrameMessage, "hei fra irc")); f.From != "kari" {
+		t.Errorf("irc line from %q", f.From)
+	}
+	alice.send("hello irc")
+	expectLine("web line", ":alice!alice@tempchat PRIVMSG #lobby :hello irc")
+	alice.send("/msg kari psst")
+	expectLine("direct message", ":alice!alice@tempchat PRIVMSG kari :psst")
+
+	fmt.Fprintf(conn, "JOIN #dev\r\n")
+	expectLine("part", ":kari!kari@tempchat PART #lobby")
+	expectLine("join", ":kari!kari@tempchat JOIN #dev")
+	expectLine("names", " 353 kari = #dev :kari")
+	alice.expect("kari leaving", isText(protocol.FrameSystem, "kari left #lobby."))
+	fmt.Fprintf(conn, "PRIVMSG #lobby :wrong room\r\n")
+	expectLine("not on channel", " 404 kari #lobby ")
+
+	// a line break in a topic stays in the topic
+	alice.send("/join ops")
+	alice.expect("ops", isText(protocol.FrameSystem, "You are now in #ops"))
+	alice.send("/topic hi\r\nQUIT :owned")
+	alice.expect("topic", isType(protocol.FrameTopicChanged))
+	fmt.Fprintf(conn, "JOIN #ops\r\n")
+	expectLine("topic", " 332 kari #ops :hi QUIT :owned\r\n")
+	alice.send("/topic bye\nQUIT :owned")
+	expectLine("topic change", ":alice!alice@tempchat TOPIC #ops :bye QUIT :owned\r\n")
+}
+
+func TestAdminKick(t *testing.T) {
+	base := startServer(t, func(cfg *chat.Config) { cfg.AdminToken = "secret" })
+	admin := func(method, path string, out any) int {
+		t.Helper()
+		req, _ := http.NewRequest(method, base+path, nil)
+		req.SetBasicAuth("admin", "secret") // what the dashboard's browser sends
+		req.Header.Set("X-Chat-Admin", "1")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		if out != nil {
+			json.NewDecoder(resp.Body).Decode(out)
+		}
+		return resp.StatusCode
+	}
+
+	resp, err := http.Get(base + "/admin/connections")
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") == "" {
+		t.Fatalf("without credentials: %v %v", err, resp.Status)
+	}
+	resp.Body.Close()
+
+	alice := dial(t, base, "")
+	alice.rename("alice")
+	alice.send("hi")
+	alice.expect("own message", isType(protocol.FrameMessage))
+
+	var conns []struct {
+		ID       int64
+		Username string
+	}
+	admin(http.MethodGet, "/admin/connections", &conns)
+	if len(conns) != 1 || conns[0].Username != "alice" {
+		t.Fatalf("connections: %+v", conns)
+	}
+	var stats struct{ Messages int64 }
+	if admin(http.MethodGet, "/admin/stats", &stats); stats.Messages != 1 {
+		t.Errorf("%d messages, want 1", stats.Messages)
+	}
+
+	// a cross site form would come with the cached credentials, but not the header
+	req, _ := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/admin/connections?id=%d", base, conns[0].ID), nil)
+	req.SetBasicAuth("admin", "secret")
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("kick without the header: %v %v", err, resp.Status)
+	}
+	if status := admin(http.MethodDelete, fmt.Sprintf("/admin/connections?id=%d", conns[0].ID), nil); status != http.StatusNoContent {
+		t.Fatalf("kick: %d", status)
+	}
+	alice.expect("kick notice", isText(protocol.FrameSystem, "You were kicked by an admin."))
+	if status := admin(http.MethodDelete, fmt.Sprintf("/admin/connections?id=%d", conns[0].ID), nil); status != http.StatusNotFound {
+		t.Errorf("kicking again: %d", status)
+	}
+}
+
+func TestClientRefresh(t *testing.T) {
+	base := startServer(t, func(cfg *chat.Config) { cfg.AdminToken = "secret" })
+	c := dial(t, base, "")
+	c.expect("joined", isCount(1))
+
+	req, _ := http.NewRequest(http.MethodPost, base+"/admin/refresh", strings.NewReader(`{"max_delay":"10s"}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("refresh: %v %v", err, resp.Status)
+	}
+	resp.Body.Close()
+	if f := c.expect("refresh", isType(protocol.FrameRefresh)); f.WaitMs < 0 || f.WaitMs >= 10000 {
+		t.Errorf("told to wait %dms, want under 10s", f.WaitMs)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	base := startServer(t, func(cfg *chat.Config) { cfg.AdminToken = "secret" })
+	admin := func(method, path, body string, out any) {
+		t.Helper()
+		req, _ := http.NewRequest(method, base+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil || resp.StatusCode >= 300 {
+			t.Fatalf("%s %s: %v %v", method, path, err, resp.Status)
+		}
+		defer resp.Body.Close()
+		if out != nil {
+			json.NewDecoder(resp.Body).Decode(out)
+		}
+	}
+
+	c := dial(t, base, "")
+	guest := c.expect("session", isType(protocol.FrameSession)).From
+	c.rename("mallory")
+	admin(http.MethodPost, "/admin/bans", `{"ip":"192.0.2.7","duration":"1h","reason":"spam"}`, nil)
+
+	type entry struct{ Actor, Action, Target, Reason string }
+	var bans []entry
+	admin(http.MethodGet, "/admin/audit?action=ban", "", &bans)
+	if len(bans) != 1 || bans[0] != (entry{"admin", "ban", "192.0.2.7", "spam"}) {
+		t.Errorf("bans: %+v", bans)
+	}
+
+	// newest first: the ban, the API call that made it, then the rename
+	var all []entry
+	admin(http.MethodGet, "/admin/audit", "", &all)
+	var actions []string
+	for _, e := range all {
+		actions = append(actions, e.Action)
+	}
+	if got := strings.Join(actions, ","); got != "ban,admin_api,rename" {
+		t.Errorf("actions %s", got)
+	}
+	if all[2].Actor != guest || all[2].Target != "mallory" {
+		t.Errorf("rename: %+v", all[2])
+	}
+}
+
+func TestRenameCooldown(t *testing.T) {
+	base := startServer(t)
+	alice := dial(t, base, "")
+	bob := dial(t, base, "")
+	guest := alice.expect("session", isType(protocol.FrameSession)).From
+	alice.expect("bob joining", isCount(2))
+
+	alice.rename("alice")
+	if f := bob.expect("rename", isType(protocol.FrameRename)); f.From != guest || f.Text != "alice" {
+		t.Errorf("rename from %q to %q", f.From, f.Text)
+	}
+	alice.send("/u alicia")
+	alice.expect("cooldown", isText(protocol.FrameError, "You can change your name again in 5m0s."))
+}
+
+func TestBandwidthUsage(t *testing.T) {
+	base := startServer(t, func(cfg *chat.Config) { cfg.AdminToken = "secret" })
+	c := dial(t, base, "")
+	c.send("hello there")
+	c.expect("own message", isType(protocol.FrameMessage))
+
+	req, _ := http.NewRequest(http.MethodGet, base+"/admin/bandwidth", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("bandwidth: %v %v", err, resp.Status)
+	}
+	defer resp.Body.Close()
+	var usage []struct {
+		User           string
+		Sent, Received int64
+	}
+	json.NewDecoder(resp.Body).Decode(&usage)
+	if len(usage) != 1 || usage[0].User != "ip:127.0.0.1" || usage[0].Sent == 0 || usage[0].Received < int64(len("hello there")) {
+		t.Errorf("usage: %+v", usage)
+	}
+}
+
+func TestAccountExportAndDelete(t *testing.T) {
+	base := startServer(t)
+	resp, err := http.Post(base+"/api/register", "application/json", strings.NewReader(`{"username":"kari","password":"hunter22"}`))
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("register: %v %v", err, resp.Status)
+	}
+	var reg struct{ Token string }
+	json.NewDecoder(resp.Body).Decode(&reg)
+	resp.Body.Close()
+	call := func(method, path string, out any) int {
+		t.Helper()
+		req, _ := http.NewRequest(method, base+path, nil)
+		req.Header.Set("Authorization", "Bearer "+reg.Token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		if out != nil {
+			json.NewDecoder(resp.Body).Decode(out)
+		}
+		return resp.StatusCode
+	}
+
+	other := dial(t, base, "")
+	other.expect("joined", isCount(1))
+	kari := dial(t, base, "login="+reg.Token)
+	kari.expect("joined", isCount(2))
+	kari.send("my own words")
+	msg := other.expect("kari's message", isType(protocol.FrameMessage))
+
+	var export struct{ Messages []protocol.Frame }
+	if status := call(http.MethodGet, "/api/account/export", &export); status != http.StatusOK || len(export.Messages) != 1 || export.Messages[0].Text != "my own words" {
+		t.Fatalf("export: %d %+v", status, export)
+	}
+
+	if status := call(http.MethodDelete, "/api/account", nil); status != http.StatusNoContent {
+		t.Fatalf("delete: %d", status)
+	}
+	if f := other.expect("redaction", isType(protocol.FrameDeleted)); f.ID != msg.ID {
+		t.Errorf("deleted message %d, want %d", f.ID, msg.ID)
+	}
+	kari.expect("deleted notice", isText(protocol.FrameSystem, "Your account has been deleted."))
+	if status := call(http.MethodGet, "/api/account/export", nil); status != http.StatusUnauthorized {
+		t.Errorf("export after delete: %d", status)
+	}
+}
+
+func TestHelpCommand(t *testing.T) {
+	base := startServer(t)
+	mod := dial(t, base, "room=ops")
+	mod.expect("own join", isCount(1))
+	member := dial(t, base, "room=ops")
+	member.expect("own join", isCount(2))
+
+	member.send("/help")
+	member.expect("help header", isText(protocol.FrameSystem, "Commands:"))
+	for {
+		f := member.expect("help line", isType(protocol.FrameSystem))
+		if strings.HasPrefix(f.Text, "/slowmode") {
+			t.Errorf("moderator command listed for a member: %q", f.Text)
+		}
+		if f.Text == "/q - Leave the chat" {
+			break
+		}
+	}
+	member.send("/slowmode 5")
+	member.expect("refused", isText(protocol.FrameError, "Only moderators can change slow mode."))
+	member.send("/frobnicate now")
+	member.expect("unknown command", isText(protocol.FrameError, "Unknown command /frobnicate, see /help."))
+
+	mod.send("/help")
+	mod.expect("moderator command", isText(protocol.FrameSystem, "/slowmode <seconds> - Set the time between messages, 0 turns it off"))
+}
+
+func TestSync(t *testing.T) {
+	base := startServer(t)
+	sync := func(query string) (res struct {
+		Cursor  string
+		Reset   bool
+		More    bool
+		Changes []protocol.Frame
+	}) {
+		t.Helper()
+		resp, err := http.Get(base + "/api/sync?" + query) // the transport asks for gzip by itself
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("sync: %v %v", err, resp.Status)
+		}
+		defer resp.Body.Close()
+		if !resp.Uncompressed {
+			t.Error("response was not gzipped")
+		}
+		json.NewDecoder(resp.Body).Decode(&res)
+		return res
+	}
+
+	c := dial(t, base, "")
+	c.send("one")
+	first := c.expect("own message", isType(protocol.FrameMessage))
+	c.send("two")
+	c.expect("own message", isType(protocol.FrameMessage))
+	c.send(fmt.Sprintf("/react %d 👍", first.ID))
+	c.expect("reaction", isType(protocol.FrameReaction))
+
+	page := sync("limit=2")
+	if !page.More || len(page.Changes) != 2 || page.Changes[0].Text != "one" || page.Changes[1].Text != "two" {
+		t.Fatalf("first page: %+v", page)
+	}
+	rest := sync("since=" + page.Cursor + "&rooms=lobby")
+	if rest.More || len(rest.Changes) != 1 || rest.Changes[0].Type != protocol.FrameReaction || rest.Changes[0].ID != first.ID {
+		t.Fatalf("second page: %+v", rest)
+	}
+	if other := sync("rooms=elsewhere"); len(other.Changes) != 0 || other.Cursor != rest.Cursor {
+		t.Errorf("other room: %+v", other)
+	}
+	epoch, seq, _ := strings.Cut(rest.Cursor, ".")
+	n, _ := strconv.Atoi(seq)
+	if future := sync(fmt.Sprintf("since=%s.%d", epoch, n+100)); !future.Reset {
+		t.Errorf("cursor from the future: %+v", future)
+	}
+	if old := sync("since=1"); !old.Reset {
+		t.Errorf("cursor without an epoch: %+v", old)
+	}
+}
+
+func TestSyncAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	sameDir := func(cfg *chat.Config) { cfg.DataDir = dir }
+	type result struct {
+		Cursor  string
+		Reset   bool
+		Changes []protocol.Frame
+	}
+	sync := func(base, since string) (res result) {
+		t.Helper()
+		resp, err := http.Get(base + "/api/sync?since=" + since)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("sync: %v %v", err, resp.Status)
+		}
+		defer resp.Body.Close()
+		json.NewDecoder(resp.Body).Decode(&res)
+		return res
+	}
+
+	base := startServer(t, sameDir)
+	c := dial(t, base, "")
+	c.send("before")
+	c.expect("own message", isType(protocol.FrameMessage))
+	cursor := sync(base, "").Cursor
+
+	// the new server's log starts over and soon gets past the old cursor,
+	// which must not pass for one of its own
+	base = startServer(t, sameDir)
+	c = dial(t, base, "")
+	for _, text := range []string{"one", "two", "three"} {
+		c.send(text)
+		c.expect("own message", isText(protocol.FrameMessage, text))
+	}
+	res := sync(base, cursor)
+	if !res.Reset || len(res.Changes) != 0 {
+		t.Fatalf("old cursor after a restart: %+v", res)
+	}
+	if res = sync(base, res.Cursor); res.Reset || len(res.Changes) != 0 {
+		t.Errorf("syncing from the new cursor: %+v", res)
+	}
+}
+
+func TestSyncAccountRooms(t *testing.T) {
+	base := startServer(t)
+	register := func(name string) string {
+		t.Helper()
+		resp, err := http.Post(base+"/api/register", "application/json", strings.NewReader(`{"username":"`+name+`","password":"hunter22"}`))
+		if err != nil || resp.StatusCode != http.StatusCreated {
+			t.Fatalf("register: %v %v", err, resp.Status)
+		}
+		defer resp.Body.Close()
+		var reg struct{ Token string }
+		json.NewDecoder(resp.Body).Decode(&reg)
+		return reg.Token
+	}
+	sync := func(token string) (status int, res struct {
+		Changes []protocol.Frame
+	}) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, base+"/api/sync", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		json.NewDecoder(resp.Body).Decode(&res)
+		return resp.StatusCode, res
+	}
+	kari, ola := register("kari"), register("ola")
+
+	// kari makes a locked room and leaves again, she still belongs to it
+	c := dial(t, base, "room=secret&key=hunter2&login="+kari)
+	c.send("the plan")
+	msg := c.expect("own message", isText(protocol.FrameMessage, "the plan"))
+	c.send(fmt.Sprintf(`{"type":"mark_read","room":"secret","id":%d}`, msg.ID))
+	c.send("/join lobby")
+	c.expect("lobby", isText(protocol.FrameSystem, "You are now in #lobby"))
+	dial(t, base, "login="+ola).expect("session", isType(protocol.FrameSession))
+
+	seen := func(changes []protocol.Frame) (message, read bool) {
+		for _, f := range changes {
+			message = message || (f.Type == protocol.FrameMessage && f.Text == "the plan")
+			read = read || (f.Type == protocol.FrameRead && f.Room == "secret" && f.ID == msg.ID)
+		}
+		return message, read
+	}
+	if _, res := sync(kari); !func() bool { m, r := seen(res.Changes); return m && r }() {
+		t.Errorf("kari's sync: %+v", res.Changes)
+	}
+	for who, token := range map[string]string{"guest": "", "ola": ola} {
+		if _, res := sync(token); func() bool { m, r := seen(res.Changes); return m || r }() {
+			t.Errorf("%s's sync has kari's room: %+v", who, res.Changes)
+		}
+	}
+	if status, _ := sync("not a token"); status != http.StatusUnauthorized {
+		t.Errorf("bad token: %d", status)
+	}
+}
+
+func TestProfileAndWhois(t *testing.T) {
+	base := startServer(t)
+	resp, err := http.Post(base+"/api/register", "application/json", strings.NewReader(`{"username":"kari","password":"hunter22"}`))
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("register: %v %v", err, resp.Status)
+	}
+	var reg struct{ Token string }
+	json.NewDecoder(resp.Body).Decode(&reg)
+	resp.Body.Close()
+	put := func(body string) int {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPut, base+"/api/account/profile", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+reg.Token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("profile: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := put(`{"avatar_url":"javascript:alert(1)"}`); status != http.StatusBadRequest {
+		t.Errorf("bad avatar: %d", status)
+	}
+	if status := put(`{"display_name":"Kari Nordmann","bio":"on call"}`); status != http.StatusOK {
+		t.Fatalf("profile: %d", status)
+	}
+
+	other := dial(t, base, "")
+	other.expect("joined", isCount(1))
+	other.send("/whois kari")
+	other.expect("account", isText(protocol.FrameSystem, "kari is Kari Nordmann."))
+	other.expect("bio", isText(protocol.FrameSystem, "Bio: on call"))
+	other.expect("offline", isText(protocol.FrameSystem, "kari is offline."))
+
+	kari := dial(t, base, "login="+reg.Token)
+	kari.expect("joined", isCount(2))
+	kari.send(`{"type":"heartbeat","state":"active"}`)
+	if f := other.expect("presence", isType(protocol.FramePresence)); f.Profile == nil || f.Profile.Bio != "on call" {
+		t.Errorf("presence without the profile: %+v", f)
+	}
+	other.send("/whois kari")
+	other.expect("online", isText(protocol.FrameSystem, "kari is active in #lobby."))
+	other.send("/whois nobody")
+	other.expect("unknown user", isText(protocol.FrameError, "No user named nobody."))
+}
+
+func TestIgnore(t *testing.T) {
+	base := startServer(t)
+	resp, err := http.Post(base+"/api/register", "application/json", strings.NewReader(`{"username":"kari","password":"hunter22"}`))
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("register: %v %v", err, resp.Status)
+	}
+	var reg struct{ Token string }
+	json.NewDecoder(resp.Body).Decode(&reg)
+	resp.Body.Close()
+
+	kari := dial(t, base, "login="+reg.Token)
+	kari.expect("joined", isCount(1))
+	troll := dial(t, base, "")
+	kari.expect("troll joined", isCount(2))
+	troll.rename("troll")
+	kari.send("/ignore troll")
+	kari.expect("ignoring", isText(protocol.FrameSystem, "You no longer see messages from troll. Undo with /unignore troll"))
+
+	// a second connection of the account ignores too, the list is kept
+	phone := dial(t, base, "login="+reg.Token)
+	phone.expect("joined", isCount(2)) // kari counts once
+	phone.send("/ignore")
+	phone.expect("list", isText(protocol.FrameSystem, "You are ignoring troll."))
+
+	troll.send("/msg kari psst")
+	troll.expect("own copy", isType(protocol.FrameDirect))
+	troll.send("lol")
+	troll.expect("own message", isType(protocol.FrameMessage))
+	kari.send("/unignore troll")
+	kari.expect("unignored", isText(protocol.FrameSystem, "You see messages from troll again."))
+	troll.send("sorry")
+	if f := kari.expect("message", isType(protocol.FrameMessage)); f.Text != "sorry" {
+		t.Errorf("got %q from %s while ignoring them", f.Text, f.From)
+	}
+	if f := phone.expect("message", func(f protocol.Frame) bool {
+		return f.Type == protocol.FrameMessage || f.Type == protocol.FrameDirect
+	}); f.Text != "sorry" {
+		t.Errorf("other connection got %q from %s while ignoring them", f.Text, f.From)
+	}
+}
+
+func TestAwayAndStatus(t *testing.T) {
+	base := startServer(t, func(cfg *chat.Config) {
+		cfg.HeartbeatTimeout = 200 * time.Millisecond // the presence loop checks every 50ms
+		cfg.AutoAway = 500 * time.Millisecond
+	})
+	presence := func(availability, status string) func(protocol.Frame) bool {
+		return func(f protocol.Frame) bool {
+			return f.Type == protocol.FramePresence && f.From == "bob" && f.Availability == availability && f.Status == status
+		}
+	}
+	alice := dial(t, base, "")
+	alice.expect("joined", isCount(1))
+	bob := dial(t, base, "")
+	alice.expect("bob joined", isCount(2))
+	bob.rename("bob")
+
+	bob.send("/status on call")
+	alice.expect("status", presence("available", "on call"))
+	bob.send("/away lunch")
+	alice.expect("away", presence("away", "lunch"))
+	bob.send("/back")
+	alice.expect("back", presence("available", "on call"))
+
+	// quiet for a while, then saying something
+	alice.expect("auto away", presence("away", "on call"))
+	bob.send("back again")
+	alice.expect("active again", presence("available", "on call"))
+}
+
+func TestMatrixBridge(t *testing.T) {
+	// a homeserver that notes what the bridge asks of it
+	calls := make(chan string, 100)
+	homeserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		calls <- r.Method + " " + r.URL.EscapedPath() + " " + r.URL.Query().Get("user_id") + " " + string(body)
+		w.Write([]byte("{}"))
+	}))
+	defer homeserver.Close()
+	expectCall := func(what, want string) {
+		t.Helper()
+		timeout := time.After(3 * time.Second)
+		var seen []string
+		for {
+			select {
+			case call := <-calls:
+				if strings.Contains(call, want) {
+					return
+				}
+				seen = append(seen, call)
+			case <-timeout:
+				t.Fatalf("waiting for %s: got %q", what, seen)
+			}
+		}
+	}
+
+	base := startServer(t, func(cfg *chat.Config) {
+		cfg.Matrix = &matrix.Config{
+			Homeserver: homeserver.URL, Domain: "example.org",
+			ASToken: "as", HSToken: "hs", SenderLocalpart: "chatbridge",
+			Rooms: map[string]string{"ops": "!ops:example.org"},
+		}
+	})
+	expectCall("bridge joining", "POST /_matrix/client/v3/join/%21ops:example.org  {}")
+
+	alice := dial(t, base, "room=ops")
+	alice.expect("joined", isCount(1))
+	alice.rename("Alice")
+	expectCall("puppet joining", "POST /_matrix/client/v3/join/%21ops:example.org @chat__alice:example.org")
+	alice.send("hello matrix")
+	expectCall("puppet talking", `@chat__alice:example.org {"body":"hello matrix","msgtype":"m.text"}`)
+
+	transaction := func(txn, token, events string) int {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPut, base+"/_matrix/app/v1/transactions/"+txn, strings.NewReader(`{"events":[`+events+`]}`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("pushing transaction: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := transaction("1", "as", `{}`); code != http.StatusForbidden {
+		t.Errorf("wrong hs_token: %d", code)
+	}
+	join := `{"type":"m.room.member","room_id":"!ops:example.org","sender":"@bob:example.org","state_key":"@bob:example.org","content":{"membership":"join"}}`
+	msg := `{"type":"m.room.message","room_id":"!ops:example.org","sender":"@bob:example.org","content":{"msgtype":"m.text","body":"hi from matrix"}}`
+	echo := `{"type":"m.room.message","room_id":"!ops:example.org","sender":"@chat__alice:example.org","content":{"msgtype":"m.text","body":"echo"}}`
+	if code := transaction("1", "hs", join+","+echo+","+msg); code != http.StatusOK {
+		t.Fatalf("transaction: %d", code)
+	}
+	alice.expect("bob joining", isText(protocol.FrameSystem, "bob joined #ops on Matrix."))
+	f := alice.expect("bob's message", isType(protocol.FrameMessage))
+	if f.From != "bob (matrix)" || f.Text != "hi from matrix" {
+		t.Errorf("got %q from %q", f.Text, f.From)
+	}
+
+	// the homeserver retrying a transaction doesn't post twice
+	transaction("1", "hs", msg)
+	transaction("2", "hs", strings.Replace(msg, "hi from matrix", "second", 1))
+	if f := alice.expect("next message", isType(protocol.FrameMessage)); f.Text != "second" {
+		t.Errorf("got %q after the retry", f.Text)
+	}
+}
+
+func TestTimestamps(t *testing.T) {
+	base := startServer(t)
+	alice := dial(t, base, "room=dev")
+	alice.expect("joined", isCount(1))
+	alice.rename("alice")
+	bob := dial(t, base, "room=dev")
+	joined := alice.expect("bob joining", isType(protocol.FrameSystem))
+	if joined.TS == 0 {
+		t.Error("system frame without a ts")
+	}
+
+	before := time.Now().UnixMilli()
+	alice.send("what time is it")
+	own := alice.expect("own message", isText(protocol.FrameMessage, "what time is it"))
+	theirs := bob.expect("alice's message", isText(protocol.FrameMessage, "what time is it"))
+	if own.TS < before || own.TS > time.Now().UnixMilli() {
+		t.Errorf("ts %d is not when the message was sent", own.TS)
+	}
+	if theirs.TS != own.TS {
+		t.Errorf("bob got ts %d, alice %d", theirs.TS, own.TS)
+	}
+}
+
+func TestClientIDAcks(t *testing.T) {
+	base := startServer(t)
+	alice := dial(t, base, "room=dev")
+	sid := alice.expect("session", isType(protocol.FrameSession)).Token
+	alice.rename("alice")
+	bob := dial(t, base, "room=dev")
+	alice.expect("bob joining", isCount(2))
+
+	alice.send(`{"type":"message","text":"did this arrive?","client_id":"a-1"}`)
+	posted := alice.expect("own message", isText(protocol.FrameMessage, "did this arrive?"))
+	ack := alice.expect("ack", isType(protocol.FrameAck))
+	if ack.ID != posted.ID || ack.ClientID != "a-1" || ack.Room != "dev" {
+		t.Fatalf("ack %+v for message %d", ack, posted.ID)
+	}
+	alice.conn.Close() // before she could tell she got the ack
+
+	// the resend after the reconnect is only acked again
+	back := dial(t, base, "room=dev&sid="+sid)
+	back.expect("session", isType(protocol.FrameSession))
+	back.send(`{"type":"message","text":"did this arrive?","client_id":"a-1"}`)
+	if again := back.expect("ack", isType(protocol.FrameAck)); again.ID != posted.ID {
+		t.Errorf("resend acked as %d, want %d", again.ID, posted.ID)
+	}
+	back.send(`{"type":"message","text":"next one","client_id":"a-2"}`)
+	bob.expect("alice's message", isText(protocol.FrameMessage, "did this arrive?"))
+	if f := bob.expect("next message", isType(protocol.FrameMessage)); f.Text != "next one" {
+		t.Errorf("bob got %q twice", f.Text)
+	}
+}
+
+func TestReadMarkers(t *testing.T) {
+	base := startServer(t)
+	resp, err := http.Post(base+"/api/register", "application/json", strings.NewReader(`{"username":"kari","password":"hunter22"}`))
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("register: %v %v", err, resp.Status)
+	}
+	var reg struct{ Token string }
+	json.NewDecoder(resp.Body).Decode(&reg)
+	resp.Body.Close()
+
+	kari := dial(t, base, "login="+reg.Token+"&room=dev")
+	if rooms := kari.expect("room list", isType(protocol.FrameRooms)); rooms.Rooms["dev"] != 1 || len(rooms.Unread) != 0 {
+		t.Fatalf("first room list %+v, unread %v", rooms.Rooms, rooms.Unread)
+	}
+	ola := dial(t, base, "room=dev")
+	ola.rename("ola")
+	var ids []int64
+	for _, text := range []string{"one", "two", "three"} {
+		ola.send(text)
+		ids = append(ids, kari.expect(text, isText(protocol.FrameMessage, text)).ID)
+	}
+	kari.send("mine doesn't count")
+	kari.expect("own message", isType(protocol.FrameMessage))
+
+	kari.send(fmt.Sprintf(`{"type":"mark_read","id":%d}`, ids[0]))
+	kari.send(fmt.Sprintf(`{"type":"mark_read","room":"dev","id":%d}`, ids[0]-1)) // backwards, ignored
+	kari.send(`{"type":"mark_read","room":"nowhere","id":1}`)
+	kari.expect("unknown room", isText(protocol.FrameError, "no such room"))
+	kari.send(`{"type":"mark_read","id":1000000}`)
+	kari.expect("future id", isText(protocol.FrameError, "there is no message with that ID yet"))
+
+	// the account's other connections see the same count
+	phone := dial(t, base, "login="+reg.Token)
+	if rooms := phone.expect("room list", isType(protocol.FrameRooms)); rooms.Unread["dev"] != 2 || rooms.Rooms["dev"] != 2 {
+		t.Errorf("room list %+v, unread %v, want 2 unread in dev", rooms.Rooms, rooms.Unread)
+	}
+	guest := dial(t, base, "")
+	if rooms := guest.expect("room list", isType(protocol.FrameRooms)); len(rooms.Unread) != 0 {
+		t.Errorf("guest got unread counts %v", rooms.Unread)
+	}
+}
+
+func TestMultiDevice(t *testing.T) {
+	base := startServer(t)
+	resp, err := http.Post(base+"/api/register", "application/json", strings.NewReader(`{"username":"kari","password":"hunter22"}`))
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("register: %v %v", err, resp.Status)
+	}
+	var reg struct{ Token string }
+	json.NewDecoder(resp.Body).Decode(&reg)
+	resp.Body.Close()
+
+	laptop := dial(t, base, "login="+reg.Token+"&room=dev")
+	laptop.expect("room list", isType(protocol.FrameRooms))
+	ola := dial(t, base, "room=dev")
+	ola.rename("ola")
+	phone := dial(t, base, "login="+reg.Token)
+	phone.expect("room list", isType(protocol.FrameRooms))
+
+	// a second device in the same room is neither announced nor counted
+	tablet := dial(t, base, "login="+reg.Token+"&room=dev")
+	if rooms := tablet.expect("room list", isType(protocol.FrameRooms)); rooms.Rooms["dev"] != 2 {
+		t.Errorf("%d in dev, want 2", rooms.Rooms["dev"])
+	}
+	laptop.send("hello")
+	if f := ola.expect("message", func(f protocol.Frame) bool {
+		return f.Type == protocol.FrameMessage || f.Type == protocol.FrameSystem
+	}); f.Text != "hello" {
+		t.Errorf("ola got %q before the message", f.Text)
+	}
+
+	// direct messages and mentions reach every device, sent ones too
+	ola.send("/msg kari psst")
+	for _, c := range []*testClient{laptop, phone, tablet} {
+		c.expect("direct message", isText(protocol.FrameDirect, "psst"))
+	}
+	laptop.send("/msg ola hi back")
+	phone.expect("sent from the laptop", isText(protocol.FrameDirect, "hi back"))
+	ola.send("@kari are you there?")
+	if f := phone.expect("mention", isType(protocol.FrameMention)); f.Room != "dev" || f.From != "ola" {
+		t.Errorf("mention %+v", f)
+	}
+
+	// /u renames every device, and new ones pick the name up
+	phone.rename("karin")
+	laptop.expect("renamed", isText(protocol.FrameSystem, "Username set to karin"))
+	if f := ola.expect("rename", isType(protocol.FrameRename)); f.From != "kari" || f.Text != "karin" {
+		t.Errorf("rename %+v", f)
+	}
+	watch := dial(t, base, "login="+reg.Token)
+	if f := watch.expect("session", isType(protocol.FrameSession)); f.From != "karin" {
+		t.Errorf("new device is called %q", f.From)
+	}
+}
+
+func TestStoredHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chat.db")
+	useDB := func(cfg *chat.Config) {
+		db, err := store.Open(store.DriverSQLite, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.Store = db // the server closes it
+	}
+	base := startServer(t, useDB)
+	alice := dial(t, base, "")
+	alice.rename("alice")
+	alice.send("before the restart")
+	posted := alice.expect("own message", isText(protocol.FrameMessage, "before the restart"))
+	alice.send(fmt.Sprintf(`{"type":"react","id":%d,"text":"👍"}`, posted.ID))
+	alice.expect("reaction", isType(protocol.FrameReaction))
+
+	// a new server on the same database, the data dir is a fresh one
+	base = startServer(t, useDB)
+	resp, err := http.Get(base + "/api/rooms/lobby/history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var history []protocol.Frame
+	json.NewDecoder(resp.Body).Decode(&history)
+	resp.Body.Close()
+	if len(history) != 1 || history[0].ID != posted.ID || history[0].Reactions["👍"] == nil {
+		t.Fatalf("history after the restart: %+v", history)
+	}
+	bob := dial(t, base, "")
+	bob.send("after the restart")
+	if f := bob.expect("own message", isType(protocol.FrameMessage)); f.ID <= posted.ID {
+		t.Errorf("message ID %d handed out again", f.ID)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	db := store.NewMemory()
+	base := startServer(t, func(cfg *chat.Config) {
+		cfg.AdminToken = "secret"
+		cfg.Store = db
+	})
+	alice := dial(t, base, "")
+	alice.rename("alice")
+	var ids []int64
+	for _, text := range []string{"one", "two", "three", "four"} {
+		alice.send(text)
+		ids = append(ids, alice.expect("own message", isText(protocol.FrameMessage, text)).ID)
+	}
+
+	req, _ := http.NewRequest(http.MethodPut, base+"/admin/rooms/lobby/retention", strings.NewReader(`{"max_count": 2, "max_age": "24h"}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		MaxAge   string `json:"max_age"`
+		MaxCount int    `json:"max_count"`
+	}
+	json.NewDecoder(resp.Body).Decode(&got)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || got.MaxAge != "24h0m0s" || got.MaxCount != 2 {
+		t.Fatalf("set retention: %d %+v", resp.StatusCode, got)
+	}
+	for _, id := range ids[:2] {
+		if f := alice.expect("redaction", isType(protocol.FrameDeleted)); f.ID != id {
+			t.Errorf("deleted %d, want %d", f.ID, id)
+		}
+	}
+	stored, err := db.Messages("lobby", 0)
+	if err != nil || len(stored) != 2 || stored[0].Text != "three" {
+		t.Errorf("stored after pruning: %+v %v", stored, err)
+	}
+
+	alice.send("/retention")
+	alice.expect("room retention", isText(protocol.FrameSystem, "#lobby keeps the last 2 messages, for 24h0m0s."))
+}
+
+func TestMessageSizeLimit(t *testing.T) {
+	base := startServer(t, func(cfg *chat.Config) { cfg.MaxMessage = 1024 })
+	alice := dial(t, base, "")
+	alice.expect("joined", isCount(1))
+
+	alice.send(strings.Repeat("a", 1500))
+	alice.expect("too large", isText(protocol.FrameError, "Message too large (1500 bytes), the limit is 1024."))
+	strike := alice.expect("strike", isType(protocol.FrameStrike))
+	if strike.Strike == nil || strike.Strike.Rule != "too_large" {
+		t.Fatalf("strike %+v", strike.Strike)
+	}
+
+	alice.send("caf\xe9")
+	alice.expect("utf-8", isText(protocol.FrameError, "Messages must be valid UTF-8."))
+
+	// past twice the limit the transport hangs up (with 1009, unless the
+	// unread rest of the frame turns that into a reset) before the hub sees it
+	alice.send(strings.Repeat("a", 5000))
+	alice.conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for {
+		_, _, err := alice.conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			t.Fatal("connection still open after an oversized frame")
+		}
+		break
+	}
+}
+
+func TestSlowClientDisconnect(t *testing.T) {
+	base := startServer(t, func(cfg *chat.Config) {
+		cfg.AdminToken = "secret"
+		cfg.SendBuffer = 4
+	})
+	alice := dial(t, base, "")
+	alice.expect("joined", isCount(1))
+	dial(t, base, "") // bob, who never reads
+	alice.expect("bob joining", isCount(2))
+
+	// bob never reads, so once the socket buffers are full his frames pile
+	// up and he gets hung up on instead of holding up alice's broadcasts
+	metrics := func() string {
+		req, _ := http.NewRequest(http.MethodGet, base+"/metrics", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("metrics: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+	filler := strings.Repeat("x", 60<<10)
+	for i := 0; i < 1000; i++ {
+		text := strconv.Itoa(i) + filler
+		alice.send(text)
+		alice.expect("own message", isText(protocol.FrameMessage, text)) // alice keeps up
+		if i%50 == 49 && strings.Contains(metrics(), "chat_slow_client_disconnects_total 1\n") {
+			return
+		}
+	}
+	t.Fatalf("bob was never hung up on:\n%s", metrics())
+}
+
+func TestEventStream(t *testing.T) {
+	base := startServer(t)
+	alice := dial(t, base, "room=ops")
+	alice.expect("joined", isCount(1))
+	alice.rename("alice")
+
+	resp, err := http.Get(base + "/events?room=ops")
+	if err != nil {
+		t.Fatalf("opening stream: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("content type %q", ct)
+	}
+	events := make(chan [2]string, 100) // id and data of each event, or the stream ID
+	go func() {
+		var id, name string
+		lines := bufio.NewScanner(resp.Body)
+		for lines.Scan() {
+			field, value, _ := strings.Cut(lines.Text(), ": ")
+			switch field {
+			case "id":
+				id = value
+			case "event":
+				name = value
+			case "data":
+				if name == "stream" {
+					events <- [2]string{"stream", value}
+				} else {
+					events <- [2]string{id, value}
+				}
+				id, name = "", ""
+			}
+		}
+		close(events)
+	}()
+	expectEvent := func(what string, match func(protocol.Frame) bool) (string, protocol.Frame) {
+		t.Helper()
+		timeout := time.After(3 * time.Second)
+		for {
+			select {
+			case ev, ok := <-events:
+				if !ok {
+					t.Fatalf("stream ended waiting for %s", what)
+				}
+				var f protocol.Frame
+				json.Unmarshal([]byte(ev[1]), &f)
+				if match(f) {
+					return ev[0], f
+				}
+			case <-timeout:
+				t.Fatalf("waiting for %s", what)
+			}
+		}
+	}
+
+	var stream string
+	select {
+	case ev := <-events:
+		if ev[0] != "stream" {
+			t.Fatalf("first event %q", ev)
+		}
+		stream = ev[1]
+	case <-time.After(3 * time.Second):
+		t.Fatal("no stream id")
+	}
+	alice.expect("stream joining", isCount(2))
+
+	post := func(stream, body string) int {
+		t.Helper()
+		resp, err := http.Post(base+"/events?stream="+stream, "text/plain", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("posting: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := post(stream, `{"type":"message","text":"hello from sse"}`); code != http.StatusAccepted {
+		t.Fatalf("post: %d", code)
+	}
+	f := alice.expect("sse message", isText(protocol.FrameMessage, "hello from sse"))
+	if id, own := expectEvent("own message", isText(protocol.FrameMessage, "hello from sse")); id != strconv.FormatInt(f.ID, 10) {
+		t.Errorf("event id %q for message %d (%+v)", id, f.ID, own)
+	}
+
+	alice.send("hi stream")
+	if _, got := expectEvent("alice's message", isText(protocol.FrameMessage, "hi stream")); got.From != "alice" {
+		t.Errorf("from %q", got.From)
+	}
+	if code := post("nope", "hi"); code != http.StatusNotFound {
+		t.Errorf("unknown stream: %d", code)
+	}
+
+	resp.Body.Close()
+	alice.expect("stream leaving", isCount(1))
+}
+
+func TestGRPCConnect(t *testing.T) {
+	base := startServer(t)
+	alice := dial(t, base, "room=ops")
+	alice.expect("joined", isCount(1))
+	alice.rename("alice")
+
+	// cleartext HTTP/2 with prior knowledge, like grpc-go without TLS
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}}
+	sendMsg := func(w io.Writer, cf protocol.ClientFrame) {
+		msg := cf.MarshalProto()
+		header := make([]byte, 5)
+		binary.BigEndian.PutUint32(header[1:], uint32(len(msg)))
+		w.Write(append(header, msg...))
+	}
+	body, requests := io.Pipe()
+	defer requests.Close()
+	req, _ := http.NewRequest(http.MethodPost, base+"/chat.Chat/Connect", body)
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Chat-Room", "ops")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Grpc-Status") != "" {
+		t.Fatalf("refused: %s %s", resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message"))
+	}
+	frames := make(chan protocol.Frame, 100)
+	go func() {
+		defer close(frames)
+		header := make([]byte, 5)
+		for {
+			if _, err := io.ReadFull(resp.Body, header); err != nil {
+				return
+			}
+			msg := make([]byte, binary.BigEndian.Uint32(header[1:]))
+			if _, err := io.ReadFull(resp.Body, msg); err != nil {
+				return
+			}
+			f, _ := protocol.UnmarshalFrameProto(msg)
+			frames <- f
+		}
+	}()
+	expectFrame := func(what string, match func(protocol.Frame) bool) protocol.Frame {
+		t.Helper()
+		timeout := time.After(3 * time.Second)
+		for {
+			select {
+			case f, ok := <-frames:
+				if !ok {
+					t.Fatalf("stream ended waiting for %s", what)
+				}
+				if match(f) {
+					return f
+				}
+			case <-timeout:
+				t.Fatalf("waiting for %s", what)
+			}
+		}
+	}
+
+	alice.expect("grpc client joining", isCount(2))
+	sendMsg(requests, protocol.ClientFrame{Type: protocol.ClientMessage, Text: "hello over grpc"})
+	alice.expect("grpc message", isText(protocol.FrameMessage, "hello over grpc"))
+	alice.send("hi grpc")
+	if f := expectFrame("alice's message", isText(protocol.FrameMessage, "hi grpc")); f.From != "alice" || f.Room != "ops" {
+		t.Errorf("got %+v", f)
+	}
+
+	// done sending still gets messages, until the call is cancelled
+	requests.Close()
+	alice.send("still there?")
+	expectFrame("after close send", isText(protocol.FrameMessage, "still there?"))
+	resp.Body.Close()
+	alice.expect("grpc client leaving", isCount(1))
+}
+
+func TestClientSDK(t *testing.T) {
+	base := startServer(t)
+	alice := dial(t, base, "room=dev")
+	alice.expect("joined", isCount(1))
+	alice.rename("alice")
+
+	c := chatclient.New("ws" + strings.TrimPrefix(base, "http") + "/ws")
+	c.SetUsername("sdk")
+	c.Join("dev", "")
+	messages := make(chan chatclient.Message, 10)
+	c.OnMessage(func(m chatclient.Message) { messages <- m })
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := c.Connect(ctx); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	alice.expect("sdk renamed", isText(protocol.FrameRename, "sdk"))
+	waitFor := func(what string, done func() bool) {
+		t.Helper()
+		for start := time.Now(); !done(); time.Sleep(10 * time.Millisecond) {
+			if time.Since(start) > 3*time.Second {
+				t.Fatalf("waiting for %s", what)
+			}
+		}
+	}
+	waitFor("the new name", func() bool { return c.Username() == "sdk" })
+	if c.Room() != "dev" {
+		t.Errorf("in %q", c.Room())
+	}
+
+	if err := c.Send("/not a command"); err != nil {
+		t.Fatal(err)
+	}
+	if f := alice.expect("sdk line", isType(protocol.FrameMessage)); f.From != "sdk" || f.Text != "/not a command" {
+		t.Errorf("alice got %+v", f)
+	}
+	alice.send("hi sdk")
+	select {
+	case m := <-messages:
+		for m.From == "sdk" {
+			m = <-messages // our own line first
+		}
+		if m.From != "alice" || m.Text != "hi sdk" || m.Room != "dev" {
+			t.Errorf("sdk got %+v", m)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("no message for the sdk")
+	}
+
+	c.Join("ops", "")
+	alice.expect("sdk leaving", isText(protocol.FrameSystem, "sdk left #dev."))
+	waitFor("the room change", func() bool { return c.Room() == "ops" })
+}
+
+func TestEncryptedRelay(t *testing.T) {
+	wordList := filepath.Join(t.TempDir(), "words.txt")
+	os.WriteFile(wordList, []byte("darn\n"), 0o644)
+	base := startServer(t, func(cfg *chat.Config) { cfg.WordList = wordList })
+	alice := dial(t, base, "")
+	alice.expect("joined", isCount(1))
+	alice.rename("alice")
+	bob := dial(t, base, "")
+	alice.expect("bob joining", isCount(2))
+	bob.rename("bob")
+
+	bob.send(`{"type":"key_exchange","to":"alice","payload":"Ym9iJ3Mga2V5"}`)
+	if f := alice.expect("key", isType(protocol.FrameKeyExchange)); f.From != "bob" || f.Payload != "Ym9iJ3Mga2V5" {
+		t.Errorf("alice got %+v", f)
+	}
+	// the payload is opaque, the word filter has no business with it
+	bob.send(`{"type":"encrypted","to":"alice","payload":"darn darn darn"}`)
+	f := alice.expect("ciphertext", isType(protocol.FrameEncrypted))
+	if f.From != "bob" || f.To != "alice" || f.Payload != "darn darn darn" || f.Text != "" || f.ID == 0 {
+		t.Errorf("alice got %+v", f)
+	}
+	if own := bob.expect("own copy", isType(protocol.FrameEncrypted)); own.ID != f.ID {
+		t.Errorf("bob's copy %+v", own)
+	}
+	bob.send(`{"type":"encrypted","to":"nobody","payload":"eA=="}`)
+	bob.expect("unknown recipient", isType(protocol.FrameError))
+	bob.send(`{"type":"encrypted","to":"alice"}`)
+	bob.expect("no payload", isType(protocol.FrameError))
+
+	resp, err := http.Get(base + "/api/rooms/lobby/history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if strings.Contains(string(body), "darn") {
+		t.Errorf("ciphertext in history: %s", body)
+	}
+}
+
+func TestTracing(t *testing.T) {
+	// The instruments use the global provider, so this stays for the rest of the run
+	spans := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)))
+
+	base := startServer(t)
+	kari := dial(t, base, "room=traced")
+	kari.send("follow me")
+	id := kari.expect("message", isText(protocol.FrameMessage, "follow me")).ID
+
+	find := func(name string, match func(sdktrace.ReadOnlySpan) bool) sdktrace.ReadOnlySpan {
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			for _, s := range spans.Ended() {
+				if s.Name() == name && match(s) {
+					return s
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("no %s span", name)
+		return nil
+	}
+	hasAttr := func(kv attribute.KeyValue) func(sdktrace.ReadOnlySpan) bool {
+		return func(s sdktrace.ReadOnlySpan) bool {
+			for _, a := range s.Attributes() {
+				if a == kv {
+					return true
+				}
+			}
+			return false
+		}
+	}
+
+	find("chat.upgrade", hasAttr(attribute.String("chat.upgrade.outcome", "ok")))
+	msg := find("chat.message", hasAttr(attribute.Int64("chat.message_id", id)))
+	fanout := find("chat.fanout", func(s sdktrace.ReadOnlySpan) bool {
+		return s.Parent().SpanID() == msg.SpanContext().SpanID()
+	})
+	if fanout.SpanContext().TraceID() != msg.SpanContext().TraceID() || !hasAttr(attribute.Int("chat.recipients", 1))(fanout) {
+		t.Errorf("fan-out span %v isn't the one of message %d", fanout.Attributes(), id)
+	}
+}
+
+func TestDebugEndpoints(t *testing.T) {
+	base := startServer(t, func(cfg *chat.Config) { cfg.AdminToken = "secret" })
+	get := func(path string, auth bool) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, base+path, nil)
+		if auth {
+			req.Header.Set("Authorization", "Bearer secret")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	for _, path := range []string{"/admin/debug/hub", "/admin/debug/pprof/", "/admin/debug/pprof/goroutine?debug=1"} {
+		if resp := get(path, false); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s without the token: %s", path, resp.Status)
+		}
+	}
+
+	alice := dial(t, base, "room=dev")
+	alice.send("hi")
+	alice.expect("own message", isType(protocol.FrameMessage))
+	var debug struct {
+		Goroutines  int
+		Connections int
+		Rooms       []struct {
+			Name        string
+			Connections int
+			History     int
+		}
+	}
+	json.NewDecoder(get("/admin/debug/hub", true).Body).Decode(&debug)
+	if debug.Goroutines == 0 || debug.Connections != 1 || len(debug.Rooms) == 0 ||
+		debug.Rooms[0].Name != "dev" || debug.Rooms[0].Connections != 1 || debug.Rooms[0].History != 1 {
+		t.Errorf("hub debug %+v", debug)
+	}
+
+	resp := get("/admin/debug/pprof/goroutine?debug=1", true)
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !bytes.Contains(body, []byte("goroutine profile")) {
+		t.Errorf("goroutine profile: %s %.100s", resp.Status, body)
+	}
+	if resp := get("/admin/debug/pprof/cmdline", true); resp.StatusCode != http.StatusOK {
+		t.Errorf("cmdline: %s", resp.Status)
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	base := startServer(t, func(cfg *chat.Config) { cfg.DuplicateWindow = time.Minute })
+	resp, err := http.Post(base+"/api/register", "application/json", strings.NewReader(`{"username":"kari","password":"hunter22"}`))
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("register: %v %v", err, resp.Status)
+	}
+	resp.Body.Close()
+
+	c := dial(t, base, "")
+	c.rename("ola")
+	c.send("hei")
+	c.expect("message", isType(protocol.FrameMessage))
+	for _, tc := range []struct {
+		send string
+		code int
+	}{
+		{"/frobnicate", protocol.CodeUnknownCommand},
+		{"/join", protocol.CodeInvalid},
+		{"/topic hijacked", protocol.CodeNotPermitted},
+		{"hei", protocol.CodeRateLimited},
+		{"/u kari", protocol.CodeNameTaken},
+		{`{"type":"mark_read","room":"nowhere","id":1}`, protocol.CodeRoomNotFound},
+		{"/msg nobody hello", protocol.CodeUserNotFound},
+		{"/reply 999999 what?", protocol.CodeMessageNotFound},
+	} {
+		c.send(tc.send)
+		if f := c.expect(tc.send, isType(protocol.FrameError)); f.Code != tc.code {
+			t.Errorf("%s: code %d (%s), want %d", tc.send, f.Code, f.Text, tc.code)
+		}
+	}
+}
+
+func TestCalls(t *testing.T) {
+	base := startServer(t)
+	alice := dial(t, base, "")
+	alice.expect("joined", isCount(1))
+	alice.rename("alice")
+	bob := dial(t, base, "")
+	alice.expect("bob joining", isCount(2))
+	bob.rename("bob")
+
+	// a private call rings bob, answering joins it
+	alice.send(`{"type":"call_offer","to":"bob","payload":"offer-sdp"}`)
+	started := alice.expect("call ID", isType(protocol.FrameCall))
+	if started.Call == "" || started.Text != "joined" {
+		t.Fatalf("alice got %+v", started)
+	}
+	ring := bob.expect("ring", isType(protocol.FrameCallOffer))
+	if ring.Call != started.Call || ring.From != "alice" || ring.Payload != "offer-sdp" {
+		t.Errorf("bob got %+v", ring)
+	}
+	bob.send(fmt.Sprintf(`{"type":"call_ice","call":%q,"to":"alice","payload":"cand-b"}`, ring.Call))
+	if f := alice.expect("early candidate", isType(protocol.FrameCallICE)); f.Payload != "cand-b" {
+		t.Errorf("alice got %+v", f)
+	}
+	bob.send(fmt.Sprintf(`{"type":"call_answer","call":%q,"to":"alice","payload":"answer-sdp"}`, ring.Call))
+	if f := alice.expect("bob in", isType(protocol.FrameCall)); f.From != "bob" || strings.Join(f.Members, ",") != "alice,bob" {
+		t.Errorf("alice got %+v", f)
+	}
+	if f := alice.expect("answer", isType(protocol.FrameCallAnswer)); f.Payload != "answer-sdp" {
+		t.Errorf("alice got %+v", f)
+	}
+	alice.send(fmt.Sprintf(`{"type":"call_hangup","call":%q}`, ring.Call))
+	if f := bob.expect("hung up", isText(protocol.FrameCall, "ended")); f.From != "alice" {
+		t.Errorf("bob got %+v", f)
+	}
+	bob.send(fmt.Sprintf(`{"type":"call_ice","call":%q,"to":"alice","payload":"late"}`, ring.Call))
+	bob.expect("call over", isType(protocol.FrameError))
+
+	// the room's call is open to everyone in it
+	alice.send(`{"type":"call_join"}`)
+	if f := bob.expect("room call", isType(protocol.FrameCall)); f.Call != "#lobby" || f.Room != "lobby" || f.From != "alice" {
+		t.Errorf("bob got %+v", f)
+	}
+	bob.send(`{"type":"call_offer","call":"#lobby","to":"alice","payload":"x"}`)
+	if f := bob.expect("not in it", isType(protocol.FrameError)); f.Code != protocol.CodeNotPermitted {
+		t.Errorf("bob got %+v", f)
+	}
+	carol := dial(t, base, "")
+	if f := carol.expect("ongoing call", isText(protocol.FrameCall, "ongoing")); strings.Join(f.Members, ",") != "alice" {
+		t.Errorf("carol got %+v", f)
+	}
+	alice.send("/join elsewhere")
+	bob.expect("call over", isText(protocol.FrameCall, "ended"))
+}
+
+func TestLinkPreviews(t *testing.T) {
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<html><head><meta property="og:title" content="Release notes"></head></html>`)
+	}))
+	defer site.Close()
+	// the site is on loopback, which only AllowPrivate lets through
+	base := startServer(t, func(cfg *chat.Config) { cfg.LinkPreviews = &preview.Config{AllowPrivate: true} })
+	c := dial(t, base, "")
+
+	link := site.URL + "/notes"
+	c.send("read " + link + ".")
+	if f := c.expect("message", isType(protocol.FrameMessage)); f.Preview != nil {
+		t.Errorf("preview before it was fetched: %+v", f.Preview)
+	}
+	late := c.expect("late preview", isType(protocol.FramePreview))
+	if late.ID == 0 || late.Preview == nil || late.Preview.Title != "Release notes" || late.Preview.URL != link {
+		t.Fatalf("got %+v", late)
+	}
+	// now it's cached, and goes out with the message
+	c.send("again: " + link)
+	if f := c.expect("message", isType(protocol.FrameMessage)); f.Preview == nil || f.Preview.Title != "Release notes" {
+		t.Errorf("got %+v", f)
+	}
+
+	resp, err := http.Get(base + "/api/rooms/lobby/history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if strings.Count(string(body), "Release notes") != 2 {
+		t.Errorf("history without previews: %s", body)
+	}
+}
+
+func TestLinkFilter(t *testing.T) {
+	base := startServer(t, func(cfg *chat.Config) { cfg.LinkBlocklist = []string{"spam.example"} })
+	c := dial(t, base, "")
+	c.send("cheap pills at https://shop.spam.example/buy")
+	if f := c.expect("strike", isType(protocol.FrameStrike)); f.Strike == nil || f.Strike.Rule != "link" {
+		t.Errorf("got %+v", f)
+	}
+	c.send("docs at https://go.dev/doc")
+	if f := c.expect("message", isType(protocol.FrameMessage)); f.Text != "docs at https://go.dev/doc" {
+		t.Errorf("the blocked line went out: %+v", f)
+	}
+
+	// locked down: only one domain, anything else is taken out
+	base = startServer(t, func(cfg *chat.Config) {
+		cfg.LinkAllowlist = []string{"intranet.example"}
+		cfg.StripLinks = true
+	})
+	c = dial(t, base, "")
+	c.send("see https://wiki.intranet.example/x and www.elsewhere.example")
+	c.expect("notice", isText(protocol.FrameSystem, "Links to sites that aren't allowed here were taken out of your message."))
+	if f := c.expect("message", isType(protocol.FrameMessage)); f.Text != "see https://wiki.intranet.example/x and [link removed]" {
+		t.Errorf("got %q", f.Text)
+	}
+}
+
+func TestJoinChallenge(t *testing.T) {
+	base := startServer(t, func(cfg *chat.Config) {
+		cfg.Challenge = chat.ChallengePoW
+		cfg.PowDifficulty = 8
+	})
+	ws := "ws" + strings.TrimPrefix(base, "http") + "/ws"
+	if _, resp, err := websocket.DefaultDialer.Dial(ws, nil); err == nil || resp == nil || resp.StatusCode != http.StatusPreconditionRequired {
+		t.Fatalf("guest without a pass got in: %v", err)
+	}
+
+	resp, err := http.Get(base + "/api/challenge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var challenge struct {
+		Type       string `json:"type"`
+		Challenge  string `json:"challenge"`
+		Difficulty int    `json:"difficulty"`
+	}
+	json.NewDecoder(resp.Body).Decode(&challenge)
+	resp.Body.Close()
+	if challenge.Type != chat.ChallengePoW || challenge.Difficulty != 8 {
+		t.Fatalf("got %+v", challenge)
+	}
+	// 8 bits is a zero first byte
+	solve := func(zero bool) string {
+		for n := 0; ; n++ {
+			if sum := sha256.Sum256([]byte(challenge.Challenge + strconv.Itoa(n))); (sum[0] == 0) == zero {
+				return strconv.Itoa(n)
+			}
+		}
+	}
+	redeem := func(nonce string) (int, string) {
+		body := fmt.Sprintf(`{"challenge":%q,"nonce":%q}`, challenge.Challenge, nonce)
+		resp, err := http.Post(base+"/api/challenge", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var got struct {
+			Pass string `json:"pass"`
+		}
+		json.NewDecoder(resp.Body).Decode(&got)
+		return resp.StatusCode, got.Pass
+	}
+	if status, _ := redeem(solve(false)); status != http.StatusForbidden {
+		t.Errorf("wrong nonce: %d", status)
+	}
+	status, pass := redeem(solve(true))
+	if status != http.StatusOK || pass == "" {
+		t.Fatalf("redeem: %d %q", status, pass)
+	}
+	c := dial(t, base, "pass="+url.QueryEscape(pass))
+	c.expect("session", isType(protocol.FrameSession))
+	if _, resp, err := websocket.DefaultDialer.Dial(ws+"?pass=1."+pass[strings.Index(pass, ".")+1:], nil); err == nil || resp.StatusCode != http.StatusPreconditionRequired {
+		t.Errorf("forged pass got in: %v", err)
+	}
+}
+
+// Keeps the mail instead of sending it
+type fakeMailer chan []byte
+
+func (m fakeMailer) Send(from string, to []string, msg []byte) error {
+	m <- msg
+	return nil
+}
+
+func TestEmailFlows(t *testing.T) {
+	mail := make(fakeMailer, 4)
+	base := startServer(t, func(cfg *chat.Config) {
+		cfg.Mailer = mail
+		cfg.PublicURL = "https://chat.example"
+	})
+	post := func(path, body string) (*http.Response, map[string]any) {
+		t.Helper()
+		resp, err := http.Post(base+path, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("POST %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		var out map[string]any
+		json.NewDecoder(resp.Body).Decode(&out)
+		return resp, out
+	}
+	linkToken := func(path string) string {
+		t.Helper()
+		select {
+		case msg := <-mail:
+			link := "https://chat.example" + path + "?token="
+			i := bytes.Index(msg, []byte(link))
+			if i < 0 {
+				t.Fatalf("no %s link in\n%s", path, msg)
+			}
+			token, _, _ := strings.Cut(string(msg[i+len(link):]), "\r\n")
+			return token
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no mail for %s", path)
+		}
+		return ""
+	}
+
+	// every POST here counts against the login rate limit, which lets 10 through
+	if resp, _ := post("/api/register", `{"username":"kari","password":"hunter22","email":"not an address"}`); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("register with a bad address: %s", resp.Status)
+	}
+	if resp, _ := post("/api/register", `{"username":"kari","password":"hunter22","email":"kari@example.com"}`); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("register: %s", resp.Status)
+	}
+	verify := linkToken("/api/email/verify")
+
+	// unchecked addresses get no resets
+	if resp, _ := post("/api/password/forgot", `{"login":"kari@example.com"}`); resp.StatusCode != http.StatusAccepted {
+		t.Errorf("forgot: %s", resp.Status)
+	}
+	select {
+	case <-mail:
+		t.Error("reset mailed to an unchecked address")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	resp, err := http.Get(base + "/api/email/verify?token=" + verify)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("verify: %v %v", err, resp.Status)
+	}
+	resp.Body.Close()
+	if resp, _ := http.Get(base + "/api/email/verify?token=" + verify); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("verify twice: %s", resp.Status)
+	}
+
+	if resp, _ := post("/api/password/forgot", `{"login":"nobody"}`); resp.StatusCode != http.StatusAccepted {
+		t.Errorf("forgot for nobody: %s", resp.Status)
+	}
+	post("/api/password/forgot", `{"login":"KARI@example.com"}`)
+	reset := linkToken("/api/password/reset")
+
+	_, out := post("/api/login", `{"username":"kari","password":"hunter22"}`)
+	old, _ := out["token"].(string)
+	resp, out = post("/api/password/reset", fmt.Sprintf(`{"token":%q,"password":"correct horse"}`, reset))
+	if resp.StatusCode != http.StatusOK || out["token"] == "" {
+		t.Fatalf("reset: %s %v", resp.Status, out)
+	}
+	if resp, _ := post("/api/password/reset", fmt.Sprintf(`{"token":%q,"password":"again again"}`, reset)); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("reset token used twice: %s", resp.Status)
+	}
+	if resp, _ := post("/api/login", `{"username":"kari","password":"hunter22"}`); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("old password still works: %s", resp.Status)
+	}
+	if resp, _ := post("/api/login", `{"username":"kari","password":"correct horse"}`); resp.StatusCode != http.StatusOK {
+		t.Errorf("new password: %s", resp.Status)
+	}
+	url := "ws" + strings.TrimPrefix(base, "http") + "/ws?login=" + old
+	if _, resp, err := websocket.DefaultDialer.Dial(url, nil); err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("login from before the reset still works: %v", err)
+	}
+}
+
+func TestRevokeLogins(t *testing.T) {
+	base := startServer(t, func(cfg *chat.Config) {
+		cfg.AdminToken = "secret"
+		cfg.LoginTTL = 300 * time.Millisecond
+	})
+	login := func() (string, string) {
+		t.Helper()
+		resp, err := http.Post(base+"/api/login", "application/json", strings.NewReader(`{"username":"kari","password":"hunter22"}`))
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("login: %v %v", err, resp.Status)
+		}
+		defer resp.Body.Close()
+		var out struct {
+			Account struct{ ID string }
+			Token   string
+		}
+		json.NewDecoder(resp.Body).Decode(&out)
+		return out.Account.ID, out.Token
+	}
+	ws := "ws" + strings.TrimPrefix(base, "http") + "/ws?login="
+	rejected := func(token string) bool {
+		_, resp, err := websocket.DefaultDialer.Dial(ws+token, nil)
+		return err != nil && resp != nil && resp.StatusCode == http.StatusUnauthorized
+	}
+	resp, err := http.Post(base+"/api/register", "application/json", strings.NewReader(`{"username":"kari","password":"hunter22"}`))
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("register: %v %v", err, resp.Status)
+	}
+	resp.Body.Close()
+
+	_, token := login()
+	time.Sleep(400 * time.Millisecond)
+	if !rejected(token) {
+		t.Error("expired login still works")
+	}
+
+	id, token := login()
+	kari := dial(t, base, "login="+token)
+	kari.expect("joined", isCount(1))
+	req, _ := http.NewRequest(http.MethodDelete, base+"/admin/accounts/"+id+"/logins", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("revoke: %v %v", err, resp.Status)
+	}
+	var revoked struct{ Logins, Connections int }
+	json.NewDecoder(resp.Body).Decode(&revoked)
+	resp.Body.Close()
+	if revoked.Logins != 1 || revoked.Connections != 1 {
+		t.Errorf("revoked %+v, want a login and a connection", revoked)
+	}
+	kari.expect("signed out", isText(protocol.FrameSystem, "You were signed out, log in again."))
+	if !rejected(token) {
+		t.Error("revoked login still works")
+	}
+}
+
+func TestMessageFilters(t *testing.T) {
+	base := startServer(t, func(cfg *chat.Config) {
+		cfg.Filters = []hub.MessageFilter{
+			hub.FilterFunc(func(m *hub.Message) hub.Verdict {
+				m.Text = strings.ReplaceAll(m.Text, "color", "colour")
+				return hub.Verdict{}
+			}),
+			hub.FilterFunc(func(m *hub.Message) hub.Verdict {
+				switch {
+				case strings.Contains(m.Text, "quiet"):
+					return hub.Verdict{Reject: true, Notice: "Not in " + m.Room + " you don't."}
+				case strings.Contains(m.Text, "sell"):
+					return hub.Verdict{Rule: "no selling"}
+				}
+				return hub.Verdict{}
+			}),
+		}
+	})
+	c := dial(t, base, "")
+	c.expect("joined", isCount(1))
+
+	c.send("nice color")
+	c.expect("rewritten message", isText(protocol.FrameMessage, "nice colour"))
+	c.send("be quiet")
+	c.expect("notice", isText(protocol.FrameSystem, "Not in lobby you don't."))
+	c.send("want to sell?")
+	if f := c.expect("strike", isType(protocol.FrameStrike)); f.Strike == nil || f.Strike.Rule != "no selling" || !strings.Contains(f.Text, `"no selling"`) {
+		t.Errorf("strike %+v", f)
+	}
+	c.send("still here")
+	c.expect("next message", isText(protocol.FrameMessage, "still here"))
+}
+
+func TestShadowBan(t *testing.T) {
+	base := startServer(t, func(cfg *chat.Config) { cfg.AdminToken = "secret" })
+	admin := func(method, path, body string) int {
+		t.Helper()
+		req, _ := http.NewRequest(method, base+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	alice := dial(t, base, "")
+	alice.rename("alice")
+	bob := dial(t, base, "")
+	bob.rename("bob")
+
+	if status := admin(http.MethodPost, "/admin/shadowbans", `{"name":"alice"}`); status != http.StatusCreated {
+		t.Fatalf("shadow ban: %d", status)
+	}
+	alice.send("anyone there?")
+	alice.expect("own message", isText(protocol.FrameMessage, "anyone there?"))
+	alice.send("/msg bob psst")
+	alice.expect("own DM", isText(protocol.FrameDirect, "psst"))
+	bob.send("quiet in here")
+	bob.expect("own message, nothing from alice before it", func(f protocol.Frame) bool {
+		if f.From == "alice" && (f.Type == protocol.FrameMessage || f.Type == protocol.FrameDirect) {
+			t.Errorf("bob got %q from a shadow banned alice", f.Text)
+		}
+		return f.Type == protocol.FrameMessage && f.From == "bob"
+	})
+
+	if status := admin(http.MethodDelete, "/admin/shadowbans?name=alice", ""); status != http.StatusNoContent {
+		t.Fatalf("lift: %d", status)
+	}
+	alice.send("back again")
+	bob.expect("alice's message", isText(protocol.FrameMessage, "back again"))
+}
+
+func TestShadowBanBypasses(t *testing.T) {
+	base := startServer(t, func(cfg *chat.Config) { cfg.AdminToken = "secret" })
+	resp, err := http.Post(base+"/api/register", "application/json", strings.NewReader(`{"username":"alice","password":"hunter22"}`))
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("register: %v %v", err, resp.Status)
+	}
+	var reg struct{ Token string }
+	json.NewDecoder(resp.Body).Decode(&reg)
+	resp.Body.Close()
+	alice := dial(t, base, "login="+reg.Token)
+	alice.expect("session", isType(protocol.FrameSession))
+	bob := dial(t, base, "")
+	bob.rename("bob")
+
+	req, _ := http.NewRequest(http.MethodPost, base+"/admin/shadowbans", strings.NewReader(`{"name":"alice"}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("shadow ban: %v %v", err, resp.Status)
+	}
+
+	alice.send(`{"type":"key_exchange","to":"bob","payload":"a2V5"}`)
+	alice.send(`{"type":"encrypted","to":"bob","payload":"c2VjcmV0"}`)
+	alice.expect("own ciphertext", isType(protocol.FrameEncrypted))
+	alice.send("/schedule 1s later")
+	alice.expect("own scheduled message", isText(protocol.FrameMessage, "later"))
+
+	bob.send("anyone?")
+	bob.expect("own message, nothing from alice before it", func(f protocol.Frame) bool {
+		if f.From == "alice" && (f.Type == protocol.FrameMessage || f.Type == protocol.FrameEncrypted || f.Type == protocol.FrameKeyExchange) {
+			t.Errorf("bob got %s %q from a shadow banned alice", f.Type, f.Text)
+		}
+		return f.Type == protocol.FrameMessage && f.From == "bob"
+	})
+}
+
+func TestModeratorShadowBan(t *testing.T) {
+	base := startServer(t, func(cfg *chat.Config) { cfg.RenameCooldown = 0 })
+	mod := dial(t, base, "room=ops") // creating the room makes you its moderator
+	mod.rename("mod")
+	troll := dial(t, base, "room=ops")
+	troll.rename("troll")
+	lurker := dial(t, base, "")
+	lurker.rename("lurker")
+
+	troll.send("/shadowban mod")
+	troll.expect("not a moderator", isText(protocol.FrameError, "Only moderators can shadow ban."))
+	mod.send("/shadowban lurker")
+	mod.expect("not in the room", isText(protocol.FrameError, "moderators can only shadow ban someone in their room"))
+
+	mod.send("/shadowban troll")
+	mod.expect("banned", isText(protocol.FrameSystem, "troll is shadow banned in #ops, nobody else here sees what they write now."))
+	mod.send("/shadowban")
+	mod.expect("names only, no addresses", isText(protocol.FrameSystem, "Shadow banned: troll (#ops)"))
+	troll.send("first!!!")
+	troll.expect("own message", isText(protocol.FrameMessage, "first!!!"))
+	mod.send("quiet now")
+	mod.expect("own message, nothing from troll before it", func(f protocol.Frame) bool {
+		if f.Type == protocol.FrameMessage && f.From == "troll" {
+			t.Errorf("mod got %q from a shadow banned troll", f.Text)
+		}
+		return f.Type == protocol.FrameMessage && f.From == "mod"
+	})
+
+	// only in #ops
+	troll.send("/join lobby")
+	troll.expect("lobby", isText(protocol.FrameSystem, "You are now in #lobby"))
+	troll.send("hi lobby")
+	lurker.expect("troll's message", isText(protocol.FrameMessage, "hi lobby"))
+
+	// the ban is the connection's that placed it, whatever it is called now
+	mod.rename("boss")
+	mod.send("/unshadowban troll")
+	mod.expect("lifted", isText(protocol.FrameSystem, "troll is no longer shadow banned."))
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	configFile := write("config.json", `{}`)
+	base := startServer(t, func(cfg *chat.Config) {
+		cfg.AdminToken = "secret"
+		cfg.ConfigFile = configFile
+		cfg.WordList = write("words.txt", "")
+		cfg.MOTDFile = write("motd.txt", "old news")
+	})
+	dialFrom := func(origin string) (*websocket.Conn, int) {
+		t.Helper()
+		conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(base, "http")+"/ws", http.Header{"Origin": {origin}})
+		if err != nil {
+			return nil, resp.StatusCode
+		}
+		resp.Body.Close()
+		t.Cleanup(func() { conn.Close() })
+		return conn, resp.StatusCode
+	}
+	if _, status := dialFrom("https://evil.example"); status != http.StatusSwitchingProtocols {
+		t.Fatalf("any origin before the reload: %d", status)
+	}
+	alice := dial(t, base, "")
+	alice.rename("alice")
+	bob := dial(t, base, "")
+	bob.rename("bob")
+
+	write("config.json", `{"allowed_origins": ["https://chat.example.com/"], "rate_limits": {"auth": {"per_second": 1, "burst": 5}}}`)
+	write("words.txt", "darn\n")
+	write("motd.txt", "fresh news")
+	req, _ := http.NewRequest(http.MethodPost, base+"/admin/reload", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("reload: %d", resp.StatusCode)
+	}
+
+	// still connected, under the new word list
+	alice.send("darn it")
+	alice.send("sorry")
+	bob.expect("alice's apology and not the word before it", func(f protocol.Frame) bool {
+		if f.Type == protocol.FrameMessage && f.Text == "darn it" {
+			t.Errorf("banned word got through after the reload")
+		}
+		return f.Type == protocol.FrameMessage && f.Text == "sorry"
+	})
+
+	if _, status := dialFrom("https://evil.example"); status != http.StatusForbidden {
+		t.Errorf("origin not on the list: %d", status)
+	}
+	conn, _ := dialFrom("https://chat.example.com")
+	if conn == nil {
+		t.Fatal("allowed origin refused")
+	}
+	c := &testClient{t: t, conn: conn}
+	c.expect("new MOTD", isText(protocol.FrameMOTD, "fresh news"))
+
+	write("config.json", `{"rate_limits": {"auth": {"per_second": 0}}}`)
+	req, _ = http.NewRequest(http.MethodPost, base+"/admin/reload", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("bad config: %d", resp.StatusCode)
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	if _, err := chat.ParseTrustedProxies("10.0.0.0/8, nonsense"); err == nil {
+		t.Error("took nonsense for a proxy")
+	}
+	proxies, err := chat.ParseTrustedProxies("127.0.0.1, 10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted := startServer(t, func(cfg *chat.Config) {
+		cfg.AdminToken = "secret"
+		cfg.TrustedProxies = proxies
+	})
+	behind := startServer(t, func(cfg *chat.Config) {
+		cfg.AdminToken = "secret"
+		cfg.BehindProxy = true // the test client is on loopback
+	})
+	ipOf := func(base string, header http.Header) string {
+		t.Helper()
+		conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(base, "http")+"/ws", header)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		resp.Body.Close()
+		defer conn.Close()
+		c := &testClient{t: t, conn: conn}
+		hello := c.expect("session", isType(protocol.FrameSession))
+
+		req, _ := http.NewRequest(http.MethodGet, base+"/admin/connections", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var conns []struct{ Username, IP string }
+		json.NewDecoder(resp.Body).Decode(&conns)
+		for _, c := range conns {
+			if c.Username == hello.From {
+				return c.IP
+			}
+		}
+		t.Fatalf("%s not among %+v", hello.From, conns)
+		return ""
+	}
+
+	for _, tc := range []struct {
+		base   string
+		header http.Header
+		want   string
+	}{
+		{trusted, nil, "127.0.0.1"},
+		{trusted, http.Header{"X-Real-Ip": {"203.0.113.7"}}, "203.0.113.7"},
+		// the client made up the first one, the last is a proxy of ours
+		{trusted, http.Header{"X-Forwarded-For": {"6.6.6.6, 203.0.113.7, 10.1.2.3"}}, "203.0.113.7"},
+		{trusted, http.Header{"X-Forwarded-For": {"10.0.0.1", "10.0.0.2"}}, "10.0.0.1"},
+		// only addresses get in, anything else is the proxy's
+		{trusted, http.Header{"X-Real-Ip": {"<script>"}}, "127.0.0.1"},
+		{trusted, http.Header{"X-Forwarded-For": {"6.6.6.6, not an address"}}, "127.0.0.1"},
+		{trusted, http.Header{"X-Forwarded-For": {"::ffff:203.0.113.7"}}, "203.0.113.7"},
+		{behind, http.Header{"X-Forwarded-For": {"6.6.6.6, 203.0.113.7"}}, "203.0.113.7"},
+		{behind, http.Header{"X-Real-Ip": {"nonsense"}}, "127.0.0.1"},
+	} {
+		if got := ipOf(tc.base, tc.header); got != tc.want {
+			t.Errorf("%v: client IP %s, want %s", tc.header, got, tc.want)
+		}
+	}
+}
+
+func TestTranscriptExport(t *testing.T) {
+	base := startServer(t, func(cfg *chat.Config) { cfg.AdminToken = "secret" })
+	alice := dial(t, base, "room=ops") // first in, so a moderator
+	alice.rename("alice")
+	bob := dial(t, base, "room=ops")
+	bob.rename("bob")
+	alice.send("deploy at five")
+	alice.expect("own message", isText(protocol.FrameMessage, "deploy at five"))
+	bob.send(`fine, "no" rollback`)
+	alice.expect("bob's message", isType(protocol.FrameMessage))
+
+	bob.send("/export")
+	bob.expect("not a moderator", isType(protocol.FrameError))
+	alice.send("/export csv 2000-01-01")
+	link := alice.expect("link", func(f protocol.Frame) bool {
+		return f.Type == protocol.FrameSystem && strings.Contains(f.Text, "/api/export?token=")
+	}).Text
+	link = link[strings.Index(link, "/api/export"):]
+
+	resp, err := http.Get(base + link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(resp.Body).ReadAll()
+	resp.Body.Close()
+	if err != nil || len(rows) != 3 || rows[1][2] != "alice" || rows[2][3] != `fine, "no" rollback` {
+		t.Fatalf("csv transcript: %q %v", rows, err)
+	}
+	if cd := resp.Header.Get("Content-Disposition"); !strings.Contains(cd, "ops-transcript.csv") {
+		t.Errorf("Content-Disposition %q", cd)
+	}
+	if resp, err := http.Get(base + "/api/export?token=nope"); err != nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("made up token: %v %v", err, resp.Status)
+	}
+
+	admin := func(query string) (int, []protocol.Frame) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, base+"/admin/rooms/ops/export"+query, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var messages []protocol.Frame
+		json.NewDecoder(resp.Body).Decode(&messages)
+		return resp.StatusCode, messages
+	}
+	if status, messages := admin(""); status != http.StatusOK || len(messages) != 2 {
+		t.Errorf("admin export: %d %+v", status, messages)
+	}
+	tomorrow := time.Now().AddDate(0, 0, 1).Format(time.DateOnly)
+	if status, messages := admin("?from=" + tomorrow); status != http.StatusOK || len(messages) != 0 {
+		t.Errorf("export from tomorrow: %d %+v", status, messages)
+	}
+	if status, _ := admin("?from=yesterday"); status != http.StatusBadRequest {
+		t.Errorf("bad date: %d", status)
+	}
+}
+
+func TestPolls(t *testing.T) {
+	base := startServer(t)
+	kari := dial(t, base, "room=dev")
+	kari.rename("kari")
+	ola := dial(t, base, "room=dev")
+	ola.rename("ola")
+
+	kari.send(`/poll "Lunch where?" pizza "the sushi place"`)
+	posted := ola.expect("poll", isType(protocol.FramePoll))
+	if p := posted.Poll; p == nil || p.Question != "Lunch where?" || len(p.Options) != 2 || p.Options[1].Text != "the sushi place" || posted.ID == 0 {
+		t.Fatalf("poll frame %+v", posted)
+	}
+	results := func(c *testClient, what string, pizza, sushi int) {
+		t.Helper()
+		c.expect(what, func(f protocol.Frame) bool {
+			return f.Type == protocol.FramePoll && f.ID == posted.ID && f.Poll.Options[0].Votes == pizza && f.Poll.Options[1].Votes == sushi
+		})
+	}
+	ola.send(fmt.Sprintf(`{"type":"vote","id":%d,"option":1}`, posted.ID))
+	results(kari, "ola's vote", 1, 0)
+	ola.send(fmt.Sprintf(`{"type":"vote","id":%d,"option":2}`, posted.ID))
+	results(kari, "ola changing the vote", 0, 1)
+	kari.send(fmt.Sprintf("/vote %d 2", posted.ID))
+	results(ola, "kari's vote", 0, 2)
+	ola.send(fmt.Sprintf(`{"type":"vote","id":%d,"option":3}`, posted.ID))
+	ola.expect("no third option", isText(protocol.FrameError, "no such option in the poll"))
+
+	ola.send("/endpoll")
+	ola.expect("not ola's poll", isText(protocol.FrameError, "only who asked and moderators can end a poll"))
+	kari.send("/endpoll")
+	closed := ola.expect("final results", func(f protocol.Frame) bool { return f.Type == protocol.FramePoll && f.Poll.Closed })
+	if closed.Poll.Options[1].Votes != 2 {
+		t.Errorf("final results %+v", closed.Poll)
+	}
+	ola.expect("winner", isText(protocol.FrameSystem, `The poll "Lunch where?" is closed: the sushi place, with 2 votes.`))
+	ola.send(fmt.Sprintf(`{"type":"vote","id":%d,"option":1}`, posted.ID))
+	ola.expect("closed poll", isText(protocol.FrameError, "no open poll with that ID in this room"))
+
+	kari.send("/poll 0s \"Too short?\" yes no")
+	kari.expect("bad duration", isType(protocol.FrameError))
+	kari.send(`/poll "Only one option?" yes`)
+	kari.expect("one option", isType(protocol.FrameError))
+}
+
+func TestQuotes(t *testing.T) {
+	base := startServer(t)
+	kari := dial(t, base, "room=dev")
+	kari.rename("kari")
+	ola := dial(t, base, "room=dev")
+	ola.rename("ola")
+
+	kari.send("ship it on friday")
+	original := ola.expect("original", isText(protocol.FrameMessage, "ship it on friday"))
+	ola.send(fmt.Sprintf(`{"type":"message","text":"no way","quote":%d}`, original.ID))
+	got := kari.expect("quote", isText(protocol.FrameMessage, "no way"))
+	if q := got.Quote; q == nil || q.ID != original.ID || q.From != "kari" || q.Text != "ship it on friday" || q.TS != original.TS {
+		t.Fatalf("quote %+v, want a copy of %+v", got.Quote, original)
+	}
+	kari.send(fmt.Sprintf("/quote %d fine, monday", got.ID))
+	if q := ola.expect("quote by command", isText(protocol.FrameMessage, "fine, monday")).Quote; q == nil || q.Text != "no way" {
+		t.Errorf("/quote %+v", q)
+	}
+
+	ola.send(`{"type":"message","text":"what?","quote":1000000}`)
+	ola.expect("unknown message", isText(protocol.FrameError, "the message you are quoting is not in this room's history"))
+
+	// and history keeps it
+	resp, err := http.Get(base + "/api/rooms/dev/history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var history []protocol.Frame
+	json.NewDecoder(resp.Body).Decode(&history)
+	resp.Body.Close()
+	if len(history) != 3 || history[1].Quote == nil || history[1].Quote.Text != "ship it on friday" {
+		t.Errorf("history %+v", history)
+	}
+}
+
+func TestCustomEmoji(t *testing.T) {
+	base := startServer(t, func(cfg *chat.Config) { cfg.AdminToken = "secret" })
+	admin := func(method, path string, body []byte) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, base+path, bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	png := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 64)...)
+	if resp := admin(http.MethodPut, "/admin/emoji/party", png); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("upload: %s", resp.Status)
+	}
+	if resp := admin(http.MethodPut, "/admin/emoji/script", []byte("<svg><script>alert(1)</script></svg>")); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("svg upload: %s", resp.Status)
+	}
+	if resp := admin(http.MethodPut, "/admin/emoji/Bad%20Name", png); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("bad name: %s", resp.Status)
+	}
+
+	kari := dial(t, base, "")
+	catalog := kari.expect("catalog", isType(protocol.FrameEmoji))
+	if len(catalog.Emoji) != 1 || catalog.Emoji[0].Name != "party" {
+		t.Fatalf("catalog %+v", catalog.Emoji)
+	}
+	kari.send("release :party: :party: :nope:")
+	msg := kari.expect("message", isType(protocol.FrameMessage))
+	if msg.Text != "release :party: :party: :nope:" || len(msg.Emoji) != 1 || msg.Emoji[0] != catalog.Emoji[0] {
+		t.Errorf("message %q with emoji %+v", msg.Text, msg.Emoji)
+	}
+
+	resp, err := http.Get(base + catalog.Emoji[0].URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "image/png" || !bytes.Equal(image, png) {
+		t.Errorf("image: %s %q", resp.Header.Get("Content-Type"), image)
+	}
+
+	if resp := admin(http.MethodDelete, "/admin/emoji/party", nil); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("delete: %s", resp.Status)
+	}
+	kari.expect("empty catalog", func(f protocol.Frame) bool { return f.Type == protocol.FrameEmoji && len(f.Emoji) == 0 })
+	if resp, err := http.Get(base + "/emoji/party"); err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("deleted emoji: %v %v", err, resp.Status)
+	}
+}
+
+func TestMarkdownRendering(t *testing.T) {
+	base := startServer(t)
+	kari := dial(t, base, "")
+	kari.rename("kari")
+	ola := dial(t, base, "")
+	ola.rename("ola")
+
+	kari.send("**ship** it <img src=x onerror=alert(1)>")
+	got := ola.expect("message", isType(protocol.FrameMessage))
+	if got.Text != "**ship** it <img src=x onerror=alert(1)>" || got.HTML != "<strong>ship</strong> it &lt;img src=x onerror=alert(1)&gt;" {
+		t.Errorf("text %q, html %q", got.Text, got.HTML)
+	}
+	kari.send("/msg ola see `make test`")
+	if dm := ola.expect("direct", isType(protocol.FrameDirect)); dm.HTML != "see <code>make test</code>" {
+		t.Errorf("direct html %q", dm.HTML)
+	}
+}
+
+func TestNameColors(t *testing.T) {
+	base := startServer(t)
+	kari := dial(t, base, "")
+	kari.rename("kari")
+	ola := dial(t, base, "")
+	ola.rename("ola")
+
+	kari.send("hei")
+	derived := ola.expect("message", isText(protocol.FrameMessage, "hei")).Color
+	if !strings.HasPrefix(derived, "#") {
+		t.Fatalf("no color on the message: %q", derived)
+	}
+	kari.send("again")
+	if again := ola.expect("message", isText(protocol.FrameMessage, "again")).Color; again != derived {
+		t.Errorf("color changed from %s to %s", derived, again)
+	}
+
+	kari.send("/color chartreuse")
+	kari.expect("not in the palette", isText(protocol.FrameError, "pick one of the palette's colors, see /color"))
+	kari.send("/color Teal")
+	if p := ola.expect("presence", isType(protocol.FramePresence)); p.From != "kari" || p.Color != "#0c8599" {
+		t.Errorf("presence %s in %q", p.From, p.Color)
+	}
+	kari.send("teal now")
+	if c := ola.expect("message", isText(protocol.FrameMessage, "teal now")).Color; c != "#0c8599" {
+		t.Errorf("message color %q after /color teal", c)
+	}
+	kari.send("/color -")
+	if p := ola.expect("presence", isType(protocol.FramePresence)); p.Color != derived {
+		t.Errorf("color %q after /color -, want %s back", p.Color, derived)
+	}
+}
+
+func TestGuestNames(t *testing.T) {
+	base := startServer(t)
+	alice := dial(t, base, "")
+	bob := dial(t, base, "")
+	a := alice.expect("session", isType(protocol.FrameSession)).From
+	b := bob.expect("session", isType(protocol.FrameSession)).From
+	if !strings.HasPrefix(a, "guest-") || !strings.HasPrefix(b, "guest-") || a == b {
+		t.Errorf("guests are %q and %q", a, b)
+	}
+
+	// nobody gets to pick a guest name, not even their own
+	alice.send("/u " + b)
+	alice.expect("reserved", isText(protocol.FrameError, "names starting with guest- are for guests"))
+	alice.send("/u Guest-1")
+	alice.expect("reserved", isText(protocol.FrameError, "names starting with guest- are for guests"))
+}
+
+func TestRenameValidation(t *testing.T) {
+	base := startServer(t)
+	alice := dial(t, base, "")
+	for _, name := range []string{"admin", "System", "", "two words", "bell\x07", "zero\u200bwidth", strings.Repeat("a", 33)} {
+		alice.send("/u " + name)
+		if f := alice.expect("rejected "+name, isType(protocol.FrameError)); f.Code != protocol.CodeNameTaken && f.Code != protocol.CodeInvalid {
+			t.Errorf("/u %q: %+v", name, f)
+		}
+	}
+	alice.send("/u root")
+	alice.expect("reserved", isText(protocol.FrameError, "that name is reserved"))
+	// none of those used up the free rename
+	alice.rename("alice")
+
+	// registering gives the same reason
+	resp, err := http.Post(base+"/api/register", "application/json", strings.NewReader(`{"username":"Admin","password":"hunter22"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict || strings.TrimSpace(string(body)) != "that name is reserved" {
+		t.Errorf("registering admin: %s %q", resp.Status, body)
+	}
+}
+
+func TestRoomPolicy(t *testing.T) {
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<html><head><meta property="og:title" content="Release notes"></head></html>`)
+	}))
+	defer site.Close()
+	base := startServer(t, func(cfg *chat.Config) { cfg.LinkPreviews = &preview.Config{AllowPrivate: true} })
+	mod := dial(t, base, "room=ops") // creating the room makes you its moderator
+	mod.rename("mod")
+	member := dial(t, base, "room=ops")
+	mod.expect("member joining", isCount(2))
+
+	member.send("/policy reactions off")
+	member.expect("refused", isText(protocol.FrameError, "Only moderators can change the room policy."))
+	mod.send("/policy reactions off")
+	if f := member.expect("room update", isType(protocol.FrameRoomUpdated)); f.Meta == nil || !f.Meta.Policy.NoReactions {
+		t.Fatalf("room_updated %+v", f.Meta)
+	}
+	mod.send("/policy link_previews off")
+	if f := member.expect("room update", isType(protocol.FrameRoomUpdated)); f.Meta == nil || !f.Meta.Policy.NoLinkPreviews || !f.Meta.Policy.NoReactions {
+		t.Fatalf("room_updated %+v", f.Meta)
+	}
+
+	mod.send("ship it")
+	msg := member.expect("message", isText(protocol.FrameMessage, "ship it"))
+	member.send(fmt.Sprintf("/react %d 👍", msg.ID))
+	member.expect("reaction refused", isText(protocol.FrameError, "reactions are turned off in this room"))
+
+	// no preview with the message, and none later either
+	member.send("read " + site.URL + "/notes")
+	if f := member.expect("own message", isType(protocol.FrameMessage)); f.Preview != nil {
+		t.Errorf("preview in a room without them: %+v", f.Preview)
+	}
+	time.Sleep(100 * time.Millisecond) // a fetch of the loopback site would be done by now
+	member.send("done")
+	member.expect("next message, no preview before it", func(f protocol.Frame) bool {
+		if f.Type == protocol.FramePreview {
+			t.Errorf("late preview in a room without them: %+v", f.Preview)
+		}
+		return f.Type == protocol.FrameMessage && f.Text == "done"
+	})
+}
+
+func TestRoomLockCommands(t *testing.T) {
+	base := startServer(t)
+	mod := dial(t, base, "room=club")
+	mod.rename("mod")
+
+	mod.send("/password")
+	mod.expect("usage, the room stays as it is", isText(protocol.FrameError, "Usage: /password <password|off>"))
+	mod.send("/password hunter2")
+	mod.expect("locked", isText(protocol.FrameSystem, "Room password updated."))
+	mod.send("/password OFF")
+	mod.expect("unlocked", isText(protocol.FrameSystem, "Room password removed."))
+
+	mod.send("/inviteonly yes")
+	mod.expect("usage", isText(protocol.FrameError, "Usage: /inviteonly <on|off>"))
+	mod.send("/inviteonly ON")
+	mod.expect("on", isText(protocol.FrameSystem, "#club invite only: on"))
+	mod.send("/inviteonly off")
+	mod.expect("off", isText(protocol.FrameSystem, "#club invite only: off"))
+}
+
+func TestUnscheduleOwner(t *testing.T) {
+	base := startServer(t, func(cfg *chat.Config) { cfg.RenameCooldown = 0 })
+	alice := dial(t, base, "")
+	alice.rename("alice")
+	alice.send("/schedule 1h see you later")
+	scheduled := alice.expect("scheduled", func(f protocol.Frame) bool {
+		return f.Type == protocol.FrameSystem && strings.HasPrefix(f.Text, "Message ")
+	})
+	id := strings.Fields(scheduled.Text)[1]
+
+	// alice moves on and someone else takes her name
+	alice.rename("alice2")
+	mallory := dial(t, base, "")
+	mallory.rename("alice")
+	mallory.send("/unschedule " + id)
+	mallory.expect("not hers", isText(protocol.FrameError, "No scheduled message "+id+" of yours."))
+
+	alice.send("/unschedule " + id)
+	alice.expect("cancelled", isText(protocol.FrameSystem, "Scheduled message "+id+" cancelled."))
+}
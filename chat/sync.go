@@ -0,0 +1,69 @@
+package chat
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Changes per sync response, clients page with the cursor they get back
+const maxSyncChanges = 1000
+
+// ######################################################################
+// function: handleSync()
+// ######################################################################
+// GET /api/sync?since=<cursor>&rooms=a,b returns every message, deletion,
+// reaction, poll update and late preview in those rooms since the cursor,
+// plus the cursor to pass next time. Without ?rooms that is every open
+// room, and with a login token also the locked rooms the user is in and
+// their read markers. For mobile clients coming back after hours, so it
+// is gzipped when they accept it.
+func (s *Server) handleSync(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var account string
+	if token := loginToken(r); token != "" {
+		a, ok := s.hub.LoginAccount(token)
+		if !ok {
+			http.Error(w, "not logged in", http.StatusUnauthorized)
+			return
+		}
+		account = a.ID
+	}
+	q := r.URL.Query()
+	var rooms []string
+	for _, name := range strings.Split(q.Get("rooms"), ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			rooms = append(rooms, name)
+		}
+	}
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	if limit <= 0 || limit > maxSyncChanges {
+		limit = maxSyncChanges
+	}
+	res, err := s.hub.Sync(q.Get("since"), account, rooms, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		writeJSON(w, http.StatusOK, res)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Add("Vary", "Accept-Encoding")
+	zw := gzip.NewWriter(w)
+	if err := json.NewEncoder(zw).Encode(res); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
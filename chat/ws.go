@@ -0,0 +1,238 @@
+package chat
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"go-chat-app/internal/client"
+	"go-chat-app/internal/hub"
+	"go-chat-app/internal/i18n"
+	"go-chat-app/internal/protocol"
+
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	// the Server's checkOrigin takes over, see reload.go
+	CheckOrigin: func(r *http.Request) bool { return true },
+	// chat.v1 JSON unless the client asks for something newer
+	Subprotocols: protocol.Subprotocols,
+}
+
+var tracer = otel.Tracer("go-chat-app/chat")
+
+// Upgrades by outcome, ok or why the connection was refused
+var upgrades, _ = otel.Meter("go-chat-app/chat").Int64Counter("chat.upgrades",
+	metric.WithUnit("{upgrade}"), metric.WithDescription("WebSocket upgrade requests by outcome."))
+
+// ######################################################################
+// function: handleConnection()
+// ######################################################################
+// The span covers getting the connection going, not its whole life.
+func (s *Server) handleConnection(w http.ResponseWriter, r *http.Request) {
+	ip := s.clientIP(r)
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer.Start(ctx, "chat.upgrade", trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("client.address", ip), attribute.String("user_agent.original", r.UserAgent())))
+	finish := func(outcome string) {
+		span.SetAttributes(attribute.String("chat.upgrade.outcome", outcome))
+		span.End()
+		upgrades.Add(ctx, 1, metric.WithAttributes(attribute.String("outcome", outcome)))
+	}
+
+	if until, banned := s.hub.IsBanned(ip); banned {
+		finish("banned")
+		http.Error(w, "banned until "+until.Format(time.RFC3339), http.StatusForbidden)
+		return
+	}
+	if !s.hub.AcquireIP(ip) {
+		finish("ip_limit")
+		http.Error(w, "too many connections from your address", http.StatusTooManyRequests)
+		return
+	}
+	defer s.hub.ReleaseIP(ip)
+
+	// Logged in clients become their account, a stale token is refused so
+	// the client knows to log in again instead of quietly being a guest
+	var account hub.Account
+	if key := botKey(r); key != "" {
+		var ok bool
+		if account, ok = s.hub.BotAccount(key); !ok {
+			finish("unauthorized")
+			http.Error(w, "invalid api key", http.StatusUnauthorized)
+			return
+		}
+	} else if token := loginToken(r); token != "" {
+		var ok bool
+		if account, ok = s.hub.LoginAccount(token); !ok {
+			finish("unauthorized")
+			http.Error(w, "login expired", http.StatusUnauthorized)
+			return
+		}
+	}
+	if !s.guestAllowed(r, ip, account.ID) {
+		finish("challenge")
+		http.Error(w, "solve the challenge at /api/challenge first", http.StatusPreconditionRequired)
+		return
+	}
+
+	ws, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		finish("failed")
+		log.Println("Upgrade error: ", err)
+		return
+	}
+	defer ws.Close()
+	ws.SetReadLimit(readLimit(s.cfg.MaxMessage))
+
+	query := r.URL.Query()
+	clientVersion := query.Get("v")
+	if s.cfg.BlockedVersions[clientVersion] {
+		finish("version")
+		log.Printf("Refusing client version %q from %s", clientVersion, ip)
+		msg := websocket.FormatCloseMessage(protocol.CloseUpgradeRequired, "client version "+clientVersion+" is no longer supported, please upgrade")
+		ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+		return
+	}
+
+	locale := i18n.Negotiate(query.Get("lang"), r.Header.Get("Accept-Language"))
+	c := client.New(ws, ip, r.UserAgent(), clientVersion, locale)
+	if s.cfg.Compression {
+		if err := c.EnableCompression(s.cfg.CompressionLevel, s.cfg.CompressionMinSize); err != nil {
+			log.Printf("Error setting compression level: %v", err)
+		}
+	}
+	if !s.negotiateLegacy(c, ws, query) {
+		finish("legacy")
+		return
+	}
+	lastID, _ := strconv.ParseInt(query.Get("last"), 10, 64)
+	span.SetAttributes(attribute.String("chat.client_version", clientVersion), attribute.String("chat.protocol", ws.Subprotocol()))
+	finish("ok")
+	s.hub.Serve(c, query.Get("sid"), query.Get("room"), query.Get("key"), account, lastID)
+}
+
+// ######################################################################
+// function: readLimit()
+// ######################################################################
+// Where a transport cuts a client off. The hub refuses frames over
+// maxMessage with an error and a strike, this only stops a client from
+// making us buffer megabytes first.
+func readLimit(maxMessage int) int64 {
+	if maxMessage <= 0 {
+		return 1 << 20
+	}
+	return 2 * int64(maxMessage)
+}
+
+// ######################################################################
+// function: clientIP()
+// ######################################################################
+// The address rate limits, bans and logs go by. When the connection comes
+// from a proxy we trust, X-Forwarded-For is read from the right, skipping
+// our own proxies: the first address that isn't one is the client, what
+// comes before it is whatever the client chose to send. Without the header
+// X-Real-IP is taken. BehindProxy trusts peers on loopback and private
+// addresses and nothing further. Anything that doesn't parse as an address
+// is ignored for the peer's, it would end up in bans and the audit log.
+func (s *Server) clientIP(r *http.Request) string {
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peer = r.RemoteAddr // unix socket, "" or "@"
+	}
+	if !s.trustedProxy(peer) {
+		return peer
+	}
+	var hops []string
+	for _, xff := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(xff, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	var forwarded string
+	switch {
+	case len(hops) == 0:
+		forwarded = strings.TrimSpace(r.Header.Get("X-Real-IP"))
+	case len(s.cfg.TrustedProxies) == 0:
+		forwarded = hops[len(hops)-1] // the one our proxy appended
+	default:
+		forwarded = hops[0] // proxies all the way down
+		for i := len(hops) - 1; i > 0; i-- {
+			if !s.trustedProxy(hops[i]) {
+				forwarded = hops[i]
+				break
+			}
+		}
+	}
+	if ip, err := netip.ParseAddr(forwarded); err == nil {
+		return ip.Unmap().String()
+	}
+	return peer
+}
+
+// ######################################################################
+// function: trustedProxy()
+// ######################################################################
+// Whether addr is one of our proxies. Unix socket peers have no address
+// and count as one if there are any, only a local proxy can reach them.
+// With BehindProxy and no TrustedProxies that is anything on a loopback
+// or private address, a client reaching the port from outside can't say
+// where it is from.
+func (s *Server) trustedProxy(addr string) bool {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return (addr == "" || addr == "@") && (s.cfg.BehindProxy || len(s.cfg.TrustedProxies) > 0)
+	}
+	ip = ip.Unmap()
+	if len(s.cfg.TrustedProxies) == 0 {
+		return s.cfg.BehindProxy && (ip.IsLoopback() || ip.IsPrivate())
+	}
+	for _, prefix := range s.cfg.TrustedProxies {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ######################################################################
+// function: ParseTrustedProxies()
+// ######################################################################
+// A -trusted-proxies flag: addresses and CIDR ranges, comma separated,
+// like "10.0.0.0/8,127.0.0.1".
+func ParseTrustedProxies(v string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		if ip, err := netip.ParseAddr(s); err == nil {
+			ip = ip.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(ip, ip.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q: not an address or CIDR range", s)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
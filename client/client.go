@@ -0,0 +1,538 @@
+// Package client is the Go SDK for the chat server. It does the WebSocket
+// and protocol work: the hello, heartbeats, acks, and reconnecting with the
+// same session so nothing is missed.
+//
+//	c := client.New("ws://localhost:6969/ws")
+//	c.SetUsername("alice")
+//	c.Join("dev", "")
+//	c.OnMessage(func(m client.Message) {
+//		fmt.Printf("%s: %s\n", m.From, m.Text)
+//	})
+//	if err := c.Connect(ctx); err != nil {
+//		log.Fatal(err)
+//	}
+//	c.Send("hello")
+//
+// Connect returns once the first connection is up and keeps it up until ctx
+// is done, Run does the same but blocks and also retries the first one.
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go-chat-app/internal/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+// Frame is everything the server sends, see the type field for what it is.
+type Frame = protocol.Frame
+
+// ClientFrame is what clients send, for SendFrame.
+type ClientFrame = protocol.ClientFrame
+
+// Waits between reconnects, doubling from the first to the second
+const (
+	minBackoff = time.Second
+	maxBackoff = 30 * time.Second
+)
+
+// How often the server hears that someone is still there
+const heartbeatInterval = 25 * time.Second
+
+// Chat lines kept for resending until the server acks them
+const maxPending = 256
+
+var (
+	// ErrUnauthorized is returned when the server refuses the login token or
+	// bot key. Trying again with the same one is no use.
+	ErrUnauthorized = errors.New("client: the server refused the login")
+	// ErrUpgradeRequired is returned when the server no longer takes this
+	// client's Version.
+	ErrUpgradeRequired = errors.New("client: the server wants a newer client")
+	// ErrNotConnected is returned by the senders between connections. Send
+	// and Reply still send the line once connected again.
+	ErrNotConnected = errors.New("client: not connected")
+)
+
+// ######################################################################
+// struct: Message
+// ######################################################################
+// A chat line, or a private message when Direct is set.
+type Message struct {
+	ID      int64
+	ReplyTo int64            // the message this one answers in a thread
+	Quote   *protocol.Quote  // the message it quotes, as it was when quoted
+	Emoji   []protocol.Emoji // custom emoji in Text, their images are on the server
+	Room    string
+	From    string
+	Color   string // From's display color, #rrggbb
+	Text    string
+	HTML    string // Text rendered from Markdown, safe to show in a page
+	Direct  bool
+	Sent    time.Time // server time the message was posted
+}
+
+// ######################################################################
+// struct: Client
+// ######################################################################
+// Set the exported fields before connecting.
+type Client struct {
+	URL     string            // the server's WebSocket endpoint, ws://host/ws
+	Login   string            // login token from /api/login, "" = a guest
+	BotKey  string            // a bot's API key, instead of Login
+	Version string            // sent as ?v=, servers can refuse old versions
+	Dialer  *websocket.Dialer // nil = websocket.DefaultDialer
+
+	mu           sync.Mutex
+	conn         *websocket.Conn
+	sid          string
+	room, key    string
+	last         int64 // newest message seen, so a reconnect gets what we missed
+	name         string
+	wantName     string
+	onMessage    func(Message)
+	onFrame      func(Frame)
+	onDisconnect func(error)
+
+	idPrefix string        // random per Client, so client IDs don't collide across restarts
+	lastID   int64         // client IDs handed out so far
+	pending  []ClientFrame // chat lines the server hasn't acked, oldest first
+
+	writeMu sync.Mutex // gorilla allows one writer per connection
+}
+
+// ######################################################################
+// function: New()
+// ######################################################################
+func New(url string) *Client {
+	prefix := make([]byte, 6)
+	rand.Read(prefix)
+	return &Client{URL: url, idPrefix: hex.EncodeToString(prefix)}
+}
+
+// ######################################################################
+// function: OnMessage()
+// ######################################################################
+// Calls h for every chat line and private message. Handlers run one at a
+// time on the connection's reader, so hand slow work to a goroutine.
+func (c *Client) OnMessage(h func(Message)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onMessage = h
+}
+
+// ######################################################################
+// function: OnFrame()
+// ######################################################################
+// Calls h for every frame, chat lines included, before OnMessage.
+func (c *Client) OnFrame(h func(Frame)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onFrame = h
+}
+
+// ######################################################################
+// function: OnDisconnect()
+// ######################################################################
+// Calls h with the reason whenever the connection drops. The client
+// reconnects on its own afterwards.
+func (c *Client) OnDisconnect(h func(error)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onDisconnect = h
+}
+
+// ######################################################################
+// function: Username()
+// ######################################################################
+// What the server calls us, once connected.
+func (c *Client) Username() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.name
+}
+
+// ######################################################################
+// function: Room()
+// ######################################################################
+// The room we are in, "" before the first join.
+func (c *Client) Room() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.room
+}
+
+// ######################################################################
+// function: SetUsername()
+// ######################################################################
+// Asks for a new name, now if connected and otherwise on connect. A new
+// session after a long outage asks again.
+func (c *Client) SetUsername(name string) error {
+	c.mu.Lock()
+	c.wantName = name
+	connected := c.conn != nil
+	c.mu.Unlock()
+	if !connected {
+		return nil
+	}
+	return c.Command("/u " + name)
+}
+
+// ######################################################################
+// function: Join()
+// ######################################################################
+// Moves to room, key being its password or an invite. Before connecting it
+// sets the room to start in.
+func (c *Client) Join(room, key string) error {
+	c.mu.Lock()
+	c.room, c.key = room, key
+	connected := c.conn != nil
+	c.mu.Unlock()
+	if !connected {
+		return nil
+	}
+	if key != "" {
+		return c.Command("/join " + room + " " + key)
+	}
+	return c.Command("/join " + room)
+}
+
+// ######################################################################
+// function: Send()
+// ######################################################################
+// Posts text in the current room. It is always a chat line, also when it
+// starts with a slash, see Command. Until the server acks it the line is
+// kept, and sent again after a reconnect: an error means it is waiting for
+// that, so don't send it again yourself.
+func (c *Client) Send(text string) error {
+	return c.post(protocol.ClientFrame{Type: protocol.ClientMessage, Text: text})
+}
+
+// ######################################################################
+// function: Reply()
+// ######################################################################
+// Answers message id, threaded under it. Resent like Send.
+func (c *Client) Reply(id int64, text string) error {
+	return c.post(protocol.ClientFrame{Type: protocol.ClientMessage, Text: text, ReplyTo: id})
+}
+
+// post sends a chat line with a client ID and keeps it until it is acked
+func (c *Client) post(cf ClientFrame) error {
+	c.mu.Lock()
+	c.lastID++
+	cf.ClientID = c.idPrefix + "-" + strconv.FormatInt(c.lastID, 10)
+	c.pending = append(c.pending, cf)
+	if over := len(c.pending) - maxPending; over > 0 {
+		c.pending = append(c.pending[:0:0], c.pending[over:]...)
+	}
+	c.mu.Unlock()
+	return c.SendFrame(cf)
+}
+
+// ######################################################################
+// function: Quote()
+// ######################################################################
+// Posts text quoting message id, which goes out with a copy of it. Resent
+// like Send.
+func (c *Client) Quote(id int64, text string) error {
+	return c.post(protocol.ClientFrame{Type: protocol.ClientMessage, Text: text, Quote: id})
+}
+
+// ######################################################################
+// function: React()
+// ######################################################################
+// Adds emoji to message id, or takes it away again.
+func (c *Client) React(id int64, emoji string) error {
+	return c.SendFrame(protocol.ClientFrame{Type: protocol.ClientReact, ID: id, Text: emoji})
+}
+
+// ######################################################################
+// function: Vote()
+// ######################################################################
+// Votes for option (1 is the first) of poll id, voting again changes it.
+// The results come as "poll" frames.
+func (c *Client) Vote(id int64, option int) error {
+	return c.SendFrame(ClientFrame{Type: protocol.ClientVote, ID: id, Option: option})
+}
+
+// ######################################################################
+// function: MarkRead()
+// ######################################################################
+// Marks everything in room up to message id as read, "" is the current
+// room. The unread counts come in the "rooms" frame on connect.
+func (c *Client) MarkRead(room string, id int64) error {
+	return c.SendFrame(ClientFrame{Type: protocol.ClientMarkRead, ID: id, Room: room})
+}
+
+// ######################################################################
+// function: SendEncrypted()
+// ######################################################################
+// Sends an end to end encrypted private message. The server relays payload
+// as it is, encrypting it and agreeing on keys (see SendKeyExchange) is up
+// to the clients. Replies come as "encrypted" frames, see OnFrame.
+func (c *Client) SendEncrypted(to, payload string) error {
+	return c.SendFrame(ClientFrame{Type: protocol.ClientEncrypted, To: to, Payload: payload})
+}
+
+// ######################################################################
+// function: SendKeyExchange()
+// ######################################################################
+// Sends key material to another user, who gets it as a "key_exchange" frame.
+func (c *Client) SendKeyExchange(to, payload string) error {
+	return c.SendFrame(ClientFrame{Type: protocol.ClientKeyExchange, To: to, Payload: payload})
+}
+
+// ######################################################################
+// function: Command()
+// ######################################################################
+// Sends a line as if typed, so "/topic hello" runs the command. Anything
+// not starting with a slash is posted.
+func (c *Client) Command(line string) error {
+	return c.write([]byte(line))
+}
+
+// ######################################################################
+// function: SendFrame()
+// ######################################################################
+// Sends any client frame, for what the helpers above don't cover.
+func (c *Client) SendFrame(cf ClientFrame) error {
+	data, err := json.Marshal(cf)
+	if err != nil {
+		return err
+	}
+	return c.write(data)
+}
+
+func (c *Client) write(data []byte) error {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	if conn == nil {
+		return ErrNotConnected
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// ######################################################################
+// function: Connect()
+// ######################################################################
+// Makes the first connection and returns its error, or nil once it is up.
+// From then on the client reconnects in the background until ctx is done.
+func (c *Client) Connect(ctx context.Context) error {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return err
+	}
+	go c.run(ctx, conn)
+	return nil
+}
+
+// ######################################################################
+// function: Run()
+// ######################################################################
+// Connects and stays connected until ctx is done, retrying with backoff.
+// Only returns early on ErrUnauthorized and ErrUpgradeRequired.
+func (c *Client) Run(ctx context.Context) error {
+	return c.run(ctx, nil)
+}
+
+// The reconnect loop, starting with conn if there already is one
+func (c *Client) run(ctx context.Context, conn *websocket.Conn) error {
+	backoff := minBackoff
+	for {
+		var err error
+		if conn == nil {
+			conn, err = c.dial(ctx)
+		}
+		if conn != nil {
+			err = c.serve(ctx, conn)
+			conn = nil
+			backoff = minBackoff
+			c.mu.Lock()
+			h := c.onDisconnect
+			c.mu.Unlock()
+			if h != nil && ctx.Err() == nil {
+				h(err)
+			}
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if errors.Is(err, ErrUnauthorized) || errors.Is(err, ErrUpgradeRequired) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, maxBackoff)
+	}
+}
+
+// dial opens a connection where we left off: same session, room and last
+// message
+func (c *Client) dial(ctx context.Context) (*websocket.Conn, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	if c.Version != "" {
+		q.Set("v", c.Version)
+	}
+	c.mu.Lock()
+	if c.sid != "" {
+		q.Set("sid", c.sid)
+	}
+	if c.room != "" {
+		q.Set("room", c.room)
+	}
+	if c.key != "" {
+		q.Set("key", c.key)
+	}
+	if c.last != 0 {
+		q.Set("last", strconv.FormatInt(c.last, 10))
+	}
+	c.mu.Unlock()
+	u.RawQuery = q.Encode()
+
+	header := http.Header{}
+	if c.BotKey != "" {
+		header.Set("Authorization", "Bot "+c.BotKey)
+	} else if c.Login != "" {
+		header.Set("Authorization", "Bearer "+c.Login)
+	}
+	dialer := websocket.DefaultDialer
+	if c.Dialer != nil {
+		dialer = c.Dialer
+	}
+	d := *dialer
+	d.Subprotocols = []string{protocol.SubprotocolV2}
+	conn, resp, err := d.DialContext(ctx, u.String(), header)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+			return nil, ErrUnauthorized
+		}
+		return nil, err
+	}
+	return conn, nil
+}
+
+// serve reads conn until it breaks
+func (c *Client) serve(ctx context.Context, conn *websocket.Conn) error {
+	defer conn.Close()
+	c.mu.Lock()
+	c.conn = conn
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.conn = nil
+		c.mu.Unlock()
+	}()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	c.SendFrame(protocol.ClientFrame{Type: protocol.ClientHello})
+	heartbeats := make(chan struct{})
+	defer close(heartbeats)
+	go c.heartbeat(heartbeats)
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			var closeErr *websocket.CloseError
+			if errors.As(err, &closeErr) && closeErr.Code == protocol.CloseUpgradeRequired {
+				return ErrUpgradeRequired
+			}
+			return err
+		}
+		var f Frame
+		if err := json.Unmarshal(data, &f); err != nil {
+			continue // only legacy servers send plain text
+		}
+		if f.Ack {
+			c.SendFrame(protocol.ClientFrame{Type: protocol.ClientAck, ID: f.ID})
+		}
+		c.handle(f)
+	}
+}
+
+// heartbeat tells the server someone is there until stop is closed
+func (c *Client) heartbeat(stop <-chan struct{}) {
+	c.SendFrame(protocol.ClientFrame{Type: protocol.ClientHeartbeat, State: "focused"})
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			c.SendFrame(protocol.ClientFrame{Type: protocol.ClientHeartbeat, State: "focused"})
+		}
+	}
+}
+
+// handle keeps track of the session and passes f on
+func (c *Client) handle(f Frame) {
+	c.mu.Lock()
+	rename := ""
+	var resend []ClientFrame
+	switch f.Type {
+	case protocol.FrameSession:
+		resumed := f.Token == c.sid
+		c.sid, c.name = f.Token, f.From
+		if !resumed && c.wantName != "" && c.wantName != c.name {
+			rename = c.wantName
+		}
+		// a new connection: whatever wasn't acked may have been lost, the
+		// server ignores the ones it already has
+		resend = append(resend, c.pending...)
+	case protocol.FrameAck:
+		for i, cf := range c.pending {
+			if cf.ClientID == f.ClientID {
+				c.pending = append(c.pending[:i:i], c.pending[i+1:]...)
+				break
+			}
+		}
+	case protocol.FrameSystem:
+		// our own renames only come as text, English as we never ask for
+		// another language
+		if f.Key == "Username set to %s" {
+			c.name = strings.TrimPrefix(f.Text, "Username set to ")
+		}
+	case protocol.FrameTopic:
+		c.room = f.Room // sent on every join
+	case protocol.FrameMessage:
+		c.last = max(c.last, f.ID)
+	}
+	onFrame, onMessage := c.onFrame, c.onMessage
+	c.mu.Unlock()
+
+	if rename != "" {
+		c.Command("/u " + rename)
+	}
+	for _, cf := range resend {
+		c.SendFrame(cf)
+	}
+	if onFrame != nil {
+		onFrame(f)
+	}
+	if onMessage != nil && (f.Type == protocol.FrameMessage || f.Type == protocol.FrameDirect) {
+		onMessage(Message{ID: f.ID, ReplyTo: f.ReplyTo, Quote: f.Quote, Emoji: f.Emoji, Room: f.Room, From: f.From, Color: f.Color, Text: f.Text, HTML: f.HTML, Direct: f.Type == protocol.FrameDirect, Sent: time.UnixMilli(f.TS)})
+	}
+}
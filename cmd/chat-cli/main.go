@@ -0,0 +1,276 @@
+// Command chat-cli is a terminal client for the chat server. Type to talk,
+// slash commands go to the server as they are (/help lists them), and /q
+// quits.
+//
+//	chat-cli -url ws://localhost:6969/ws -name alice -room dev
+//
+// Log in with -login and a token from /api/login to be your account instead
+// of a guest. A dropped connection is picked back up with the same session.
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"go-chat-app/client"
+	"go-chat-app/internal/protocol"
+)
+
+const version = "cli-1"
+
+// ANSI colors, blanked by -no-color
+var (
+	colorReset  = "\033[0m"
+	colorDim    = "\033[2m"
+	colorRed    = "\033[31m"
+	colorGreen  = "\033[32m"
+	colorYellow = "\033[33m"
+	colorBlue   = "\033[34m"
+	colorCyan   = "\033[36m"
+	colorBold   = "\033[1m"
+)
+
+// ######################################################################
+// struct: session
+// ######################################################################
+// The terminal side of a client.Client.
+type session struct {
+	c *client.Client
+
+	mu       sync.Mutex
+	pending  []string // typed while disconnected, sent on the way back
+	quitting bool
+
+	interactive bool       // stdout is a terminal, so there is a prompt to keep
+	out         sync.Mutex // one line on the terminal at a time
+}
+
+func main() {
+	server := flag.String("url", "ws://localhost:6969/ws", "chat server WebSocket URL")
+	name := flag.String("name", "", "username to take, default the one the server hands out")
+	room := flag.String("room", "", "room to join, default the lobby")
+	key := flag.String("key", "", "password or invite for a locked -room")
+	login := flag.String("login", "", "login token, to be your account instead of a guest")
+	noColor := flag.Bool("no-color", os.Getenv("NO_COLOR") != "", "plain text output")
+	flag.Parse()
+	if *noColor {
+		colorReset, colorDim, colorRed, colorGreen, colorYellow, colorBlue, colorCyan, colorBold = "", "", "", "", "", "", "", ""
+	}
+
+	c := client.New(*server)
+	c.Login = *login
+	c.Version = version
+	if *name != "" {
+		c.SetUsername(*name)
+	}
+	if *room != "" {
+		c.Join(*room, *key)
+	}
+	s := &session{c: c}
+	if info, err := os.Stdout.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		s.interactive = true
+	}
+	c.OnFrame(s.render)
+	c.OnDisconnect(func(err error) {
+		s.mu.Lock()
+		quitting := s.quitting
+		s.mu.Unlock()
+		if !quitting {
+			s.print(colorDim, fmt.Sprintf("Disconnected (%v), reconnecting...", err))
+		}
+	})
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	lines := make(chan string)
+	go func() {
+		in := bufio.NewScanner(os.Stdin)
+		for in.Scan() {
+			lines <- in.Text()
+		}
+		close(lines)
+	}()
+	go s.readInput(ctx, stop, lines)
+
+	err := c.Run(ctx)
+	if errors.Is(err, client.ErrUnauthorized) {
+		log.Fatal("Login refused, get a new token")
+	}
+	if err != nil && ctx.Err() == nil {
+		log.Fatal(err)
+	}
+	fmt.Println()
+}
+
+// ######################################################################
+// function: readInput()
+// ######################################################################
+// Sends what the user types. /q quits.
+func (s *session) readInput(ctx context.Context, quit func(), lines <-chan string) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case line, ok := <-lines:
+			if !ok || line == "/q" || line == "/quit" {
+				s.mu.Lock()
+				s.quitting = true
+				s.mu.Unlock()
+				s.c.Command("/q")
+				time.Sleep(200 * time.Millisecond) // let it get out
+				quit()
+				return
+			}
+			if strings.TrimSpace(line) == "" {
+				s.prompt()
+				continue
+			}
+			var err error
+			if fields := strings.Fields(line); fields[0] == "/join" && len(fields) > 1 {
+				// through the client, so it rejoins there after a reconnect
+				key := ""
+				if len(fields) > 2 {
+					key = fields[2]
+				}
+				err = s.c.Join(fields[1], key)
+			} else {
+				err = s.c.Command(line)
+			}
+			if err != nil {
+				s.mu.Lock()
+				s.pending = append(s.pending, line)
+				s.mu.Unlock()
+				s.print(colorYellow, "Not connected, sending that once we are.")
+			}
+		}
+	}
+}
+
+// ######################################################################
+// function: render()
+// ######################################################################
+// One frame on the terminal.
+func (s *session) render(f protocol.Frame) {
+	stamp := time.Now().Format("15:04")
+	if f.TS != 0 {
+		stamp = time.UnixMilli(f.TS).Format("15:04") // the server's clock, not ours
+	}
+	switch f.Type {
+	case protocol.FrameSession:
+		s.mu.Lock()
+		pending := s.pending
+		s.pending = nil
+		s.mu.Unlock()
+		for _, line := range pending {
+			s.c.Command(line)
+		}
+		s.prompt()
+	case protocol.FrameUserCount:
+		// too chatty for a terminal
+	case protocol.FrameMessage:
+		color := colorBold
+		if f.From == s.c.Username() {
+			color = colorGreen
+		}
+		reply := ""
+		if f.ReplyTo != 0 {
+			reply = fmt.Sprintf("↳%d ", f.ReplyTo)
+		}
+		if q := f.Quote; q != nil {
+			s.print(colorDim, fmt.Sprintf("  ┌ <%s> %s", q.From, q.Text))
+		}
+		s.print("", fmt.Sprintf("%s%s [%d]%s %s%s<%s>%s %s", colorDim, stamp, f.ID, colorReset, reply, color, f.From, colorReset, f.Text))
+	case protocol.FrameDirect:
+		s.print(colorBlue, fmt.Sprintf("%s ✉ %s: %s", stamp, f.From, f.Text))
+	case protocol.FrameMissedMessages:
+		s.print(colorDim, "While you were away:")
+		for _, m := range f.Messages {
+			where := "#" + m.Room
+			if m.Type == protocol.FrameDirect {
+				where = "✉"
+			}
+			s.print(colorBlue, fmt.Sprintf("%s %s: %s", where, m.From, m.Text))
+		}
+	case protocol.FrameError, protocol.FrameStrike:
+		s.print(colorRed, f.Text)
+	case protocol.FrameSlowMode:
+		s.print(colorYellow, f.Text)
+	case protocol.FrameAnnouncement:
+		s.print(colorYellow+colorBold, fmt.Sprintf("📢 %s: %s", f.From, f.Text))
+	case protocol.FrameTopic:
+		s.print(colorCyan, fmt.Sprintf("Topic for #%s: %s", f.Room, orNone(f.Text)))
+	case protocol.FrameTopicChanged:
+		s.print(colorCyan, fmt.Sprintf("%s changed the topic to: %s", f.From, orNone(f.Text)))
+	case protocol.FrameRename:
+		s.print(colorDim, fmt.Sprintf("%s is now known as %s", f.From, f.Text))
+	case protocol.FramePins, protocol.FramePinned:
+		for _, pin := range f.Pins {
+			s.print(colorBlue, fmt.Sprintf("📌 [%d] %s: %s", pin.ID, pin.From, pin.Text))
+		}
+	case protocol.FrameUnpinned:
+		s.print(colorDim, fmt.Sprintf("%s unpinned message %d", f.From, f.ID))
+	case protocol.FrameReaction:
+		s.print(colorDim, fmt.Sprintf("%s reacted %s to [%d] (%d)", f.From, f.Text, f.ID, f.Count))
+	case protocol.FrameDeleted:
+		s.print(colorDim, fmt.Sprintf("Message %d was deleted", f.ID))
+	case protocol.FrameInvite:
+		s.print(colorGreen, f.Text)
+	case protocol.FrameBanner:
+		if f.Banner != nil {
+			s.print(colorYellow, fmt.Sprintf("[%s] %s", f.Banner.Level, f.Banner.Text))
+		}
+	case protocol.FramePresence, protocol.FrameRefresh:
+		// nothing to show in a terminal
+	case protocol.FrameRoomUpdated:
+		s.print(colorDim, fmt.Sprintf("#%s was updated", f.Room))
+	default:
+		for _, line := range strings.Split(f.Text, "\n") {
+			s.print(colorDim, line)
+		}
+	}
+}
+
+func orNone(text string) string {
+	if text == "" {
+		return "(none)"
+	}
+	return text
+}
+
+// print writes a line above the prompt
+func (s *session) print(color, line string) {
+	s.out.Lock()
+	defer s.out.Unlock()
+	if s.interactive {
+		fmt.Print("\r\033[K") // over the prompt
+	}
+	fmt.Printf("%s%s%s\n", color, line, colorReset)
+	s.promptLocked()
+}
+
+func (s *session) prompt() {
+	s.out.Lock()
+	defer s.out.Unlock()
+	s.promptLocked()
+}
+
+func (s *session) promptLocked() {
+	if !s.interactive {
+		return
+	}
+	room := s.c.Room()
+	if room == "" {
+		room = "lobby"
+	}
+	fmt.Printf("%s#%s>%s ", colorCyan, room, colorReset)
+}
@@ -0,0 +1,297 @@
+// Command chatbench opens a number of WebSocket connections to a chat
+// server, has them all talk in one room and reports how long broadcasts take
+// to arrive. Point it at a server started with -max-conns-per-ip 0, or every
+// connection past the limit is refused.
+//
+//	chatbench -url ws://localhost:6969/ws -conns 200 -rate 0.5 -duration 1m
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"go-chat-app/internal/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	marker     = "chatbench"
+	bucketSize = 100 * time.Microsecond
+	maxLatency = 30 * time.Second
+)
+
+// ######################################################################
+// struct: histogram
+// ######################################################################
+// Fixed 100µs buckets, so an hour long soak costs no more memory than a
+// ten second run. Anything slower than maxLatency lands in the last bucket.
+type histogram struct {
+	mu      sync.Mutex
+	buckets []int64
+	count   int64
+	max     time.Duration
+}
+
+func newHistogram() *histogram {
+	return &histogram{buckets: make([]int64, maxLatency/bucketSize+1)}
+}
+
+func (h *histogram) add(d time.Duration) {
+	i := int(d / bucketSize)
+	if i < 0 {
+		i = 0 // clocks on the same machine, but still
+	}
+	if i >= len(h.buckets) {
+		i = len(h.buckets) - 1
+	}
+	h.mu.Lock()
+	h.buckets[i]++
+	h.count++
+	if d > h.max {
+		h.max = d
+	}
+	h.mu.Unlock()
+}
+
+// percentile p (0-100), as the upper edge of the bucket it falls in
+func (h *histogram) percentile(p float64) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.count == 0 {
+		return 0
+	}
+	if p >= 100 {
+		return h.max
+	}
+	want := int64(float64(h.count) * p / 100)
+	var seen int64
+	for i, n := range h.buckets {
+		seen += n
+		if seen > want {
+			return time.Duration(i+1) * bucketSize
+		}
+	}
+	return h.max
+}
+
+// ######################################################################
+// struct: stats
+// ######################################################################
+type stats struct {
+	connected  atomic.Int64
+	dialErrors atomic.Int64
+	sent       atomic.Int64
+	sendErrors atomic.Int64
+	received   atomic.Int64
+	readErrors atomic.Int64
+	serverErrs atomic.Int64 // error frames, e.g. moderation or slow mode
+	latency    *histogram
+}
+
+// ######################################################################
+// function: main()
+// ######################################################################
+func main() {
+	target := flag.String("url", "ws://localhost:6969/ws", "WebSocket endpoint of the server")
+	conns := flag.Int("conns", 50, "concurrent connections")
+	rate := flag.Float64("rate", 1, "messages per second per connection")
+	duration := flag.Duration("duration", 30*time.Second, "how long to send for (0 = until interrupted)")
+	room := flag.String("room", "chatbench", "room all connections join")
+	size := flag.Int("size", 64, "message size in bytes")
+	rampUp := flag.Duration("ramp-up", 5*time.Second, "spread the connects over this long")
+	report := flag.Duration("report", 10*time.Second, "print running numbers this often (0 = only at the end)")
+	flag.Parse()
+
+	if *conns <= 0 || *rate <= 0 {
+		log.Fatal("-conns and -rate must be positive")
+	}
+	u, err := url.Parse(*target)
+	if err != nil {
+		log.Fatalf("Error parsing -url: %v", err)
+	}
+	q := u.Query()
+	q.Set("room", *room)
+	u.RawQuery = q.Encode()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	st := &stats{latency: newHistogram()}
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	sending, stopSending := context.WithCancel(ctx)
+	for i := 0; i < *conns; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// spread the connects so we measure chatting, not the accept queue
+			select {
+			case <-time.After(time.Duration(i) * *rampUp / time.Duration(*conns)):
+			case <-sending.Done():
+				return
+			}
+			runConn(sending, u.String(), i, *rate, *size, st)
+		}(i)
+	}
+
+	if *report > 0 {
+		go func() {
+			ticker := time.NewTicker(*report)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-sending.Done():
+					return
+				case <-ticker.C:
+					printStats(os.Stderr, st, time.Since(start), *conns)
+				}
+			}
+		}()
+	}
+
+	if *duration > 0 {
+		select {
+		case <-time.After(*rampUp + *duration):
+		case <-ctx.Done():
+		}
+	} else {
+		<-ctx.Done()
+	}
+	stopSending()
+	wg.Wait()
+	printStats(os.Stdout, st, time.Since(start), *conns)
+}
+
+// ######################################################################
+// function: runConn()
+// ######################################################################
+// One connection: a reader timing every benchmark message that comes back
+// and a writer sending at the given rate until ctx is done.
+func runConn(ctx context.Context, target string, n int, rate float64, size int, st *stats) {
+	conn, resp, err := websocket.DefaultDialer.DialContext(ctx, target, nil)
+	if err != nil {
+		st.dialErrors.Add(1)
+		if ctx.Err() == nil {
+			log.Printf("Error connecting #%d: %v", n, err)
+		}
+		return
+	}
+	resp.Body.Close()
+	// without a hello the server waits a moment and then talks plain text
+	hello, _ := json.Marshal(protocol.ClientFrame{Type: protocol.ClientHello})
+	if err := conn.WriteMessage(websocket.TextMessage, hello); err != nil {
+		st.dialErrors.Add(1)
+		conn.Close()
+		return
+	}
+	st.connected.Add(1)
+	defer st.connected.Add(-1)
+
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		for {
+			_, data, err := conn.ReadMessage()
+			now := time.Now()
+			if err != nil {
+				if ctx.Err() == nil {
+					st.readErrors.Add(1)
+				}
+				return
+			}
+			var f protocol.Frame
+			if json.Unmarshal(data, &f) != nil {
+				continue
+			}
+			switch f.Type {
+			case protocol.FrameError:
+				st.serverErrs.Add(1)
+			case protocol.FrameMessage:
+				if sent, ok := parseMarker(f.Text); ok {
+					st.received.Add(1)
+					st.latency.add(now.Sub(sent))
+				}
+			}
+		}
+	}()
+
+	// jitter the first send so the connections don't tick in lockstep
+	interval := time.Duration(float64(time.Second) / rate)
+	timer := time.NewTimer(time.Duration(rand.Int63n(int64(interval))))
+	defer timer.Stop()
+	padding := strings.Repeat("x", max(0, size-len(marker)-21))
+
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			break loop
+		case <-readDone:
+			break loop
+		case <-timer.C:
+		}
+		msg := fmt.Sprintf("%s %d %s", marker, time.Now().UnixNano(), padding)
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			st.sendErrors.Add(1)
+			break
+		}
+		st.sent.Add(1)
+		timer.Reset(interval)
+	}
+
+	// give the last broadcasts a moment to arrive before hanging up
+	time.Sleep(time.Second)
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	conn.Close()
+	<-readDone
+}
+
+// "chatbench 1712345678901234567 xxxx" -> the send time
+func parseMarker(text string) (time.Time, bool) {
+	fields := strings.Fields(text)
+	if len(fields) < 2 || fields[0] != marker {
+		return time.Time{}, false
+	}
+	nanos, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, nanos), true
+}
+
+// ######################################################################
+// function: printStats()
+// ######################################################################
+// Every message should reach every connection in the room, the sender
+// included, so the delivery ratio is received / (sent * connections). It
+// reads a bit low when messages were sent during the ramp-up.
+func printStats(w *os.File, st *stats, elapsed time.Duration, conns int) {
+	sent, received := st.sent.Load(), st.received.Load()
+	delivery := 0.0
+	if sent > 0 {
+		delivery = 100 * float64(received) / float64(sent*int64(conns))
+	}
+	fmt.Fprintf(w, "%s  conns %d (dial errors %d)  sent %d (%.1f/s, errors %d)  received %d (%.1f/s, %.1f%% delivered)\n",
+		elapsed.Round(time.Second), st.connected.Load(), st.dialErrors.Load(),
+		sent, float64(sent)/elapsed.Seconds(), st.sendErrors.Load(),
+		received, float64(received)/elapsed.Seconds(), delivery)
+	fmt.Fprintf(w, "  latency p50 %s  p90 %s  p99 %s  max %s  read errors %d  server errors %d\n",
+		st.latency.percentile(50), st.latency.percentile(90), st.latency.percentile(99), st.latency.percentile(100),
+		st.readErrors.Load(), st.serverErrs.Load())
+}
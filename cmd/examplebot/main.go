@@ -0,0 +1,53 @@
+// Command examplebot is a bot built on the bot package. It answers !roll
+// with a dice roll and !time with the server's clock. Create it with
+//
+//	curl -H "Authorization: Bearer $ADMIN_TOKEN" -d '{"name":"dicebot","commands":["roll","time"]}' localhost:6969/admin/bots
+//
+// and run it with the key from the reply:
+//
+//	BOT_KEY=... examplebot -url ws://localhost:6969/ws -room dev
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"go-chat-app/bot"
+)
+
+func main() {
+	addr := flag.String("url", "ws://localhost:6969/ws", "chat server WebSocket URL")
+	room := flag.String("room", "", "room to join, default the lobby")
+	flag.Parse()
+	key := os.Getenv("BOT_KEY")
+	if key == "" {
+		log.Fatal("Set BOT_KEY to the bot's API key")
+	}
+
+	b := bot.New(*addr, key)
+	b.Room = *room
+	b.Command("roll", func(m *bot.Message) {
+		sides, err := strconv.Atoi(m.Args)
+		if err != nil || sides < 2 {
+			sides = 6
+		}
+		m.Reply(fmt.Sprintf("%s rolled %d (d%d)", m.From, rand.Intn(sides)+1, sides))
+	})
+	b.Command("time", func(m *bot.Message) {
+		m.Reply(time.Now().Format(time.RFC1123))
+	})
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := b.Run(ctx); err != nil && ctx.Err() == nil {
+		log.Fatal(err)
+	}
+}
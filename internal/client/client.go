@@ -0,0 +1,402 @@
+// Package client wraps one WebSocket connection and the identity of whoever is on it.
+package client
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go-chat-app/internal/i18n"
+	"go-chat-app/internal/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+// A client that cannot take a frame within this long is treated as gone
+const writeWait = 10 * time.Second
+
+// Frames queued for a client before SetBackpressure says otherwise
+const DefaultSendBuffer = 256
+
+// What Send does when a client's send buffer is full
+const (
+	DropOldest = "drop_oldest" // make room by dropping the oldest queued frame
+	DropNewest = "drop_newest" // drop the frame being sent
+	Disconnect = "disconnect"  // hang up, the client can reconnect and catch up
+)
+
+var (
+	ErrDeadConn   = errors.New("connection is closed")
+	ErrSlowClient = errors.New("client is not keeping up")
+)
+
+// ######################################################################
+// interface: Conn
+// ######################################################################
+// What a client talks through. A *websocket.Conn, or a gateway that turns
+// another protocol into frames, see chat/irc.go.
+type Conn interface {
+	ReadMessage() (messageType int, data []byte, err error)
+	WriteMessage(messageType int, data []byte) error
+	SetWriteDeadline(t time.Time) error
+	EnableWriteCompression(enable bool)
+	SetCompressionLevel(level int) error
+	Subprotocol() string
+	Close() error
+}
+
+// ######################################################################
+// struct: Client
+// ######################################################################
+// The hub guards Username and SID with its own mutex, everything else here
+// is either fixed at connect or safe to use from any goroutine.
+type Client struct {
+	conn    Conn
+	writeMu sync.Mutex  // gorilla allows one writer per connection
+	dead    atomic.Bool // a write failed, the connection is being torn down
+	codec   protocol.Codec
+
+	// Send queues frames and the write pump writes them, so one slow client
+	// doesn't hold up a broadcast to everyone else
+	queueMu   sync.Mutex
+	queue     []outgoing
+	buffer    int    // most frames queued at once
+	overflow  string // DropOldest, DropNewest or Disconnect
+	wake      chan struct{}
+	closing   chan struct{} // Close or Kill was called, the pump winds down
+	closeOnce sync.Once
+	dropped   atomic.Int64 // frames thrown away by the overflow policy
+	slow      atomic.Bool  // hung up on by the Disconnect policy
+
+	compressMin int // frames at least this big get deflated, 0 = none, guarded by writeMu
+
+	first chan readResult // message read ahead by AwaitFirst, only touched by the reader
+
+	sent, received atomic.Int64 // message payload bytes, before compression
+
+	localeMu sync.Mutex
+	locale   string
+
+	SID      string // session id, lets the client resume after a server restart
+	Username string
+
+	IP        string
+	UserAgent string
+	Version   string // declared by the client with ?v= on the upgrade request
+}
+
+// ######################################################################
+// function: New()
+// ######################################################################
+func New(conn Conn, ip, userAgent, version, locale string) *Client {
+	c := &Client{
+		conn:      conn,
+		codec:     protocol.CodecFor(conn.Subprotocol()),
+		buffer:    DefaultSendBuffer,
+		overflow:  Disconnect,
+		wake:      make(chan struct{}, 1),
+		closing:   make(chan struct{}),
+		IP:        ip,
+		UserAgent: userAgent,
+		Version:   version,
+		locale:    locale,
+	}
+	go c.writePump()
+	return c
+}
+
+// ######################################################################
+// function: SetBackpressure()
+// ######################################################################
+// How many frames may wait for the client, and what happens to the next one
+// when that many are waiting.
+func (c *Client) SetBackpressure(buffer int, overflow string) {
+	c.queueMu.Lock()
+	defer c.queueMu.Unlock()
+	if buffer > 0 {
+		c.buffer = buffer
+	}
+	if overflow != "" {
+		c.overflow = overflow
+	}
+}
+
+// ######################################################################
+// function: Backlog()
+// ######################################################################
+// Frames waiting for the client, and how many the overflow policy dropped
+// so far. Slow is set once the Disconnect policy hung up on it.
+func (c *Client) Backlog() (queued int, dropped int64, slow bool) {
+	c.queueMu.Lock()
+	queued = len(c.queue)
+	c.queueMu.Unlock()
+	return queued, c.dropped.Load(), c.slow.Load()
+}
+
+// ######################################################################
+// function: Binary()
+// ######################################################################
+// Whether the client negotiated protobuf frames.
+func (c *Client) Binary() bool {
+	return c.codec.Binary
+}
+
+// ######################################################################
+// function: Codec()
+// ######################################################################
+func (c *Client) Codec() protocol.Codec {
+	return c.codec
+}
+
+// ######################################################################
+// function: Read()
+// ######################################################################
+// Next message from the client. Only the goroutine serving the client reads.
+func (c *Client) Read() (int, []byte, error) {
+	if c.first != nil {
+		r := <-c.first
+		c.first = nil
+		c.received.Add(int64(len(r.data)))
+		return r.messageType, r.data, r.err
+	}
+	messageType, data, err := c.conn.ReadMessage()
+	c.received.Add(int64(len(data)))
+	return messageType, data, err
+}
+
+// ######################################################################
+// function: Traffic()
+// ######################################################################
+// Payload bytes sent to and received from the client so far.
+func (c *Client) Traffic() (sent, received int64) {
+	return c.sent.Load(), c.received.Load()
+}
+
+type readResult struct {
+	messageType int
+	data        []byte
+	err         error
+}
+
+// ######################################################################
+// function: AwaitFirst()
+// ######################################################################
+// Waits up to wait for the client's first message, without consuming it:
+// the next Read returns it either way. arrived is false on timeout, data is
+// nil unless a text message came.
+func (c *Client) AwaitFirst(wait time.Duration) (data []byte, arrived bool) {
+	// a read deadline would break the connection for good, so read aside
+	first, result := make(chan readResult, 1), make(chan readResult, 1)
+	c.first = first
+	go func() {
+		messageType, data, err := c.conn.ReadMessage()
+		r := readResult{messageType, data, err}
+		result <- r
+		first <- r
+	}()
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case r := <-result:
+		if r.err == nil && r.messageType == websocket.TextMessage {
+			return r.data, true
+		}
+		return nil, true
+	case <-timer.C:
+		return nil, false
+	}
+}
+
+// ######################################################################
+// function: Downgrade()
+// ######################################################################
+// Switches to the legacy line protocol. Only before anything else may send
+// to the client.
+func (c *Client) Downgrade() {
+	c.codec = protocol.LegacyCodec()
+}
+
+// ######################################################################
+// function: Send()
+// ######################################################################
+// Queues a frame for the client, translating server text into its
+// language. Only fails when the client is gone, or was just hung up on for
+// not keeping up.
+func (c *Client) Send(f protocol.Frame) error {
+	if c.dead.Load() {
+		return ErrDeadConn
+	}
+	if f.Format != "" {
+		f.Text = i18n.Tr(c.Locale(), f.Format, f.Args...)
+	}
+	data, err := c.codec.Encode(f)
+	if err != nil || data == nil {
+		return err
+	}
+	messageType := websocket.TextMessage
+	if c.codec.Binary {
+		messageType = websocket.BinaryMessage
+	}
+
+	c.queueMu.Lock()
+	if len(c.queue) >= c.buffer {
+		switch c.overflow {
+		case DropNewest:
+			c.queueMu.Unlock()
+			c.dropped.Add(1)
+			return nil
+		case DropOldest:
+			c.queue = c.queue[1:]
+			c.dropped.Add(1)
+		default:
+			c.queueMu.Unlock()
+			c.slow.Store(true)
+			c.Kill()
+			return ErrSlowClient
+		}
+	}
+	c.queue = append(c.queue, outgoing{messageType, data})
+	c.queueMu.Unlock()
+
+	select {
+	case c.wake <- struct{}{}:
+	default: // the pump is already awake
+	}
+	return nil
+}
+
+type outgoing struct {
+	messageType int
+	data        []byte
+}
+
+// ######################################################################
+// function: writePump()
+// ######################################################################
+// The one goroutine writing to the connection. A failed write kills the
+// client, which makes its read loop exit and clean up.
+func (c *Client) writePump() {
+	for {
+		select {
+		case <-c.wake:
+			if err := c.flush(); err != nil {
+				c.Kill()
+				return
+			}
+		case <-c.closing:
+			if !c.dead.Load() {
+				c.flush() // a kick or a /q still gets its last words out
+			}
+			c.conn.Close()
+			return
+		}
+	}
+}
+
+// flush writes everything queued so far
+func (c *Client) flush() error {
+	for {
+		c.queueMu.Lock()
+		batch := c.queue
+		c.queue = nil
+		c.queueMu.Unlock()
+		if len(batch) == 0 {
+			return nil
+		}
+		for _, out := range batch {
+			if err := c.write(out); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (c *Client) write(out outgoing) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.compressMin > 0 {
+		// small frames come out bigger with the deflate overhead
+		c.conn.EnableWriteCompression(len(out.data) >= c.compressMin)
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	if err := c.conn.WriteMessage(out.messageType, out.data); err != nil {
+		return err
+	}
+	c.sent.Add(int64(len(out.data)))
+	return nil
+}
+
+// ######################################################################
+// function: EnableCompression()
+// ######################################################################
+// Deflates frames of minSize bytes or more at the given flate level. Does
+// nothing unless permessage-deflate was negotiated on the upgrade.
+func (c *Client) EnableCompression(level, minSize int) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := c.conn.SetCompressionLevel(level); err != nil {
+		return err
+	}
+	c.compressMin = max(minSize, 1)
+	return nil
+}
+
+// ######################################################################
+// function: SendSystem()
+// ######################################################################
+// Sends a notice in the client's language, format is the English text.
+func (c *Client) SendSystem(format string, args ...any) error {
+	return c.Send(protocol.Frame{Type: protocol.FrameSystem, Format: format, Args: args})
+}
+
+// ######################################################################
+// function: SendError()
+// ######################################################################
+// Like SendSystem, as an error frame with one of the protocol.Code
+// constants.
+func (c *Client) SendError(code int, format string, args ...any) error {
+	return c.Send(protocol.Frame{Type: protocol.FrameError, Code: code, Format: format, Args: args})
+}
+
+// ######################################################################
+// function: Locale()
+// ######################################################################
+func (c *Client) Locale() string {
+	c.localeMu.Lock()
+	defer c.localeMu.Unlock()
+	return c.locale
+}
+
+// ######################################################################
+// function: SetLocale()
+// ######################################################################
+func (c *Client) SetLocale(locale string) {
+	c.localeMu.Lock()
+	defer c.localeMu.Unlock()
+	c.locale = locale
+}
+
+// ######################################################################
+// function: Kill()
+// ######################################################################
+// Marks the client dead so nobody writes to it anymore, and closes the
+// connection so its read loop exits. False if it was already dead.
+func (c *Client) Kill() bool {
+	if c.dead.Swap(true) {
+		return false
+	}
+	c.closeOnce.Do(func() { close(c.closing) })
+	c.conn.Close()
+	return true
+}
+
+// ######################################################################
+// function: Close()
+// ######################################################################
+// Closes the connection once what is queued has been written, the read
+// loop notices and cleans up.
+func (c *Client) Close() error {
+	c.closeOnce.Do(func() { close(c.closing) })
+	return nil
+}
@@ -0,0 +1,339 @@
+package hub
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"go-chat-app/internal/protocol"
+)
+
+const (
+	accountsFile = "accounts.json"
+	linkTokenTTL = 10 * time.Minute
+)
+
+// Identity providers an account can be reached through
+const (
+	ProviderPassword = "password"
+	ProviderGitHub   = "github"
+	ProviderGoogle   = "google"
+	ProviderLDAP     = "ldap"
+)
+
+var (
+	ErrNoAccount     = errors.New("no such account")
+	ErrIdentityTaken = errors.New("identity belongs to another account")
+	ErrLastIdentity  = errors.New("cannot remove the last identity of an account")
+	errLinkExpired   = errors.New("link token is invalid or expired")
+)
+
+// ######################################################################
+// struct: Identity
+// ######################################################################
+// One way of proving who you are. Subject is what the provider calls the
+// user (GitHub user id, LDAP DN, username for passwords).
+type Identity struct {
+	Provider string    `json:"provider"`
+	Subject  string    `json:"subject"`
+	Secret   string    `json:"secret,omitempty"` // whatever the provider needs to verify, never sent out
+	Linked   time.Time `json:"linked"`
+}
+
+func (id Identity) key() string {
+	return id.Provider + ":" + id.Subject
+}
+
+// ######################################################################
+// struct: Account
+// ######################################################################
+// A chat account. Messages are attributed to Name, which stays the same
+// whichever identity was used to log in, so moving from one SSO provider to
+// another keeps the history yours.
+type Account struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Created    time.Time  `json:"created"`
+	Identities []Identity `json:"identities"`
+
+	// for password resets, only once the link mailed to it was opened
+	Email         string `json:"email,omitempty"`
+	EmailVerified bool   `json:"email_verified,omitempty"`
+
+	// profile, see SetProfile
+	DisplayName string `json:"display_name,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+	Bio         string `json:"bio,omitempty"`
+	Color       string `json:"color,omitempty"` // from /color, "" = derived from the ID
+
+	// bot accounts log in with an API key and own their !commands, see CreateBot
+	Bot      bool     `json:"bot,omitempty"`
+	Commands []string `json:"commands,omitempty"`
+}
+
+// what others see of the account, joined is when it was created
+func (a *Account) Profile() protocol.Profile {
+	return protocol.Profile{DisplayName: a.DisplayName, AvatarURL: a.AvatarURL, Bio: a.Bio, Joined: a.Created, Bot: a.Bot}
+}
+
+// copy without the secrets, for handing out
+func (a *Account) public() Account {
+	out := *a
+	out.Identities = make([]Identity, len(a.Identities))
+	for i, id := range a.Identities {
+		id.Secret = ""
+		out.Identities[i] = id
+	}
+	return out
+}
+
+// ######################################################################
+// struct: LinkConflict
+// ######################################################################
+// Returned when the identity being linked already has an account of its
+// own. Completing the link again with merge set folds Other into Account.
+type LinkConflict struct {
+	Account string `json:"account"`
+	Other   string `json:"other"`
+}
+
+func (c *LinkConflict) Error() string {
+	return fmt.Sprintf("%v (%s)", ErrIdentityTaken, c.Other)
+}
+
+func (c *LinkConflict) Unwrap() error { return ErrIdentityTaken }
+
+type linkToken struct {
+	account string
+	expires time.Time
+}
+
+// ######################################################################
+// function: loadAccounts()
+// ######################################################################
+func (h *Hub) loadAccounts() {
+	h.accountsMu.Lock()
+	defer h.accountsMu.Unlock()
+	if err := h.loadJSON(accountsFile, &h.accounts); err != nil {
+		log.Printf("Error loading accounts: %v", err)
+	}
+	if h.accounts == nil {
+		h.accounts = make(map[string]*Account)
+	}
+	for _, a := range h.accounts {
+		for _, id := range a.Identities {
+			h.identities[id.key()] = a.ID
+		}
+	}
+}
+
+func (h *Hub) saveAccountsLocked() {
+	if err := h.saveJSON(accountsFile, h.accounts); err != nil {
+		log.Printf("Error persisting accounts: %v", err)
+	}
+}
+
+// ######################################################################
+// function: AccountFor()
+// ######################################################################
+// The account an identity belongs to, with its secrets, for verifying a login.
+func (h *Hub) AccountFor(provider, subject string) (Account, Identity, bool) {
+	h.accountsMu.Lock()
+	defer h.accountsMu.Unlock()
+	id := Identity{Provider: provider, Subject: subject}
+	a, ok := h.accounts[h.identities[id.key()]]
+	if !ok {
+		return Account{}, Identity{}, false
+	}
+	for _, ident := range a.Identities {
+		if ident.key() == id.key() {
+			return a.public(), ident, true
+		}
+	}
+	return Account{}, Identity{}, false
+}
+
+// ######################################################################
+// function: Account()
+// ######################################################################
+func (h *Hub) Account(id string) (Account, bool) {
+	h.accountsMu.Lock()
+	defer h.accountsMu.Unlock()
+	a, ok := h.accounts[id]
+	if !ok {
+		return Account{}, false
+	}
+	return a.public(), true
+}
+
+// ######################################################################
+// function: Accounts()
+// ######################################################################
+// Every account, oldest first.
+func (h *Hub) Accounts() []Account {
+	h.accountsMu.Lock()
+	list := make([]Account, 0, len(h.accounts))
+	for _, a := range h.accounts {
+		list = append(list, a.public())
+	}
+	h.accountsMu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	return list
+}
+
+// ######################################################################
+// function: CreateAccount()
+// ######################################################################
+func (h *Hub) CreateAccount(name string, ident Identity) (Account, error) {
+	h.accountsMu.Lock()
+	defer h.accountsMu.Unlock()
+	return h.createLocked(name, ident)
+}
+
+func (h *Hub) createLocked(name string, ident Identity) (Account, error) {
+	if _, taken := h.identities[ident.key()]; taken {
+		return Account{}, ErrIdentityTaken
+	}
+	now := time.Now()
+	ident.Linked = now
+	a := &Account{ID: randomToken(8), Name: name, Created: now, Identities: []Identity{ident}}
+	h.accounts[a.ID] = a
+	h.identities[ident.key()] = a.ID
+	h.saveAccountsLocked()
+	return a.public(), nil
+}
+
+// ######################################################################
+// function: linkLocked()
+// ######################################################################
+// Adds ident to the account. Linking an identity the account already has
+// just updates it, one that is on another account is a *LinkConflict.
+func (h *Hub) linkLocked(account string, ident Identity) error {
+	a, ok := h.accounts[account]
+	if !ok {
+		return ErrNoAccount
+	}
+	if owner, taken := h.identities[ident.key()]; taken && owner != account {
+		return &LinkConflict{Account: account, Other: owner}
+	}
+	ident.Linked = time.Now()
+	for i, existing := range a.Identities {
+		if existing.key() == ident.key() {
+			a.Identities[i] = ident
+			h.saveAccountsLocked()
+			return nil
+		}
+	}
+	a.Identities = append(a.Identities, ident)
+	h.identities[ident.key()] = account
+	h.saveAccountsLocked()
+	return nil
+}
+
+// ######################################################################
+// function: UnlinkIdentity()
+// ######################################################################
+func (h *Hub) UnlinkIdentity(account, provider, subject string) error {
+	h.accountsMu.Lock()
+	defer h.accountsMu.Unlock()
+	a, ok := h.accounts[account]
+	if !ok {
+		return ErrNoAccount
+	}
+	key := Identity{Provider: provider, Subject: subject}.key()
+	for i, id := range a.Identities {
+		if id.key() != key {
+			continue
+		}
+		if len(a.Identities) == 1 {
+			return ErrLastIdentity
+		}
+		a.Identities = append(a.Identities[:i], a.Identities[i+1:]...)
+		delete(h.identities, key)
+		h.saveAccountsLocked()
+		return nil
+	}
+	return ErrNotFound
+}
+
+// ######################################################################
+// function: MergeAccounts()
+// ######################################################################
+// Moves every identity of drop over to keep and deletes drop. keep's name
+// wins, history posted under the other name stays as it was.
+func (h *Hub) MergeAccounts(keep, drop string) (Account, error) {
+	h.accountsMu.Lock()
+	defer h.accountsMu.Unlock()
+	return h.mergeLocked(keep, drop)
+}
+
+func (h *Hub) mergeLocked(keep, drop string) (Account, error) {
+	k, ok := h.accounts[keep]
+	d, ok2 := h.accounts[drop]
+	if !ok || !ok2 || keep == drop {
+		return Account{}, ErrNoAccount
+	}
+	now := time.Now()
+	for _, id := range d.Identities {
+		id.Linked = now
+		k.Identities = append(k.Identities, id)
+		h.identities[id.key()] = keep
+	}
+	delete(h.accounts, drop)
+	h.saveAccountsLocked()
+	h.moveOffline(keep, drop)
+	log.Printf("Merged account %s (%s) into %s (%s)", drop, d.Name, keep, k.Name)
+	return k.public(), nil
+}
+
+// ######################################################################
+// function: StartLink()
+// ######################################################################
+// First half of linking: a logged in user asks for a token, then logs in
+// with the other provider carrying it along. The token is what proves the
+// second login was started from this account.
+func (h *Hub) StartLink(account string) (string, error) {
+	h.accountsMu.Lock()
+	defer h.accountsMu.Unlock()
+	if _, ok := h.accounts[account]; !ok {
+		return "", ErrNoAccount
+	}
+	now := time.Now()
+	for token, lt := range h.linkTokens {
+		if now.After(lt.expires) {
+			delete(h.linkTokens, token)
+		}
+	}
+	token := randomToken(16)
+	h.linkTokens[token] = linkToken{account: account, expires: now.Add(linkTokenTTL)}
+	return token, nil
+}
+
+// ######################################################################
+// function: CompleteLink()
+// ######################################################################
+// Second half: ident has just been verified by its provider. If it already
+// has an account of its own the result is a *LinkConflict and the token
+// stays valid, so the user can decide to merge the two (having proven both)
+// or leave things as they are.
+func (h *Hub) CompleteLink(token string, ident Identity, merge bool) (Account, error) {
+	h.accountsMu.Lock()
+	defer h.accountsMu.Unlock()
+	lt, ok := h.linkTokens[token]
+	if !ok || time.Now().After(lt.expires) {
+		return Account{}, errLinkExpired
+	}
+
+	err := h.linkLocked(lt.account, ident)
+	var conflict *LinkConflict
+	if errors.As(err, &conflict) && merge {
+		_, err = h.mergeLocked(lt.account, conflict.Other)
+	}
+	if err != nil {
+		return Account{}, err
+	}
+	delete(h.linkTokens, token)
+	return h.accounts[lt.account].public(), nil
+}
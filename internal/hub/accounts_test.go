@@ -0,0 +1,173 @@
+package hub
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"go-chat-app/internal/protocol"
+)
+
+func TestAccountLinking(t *testing.T) {
+	h := New(Config{DataDir: t.TempDir()})
+	pw := Identity{Provider: ProviderPassword, Subject: "kari"}
+	gh := Identity{Provider: ProviderGitHub, Subject: "1234"}
+	google := Identity{Provider: ProviderGoogle, Subject: "kari@example.com"}
+
+	kari, err := h.CreateAccount("kari", pw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := h.CreateAccount("kari-gh", gh)
+
+	// plain link
+	token, _ := h.StartLink(kari.ID)
+	if _, err := h.CompleteLink(token, google, false); err != nil {
+		t.Fatalf("linking google: %v", err)
+	}
+	if _, err := h.CompleteLink(token, google, false); err == nil {
+		t.Error("link token worked twice")
+	}
+
+	// github already has its own account: conflict first, merge on request
+	token, _ = h.StartLink(kari.ID)
+	_, err = h.CompleteLink(token, gh, false)
+	var conflict *LinkConflict
+	if !errors.As(err, &conflict) || conflict.Other != other.ID {
+		t.Fatalf("expected a conflict with %s, got %v", other.ID, err)
+	}
+	merged, err := h.CompleteLink(token, gh, true)
+	if err != nil {
+		t.Fatalf("merging: %v", err)
+	}
+	if len(merged.Identities) != 3 || merged.Name != "kari" {
+		t.Errorf("merged account %+v", merged)
+	}
+	if _, ok := h.Account(other.ID); ok {
+		t.Error("merged account still exists")
+	}
+	if a, _, ok := h.AccountFor(ProviderGitHub, "1234"); !ok || a.ID != kari.ID {
+		t.Errorf("github login finds %+v", a)
+	}
+
+	// survives a restart, and the last identity cannot be removed
+	h = New(Config{DataDir: h.cfg.DataDir})
+	for _, id := range []Identity{pw, gh} {
+		if err := h.UnlinkIdentity(kari.ID, id.Provider, id.Subject); err != nil {
+			t.Fatalf("unlink %s: %v", id.Provider, err)
+		}
+	}
+	if err := h.UnlinkIdentity(kari.ID, google.Provider, google.Subject); !errors.Is(err, ErrLastIdentity) {
+		t.Errorf("removing the last identity: %v", err)
+	}
+}
+
+func TestOfflineQueue(t *testing.T) {
+	dir := t.TempDir()
+	h := New(Config{DataDir: dir})
+	kari, _ := h.CreateAccount("kari", Identity{Provider: ProviderPassword, Subject: "kari"})
+	ola, _ := h.CreateAccount("ola", Identity{Provider: ProviderPassword, Subject: "ola"})
+
+	// mentioned twice, queued once; guests and unknown names are ignored
+	h.deliverMentions(protocol.Frame{Type: protocol.FrameMessage, ID: 1, From: "ola", Text: "hei @kari, ser du dette @Kari? @nobody"})
+	if got := len(h.offline[kari.ID]); got != 1 {
+		t.Fatalf("%d queued for kari, want 1", got)
+	}
+
+	// in any case, nobody else gets to be Kari
+	if id, ok := h.accountNamed("KARI"); !ok || id != kari.ID {
+		t.Errorf("KARI is %q", id)
+	}
+	if err := h.checkName(&Chatter{}, "Kari"); !errors.Is(err, errNameOwned) {
+		t.Errorf("a guest as Kari: %v", err)
+	}
+
+	for i := 0; i < maxOffline+5; i++ {
+		h.queueOffline(ola.ID, protocol.Frame{Type: protocol.FrameDirect, ID: int64(100 + i)})
+	}
+	queue := h.offline[ola.ID]
+	if len(queue) != maxOffline || queue[0].ID != 105 {
+		t.Fatalf("queue of %d starting at %d, want %d starting at 105", len(queue), queue[0].ID, maxOffline)
+	}
+
+	// survives a restart, and follows a merge
+	h = New(Config{DataDir: dir})
+	if _, err := h.MergeAccounts(ola.ID, kari.ID); err != nil {
+		t.Fatal(err)
+	}
+	queue = h.offline[ola.ID]
+	if len(queue) != maxOffline || queue[len(queue)-1].ID != 1 || h.offline[kari.ID] != nil {
+		t.Errorf("after merge: %d queued for ola ending at %d", len(queue), queue[len(queue)-1].ID)
+	}
+}
+
+func TestLoginWithProvider(t *testing.T) {
+	h := New(Config{DataDir: t.TempDir()})
+	h.CreateAccount("kari", Identity{Provider: ProviderPassword, Subject: "kari"})
+	gh := Identity{Provider: ProviderGitHub, Subject: "1234"}
+
+	// a new identity gets an account, under a free name
+	first, token, err := h.LoginWith(gh, "kari")
+	if err != nil || first.Name != "kari2" {
+		t.Fatalf("first login: %+v %v", first, err)
+	}
+	if a, ok := h.LoginAccount(token); !ok || a.ID != first.ID {
+		t.Errorf("token is for %+v", a)
+	}
+
+	// and the same account every time after
+	again, _, err := h.LoginWith(gh, "someone else")
+	if err != nil || again.ID != first.ID || again.Name != "kari2" {
+		t.Errorf("second login: %+v %v", again, err)
+	}
+	if _, _, err := h.LoginWith(Identity{Provider: ProviderGoogle, Subject: "x"}, "has spaces"); err != nil {
+		t.Errorf("login with an unusable name: %v", err)
+	}
+
+	// a name is taken in any case
+	if _, _, err := h.Register("KARI", "hunter22", ""); !errors.Is(err, ErrNameTaken) {
+		t.Errorf("registering KARI: %v", err)
+	}
+	if other, _, _ := h.LoginWith(Identity{Provider: ProviderGitHub, Subject: "5678"}, "Kari"); other.Name != "Kari3" {
+		t.Errorf("login as Kari got %q", other.Name)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	h := New(Config{DataDir: t.TempDir()})
+	per, _, err := h.Register("per", "hunter22", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens := len(h.logins)
+	if a, err := h.Authenticate("per", "hunter22"); err != nil || a.ID != per.ID {
+		t.Errorf("authenticate: %+v %v", a, err)
+	}
+	if _, err := h.Authenticate("per", "hunter2"); !errors.Is(err, ErrBadLogin) {
+		t.Errorf("wrong password: %v", err)
+	}
+	if len(h.logins) != tokens {
+		t.Errorf("%d login tokens after authenticating, want %d", len(h.logins), tokens)
+	}
+}
+
+func TestGuestNames(t *testing.T) {
+	dir := t.TempDir()
+	h := New(Config{DataDir: dir, SnapshotGrace: time.Minute})
+	if a, b := h.guestName(), h.guestName(); a != "guest-1000" || b != "guest-1001" {
+		t.Errorf("first guests %s and %s", a, b)
+	}
+
+	// after a restart, past the guests still owed their session
+	snap := Snapshot{TakenAt: time.Now(), Sessions: map[string]snapshotSession{
+		"a": {Username: "guest-5000", Room: "lobby"},
+		"b": {Username: "kari", Room: "lobby"},
+	}}
+	if err := h.saveJSON(snapshotFile, snap); err != nil {
+		t.Fatal(err)
+	}
+	h = New(Config{DataDir: dir, SnapshotGrace: time.Minute})
+	if name := h.guestName(); name != "guest-5001" {
+		t.Errorf("first guest after restart is %s", name)
+	}
+}
@@ -0,0 +1,151 @@
+package hub
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// Upper bounds (seconds) of the ack latency histogram buckets
+var ackBuckets = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+type ackKey struct {
+	chatter *Chatter
+	id      int64
+}
+
+type ackSample struct {
+	room string
+	sent time.Time
+}
+
+// ######################################################################
+// struct: deliveryStats
+// ######################################################################
+// Sampled delivery counters for one room.
+type deliveryStats struct {
+	sampled    int64
+	acked      int64
+	expired    int64
+	latencySum float64
+	buckets    []int64 // cumulative per ackBuckets entry
+}
+
+// ######################################################################
+// function: sampleAck()
+// ######################################################################
+// Decides whether this delivery should ask for an ack, and if so starts the clock.
+func (h *Hub) sampleAck(chatter *Chatter, room string, id int64) bool {
+	if h.cfg.AckSampleRate <= 0 || rand.Float64() >= h.cfg.AckSampleRate {
+		return false
+	}
+	h.ackMu.Lock()
+	defer h.ackMu.Unlock()
+	h.pendingAcks[ackKey{chatter, id}] = ackSample{room: room, sent: time.Now()}
+	h.statsFor(room).sampled++
+	return true
+}
+
+// ######################################################################
+// function: receiveAck()
+// ######################################################################
+func (h *Hub) receiveAck(chatter *Chatter, id int64) {
+	h.ackMu.Lock()
+	defer h.ackMu.Unlock()
+	key := ackKey{chatter, id}
+	sample, ok := h.pendingAcks[key]
+	if !ok {
+		return // not sampled, expired, or acked twice
+	}
+	delete(h.pendingAcks, key)
+
+	stats := h.statsFor(sample.room)
+	latency := time.Since(sample.sent).Seconds()
+	stats.acked++
+	stats.latencySum += latency
+	for i, le := range ackBuckets {
+		if latency <= le {
+			stats.buckets[i]++
+		}
+	}
+}
+
+// ######################################################################
+// function: expireAcks()
+// ######################################################################
+// Counts samples that were never acked within the timeout as lost deliveries.
+func (h *Hub) expireAcks(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		h.ackMu.Lock()
+		deadline := time.Now().Add(-h.cfg.AckTimeout)
+		for key, sample := range h.pendingAcks {
+			if sample.sent.Before(deadline) {
+				delete(h.pendingAcks, key)
+				h.statsFor(sample.room).expired++
+			}
+		}
+		h.ackMu.Unlock()
+	}
+}
+
+// Caller holds ackMu.
+func (h *Hub) statsFor(room string) *deliveryStats {
+	stats, ok := h.delivery[room]
+	if !ok {
+		stats = &deliveryStats{buckets: make([]int64, len(ackBuckets))}
+		h.delivery[room] = stats
+	}
+	return stats
+}
+
+// ######################################################################
+// function: writeAckMetrics()
+// ######################################################################
+// Prometheus text format for the sampled delivery SLO.
+func (h *Hub) writeAckMetrics(w io.Writer) {
+	h.ackMu.Lock()
+	defer h.ackMu.Unlock()
+
+	names := make([]string, 0, len(h.delivery))
+	for room := range h.delivery {
+		names = append(names, room)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(w, "# HELP chat_delivery_sampled_total Broadcast deliveries that asked the client for an ack.")
+	fmt.Fprintln(w, "# TYPE chat_delivery_sampled_total counter")
+	for _, room := range names {
+		fmt.Fprintf(w, "chat_delivery_sampled_total{room=%q} %d\n", room, h.delivery[room].sampled)
+	}
+	fmt.Fprintln(w, "# HELP chat_delivery_acked_total Sampled deliveries acked by the client.")
+	fmt.Fprintln(w, "# TYPE chat_delivery_acked_total counter")
+	for _, room := range names {
+		fmt.Fprintf(w, "chat_delivery_acked_total{room=%q} %d\n", room, h.delivery[room].acked)
+	}
+	fmt.Fprintln(w, "# HELP chat_delivery_expired_total Sampled deliveries never acked within the timeout.")
+	fmt.Fprintln(w, "# TYPE chat_delivery_expired_total counter")
+	for _, room := range names {
+		fmt.Fprintf(w, "chat_delivery_expired_total{room=%q} %d\n", room, h.delivery[room].expired)
+	}
+	fmt.Fprintln(w, "# HELP chat_delivery_latency_seconds Time from broadcast to client ack.")
+	fmt.Fprintln(w, "# TYPE chat_delivery_latency_seconds histogram")
+	for _, room := range names {
+		stats := h.delivery[room]
+		for i, le := range ackBuckets {
+			fmt.Fprintf(w, "chat_delivery_latency_seconds_bucket{room=%q,le=\"%g\"} %d\n", room, le, stats.buckets[i])
+		}
+		fmt.Fprintf(w, "chat_delivery_latency_seconds_bucket{room=%q,le=\"+Inf\"} %d\n", room, stats.acked)
+		fmt.Fprintf(w, "chat_delivery_latency_seconds_sum{room=%q} %g\n", room, stats.latencySum)
+		fmt.Fprintf(w, "chat_delivery_latency_seconds_count{room=%q} %d\n", room, stats.acked)
+	}
+}
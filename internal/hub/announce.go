@@ -0,0 +1,73 @@
+package hub
+
+import (
+	"log"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+
+	"go-chat-app/internal/protocol"
+)
+
+// Sent to every new connection, in their language, unless -motd points to a file
+const defaultMOTD = `Welcome to kihle's tempChat.
+Change username with: /u <your_username>
+Leave/clear chat with: /q
+All commands: /help`
+
+// ######################################################################
+// function: readMOTD()
+// ######################################################################
+// The message of the day in path, the built in one if there is no path.
+func readMOTD(path string) (string, error) {
+	if path == "" {
+		return defaultMOTD, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// ######################################################################
+// function: sendMOTD()
+// ######################################################################
+func (h *Hub) sendMOTD(chatter *Chatter) {
+	h.mu.Lock()
+	motd := h.motd
+	h.mu.Unlock()
+	if motd != "" {
+		chatter.Send(protocol.Frame{Type: protocol.FrameMOTD, Format: motd})
+	}
+}
+
+// ######################################################################
+// function: Announce()
+// ######################################################################
+// Delivers an announcement to everyone connected, whatever room they are in.
+func (h *Hub) Announce(from, text string) {
+	log.Printf("Announcement from %s: %s", from, text)
+	h.broadcast(protocol.Frame{Type: protocol.FrameAnnouncement, From: from, Text: text}, nil)
+}
+
+// ######################################################################
+// function: RequestRefresh()
+// ######################################################################
+// Tells every connected client to reload after a deployment. Each one
+// waits somewhere up to maxDelay, so they don't all come back in the same
+// second. Returns how many were told.
+func (h *Hub) RequestRefresh(maxDelay time.Duration) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	log.Printf("Asking %d clients to reload within %s", h.chatters.len(), maxDelay)
+	for _, chatter := range h.chatters.all() {
+		var wait time.Duration
+		if maxDelay > 0 {
+			wait = time.Duration(rand.Int63n(int64(maxDelay)))
+		}
+		chatter.Send(protocol.Frame{Type: protocol.FrameRefresh, WaitMs: wait.Milliseconds()})
+	}
+	return h.chatters.len()
+}
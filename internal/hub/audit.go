@@ -0,0 +1,135 @@
+package hub
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// One JSON entry per line, only ever appended to
+const auditFile = "audit.log"
+
+// ######################################################################
+// struct: AuditEntry
+// ######################################################################
+// Who did what to whom. Actor is a username, "admin" for the admin API or
+// "automod" for strikes.
+type AuditEntry struct {
+	At     time.Time `json:"at"`
+	Actor  string    `json:"actor"`
+	Action string    `json:"action"`
+	Target string    `json:"target,omitempty"`
+	Room   string    `json:"room,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+	IP     string    `json:"ip,omitempty"` // the actor's
+}
+
+// ######################################################################
+// struct: AuditFilter
+// ######################################################################
+// Zero fields match everything. Limit 0 means no limit.
+type AuditFilter struct {
+	Actor  string
+	Action string
+	Target string
+	Since  time.Time
+	Limit  int
+}
+
+func (f AuditFilter) matches(e AuditEntry) bool {
+	return (f.Actor == "" || e.Actor == f.Actor) &&
+		(f.Action == "" || e.Action == f.Action) &&
+		(f.Target == "" || e.Target == f.Target) &&
+		!e.At.Before(f.Since)
+}
+
+// ######################################################################
+// function: Audit()
+// ######################################################################
+// Appends e to the audit log. Failing to write it is logged, the action
+// itself has already happened.
+func (h *Hub) Audit(e AuditEntry) {
+	if e.At.IsZero() {
+		e.At = time.Now()
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("Error encoding audit entry: %v", err)
+		return
+	}
+	h.auditMu.Lock()
+	defer h.auditMu.Unlock()
+	if err := h.appendAuditLocked(append(line, '\n')); err != nil {
+		log.Printf("Error writing audit log: %v", err)
+	}
+}
+
+func (h *Hub) appendAuditLocked(line []byte) (err error) {
+	done := h.storageOp(context.Background(), "append", auditFile)
+	defer func() { done(err) }()
+	if err := os.MkdirAll(h.cfg.DataDir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(h.cfg.DataDir, auditFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(line); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ######################################################################
+// function: AuditLog()
+// ######################################################################
+// Entries matching filter, newest first.
+func (h *Hub) AuditLog(filter AuditFilter) (entries []AuditEntry, err error) {
+	h.auditMu.Lock()
+	defer h.auditMu.Unlock()
+	done := h.storageOp(context.Background(), "load", auditFile)
+	defer func() { done(err) }()
+
+	f, err := os.Open(filepath.Join(h.cfg.DataDir, auditFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return []AuditEntry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue // a line cut short by a crash
+		}
+		if filter.matches(e) {
+			entries = append(entries, e)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// oldest first in the file
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	if filter.Limit > 0 && len(entries) > filter.Limit {
+		entries = entries[:filter.Limit]
+	}
+	if entries == nil {
+		entries = []AuditEntry{}
+	}
+	return entries, nil
+}
@@ -0,0 +1,46 @@
+package hub
+
+import (
+	"fmt"
+	"io"
+	"log"
+)
+
+// ######################################################################
+// function: retireBacklog()
+// ######################################################################
+// Adds what the slow client policy did to a departing chatter to the hub
+// totals. Caller holds the mutex.
+func (h *Hub) retireBacklog(chatter *Chatter) {
+	_, dropped, slow := chatter.Backlog()
+	h.droppedFrames.Add(dropped)
+	if slow {
+		h.slowHangups.Add(1)
+		log.Printf("Hung up on %s (%s): not keeping up with its frames", chatter.Username, chatter.IP)
+	}
+}
+
+// ######################################################################
+// function: writeBackpressureMetrics()
+// ######################################################################
+// Prometheus text format for the send buffers of slow clients.
+func (h *Hub) writeBackpressureMetrics(w io.Writer) {
+	dropped, queued := h.droppedFrames.Load(), 0
+	h.mu.Lock()
+	for _, chatter := range h.chatters.all() {
+		n, d, _ := chatter.Backlog()
+		queued += n
+		dropped += d
+	}
+	h.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP chat_send_queued_frames Frames waiting in client send buffers.")
+	fmt.Fprintln(w, "# TYPE chat_send_queued_frames gauge")
+	fmt.Fprintf(w, "chat_send_queued_frames %d\n", queued)
+	fmt.Fprintln(w, "# HELP chat_send_dropped_total Frames dropped because a client's send buffer was full.")
+	fmt.Fprintln(w, "# TYPE chat_send_dropped_total counter")
+	fmt.Fprintf(w, "chat_send_dropped_total %d\n", dropped)
+	fmt.Fprintln(w, "# HELP chat_slow_client_disconnects_total Clients hung up on because their send buffer was full.")
+	fmt.Fprintln(w, "# TYPE chat_slow_client_disconnects_total counter")
+	fmt.Fprintf(w, "chat_slow_client_disconnects_total %d\n", h.slowHangups.Load())
+}
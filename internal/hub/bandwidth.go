@@ -0,0 +1,169 @@
+package hub
+
+import (
+	"context"
+	"log"
+	"sort"
+	"time"
+
+	"go-chat-app/internal/protocol"
+)
+
+// How often traffic is totted up and caps enforced, and how long a
+// throttled client waits after each message it sends
+const (
+	bandwidthInterval = 10 * time.Second
+	throttleDelay     = time.Second
+)
+
+// ######################################################################
+// struct: Usage
+// ######################################################################
+// One user's traffic today (UTC). Users are accounts, guests count per IP
+// so reconnecting doesn't start them over.
+type Usage struct {
+	User     string `json:"user"` // account id, or ip:<address> for guests
+	Day      string `json:"day"`
+	Sent     int64  `json:"sent"`
+	Received int64  `json:"received"`
+}
+
+func (u *Usage) total() int64 {
+	return u.Sent + u.Received
+}
+
+// Caller holds h.mu.
+func usageKeyLocked(chatter *Chatter) string {
+	if chatter.account != "" {
+		return chatter.account
+	}
+	return "ip:" + chatter.IP
+}
+
+// ######################################################################
+// function: chargeBandwidth()
+// ######################################################################
+// Adds what every connection did since the last time to its user's total
+// and returns the connections whose user is over cfg.BandwidthCap.
+func (h *Hub) chargeBandwidth() []*Chatter {
+	type charge struct {
+		chatter *Chatter
+		key     string
+	}
+	h.mu.Lock()
+	charges := make([]charge, 0, h.chatters.len())
+	for _, chatter := range h.chatters.all() {
+		charges = append(charges, charge{chatter, usageKeyLocked(chatter)})
+	}
+	h.mu.Unlock()
+
+	day := time.Now().UTC().Format(time.DateOnly)
+	h.usageMu.Lock()
+	defer h.usageMu.Unlock()
+	for key, u := range h.usage {
+		if u.Day != day {
+			delete(h.usage, key)
+		}
+	}
+	for _, c := range charges {
+		h.chargeLocked(c.chatter, c.key, day)
+	}
+
+	var over []*Chatter
+	for _, c := range charges {
+		capped := h.cfg.BandwidthCap > 0 && h.usage[c.key].total() > h.cfg.BandwidthCap
+		c.chatter.throttled = capped && !h.cfg.BandwidthDisconnect
+		if capped {
+			over = append(over, c.chatter)
+		}
+	}
+	return over
+}
+
+// Caller holds usageMu.
+func (h *Hub) chargeLocked(chatter *Chatter, key, day string) *Usage {
+	u, ok := h.usage[key]
+	if !ok || u.Day != day {
+		u = &Usage{User: key, Day: day}
+		h.usage[key] = u
+	}
+	sent, received := chatter.Traffic()
+	u.Sent += sent - chatter.chargedSent
+	u.Received += received - chatter.chargedReceived
+	chatter.chargedSent, chatter.chargedReceived = sent, received
+	return u
+}
+
+// ######################################################################
+// function: chargeDisconnect()
+// ######################################################################
+// The last bit of a connection's traffic, when it goes away.
+func (h *Hub) chargeDisconnect(chatter *Chatter) {
+	h.mu.Lock()
+	key := usageKeyLocked(chatter)
+	h.mu.Unlock()
+	h.usageMu.Lock()
+	h.chargeLocked(chatter, key, time.Now().UTC().Format(time.DateOnly))
+	h.usageMu.Unlock()
+}
+
+// ######################################################################
+// function: bandwidthLoop()
+// ######################################################################
+// Throttles, or with cfg.BandwidthDisconnect drops, connections of users
+// over their daily cap.
+func (h *Hub) bandwidthLoop(ctx context.Context) {
+	ticker := time.NewTicker(bandwidthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, chatter := range h.chargeBandwidth() {
+			if !h.cfg.BandwidthDisconnect {
+				continue
+			}
+			h.mu.Lock()
+			if chatter.kicked {
+				h.mu.Unlock()
+				continue
+			}
+			chatter.kicked = true // no resuming around the cap either
+			name := chatter.Username
+			h.mu.Unlock()
+			log.Printf("Disconnecting %s (%s), over the daily bandwidth cap", name, chatter.IP)
+			h.Audit(AuditEntry{Actor: "automod", Action: "kick", Target: name, Reason: "bandwidth cap"})
+			chatter.SendError(protocol.CodeRateLimited, "You have used up today's bandwidth.")
+			chatter.Close()
+		}
+	}
+}
+
+// ######################################################################
+// function: throttled()
+// ######################################################################
+// Whether the chatter's user is over the cap and has to slow down. Only
+// the chatter's own goroutine asks.
+func (h *Hub) throttled(chatter *Chatter) bool {
+	h.usageMu.Lock()
+	defer h.usageMu.Unlock()
+	return chatter.throttled
+}
+
+// ######################################################################
+// function: BandwidthUsage()
+// ######################################################################
+// Today's traffic per user, biggest first.
+func (h *Hub) BandwidthUsage() []Usage {
+	h.chargeBandwidth()
+	h.usageMu.Lock()
+	list := make([]Usage, 0, len(h.usage))
+	for _, u := range h.usage {
+		list = append(list, *u)
+	}
+	h.usageMu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].total() > list[j].total() })
+	return list
+}
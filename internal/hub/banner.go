@@ -0,0 +1,91 @@
+package hub
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"go-chat-app/internal/protocol"
+)
+
+const maxBannerLen = 500
+
+var (
+	errBannerEmpty = errors.New("a banner needs some text")
+	errBannerLong  = fmt.Errorf("a banner can be at most %d characters", maxBannerLen)
+	errBannerLevel = errors.New("banner level is info, warning or incident")
+)
+
+// ######################################################################
+// function: newBanner()
+// ######################################################################
+// Checks text and level, level "" is info.
+func newBanner(text, level, by string) (*protocol.Banner, error) {
+	text = strings.TrimSpace(text)
+	switch {
+	case text == "":
+		return nil, errBannerEmpty
+	case len([]rune(text)) > maxBannerLen:
+		return nil, errBannerLong
+	}
+	switch level {
+	case "":
+		level = protocol.BannerInfo
+	case protocol.BannerInfo, protocol.BannerWarning, protocol.BannerIncident:
+	default:
+		return nil, errBannerLevel
+	}
+	return &protocol.Banner{Text: text, Level: level, SetBy: by, SetAt: time.Now().UTC()}, nil
+}
+
+// ######################################################################
+// function: setBanner()
+// ######################################################################
+// Replaces the room's banner, nil clears it. Everyone in the room gets the
+// new one right away.
+func (h *Hub) setBanner(room *Room, banner *protocol.Banner) {
+	h.mu.Lock()
+	room.banner = banner
+	if err := h.saveRoomsLocked(); err != nil {
+		log.Printf("Error persisting rooms: %v", err)
+	}
+	h.mu.Unlock()
+
+	h.broadcastRoom(room, protocol.Frame{Type: protocol.FrameBanner, Room: room.name, Banner: banner}, nil)
+}
+
+// ######################################################################
+// function: sendBanner()
+// ######################################################################
+// Done on join, and for /banner. always also sends an empty banner frame,
+// so the client can drop a stale one.
+func (h *Hub) sendBanner(chatter *Chatter, room *Room, always bool) {
+	h.mu.Lock()
+	banner := room.banner
+	h.mu.Unlock()
+
+	if banner != nil || always {
+		chatter.Send(protocol.Frame{Type: protocol.FrameBanner, Room: room.name, Banner: banner})
+	}
+}
+
+// ######################################################################
+// function: SetRoomBanner()
+// ######################################################################
+// For the admin API, text "" clears the banner. The room is created if needed.
+func (h *Hub) SetRoomBanner(name, text, level, by string) (*protocol.Banner, error) {
+	var banner *protocol.Banner
+	if text != "" {
+		var err error
+		if banner, err = newBanner(text, level, by); err != nil {
+			return nil, err
+		}
+	}
+	h.mu.Lock()
+	room, _ := h.getRoom(name)
+	h.mu.Unlock()
+	h.setBanner(room, banner)
+	return banner, nil
+}
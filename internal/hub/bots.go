@@ -0,0 +1,234 @@
+package hub
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Bots log in with an API key of the form "<key id>.<secret>". The key id
+// is the subject of the account's bot identity, only a hash of the secret
+// is kept.
+const (
+	ProviderBot    = "bot"
+	maxBotCommands = maxSubscribedCommands
+	maxCommandLen  = 32
+)
+
+var (
+	ErrNotBot        = errors.New("not a bot account")
+	errBotCommand    = fmt.Errorf("commands are letters, digits, - and _, at most %d of them", maxBotCommands)
+	errCommandTaken  = errors.New("another bot already has that command")
+	errNotGranted    = errors.New("bots can only subscribe to the commands they were granted")
+	errBotNoPatterns = errors.New("bots can't subscribe to patterns")
+)
+
+// ######################################################################
+// function: CreateBot()
+// ######################################################################
+// Creates a bot account owning name and the given !commands. Returns the
+// account and its API key, which can't be looked up again later.
+func (h *Hub) CreateBot(name string, commands []string) (Account, string, error) {
+	if err := nameError(name); err != nil {
+		return Account{}, "", err
+	}
+	commands, err := normalizeCommands(commands)
+	if err != nil {
+		return Account{}, "", err
+	}
+	id, secret, ident := newBotKey()
+
+	h.accountsMu.Lock()
+	defer h.accountsMu.Unlock()
+	if h.nameTakenLocked(name) {
+		return Account{}, "", ErrNameTaken
+	}
+	if err := h.checkCommandsLocked("", commands); err != nil {
+		return Account{}, "", err
+	}
+	a, err := h.createLocked(name, ident)
+	if err != nil {
+		return Account{}, "", err
+	}
+	bot := h.accounts[a.ID]
+	bot.Bot = true
+	bot.Commands = commands
+	h.saveAccountsLocked()
+	return bot.public(), id + "." + secret, nil
+}
+
+// ######################################################################
+// function: SetBotCommands()
+// ######################################################################
+// Replaces the commands granted to a bot. Connected instances keep their
+// subscription until they reconnect.
+func (h *Hub) SetBotCommands(account string, commands []string) (Account, error) {
+	commands, err := normalizeCommands(commands)
+	if err != nil {
+		return Account{}, err
+	}
+	h.accountsMu.Lock()
+	defer h.accountsMu.Unlock()
+	a, ok := h.accounts[account]
+	if !ok || !a.Bot {
+		return Account{}, ErrNotBot
+	}
+	if err := h.checkCommandsLocked(account, commands); err != nil {
+		return Account{}, err
+	}
+	a.Commands = commands
+	h.saveAccountsLocked()
+	return a.public(), nil
+}
+
+// ######################################################################
+// function: RotateBotKey()
+// ######################################################################
+// Gives the bot a new API key, the old one stops working for new
+// connections right away.
+func (h *Hub) RotateBotKey(account string) (string, error) {
+	id, secret, ident := newBotKey()
+	h.accountsMu.Lock()
+	defer h.accountsMu.Unlock()
+	a, ok := h.accounts[account]
+	if !ok || !a.Bot {
+		return "", ErrNotBot
+	}
+	ident.Linked = time.Now()
+	kept := a.Identities[:0:0]
+	for _, old := range a.Identities {
+		if old.Provider == ProviderBot {
+			delete(h.identities, old.key())
+			continue
+		}
+		kept = append(kept, old)
+	}
+	a.Identities = append(kept, ident)
+	h.identities[ident.key()] = a.ID
+	h.saveAccountsLocked()
+	return id + "." + secret, nil
+}
+
+// ######################################################################
+// function: BotAccount()
+// ######################################################################
+// The bot an API key belongs to, if the key is good.
+func (h *Hub) BotAccount(key string) (Account, bool) {
+	id, secret, ok := strings.Cut(key, ".")
+	if !ok {
+		return Account{}, false
+	}
+	a, ident, ok := h.AccountFor(ProviderBot, id)
+	if !ok || !a.Bot {
+		return Account{}, false
+	}
+	sum := sha256.Sum256([]byte(secret))
+	return a, subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(ident.Secret)) == 1
+}
+
+// ######################################################################
+// function: Bots()
+// ######################################################################
+// Every bot account, by name.
+func (h *Hub) Bots() []Account {
+	h.accountsMu.Lock()
+	var list []Account
+	for _, a := range h.accounts {
+		if a.Bot {
+			list = append(list, a.public())
+		}
+	}
+	h.accountsMu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// ######################################################################
+// function: botCommands()
+// ######################################################################
+// Granted command -> bot name, for /help.
+func (h *Hub) botCommands() map[string]string {
+	h.accountsMu.Lock()
+	defer h.accountsMu.Unlock()
+	owners := make(map[string]string)
+	for _, a := range h.accounts {
+		for _, c := range a.Commands {
+			owners[c] = a.Name
+		}
+	}
+	return owners
+}
+
+// ######################################################################
+// function: botSubscription()
+// ######################################################################
+// Bots only get to listen for their own commands, so two bots never answer
+// the same !command. Unsubscribing puts a bot back on all of them. Returns
+// the commands to subscribe to.
+func (h *Hub) botSubscription(chatter *Chatter, commands, patterns []string) ([]string, error) {
+	h.mu.Lock()
+	grants, bot := chatter.grants, chatter.bot
+	h.mu.Unlock()
+	switch {
+	case !bot:
+		return commands, nil
+	case len(patterns) > 0:
+		return nil, errBotNoPatterns
+	case len(commands) == 0:
+		return grants, nil
+	}
+	for _, c := range commands {
+		if !slices.Contains(grants, strings.ToLower(strings.TrimPrefix(strings.TrimSpace(c), "!"))) {
+			return nil, errNotGranted
+		}
+	}
+	return commands, nil
+}
+
+// Caller holds accountsMu.
+func (h *Hub) checkCommandsLocked(account string, commands []string) error {
+	for _, a := range h.accounts {
+		if a.ID == account {
+			continue
+		}
+		for _, c := range a.Commands {
+			if slices.Contains(commands, c) {
+				return errCommandTaken
+			}
+		}
+	}
+	return nil
+}
+
+func normalizeCommands(commands []string) ([]string, error) {
+	if len(commands) > maxBotCommands {
+		return nil, errBotCommand
+	}
+	var out []string
+	for _, c := range commands {
+		c = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(c), "!"))
+		if c == "" || len(c) > maxCommandLen || strings.IndexFunc(c, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '-' && r != '_'
+		}) >= 0 {
+			return nil, errBotCommand
+		}
+		if !slices.Contains(out, c) {
+			out = append(out, c)
+		}
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+func newBotKey() (id, secret string, ident Identity) {
+	id, secret = randomToken(8), randomToken(24)
+	sum := sha256.Sum256([]byte(secret))
+	return id, secret, Identity{Provider: ProviderBot, Subject: id, Secret: hex.EncodeToString(sum[:])}
+}
@@ -0,0 +1,69 @@
+package hub
+
+import (
+	"strings"
+
+	"go-chat-app/internal/protocol"
+)
+
+// ######################################################################
+// function: Follow()
+// ######################################################################
+// Every frame that goes out in the room, for bridges to other networks.
+// Unlike Watch it works for any room, creating it if needed, and includes
+// joins and leaves. A bridge that falls behind misses frames. Call the
+// returned func to stop.
+func (h *Hub) Follow(name string) (<-chan protocol.Frame, func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	room, _ := h.getRoom(name)
+	frames := make(chan protocol.Frame, 256)
+	room.watchers[frames] = true
+	stop := func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(room.watchers, frames)
+		if room.disposableLocked() {
+			delete(h.rooms, room.name)
+		}
+	}
+	return frames, stop
+}
+
+// ######################################################################
+// function: Relay()
+// ######################################################################
+// Posts a message from someone on another network into the room. from
+// should say where they are, "bob (matrix)", so they can't pass for a
+// user here.
+func (h *Hub) Relay(name, from, text string) error {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return nil
+	}
+	text, err := h.filterExternal(name, from, text)
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	room, _ := h.getRoom(name)
+	h.mu.Unlock()
+	h.postExternal(room, from, text)
+	h.posted.Add(1)
+	return nil
+}
+
+// ######################################################################
+// function: RelayPresence()
+// ######################################################################
+// Tells the room someone on another network came or went.
+func (h *Hub) RelayPresence(name, who, network string, joined bool) {
+	h.mu.Lock()
+	room, _ := h.getRoom(name)
+	h.mu.Unlock()
+	format := "%s left #%s on %s."
+	if joined {
+		format = "%s joined #%s on %s."
+	}
+	h.broadcastRoom(room, protocol.Systemf(room.name, format, who, room.name, network), nil)
+}
@@ -0,0 +1,314 @@
+package hub
+
+import (
+	"errors"
+	"sort"
+
+	"go-chat-app/internal/protocol"
+)
+
+// Voice and video calls over WebRTC. The media goes between the clients,
+// the hub only passes on their offers, answers and ICE candidates and
+// tells everyone in a call who else is.
+//
+// A private call starts with a call_offer to someone without a call ID:
+// all their devices ring until one answers, which joins them, or they
+// hang up. A room has at most one call, "#<room>", and whoever joins it
+// sends an offer to each of the members in the call frame they get back,
+// a mesh. Call frames say what happened in text: joined, left, ended, or
+// ongoing for the call of a room you have just come into.
+
+const roomCallPrefix = "#"
+
+var (
+	errNoCall      = errors.New("there is no such call")
+	errNotInCall   = errors.New("you are not in that call")
+	errCallRoom    = errors.New("you can only join the call of the room you are in")
+	errCallPeer    = errors.New("call signaling needs someone to send it to and a payload")
+	errCallNobody  = errors.New("nobody by that name is in the call")
+	errCallOffline = errors.New("nobody by that name is online")
+	errCallPayload = errors.New("that payload is too big")
+)
+
+// Relayed frame per client frame
+var callRelays = map[string]string{
+	protocol.ClientCallOffer:  protocol.FrameCallOffer,
+	protocol.ClientCallAnswer: protocol.FrameCallAnswer,
+	protocol.ClientCallICE:    protocol.FrameCallICE,
+}
+
+// ######################################################################
+// struct: call
+// ######################################################################
+// Guarded by the hub mutex.
+type call struct {
+	id      string
+	room    *Room // nil for a private call
+	members map[*Chatter]bool
+	ringing map[string]bool // names offered a private call that haven't answered
+}
+
+// ######################################################################
+// function: handleCall()
+// ######################################################################
+func (h *Hub) handleCall(chatter *Chatter, cf protocol.ClientFrame) error {
+	switch cf.Type {
+	case protocol.ClientCallJoin:
+		return h.joinRoomCall(chatter, cf.Room)
+	case protocol.ClientCallHangup:
+		return h.hangUp(chatter, cf.Call)
+	}
+	return h.signalCall(chatter, cf)
+}
+
+// ######################################################################
+// function: joinRoomCall()
+// ######################################################################
+// Joins the call of the chatter's room, starting it if there is none.
+func (h *Hub) joinRoomCall(chatter *Chatter, name string) error {
+	h.mu.Lock()
+	room := chatter.room
+	if room == nil || (name != "" && name != room.name) {
+		h.mu.Unlock()
+		return errCallRoom
+	}
+	id := roomCallPrefix + room.name
+	c := h.calls[id]
+	if c == nil {
+		c = &call{id: id, room: room, members: make(map[*Chatter]bool)}
+		h.calls[id] = c
+	}
+	if c.members[chatter] {
+		h.mu.Unlock()
+		return nil
+	}
+	c.members[chatter] = true
+	f := c.frameLocked(chatter, "joined")
+	h.mu.Unlock()
+
+	h.broadcastRoom(room, f, nil)
+	return nil
+}
+
+// ######################################################################
+// function: signalCall()
+// ######################################################################
+// Passes an offer, answer or ICE candidate on to cf.To in the call. An
+// offer without a call starts a private one and rings cf.To, and an
+// answer to a ring joins the call.
+func (h *Hub) signalCall(from *Chatter, cf protocol.ClientFrame) error {
+	if cf.To == "" || cf.Payload == "" {
+		return errCallPeer
+	}
+	if len(cf.Payload) > maxPayload {
+		return errCallPayload
+	}
+
+	h.mu.Lock()
+	var presence []callNotice
+	c := h.calls[cf.Call]
+	switch {
+	case cf.Call == "" && cf.Type == protocol.ClientCallOffer:
+		if cf.To == from.Username {
+			h.mu.Unlock()
+			return errCallPeer
+		}
+		c = &call{id: randomToken(8), members: map[*Chatter]bool{from: true}, ringing: make(map[string]bool)}
+		h.calls[c.id] = c
+		// the caller learns the call's ID from this
+		presence = append(presence, callNotice{f: c.frameLocked(from, "joined"), to: []*Chatter{from}})
+	case c == nil:
+		h.mu.Unlock()
+		return errNoCall
+	case c.members[from]:
+	case c.ringing[from.Username] && cf.Type == protocol.ClientCallAnswer:
+		delete(c.ringing, from.Username)
+		c.members[from] = true
+		presence = append(presence, callNotice{f: c.frameLocked(from, "joined"), to: h.callRecipientsLocked(c, from)})
+	case c.ringing[from.Username] && cf.Type == protocol.ClientCallICE:
+		// candidates can come before the answer
+	default:
+		h.mu.Unlock()
+		return errNotInCall
+	}
+
+	var targets []*Chatter
+	for member := range c.members {
+		if member.Username == cf.To && member != from {
+			targets = append(targets, member)
+		}
+	}
+	if len(targets) == 0 {
+		if c.room == nil && cf.Type == protocol.ClientCallOffer && cf.To != from.Username {
+			c.ringing[cf.To] = true
+		}
+		if !c.ringing[cf.To] {
+			h.mu.Unlock()
+			return errCallNobody
+		}
+		for _, chatter := range h.chatters.all() {
+			if chatter.Username == cf.To && !chatter.ignoring[from.Username] {
+				targets = append(targets, chatter)
+			}
+		}
+		if len(targets) == 0 {
+			delete(c.ringing, cf.To)
+			if len(c.ringing) == 0 && len(c.members) < 2 {
+				delete(h.calls, c.id)
+			}
+			h.mu.Unlock()
+			return errCallOffline
+		}
+	}
+	f := protocol.Frame{Type: callRelays[cf.Type], Call: c.id, From: from.Username, To: cf.To, Payload: cf.Payload}
+	if c.room != nil {
+		f.Room = c.room.name
+	}
+	h.mu.Unlock()
+
+	for _, n := range presence {
+		h.sendCallNotice(n)
+	}
+	for _, chatter := range targets {
+		chatter.Send(f)
+	}
+	return nil
+}
+
+// ######################################################################
+// function: hangUp()
+// ######################################################################
+// Leaves the call, or turns down its ring.
+func (h *Hub) hangUp(chatter *Chatter, id string) error {
+	h.mu.Lock()
+	c := h.calls[id]
+	if c == nil {
+		h.mu.Unlock()
+		return errNoCall
+	}
+	if !c.members[chatter] && !c.ringing[chatter.Username] {
+		h.mu.Unlock()
+		return errNotInCall
+	}
+	n := h.leaveCallLocked(c, chatter)
+	h.mu.Unlock()
+
+	h.sendCallNotice(n)
+	return nil
+}
+
+// ######################################################################
+// function: leaveCalls()
+// ######################################################################
+// Takes the chatter out of every call it's in, or only the one of room
+// if that isn't nil. For disconnects and room changes.
+func (h *Hub) leaveCalls(chatter *Chatter, room *Room) {
+	var notices []callNotice
+	h.mu.Lock()
+	for _, c := range h.calls {
+		if c.members[chatter] && (room == nil || c.room == room) {
+			notices = append(notices, h.leaveCallLocked(c, chatter))
+		}
+	}
+	h.mu.Unlock()
+
+	for _, n := range notices {
+		h.sendCallNotice(n)
+	}
+}
+
+// ######################################################################
+// function: leaveCallLocked()
+// ######################################################################
+// A private call is over when there aren't two people left in it or
+// ringing, a room call when nobody is in it. Caller holds the mutex.
+func (h *Hub) leaveCallLocked(c *call, chatter *Chatter) callNotice {
+	// everyone involved before, so the ringing stops too
+	to := h.callRecipientsLocked(c, chatter)
+	if c.members[chatter] {
+		delete(c.members, chatter)
+	} else {
+		delete(c.ringing, chatter.Username)
+	}
+	what := "left"
+	if len(c.members) == 0 || (c.room == nil && len(c.members)+len(c.ringing) < 2) {
+		delete(h.calls, c.id)
+		what = "ended"
+	}
+	return callNotice{f: c.frameLocked(chatter, what), to: to, room: c.room}
+}
+
+// ######################################################################
+// function: callRecipientsLocked()
+// ######################################################################
+// Who hears about a private call: its members, the devices it rings and
+// those of who did it. Room calls go to the whole room instead. Caller
+// holds the mutex.
+func (h *Hub) callRecipientsLocked(c *call, who *Chatter) []*Chatter {
+	if c.room != nil {
+		return nil
+	}
+	var to []*Chatter
+	for _, chatter := range h.chatters.all() {
+		if c.members[chatter] || c.ringing[chatter.Username] || chatter.Username == who.Username {
+			to = append(to, chatter)
+		}
+	}
+	return to
+}
+
+// ######################################################################
+// function: frameLocked()
+// ######################################################################
+// Call presence, who did what and who is in the call now. Caller holds
+// the mutex.
+func (c *call) frameLocked(who *Chatter, what string) protocol.Frame {
+	f := protocol.Frame{Type: protocol.FrameCall, Call: c.id, From: who.Username, Text: what}
+	if c.room != nil {
+		f.Room = c.room.name
+	}
+	seen := make(map[string]bool, len(c.members))
+	for member := range c.members {
+		if !seen[member.Username] {
+			seen[member.Username] = true
+			f.Members = append(f.Members, member.Username)
+		}
+	}
+	sort.Strings(f.Members)
+	return f
+}
+
+// A call frame and who gets it, to send once the mutex is released
+type callNotice struct {
+	f    protocol.Frame
+	to   []*Chatter
+	room *Room // for room calls, everyone in it
+}
+
+func (h *Hub) sendCallNotice(n callNotice) {
+	if n.room != nil {
+		h.broadcastRoom(n.room, n.f, nil)
+		return
+	}
+	for _, chatter := range n.to {
+		chatter.Send(n.f)
+	}
+}
+
+// ######################################################################
+// function: sendRoomCall()
+// ######################################################################
+// Tells a newcomer to the room about its call, if it has one.
+func (h *Hub) sendRoomCall(chatter *Chatter, room *Room) {
+	h.mu.Lock()
+	c := h.calls[roomCallPrefix+room.name]
+	var f protocol.Frame
+	if c != nil {
+		f = c.frameLocked(chatter, "ongoing")
+		f.From = ""
+	}
+	h.mu.Unlock()
+	if c != nil {
+		chatter.Send(f)
+	}
+}
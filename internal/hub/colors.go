@@ -0,0 +1,150 @@
+package hub
+
+import (
+	"errors"
+	"hash/fnv"
+	"sort"
+	"strings"
+)
+
+// Everyone has a display color from the palette, the same on every client:
+// one picked with /color, or else one that follows from the account (the
+// name for guests). Message and presence frames carry it.
+
+// Names to colors that read well on light and dark backgrounds
+var palette = map[string]string{
+	"red":    "#d64545",
+	"orange": "#d9730d",
+	"amber":  "#b7791f",
+	"green":  "#2f9e44",
+	"teal":   "#0c8599",
+	"blue":   "#1c7ed6",
+	"indigo": "#4c6ef5",
+	"violet": "#7950f2",
+	"purple": "#ae3ec9",
+	"pink":   "#d6336c",
+	"brown":  "#8d6e63",
+	"slate":  "#607d8b",
+}
+
+// palette names in order, for derived colors and listing them
+var paletteNames = func() []string {
+	names := make([]string, 0, len(palette))
+	for name := range palette {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}()
+
+var errColor = errors.New("pick one of the palette's colors, see /color")
+
+// ######################################################################
+// function: derivedColor()
+// ######################################################################
+// The palette color key hashes to.
+func derivedColor(key string) string {
+	sum := fnv.New32a()
+	sum.Write([]byte(key))
+	return palette[paletteNames[sum.Sum32()%uint32(len(paletteNames))]]
+}
+
+// ######################################################################
+// function: paletteColor()
+// ######################################################################
+// The color for a palette name or one of its values ("teal", "#0C8599").
+func paletteColor(choice string) (string, bool) {
+	choice = strings.ToLower(strings.TrimSpace(choice))
+	if c, ok := palette[choice]; ok {
+		return c, true
+	}
+	for _, c := range palette {
+		if c == choice {
+			return c, true
+		}
+	}
+	return "", false
+}
+
+// ######################################################################
+// function: colorOf()
+// ######################################################################
+func (h *Hub) colorOf(chatter *Chatter) string {
+	h.mu.Lock()
+	id, chosen, name := chatter.account, chatter.color, chatter.Username
+	h.mu.Unlock()
+	if id == "" {
+		if chosen != "" {
+			return chosen
+		}
+		return derivedColor(strings.ToLower(name))
+	}
+	h.accountsMu.Lock()
+	defer h.accountsMu.Unlock()
+	if a, ok := h.accounts[id]; ok && a.Color != "" {
+		return a.Color
+	}
+	return derivedColor(id)
+}
+
+// ######################################################################
+// function: setColor()
+// ######################################################################
+// Sets the chatter's color, on the account if signed in. "" goes back to
+// the derived one.
+func (h *Hub) setColor(chatter *Chatter, choice string) error {
+	color := ""
+	if choice != "" {
+		var ok bool
+		if color, ok = paletteColor(choice); !ok {
+			return errColor
+		}
+	}
+	h.mu.Lock()
+	id := chatter.account
+	if id == "" {
+		chatter.color = color
+	}
+	h.mu.Unlock()
+	if id != "" {
+		h.accountsMu.Lock()
+		if a, ok := h.accounts[id]; ok {
+			a.Color = color
+			h.saveAccountsLocked()
+		}
+		h.accountsMu.Unlock()
+		for _, c := range h.accountChatters(id) {
+			h.broadcastPresence(c)
+		}
+		return nil
+	}
+	h.broadcastPresence(chatter)
+	return nil
+}
+
+// ######################################################################
+// function: cmdColor()
+// ######################################################################
+// /color shows yours and the palette, /color <name> picks one and
+// /color - goes back to the one you got.
+func (h *Hub) cmdColor(chatter *Chatter, args string) bool {
+	if args == "" {
+		current := h.colorOf(chatter)
+		for name, c := range palette {
+			if c == current {
+				current = name
+			}
+		}
+		chatter.SendSystem("Your color is %s. Colors: %s.", current, strings.Join(paletteNames, ", "))
+		return false
+	}
+	if args == "-" {
+		args = ""
+	}
+	if err := h.setColor(chatter, args); err != nil {
+		chatter.fail(err)
+		return false
+	}
+	chatter.SendSystem("Color updated.")
+	return false
+}
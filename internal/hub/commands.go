@@ -0,0 +1,605 @@
+package hub
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go-chat-app/internal/i18n"
+	"go-chat-app/internal/protocol"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Who may run a command
+type permission int
+
+const (
+	permEveryone  permission = iota
+	permModerator            // of the room the chatter is in, or an admin
+	permAdmin                // opped with /op
+)
+
+// ######################################################################
+// struct: command
+// ######################################################################
+// A slash command. run gets everything after "/name ", trimmed, and
+// returns true if the connection should be closed. Commands that anyone
+// can look at but only moderators change (/topic, /banner, /policy) are
+// permEveryone and check for themselves.
+type command struct {
+	name        string
+	aliases     []string
+	usage       string // arguments, for /help
+	description string // English, translated like any other server text
+	permission  permission
+	denied      string // error for chatters without the permission
+	run         func(h *Hub, chatter *Chatter, args string) bool
+}
+
+// commands in the order /help lists them, set up in init since /help
+// itself needs the list
+var (
+	commands     []*command
+	commandIndex map[string]*command
+)
+
+func init() {
+	commands = []*command{
+		{name: "help", description: "List the commands you can use", run: (*Hub).cmdHelp},
+		{name: "u", usage: "<name>", description: "Change your name", run: (*Hub).cmdRename},
+		{name: "lang", usage: "<" + strings.Join(i18n.Locales, "|") + ">", description: "Change the language of server messages", run: (*Hub).cmdLang},
+		{name: "join", usage: "<room> [password or invite]", description: "Switch to another room", run: (*Hub).cmdJoin},
+		{name: "away", usage: "[reason]", description: "Mark yourself away", run: (*Hub).cmdAway},
+		{name: "back", description: "Mark yourself available again", run: (*Hub).cmdBack},
+		{name: "color", usage: "[color|-]", description: "Show or pick the color of your name", run: (*Hub).cmdColor},
+		{name: "status", usage: "[text|-]", description: "Set the status others see next to your name", run: (*Hub).cmdStatus},
+		{name: "whois", usage: "<user>", description: "Show who someone is and where they are", run: (*Hub).cmdWhois},
+		{name: "ignore", usage: "[user]", description: "Stop seeing someone's messages, or list who you ignore", run: (*Hub).cmdIgnore},
+		{name: "unignore", usage: "<user>", description: "See someone's messages again", run: (*Hub).cmdUnignore},
+		{name: "msg", usage: "<user> <text>", description: "Send a private message", run: (*Hub).cmdMsg},
+		{name: "reply", usage: "<message id> <text>", description: "Reply to a message in a thread", run: (*Hub).cmdReply},
+		{name: "quote", usage: "<message id> <text>", description: "Answer a message, quoting it", run: (*Hub).cmdQuote},
+		{name: "whisper-ttl", usage: "<duration> <text>", description: "Send a message that deletes itself", run: (*Hub).cmdWhisperTTL},
+		{name: "poll", usage: `[duration] "<question>" <option> <option>...`, description: "Ask the room a question", run: (*Hub).cmdPoll},
+		{name: "vote", usage: "<poll id> <option number>", description: "Vote in a poll, again to change your vote", run: (*Hub).cmdVote},
+		{name: "endpoll", usage: "[poll id]", description: "Close a poll you asked, moderators any poll", run: (*Hub).cmdEndPoll},
+		{name: "react", usage: "<message id> <emoji>", description: "Add or remove a reaction", run: (*Hub).cmdReact},
+		{name: "topic", usage: "[topic|-]", description: "Show the room topic, moderators can change it", run: (*Hub).cmdTopic},
+		{name: "banner", usage: "[info|warning|incident] [text|-]", description: "Show the room banner, moderators can change it", run: (*Hub).cmdBanner},
+		{name: "policy", usage: "[reactions|uploads|link_previews on|off]", description: "Show the room policy, moderators can change it", run: (*Hub).cmdPolicy},
+		{name: "spam", usage: "[repeats <n> <seconds>|caps <percent>|mentions <n>|off|default]", description: "Show the spam rules, moderators can change them", run: (*Hub).cmdSpam},
+		{name: "retention", usage: "[age <duration>|count <n>|off|default]", description: "Show how long messages are kept, moderators can change it", run: (*Hub).cmdRetention},
+		{name: "schedule", usage: "<duration> <text>", description: "Post a message later", run: (*Hub).cmdSchedule},
+		{name: "unschedule", usage: "<id>", description: "Cancel a scheduled message", run: (*Hub).cmdUnschedule},
+		{name: "subscribe", usage: "<command>...", description: "Only get messages starting with these !commands, for bots", run: (*Hub).cmdSubscribe},
+		{name: "unsubscribe", description: "Get every message again", run: (*Hub).cmdUnsubscribe},
+		{name: "op", usage: "<admin token>", description: "Become a moderator in every room", run: (*Hub).cmdOp},
+		{name: "q", aliases: []string{"quit"}, description: "Leave the chat", run: (*Hub).cmdQuit},
+
+		{name: "export", usage: "[json|csv|text] [from] [to]", description: "Get a link to download the room's transcript", permission: permModerator,
+			denied: "Only moderators can export the room.", run: (*Hub).cmdExport},
+		{name: "slowmode", usage: "<seconds>", description: "Set the time between messages, 0 turns it off", permission: permModerator,
+			denied: "Only moderators can change slow mode.", run: (*Hub).cmdSlowMode},
+		{name: "password", usage: "<password|off>", description: "Lock the room with a password", permission: permModerator,
+			denied: "Only moderators can lock a room, and the lobby stays open.", run: (*Hub).cmdPassword},
+		{name: "inviteonly", usage: "<on|off>", description: "Only let invited users in", permission: permModerator,
+			denied: "Only moderators can lock a room, and the lobby stays open.", run: (*Hub).cmdInviteOnly},
+		{name: "invite", usage: "<user>", description: "Invite a user to this room", permission: permModerator,
+			denied: "Only moderators can invite.", run: (*Hub).cmdInvite},
+		{name: "pin", usage: "<message id>", description: "Pin a message", permission: permModerator,
+			denied: "Only moderators can pin messages.", run: (*Hub).cmdPin},
+		{name: "unpin", usage: "<message id>", description: "Unpin a message", permission: permModerator,
+			denied: "Only moderators can pin messages.", run: (*Hub).cmdUnpin},
+		{name: "meta", usage: "<description|icon|welcome|tags> <value>", description: "Edit the room's directory entry", permission: permModerator,
+			denied: "Only moderators can edit the room.", run: (*Hub).cmdMeta},
+		{name: "shadowban", usage: "[user]", description: "Hide what a user writes from everyone else here, or list who is", permission: permModerator,
+			denied: "Only moderators can shadow ban.", run: (*Hub).cmdShadowBan},
+		{name: "unshadowban", usage: "<user>", description: "Lift a shadow ban", permission: permModerator,
+			denied: "Only moderators can shadow ban.", run: (*Hub).cmdUnshadowBan},
+
+		{name: "announce", usage: "<text>", description: "Announce something in every room", permission: permAdmin,
+			denied: "Only admins can make announcements.", run: (*Hub).cmdAnnounce},
+	}
+	commandIndex = make(map[string]*command)
+	for _, cmd := range commands {
+		commandIndex[cmd.name] = cmd
+		for _, alias := range cmd.aliases {
+			commandIndex[alias] = cmd
+		}
+	}
+}
+
+// ######################################################################
+// function: runCommand()
+// ######################################################################
+// Runs message if it is a slash command. handled is false for chat lines,
+// closing is true if the connection should be closed.
+func (h *Hub) runCommand(chatter *Chatter, message string) (handled, closing bool) {
+	if !strings.HasPrefix(message, "/") || len(message) < 2 {
+		return false, false
+	}
+	name, args, _ := strings.Cut(message[1:], " ")
+	cmd, ok := commandIndex[name]
+	if !ok {
+		chatter.SendError(protocol.CodeUnknownCommand, "Unknown command /%s, see /help.", name)
+		return true, false
+	}
+	if !h.allowed(chatter, cmd.permission) {
+		chatter.SendError(protocol.CodeNotPermitted, cmd.denied)
+		return true, false
+	}
+	_, span := tracer.Start(context.Background(), "chat.command", trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("chat.command", cmd.name)))
+	defer span.End()
+	return true, cmd.run(h, chatter, strings.TrimSpace(args))
+}
+
+func (h *Hub) allowed(chatter *Chatter, p permission) bool {
+	switch p {
+	case permModerator:
+		return h.isModerator(chatter, chatter.room)
+	case permAdmin:
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		return chatter.admin
+	}
+	return true
+}
+
+// ######################################################################
+// function: cmdHelp()
+// ######################################################################
+// One line per command the chatter may run here, so moderators see more.
+func (h *Hub) cmdHelp(chatter *Chatter, _ string) bool {
+	chatter.SendSystem("Commands:")
+	for _, cmd := range commands {
+		if !h.allowed(chatter, cmd.permission) {
+			continue
+		}
+		usage := "/" + cmd.name
+		if cmd.usage != "" {
+			usage += " " + cmd.usage
+		}
+		chatter.SendSystem("%s - %s", usage, i18n.Localized(cmd.description))
+	}
+
+	owners := h.botCommands()
+	if len(owners) == 0 {
+		return false
+	}
+	names := make([]string, 0, len(owners))
+	for name := range owners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	chatter.SendSystem("Bot commands:")
+	for _, name := range names {
+		chatter.SendSystem("!%s - answered by %s", name, owners[name])
+	}
+	return false
+}
+
+func (h *Hub) cmdRename(chatter *Chatter, args string) bool {
+	h.rename(chatter, args)
+	return false
+}
+
+func (h *Hub) cmdLang(chatter *Chatter, args string) bool {
+	locale := i18n.Supported(args)
+	if locale == "" {
+		chatter.SendError(protocol.CodeInvalid, "Usage: /lang <%s>", strings.Join(i18n.Locales, "|"))
+		return false
+	}
+	chatter.SetLocale(locale)
+	chatter.SendSystem("Language set to %s", locale)
+	return false
+}
+
+func (h *Hub) cmdJoin(chatter *Chatter, args string) bool {
+	name, key, _ := strings.Cut(args, " ")
+	name, key = strings.ToLower(name), strings.TrimSpace(key)
+	if name == "" {
+		chatter.SendError(protocol.CodeInvalid, "Usage: /join <room> [password or invite]")
+		return false
+	}
+	old := chatter.room
+	if old.name == name {
+		chatter.SendError(protocol.CodeInvalid, "You are already in #%s", name)
+		return false
+	}
+	room, err := h.joinRoom(chatter, name, key)
+	if err != nil {
+		chatter.SendError(errorCode(err), "Could not join #%s: %s", name, i18n.Tr(chatter.Locale(), err.Error()))
+		return false
+	}
+	h.leaveCalls(chatter, old)
+	h.mu.Lock()
+	stays := old.otherDeviceLocked(chatter)
+	h.mu.Unlock()
+	if !stays {
+		h.broadcastRoom(old, protocol.Systemf(old.name, "%s left #%s.", chatter.Username, old.name), nil)
+		h.emit(Event{Type: EventLeave, Room: old.name, User: chatter.Username})
+	}
+	chatter.Send(protocol.Systemf(room.name, "You are now in #%s", room.name))
+	return false
+}
+
+func (h *Hub) cmdOp(chatter *Chatter, token string) bool {
+	if h.cfg.AdminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(h.cfg.AdminToken)) != 1 {
+		chatter.SendError(protocol.CodeNotPermitted, "Wrong admin token.")
+		return false
+	}
+	h.mu.Lock()
+	chatter.admin = true
+	h.mu.Unlock()
+	h.Audit(AuditEntry{Actor: chatter.Username, Action: "op", IP: chatter.IP})
+	chatter.SendSystem("You are now a moderator in every room.")
+	return false
+}
+
+func (h *Hub) cmdSlowMode(chatter *Chatter, args string) bool {
+	seconds, err := strconv.Atoi(args)
+	if err != nil || seconds < 0 {
+		chatter.SendError(protocol.CodeInvalid, "Usage: /slowmode <seconds> (0 turns it off)")
+		return false
+	}
+	h.setSlowMode(chatter.room, time.Duration(seconds)*time.Second)
+	return false
+}
+
+func (h *Hub) cmdPolicy(chatter *Chatter, args string) bool {
+	fields := strings.Fields(args)
+	if len(fields) == 0 {
+		h.sendPolicy(chatter)
+		return false
+	}
+	if !h.isModerator(chatter, chatter.room) {
+		chatter.SendError(protocol.CodeNotPermitted, "Only moderators can change the room policy.")
+		return false
+	}
+	if len(fields) != 2 || (fields[1] != "on" && fields[1] != "off") {
+		chatter.SendError(protocol.CodeInvalid, "Usage: /policy <reactions|uploads|link_previews> <on|off>")
+		return false
+	}
+	if err := h.setPolicy(chatter.room, fields[0], fields[1] == "on"); err != nil {
+		chatter.fail(err)
+		return false
+	}
+	h.broadcastRoom(chatter.room, protocol.Systemf(chatter.room.name, "%s turned %s %s in #%s.", chatter.Username, fields[0], i18n.Localized(fields[1]), chatter.room.name), nil)
+	return false
+}
+
+// patterns need the JSON or protobuf subscribe frame, spaces and all
+func (h *Hub) cmdSubscribe(chatter *Chatter, args string) bool {
+	if err := h.subscribe(chatter, strings.Fields(args), nil); err != nil {
+		chatter.fail(err)
+	}
+	return false
+}
+
+func (h *Hub) cmdUnsubscribe(chatter *Chatter, _ string) bool {
+	h.subscribe(chatter, nil, nil)
+	return false
+}
+
+func (h *Hub) cmdTopic(chatter *Chatter, topic string) bool {
+	if topic == "" {
+		h.mu.Lock()
+		current := chatter.room.topic
+		h.mu.Unlock()
+		chatter.Send(protocol.Frame{Type: protocol.FrameTopic, Room: chatter.room.name, Text: current})
+		return false
+	}
+	if !h.isModerator(chatter, chatter.room) {
+		chatter.SendError(protocol.CodeNotPermitted, "Only moderators can change the topic.")
+		return false
+	}
+	if topic == "-" {
+		topic = "" // "/topic -" clears it
+	}
+	h.setTopic(chatter.room, topic, chatter)
+	return false
+}
+
+func (h *Hub) cmdBanner(chatter *Chatter, text string) bool {
+	if text == "" {
+		h.sendBanner(chatter, chatter.room, true)
+		return false
+	}
+	if !h.isModerator(chatter, chatter.room) {
+		chatter.SendError(protocol.CodeNotPermitted, "Only moderators can change the banner.")
+		return false
+	}
+	if text == "-" {
+		h.setBanner(chatter.room, nil) // "/banner -" clears it
+		return false
+	}
+	// "/banner incident db is down" or just "/banner be nice"
+	level := ""
+	if first, rest, ok := strings.Cut(text, " "); ok {
+		switch first {
+		case protocol.BannerInfo, protocol.BannerWarning, protocol.BannerIncident:
+			level, text = first, rest
+		}
+	}
+	banner, err := newBanner(text, level, chatter.Username)
+	if err != nil {
+		chatter.fail(err)
+		return false
+	}
+	h.setBanner(chatter.room, banner)
+	return false
+}
+
+func (h *Hub) cmdPassword(chatter *Chatter, password string) bool {
+	if chatter.room.name == DefaultRoom {
+		chatter.SendError(protocol.CodeNotPermitted, "Only moderators can lock a room, and the lobby stays open.")
+		return false
+	}
+	switch {
+	case password == "":
+		chatter.SendError(protocol.CodeInvalid, "Usage: /password <password|off>")
+		return false
+	case strings.EqualFold(password, "off"), password == "-":
+		h.setRoomPassword(chatter.room, "")
+		chatter.SendSystem("Room password removed.")
+		return false
+	}
+	h.setRoomPassword(chatter.room, password)
+	chatter.SendSystem("Room password updated.")
+	return false
+}
+
+func (h *Hub) cmdInviteOnly(chatter *Chatter, args string) bool {
+	if chatter.room.name == DefaultRoom {
+		chatter.SendError(protocol.CodeNotPermitted, "Only moderators can lock a room, and the lobby stays open.")
+		return false
+	}
+	state := strings.ToLower(args)
+	if state != "on" && state != "off" {
+		chatter.SendError(protocol.CodeInvalid, "Usage: /inviteonly <on|off>")
+		return false
+	}
+	h.setInviteOnly(chatter.room, state == "on")
+	h.broadcastRoom(chatter.room, protocol.Systemf(chatter.room.name, "#%s invite only: %s", chatter.room.name, i18n.Localized(state)), nil)
+	return false
+}
+
+func (h *Hub) cmdAway(chatter *Chatter, reason string) bool {
+	if err := h.setAway(chatter, true, reason); err != nil {
+		chatter.fail(err)
+		return false
+	}
+	chatter.SendSystem("You are marked as away.")
+	return false
+}
+
+func (h *Hub) cmdBack(chatter *Chatter, _ string) bool {
+	h.setAway(chatter, false, "")
+	chatter.SendSystem("You are no longer marked as away.")
+	return false
+}
+
+func (h *Hub) cmdStatus(chatter *Chatter, status string) bool {
+	if status == "" {
+		h.mu.Lock()
+		status = chatter.status
+		h.mu.Unlock()
+		chatter.SendSystem("Your status: %s", status)
+		return false
+	}
+	if status == "-" {
+		status = "" // "/status -" clears it
+	}
+	if err := h.setStatus(chatter, status); err != nil {
+		chatter.fail(err)
+		return false
+	}
+	chatter.SendSystem("Status updated.")
+	return false
+}
+
+func (h *Hub) cmdWhois(chatter *Chatter, name string) bool {
+	if name == "" {
+		chatter.SendError(protocol.CodeInvalid, "Usage: /whois <user>")
+		return false
+	}
+	h.whois(chatter, name)
+	return false
+}
+
+func (h *Hub) cmdIgnore(chatter *Chatter, name string) bool {
+	if name == "" {
+		if list := h.ignored(chatter); len(list) > 0 {
+			chatter.SendSystem("You are ignoring %s.", strings.Join(list, ", "))
+		} else {
+			chatter.SendSystem("You are not ignoring anyone.")
+		}
+		return false
+	}
+	if err := h.ignore(chatter, name, true); err != nil {
+		chatter.fail(err)
+		return false
+	}
+	chatter.SendSystem("You no longer see messages from %s. Undo with /unignore %s", name, name)
+	return false
+}
+
+func (h *Hub) cmdUnignore(chatter *Chatter, name string) bool {
+	if name == "" {
+		chatter.SendError(protocol.CodeInvalid, "Usage: /unignore <user>")
+		return false
+	}
+	h.ignore(chatter, name, false)
+	chatter.SendSystem("You see messages from %s again.", name)
+	return false
+}
+
+func (h *Hub) cmdMsg(chatter *Chatter, args string) bool {
+	to, text, ok := strings.Cut(args, " ")
+	if text = strings.TrimSpace(text); !ok || to == "" || text == "" {
+		chatter.SendError(protocol.CodeInvalid, "Usage: /msg <user> <text>")
+		return false
+	}
+	h.sendDirect(chatter, to, text)
+	return false
+}
+
+func (h *Hub) cmdInvite(chatter *Chatter, name string) bool {
+	invitees := h.findChatters(name)
+	if len(invitees) == 0 {
+		chatter.SendError(protocol.CodeUserNotFound, "No user named %s is online.", name)
+		return false
+	}
+	token := h.createInvite(chatter.room)
+	for _, invitee := range invitees {
+		invitee.Send(protocol.Frame{
+			Type:   protocol.FrameInvite,
+			Room:   chatter.room.name,
+			From:   chatter.Username,
+			Token:  token,
+			Format: "%s invited you to #%s. Join with: /join %s %s",
+			Args:   []any{chatter.Username, chatter.room.name, chatter.room.name, token},
+		})
+	}
+	chatter.SendSystem("Invite sent to %s", name)
+	return false
+}
+
+func (h *Hub) cmdPin(chatter *Chatter, args string) bool {
+	return h.pinCommand(chatter, args, true)
+}
+
+func (h *Hub) cmdUnpin(chatter *Chatter, args string) bool {
+	return h.pinCommand(chatter, args, false)
+}
+
+func (h *Hub) pinCommand(chatter *Chatter, args string, pin bool) bool {
+	command := "/unpin"
+	if pin {
+		command = "/pin"
+	}
+	id, err := strconv.ParseInt(args, 10, 64)
+	if err != nil {
+		chatter.SendError(protocol.CodeInvalid, "Usage: %s <message id>", command)
+		return false
+	}
+	if pin {
+		err = h.pinMessage(chatter.room, id, chatter)
+	} else {
+		err = h.unpinMessage(chatter.room, id, chatter)
+	}
+	if err != nil {
+		chatter.fail(err)
+	}
+	return false
+}
+
+func (h *Hub) cmdReact(chatter *Chatter, args string) bool {
+	idText, emoji, _ := strings.Cut(args, " ")
+	id, err := strconv.ParseInt(idText, 10, 64)
+	if err != nil {
+		chatter.SendError(protocol.CodeInvalid, "Usage: /react <message id> <emoji>")
+		return false
+	}
+	if err := h.toggleReaction(chatter, id, emoji); err != nil {
+		chatter.fail(err)
+	}
+	return false
+}
+
+func (h *Hub) cmdSchedule(chatter *Chatter, args string) bool {
+	d, text, err := parseSchedule(args)
+	if err != nil {
+		chatter.fail(err)
+		return false
+	}
+	text, ok, struck := h.filterChat(chatter, text)
+	if !ok {
+		return struck
+	}
+	m, err := h.Schedule(chatter.room.name, chatter.Username, h.clientIDOwner(chatter), chatter.IP, text, time.Now().Add(d))
+	if err != nil {
+		chatter.fail(err)
+		return false
+	}
+	chatter.SendSystem("Message %s scheduled for %s in #%s. Cancel with /unschedule %s", m.ID, m.At.Format("15:04:05"), m.Room, m.ID)
+	return false
+}
+
+func (h *Hub) cmdUnschedule(chatter *Chatter, id string) bool {
+	h.scheduleMu.Lock()
+	m, ok := h.scheduled[id]
+	h.scheduleMu.Unlock()
+	if !ok || ((m.Owner == "" || m.Owner != h.clientIDOwner(chatter)) && !h.allowed(chatter, permAdmin)) {
+		chatter.SendError(protocol.CodeMessageNotFound, "No scheduled message %s of yours.", id)
+		return false
+	}
+	h.Unschedule(id)
+	chatter.SendSystem("Scheduled message %s cancelled.", id)
+	return false
+}
+
+func (h *Hub) cmdAnnounce(chatter *Chatter, text string) bool {
+	h.Announce(chatter.Username, text)
+	return false
+}
+
+func (h *Hub) cmdMeta(chatter *Chatter, args string) bool {
+	field, value, _ := strings.Cut(args, " ")
+	value = strings.TrimSpace(value)
+	var update func(*protocol.RoomMeta)
+	switch field {
+	case "description":
+		update = func(m *protocol.RoomMeta) { m.Description = value }
+	case "icon":
+		update = func(m *protocol.RoomMeta) { m.Icon = value }
+	case "welcome":
+		update = func(m *protocol.RoomMeta) { m.Welcome = value }
+	case "tags":
+		update = func(m *protocol.RoomMeta) { m.Tags = strings.Fields(value) }
+	default:
+		chatter.SendError(protocol.CodeInvalid, "Usage: /meta <description|icon|welcome|tags> <value>")
+		return false
+	}
+	h.updateRoomMeta(chatter.room, update)
+	return false
+}
+
+func (h *Hub) cmdQuit(chatter *Chatter, _ string) bool {
+	fmt.Printf("User %s has disconnected.\n", chatter.Username)
+	return true // close the connection
+}
+
+func (h *Hub) cmdReply(chatter *Chatter, args string) bool {
+	id, text, ok := parseReply(args)
+	if !ok {
+		chatter.SendError(protocol.CodeInvalid, "Usage: /reply <message id> <text>")
+		return false
+	}
+	return h.postMessage(chatter, Post{Text: text, ReplyTo: id})
+}
+
+func (h *Hub) cmdQuote(chatter *Chatter, args string) bool {
+	id, text, ok := parseReply(args)
+	if !ok {
+		chatter.SendError(protocol.CodeInvalid, "Usage: /quote <message id> <text>")
+		return false
+	}
+	return h.postMessage(chatter, Post{Text: text, Quote: id})
+}
+
+func (h *Hub) cmdWhisperTTL(chatter *Chatter, args string) bool {
+	ttl, text, ok := parseWhisperTTL(args)
+	if !ok {
+		chatter.SendError(protocol.CodeInvalid, "Usage: /whisper-ttl <duration, e.g. 30s> <text>")
+		return false
+	}
+	return h.postMessage(chatter, Post{Text: text, TTL: ttl})
+}
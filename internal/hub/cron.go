@@ -0,0 +1,136 @@
+package hub
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ######################################################################
+// struct: cronSpec
+// ######################################################################
+// The usual five cron fields: minute hour day-of-month month day-of-week.
+// Each field takes *, numbers, ranges (1-5), lists (1,15) and steps (*/15).
+type cronSpec struct {
+	minute, hour, dom, month, dow [61]bool
+	domAny, dowAny                bool
+}
+
+var cronFields = []struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 6},
+}
+
+// ######################################################################
+// function: parseCron()
+// ######################################################################
+func parseCron(spec string) (*cronSpec, error) {
+	parts := strings.Fields(spec)
+	if len(parts) != len(cronFields) {
+		return nil, fmt.Errorf("cron spec needs 5 fields (minute hour day month weekday), got %d", len(parts))
+	}
+	c := &cronSpec{domAny: parts[2] == "*", dowAny: parts[4] == "*"}
+	sets := []*[61]bool{&c.minute, &c.hour, &c.dom, &c.month, &c.dow}
+	for i, part := range parts {
+		f := cronFields[i]
+		if f.name == "day of week" {
+			part = strings.ReplaceAll(part, "7", "0") // sunday is both 0 and 7
+		}
+		for _, item := range strings.Split(part, ",") {
+			if err := parseCronItem(item, f.min, f.max, sets[i]); err != nil {
+				return nil, fmt.Errorf("%s: %w", f.name, err)
+			}
+		}
+	}
+	return c, nil
+}
+
+func parseCronItem(item string, min, max int, set *[61]bool) error {
+	rng, stepText, hasStep := strings.Cut(item, "/")
+	step := 1
+	if hasStep {
+		n, err := strconv.Atoi(stepText)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid step %q", stepText)
+		}
+		step = n
+	}
+
+	lo, hi := min, max
+	if rng != "*" {
+		loText, hiText, isRange := strings.Cut(rng, "-")
+		var err error
+		if lo, err = strconv.Atoi(loText); err != nil {
+			return fmt.Errorf("invalid value %q", loText)
+		}
+		hi = lo
+		if isRange {
+			if hi, err = strconv.Atoi(hiText); err != nil {
+				return fmt.Errorf("invalid value %q", hiText)
+			}
+		} else if hasStep {
+			hi = max // 5/15 means 5, 20, 35, 50
+		}
+	}
+	if lo < min || hi > max || lo > hi {
+		return fmt.Errorf("%q is outside %d-%d", rng, min, max)
+	}
+	for v := lo; v <= hi; v += step {
+		set[v] = true
+	}
+	return nil
+}
+
+// ######################################################################
+// function: dayMatches()
+// ######################################################################
+// Like cron: when both day fields are restricted either one may match.
+func (c *cronSpec) dayMatches(t time.Time) bool {
+	dom, dow := c.dom[t.Day()], c.dow[int(t.Weekday())]
+	switch {
+	case c.domAny && c.dowAny:
+		return true
+	case c.domAny:
+		return dow
+	case c.dowAny:
+		return dom
+	}
+	return dom || dow
+}
+
+// ######################################################################
+// function: next()
+// ######################################################################
+// The first matching minute after t, on the wall clock of loc. Zero if the
+// spec never matches (30 2 31 2 *).
+func (c *cronSpec) next(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc).Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		y, mo, d := t.Date()
+		prev := t
+		switch {
+		case !c.month[int(mo)]:
+			t = time.Date(y, mo+1, 1, 0, 0, 0, 0, loc)
+		case !c.dayMatches(t):
+			t = time.Date(y, mo, d+1, 0, 0, 0, 0, loc)
+		case !c.hour[t.Hour()]:
+			t = time.Date(y, mo, d, t.Hour()+1, 0, 0, 0, loc)
+		case !c.minute[t.Minute()]:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+		if !t.After(prev) { // the wall clock went back an hour
+			t = prev.Add(time.Minute)
+		}
+	}
+	return time.Time{}
+}
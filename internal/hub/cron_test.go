@@ -0,0 +1,55 @@
+package hub
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	oslo, err := time.LoadLocation("Europe/Oslo")
+	if err != nil {
+		t.Skip("no tz data:", err)
+	}
+	kolkata, err := time.LoadLocation("Asia/Kolkata")
+	if err != nil {
+		t.Skip("no tz data:", err)
+	}
+
+	tests := []struct {
+		spec  string
+		loc   *time.Location
+		after string // RFC 3339
+		want  string
+	}{
+		{"*/15 * * * *", time.UTC, "2026-01-01T10:07:30Z", "2026-01-01T10:15:00Z"},
+		{"0 9 * * 1-5", oslo, "2026-01-02T09:00:00+01:00", "2026-01-05T09:00:00+01:00"}, // friday -> monday
+		{"0 9 * * *", oslo, "2026-03-28T10:00:00+01:00", "2026-03-29T09:00:00+02:00"},   // over the DST switch
+		{"30 2 * * *", oslo, "2026-03-29T01:00:00+01:00", "2026-03-30T02:30:00+02:00"},  // 02:30 does not exist that night
+		{"0 10 * * *", kolkata, "2026-01-01T00:00:00Z", "2026-01-01T10:00:00+05:30"},
+		{"0 0 1,15 * 0", time.UTC, "2026-02-02T00:00:00Z", "2026-02-08T00:00:00Z"}, // sunday or the 1st/15th
+		{"0 12 29 2 *", time.UTC, "2026-03-01T00:00:00Z", "2028-02-29T12:00:00Z"},
+	}
+	for _, tt := range tests {
+		c, err := parseCron(tt.spec)
+		if err != nil {
+			t.Fatalf("parseCron(%q): %v", tt.spec, err)
+		}
+		after, _ := time.Parse(time.RFC3339, tt.after)
+		want, _ := time.Parse(time.RFC3339, tt.want)
+		if got := c.next(after, tt.loc); !got.Equal(want) {
+			t.Errorf("%q after %s = %s, want %s", tt.spec, tt.after, got, tt.want)
+		}
+	}
+}
+
+func TestCronInvalid(t *testing.T) {
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* 5-2 * * *", "*/0 * * * *", "a * * * *"} {
+		if _, err := parseCron(spec); err == nil {
+			t.Errorf("parseCron(%q) accepted", spec)
+		}
+	}
+	c, _ := parseCron("0 0 31 2 *")
+	if next := c.next(time.Now(), time.UTC); !next.IsZero() {
+		t.Errorf("february 31st matched %s", next)
+	}
+}
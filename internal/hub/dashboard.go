@@ -0,0 +1,85 @@
+package hub
+
+import (
+	"log"
+	"sort"
+	"time"
+)
+
+// ######################################################################
+// struct: Connection
+// ######################################################################
+// One open connection, as the admin dashboard lists it.
+type Connection struct {
+	ID        int64     `json:"id"`
+	Username  string    `json:"username"`
+	Account   string    `json:"account,omitempty"`
+	Room      string    `json:"room"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Protocol  string    `json:"protocol"`
+	Presence  string    `json:"presence"`
+	Connected time.Time `json:"connected"`
+
+	PreviousNames []string `json:"previous_names,omitempty"`
+	BytesSent     int64    `json:"bytes_sent"`
+	BytesReceived int64    `json:"bytes_received"`
+}
+
+// ######################################################################
+// function: Connections()
+// ######################################################################
+// Everyone connected, oldest connection first.
+func (h *Hub) Connections() []Connection {
+	h.mu.Lock()
+	list := make([]Connection, 0, h.chatters.len())
+	for _, chatter := range h.chatters.all() {
+		c := Connection{
+			ID:        chatter.id,
+			Username:  chatter.Username,
+			Account:   chatter.account,
+			IP:        chatter.IP,
+			UserAgent: chatter.UserAgent,
+			Protocol:  chatter.Codec().Name(),
+			Presence:  chatter.presence,
+			Connected: chatter.connected,
+
+			PreviousNames: append([]string(nil), chatter.previousNames...),
+		}
+		if chatter.room != nil {
+			c.Room = chatter.room.name
+		}
+		c.BytesSent, c.BytesReceived = chatter.Traffic()
+		list = append(list, c)
+	}
+	h.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// ######################################################################
+// function: Kick()
+// ######################################################################
+// Disconnects connection id for good, no resuming. False if it is gone
+// already.
+func (h *Hub) Kick(id int64, reason string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, chatter := range h.chatters.all() {
+		if chatter.id != id || chatter.kicked {
+			continue
+		}
+		log.Printf("Admin kicked %s (%s)", chatter.Username, chatter.IP)
+		chatter.kicked = true
+		ev := Event{Type: EventModeration, Action: "kick", User: chatter.Username}
+		if chatter.room != nil {
+			ev.Room = chatter.room.name
+		}
+		h.emit(ev)
+		h.Audit(AuditEntry{Actor: "admin", Action: "kick", Target: chatter.Username, Room: ev.Room, Reason: reason})
+		chatter.SendSystem("You were kicked by an admin.")
+		chatter.Close()
+		return true
+	}
+	return false
+}
@@ -0,0 +1,88 @@
+package hub
+
+import (
+	"runtime"
+	"sort"
+)
+
+// ######################################################################
+// struct: Debug
+// ######################################################################
+// A look inside the hub for chasing leaks and slow fan-out, see
+// /admin/debug/hub. Not a stable format.
+type Debug struct {
+	Goroutines  int `json:"goroutines"`
+	Connections int `json:"connections"`
+
+	Rooms       []RoomDebug  `json:"rooms"`        // most connections first
+	SendBuffers []SendBuffer `json:"send_buffers"` // connections with frames waiting, fullest first
+
+	FanoutWorkers int   `json:"fanout_workers"`
+	FanoutQueued  int   `json:"fanout_queued"` // chunks waiting for a worker
+	EventTaps     []int `json:"event_taps"`    // events waiting per exporter
+}
+
+type RoomDebug struct {
+	Name        string `json:"name"`
+	Connections int    `json:"connections"`
+	People      int    `json:"people"` // accounts count once
+	Moderators  int    `json:"moderators"`
+	Watchers    int    `json:"watchers"` // embeds and bridges
+	History     int    `json:"history"`
+}
+
+type SendBuffer struct {
+	ID       int64  `json:"id"` // as in /admin/connections
+	Username string `json:"username"`
+	Room     string `json:"room"`
+	Queued   int    `json:"queued"`
+	Dropped  int64  `json:"dropped"`
+	Slow     bool   `json:"slow"` // hung up on, not gone yet
+}
+
+// ######################################################################
+// function: Debug()
+// ######################################################################
+func (h *Hub) Debug() Debug {
+	d := Debug{Goroutines: runtime.NumGoroutine(), FanoutWorkers: h.fanout.workers, FanoutQueued: len(h.fanout.jobs)}
+
+	h.mu.Lock()
+	d.Connections = h.chatters.len()
+	for _, room := range h.rooms {
+		d.Rooms = append(d.Rooms, RoomDebug{
+			Name:        room.name,
+			Connections: len(room.members),
+			People:      room.membersLocked(),
+			Moderators:  len(room.moderators),
+			Watchers:    len(room.watchers),
+			History:     len(room.history),
+		})
+	}
+	for _, chatter := range h.chatters.all() {
+		queued, dropped, slow := chatter.Backlog()
+		if queued == 0 && !slow {
+			continue
+		}
+		b := SendBuffer{ID: chatter.id, Username: chatter.Username, Queued: queued, Dropped: dropped, Slow: slow}
+		if chatter.room != nil {
+			b.Room = chatter.room.name
+		}
+		d.SendBuffers = append(d.SendBuffers, b)
+	}
+	h.mu.Unlock()
+
+	h.webhooksMu.Lock()
+	for tap := range h.taps {
+		d.EventTaps = append(d.EventTaps, len(tap))
+	}
+	h.webhooksMu.Unlock()
+
+	sort.Slice(d.Rooms, func(i, j int) bool {
+		if d.Rooms[i].Connections != d.Rooms[j].Connections {
+			return d.Rooms[i].Connections > d.Rooms[j].Connections
+		}
+		return d.Rooms[i].Name < d.Rooms[j].Name
+	})
+	sort.Slice(d.SendBuffers, func(i, j int) bool { return d.SendBuffers[i].Queued > d.SendBuffers[j].Queued })
+	return d
+}
@@ -0,0 +1,100 @@
+package hub
+
+import "slices"
+
+// An account can be signed in on several devices at once. They count as
+// one person in rooms and user counts, share their name and presence, and
+// all get the account's direct messages and mentions.
+
+// Presence states in the order they win when an account's devices disagree
+var presenceRank = []string{presenceActive, presenceAway, presenceIdle, presenceOnline}
+
+// ######################################################################
+// function: personLocked()
+// ######################################################################
+// Who is behind the connection: its account, or for guests the connection
+// itself. Caller holds the mutex.
+func (c *Chatter) personLocked() any {
+	if c.account != "" {
+		return c.account
+	}
+	return c
+}
+
+// ######################################################################
+// function: peopleLocked()
+// ######################################################################
+// How many people the connections are, each account counted once. Caller
+// holds the mutex.
+func peopleLocked(chatters []*Chatter) int {
+	seen := make(map[any]bool, len(chatters))
+	for _, c := range chatters {
+		seen[c.personLocked()] = true
+	}
+	return len(seen)
+}
+
+// ######################################################################
+// function: membersLocked()
+// ######################################################################
+// The room's member count as people. Caller holds the mutex.
+func (room *Room) membersLocked() int {
+	seen := make(map[any]bool, len(room.members))
+	for c := range room.members {
+		seen[c.personLocked()] = true
+	}
+	return len(seen)
+}
+
+// ######################################################################
+// function: otherDeviceLocked()
+// ######################################################################
+// True if another connection of the chatter's account is in the room. Joins
+// and leaves of a second device aren't announced. Caller holds the mutex.
+func (room *Room) otherDeviceLocked(chatter *Chatter) bool {
+	if chatter.account == "" {
+		return false
+	}
+	for c := range room.members {
+		if c != chatter && c.account == chatter.account {
+			return true
+		}
+	}
+	return false
+}
+
+// ######################################################################
+// function: devicesLocked()
+// ######################################################################
+// The chatter and every other connection of its account. Caller holds the
+// mutex.
+func (h *Hub) devicesLocked(chatter *Chatter) []*Chatter {
+	if chatter.account == "" {
+		return []*Chatter{chatter}
+	}
+	var found []*Chatter
+	for _, c := range h.chatters.all() {
+		if c.account == chatter.account {
+			found = append(found, c)
+		}
+	}
+	if !slices.Contains(found, chatter) {
+		found = append(found, chatter) // not registered yet, or already gone
+	}
+	return found
+}
+
+// ######################################################################
+// function: accountPresenceLocked()
+// ######################################################################
+// The most attentive presence of the chatter's devices. Caller holds the
+// mutex.
+func (h *Hub) accountPresenceLocked(chatter *Chatter) string {
+	best := chatter.presence
+	for _, c := range h.devicesLocked(chatter) {
+		if slices.Index(presenceRank, c.presence) < slices.Index(presenceRank, best) {
+			best = c.presence
+		}
+	}
+	return best
+}
@@ -0,0 +1,197 @@
+package hub
+
+import (
+	"errors"
+	"io"
+	"log"
+	"slices"
+	"sort"
+	"time"
+
+	"go-chat-app/internal/protocol"
+)
+
+var ErrNoRoom = errors.New("no such room")
+
+// ######################################################################
+// struct: RoomInfo
+// ######################################################################
+// A room as listed by the room directory.
+type RoomInfo struct {
+	Name     string           `json:"name"`
+	Members  int              `json:"members"`
+	Topic    string           `json:"topic,omitempty"`
+	Locked   bool             `json:"locked,omitempty"`
+	Invite   bool             `json:"invite_only,omitempty"`
+	SlowMode int              `json:"slow_mode_seconds,omitempty"`
+	Banner   *protocol.Banner `json:"banner,omitempty"`
+	protocol.RoomMeta
+}
+
+func roomInfoLocked(room *Room) RoomInfo {
+	return RoomInfo{
+		Name:     room.name,
+		Members:  room.membersLocked(),
+		Topic:    room.topic,
+		Locked:   room.passwordHash != "",
+		Invite:   room.inviteOnly,
+		SlowMode: int(room.slowMode.Seconds()),
+		Banner:   room.banner,
+		RoomMeta: room.meta,
+	}
+}
+
+// ######################################################################
+// function: Rooms()
+// ######################################################################
+// Every room, by name.
+func (h *Hub) Rooms() []RoomInfo {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	list := make([]RoomInfo, 0, len(h.rooms))
+	for _, room := range h.rooms {
+		list = append(list, roomInfoLocked(room))
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// ######################################################################
+// function: Room()
+// ######################################################################
+func (h *Hub) Room(name string) (RoomInfo, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	room, ok := h.rooms[name]
+	if !ok {
+		return RoomInfo{}, false
+	}
+	return roomInfoLocked(room), true
+}
+
+// ######################################################################
+// function: Members()
+// ######################################################################
+// Who is in the room, by name.
+func (h *Hub) Members(name string) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	room, ok := h.rooms[name]
+	if !ok {
+		return nil
+	}
+	names := make([]string, 0, len(room.members))
+	for chatter := range room.members {
+		names = append(names, chatter.Username)
+	}
+	sort.Strings(names)
+	return slices.Compact(names) // an account on several devices
+}
+
+// ######################################################################
+// function: History()
+// ######################################################################
+// The last limit messages of a room (0 = all kept), or with thread set that
+// message and all replies below it. key is the password or invite of a
+// locked room.
+func (h *Hub) History(name, key string, thread int64, limit int) ([]protocol.Frame, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	room, ok := h.rooms[name]
+	if !ok {
+		return nil, ErrNoRoom
+	}
+	if err := h.checkAccessLocked(&Chatter{}, room, key); err != nil {
+		return nil, err
+	}
+	if thread != 0 {
+		messages := room.threadLocked(thread)
+		if len(messages) == 0 {
+			return nil, ErrNotFound
+		}
+		return messages, nil
+	}
+	return room.recentLocked(limit), nil
+}
+
+// ######################################################################
+// function: UpdateRoomMeta()
+// ######################################################################
+// Like /meta, for the admin API. The room is created if it does not exist yet.
+func (h *Hub) UpdateRoomMeta(name string, update func(*protocol.RoomMeta)) protocol.RoomMeta {
+	h.mu.Lock()
+	room, _ := h.getRoom(name)
+	h.mu.Unlock()
+	return h.updateRoomMeta(room, update)
+}
+
+// ######################################################################
+// function: MailList()
+// ######################################################################
+func (h *Hub) MailList(name string) (MailList, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	room, ok := h.rooms[name]
+	if !ok || room.mail == nil {
+		return MailList{}, false
+	}
+	return *room.mail, true
+}
+
+// ######################################################################
+// function: SetMailList()
+// ######################################################################
+// Replaces the room's mailing list, keeping the time of the last digest.
+// A new list starts counting from now. The room is created if needed.
+func (h *Hub) SetMailList(name string, list MailList) MailList {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	room, _ := h.getRoom(name)
+	if room.mail != nil {
+		list.LastDigest = room.mail.LastDigest
+	} else {
+		list.LastDigest = time.Now()
+	}
+	room.mail = &list
+	if err := h.saveRoomsLocked(); err != nil {
+		log.Printf("Error persisting rooms: %v", err)
+	}
+	return list
+}
+
+// ######################################################################
+// function: RemoveMailList()
+// ######################################################################
+func (h *Hub) RemoveMailList(name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if room, ok := h.rooms[name]; ok {
+		room.mail = nil
+		if err := h.saveRoomsLocked(); err != nil {
+			log.Printf("Error persisting rooms: %v", err)
+		}
+	}
+}
+
+// ######################################################################
+// function: Insights()
+// ######################################################################
+func (h *Hub) Insights(name string, since time.Time, top int) (Insights, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	room, ok := h.rooms[name]
+	if !ok {
+		return Insights{}, false
+	}
+	return room.insightsLocked(since, top), true
+}
+
+// ######################################################################
+// function: WriteMetrics()
+// ######################################################################
+// Prometheus text format.
+func (h *Hub) WriteMetrics(w io.Writer) {
+	h.writeAckMetrics(w)
+	h.writeStorageMetrics(w)
+	h.writeBackpressureMetrics(w)
+}
@@ -0,0 +1,115 @@
+package hub
+
+import (
+	"crypto/sha256"
+	"errors"
+	"time"
+)
+
+var (
+	errDuplicate       = errors.New("duplicate message")
+	errClientIDTooLong = errors.New("client_id is too long")
+)
+
+// How long client IDs are remembered, a resend comes with the reconnect
+const clientIDWindow = 10 * time.Minute
+
+const maxClientID = 64
+
+type postKey struct {
+	room string
+	hash [sha256.Size]byte
+}
+
+// ######################################################################
+// function: isDuplicate()
+// ######################################################################
+// True if the chatter already posted exactly this text in the room within
+// cfg.DuplicateWindow. Otherwise the post is remembered. Only the chatter's
+// own goroutine posts for it, so no locking.
+func (h *Hub) isDuplicate(chatter *Chatter, room, text string) bool {
+	window := h.cfg.DuplicateWindow
+	if window <= 0 {
+		return false
+	}
+	now := time.Now()
+	for key, at := range chatter.recentPosts {
+		if now.Sub(at) >= window {
+			delete(chatter.recentPosts, key)
+		}
+	}
+	key := postKey{room, sha256.Sum256([]byte(text))}
+	if _, ok := chatter.recentPosts[key]; ok {
+		return true
+	}
+	if chatter.recentPosts == nil {
+		chatter.recentPosts = make(map[postKey]time.Time)
+	}
+	chatter.recentPosts[key] = now
+	return false
+}
+
+// Client IDs are the client's to pick, so they are kept apart per account
+// (or per session for guests)
+type clientIDKey struct {
+	owner string
+	id    string
+}
+
+type postedAs struct {
+	id   int64
+	room string
+}
+
+type clientIDSeen struct {
+	key clientIDKey
+	at  time.Time
+}
+
+// ######################################################################
+// function: clientIDOwner()
+// ######################################################################
+// Whose client IDs the chatter's are: the account's, which keeps them
+// across devices and sessions, or else the session's, which a reconnect
+// resumes.
+func (h *Hub) clientIDOwner(chatter *Chatter) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return chatter.ownerLocked()
+}
+
+// Caller holds the mutex.
+func (chatter *Chatter) ownerLocked() string {
+	if chatter.account != "" {
+		return "account:" + chatter.account
+	}
+	return "session:" + chatter.SID
+}
+
+// ######################################################################
+// function: postedClientID()
+// ######################################################################
+// Where the message with this client ID went, if it was posted already.
+func (h *Hub) postedClientID(owner, id string) (postedAs, bool) {
+	h.clientIDsMu.Lock()
+	defer h.clientIDsMu.Unlock()
+	posted, ok := h.clientIDs[clientIDKey{owner, id}]
+	return posted, ok
+}
+
+// ######################################################################
+// function: rememberClientID()
+// ######################################################################
+// Keeps the server ID a client ID got for clientIDWindow.
+func (h *Hub) rememberClientID(owner, id string, posted postedAs) {
+	h.clientIDsMu.Lock()
+	defer h.clientIDsMu.Unlock()
+	now := time.Now()
+	for len(h.clientIDOrder) > 0 && now.Sub(h.clientIDOrder[0].at) >= clientIDWindow {
+		delete(h.clientIDs, h.clientIDOrder[0].key)
+		h.clientIDOrder = h.clientIDOrder[1:]
+	}
+	key := clientIDKey{owner, id}
+	h.clientIDs[key] = posted
+	h.clientIDOrder = append(h.clientIDOrder, clientIDSeen{key, now})
+}
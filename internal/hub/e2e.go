@@ -0,0 +1,42 @@
+package hub
+
+import (
+	"time"
+
+	"go-chat-app/internal/protocol"
+)
+
+// Biggest encrypted payload relayed, a long message or a bundle of keys
+const maxPayload = 16 << 10
+
+// ######################################################################
+// function: relayEncrypted()
+// ######################################################################
+// Passes an end to end encrypted private message or key exchange on to
+// its recipient. The payload is ciphertext, so there is nothing for the
+// word filter or spam checks to look at, and it is never recorded or
+// emitted anywhere a plaintext message would be. Offline accounts get it
+// queued like any private message, shadow banned senders' go nowhere.
+func (h *Hub) relayEncrypted(from *Chatter, cf protocol.ClientFrame) {
+	if cf.To == "" || cf.Payload == "" {
+		from.SendError(protocol.CodeInvalid, "Encrypted messages need a recipient and a payload.")
+		return
+	}
+	if len(cf.Payload) > maxPayload {
+		from.SendError(protocol.CodeTooLarge, "That payload is too big.")
+		return
+	}
+	f := protocol.Frame{Type: protocol.FrameKeyExchange, From: from.Username, To: cf.To, Payload: cf.Payload}
+	if cf.Type == protocol.ClientEncrypted {
+		f.Type, f.ID, f.SentAt = protocol.FrameEncrypted, h.nextMessageID(), time.Now()
+	}
+	if h.shadowBanned(from) {
+		if f.Type == protocol.FrameEncrypted {
+			from.Send(f) // looks delivered, like sendDirect
+		}
+		return
+	}
+	if h.deliverDirect(from, cf.To, f) && f.Type == protocol.FrameEncrypted {
+		from.Send(f) // the sender's copy, as confirmation
+	}
+}
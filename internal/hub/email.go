@@ -0,0 +1,256 @@
+package hub
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Email addresses of accounts are checked by mailing a link, and a
+// checked address can get a password reset link. The tokens in those links
+// live in memory like login tokens, a restart means asking for a new one.
+
+const (
+	verifyTokenTTL = 24 * time.Hour
+	resetTokenTTL  = time.Hour
+	maxEmail       = 254
+)
+
+var (
+	ErrBadEmail   = errors.New("that is not an email address")
+	ErrNoMailer   = errors.New("this server has no way to send mail")
+	ErrMailToken  = errors.New("that link is invalid or has expired")
+	errNoPassword = errors.New("account has no password to reset")
+)
+
+type mailToken struct {
+	account string
+	email   string // the address it went to, a verification is for that one only
+	reset   bool   // password reset, not an address check
+	expires time.Time
+}
+
+// ######################################################################
+// function: parseEmail()
+// ######################################################################
+// A bare address, "kari@example.com", not "Kari <kari@example.com>".
+func parseEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email || addr.Name != "" || len(email) > maxEmail {
+		return "", ErrBadEmail
+	}
+	return email, nil
+}
+
+// ######################################################################
+// function: SetEmail()
+// ######################################################################
+// Gives the account a new, unchecked address and mails it a link to check
+// it with. Password resets only go to checked addresses.
+func (h *Hub) SetEmail(id, email string) error {
+	email, err := parseEmail(email)
+	if err != nil {
+		return err
+	}
+	if h.mailer() == nil {
+		return ErrNoMailer
+	}
+	h.accountsMu.Lock()
+	a, ok := h.accounts[id]
+	if !ok {
+		h.accountsMu.Unlock()
+		return ErrNoAccount
+	}
+	a.Email, a.EmailVerified = email, false
+	h.saveAccountsLocked()
+	token := h.issueMailTokenLocked(mailToken{account: id, email: email, expires: time.Now().Add(verifyTokenTTL)})
+	name := a.Name
+	h.accountsMu.Unlock()
+
+	return h.sendAccountMail(email, "Check your email address",
+		fmt.Sprintf("Hi %s,\r\n\r\nto confirm this is your address, open\r\n\r\n%s\r\n\r\n"+
+			"The link works for %s. If you didn't ask for this, ignore this mail.\r\n",
+			name, h.mailLink("/api/email/verify", token), verifyTokenTTL))
+}
+
+// ######################################################################
+// function: VerifyEmail()
+// ######################################################################
+func (h *Hub) VerifyEmail(token string) (Account, error) {
+	h.accountsMu.Lock()
+	defer h.accountsMu.Unlock()
+	mt, ok := h.takeMailTokenLocked(token, false)
+	if !ok {
+		return Account{}, ErrMailToken
+	}
+	a, ok := h.accounts[mt.account]
+	if !ok || a.Email != mt.email {
+		return Account{}, ErrMailToken // gone, or the address changed since
+	}
+	a.EmailVerified = true
+	h.saveAccountsLocked()
+	return a.public(), nil
+}
+
+// ######################################################################
+// function: RequestPasswordReset()
+// ######################################################################
+// Mails a reset link to the account with login as its username or
+// checked address, if it has a password and a checked address. Whether
+// there is such an account isn't told, so this can't be used to find out.
+func (h *Hub) RequestPasswordReset(login string) error {
+	m := h.mailer()
+	if m == nil {
+		return ErrNoMailer
+	}
+	login = strings.TrimSpace(login)
+	h.accountsMu.Lock()
+	var found *Account
+	for _, a := range h.accounts {
+		if a.EmailVerified && hasPassword(a) && (a.Name == login || strings.EqualFold(a.Email, login)) {
+			found = a
+			break
+		}
+	}
+	if found == nil {
+		h.accountsMu.Unlock()
+		return nil
+	}
+	token := h.issueMailTokenLocked(mailToken{account: found.ID, email: found.Email, reset: true, expires: time.Now().Add(resetTokenTTL)})
+	name, email := found.Name, found.Email
+	h.accountsMu.Unlock()
+
+	err := h.sendAccountMail(email, "Reset your password",
+		fmt.Sprintf("Hi %s,\r\n\r\nto pick a new password, open\r\n\r\n%s\r\n\r\n"+
+			"The link works for %s. If you didn't ask for this, ignore this mail, your password stays as it is.\r\n",
+			name, h.mailLink("/api/password/reset", token), resetTokenTTL))
+	if err != nil {
+		log.Printf("Error mailing password reset for %s: %v", name, err)
+	}
+	return nil
+}
+
+// ######################################################################
+// function: ResetPassword()
+// ######################################################################
+// Sets the password of the token's account. Every login of the account
+// is signed out, and a new one is returned.
+func (h *Hub) ResetPassword(token, password string) (Account, string, error) {
+	if len(password) < minPassword || len(password) > maxPassword {
+		return Account{}, "", ErrBadPassword
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return Account{}, "", err
+	}
+
+	h.accountsMu.Lock()
+	defer h.accountsMu.Unlock()
+	mt, ok := h.takeMailTokenLocked(token, true)
+	if !ok {
+		return Account{}, "", ErrMailToken
+	}
+	a, ok := h.accounts[mt.account]
+	if !ok || a.Email != mt.email {
+		return Account{}, "", ErrMailToken
+	}
+	changed := false
+	for i := range a.Identities {
+		if a.Identities[i].Provider == ProviderPassword {
+			a.Identities[i].Secret = string(hash)
+			changed = true
+		}
+	}
+	if !changed {
+		return Account{}, "", errNoPassword
+	}
+	h.saveAccountsLocked()
+	for t, lt := range h.logins {
+		if lt.account == a.ID {
+			delete(h.logins, t)
+		}
+	}
+	for t, other := range h.mailTokens {
+		if other.account == a.ID && other.reset {
+			delete(h.mailTokens, t)
+		}
+	}
+	h.Audit(AuditEntry{Actor: a.Name, Action: "password_reset", Target: a.Name})
+	return a.public(), h.issueLoginLocked(a.ID), nil
+}
+
+func hasPassword(a *Account) bool {
+	for _, ident := range a.Identities {
+		if ident.Provider == ProviderPassword {
+			return true
+		}
+	}
+	return false
+}
+
+// Caller holds accountsMu.
+func (h *Hub) issueMailTokenLocked(mt mailToken) string {
+	now := time.Now()
+	for token, old := range h.mailTokens {
+		if now.After(old.expires) {
+			delete(h.mailTokens, token)
+		}
+	}
+	token := randomToken(16)
+	h.mailTokens[token] = mt
+	return token
+}
+
+// One use only. Caller holds accountsMu.
+func (h *Hub) takeMailTokenLocked(token string, reset bool) (mailToken, bool) {
+	mt, ok := h.mailTokens[token]
+	if !ok || mt.reset != reset {
+		return mailToken{}, false
+	}
+	delete(h.mailTokens, token)
+	return mt, time.Now().Before(mt.expires)
+}
+
+// ######################################################################
+// function: mailLink()
+// ######################################################################
+// Link to path with the token, or just the token without cfg.PublicURL.
+func (h *Hub) mailLink(path, token string) string {
+	if h.cfg.PublicURL == "" {
+		return "code " + token
+	}
+	return strings.TrimSuffix(h.cfg.PublicURL, "/") + path + "?token=" + url.QueryEscape(token)
+}
+
+// ######################################################################
+// function: sendAccountMail()
+// ######################################################################
+func (h *Hub) sendAccountMail(to, subject, body string) error {
+	m := h.mailer()
+	if m == nil {
+		return ErrNoMailer
+	}
+	from := h.cfg.MailFrom
+	if from == "" {
+		host := "localhost"
+		if u, err := url.Parse(h.cfg.PublicURL); err == nil && u.Hostname() != "" {
+			host = u.Hostname()
+		}
+		from = "noreply@" + host
+	}
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(body)
+	return m.Send(from, []string{to}, []byte(msg.String()))
+}
@@ -0,0 +1,178 @@
+package hub
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"time"
+
+	"go-chat-app/internal/protocol"
+)
+
+// Custom emoji are uploaded by admins and served at /emoji/<name>. A chat
+// line keeps its :shortcodes: as typed, the message frame lists the custom
+// emoji in it so clients know which ones to show as images. Everyone gets
+// the whole catalog on connect and again when it changes.
+
+const (
+	emojiFile     = "emoji.json"
+	maxEmojiImage = 128 << 10
+	maxEmoji      = 500
+)
+
+var (
+	emojiName      = regexp.MustCompile(`^[a-z0-9_+-]{2,32}$`)
+	emojiShortcode = regexp.MustCompile(`:([a-z0-9_+-]{2,32}):`)
+
+	// what browsers show in an <img>, SVG isn't since it can carry scripts
+	emojiTypes = map[string]bool{"image/png": true, "image/gif": true, "image/webp": true, "image/jpeg": true}
+
+	errEmojiName  = errors.New("emoji names are 2 to 32 of a-z, 0-9, _, + and -")
+	errEmojiImage = fmt.Errorf("emoji are PNG, GIF, WebP or JPEG images of at most %d KB", maxEmojiImage>>10)
+	errEmojiFull  = fmt.Errorf("there can be %d custom emoji", maxEmoji)
+)
+
+// ######################################################################
+// struct: CustomEmoji
+// ######################################################################
+type CustomEmoji struct {
+	Name        string    `json:"name"`
+	ContentType string    `json:"content_type"`
+	Image       []byte    `json:"image"`
+	Hash        string    `json:"hash"` // of the image, the URL changes with it
+	Added       time.Time `json:"added"`
+}
+
+// Where clients fetch the image, versioned so caches pick up a new one
+func (e CustomEmoji) ref() protocol.Emoji {
+	return protocol.Emoji{Name: e.Name, URL: "/emoji/" + e.Name + "?v=" + e.Hash}
+}
+
+// ######################################################################
+// function: AddEmoji()
+// ######################################################################
+// Adds emoji name, or replaces its image.
+func (h *Hub) AddEmoji(name string, image []byte) (protocol.Emoji, error) {
+	if !emojiName.MatchString(name) {
+		return protocol.Emoji{}, errEmojiName
+	}
+	contentType := http.DetectContentType(image)
+	if len(image) == 0 || len(image) > maxEmojiImage || !emojiTypes[contentType] {
+		return protocol.Emoji{}, errEmojiImage
+	}
+	sum := sha256.Sum256(image)
+	e := CustomEmoji{Name: name, ContentType: contentType, Image: image, Hash: hex.EncodeToString(sum[:6]), Added: time.Now()}
+
+	h.emojiMu.Lock()
+	if _, ok := h.emoji[name]; !ok && len(h.emoji) >= maxEmoji {
+		h.emojiMu.Unlock()
+		return protocol.Emoji{}, errEmojiFull
+	}
+	h.emoji[name] = e
+	h.saveEmojiLocked()
+	h.emojiMu.Unlock()
+
+	h.broadcast(protocol.Frame{Type: protocol.FrameEmoji, Emoji: h.EmojiCatalog()}, nil)
+	return e.ref(), nil
+}
+
+// ######################################################################
+// function: RemoveEmoji()
+// ######################################################################
+func (h *Hub) RemoveEmoji(name string) bool {
+	h.emojiMu.Lock()
+	_, ok := h.emoji[name]
+	if ok {
+		delete(h.emoji, name)
+		h.saveEmojiLocked()
+	}
+	h.emojiMu.Unlock()
+	if ok {
+		h.broadcast(protocol.Frame{Type: protocol.FrameEmoji, Emoji: h.EmojiCatalog()}, nil)
+	}
+	return ok
+}
+
+// ######################################################################
+// function: EmojiCatalog()
+// ######################################################################
+// Every custom emoji by name.
+func (h *Hub) EmojiCatalog() []protocol.Emoji {
+	h.emojiMu.Lock()
+	catalog := make([]protocol.Emoji, 0, len(h.emoji))
+	for _, e := range h.emoji {
+		catalog = append(catalog, e.ref())
+	}
+	h.emojiMu.Unlock()
+	sort.Slice(catalog, func(i, j int) bool { return catalog[i].Name < catalog[j].Name })
+	return catalog
+}
+
+// ######################################################################
+// function: Emoji()
+// ######################################################################
+// The emoji with its image, for serving it.
+func (h *Hub) Emoji(name string) (CustomEmoji, bool) {
+	h.emojiMu.Lock()
+	defer h.emojiMu.Unlock()
+	e, ok := h.emoji[name]
+	return e, ok
+}
+
+// ######################################################################
+// function: emojiIn()
+// ######################################################################
+// The custom emoji text uses, each once, in the order they first appear.
+func (h *Hub) emojiIn(text string) []protocol.Emoji {
+	matches := emojiShortcode.FindAllStringSubmatch(text, -1)
+	if len(matches) == 0 {
+		return nil
+	}
+	h.emojiMu.Lock()
+	defer h.emojiMu.Unlock()
+	var used []protocol.Emoji
+	seen := make(map[string]bool)
+	for _, m := range matches {
+		if e, ok := h.emoji[m[1]]; ok && !seen[m[1]] {
+			seen[m[1]] = true
+			used = append(used, e.ref())
+		}
+	}
+	return used
+}
+
+// ######################################################################
+// function: sendEmoji()
+// ######################################################################
+// The catalog, on connect. Nothing when there are no custom emoji.
+func (h *Hub) sendEmoji(chatter *Chatter) {
+	if catalog := h.EmojiCatalog(); len(catalog) > 0 {
+		chatter.Send(protocol.Frame{Type: protocol.FrameEmoji, Emoji: catalog})
+	}
+}
+
+// ######################################################################
+// function: loadEmoji()
+// ######################################################################
+func (h *Hub) loadEmoji() {
+	h.emojiMu.Lock()
+	defer h.emojiMu.Unlock()
+	if err := h.loadJSON(emojiFile, &h.emoji); err != nil {
+		log.Printf("Error loading custom emoji: %v", err)
+	}
+	if h.emoji == nil {
+		h.emoji = make(map[string]CustomEmoji)
+	}
+}
+
+// Caller holds emojiMu.
+func (h *Hub) saveEmojiLocked() {
+	if err := h.saveJSON(emojiFile, h.emoji); err != nil {
+		log.Printf("Error persisting custom emoji: %v", err)
+	}
+}
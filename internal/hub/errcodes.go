@@ -0,0 +1,73 @@
+package hub
+
+import (
+	"errors"
+
+	"go-chat-app/internal/protocol"
+)
+
+// Error frame codes for the hub's errors, anything not listed is
+// protocol.CodeInvalid
+var errorCodes = map[error]int{
+	errWrongPassword: protocol.CodeNotPermitted,
+	errInviteOnly:    protocol.CodeNotPermitted,
+	errReactionsOff:  protocol.CodeNotPermitted,
+	errNotGranted:    protocol.CodeNotPermitted,
+	errBotNoPatterns: protocol.CodeNotPermitted,
+	errNotInCall:     protocol.CodeNotPermitted,
+	errCallRoom:      protocol.CodeNotPermitted,
+	errPollNotYours:  protocol.CodeNotPermitted,
+	errShadowNotHere: protocol.CodeNotPermitted,
+	errShadowNotOurs: protocol.CodeNotPermitted,
+
+	errDuplicate: protocol.CodeRateLimited,
+
+	errNameOwned:    protocol.CodeNameTaken,
+	ErrGuestName:    protocol.CodeNameTaken,
+	ErrReserved:     protocol.CodeNameTaken,
+	ErrNameTaken:    protocol.CodeNameTaken,
+	errCommandTaken: protocol.CodeNameTaken,
+
+	ErrNoRoom: protocol.CodeRoomNotFound,
+
+	errCallNobody:   protocol.CodeUserNotFound,
+	errCallOffline:  protocol.CodeUserNotFound,
+	errShadowNobody: protocol.CodeUserNotFound,
+	errNoShadowBan:  protocol.CodeUserNotFound,
+
+	ErrNotFound:   protocol.CodeMessageNotFound,
+	errNoParent:   protocol.CodeMessageNotFound,
+	errNoQuote:    protocol.CodeMessageNotFound,
+	errReadMarkID: protocol.CodeMessageNotFound,
+	errNoPoll:     protocol.CodeMessageNotFound,
+
+	errClientIDTooLong: protocol.CodeTooLarge,
+	errStatusLength:    protocol.CodeTooLarge,
+	errBannerLong:      protocol.CodeTooLarge,
+	errCallPayload:     protocol.CodeTooLarge,
+
+	errTooManyPins:  protocol.CodeLimitReached,
+	errIgnoreFull:   protocol.CodeLimitReached,
+	errScheduleFull: protocol.CodeLimitReached,
+	errTooManyPolls: protocol.CodeLimitReached,
+}
+
+// ######################################################################
+// function: errorCode()
+// ######################################################################
+func errorCode(err error) int {
+	for e, code := range errorCodes {
+		if errors.Is(err, e) {
+			return code
+		}
+	}
+	return protocol.CodeInvalid
+}
+
+// ######################################################################
+// function: fail()
+// ######################################################################
+// Tells the chatter err, translated, with its code.
+func (c *Chatter) fail(err error) {
+	c.SendError(errorCode(err), err.Error())
+}
@@ -0,0 +1,125 @@
+package hub
+
+import (
+	"context"
+	"log"
+	"runtime"
+	"sync"
+
+	"go-chat-app/internal/protocol"
+)
+
+// Broadcasts to fewer recipients than this go out on the caller's goroutine,
+// handing them to workers costs more than it saves
+const fanoutMin = 64
+
+// ######################################################################
+// struct: fanout
+// ######################################################################
+// A fixed set of workers encoding and queueing broadcast frames. Each
+// broadcast splits its recipients into chunks and waits for all of them
+// before returning, and broadcasts happen under the hub mutex, so every
+// member still gets a room's frames in the order they were broadcast.
+// The workers start with the first big broadcast and stop when Run
+// returns.
+type fanout struct {
+	start   sync.Once
+	workers int
+	jobs    chan func() // bounded, a full queue means the caller does the chunk itself
+	running sync.WaitGroup
+	stopped bool // guarded by the hub mutex
+}
+
+func newFanout(workers int) *fanout {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	return &fanout{workers: workers, jobs: make(chan func(), workers)}
+}
+
+func (f *fanout) work() {
+	defer f.running.Done()
+	for job := range f.jobs {
+		job()
+	}
+}
+
+// ######################################################################
+// function: stopLocked()
+// ######################################################################
+// Lets the workers go and waits for them. Broadcasts after this go out on
+// the caller's goroutine. Caller holds the hub mutex, so no broadcast is
+// handing out jobs.
+func (f *fanout) stopLocked() {
+	if f.stopped {
+		return
+	}
+	f.stopped = true
+	close(f.jobs)
+	f.running.Wait()
+}
+
+type delivery struct {
+	chatter *Chatter
+	frame   protocol.Frame
+}
+
+// ######################################################################
+// function: deliverLocked()
+// ######################################################################
+// Sends every delivery, spread over the fan-out workers for big rooms, and
+// drops the chatters that couldn't take theirs. Caller holds the mutex.
+func (h *Hub) deliverLocked(deliveries []delivery) {
+	fanoutRecipients.Record(context.Background(), int64(len(deliveries)))
+	f := h.fanout
+	if len(deliveries) < fanoutMin || f.workers < 2 || f.stopped {
+		for _, d := range deliveries {
+			if err := d.chatter.Send(d.frame); err != nil {
+				log.Printf("Error: %v", err)
+				h.dropChatterLocked(d.chatter)
+			}
+		}
+		return
+	}
+	f.start.Do(func() {
+		f.running.Add(f.workers)
+		for i := 0; i < f.workers; i++ {
+			go f.work()
+		}
+	})
+
+	var (
+		wg       sync.WaitGroup
+		failedMu sync.Mutex
+		failed   []*Chatter
+	)
+	send := func(chunk []delivery) {
+		defer wg.Done()
+		for _, d := range chunk {
+			if err := d.chatter.Send(d.frame); err != nil {
+				log.Printf("Error: %v", err)
+				failedMu.Lock()
+				failed = append(failed, d.chatter)
+				failedMu.Unlock()
+			}
+		}
+	}
+	size := (len(deliveries) + f.workers - 1) / f.workers
+	for len(deliveries) > size {
+		chunk := deliveries[:size]
+		deliveries = deliveries[size:]
+		wg.Add(1)
+		select {
+		case f.jobs <- func() { send(chunk) }:
+		default:
+			send(chunk) // every worker is busy with other broadcasts
+		}
+	}
+	wg.Add(1)
+	send(deliveries) // the last chunk is ours
+	wg.Wait()
+
+	for _, chatter := range failed {
+		h.dropChatterLocked(chatter)
+	}
+}
@@ -0,0 +1,187 @@
+package hub
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"go-chat-app/internal/client"
+	"go-chat-app/internal/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+// A connection that takes every frame at once and never sends any
+type discardConn struct {
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newDiscardConn() *discardConn { return &discardConn{closed: make(chan struct{})} }
+
+func (c *discardConn) ReadMessage() (int, []byte, error) {
+	<-c.closed
+	return 0, nil, websocket.ErrCloseSent
+}
+func (c *discardConn) WriteMessage(int, []byte) error   { return nil }
+func (c *discardConn) SetWriteDeadline(time.Time) error { return nil }
+func (c *discardConn) EnableWriteCompression(bool)      {}
+func (c *discardConn) SetCompressionLevel(int) error    { return nil }
+func (c *discardConn) Subprotocol() string              { return protocol.SubprotocolV2 }
+func (c *discardConn) Close() error                     { c.closeOnce.Do(func() { close(c.closed) }); return nil }
+
+// benchRoom fills a room with members that have their own language, so
+// every delivery translates and encodes a frame of its own
+func benchRoom(b *testing.B, workers, members int) (*Hub, *Room) {
+	h := New(Config{DataDir: b.TempDir(), FanoutWorkers: workers})
+	h.mu.Lock()
+	room, _ := h.getRoom("bench")
+	for i := 0; i < members; i++ {
+		locale := "en"
+		if i%2 == 1 {
+			locale = "no"
+		}
+		c := client.New(newDiscardConn(), "127.0.0.1", "bench", "", locale)
+		c.SetBackpressure(1<<20, client.DropOldest) // measure the fan-out, not the buffer
+		chatter := &Chatter{Client: c, presence: presenceOnline, id: h.lastConnID.Add(1), room: room}
+		h.chatters.add(chatter)
+		room.members[chatter] = true
+	}
+	h.mu.Unlock()
+	b.Cleanup(func() {
+		for chatter := range room.members {
+			chatter.Kill()
+		}
+	})
+	return h, room
+}
+
+func BenchmarkBroadcastRoom(b *testing.B) {
+	for _, members := range []int{100, 1000, 10000} {
+		for _, workers := range []int{1, 0} {
+			name := fmt.Sprintf("members=%d/sequential", members)
+			if workers == 0 {
+				name = fmt.Sprintf("members=%d/pool", members)
+			}
+			b.Run(name, func(b *testing.B) {
+				h, room := benchRoom(b, workers, members)
+				frame := protocol.Systemf(room.name, "%s joined #%s.", "someone", room.name)
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					h.broadcastRoom(room, frame, nil)
+				}
+			})
+		}
+	}
+}
+
+func TestBroadcastOrder(t *testing.T) {
+	h := New(Config{DataDir: t.TempDir(), FanoutWorkers: 4})
+	h.mu.Lock()
+	room, _ := h.getRoom("order")
+	conns := make([]*recordConn, fanoutMin*4)
+	for i := range conns {
+		conns[i] = &recordConn{discardConn: newDiscardConn()}
+		chatter := &Chatter{Client: client.New(conns[i], "127.0.0.1", "test", "", "en"), id: h.lastConnID.Add(1), room: room}
+		h.chatters.add(chatter)
+		room.members[chatter] = true
+	}
+	h.mu.Unlock()
+
+	// broadcasts from several goroutines at once
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				h.broadcastRoom(room, protocol.Frame{Type: protocol.FrameSystem, Room: room.name, Text: fmt.Sprintf("%d-%d", g, i)}, nil)
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	// every member saw all 200, in one and the same order
+	deadline := time.Now().Add(3 * time.Second)
+	want := conns[0].wait(t, 200, deadline)
+	for _, conn := range conns[1:] {
+		got := conn.wait(t, 200, deadline)
+		for i := range want {
+			if got[i] != want[i] {
+				t.Fatalf("frame %d: got %s, another member got %s", i, got[i], want[i])
+			}
+		}
+	}
+}
+
+// A discardConn remembering what was written
+type recordConn struct {
+	*discardConn
+	mu     sync.Mutex
+	frames []string
+}
+
+func (c *recordConn) WriteMessage(_ int, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.frames = append(c.frames, string(data))
+	return nil
+}
+
+func (c *recordConn) wait(t *testing.T, n int, deadline time.Time) []string {
+	t.Helper()
+	for {
+		c.mu.Lock()
+		frames := c.frames
+		c.mu.Unlock()
+		if len(frames) >= n {
+			return frames
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d of %d frames", len(frames), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFanoutStops(t *testing.T) {
+	h := New(Config{DataDir: t.TempDir(), FanoutWorkers: 4, SnapshotInterval: time.Minute, UserCountInterval: time.Second, HeartbeatTimeout: time.Minute})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		h.Run(ctx)
+		close(done)
+	}()
+
+	h.mu.Lock()
+	room, _ := h.getRoom("big")
+	for i := 0; i < fanoutMin*2; i++ {
+		chatter := &Chatter{Client: client.New(newDiscardConn(), "127.0.0.1", "test", "", "en"), id: h.lastConnID.Add(1), room: room}
+		h.chatters.add(chatter)
+		room.members[chatter] = true
+	}
+	h.mu.Unlock()
+	h.broadcastRoom(room, protocol.Frame{Type: protocol.FrameSystem, Room: room.name, Text: "workers up"}, nil)
+
+	// Run only returns once the workers are gone
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Run never returned")
+	}
+	select {
+	case _, open := <-h.fanout.jobs:
+		if open {
+			t.Error("a job was left in the queue")
+		}
+	default:
+		t.Error("the workers' queue is still open")
+	}
+	// and broadcasts still work, without them
+	if n := h.broadcastRoom(room, protocol.Frame{Type: protocol.FrameSystem, Room: room.name, Text: "after"}, nil); n != fanoutMin*2 {
+		t.Errorf("broadcast to %d after shutdown", n)
+	}
+}
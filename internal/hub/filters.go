@@ -0,0 +1,145 @@
+package hub
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Every chat line goes through a chain of message filters before it's
+// sent: the banned words, the link lists, spam, then whatever cfg.Filters adds,
+// for rules of your own without touching the hub. A filter can change the
+// text for the ones after it, drop the message, or drop it and strike the
+// sender. The first one to drop it ends the chain.
+//
+// Lines from bridges and incoming webhooks go through the chain too, with
+// nobody to strike: anything a filter drops comes back as errHookBlocked.
+
+// ######################################################################
+// struct: Message
+// ######################################################################
+// A chat line being filtered, and where it comes from.
+type Message struct {
+	From    string // username, or the name a bridge or webhook posts as
+	Account string // account id, "" for guests and external posts
+	Room    string
+	IP      string // "" for external posts
+	Text    string // filters may change it
+
+	chatter *Chatter // nil for external posts
+}
+
+// ######################################################################
+// struct: Verdict
+// ######################################################################
+// What a filter decided. The zero Verdict lets the message through.
+type Verdict struct {
+	Reject bool   // drop the message
+	Rule   string // strike the sender for breaking this rule, drops it too
+	Notice string // system message to the sender, to say what happened
+}
+
+// ######################################################################
+// interface: MessageFilter
+// ######################################################################
+// Filters are called from every connection's read loop at once, so they
+// have to be safe for concurrent use.
+type MessageFilter interface {
+	Filter(m *Message) Verdict
+}
+
+// FilterFunc lets a plain function be a MessageFilter
+type FilterFunc func(m *Message) Verdict
+
+func (f FilterFunc) Filter(m *Message) Verdict { return f(m) }
+
+// ######################################################################
+// function: filterMessage()
+// ######################################################################
+// Runs m through the chain. Notices go to the chatter if there is one.
+func (h *Hub) filterMessage(chatter *Chatter, m *Message) Verdict {
+	for _, f := range h.filters {
+		v := f.Filter(m)
+		if v.Notice != "" && chatter != nil {
+			chatter.SendSystem("%s", v.Notice)
+		}
+		if v.Reject || v.Rule != "" {
+			return v
+		}
+	}
+	return Verdict{}
+}
+
+// ######################################################################
+// function: filterChat()
+// ######################################################################
+// filterMessage for a chatter's own line. Returns the text to send, ok
+// false if it was dropped and struck true if the chatter got struck out
+// over it.
+func (h *Hub) filterChat(chatter *Chatter, text string) (out string, ok, struck bool) {
+	m := Message{From: chatter.Username, IP: chatter.IP, Text: text, chatter: chatter}
+	h.mu.Lock()
+	m.Account = chatter.account
+	if chatter.room != nil {
+		m.Room = chatter.room.name
+	}
+	h.mu.Unlock()
+	v := h.filterMessage(chatter, &m)
+	if v.Rule != "" {
+		return "", false, h.strike(chatter, v.Rule)
+	}
+	return m.Text, !v.Reject, false
+}
+
+// ######################################################################
+// function: filterExternal()
+// ######################################################################
+// filterMessage for bridges and webhooks, which can't be struck.
+func (h *Hub) filterExternal(room, from, text string) (string, error) {
+	m := Message{From: from, Room: room, Text: text}
+	if v := h.filterMessage(nil, &m); v.Reject || v.Rule != "" {
+		return "", errHookBlocked
+	}
+	return m.Text, nil
+}
+
+// ######################################################################
+// type: wordFilter
+// ######################################################################
+// Strikes for the words in cfg.WordList, whole words only.
+type wordFilter struct{ h *Hub }
+
+func (f wordFilter) Filter(m *Message) Verdict {
+	f.h.mu.Lock()
+	banned := f.h.bannedWords // replaced, never changed, on reload
+	f.h.mu.Unlock()
+	if len(banned) == 0 {
+		return Verdict{}
+	}
+	words := strings.FieldsFunc(strings.ToLower(m.Text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, word := range words {
+		if banned[word] {
+			return Verdict{Rule: ruleProfanity}
+		}
+	}
+	return Verdict{}
+}
+
+// ######################################################################
+// type: linkFilter
+// ######################################################################
+// Strikes for links the block- and allowlists don't allow, or takes them
+// out with cfg.StripLinks.
+type linkFilter struct{ h *Hub }
+
+func (f linkFilter) Filter(m *Message) Verdict {
+	if !f.h.hasBlockedLink(m.Text) {
+		return Verdict{}
+	}
+	if !f.h.cfg.StripLinks {
+		return Verdict{Rule: ruleLink}
+	}
+	m.Text, _ = f.h.stripLinks(m.Text)
+	return Verdict{Notice: "Links to sites that aren't allowed here were taken out of your message."}
+}
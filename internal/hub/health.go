@@ -0,0 +1,66 @@
+package hub
+
+import (
+	"context"
+	"errors"
+	"os"
+)
+
+var (
+	errNotRunning = errors.New("hub is not running")
+	errHubStuck   = errors.New("hub lock not acquired in time")
+)
+
+// ######################################################################
+// function: Alive()
+// ######################################################################
+// Fails if the hub mutex cannot be taken before ctx is done, which is what
+// a deadlocked hub looks like from the outside. Nothing short of a restart
+// fixes that, so this is the liveness check.
+func (h *Hub) Alive(ctx context.Context) error {
+	acquired := make(chan struct{})
+	go func() {
+		h.mu.Lock()
+		h.mu.Unlock()
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		return nil
+	case <-ctx.Done():
+		return errHubStuck
+	}
+}
+
+// ######################################################################
+// function: Ready()
+// ######################################################################
+// Whether the hub should be sent new connections: it is running, not
+// stuck and can write its data dir (and reach its database). One result
+// per check, nil = fine.
+func (h *Hub) Ready(ctx context.Context) map[string]error {
+	hubErr := errNotRunning
+	if h.running.Load() {
+		hubErr = h.Alive(ctx)
+	}
+	checks := map[string]error{"hub": hubErr, "storage": h.checkDataDir()}
+	if db, ok := h.cfg.Store.(interface{ Ping(context.Context) error }); ok {
+		checks["database"] = db.Ping(ctx)
+	}
+	return checks
+}
+
+// ######################################################################
+// function: checkDataDir()
+// ######################################################################
+func (h *Hub) checkDataDir() error {
+	if err := os.MkdirAll(h.cfg.DataDir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(h.cfg.DataDir, ".readyz-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
@@ -0,0 +1,321 @@
+package hub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"go-chat-app/internal/markdown"
+	"go-chat-app/internal/protocol"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const maxTTL = time.Hour
+
+// Quoted text is cut to this many runes, the quote is a reminder of what
+// was said and not a second copy of it
+const maxQuoteText = 300
+
+// Room history in the store, as it shows in the storage metrics
+const messagesDoc = "messages"
+
+var (
+	errNoParent = errors.New("the message you are replying to does not exist")
+	errNoQuote  = errors.New("the message you are quoting is not in this room's history")
+	errTTL      = fmt.Errorf("self-destruct time must be between 1s and %s", maxTTL)
+)
+
+// ######################################################################
+// struct: Post
+// ######################################################################
+// A chat line a client wants to send, with its options.
+type Post struct {
+	Text     string
+	ReplyTo  int64         // parent message ID for threaded replies, 0 = top level
+	Quote    int64         // message in the room to quote, 0 = none
+	TTL      time.Duration // self-destruct after this, 0 = keep
+	ClientID string        // the client's own ID for it, acked and deduplicated, "" = none
+}
+
+// ######################################################################
+// function: postMessage()
+// ######################################################################
+// Runs a chat line through moderation, duplicate and slow mode checks, then
+// broadcasts it to the chatter's room. Returns true if the chatter got
+// struck out.
+func (h *Hub) postMessage(chatter *Chatter, p Post) bool {
+	received := time.Now()
+	ctx, span := tracer.Start(context.Background(), "chat.message", trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+	text, replyTo := p.Text, p.ReplyTo
+	var owner string
+	if p.ClientID != "" {
+		if len(p.ClientID) > maxClientID {
+			chatter.fail(errClientIDTooLong)
+			return false
+		}
+		// a resend of something that made it, the client only missed the ack
+		owner = h.clientIDOwner(chatter)
+		if posted, ok := h.postedClientID(owner, p.ClientID); ok {
+			chatter.Send(protocol.Frame{Type: protocol.FrameAck, ID: posted.id, Room: posted.room, ClientID: p.ClientID})
+			return false
+		}
+	}
+	if p.TTL != 0 && (p.TTL < time.Second || p.TTL > maxTTL) {
+		chatter.fail(errTTL)
+		return false
+	}
+	text, ok, struck := h.filterChat(chatter, text)
+	if !ok {
+		return struck
+	}
+	room := chatter.room
+	if h.isDuplicate(chatter, room.name, text) {
+		chatter.fail(errDuplicate)
+		return false
+	}
+	if wait := h.slowModeWait(chatter); wait > 0 {
+		chatter.Send(protocol.Frame{
+			Type:   protocol.FrameSlowMode,
+			Room:   room.name,
+			WaitMs: wait.Milliseconds(),
+			Format: "Slow mode is on, wait %ds before your next message.",
+			Args:   []any{int(wait.Seconds() + 0.5)},
+		})
+		return false
+	}
+
+	shadow := h.shadowBannedIn(chatter, room.name)
+	color := h.colorOf(chatter)
+	link, preview, fetchPreview := h.linkPreview(room, text)
+
+	h.mu.Lock()
+	if replyTo != 0 {
+		if _, ok := room.findLocked(replyTo); !ok {
+			h.mu.Unlock()
+			chatter.fail(errNoParent)
+			return false
+		}
+	}
+	var quote *protocol.Quote
+	if p.Quote != 0 {
+		quoted, ok := room.findLocked(p.Quote)
+		if !ok {
+			h.mu.Unlock()
+			chatter.fail(errNoQuote)
+			return false
+		}
+		quote = quoteOf(quoted)
+	}
+	// ID only once the message is going out, so IDs stay dense
+	f := protocol.Frame{Type: protocol.FrameMessage, ID: h.nextMessageID(), Room: room.name, From: chatter.Username, Color: color, Text: text, HTML: markdown.Render(text), ReplyTo: replyTo, SentAt: time.Now(), Preview: preview, Quote: quote, Emoji: h.emojiIn(text)}
+	if p.TTL == 0 && !shadow {
+		room.recordLocked(f, h.cfg.HistorySize) // ephemeral messages never hit history
+	}
+	h.mu.Unlock()
+	if shadow {
+		f.TTLMs = p.TTL.Milliseconds()
+		h.echoShadow(chatter, f)
+		if p.ClientID != "" {
+			h.rememberClientID(owner, p.ClientID, postedAs{f.ID, room.name})
+			chatter.Send(protocol.Frame{Type: protocol.FrameAck, ID: f.ID, Room: room.name, ClientID: p.ClientID})
+		}
+		return false
+	}
+	span.SetAttributes(attribute.String("chat.room", room.name), attribute.Int64("chat.message_id", f.ID))
+	if p.ClientID != "" {
+		h.rememberClientID(owner, p.ClientID, postedAs{f.ID, room.name})
+	}
+
+	if p.TTL != 0 {
+		f.TTLMs = p.TTL.Milliseconds()
+		time.AfterFunc(p.TTL, func() {
+			h.broadcastRoom(room, protocol.Frame{Type: protocol.FrameDeleted, Room: room.name, ID: f.ID}, nil)
+		})
+	}
+
+	// Broadcast the message to the room (the sender gets it too, as confirmation)
+	h.mu.Lock()
+	filtered := !chatter.wantsMessageLocked(f)
+	h.mu.Unlock()
+	_, fan := tracer.Start(ctx, "chat.fanout")
+	recipients := h.broadcastRoom(room, f, nil)
+	fan.SetAttributes(attribute.Int("chat.recipients", recipients))
+	fan.End()
+	messageDuration.Record(ctx, time.Since(received).Seconds())
+	if filtered {
+		chatter.Send(f) // a subscribed bot still gets its own post back
+	}
+	if p.ClientID != "" {
+		chatter.Send(protocol.Frame{Type: protocol.FrameAck, ID: f.ID, Room: room.name, ClientID: p.ClientID})
+	}
+	h.posted.Add(1)
+	if p.TTL == 0 {
+		h.storeMessage(ctx, f) // after the broadcast, the room doesn't wait for the disk
+		if fetchPreview {
+			go h.fetchPreview(room, f.ID, link)
+		}
+		h.deliverMentions(f)
+		h.emit(Event{Type: EventMessage, Room: room.name, User: f.From, Text: f.Text, ID: f.ID, Trace: span.SpanContext()})
+	}
+	return false
+}
+
+// ######################################################################
+// function: parseWhisperTTL()
+// ######################################################################
+// "30s <text>" after /whisper-ttl -> 30s, text
+func parseWhisperTTL(args string) (time.Duration, string, bool) {
+	ttlText, text, _ := strings.Cut(args, " ")
+	ttl, err := time.ParseDuration(ttlText)
+	text = strings.TrimSpace(text)
+	if err != nil || text == "" {
+		return 0, "", false
+	}
+	return ttl, text, true
+}
+
+// ######################################################################
+// function: parseReply()
+// ######################################################################
+// "<id> <text>" after /reply -> id, text
+func parseReply(args string) (int64, string, bool) {
+	idText, text, _ := strings.Cut(args, " ")
+	id, err := strconv.ParseInt(idText, 10, 64)
+	text = strings.TrimSpace(text)
+	if err != nil || id <= 0 || text == "" {
+		return 0, "", false
+	}
+	return id, text, true
+}
+
+// ######################################################################
+// function: quoteOf()
+// ######################################################################
+// The snapshot of f that goes out with a message quoting it.
+func quoteOf(f protocol.Frame) *protocol.Quote {
+	text := f.Text
+	if runes := []rune(text); len(runes) > maxQuoteText {
+		text = string(runes[:maxQuoteText-1]) + "…"
+	}
+	q := &protocol.Quote{ID: f.ID, From: f.From, Text: text}
+	if !f.SentAt.IsZero() {
+		q.TS = f.SentAt.UnixMilli()
+	}
+	return q
+}
+
+// ######################################################################
+// function: recordLocked()
+// ######################################################################
+// Keeps the last size messages of the room. Caller holds the mutex.
+func (room *Room) recordLocked(f protocol.Frame, size int) {
+	if size <= 0 {
+		return
+	}
+	room.history = append(room.history, f)
+	if over := len(room.history) - size; over > 0 {
+		room.history = append(room.history[:0:0], room.history[over:]...)
+	}
+}
+
+// ######################################################################
+// function: findLocked()
+// ######################################################################
+// Caller holds the mutex.
+func (room *Room) findLocked(id int64) (protocol.Frame, bool) {
+	for i := len(room.history) - 1; i >= 0; i-- {
+		if room.history[i].ID == id {
+			return room.history[i], true
+		}
+	}
+	return protocol.Frame{}, false
+}
+
+// ######################################################################
+// function: threadLocked()
+// ######################################################################
+// Returns the message with the given ID followed by every reply below it,
+// replies to replies included, oldest first. Caller holds the mutex.
+func (room *Room) threadLocked(root int64) []protocol.Frame {
+	inThread := map[int64]bool{root: true}
+	var thread []protocol.Frame
+	for _, f := range room.history {
+		if f.ID == root || (f.ReplyTo != 0 && inThread[f.ReplyTo]) {
+			inThread[f.ID] = true
+			thread = append(thread, f)
+		}
+	}
+	return thread
+}
+
+// ######################################################################
+// function: recentLocked()
+// ######################################################################
+// The last limit messages, oldest first. Caller holds the mutex.
+func (room *Room) recentLocked(limit int) []protocol.Frame {
+	start := 0
+	if limit > 0 && len(room.history) > limit {
+		start = len(room.history) - limit
+	}
+	return append([]protocol.Frame(nil), room.history[start:]...)
+}
+
+// ######################################################################
+// function: storeMessage()
+// ######################################################################
+// Writes f (new, or its reactions changed) to the store's history, unless
+// no history is kept. The message is out already, so a failure is only
+// logged.
+func (h *Hub) storeMessage(ctx context.Context, f protocol.Frame) {
+	if h.cfg.HistorySize <= 0 {
+		return
+	}
+	done := h.storageOp(ctx, "save", messagesDoc)
+	err := h.cfg.Store.SaveMessage(f)
+	done(err)
+	if err != nil {
+		log.Printf("Error storing message %d: %v", f.ID, err)
+	}
+}
+
+// ######################################################################
+// function: loadHistory()
+// ######################################################################
+// Gives the lobby and the rooms from rooms.json their history back. Rooms
+// that go away when empty start over.
+func (h *Hub) loadHistory() {
+	if h.cfg.HistorySize <= 0 {
+		return
+	}
+	h.mu.Lock()
+	h.getRoom(DefaultRoom)
+	names := make([]string, 0, len(h.rooms))
+	for name := range h.rooms {
+		names = append(names, name)
+	}
+	h.mu.Unlock()
+
+	for _, name := range names {
+		done := h.storageOp(context.Background(), "load", messagesDoc)
+		history, err := h.cfg.Store.Messages(name, h.cfg.HistorySize)
+		done(err)
+		if err != nil {
+			log.Printf("Error loading the history of #%s: %v", name, err)
+			continue
+		}
+		if len(history) == 0 {
+			continue
+		}
+		h.bumpMessageID(history[len(history)-1].ID)
+		h.mu.Lock()
+		h.rooms[name].history = history
+		h.mu.Unlock()
+	}
+}
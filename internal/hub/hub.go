@@ -0,0 +1,517 @@
+// Package hub is the chat engine: connected chatters, rooms and everything
+// that happens in them.
+package hub
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go-chat-app/internal/client"
+	"go-chat-app/internal/preview"
+	"go-chat-app/internal/protocol"
+	"go-chat-app/internal/store"
+)
+
+// ######################################################################
+// struct: Config
+// ######################################################################
+type Config struct {
+	DataDir    string      // audit log, and bans and other state unless Store says otherwise
+	Store      store.Store // where state and room history are persisted, nil = JSON files in DataDir
+	AdminToken string      // unlocks /op, empty disables it
+
+	MaxConnsPerIP  int // simultaneous connections allowed per IP, 0 = unlimited
+	MaxMessageSize int // bytes in one client frame, bigger ones get an error and a strike, 0 = unlimited
+
+	SendBuffer  int    // frames queued for a slow client, 0 = client.DefaultSendBuffer
+	SlowClients string // what happens once they are queued, see client.SetBackpressure
+
+	FanoutWorkers int // goroutines delivering broadcasts to big rooms, 0 = one per CPU
+
+	WordList   string          // file with banned words, one per line
+	Filters    []MessageFilter // run on every chat line after the word list, link and spam checks
+	Spam       SpamRules       // what counts as spam, rooms can have their own
+	MaxStrikes int             // strikes before a chatter is removed
+	StrikeBan  time.Duration   // IP ban handed out on the last strike, 0 = just kick
+
+	AckSampleRate float64       // fraction of broadcast deliveries that ask for an ack
+	AckTimeout    time.Duration // unacked samples after this count as lost
+
+	SnapshotInterval time.Duration // how often volatile hub state is written to disk
+	SnapshotGrace    time.Duration // how long restored sessions wait for their client
+	ResumeWindow     time.Duration // how long a dropped client can resume its session, 0 = not at all
+	LoginTTL         time.Duration // how long a login token is good for, 0 = LoginTokenTTL
+
+	HistorySize int       // messages kept per room for replies and history queries
+	Retention   Retention // how long rooms keep messages, in history and the store, unless they say otherwise
+
+	SMTPAddr     string // outgoing mail server for room digests and account mail, host:port
+	SMTPUser     string
+	SMTPPassword string
+	Mailer       Mailer // sends the mail instead of SMTPAddr, if set
+	MailFrom     string // sender of account mail, "" = noreply@ the PublicURL host
+	PublicURL    string // where browsers reach the server, for the links in account mail
+	MailIngest   string // address for the SMTP listener taking digest replies, "" = off
+
+	MOTDFile string // message of the day, "" = built in welcome text
+
+	HeartbeatTimeout time.Duration // no app heartbeat for this long = idle
+	AutoAway         time.Duration // no chat lines or commands for this long = away, 0 = never
+
+	UserCountInterval time.Duration // user_count frames go out at most this often
+
+	DuplicateWindow time.Duration // the same text again in the same room within this is refused, 0 = allowed
+	RenameCooldown  time.Duration // time between renames of a connection, the first one is free
+
+	BandwidthCap        int64 // payload bytes per user and day, 0 = unlimited
+	BandwidthDisconnect bool  // drop users over the cap instead of throttling them
+
+	StoragePool int           // loads and saves running at once, 0 = unlimited
+	StorageSlow time.Duration // loads and saves taking this long get logged, 0 = never
+
+	Previews *preview.Fetcher // link previews on chat lines, nil = none
+
+	LinkBlocklist []string // domains links in chat lines may not point to
+	LinkAllowlist []string // if set, the only domains links may point to
+	StripLinks    bool     // take such links out instead of refusing the line with a strike
+}
+
+// ######################################################################
+// struct: Hub
+// ######################################################################
+type Hub struct {
+	cfg Config
+
+	chatters *registry // every connection, with its own locks
+
+	mu        sync.Mutex // guards rooms, everything in them and the chatters' fields
+	rooms     map[string]*Room
+	calls     map[string]*call // ongoing calls by ID, see calls.go
+	polls     map[int64]*poll  // open polls by message ID, see polls.go
+	changes   []change         // recent room changes for /api/sync, oldest first
+	changeSeq int64            // seq of the latest change, the sync cursor
+	// tells this run's sync cursors from earlier ones, the log and its seqs
+	// start over with every run
+	changeEpoch string
+	// user or room counts changed since the last user_count frame, which
+	// goes out at most every cfg.UserCountInterval so reconnect storms
+	// don't turn into n² frames
+	countsDirty atomic.Bool
+
+	running       atomic.Bool // between Run starting and shutting down, for readiness
+	lastMessageID atomic.Int64
+	lastConnID    atomic.Int64
+	lastGuest     atomic.Int64 // number of the last guest-<number> handed out
+	posted        atomic.Int64 // chat lines since start, for throughput
+
+	// frames dropped for and clients hung up on by the slow client policy,
+	// counted as the connections go, see backpressure.go
+	droppedFrames atomic.Int64
+	slowHangups   atomic.Int64
+	bannedWords   map[string]bool // guarded by mu, swapped whole by Reload
+	filters       []MessageFilter // the built in ones, then cfg.Filters
+	linkBlock     preview.Domains
+	linkAllow     preview.Domains
+	motd          string // guarded by mu
+
+	ipMu    sync.Mutex
+	ipConns map[string]int       // ip -> open connections
+	ipBans  map[string]time.Time // ip -> ban expiry
+
+	ackMu       sync.Mutex
+	pendingAcks map[ackKey]ackSample
+	delivery    map[string]*deliveryStats
+
+	restoredMu sync.Mutex
+	restored   map[string]snapshotSession // sessions waiting for their client to come back
+
+	scheduleMu sync.Mutex
+	scheduled  map[string]ScheduledMessage
+	recurring  map[string]RecurringAnnouncement
+
+	accountsMu sync.Mutex
+	accounts   map[string]*Account
+	identities map[string]string    // provider:subject -> account id
+	linkTokens map[string]linkToken // pending account links
+	logins     map[string]linkToken // login token -> account, same shape
+	mailTokens map[string]mailToken // links mailed for address checks and password resets
+
+	auditMu sync.Mutex // one writer for the audit log
+
+	exportMu sync.Mutex
+	exports  map[string]exportToken // /export links
+
+	usageMu sync.Mutex
+	usage   map[string]*Usage // bandwidth today, by user
+
+	webhooksMu sync.Mutex
+	webhooks   map[string]Webhook
+	incoming   map[string]IncomingHook // by token
+	taps       map[chan Event]bool     // event exporters, see Events
+
+	offlineMu sync.Mutex
+	offline   map[string][]protocol.Frame // account id -> DMs and mentions queued while signed out
+
+	ignoresMu sync.Mutex
+	ignores   map[string][]string // account id -> names it ignores
+
+	emojiMu sync.Mutex
+	emoji   map[string]CustomEmoji // custom emoji by name, see emoji.go
+
+	shadowMu       sync.Mutex
+	shadowBans     map[string]ShadowBan            // "account:<id>" or "ip:<address>", see shadowban.go
+	roomShadowBans map[string]map[string]ShadowBan // room -> the same, placed by its moderators
+
+	readMarksMu sync.Mutex
+	readMarks   map[string]map[string]int64 // account id -> room -> last read message ID
+
+	clientIDsMu   sync.Mutex
+	clientIDs     map[clientIDKey]postedAs // messages by the ID their client gave them, see duplicates.go
+	clientIDOrder []clientIDSeen           // oldest first, for forgetting them again
+
+	storage *storageMetrics
+	fanout  *fanout
+}
+
+// ######################################################################
+// struct: Chatter
+// ######################################################################
+// A connected client plus what the hub knows about it. Fields are guarded
+// by the hub mutex, except room, which only the chatter's own goroutine
+// changes (under the mutex), so that goroutine may read it without.
+type Chatter struct {
+	*client.Client
+
+	strikes     int
+	room        *Room
+	admin       bool                  // moderator in every room, unlocked with /op <admin token>
+	lastMessage time.Time             // for slow mode
+	recentPosts map[postKey]time.Time // for duplicate suppression, only touched by the chatter's goroutine
+	spam        spamState             // same
+
+	presence      string // see presence.go
+	lastHeartbeat time.Time
+	focused       bool
+	batterySaver  bool
+
+	subscription *subscription    // bots filtering chat lines, nil = everything
+	bot          bool             // signed in with an API key
+	grants       []string         // the bot's commands, it may only subscribe to these
+	replaced     bool             // by a newer connection, don't park the session
+	account      string           // signed in account id, "" = guest
+	ignoring     map[string]bool  // names whose messages and DMs don't reach this chatter
+	readMarks    map[string]int64 // room -> last read message ID, for guests, see readmarks.go
+
+	id        int64     // connection number, for the admin dashboard
+	connected time.Time // when the connection was upgraded
+	kicked    bool      // by an admin, don't park the session
+
+	away         bool      // /away, or auto away
+	autoAway     bool      // away because of cfg.AutoAway, ends with any activity
+	awayReason   string    // from /away <reason>
+	status       string    // from /status
+	color        string    // from /color, for guests, accounts keep theirs
+	lastActivity time.Time // last chat line or command, for auto away
+
+	lastRename    time.Time // for the rename cooldown
+	previousNames []string  // on this connection, oldest first, for moderators
+
+	// bandwidth accounting, guarded by usageMu
+	chargedSent, chargedReceived int64 // traffic already added to the user's total
+	throttled                    bool  // the user is over the daily cap
+}
+
+// ######################################################################
+// function: New()
+// ######################################################################
+// Creates a hub and loads whatever state the store has from last time.
+func New(cfg Config) *Hub {
+	if cfg.Store == nil {
+		cfg.Store = store.NewFiles(cfg.DataDir)
+	}
+	h := &Hub{
+		cfg:         cfg,
+		chatters:    newRegistry(),
+		rooms:       make(map[string]*Room),
+		changeEpoch: randomToken(4),
+		calls:       make(map[string]*call),
+		polls:       make(map[int64]*poll),
+		linkBlock:   preview.ParseDomains(cfg.LinkBlocklist),
+		linkAllow:   preview.ParseDomains(cfg.LinkAllowlist),
+		ipConns:     make(map[string]int),
+		ipBans:      make(map[string]time.Time),
+		pendingAcks: make(map[ackKey]ackSample),
+		delivery:    make(map[string]*deliveryStats),
+		restored:    make(map[string]snapshotSession),
+		scheduled:   make(map[string]ScheduledMessage),
+		recurring:   make(map[string]RecurringAnnouncement),
+		accounts:    make(map[string]*Account),
+		identities:  make(map[string]string),
+		linkTokens:  make(map[string]linkToken),
+		logins:      make(map[string]linkToken),
+		mailTokens:  make(map[string]mailToken),
+		exports:     make(map[string]exportToken),
+		usage:       make(map[string]*Usage),
+		clientIDs:   make(map[clientIDKey]postedAs),
+		storage:     newStorageMetrics(cfg.StoragePool),
+		fanout:      newFanout(cfg.FanoutWorkers),
+	}
+	h.loadBans()
+	h.loadWordList()
+	h.filters = append([]MessageFilter{wordFilter{h}, linkFilter{h}, spamFilter{h}}, cfg.Filters...)
+	h.loadRooms()
+	h.loadHistory()
+	h.loadMOTD()
+	h.loadScheduled()
+	h.loadRecurring()
+	h.loadAccounts()
+	h.loadOffline()
+	h.loadIgnores()
+	h.loadReadMarks()
+	h.loadShadowBans()
+	h.loadWebhooks()
+	h.loadIncomingHooks()
+	h.loadEmoji()
+	h.lastGuest.Store(firstGuest - 1)
+	h.restoreSnapshot()
+	return h
+}
+
+// ######################################################################
+// function: Run()
+// ######################################################################
+// Runs the background jobs until ctx is done, then writes a last snapshot
+// so a restart loses nothing, disconnects everyone and stops the fan-out
+// workers.
+func (h *Hub) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	jobs := []func(context.Context){h.expireAcks, h.snapshotLoop, h.presenceLoop, h.digestLoop, h.scheduleLoop, h.userCountLoop, h.bandwidthLoop, h.retentionLoop}
+	if h.cfg.MailIngest != "" {
+		jobs = append(jobs, h.listenMailIngest)
+	}
+	for _, job := range jobs {
+		wg.Add(1)
+		go func(job func(context.Context)) {
+			defer wg.Done()
+			job(ctx)
+		}(job)
+	}
+	stopObserving := h.observe()
+	defer stopObserving()
+	h.running.Store(true)
+	<-ctx.Done()
+	h.running.Store(false)
+	wg.Wait()
+
+	h.saveSnapshot()
+	h.mu.Lock()
+	for _, chatter := range h.chatters.all() {
+		chatter.Close()
+	}
+	h.fanout.stopLocked()
+	h.mu.Unlock()
+	if err := h.cfg.Store.Close(); err != nil {
+		log.Printf("Error closing the store: %v", err)
+	}
+}
+
+// ######################################################################
+// function: nextMessageID()
+// ######################################################################
+func (h *Hub) nextMessageID() int64 {
+	return h.lastMessageID.Add(1)
+}
+
+// ######################################################################
+// function: bumpMessageID()
+// ######################################################################
+// Makes sure IDs handed out from now on are above id.
+func (h *Hub) bumpMessageID(id int64) {
+	for {
+		last := h.lastMessageID.Load()
+		if last >= id || h.lastMessageID.CompareAndSwap(last, id) {
+			return
+		}
+	}
+}
+
+// ######################################################################
+// function: findChatters()
+// ######################################################################
+// Usernames are not unique, so this returns everyone going by that name.
+func (h *Hub) findChatters(username string) []*Chatter {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var found []*Chatter
+	for _, chatter := range h.chatters.all() {
+		if chatter.Username == username {
+			found = append(found, chatter)
+		}
+	}
+	return found
+}
+
+// ######################################################################
+// function: removeChatterLocked()
+// ######################################################################
+// Takes the chatter out of its room and the registry. Safe to call more
+// than once. Caller holds the mutex.
+func (h *Hub) removeChatterLocked(chatter *Chatter) {
+	if chatter.room != nil {
+		h.removeMemberLocked(chatter.room, chatter)
+	}
+	if h.chatters.remove(chatter) {
+		h.retireBacklog(chatter)
+		h.countsDirty.Store(true)
+	}
+}
+
+// ######################################################################
+// function: dropChatterLocked()
+// ######################################################################
+// Called when a write to the chatter failed: it is removed right away so
+// broadcasts stop trying it, and closing the connection makes its read loop
+// exit and run the rest of the cleanup. Caller holds the mutex.
+func (h *Hub) dropChatterLocked(chatter *Chatter) {
+	if chatter.Kill() {
+		h.removeChatterLocked(chatter)
+	}
+}
+
+// ######################################################################
+// function: broadcastUserCountLocked()
+// ######################################################################
+// Everyone connected plus the members of every room, as listed in the room
+// directory anyway. Caller holds the mutex.
+func (h *Hub) broadcastUserCountLocked() {
+	rooms := make(map[string]int, len(h.rooms))
+	for name, room := range h.rooms {
+		if n := room.membersLocked(); n > 0 {
+			rooms[name] = n
+		}
+	}
+	chatters := h.chatters.all()
+	f := protocol.Frame{Type: protocol.FrameUserCount, Count: peopleLocked(chatters), Rooms: rooms}
+	for _, chatter := range chatters {
+		if !chatter.wantsBackgroundNoiseLocked() {
+			continue
+		}
+		err := chatter.Send(f)
+		if err != nil {
+			log.Printf("Error broadcasting user count: %v", err)
+			h.dropChatterLocked(chatter)
+		}
+	}
+}
+
+// ######################################################################
+// function: userCountLoop()
+// ######################################################################
+func (h *Hub) userCountLoop(ctx context.Context) {
+	ticker := time.NewTicker(h.cfg.UserCountInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		h.mu.Lock()
+		if h.countsDirty.Swap(false) {
+			h.broadcastUserCountLocked()
+		}
+		h.mu.Unlock()
+	}
+}
+
+// ######################################################################
+// function: broadcast()
+// ######################################################################
+func (h *Hub) broadcast(f protocol.Frame, sender *Chatter) {
+	if f.SentAt.IsZero() {
+		f.SentAt = time.Now() // the same ts for everyone
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, chatter := range h.chatters.all() {
+		if sender == nil || chatter != sender {
+			err := chatter.Send(f)
+			if err != nil {
+				log.Printf("Error: %v", err)
+				h.dropChatterLocked(chatter)
+			}
+		}
+	}
+}
+
+// ######################################################################
+// struct: Stats
+// ######################################################################
+// Connection counts broken down by user agent, declared client version and
+// negotiated subprotocol.
+type Stats struct {
+	Connections    int            `json:"connections"`
+	UserAgents     map[string]int `json:"user_agents"`
+	ClientVersions map[string]int `json:"client_versions"`
+	Protocols      map[string]int `json:"protocols"`
+	Presence       map[string]int `json:"presence"`
+	Messages       int64          `json:"messages"`       // posted since start
+	BytesSent      int64          `json:"bytes_sent"`     // by the open connections
+	BytesReceived  int64          `json:"bytes_received"` // from them
+}
+
+// ######################################################################
+// function: Stats()
+// ######################################################################
+func (h *Hub) Stats() Stats {
+	stats := Stats{
+		UserAgents:     make(map[string]int),
+		ClientVersions: make(map[string]int),
+		Protocols:      make(map[string]int),
+		Presence:       make(map[string]int),
+		Messages:       h.posted.Load(),
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, chatter := range h.chatters.all() {
+		stats.Connections++
+		stats.UserAgents[orUnknown(chatter.UserAgent)]++
+		stats.ClientVersions[orUnknown(chatter.Version)]++
+		stats.Protocols[chatter.Codec().Name()]++
+		stats.Presence[chatter.presence]++
+		sent, received := chatter.Traffic()
+		stats.BytesSent += sent
+		stats.BytesReceived += received
+	}
+	return stats
+}
+
+func orUnknown(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
+
+// ######################################################################
+// function: loadJSON()
+// ######################################################################
+// Reads document name from the store into v. One that was never saved is
+// not an error.
+func (h *Hub) loadJSON(name string, v any) (err error) {
+	done := h.storageOp(context.Background(), "load", name)
+	defer func() { done(err) }()
+	return h.cfg.Store.Load(name, v)
+}
+
+// ######################################################################
+// function: saveJSON()
+// ######################################################################
+func (h *Hub) saveJSON(name string, v any) (err error) {
+	done := h.storageOp(context.Background(), "save", name)
+	defer func() { done(err) }()
+	return h.cfg.Store.Save(name, v)
+}
@@ -0,0 +1,130 @@
+package hub
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+)
+
+const (
+	ignoresFile = "ignores.json"
+	maxIgnores  = 100
+)
+
+var (
+	errIgnoreSelf = errors.New("you can't ignore yourself")
+	errIgnoreFull = fmt.Errorf("you can ignore at most %d users", maxIgnores)
+)
+
+// ######################################################################
+// function: ignore()
+// ######################################################################
+// Stops name's chat lines and direct messages reaching the chatter. For
+// accounts the list is kept and applies to all its connections, guests
+// lose it when they disconnect. The ignored user isn't told.
+func (h *Hub) ignore(chatter *Chatter, name string, on bool) error {
+	h.mu.Lock()
+	if name == chatter.Username {
+		h.mu.Unlock()
+		return errIgnoreSelf
+	}
+	account := chatter.account
+	list := chatter.ignoredLocked()
+	h.mu.Unlock()
+
+	if account != "" {
+		h.ignoresMu.Lock()
+		list = h.ignores[account]
+		h.ignoresMu.Unlock()
+	}
+	switch i := slices.Index(list, name); {
+	case on && i >= 0, !on && i < 0:
+		return nil
+	case on && len(list) >= maxIgnores:
+		return errIgnoreFull
+	case on:
+		list = append(list[:len(list):len(list)], name)
+	default:
+		list = slices.Delete(slices.Clone(list), i, i+1)
+	}
+
+	targets := []*Chatter{chatter}
+	if account != "" {
+		h.ignoresMu.Lock()
+		if len(list) == 0 {
+			delete(h.ignores, account)
+		} else {
+			h.ignores[account] = list
+		}
+		h.saveIgnoresLocked()
+		h.ignoresMu.Unlock()
+		targets = h.accountChatters(account)
+	}
+	h.mu.Lock()
+	for _, c := range targets {
+		c.setIgnoredLocked(list)
+	}
+	h.mu.Unlock()
+	return nil
+}
+
+// Caller holds the mutex.
+func (c *Chatter) ignoredLocked() []string {
+	list := make([]string, 0, len(c.ignoring))
+	for name := range c.ignoring {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// Caller holds the mutex.
+func (c *Chatter) setIgnoredLocked(list []string) {
+	c.ignoring = make(map[string]bool, len(list))
+	for _, name := range list {
+		c.ignoring[name] = true
+	}
+}
+
+// ######################################################################
+// function: ignored()
+// ######################################################################
+// Who the chatter ignores, sorted.
+func (h *Hub) ignored(chatter *Chatter) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return chatter.ignoredLocked()
+}
+
+// ######################################################################
+// function: accountIgnores()
+// ######################################################################
+// For messages queued while the account is signed out.
+func (h *Hub) accountIgnores(account, name string) bool {
+	h.ignoresMu.Lock()
+	defer h.ignoresMu.Unlock()
+	return slices.Contains(h.ignores[account], name)
+}
+
+// ######################################################################
+// function: loadIgnores()
+// ######################################################################
+func (h *Hub) loadIgnores() {
+	h.ignoresMu.Lock()
+	defer h.ignoresMu.Unlock()
+	if err := h.loadJSON(ignoresFile, &h.ignores); err != nil {
+		log.Printf("Error loading ignore lists: %v", err)
+	}
+	if h.ignores == nil {
+		h.ignores = make(map[string][]string)
+	}
+}
+
+// Caller holds ignoresMu.
+func (h *Hub) saveIgnoresLocked() {
+	if err := h.saveJSON(ignoresFile, h.ignores); err != nil {
+		log.Printf("Error persisting ignore lists: %v", err)
+	}
+}
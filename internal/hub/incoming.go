@@ -0,0 +1,147 @@
+package hub
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	incomingHooksFile = "incoming_hooks.json"
+	maxHookText       = 4000
+	maxHookName       = 32
+)
+
+var (
+	ErrNoHook      = errors.New("no such hook")
+	errHookRoom    = errors.New("hooks need a room")
+	errHookName    = fmt.Errorf("hook names are at most %d characters", maxHookName)
+	errHookText    = fmt.Errorf("text must be 1 to %d characters", maxHookText)
+	errHookBlocked = errors.New("message breaks the chat rules")
+)
+
+// ######################################################################
+// struct: IncomingHook
+// ######################################################################
+// A secret URL that posts into Room, for CI and monitoring. Posts show up
+// as "<Name> (hook)", so a hook can't pass for a real user.
+type IncomingHook struct {
+	ID      string    `json:"id"`
+	Token   string    `json:"token"`
+	Room    string    `json:"room"`
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+}
+
+// ######################################################################
+// function: AddIncomingHook()
+// ######################################################################
+func (h *Hub) AddIncomingHook(room, name string) (IncomingHook, error) {
+	if room == "" {
+		return IncomingHook{}, errHookRoom
+	}
+	if name == "" {
+		name = "webhook"
+	}
+	if len(name) > maxHookName {
+		return IncomingHook{}, errHookName
+	}
+	hook := IncomingHook{ID: randomToken(6), Token: randomToken(24), Room: room, Name: name, Created: time.Now()}
+
+	h.webhooksMu.Lock()
+	defer h.webhooksMu.Unlock()
+	h.incoming[hook.Token] = hook
+	h.saveIncomingHooksLocked()
+	return hook, nil
+}
+
+// ######################################################################
+// function: RemoveIncomingHook()
+// ######################################################################
+func (h *Hub) RemoveIncomingHook(id string) bool {
+	h.webhooksMu.Lock()
+	defer h.webhooksMu.Unlock()
+	for token, hook := range h.incoming {
+		if hook.ID == id {
+			delete(h.incoming, token)
+			h.saveIncomingHooksLocked()
+			return true
+		}
+	}
+	return false
+}
+
+// ######################################################################
+// function: IncomingHooks()
+// ######################################################################
+// Every incoming hook, oldest first.
+func (h *Hub) IncomingHooks() []IncomingHook {
+	h.webhooksMu.Lock()
+	list := make([]IncomingHook, 0, len(h.incoming))
+	for _, hook := range h.incoming {
+		list = append(list, hook)
+	}
+	h.webhooksMu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	return list
+}
+
+// ######################################################################
+// function: PostIncoming()
+// ######################################################################
+// Posts text into the hook's room. username replaces the hook's name for
+// this one message, like Slack does.
+func (h *Hub) PostIncoming(token, username, text string) error {
+	h.webhooksMu.Lock()
+	hook, ok := h.incoming[token]
+	h.webhooksMu.Unlock()
+	if !ok {
+		return ErrNoHook
+	}
+	text = strings.TrimSpace(text)
+	if text == "" || len(text) > maxHookText {
+		return errHookText
+	}
+	name := hook.Name
+	if username = strings.TrimSpace(username); username != "" {
+		if len(username) > maxHookName {
+			return errHookName
+		}
+		name = username
+	}
+	text, err := h.filterExternal(hook.Room, name+" (hook)", text)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	room, _ := h.getRoom(hook.Room)
+	h.mu.Unlock()
+	h.postExternal(room, name+" (hook)", text)
+	h.posted.Add(1)
+	return nil
+}
+
+// ######################################################################
+// function: loadIncomingHooks()
+// ######################################################################
+func (h *Hub) loadIncomingHooks() {
+	h.webhooksMu.Lock()
+	defer h.webhooksMu.Unlock()
+	if err := h.loadJSON(incomingHooksFile, &h.incoming); err != nil {
+		log.Printf("Error loading incoming hooks: %v", err)
+	}
+	if h.incoming == nil {
+		h.incoming = make(map[string]IncomingHook)
+	}
+}
+
+// Caller holds webhooksMu.
+func (h *Hub) saveIncomingHooksLocked() {
+	if err := h.saveJSON(incomingHooksFile, h.incoming); err != nil {
+		log.Printf("Error persisting incoming hooks: %v", err)
+	}
+}
@@ -0,0 +1,130 @@
+package hub
+
+import (
+	"log"
+	"time"
+)
+
+const bansFile = "bans.json"
+
+// ######################################################################
+// function: AcquireIP()
+// ######################################################################
+// Reserves a connection slot for ip, false if the per-IP cap is reached.
+func (h *Hub) AcquireIP(ip string) bool {
+	h.ipMu.Lock()
+	defer h.ipMu.Unlock()
+	if h.cfg.MaxConnsPerIP > 0 && h.ipConns[ip] >= h.cfg.MaxConnsPerIP {
+		return false
+	}
+	h.ipConns[ip]++
+	return true
+}
+
+// ######################################################################
+// function: ReleaseIP()
+// ######################################################################
+func (h *Hub) ReleaseIP(ip string) {
+	h.ipMu.Lock()
+	defer h.ipMu.Unlock()
+	h.ipConns[ip]--
+	if h.ipConns[ip] <= 0 {
+		delete(h.ipConns, ip)
+	}
+}
+
+// ######################################################################
+// function: IsBanned()
+// ######################################################################
+func (h *Hub) IsBanned(ip string) (time.Time, bool) {
+	h.ipMu.Lock()
+	defer h.ipMu.Unlock()
+	until, ok := h.ipBans[ip]
+	if !ok {
+		return time.Time{}, false
+	}
+	if time.Now().After(until) {
+		delete(h.ipBans, ip)
+		return time.Time{}, false
+	}
+	return until, true
+}
+
+// ######################################################################
+// function: BanIP()
+// ######################################################################
+// Bans ip for d, persists the ban list and kicks anyone already connected
+// from it. Webhooks get a ban event with the reason.
+func (h *Hub) BanIP(ip string, d time.Duration, reason string) error {
+	return h.banIP(ip, d, Event{Action: "admin", Text: reason})
+}
+
+// ev is filled in with what automod knows, the rest is added here.
+func (h *Hub) banIP(ip string, d time.Duration, ev Event) error {
+	until := time.Now().Add(d)
+	h.ipMu.Lock()
+	h.ipBans[ip] = until
+	err := h.saveJSON(bansFile, h.ipBans)
+	h.ipMu.Unlock()
+
+	h.mu.Lock()
+	for _, chatter := range h.chatters.all() {
+		if chatter.IP == ip {
+			if ev.User == "" {
+				ev.User = chatter.Username
+			}
+			chatter.Close()
+		}
+	}
+	h.mu.Unlock()
+
+	ev.Type, ev.IP, ev.Until = EventBan, ip, until
+	h.emit(ev)
+	return err
+}
+
+// ######################################################################
+// function: UnbanIP()
+// ######################################################################
+func (h *Hub) UnbanIP(ip string) error {
+	h.ipMu.Lock()
+	defer h.ipMu.Unlock()
+	delete(h.ipBans, ip)
+	return h.saveJSON(bansFile, h.ipBans)
+}
+
+// ######################################################################
+// function: Bans()
+// ######################################################################
+func (h *Hub) Bans() map[string]time.Time {
+	h.ipMu.Lock()
+	defer h.ipMu.Unlock()
+	now := time.Now()
+	bans := make(map[string]time.Time, len(h.ipBans))
+	for ip, until := range h.ipBans {
+		if now.Before(until) {
+			bans[ip] = until
+		}
+	}
+	return bans
+}
+
+// ######################################################################
+// function: loadBans()
+// ######################################################################
+func (h *Hub) loadBans() {
+	bans := make(map[string]time.Time)
+	if err := h.loadJSON(bansFile, &bans); err != nil {
+		log.Printf("Error loading bans: %v", err)
+		return
+	}
+	now := time.Now()
+	for ip, until := range bans {
+		if now.After(until) {
+			delete(bans, ip)
+		}
+	}
+	h.ipMu.Lock()
+	h.ipBans = bans
+	h.ipMu.Unlock()
+}
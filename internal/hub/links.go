@@ -0,0 +1,54 @@
+package hub
+
+import (
+	"strings"
+
+	"go-chat-app/internal/preview"
+)
+
+// What a stripped link is replaced with
+const linkRemoved = "[link removed]"
+
+// ######################################################################
+// function: linkAllowed()
+// ######################################################################
+// Not on cfg.LinkBlocklist, and on cfg.LinkAllowlist if there is one.
+func (h *Hub) linkAllowed(link string) bool {
+	host := preview.Host(link)
+	if host == "" || h.linkBlock.Match(host) {
+		return false
+	}
+	return len(h.linkAllow) == 0 || h.linkAllow.Match(host)
+}
+
+// ######################################################################
+// function: hasBlockedLink()
+// ######################################################################
+func (h *Hub) hasBlockedLink(text string) bool {
+	if len(h.linkBlock) == 0 && len(h.linkAllow) == 0 {
+		return false
+	}
+	for _, link := range preview.FindURLs(text) {
+		if !h.linkAllowed(link) {
+			return true
+		}
+	}
+	return false
+}
+
+// ######################################################################
+// function: stripLinks()
+// ######################################################################
+// With cfg.StripLinks, text with the links that aren't allowed taken out.
+// stripped says if there were any. Without it linkFilter strikes for them.
+func (h *Hub) stripLinks(text string) (string, bool) {
+	if !h.cfg.StripLinks || !h.hasBlockedLink(text) {
+		return text, false
+	}
+	for _, link := range preview.FindURLs(text) {
+		if !h.linkAllowed(link) {
+			text = strings.Replace(text, link, linkRemoved, 1)
+		}
+	}
+	return text, true
+}
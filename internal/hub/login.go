@@ -0,0 +1,327 @@
+package hub
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// Guests are called this and a number until they pick a name, so nobody
+	// gets to own names starting with it
+	GuestPrefix   = "guest-"
+	firstGuest    = 1000
+	LoginTokenTTL = 30 * 24 * time.Hour // unless Config.LoginTTL says otherwise
+	maxNameLength = 32
+	minPassword   = 8
+	maxPassword   = 72 // bcrypt ignores anything after that
+)
+
+var (
+	ErrNameTaken   = errors.New("that username is already registered")
+	ErrBadLogin    = errors.New("wrong username or password")
+	ErrBadName     = errors.New("usernames are 1 to 32 characters, without spaces or control characters")
+	ErrBadPassword = errors.New("passwords are 8 to 72 bytes")
+	errNameOwned   = errors.New("that name is registered, log in to use it")
+	ErrGuestName   = errors.New("names starting with " + GuestPrefix + " are for guests")
+	ErrReserved    = errors.New("that name is reserved")
+)
+
+// Names the server itself shows up as (audit actors, system lines), so
+// nobody can pass for it. Compared ignoring case.
+var reservedNames = []string{"admin", "administrator", "automod", "moderator", "root", "server", "system"}
+
+func reservedName(name string) bool {
+	for _, r := range reservedNames {
+		if strings.EqualFold(name, r) {
+			return true
+		}
+	}
+	return false
+}
+
+// compared against when the user doesn't exist, so a wrong name takes as
+// long as a wrong password
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("not a password"), bcrypt.DefaultCost)
+	return hash
+})
+
+func validName(name string) bool {
+	if name == "" || utf8.RuneCountInString(name) > maxNameLength || isGuestName(name) {
+		return false
+	}
+	return strings.IndexFunc(name, func(r rune) bool { return unicode.IsSpace(r) || !unicode.IsPrint(r) }) < 0
+}
+
+// Why name can't be anyone's, nil if it can. Registering and /u give the
+// same reasons.
+func nameError(name string) error {
+	switch {
+	case isGuestName(name):
+		return ErrGuestName
+	case reservedName(name):
+		return ErrReserved
+	case !validName(name):
+		return ErrBadName
+	}
+	return nil
+}
+
+func isGuestName(name string) bool {
+	return len(name) >= len(GuestPrefix) && strings.EqualFold(name[:len(GuestPrefix)], GuestPrefix)
+}
+
+// ######################################################################
+// function: guestName()
+// ######################################################################
+// The next guest-<number>. Numbers only go up, past the ones restored
+// sessions have too, so no two guests get the same.
+func (h *Hub) guestName() string {
+	return GuestPrefix + strconv.FormatInt(h.lastGuest.Add(1), 10)
+}
+
+// bumpGuest makes sure guestName() never hands out name again
+func (h *Hub) bumpGuest(name string) {
+	if !isGuestName(name) {
+		return
+	}
+	n, err := strconv.ParseInt(name[len(GuestPrefix):], 10, 64)
+	if err != nil {
+		return
+	}
+	for {
+		last := h.lastGuest.Load()
+		if last >= n || h.lastGuest.CompareAndSwap(last, n) {
+			return
+		}
+	}
+}
+
+// ######################################################################
+// function: Register()
+// ######################################################################
+// Creates a password account owning name and logs it in. Returns the
+// account and a login token for the WebSocket handshake. email is
+// optional, it's mailed a link to check it.
+func (h *Hub) Register(name, password, email string) (Account, string, error) {
+	if err := nameError(name); err != nil {
+		return Account{}, "", err
+	}
+	if len(password) < minPassword || len(password) > maxPassword {
+		return Account{}, "", ErrBadPassword
+	}
+	if email != "" {
+		if _, err := parseEmail(email); err != nil {
+			return Account{}, "", err
+		}
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return Account{}, "", err
+	}
+
+	h.accountsMu.Lock()
+	if h.nameTakenLocked(name) {
+		h.accountsMu.Unlock()
+		return Account{}, "", ErrNameTaken
+	}
+	a, err := h.createLocked(name, Identity{Provider: ProviderPassword, Subject: name, Secret: string(hash)})
+	if err != nil {
+		h.accountsMu.Unlock()
+		return Account{}, "", ErrNameTaken // the identity is the name, same thing
+	}
+	token := h.issueLoginLocked(a.ID)
+	h.accountsMu.Unlock()
+
+	if email != "" {
+		// the account is made either way, the address can be set again
+		if err := h.SetEmail(a.ID, email); err != nil {
+			log.Printf("Error mailing address check for %s: %v", name, err)
+		} else {
+			a.Email = strings.TrimSpace(email)
+		}
+	}
+	return a, token, nil
+}
+
+// ######################################################################
+// function: Login()
+// ######################################################################
+func (h *Hub) Login(name, password string) (Account, string, error) {
+	a, err := h.Authenticate(name, password)
+	if err != nil {
+		return Account{}, "", err
+	}
+
+	h.accountsMu.Lock()
+	defer h.accountsMu.Unlock()
+	return a, h.issueLoginLocked(a.ID), nil
+}
+
+// ######################################################################
+// function: Authenticate()
+// ######################################################################
+// Checks the password like Login, without issuing a login token. For
+// connections that sign in afresh each time, like IRC, a token would
+// only sit in h.logins until it expires.
+func (h *Hub) Authenticate(name, password string) (Account, error) {
+	a, ident, ok := h.AccountFor(ProviderPassword, name)
+	hash := dummyHash()
+	if ok {
+		hash = []byte(ident.Secret)
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil || !ok {
+		return Account{}, ErrBadLogin
+	}
+	return a, nil
+}
+
+// ######################################################################
+// function: Logout()
+// ######################################################################
+func (h *Hub) Logout(token string) {
+	h.accountsMu.Lock()
+	delete(h.logins, token)
+	h.accountsMu.Unlock()
+}
+
+// ######################################################################
+// function: LoginAccount()
+// ######################################################################
+// The account a login token belongs to, if the token is still good.
+func (h *Hub) LoginAccount(token string) (Account, bool) {
+	h.accountsMu.Lock()
+	defer h.accountsMu.Unlock()
+	lt, ok := h.logins[token]
+	if !ok || time.Now().After(lt.expires) {
+		delete(h.logins, token)
+		return Account{}, false
+	}
+	a, ok := h.accounts[lt.account]
+	if !ok {
+		return Account{}, false // merged away since
+	}
+	return a.public(), true
+}
+
+// Caller holds accountsMu.
+func (h *Hub) issueLoginLocked(account string) string {
+	now := time.Now()
+	for token, lt := range h.logins {
+		if now.After(lt.expires) {
+			delete(h.logins, token)
+		}
+	}
+	token := randomToken(16)
+	h.logins[token] = linkToken{account: account, expires: now.Add(h.LoginTTL())}
+	return token
+}
+
+// ######################################################################
+// function: LoginTTL()
+// ######################################################################
+func (h *Hub) LoginTTL() time.Duration {
+	if h.cfg.LoginTTL > 0 {
+		return h.cfg.LoginTTL
+	}
+	return LoginTokenTTL
+}
+
+// ######################################################################
+// function: RevokeLogins()
+// ######################################################################
+// Signs the account out everywhere: every login token stops working and
+// its open connections are closed, for good. Returns how many of each.
+func (h *Hub) RevokeLogins(id, actor string) (tokens, conns int, err error) {
+	h.accountsMu.Lock()
+	a, ok := h.accounts[id]
+	if !ok {
+		h.accountsMu.Unlock()
+		return 0, 0, ErrNoAccount
+	}
+	name := a.Name
+	for token, lt := range h.logins {
+		if lt.account == id {
+			delete(h.logins, token)
+			tokens++
+		}
+	}
+	h.accountsMu.Unlock()
+
+	for _, chatter := range h.accountChatters(id) {
+		h.mu.Lock()
+		chatter.kicked = true // no resuming with the session token either
+		h.mu.Unlock()
+		chatter.SendSystem("You were signed out, log in again.")
+		chatter.Close()
+		conns++
+	}
+	log.Printf("Revoked %d logins and closed %d connections of %s", tokens, conns, name)
+	h.Audit(AuditEntry{Actor: actor, Action: "revoke_logins", Target: name})
+	return tokens, conns, nil
+}
+
+// Caller holds accountsMu. Reserved names count as taken, and names that
+// only differ in case are the same name, like for reserved ones.
+func (h *Hub) nameTakenLocked(name string) bool {
+	if reservedName(name) {
+		return true
+	}
+	for _, a := range h.accounts {
+		if strings.EqualFold(a.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// ######################################################################
+// function: checkName()
+// ######################################################################
+// Whether chatter may call itself name: a valid name that isn't reserved,
+// and registered names belong to whoever is signed in to the account.
+func (h *Hub) checkName(chatter *Chatter, name string) error {
+	if err := nameError(name); err != nil {
+		return err
+	}
+	if owner, ok := h.accountNamed(name); ok && owner != chatter.account {
+		return errNameOwned
+	}
+	return nil
+}
+
+// ######################################################################
+// function: LoginWith()
+// ######################################################################
+// Logs in with an identity a provider has just vouched for. One nobody has
+// seen before gets a new account, named after name as far as that is free.
+func (h *Hub) LoginWith(ident Identity, name string) (Account, string, error) {
+	h.accountsMu.Lock()
+	defer h.accountsMu.Unlock()
+	if id, ok := h.identities[ident.key()]; ok {
+		return h.accounts[id].public(), h.issueLoginLocked(id), nil
+	}
+
+	if !validName(name) {
+		name = ident.Provider
+	}
+	free := name
+	for n := 2; h.nameTakenLocked(free); n++ {
+		free = fmt.Sprintf("%s%d", name, n)
+	}
+	a, err := h.createLocked(free, ident)
+	if err != nil {
+		return Account{}, "", err
+	}
+	log.Printf("New %s account %s (%s)", ident.Provider, a.ID, a.Name)
+	return a, h.issueLoginLocked(a.ID), nil
+}
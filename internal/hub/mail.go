@@ -0,0 +1,305 @@
+package hub
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"go-chat-app/internal/markdown"
+	"go-chat-app/internal/protocol"
+)
+
+// ######################################################################
+// struct: MailList
+// ######################################################################
+// Mailing list settings of a room: subscribers get a digest every Frequency,
+// and mail they send to Address is posted back into the room.
+type MailList struct {
+	Address     string    `json:"address"`
+	Frequency   string    `json:"frequency"` // "daily" or "weekly"
+	Subscribers []string  `json:"subscribers"`
+	LastDigest  time.Time `json:"last_digest,omitempty"`
+}
+
+func (m *MailList) period() time.Duration {
+	if m.Frequency == "weekly" {
+		return 7 * 24 * time.Hour
+	}
+	return 24 * time.Hour
+}
+
+func (m *MailList) subscribed(address string) bool {
+	for _, s := range m.Subscribers {
+		if strings.EqualFold(s, address) {
+			return true
+		}
+	}
+	return false
+}
+
+// ######################################################################
+// function: digestLoop()
+// ######################################################################
+// Checks every few minutes which rooms are due a digest and mails it out.
+func (h *Hub) digestLoop(ctx context.Context) {
+	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		h.sendDueDigests()
+	}
+}
+
+// ######################################################################
+// function: sendDueDigests()
+// ######################################################################
+func (h *Hub) sendDueDigests() {
+	type digest struct {
+		room     string
+		list     MailList
+		messages []protocol.Frame
+	}
+	var due []digest
+
+	h.mu.Lock()
+	now := time.Now()
+	for name, room := range h.rooms {
+		list := room.mail
+		if list == nil || len(list.Subscribers) == 0 || now.Sub(list.LastDigest) < list.period() {
+			continue
+		}
+		var messages []protocol.Frame
+		for _, f := range room.history {
+			if f.SentAt.After(list.LastDigest) {
+				messages = append(messages, f)
+			}
+		}
+		list.LastDigest = now
+		if len(messages) > 0 {
+			due = append(due, digest{room: name, list: *list, messages: messages})
+		}
+	}
+	if len(due) > 0 {
+		if err := h.saveRoomsLocked(); err != nil {
+			log.Printf("Error persisting rooms: %v", err)
+		}
+	}
+	h.mu.Unlock()
+
+	for _, d := range due {
+		if err := h.sendDigest(d.room, d.list, d.messages); err != nil {
+			log.Printf("Error mailing digest for #%s: %v", d.room, err)
+		}
+	}
+}
+
+// ######################################################################
+// function: sendDigest()
+// ######################################################################
+func (h *Hub) sendDigest(room string, list MailList, messages []protocol.Frame) error {
+	var body strings.Builder
+	fmt.Fprintf(&body, "From: %s\r\n", list.Address)
+	fmt.Fprintf(&body, "To: %s\r\n", list.Address)
+	fmt.Fprintf(&body, "Reply-To: %s\r\n", list.Address)
+	fmt.Fprintf(&body, "Subject: #%s %s digest (%d messages)\r\n", room, list.Frequency, len(messages))
+	fmt.Fprintf(&body, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	for _, f := range messages {
+		fmt.Fprintf(&body, "[%s] %s: %s\r\n", f.SentAt.Format("2006-01-02 15:04"), f.From, f.Text)
+	}
+	fmt.Fprintf(&body, "\r\n-- \r\nReply to this mail to post in #%s.\r\n", room)
+
+	m := h.mailer()
+	if m == nil {
+		return ErrNoMailer
+	}
+	// Subscribers go in the envelope only, so they don't see each other
+	return m.Send(list.Address, list.Subscribers, []byte(body.String()))
+}
+
+// ######################################################################
+// function: listenMailIngest()
+// ######################################################################
+// A minimal SMTP server for replies to room digests. Point the MX (or a
+// forwarding rule) for the list addresses at it.
+func (h *Hub) listenMailIngest(ctx context.Context) {
+	addr := h.cfg.MailIngest
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Printf("Mail ingest disabled: %v", err)
+		return
+	}
+	log.Printf("Mail ingest listening on %s", addr)
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	for {
+		conn, err := ln.Accept()
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("Mail ingest accept error: %v", err)
+			continue
+		}
+		go h.handleMailConn(conn)
+	}
+}
+
+// ######################################################################
+// function: handleMailConn()
+// ######################################################################
+func (h *Hub) handleMailConn(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	reply := func(code int, msg string) { tp.PrintfLine("%d %s", code, msg) }
+
+	var from string
+	var to []string
+	reply(220, "tempChat mail ingest ready")
+	for {
+		conn.SetDeadline(time.Now().Add(2 * time.Minute))
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "HELO", "EHLO":
+			reply(250, "hello")
+		case "MAIL":
+			from = smtpAddress(arg)
+			to = nil
+			reply(250, "ok")
+		case "RCPT":
+			to = append(to, smtpAddress(arg))
+			reply(250, "ok")
+		case "DATA":
+			if from == "" || len(to) == 0 {
+				reply(503, "need MAIL and RCPT first")
+				continue
+			}
+			reply(354, "end with <CRLF>.<CRLF>")
+			data, err := io.ReadAll(io.LimitReader(tp.DotReader(), 1<<20))
+			if err != nil {
+				return
+			}
+			if err := h.ingestMail(from, to, string(data)); err != nil {
+				reply(550, err.Error())
+				continue
+			}
+			reply(250, "posted")
+		case "RSET":
+			from, to = "", nil
+			reply(250, "ok")
+		case "NOOP":
+			reply(250, "ok")
+		case "QUIT":
+			reply(221, "bye")
+			return
+		default:
+			reply(502, "not implemented")
+		}
+	}
+}
+
+// "FROM:<a@b.c> SIZE=123" -> "a@b.c"
+func smtpAddress(arg string) string {
+	_, addr, _ := strings.Cut(arg, ":")
+	addr = strings.TrimSpace(addr)
+	if i := strings.IndexByte(addr, '>'); i >= 0 {
+		addr = addr[:i]
+	}
+	return strings.ToLower(strings.TrimPrefix(addr, "<"))
+}
+
+// ######################################################################
+// function: ingestMail()
+// ######################################################################
+// Posts the reply into every room whose list address it was sent to, as
+// long as the sender is subscribed to that list.
+func (h *Hub) ingestMail(from string, to []string, data string) error {
+	msg, err := mail.ReadMessage(strings.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("unreadable message")
+	}
+	name := from
+	if addr, err := mail.ParseAddress(msg.Header.Get("From")); err == nil && addr.Name != "" {
+		name = addr.Name
+	}
+	body, err := io.ReadAll(msg.Body)
+	if err != nil {
+		return fmt.Errorf("unreadable body")
+	}
+	text := stripQuoted(string(body))
+	if text == "" {
+		return fmt.Errorf("empty message")
+	}
+
+	var targets []*Room
+	h.mu.Lock()
+	for _, room := range h.rooms {
+		if room.mail == nil || !room.mail.subscribed(from) {
+			continue
+		}
+		for _, rcpt := range to {
+			if strings.EqualFold(rcpt, room.mail.Address) {
+				targets = append(targets, room)
+				break
+			}
+		}
+	}
+	h.mu.Unlock()
+
+	if len(targets) == 0 {
+		return fmt.Errorf("no list here takes mail from %s", from)
+	}
+	for _, room := range targets {
+		h.postExternal(room, name+" (email)", text)
+	}
+	return nil
+}
+
+// ######################################################################
+// function: stripQuoted()
+// ######################################################################
+// Keeps what the person wrote and drops the quoted digest below it.
+func stripQuoted(body string) string {
+	var lines []string
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.HasPrefix(line, ">") || line == "-- " {
+			break
+		}
+		if strings.HasPrefix(line, "On ") && strings.HasSuffix(line, "wrote:") {
+			break
+		}
+		lines = append(lines, line)
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// ######################################################################
+// function: postExternal()
+// ######################################################################
+// Posts a message into a room on behalf of someone who is not connected.
+func (h *Hub) postExternal(room *Room, from, text string) {
+	f := protocol.Frame{Type: protocol.FrameMessage, ID: h.nextMessageID(), Room: room.name, From: from, Color: derivedColor(strings.ToLower(from)), Text: text, HTML: markdown.Render(text), SentAt: time.Now()}
+	h.mu.Lock()
+	room.recordLocked(f, h.cfg.HistorySize)
+	h.mu.Unlock()
+	h.broadcastRoom(room, f, nil)
+	h.storeMessage(context.Background(), f)
+}
@@ -0,0 +1,48 @@
+package hub
+
+import (
+	"net"
+	"net/smtp"
+)
+
+// ######################################################################
+// interface: Mailer
+// ######################################################################
+// Sends mail for the hub: room digests, address checks and password
+// resets. msg is the whole message, headers included.
+type Mailer interface {
+	Send(from string, to []string, msg []byte) error
+}
+
+// ######################################################################
+// struct: SMTPMailer
+// ######################################################################
+// Hands mail to an SMTP server, with PLAIN auth if User is set.
+type SMTPMailer struct {
+	Addr     string // host:port
+	User     string
+	Password string
+}
+
+func (m SMTPMailer) Send(from string, to []string, msg []byte) error {
+	var auth smtp.Auth
+	if m.User != "" {
+		host, _, _ := net.SplitHostPort(m.Addr)
+		auth = smtp.PlainAuth("", m.User, m.Password, host)
+	}
+	return smtp.SendMail(m.Addr, auth, from, to, msg)
+}
+
+// ######################################################################
+// function: mailer()
+// ######################################################################
+// cfg.Mailer, or SMTP to cfg.SMTPAddr. nil if there is neither.
+func (h *Hub) mailer() Mailer {
+	switch {
+	case h.cfg.Mailer != nil:
+		return h.cfg.Mailer
+	case h.cfg.SMTPAddr != "":
+		return SMTPMailer{Addr: h.cfg.SMTPAddr, User: h.cfg.SMTPUser, Password: h.cfg.SMTPPassword}
+	}
+	return nil
+}
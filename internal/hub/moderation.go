@@ -0,0 +1,166 @@
+package hub
+
+import (
+	"bufio"
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"text/template"
+
+	"go-chat-app/internal/protocol"
+)
+
+// Rules a chatter can be struck for
+const (
+	ruleProfanity = "profanity"
+	ruleBinary    = "binary"
+	ruleTooLarge  = "too_large"
+	ruleLink      = "link"
+	// ruleSpam is in spam.go
+)
+
+var ruleText = map[string]map[string]string{
+	"en": {
+		ruleProfanity: "no profanity",
+		ruleBinary:    "no binary messages",
+		ruleTooLarge:  "no oversized messages",
+		ruleLink:      "no links to blocked sites",
+		ruleSpam:      "no spam",
+	},
+	"no": {
+		ruleProfanity: "ingen banning",
+		ruleBinary:    "ingen binærmeldinger",
+		ruleTooLarge:  "ingen for store meldinger",
+		ruleLink:      "ingen lenker til blokkerte nettsteder",
+		ruleSpam:      "ingen spam",
+	},
+}
+
+var consequenceText = map[string]map[string]string{
+	"en": {"warning": "another warning", "kick": "you will be kicked", "ban": "you will be banned for"},
+	"no": {"warning": "en ny advarsel", "kick": "du blir kastet ut", "ban": "du blir utestengt i"},
+}
+
+var strikeTemplates = map[string]*template.Template{
+	"en": template.Must(template.New("en").Parse(
+		`Strike {{.Strikes}}/{{.MaxStrikes}}: you broke the rule "{{.Rule}}".` +
+			`{{if .Banned}} You are banned for {{.Ban}}.{{else if .Kicked}} You have been kicked.` +
+			`{{else}} Next strike: {{.Next}}{{if eq .NextKey "ban"}} {{.Ban}}{{end}}.{{end}}`)),
+	"no": template.Must(template.New("no").Parse(
+		`Prikk {{.Strikes}}/{{.MaxStrikes}}: du brøt regelen "{{.Rule}}".` +
+			`{{if .Banned}} Du er utestengt i {{.Ban}}.{{else if .Kicked}} Du har blitt kastet ut.` +
+			`{{else}} Neste prikk: {{.Next}}{{if eq .NextKey "ban"}} {{.Ban}}{{end}}.{{end}}`)),
+}
+
+// ######################################################################
+// function: readWordList()
+// ######################################################################
+// One banned word per line, blank lines and # comments are ignored.
+func readWordList(path string) (map[string]bool, error) {
+	words := make(map[string]bool)
+	if path == "" {
+		return words, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		word := strings.ToLower(strings.TrimSpace(scanner.Text()))
+		if word != "" && !strings.HasPrefix(word, "#") {
+			words[word] = true
+		}
+	}
+	return words, scanner.Err()
+}
+
+// ######################################################################
+// function: strike()
+// ######################################################################
+// Gives the chatter a strike for breaking rule and DMs them about it.
+// Reaching MaxStrikes kicks them, plus a temporary IP ban if configured.
+// Returns true if the chatter was removed.
+func (h *Hub) strike(chatter *Chatter, rule string) bool {
+	chatter.strikes++
+	notice := &protocol.StrikeNotice{Rule: rule, Strikes: chatter.strikes, MaxStrikes: h.cfg.MaxStrikes}
+
+	final := chatter.strikes >= h.cfg.MaxStrikes
+	switch {
+	case final:
+		notice.Next = "ban"
+		notice.Banned = h.cfg.StrikeBan > 0
+	case chatter.strikes == h.cfg.MaxStrikes-1 && h.cfg.StrikeBan > 0:
+		notice.Next = "ban"
+	case chatter.strikes == h.cfg.MaxStrikes-1:
+		notice.Next = "kick"
+	default:
+		notice.Next = "warning"
+	}
+
+	if err := chatter.Send(protocol.Frame{Type: protocol.FrameStrike, Text: h.renderStrike(chatter.Locale(), notice, final), Strike: notice}); err != nil {
+		log.Printf("Error sending strike to %s: %v", chatter.Username, err)
+	}
+	log.Printf("Strike %d/%d for %s (%s): %s", chatter.strikes, h.cfg.MaxStrikes, chatter.Username, chatter.IP, rule)
+	ev := Event{Type: EventModeration, Action: "strike", User: chatter.Username, Text: rule}
+	if chatter.room != nil {
+		ev.Room = chatter.room.name
+	}
+	switch {
+	case final && notice.Banned:
+		ev.Action = "ban"
+	case final:
+		ev.Action = "kick"
+	}
+	if ev.Action != "ban" {
+		h.emit(ev) // bans go out from banIP
+	}
+	if final {
+		h.Audit(AuditEntry{Actor: "automod", Action: ev.Action, Target: chatter.Username, Room: ev.Room, Reason: rule})
+	}
+
+	if !final {
+		return false
+	}
+	if h.cfg.StrikeBan > 0 {
+		ban := Event{Action: "automod", Room: ev.Room, User: chatter.Username, Text: rule}
+		if err := h.banIP(chatter.IP, h.cfg.StrikeBan, ban); err != nil {
+			log.Printf("Error persisting bans: %v", err)
+		}
+	} else {
+		chatter.Close()
+	}
+	return true
+}
+
+// ######################################################################
+// function: renderStrike()
+// ######################################################################
+func (h *Hub) renderStrike(locale string, notice *protocol.StrikeNotice, final bool) string {
+	tmpl, ok := strikeTemplates[locale]
+	if !ok {
+		locale, tmpl = "en", strikeTemplates["en"]
+	}
+	rule, ok := ruleText[locale][notice.Rule]
+	if !ok {
+		rule = notice.Rule // one of a MessageFilter's own
+	}
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, map[string]any{
+		"Rule":       rule,
+		"Strikes":    notice.Strikes,
+		"MaxStrikes": notice.MaxStrikes,
+		"Next":       consequenceText[locale][notice.Next],
+		"NextKey":    notice.Next,
+		"Ban":        h.cfg.StrikeBan.String(),
+		"Banned":     final && notice.Banned,
+		"Kicked":     final && !notice.Banned,
+	})
+	if err != nil {
+		log.Printf("Error rendering strike notice: %v", err)
+	}
+	return buf.String()
+}
@@ -0,0 +1,256 @@
+package hub
+
+import (
+	"log"
+	"strings"
+	"time"
+	"unicode"
+
+	"go-chat-app/internal/markdown"
+	"go-chat-app/internal/protocol"
+)
+
+const (
+	offlineFile = "offline.json"
+	maxOffline  = 100 // per account, the oldest go first
+)
+
+// ######################################################################
+// function: signIn()
+// ######################################################################
+// Ties the chatter to an account, which gives it the account's name. What
+// was queued for the account comes with deliverOffline once it is in a room.
+func (h *Hub) signIn(chatter *Chatter, account Account) {
+	h.ignoresMu.Lock()
+	ignoring := h.ignores[account.ID]
+	h.ignoresMu.Unlock()
+	h.mu.Lock()
+	chatter.account = account.ID
+	chatter.Username = account.Name
+	for _, c := range h.devicesLocked(chatter) {
+		if c != chatter {
+			chatter.Username = c.Username // renamed with /u on another device
+			break
+		}
+	}
+	chatter.setIgnoredLocked(ignoring)
+	if account.Bot {
+		// only its own commands until it subscribes to fewer
+		chatter.bot, chatter.grants = true, account.Commands
+		chatter.subscription, _ = newSubscription(account.Commands, nil)
+	}
+	h.mu.Unlock()
+}
+
+// ######################################################################
+// function: accountChatters()
+// ######################################################################
+// Every connection signed in to the account.
+func (h *Hub) accountChatters(id string) []*Chatter {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var found []*Chatter
+	for _, chatter := range h.chatters.all() {
+		if chatter.account == id {
+			found = append(found, chatter)
+		}
+	}
+	return found
+}
+
+// ######################################################################
+// function: accountNamed()
+// ######################################################################
+// Account names are matched in any case, like nameTakenLocked does, or
+// "Kari" would be a guest passing as kari. Older accounts can still differ
+// only in case, the exact match wins then.
+func (h *Hub) accountNamed(name string) (string, bool) {
+	h.accountsMu.Lock()
+	defer h.accountsMu.Unlock()
+	found := ""
+	for id, a := range h.accounts {
+		if a.Name == name {
+			return id, true
+		}
+		if strings.EqualFold(a.Name, name) {
+			found = id
+		}
+	}
+	return found, found != ""
+}
+
+// ######################################################################
+// function: queueOffline()
+// ######################################################################
+// Keeps f for the account until it signs in again.
+func (h *Hub) queueOffline(account string, f protocol.Frame) {
+	f.Ack = false
+	f = protocol.Stamp(f) // ts is saved with it, SentAt isn't
+	h.offlineMu.Lock()
+	defer h.offlineMu.Unlock()
+	queue := append(h.offline[account], f)
+	if over := len(queue) - maxOffline; over > 0 {
+		queue = append(queue[:0:0], queue[over:]...)
+	}
+	h.offline[account] = queue
+	h.saveOfflineLocked()
+}
+
+// ######################################################################
+// function: deliverOffline()
+// ######################################################################
+// Sends everything queued for the account in one missed_messages frame.
+func (h *Hub) deliverOffline(chatter *Chatter, account string) {
+	h.offlineMu.Lock()
+	queue := h.offline[account]
+	if len(queue) > 0 {
+		delete(h.offline, account)
+		h.saveOfflineLocked()
+	}
+	h.offlineMu.Unlock()
+
+	if len(queue) > 0 {
+		chatter.Send(protocol.Frame{Type: protocol.FrameMissedMessages, Messages: queue})
+	}
+}
+
+// ######################################################################
+// function: moveOffline()
+// ######################################################################
+// For merged accounts, drop's queue goes to keep.
+func (h *Hub) moveOffline(keep, drop string) {
+	h.offlineMu.Lock()
+	defer h.offlineMu.Unlock()
+	queue, ok := h.offline[drop]
+	if !ok {
+		return
+	}
+	delete(h.offline, drop)
+	queue = append(h.offline[keep], queue...)
+	if over := len(queue) - maxOffline; over > 0 {
+		queue = queue[over:]
+	}
+	h.offline[keep] = queue
+	h.saveOfflineLocked()
+}
+
+// ######################################################################
+// function: deliverMentions()
+// ######################################################################
+// A chat line that @mentions an account goes to its devices in other rooms
+// as a mention frame, or is queued for it if nobody is signed in. Once per
+// account however often it is mentioned.
+func (h *Hub) deliverMentions(f protocol.Frame) {
+	done := make(map[string]bool)
+	for _, word := range strings.Fields(f.Text) {
+		if !strings.HasPrefix(word, "@") {
+			continue
+		}
+		name := strings.TrimRightFunc(word[1:], unicode.IsPunct) // "@kari," and "@kari!"
+		account, ok := h.accountNamed(name)
+		if !ok || done[account] || h.accountIgnores(account, f.From) {
+			continue
+		}
+		done[account] = true
+		devices := h.accountChatters(account)
+		if len(devices) == 0 {
+			h.queueOffline(account, f)
+			continue
+		}
+		mention := f
+		mention.Type = protocol.FrameMention
+		for _, chatter := range devices {
+			h.mu.Lock()
+			elsewhere := chatter.room == nil || chatter.room.name != f.Room
+			h.mu.Unlock()
+			if elsewhere {
+				chatter.Send(mention)
+			}
+		}
+	}
+}
+
+// ######################################################################
+// function: sendDirect()
+// ######################################################################
+// A private message. A registered name only reaches whoever is signed in
+// to that account, and is queued if nobody is. Anything else goes to every
+// guest using the name. Being ignored looks like being delivered.
+func (h *Hub) sendDirect(from *Chatter, to, text string) {
+	f := protocol.Frame{Type: protocol.FrameDirect, ID: h.nextMessageID(), From: from.Username, Color: h.colorOf(from), Text: text, HTML: markdown.Render(text), SentAt: time.Now()}
+	if h.shadowBanned(from) {
+		from.Send(f) // looks delivered
+		return
+	}
+	if !h.deliverDirect(from, to, f) {
+		return
+	}
+	// the sender's copy, as confirmation and for their other devices
+	h.mu.Lock()
+	devices := h.devicesLocked(from)
+	h.mu.Unlock()
+	for _, c := range devices {
+		c.Send(f)
+	}
+}
+
+// ######################################################################
+// function: deliverDirect()
+// ######################################################################
+// Gets f to to like sendDirect, or queues it. False if there is nobody by
+// that name, which from has been told.
+func (h *Hub) deliverDirect(from *Chatter, to string, f protocol.Frame) bool {
+	account, registered := h.accountNamed(to)
+	var recipients []*Chatter
+	if registered {
+		recipients = h.accountChatters(account)
+	} else {
+		recipients = h.findChatters(to)
+	}
+	switch {
+	case len(recipients) > 0:
+		for _, chatter := range recipients {
+			h.mu.Lock()
+			ignored := chatter.ignoring[f.From]
+			h.mu.Unlock()
+			if !ignored {
+				chatter.Send(f)
+			}
+		}
+	case registered:
+		if !h.accountIgnores(account, f.From) {
+			h.queueOffline(account, f)
+		}
+		from.SendSystem("%s is offline and gets your message when they are back.", to)
+	default:
+		from.SendError(protocol.CodeUserNotFound, "No user named %s is online.", to)
+		return false
+	}
+	return true
+}
+
+// ######################################################################
+// function: loadOffline()
+// ######################################################################
+func (h *Hub) loadOffline() {
+	h.offlineMu.Lock()
+	defer h.offlineMu.Unlock()
+	if err := h.loadJSON(offlineFile, &h.offline); err != nil {
+		log.Printf("Error loading offline messages: %v", err)
+	}
+	if h.offline == nil {
+		h.offline = make(map[string][]protocol.Frame)
+	}
+	for _, queue := range h.offline {
+		for _, f := range queue {
+			h.bumpMessageID(f.ID)
+		}
+	}
+}
+
+// Caller holds offlineMu.
+func (h *Hub) saveOfflineLocked() {
+	if err := h.saveJSON(offlineFile, h.offline); err != nil {
+		log.Printf("Error persisting offline messages: %v", err)
+	}
+}
@@ -0,0 +1,94 @@
+package hub
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"go-chat-app/internal/protocol"
+)
+
+const maxPins = 50
+
+var (
+	ErrNotFound      = errors.New("no such message in this room")
+	errAlreadyPinned = errors.New("message is already pinned")
+	errNotPinned     = errors.New("message is not pinned")
+	errTooManyPins   = fmt.Errorf("a room can have at most %d pins", maxPins)
+	errBadReaction   = errors.New("a reaction is a single emoji or :shortcode:")
+	errReactionsOff  = errors.New("reactions are turned off in this room")
+	errNoFeature     = errors.New("unknown feature, use reactions, uploads or link_previews")
+)
+
+// ######################################################################
+// function: pinMessage()
+// ######################################################################
+// Pins a message from the room's history. The whole message is kept, so
+// the pin outlives the history buffer and restarts.
+func (h *Hub) pinMessage(room *Room, id int64, by *Chatter) error {
+	h.mu.Lock()
+	for _, p := range room.pins {
+		if p.ID == id {
+			h.mu.Unlock()
+			return errAlreadyPinned
+		}
+	}
+	if len(room.pins) >= maxPins {
+		h.mu.Unlock()
+		return errTooManyPins
+	}
+	f, ok := room.findLocked(id)
+	if !ok {
+		h.mu.Unlock()
+		return ErrNotFound
+	}
+	f.Ack = false
+	room.pins = append(room.pins, f)
+	if err := h.saveRoomsLocked(); err != nil {
+		log.Printf("Error persisting rooms: %v", err)
+	}
+	h.mu.Unlock()
+
+	h.broadcastRoom(room, protocol.Frame{Type: protocol.FramePinned, Room: room.name, From: by.Username, Pins: []protocol.Frame{f}}, nil)
+	return nil
+}
+
+// ######################################################################
+// function: unpinMessage()
+// ######################################################################
+func (h *Hub) unpinMessage(room *Room, id int64, by *Chatter) error {
+	h.mu.Lock()
+	found := false
+	for i, p := range room.pins {
+		if p.ID == id {
+			room.pins = append(room.pins[:i], room.pins[i+1:]...)
+			found = true
+			break
+		}
+	}
+	if !found {
+		h.mu.Unlock()
+		return errNotPinned
+	}
+	if err := h.saveRoomsLocked(); err != nil {
+		log.Printf("Error persisting rooms: %v", err)
+	}
+	h.mu.Unlock()
+
+	h.broadcastRoom(room, protocol.Frame{Type: protocol.FrameUnpinned, Room: room.name, From: by.Username, ID: id}, nil)
+	return nil
+}
+
+// ######################################################################
+// function: sendPins()
+// ######################################################################
+// Delivers the room's pinned messages to a member, done on join.
+func (h *Hub) sendPins(chatter *Chatter, room *Room) {
+	h.mu.Lock()
+	pins := append([]protocol.Frame(nil), room.pins...)
+	h.mu.Unlock()
+
+	if len(pins) > 0 {
+		chatter.Send(protocol.Frame{Type: protocol.FramePins, Room: room.name, Pins: pins})
+	}
+}
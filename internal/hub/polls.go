@@ -0,0 +1,293 @@
+package hub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"go-chat-app/internal/protocol"
+)
+
+// /poll posts a question with options as a poll frame, which has a
+// message ID like any chat line. Votes come as vote frames, or /vote from
+// text clients: one per signed in account or session, a new one replaces
+// it. Every vote sends the room the new results. A poll closes when its
+// time is up or with /endpoll, from the one who asked or a moderator.
+//
+// Open polls only live in memory, votes for one from before a restart are
+// refused.
+
+const (
+	defaultPollDuration = 24 * time.Hour
+	maxPollDuration     = 7 * 24 * time.Hour
+	maxPollQuestion     = 300
+	maxPollOption       = 100
+	maxPollOptions      = 10
+	maxPollsPerRoom     = 20
+)
+
+var (
+	errPollUsage    = errors.New(`usage: /poll [duration] "question" "option" "option"...`)
+	errNoPoll       = errors.New("no open poll with that ID in this room")
+	errPollOption   = errors.New("no such option in the poll")
+	errPollNotYours = errors.New("only who asked and moderators can end a poll")
+	errTooManyPolls = fmt.Errorf("a room can have %d open polls at a time", maxPollsPerRoom)
+)
+
+// ######################################################################
+// struct: poll
+// ######################################################################
+// Guarded by the hub mutex.
+type poll struct {
+	id       int64
+	room     *Room
+	from     string
+	owner    string // clientIDOwner of who asked
+	question string
+	options  []string
+	votes    map[string]int // voter -> option index
+	closes   time.Time
+	timer    *time.Timer
+}
+
+// Caller holds the mutex.
+func (p *poll) resultsLocked(closed bool) *protocol.Poll {
+	out := &protocol.Poll{Question: p.question, Options: make([]protocol.PollOption, len(p.options)), Closes: p.closes.UnixMilli(), Closed: closed}
+	for i, text := range p.options {
+		out.Options[i].Text = text
+	}
+	for _, i := range p.votes {
+		out.Options[i].Votes++
+	}
+	return out
+}
+
+// ######################################################################
+// function: parsePoll()
+// ######################################################################
+// [duration] "question" option... Options with spaces need quotes.
+func parsePoll(args string) (time.Duration, string, []string, error) {
+	words, err := quotedFields(args)
+	if err != nil || len(words) == 0 {
+		return 0, "", nil, errPollUsage
+	}
+	d := defaultPollDuration
+	if parsed, err := time.ParseDuration(words[0]); err == nil && !strings.HasPrefix(strings.TrimSpace(args), `"`) {
+		if parsed <= 0 || parsed > maxPollDuration {
+			return 0, "", nil, fmt.Errorf("a poll runs for up to %s", maxPollDuration)
+		}
+		d, words = parsed, words[1:]
+	}
+	if len(words) < 3 || len(words) > maxPollOptions+1 {
+		return 0, "", nil, fmt.Errorf("a poll has a question and 2 to %d options", maxPollOptions)
+	}
+	if utf8.RuneCountInString(words[0]) > maxPollQuestion {
+		return 0, "", nil, fmt.Errorf("the question can be %d characters", maxPollQuestion)
+	}
+	for _, option := range words[1:] {
+		if option == "" || utf8.RuneCountInString(option) > maxPollOption {
+			return 0, "", nil, fmt.Errorf("options are 1 to %d characters", maxPollOption)
+		}
+	}
+	return d, words[0], words[1:], nil
+}
+
+// Splits on spaces, keeping "quoted strings" together.
+func quotedFields(s string) ([]string, error) {
+	var fields []string
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimSpace(s) {
+		if s[0] != '"' {
+			end := strings.IndexAny(s, " \t")
+			if end < 0 {
+				end = len(s)
+			}
+			fields = append(fields, s[:end])
+			s = s[end:]
+			continue
+		}
+		end := strings.IndexByte(s[1:], '"')
+		if end < 0 {
+			return nil, errPollUsage
+		}
+		fields = append(fields, strings.TrimSpace(s[1:end+1]))
+		s = s[end+2:]
+	}
+	return fields, nil
+}
+
+// ######################################################################
+// function: cmdPoll()
+// ######################################################################
+func (h *Hub) cmdPoll(chatter *Chatter, args string) bool {
+	d, question, options, err := parsePoll(args)
+	if err != nil {
+		chatter.fail(err)
+		return false
+	}
+	if _, ok, struck := h.filterChat(chatter, question+"\n"+strings.Join(options, "\n")); !ok {
+		return struck
+	}
+
+	owner := h.clientIDOwner(chatter)
+	room := chatter.room
+	shadow := h.shadowBannedIn(chatter, room.name)
+	p := &poll{room: room, from: chatter.Username, owner: owner, question: question, options: options, votes: make(map[string]int), closes: time.Now().Add(d)}
+	h.mu.Lock()
+	open := 0
+	for _, other := range h.polls {
+		if other.room == room {
+			open++
+		}
+	}
+	if open >= maxPollsPerRoom {
+		h.mu.Unlock()
+		chatter.fail(errTooManyPolls)
+		return false
+	}
+	p.id = h.nextMessageID()
+	f := protocol.Frame{Type: protocol.FramePoll, ID: p.id, Room: room.name, From: chatter.Username, Text: question, Poll: p.resultsLocked(false), SentAt: time.Now()}
+	if shadow {
+		h.mu.Unlock()
+		h.echoShadow(chatter, f)
+		return false
+	}
+	h.polls[p.id] = p
+	room.recordLocked(f, h.cfg.HistorySize)
+	p.timer = time.AfterFunc(d, func() { h.closePoll(p.id) })
+	h.mu.Unlock()
+
+	h.broadcastRoom(room, f, nil)
+	h.storeMessage(context.Background(), f)
+	return false
+}
+
+// ######################################################################
+// function: Vote()
+// ######################################################################
+// option 1 is the first one. Voting again changes the vote.
+func (h *Hub) Vote(chatter *Chatter, id int64, option int) error {
+	voter := h.clientIDOwner(chatter)
+	h.mu.Lock()
+	p, ok := h.polls[id]
+	if !ok || p.room != chatter.room {
+		h.mu.Unlock()
+		return errNoPoll
+	}
+	if option < 1 || option > len(p.options) {
+		h.mu.Unlock()
+		return errPollOption
+	}
+	p.votes[voter] = option - 1
+	f := h.pollUpdateLocked(p, false)
+	h.mu.Unlock()
+
+	h.broadcastRoom(p.room, f, nil)
+	return nil
+}
+
+// The results frame, and the same in the room's history. Caller holds the
+// mutex.
+func (h *Hub) pollUpdateLocked(p *poll, closed bool) protocol.Frame {
+	results := p.resultsLocked(closed)
+	f := protocol.Frame{Type: protocol.FramePoll, ID: p.id, Room: p.room.name, From: p.from, Text: p.question, Poll: results}
+	if i := p.room.indexLocked(p.id); i >= 0 {
+		p.room.history[i].Poll = results
+		f.SentAt = p.room.history[i].SentAt
+		f.Reactions = make(map[string][]string, len(p.room.history[i].Reactions)) // stored, it mustn't lose them
+		for e, who := range p.room.history[i].Reactions {
+			f.Reactions[e] = who
+		}
+	}
+	return f
+}
+
+// ######################################################################
+// function: closePoll()
+// ######################################################################
+// Sends the final results, false if the poll was closed already.
+func (h *Hub) closePoll(id int64) bool {
+	h.mu.Lock()
+	p, ok := h.polls[id]
+	if !ok {
+		h.mu.Unlock()
+		return false
+	}
+	delete(h.polls, id)
+	p.timer.Stop()
+	f := h.pollUpdateLocked(p, true)
+	h.mu.Unlock()
+
+	h.broadcastRoom(p.room, f, nil)
+	h.storeMessage(context.Background(), f)
+	best, votes := -1, 0
+	for i, o := range f.Poll.Options {
+		if o.Votes > votes {
+			best, votes = i, o.Votes
+		}
+	}
+	if best < 0 {
+		h.broadcastRoom(p.room, protocol.Systemf(p.room.name, "The poll \"%s\" is closed, nobody voted.", p.question), nil)
+	} else {
+		h.broadcastRoom(p.room, protocol.Systemf(p.room.name, "The poll \"%s\" is closed: %s, with %d votes.", p.question, f.Poll.Options[best].Text, votes), nil)
+	}
+	return true
+}
+
+// ######################################################################
+// function: cmdVote()
+// ######################################################################
+// /vote <poll id> <option>, for clients that can't send vote frames.
+func (h *Hub) cmdVote(chatter *Chatter, args string) bool {
+	fields := strings.Fields(args)
+	if len(fields) != 2 {
+		chatter.SendError(protocol.CodeInvalid, "Usage: /vote <poll id> <option number>")
+		return false
+	}
+	id, err1 := strconv.ParseInt(fields[0], 10, 64)
+	option, err2 := strconv.Atoi(fields[1])
+	if err1 != nil || err2 != nil {
+		chatter.SendError(protocol.CodeInvalid, "Usage: /vote <poll id> <option number>")
+		return false
+	}
+	if err := h.Vote(chatter, id, option); err != nil {
+		chatter.fail(err)
+	}
+	return false
+}
+
+// ######################################################################
+// function: cmdEndPoll()
+// ######################################################################
+// /endpoll [id] closes the poll, the room's latest if no ID is given.
+func (h *Hub) cmdEndPoll(chatter *Chatter, args string) bool {
+	owner := h.clientIDOwner(chatter)
+	moderator := h.isModerator(chatter, chatter.room)
+	h.mu.Lock()
+	var p *poll
+	if id, err := strconv.ParseInt(strings.TrimSpace(args), 10, 64); err == nil {
+		p = h.polls[id]
+	} else if strings.TrimSpace(args) == "" {
+		for _, other := range h.polls {
+			if other.room == chatter.room && (p == nil || other.id > p.id) {
+				p = other
+			}
+		}
+	}
+	switch {
+	case p == nil || p.room != chatter.room:
+		h.mu.Unlock()
+		chatter.fail(errNoPoll)
+		return false
+	case p.owner != owner && !moderator:
+		h.mu.Unlock()
+		chatter.fail(errPollNotYours)
+		return false
+	}
+	h.mu.Unlock()
+	h.closePoll(p.id)
+	return false
+}
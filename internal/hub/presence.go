@@ -0,0 +1,219 @@
+package hub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"go-chat-app/internal/protocol"
+)
+
+// Presence states, from most to least attentive
+const (
+	presenceActive  = "active"  // heartbeat says the app is focused
+	presenceAway    = "away"    // heartbeat says the app is in the background
+	presenceIdle    = "idle"    // heartbeats stopped, the socket may be a zombie
+	presenceOnline  = "online"  // connected, client never sent a heartbeat
+	presenceOffline = "offline" // sent once when the chatter leaves
+)
+
+// Availability is what the user says, or what we guess after cfg.AutoAway
+// without them doing anything. Presence is what the client app reports.
+const (
+	availableNow  = "available"
+	availableAway = "away"
+)
+
+const maxStatusLen = 100
+
+var errStatusLength = fmt.Errorf("a status can be at most %d characters", maxStatusLen)
+
+// ######################################################################
+// function: heartbeat()
+// ######################################################################
+// Records the client's reported state and tells the room if the chatter's
+// presence changed because of it.
+func (h *Hub) heartbeat(chatter *Chatter, state string, batterySaver bool) {
+	h.mu.Lock()
+	chatter.lastHeartbeat = time.Now()
+	chatter.focused = state == "focused" || state == presenceActive
+	chatter.batterySaver = batterySaver
+	changed := chatter.updatePresenceLocked(h.cfg.HeartbeatTimeout)
+	h.mu.Unlock()
+
+	if changed {
+		h.broadcastPresence(chatter)
+	}
+}
+
+// ######################################################################
+// function: updatePresenceLocked()
+// ######################################################################
+// Derives the presence from the last heartbeat, true if it changed.
+// No heartbeat for timeout means idle.
+// Caller holds the mutex.
+func (c *Chatter) updatePresenceLocked(timeout time.Duration) bool {
+	presence := presenceOnline
+	switch {
+	case c.lastHeartbeat.IsZero():
+	case time.Since(c.lastHeartbeat) > timeout:
+		presence = presenceIdle
+	case c.focused:
+		presence = presenceActive
+	default:
+		presence = presenceAway
+	}
+	if presence == c.presence {
+		return false
+	}
+	c.presence = presence
+	return true
+}
+
+// ######################################################################
+// function: setAway()
+// ######################################################################
+// /away and /back. A reason shows as the status while away.
+func (h *Hub) setAway(chatter *Chatter, away bool, reason string) error {
+	reason = strings.TrimSpace(reason)
+	if utf8.RuneCountInString(reason) > maxStatusLen {
+		return errStatusLength
+	}
+	h.mu.Lock()
+	chatter.away, chatter.autoAway, chatter.awayReason = away, false, reason
+	h.mu.Unlock()
+	h.broadcastPresence(chatter)
+	return nil
+}
+
+// ######################################################################
+// function: setStatus()
+// ######################################################################
+// "" clears it.
+func (h *Hub) setStatus(chatter *Chatter, status string) error {
+	status = strings.TrimSpace(status)
+	if utf8.RuneCountInString(status) > maxStatusLen {
+		return errStatusLength
+	}
+	if strings.ContainsFunc(status, func(r rune) bool { return r < ' ' }) {
+		return errors.New("a status is a single line")
+	}
+	h.mu.Lock()
+	chatter.status = status
+	h.mu.Unlock()
+	h.broadcastPresence(chatter)
+	return nil
+}
+
+// ######################################################################
+// function: noteActivity()
+// ######################################################################
+// The user did something: sent a line, a command or a reaction. Heartbeats
+// and acks don't count, apps send those by themselves. Ends an automatic
+// away, a chosen one stays until /back.
+func (h *Hub) noteActivity(chatter *Chatter) {
+	h.mu.Lock()
+	chatter.lastActivity = time.Now()
+	back := chatter.autoAway
+	if back {
+		chatter.away, chatter.autoAway = false, false
+	}
+	h.mu.Unlock()
+	if back {
+		h.broadcastPresence(chatter)
+	}
+}
+
+// Turns the chatter away after autoAway without activity, true if it did.
+// Caller holds the mutex.
+func (c *Chatter) updateAutoAwayLocked(autoAway time.Duration) bool {
+	if autoAway <= 0 || c.away || time.Since(c.lastActivity) < autoAway {
+		return false
+	}
+	c.away, c.autoAway = true, true
+	return true
+}
+
+// What others see as the chatter's availability and status line.
+// Caller holds the mutex.
+func (c *Chatter) availabilityLocked() (string, string) {
+	if !c.away {
+		return availableNow, c.status
+	}
+	if c.awayReason != "" {
+		return availableAway, c.awayReason
+	}
+	return availableAway, c.status
+}
+
+// ######################################################################
+// function: activelyViewingLocked()
+// ######################################################################
+// True if someone is looking at the chat right now. Caller holds the mutex.
+func (c *Chatter) activelyViewingLocked() bool {
+	return c.presence == presenceActive
+}
+
+// ######################################################################
+// function: wantsBackgroundNoiseLocked()
+// ######################################################################
+// Clients in the background with battery saver on skip frames that only
+// matter on screen (user counts, ack sampling). Caller holds the mutex.
+func (c *Chatter) wantsBackgroundNoiseLocked() bool {
+	return !(c.batterySaver && c.presence != presenceActive)
+}
+
+// ######################################################################
+// function: presenceLoop()
+// ######################################################################
+// Turns chatters whose heartbeats stopped idle, and those who haven't done
+// anything for cfg.AutoAway away.
+func (h *Hub) presenceLoop(ctx context.Context) {
+	ticker := time.NewTicker(h.cfg.HeartbeatTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		var changed []*Chatter
+		h.mu.Lock()
+		for _, chatter := range h.chatters.all() {
+			presence := chatter.updatePresenceLocked(h.cfg.HeartbeatTimeout)
+			if away := chatter.updateAutoAwayLocked(h.cfg.AutoAway); presence || away {
+				changed = append(changed, chatter)
+			}
+		}
+		h.mu.Unlock()
+
+		for _, chatter := range changed {
+			h.broadcastPresence(chatter)
+		}
+	}
+}
+
+// ######################################################################
+// function: broadcastPresence()
+// ######################################################################
+func (h *Hub) broadcastPresence(chatter *Chatter) {
+	h.mu.Lock()
+	room, presence := chatter.room, h.accountPresenceLocked(chatter)
+	availability, status := chatter.availabilityLocked()
+	h.mu.Unlock()
+	if room != nil {
+		h.broadcastRoom(room, protocol.Frame{
+			Type:         protocol.FramePresence,
+			Room:         room.name,
+			From:         chatter.Username,
+			Text:         presence,
+			Profile:      h.profileOf(chatter),
+			Color:        h.colorOf(chatter),
+			Availability: availability,
+			Status:       status,
+		}, nil)
+	}
+}
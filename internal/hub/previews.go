@@ -0,0 +1,66 @@
+package hub
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go-chat-app/internal/preview"
+	"go-chat-app/internal/protocol"
+)
+
+// Longest a late preview is waited for
+const previewTimeout = 10 * time.Second
+
+// ######################################################################
+// function: linkPreview()
+// ######################################################################
+// The link in text that gets a preview, "" if none does (no link, no
+// fetcher, or the room's policy is against it), and the preview if it
+// was fetched lately. fetch says it wasn't.
+func (h *Hub) linkPreview(room *Room, text string) (link string, p *protocol.LinkPreview, fetch bool) {
+	if h.cfg.Previews == nil {
+		return "", nil, false
+	}
+	if link = preview.FindURL(text); link == "" {
+		return "", nil, false
+	}
+	h.mu.Lock()
+	allowed := room.meta.Policy.Allows(protocol.FeatureLinkPreviews)
+	h.mu.Unlock()
+	if !allowed {
+		return "", nil, false
+	}
+	p, cached := h.cfg.Previews.Cached(link)
+	return link, p, !cached
+}
+
+// ######################################################################
+// function: fetchPreview()
+// ######################################################################
+// Fetches the preview of a message that went out without one, and sends
+// it to the room in a preview frame. History gets it too.
+func (h *Hub) fetchPreview(room *Room, id int64, link string) {
+	ctx, cancel := context.WithTimeout(context.Background(), previewTimeout)
+	defer cancel()
+	p, err := h.cfg.Previews.Fetch(ctx, link)
+	if err != nil {
+		log.Printf("Error fetching link preview of %s: %v", link, err)
+	}
+	if p == nil {
+		return
+	}
+
+	h.mu.Lock()
+	i := room.indexLocked(id)
+	if i < 0 {
+		h.mu.Unlock()
+		return // deleted in the meantime, or out of history already
+	}
+	room.history[i].Preview = p
+	stored := room.history[i]
+	h.mu.Unlock()
+
+	h.broadcastRoom(room, protocol.Frame{Type: protocol.FramePreview, Room: room.name, ID: id, Preview: p}, nil)
+	h.storeMessage(ctx, stored)
+}
@@ -0,0 +1,140 @@
+package hub
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+
+	"go-chat-app/internal/i18n"
+	"go-chat-app/internal/protocol"
+)
+
+const (
+	maxDisplayName = 64
+	maxBio         = 280
+	maxAvatarURL   = 512
+)
+
+var (
+	errDisplayName = fmt.Errorf("display name can be at most %d characters", maxDisplayName)
+	errBio         = fmt.Errorf("bio can be at most %d characters", maxBio)
+	errAvatarURL   = fmt.Errorf("avatar url must be http or https and at most %d characters", maxAvatarURL)
+)
+
+// ######################################################################
+// function: SetProfile()
+// ######################################################################
+// Replaces the account's profile. Rooms its connections are in get a
+// presence frame with the new one.
+func (h *Hub) SetProfile(id string, p protocol.Profile) (protocol.Profile, error) {
+	p.DisplayName, p.Bio, p.AvatarURL = strings.TrimSpace(p.DisplayName), strings.TrimSpace(p.Bio), strings.TrimSpace(p.AvatarURL)
+	if utf8.RuneCountInString(p.DisplayName) > maxDisplayName {
+		return protocol.Profile{}, errDisplayName
+	}
+	if utf8.RuneCountInString(p.Bio) > maxBio {
+		return protocol.Profile{}, errBio
+	}
+	if p.AvatarURL != "" {
+		u, err := url.Parse(p.AvatarURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || len(p.AvatarURL) > maxAvatarURL {
+			return protocol.Profile{}, errAvatarURL
+		}
+	}
+
+	h.accountsMu.Lock()
+	a, ok := h.accounts[id]
+	if !ok {
+		h.accountsMu.Unlock()
+		return protocol.Profile{}, ErrNoAccount
+	}
+	a.DisplayName, a.AvatarURL, a.Bio = p.DisplayName, p.AvatarURL, p.Bio
+	h.saveAccountsLocked()
+	p = a.Profile()
+	h.accountsMu.Unlock()
+
+	for _, chatter := range h.accountChatters(id) {
+		h.broadcastPresence(chatter)
+	}
+	return p, nil
+}
+
+// ######################################################################
+// function: profileOf()
+// ######################################################################
+// The profile of the chatter's account, nil for guests.
+func (h *Hub) profileOf(chatter *Chatter) *protocol.Profile {
+	h.mu.Lock()
+	id := chatter.account
+	h.mu.Unlock()
+	if id == "" {
+		return nil
+	}
+	h.accountsMu.Lock()
+	defer h.accountsMu.Unlock()
+	a, ok := h.accounts[id]
+	if !ok {
+		return nil
+	}
+	p := a.Profile()
+	return &p
+}
+
+// ######################################################################
+// function: whois()
+// ######################################################################
+// What there is to know about name: the profile if it is an account, and
+// where it is if it is online.
+func (h *Hub) whois(chatter *Chatter, name string) {
+	online := h.findChatters(name)
+	var profile *protocol.Profile
+	if id, ok := h.accountNamed(name); ok {
+		h.accountsMu.Lock()
+		if a, ok := h.accounts[id]; ok {
+			p := a.Profile()
+			profile = &p
+		}
+		h.accountsMu.Unlock()
+	}
+	if profile == nil && len(online) == 0 {
+		chatter.SendError(protocol.CodeUserNotFound, "No user named %s.", name)
+		return
+	}
+
+	if profile == nil {
+		chatter.SendSystem("%s is a guest.", name)
+	} else {
+		if profile.DisplayName != "" {
+			chatter.SendSystem("%s is %s.", name, profile.DisplayName)
+		}
+		if profile.Bio != "" {
+			chatter.SendSystem("Bio: %s", profile.Bio)
+		}
+		if profile.AvatarURL != "" {
+			chatter.SendSystem("Avatar: %s", profile.AvatarURL)
+		}
+		chatter.SendSystem("%s has been a member since %s.", name, profile.Joined.Format("2006-01-02"))
+	}
+
+	if len(online) == 0 {
+		chatter.SendSystem("%s is offline.", name)
+		return
+	}
+	h.mu.Lock()
+	var rooms []string
+	presence := online[0].presence
+	availability, status := online[0].availabilityLocked()
+	for _, c := range online {
+		if c.room != nil {
+			rooms = append(rooms, "#"+c.room.name)
+		}
+	}
+	h.mu.Unlock()
+	if availability == availableAway {
+		presence = availableAway
+	}
+	chatter.SendSystem("%s is %s in %s.", name, i18n.Localized(presence), strings.Join(rooms, ", "))
+	if status != "" {
+		chatter.SendSystem("Status: %s", status)
+	}
+}
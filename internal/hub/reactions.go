@@ -0,0 +1,172 @@
+package hub
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"go-chat-app/internal/protocol"
+)
+
+const maxReactionLen = 32 // bytes, enough for any emoji sequence or a :shortcode:
+
+// ######################################################################
+// function: toggleReaction()
+// ######################################################################
+// Adds the chatter's reaction to a message in its room, or takes it back if
+// it was already there, and tells the room the new count.
+func (h *Hub) toggleReaction(chatter *Chatter, id int64, emoji string) error {
+	emoji = strings.TrimSpace(emoji)
+	if emoji == "" || len(emoji) > maxReactionLen || !utf8.ValidString(emoji) {
+		return errBadReaction
+	}
+	room := chatter.room
+
+	h.mu.Lock()
+	if !room.meta.Policy.Allows(protocol.FeatureReactions) {
+		h.mu.Unlock()
+		return errReactionsOff
+	}
+	i := room.indexLocked(id)
+	if i < 0 {
+		h.mu.Unlock()
+		return ErrNotFound
+	}
+	msg := &room.history[i]
+	if msg.Reactions == nil {
+		msg.Reactions = make(map[string][]string)
+	}
+	users := msg.Reactions[emoji]
+	removed := false
+	for j, u := range users {
+		if u == chatter.Username {
+			users = append(users[:j:j], users[j+1:]...)
+			removed = true
+			break
+		}
+	}
+	if !removed {
+		users = append(users, chatter.Username)
+	}
+	if len(users) == 0 {
+		delete(msg.Reactions, emoji)
+	} else {
+		msg.Reactions[emoji] = users
+	}
+	count := len(users)
+	stored := *msg
+	stored.Reactions = make(map[string][]string, len(msg.Reactions)) // msg changes under the mutex
+	for e, who := range msg.Reactions {
+		stored.Reactions[e] = who
+	}
+	h.mu.Unlock()
+
+	h.broadcastRoom(room, protocol.Frame{Type: protocol.FrameReaction, Room: room.name, ID: id, From: chatter.Username, Text: emoji, Count: count}, nil)
+	h.storeMessage(context.Background(), stored)
+	return nil
+}
+
+// ######################################################################
+// function: indexLocked()
+// ######################################################################
+// Position of the message in the room's history, -1 if it is gone.
+// Caller holds the mutex.
+func (room *Room) indexLocked(id int64) int {
+	for i := len(room.history) - 1; i >= 0; i-- {
+		if room.history[i].ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// ######################################################################
+// struct: Insights
+// ######################################################################
+// Community stats for a room over a period, computed from its history.
+type Insights struct {
+	Room          string         `json:"room"`
+	Since         time.Time      `json:"since"`
+	Messages      int            `json:"messages"`
+	MostReacted   []reactedEntry `json:"most_reacted"`
+	MostActive    []memberEntry  `json:"most_active"`
+	BusiestThread []threadEntry  `json:"busiest_threads"`
+}
+
+type reactedEntry struct {
+	ID        int64  `json:"id"`
+	From      string `json:"from"`
+	Text      string `json:"text"`
+	Reactions int    `json:"reactions"`
+}
+
+type memberEntry struct {
+	Username string `json:"username"`
+	Messages int    `json:"messages"`
+}
+
+type threadEntry struct {
+	ID      int64  `json:"id"`
+	From    string `json:"from"`
+	Text    string `json:"text"`
+	Replies int    `json:"replies"`
+}
+
+// ######################################################################
+// function: insightsLocked()
+// ######################################################################
+// top caps every leaderboard. Caller holds the mutex.
+func (room *Room) insightsLocked(since time.Time, top int) Insights {
+	in := Insights{Room: room.name, Since: since}
+	active := make(map[string]int)
+	replies := make(map[int64]int) // thread root -> replies
+	root := make(map[int64]int64)  // message -> its thread root
+	byID := make(map[int64]protocol.Frame)
+
+	for _, f := range room.history {
+		byID[f.ID] = f
+		if f.ReplyTo != 0 {
+			if r, ok := root[f.ReplyTo]; ok {
+				root[f.ID] = r
+			} else {
+				root[f.ID] = f.ReplyTo
+			}
+		} else {
+			root[f.ID] = f.ID
+		}
+		if f.SentAt.Before(since) {
+			continue
+		}
+
+		in.Messages++
+		active[f.From]++
+		if f.ReplyTo != 0 {
+			replies[root[f.ID]]++
+		}
+		reactions := 0
+		for _, users := range f.Reactions {
+			reactions += len(users)
+		}
+		if reactions > 0 {
+			in.MostReacted = append(in.MostReacted, reactedEntry{ID: f.ID, From: f.From, Text: f.Text, Reactions: reactions})
+		}
+	}
+
+	for username, n := range active {
+		in.MostActive = append(in.MostActive, memberEntry{Username: username, Messages: n})
+	}
+	for id, n := range replies {
+		f := byID[id] // zero if the root already scrolled out of history
+		in.BusiestThread = append(in.BusiestThread, threadEntry{ID: id, From: f.From, Text: f.Text, Replies: n})
+	}
+
+	sort.Slice(in.MostReacted, func(i, j int) bool { return in.MostReacted[i].Reactions > in.MostReacted[j].Reactions })
+	sort.Slice(in.MostActive, func(i, j int) bool { return in.MostActive[i].Messages > in.MostActive[j].Messages })
+	sort.Slice(in.BusiestThread, func(i, j int) bool { return in.BusiestThread[i].Replies > in.BusiestThread[j].Replies })
+	in.MostReacted = in.MostReacted[:min(top, len(in.MostReacted))]
+	in.MostActive = in.MostActive[:min(top, len(in.MostActive))]
+	in.BusiestThread = in.BusiestThread[:min(top, len(in.BusiestThread))]
+	return in
+}
@@ -0,0 +1,141 @@
+package hub
+
+import (
+	"errors"
+	"log"
+	"strings"
+
+	"go-chat-app/internal/protocol"
+)
+
+const readMarksFile = "readmarks.json"
+
+var errReadMarkID = errors.New("there is no message with that ID yet")
+
+// ######################################################################
+// function: markRead()
+// ######################################################################
+// Everything in room up to message id has been read, "" is the chatter's
+// current room. Marks only move forward. Accounts keep theirs across
+// connections and restarts, and their other devices find them in
+// /api/sync. Guests lose them when they disconnect.
+func (h *Hub) markRead(chatter *Chatter, roomName string, id int64) error {
+	if id <= 0 || id > h.lastMessageID.Load() {
+		return errReadMarkID
+	}
+	h.mu.Lock()
+	if roomName == "" && chatter.room != nil {
+		roomName = chatter.room.name
+	}
+	roomName = strings.ToLower(roomName)
+	if _, ok := h.rooms[roomName]; !ok {
+		h.mu.Unlock()
+		return ErrNoRoom
+	}
+	account := chatter.account
+	if account == "" {
+		if chatter.readMarks == nil {
+			chatter.readMarks = make(map[string]int64)
+		}
+		if id > chatter.readMarks[roomName] {
+			chatter.readMarks[roomName] = id
+		}
+		h.mu.Unlock()
+		return nil
+	}
+	h.mu.Unlock()
+
+	h.readMarksMu.Lock()
+	marks := h.readMarks[account]
+	if id <= marks[roomName] {
+		h.readMarksMu.Unlock()
+		return nil
+	}
+	if marks == nil {
+		marks = make(map[string]int64)
+		h.readMarks[account] = marks
+	}
+	marks[roomName] = id
+	h.saveReadMarksLocked()
+	h.readMarksMu.Unlock()
+
+	h.mu.Lock()
+	h.recordReadLocked(account, roomName, id)
+	h.mu.Unlock()
+	return nil
+}
+
+// ######################################################################
+// function: readMarksOf()
+// ######################################################################
+// A copy of the chatter's marks, room -> last read message ID.
+func (h *Hub) readMarksOf(chatter *Chatter) map[string]int64 {
+	h.mu.Lock()
+	account := chatter.account
+	marks := make(map[string]int64, len(chatter.readMarks))
+	for room, id := range chatter.readMarks {
+		marks[room] = id
+	}
+	h.mu.Unlock()
+
+	if account != "" {
+		h.readMarksMu.Lock()
+		for room, id := range h.readMarks[account] {
+			marks[room] = id
+		}
+		h.readMarksMu.Unlock()
+	}
+	return marks
+}
+
+// ######################################################################
+// function: sendRooms()
+// ######################################################################
+// The room list with members per room, and for every room the chatter has
+// marked read how many messages came after. Only the room history is
+// counted, so the count tops out at cfg.HistorySize. The chatter's own
+// messages and those of users they ignore don't count.
+func (h *Hub) sendRooms(chatter *Chatter) {
+	marks := h.readMarksOf(chatter)
+	h.mu.Lock()
+	f := protocol.Frame{Type: protocol.FrameRooms, Rooms: make(map[string]int, len(h.rooms)), Unread: make(map[string]int, len(marks))}
+	for name, room := range h.rooms {
+		if n := room.membersLocked(); n > 0 {
+			f.Rooms[name] = n
+		}
+		last, ok := marks[name]
+		if !ok {
+			continue
+		}
+		unread := 0
+		for _, m := range room.history {
+			if m.ID > last && m.From != chatter.Username && !chatter.ignoring[m.From] {
+				unread++
+			}
+		}
+		f.Unread[name] = unread
+	}
+	h.mu.Unlock()
+	chatter.Send(f)
+}
+
+// ######################################################################
+// function: loadReadMarks()
+// ######################################################################
+func (h *Hub) loadReadMarks() {
+	h.readMarksMu.Lock()
+	defer h.readMarksMu.Unlock()
+	if err := h.loadJSON(readMarksFile, &h.readMarks); err != nil {
+		log.Printf("Error loading read markers: %v", err)
+	}
+	if h.readMarks == nil {
+		h.readMarks = make(map[string]map[string]int64)
+	}
+}
+
+// Caller holds readMarksMu.
+func (h *Hub) saveReadMarksLocked() {
+	if err := h.saveJSON(readMarksFile, h.readMarks); err != nil {
+		log.Printf("Error persisting read markers: %v", err)
+	}
+}
@@ -0,0 +1,195 @@
+package hub
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"go-chat-app/internal/i18n"
+	"go-chat-app/internal/protocol"
+)
+
+const recurringFile = "recurring.json"
+
+// ######################################################################
+// struct: RecurringAnnouncement
+// ######################################################################
+// An announcement that goes out whenever Spec matches the wall clock of
+// TimeZone, so "0 9 * * 1" stays at nine on mondays across DST changes.
+// Texts has a version per locale, everyone else gets Text.
+type RecurringAnnouncement struct {
+	ID       string            `json:"id"`
+	Room     string            `json:"room,omitempty"` // "" = everyone connected
+	From     string            `json:"from"`
+	Text     string            `json:"text"`
+	Texts    map[string]string `json:"texts,omitempty"`
+	Spec     string            `json:"spec"`
+	TimeZone string            `json:"time_zone"`
+	Next     time.Time         `json:"next"`
+
+	cron *cronSpec
+	loc  *time.Location
+}
+
+// ######################################################################
+// function: prepare()
+// ######################################################################
+// Checks spec, time zone and locales and works out the next run after now.
+func (a *RecurringAnnouncement) prepare(now time.Time) error {
+	cron, err := parseCron(a.Spec)
+	if err != nil {
+		return err
+	}
+	if a.TimeZone == "" {
+		a.TimeZone = "UTC"
+	}
+	loc, err := time.LoadLocation(a.TimeZone)
+	if err != nil {
+		return fmt.Errorf("unknown time zone %q", a.TimeZone)
+	}
+	for locale := range a.Texts {
+		if i18n.Supported(locale) != locale {
+			return fmt.Errorf("unsupported locale %q", locale)
+		}
+	}
+	a.cron, a.loc = cron, loc
+	a.Next = cron.next(now, loc)
+	if a.Next.IsZero() {
+		return fmt.Errorf("spec %q never matches", a.Spec)
+	}
+	return nil
+}
+
+// ######################################################################
+// function: AddRecurring()
+// ######################################################################
+func (h *Hub) AddRecurring(a RecurringAnnouncement) (RecurringAnnouncement, error) {
+	if err := a.prepare(time.Now()); err != nil {
+		return RecurringAnnouncement{}, err
+	}
+	a.ID = randomToken(6)
+
+	h.scheduleMu.Lock()
+	defer h.scheduleMu.Unlock()
+	h.recurring[a.ID] = a
+	h.saveRecurringLocked()
+	return a, nil
+}
+
+// ######################################################################
+// function: RemoveRecurring()
+// ######################################################################
+func (h *Hub) RemoveRecurring(id string) bool {
+	h.scheduleMu.Lock()
+	defer h.scheduleMu.Unlock()
+	if _, ok := h.recurring[id]; !ok {
+		return false
+	}
+	delete(h.recurring, id)
+	h.saveRecurringLocked()
+	return true
+}
+
+// ######################################################################
+// function: RecurringAnnouncements()
+// ######################################################################
+// Everything set up, the next one to go out first.
+func (h *Hub) RecurringAnnouncements() []RecurringAnnouncement {
+	h.scheduleMu.Lock()
+	list := make([]RecurringAnnouncement, 0, len(h.recurring))
+	for _, a := range h.recurring {
+		list = append(list, a)
+	}
+	h.scheduleMu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Next.Before(list[j].Next) })
+	return list
+}
+
+func (h *Hub) saveRecurringLocked() {
+	if err := h.saveJSON(recurringFile, h.recurring); err != nil {
+		log.Printf("Error persisting recurring announcements: %v", err)
+	}
+}
+
+// ######################################################################
+// function: loadRecurring()
+// ######################################################################
+// Unlike one-off messages, runs missed while the server was down are
+// skipped: nobody wants last week's "standup in 5 minutes".
+func (h *Hub) loadRecurring() {
+	h.scheduleMu.Lock()
+	defer h.scheduleMu.Unlock()
+	if err := h.loadJSON(recurringFile, &h.recurring); err != nil {
+		log.Printf("Error loading recurring announcements: %v", err)
+	}
+	if h.recurring == nil {
+		h.recurring = make(map[string]RecurringAnnouncement)
+	}
+	now := time.Now()
+	for id, a := range h.recurring {
+		if err := a.prepare(now); err != nil {
+			log.Printf("Error loading recurring announcement %s, dropping it: %v", id, err)
+			delete(h.recurring, id)
+			continue
+		}
+		h.recurring[id] = a
+	}
+}
+
+// ######################################################################
+// function: runRecurring()
+// ######################################################################
+// Called by scheduleLoop every tick. There is no leader election, every
+// server runs its own scheduler: fine for the one node the chat runs as,
+// but servers set up with the same recurring.json would each send them.
+func (h *Hub) runRecurring(now time.Time) {
+	var due []RecurringAnnouncement
+	h.scheduleMu.Lock()
+	for id, a := range h.recurring {
+		if !a.Next.After(now) {
+			due = append(due, a)
+			a.Next = a.cron.next(now, a.loc)
+			h.recurring[id] = a
+		}
+	}
+	h.scheduleMu.Unlock()
+
+	for _, a := range due {
+		h.announceLocalized(a)
+	}
+}
+
+// ######################################################################
+// function: announceLocalized()
+// ######################################################################
+func (h *Hub) announceLocalized(a RecurringAnnouncement) {
+	log.Printf("Recurring announcement %s from %s in %q", a.ID, a.From, a.Room)
+	f := protocol.Frame{Type: protocol.FrameAnnouncement, Room: a.Room, From: a.From, Text: a.Text}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var recipients []*Chatter
+	if a.Room == "" {
+		recipients = h.chatters.all()
+	} else {
+		room, ok := h.rooms[a.Room]
+		if !ok {
+			return
+		}
+		room.notifyWatchersLocked(f)
+		for chatter := range room.members {
+			recipients = append(recipients, chatter)
+		}
+	}
+	for _, chatter := range recipients {
+		out := f
+		if text, ok := a.Texts[chatter.Locale()]; ok {
+			out.Text = text
+		}
+		if err := chatter.Send(out); err != nil {
+			log.Printf("Error: %v", err)
+			h.dropChatterLocked(chatter)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package hub
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Shards of the connection registry, a power of two
+const registryShards = 32
+
+// ######################################################################
+// struct: registry
+// ######################################################################
+// Every open connection, split over shards with a lock each so connects
+// and disconnects don't queue up behind the hub mutex or each other. The
+// registry only knows who is connected: rooms and the chatters' own fields
+// are still guarded by the hub mutex.
+type registry struct {
+	shards [registryShards]registryShard
+	count  atomic.Int64
+}
+
+type registryShard struct {
+	mu       sync.Mutex
+	chatters map[*Chatter]bool
+}
+
+func newRegistry() *registry {
+	r := &registry{}
+	for i := range r.shards {
+		r.shards[i].chatters = make(map[*Chatter]bool)
+	}
+	return r
+}
+
+func (r *registry) shard(chatter *Chatter) *registryShard {
+	return &r.shards[chatter.id&(registryShards-1)]
+}
+
+// add registers a new connection
+func (r *registry) add(chatter *Chatter) {
+	s := r.shard(chatter)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.chatters[chatter] {
+		s.chatters[chatter] = true
+		r.count.Add(1)
+	}
+}
+
+// remove is false if the chatter was already gone
+func (r *registry) remove(chatter *Chatter) bool {
+	s := r.shard(chatter)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.chatters[chatter] {
+		return false
+	}
+	delete(s.chatters, chatter)
+	r.count.Add(-1)
+	return true
+}
+
+func (r *registry) len() int {
+	return int(r.count.Load())
+}
+
+// all is everyone connected right now, one shard at a time
+func (r *registry) all() []*Chatter {
+	list := make([]*Chatter, 0, r.len())
+	for i := range r.shards {
+		s := &r.shards[i]
+		s.mu.Lock()
+		for chatter := range s.chatters {
+			list = append(list, chatter)
+		}
+		s.mu.Unlock()
+	}
+	return list
+}
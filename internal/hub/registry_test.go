@@ -0,0 +1,82 @@
+package hub
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// The registry as it was before sharding: one map behind one mutex
+type lockedRegistry struct {
+	mu       sync.Mutex
+	chatters map[*Chatter]bool
+}
+
+func (r *lockedRegistry) add(chatter *Chatter) {
+	r.mu.Lock()
+	r.chatters[chatter] = true
+	r.mu.Unlock()
+}
+
+func (r *lockedRegistry) remove(chatter *Chatter) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.chatters[chatter] {
+		return false
+	}
+	delete(r.chatters, chatter)
+	return true
+}
+
+// Connects and disconnects from every goroutine at once, as in a
+// reconnect storm
+func BenchmarkRegistryChurn(b *testing.B) {
+	var ids atomic.Int64
+	churn := func(b *testing.B, add func(*Chatter), remove func(*Chatter) bool) {
+		b.RunParallel(func(pb *testing.PB) {
+			mine := make([]*Chatter, 64)
+			for i := range mine {
+				mine[i] = &Chatter{id: ids.Add(1)}
+			}
+			for i := 0; pb.Next(); i++ {
+				chatter := mine[i%len(mine)]
+				add(chatter)
+				remove(chatter)
+			}
+		})
+	}
+	b.Run("single", func(b *testing.B) {
+		r := &lockedRegistry{chatters: make(map[*Chatter]bool)}
+		churn(b, r.add, r.remove)
+	})
+	b.Run("sharded", func(b *testing.B) {
+		r := newRegistry()
+		churn(b, r.add, r.remove)
+	})
+}
+
+func TestRegistry(t *testing.T) {
+	r := newRegistry()
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				chatter := &Chatter{id: int64(g*100 + i)}
+				r.add(chatter)
+				r.add(chatter)
+				if i%2 == 0 && !r.remove(chatter) {
+					t.Error("remove of a registered chatter failed")
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	if r.len() != 400 || len(r.all()) != 400 {
+		t.Fatalf("len %d, all %d, want 400", r.len(), len(r.all()))
+	}
+	if r.remove(&Chatter{id: 1}) {
+		t.Error("removed a chatter that was never added")
+	}
+}
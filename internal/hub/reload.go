@@ -0,0 +1,68 @@
+package hub
+
+import (
+	"log"
+)
+
+// What can change without a restart: the word list and the MOTD are read
+// from their files again, the IP and shadow ban lists from the store, for
+// when they were edited by hand or by another tool. Connected chatters keep
+// their connections and get the new rules with their next line.
+
+// ######################################################################
+// function: loadWordList()
+// ######################################################################
+// Reads cfg.WordList into bannedWords. A list that can't be read leaves
+// the one there was.
+func (h *Hub) loadWordList() {
+	words, err := readWordList(h.cfg.WordList)
+	if err != nil {
+		log.Printf("Error loading word list: %v", err)
+		return
+	}
+	h.mu.Lock()
+	h.bannedWords = words
+	h.mu.Unlock()
+}
+
+// ######################################################################
+// function: loadMOTD()
+// ######################################################################
+// Reads cfg.MOTDFile, keeping the MOTD there was if it can't. That's the
+// built in one on startup.
+func (h *Hub) loadMOTD() {
+	motd, err := readMOTD(h.cfg.MOTDFile)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err != nil {
+		log.Printf("Error loading MOTD, keeping the one there was: %v", err)
+		if h.motd == "" {
+			h.motd = defaultMOTD
+		}
+		return
+	}
+	h.motd = motd
+}
+
+// ######################################################################
+// function: Reload()
+// ######################################################################
+// Re-reads the word list, MOTD and ban lists and takes the new per-IP
+// connection cap. Connections already over it stay, new ones wait. by is
+// who asked, for the audit log.
+func (h *Hub) Reload(maxConnsPerIP int, by string) {
+	h.loadWordList()
+	h.loadMOTD()
+	h.loadBans()
+	h.loadShadowBans()
+
+	h.ipMu.Lock()
+	h.cfg.MaxConnsPerIP = maxConnsPerIP // only ever read under ipMu
+	h.ipMu.Unlock()
+
+	h.mu.Lock()
+	words := len(h.bannedWords)
+	h.mu.Unlock()
+	log.Printf("Reloaded: %d banned words, %d IP bans, %d shadow bans", words, len(h.Bans()), len(h.ShadowBans()))
+	h.Audit(AuditEntry{Actor: by, Action: "reload"})
+}
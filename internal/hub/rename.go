@@ -0,0 +1,51 @@
+package hub
+
+import (
+	"slices"
+	"time"
+
+	"go-chat-app/internal/protocol"
+)
+
+// ######################################################################
+// function: rename()
+// ######################################################################
+// /u <name>. The first rename of a connection is free, after that one per
+// cfg.RenameCooldown so nobody can hide behind a new name every message.
+// The room sees a rename frame with the old name in from and the new one
+// in text, webhooks a rename event per room. A signed in user is renamed on
+// all their devices.
+func (h *Hub) rename(chatter *Chatter, name string) {
+	if err := h.checkName(chatter, name); err != nil {
+		chatter.fail(err)
+		return
+	}
+	h.mu.Lock()
+	wait := h.cfg.RenameCooldown - time.Since(chatter.lastRename)
+	if !chatter.lastRename.IsZero() && wait > 0 {
+		h.mu.Unlock()
+		chatter.SendError(protocol.CodeRateLimited, "You can change your name again in %s.", wait.Round(time.Second))
+		return
+	}
+	old := chatter.Username
+	devices := h.devicesLocked(chatter)
+	var rooms []*Room
+	for _, c := range devices {
+		c.Username = name
+		c.lastRename = time.Now()
+		c.previousNames = append(c.previousNames, old)
+		if c.room != nil && !slices.Contains(rooms, c.room) {
+			rooms = append(rooms, c.room)
+		}
+	}
+	h.mu.Unlock()
+
+	h.Audit(AuditEntry{Actor: old, Action: "rename", Target: name, IP: chatter.IP})
+	for _, c := range devices {
+		c.SendSystem("Username set to %s", name)
+	}
+	for _, room := range rooms {
+		h.broadcastRoom(room, protocol.Frame{Type: protocol.FrameRename, Room: room.name, From: old, Text: name}, chatter)
+		h.emit(Event{Type: EventRename, Room: room.name, User: old, Text: name})
+	}
+}
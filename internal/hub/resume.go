@@ -0,0 +1,91 @@
+package hub
+
+import (
+	"time"
+
+	"go-chat-app/internal/protocol"
+)
+
+// Sessions also survive network blips, not just server restarts: a client
+// whose connection drops gets its session parked for cfg.ResumeWindow, and
+// reconnecting with ?sid= and the last message ID it saw (?last=) puts it
+// back in its room under its name, with whatever it missed from the room
+// history.
+
+// ######################################################################
+// function: parkSession()
+// ######################################################################
+// Keeps a dropped chatter's session around for a reconnect. Not for
+// chatters that quit, were kicked or were replaced by a newer connection.
+func (h *Hub) parkSession(chatter *Chatter) {
+	if h.cfg.ResumeWindow <= 0 {
+		return
+	}
+	h.mu.Lock()
+	if chatter.replaced || chatter.kicked || chatter.room == nil {
+		h.mu.Unlock()
+		return
+	}
+	session := snapshotSession{
+		Username:  chatter.Username,
+		Room:      chatter.room.name,
+		Moderator: chatter.room.moderators[chatter],
+		Strikes:   chatter.strikes,
+		expires:   time.Now().Add(h.cfg.ResumeWindow),
+	}
+	h.mu.Unlock()
+
+	h.restoredMu.Lock()
+	h.restored[chatter.SID] = session
+	h.restoredMu.Unlock()
+	time.AfterFunc(h.cfg.ResumeWindow, h.expireRestored)
+}
+
+// ######################################################################
+// function: takeOverSession()
+// ######################################################################
+// The old connection often isn't noticed as dead yet when the client is
+// already back. Then the new connection takes the session from it and the
+// old one is closed without being parked.
+func (h *Hub) takeOverSession(sid string) (snapshotSession, bool) {
+	if sid == "" || h.cfg.ResumeWindow <= 0 {
+		return snapshotSession{}, false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, chatter := range h.chatters.all() {
+		if chatter.SID != sid || chatter.room == nil || chatter.replaced {
+			continue
+		}
+		chatter.replaced = true
+		chatter.Close()
+		return snapshotSession{
+			Username:  chatter.Username,
+			Room:      chatter.room.name,
+			Moderator: chatter.room.moderators[chatter],
+			Strikes:   chatter.strikes,
+		}, true
+	}
+	return snapshotSession{}, false
+}
+
+// ######################################################################
+// function: sendMissed()
+// ######################################################################
+// Replays the room's messages after lastID, as far back as the history
+// buffer goes.
+func (h *Hub) sendMissed(chatter *Chatter, room *Room, lastID int64) {
+	h.mu.Lock()
+	var missed []protocol.Frame
+	for _, f := range room.history {
+		if f.ID > lastID && !chatter.ignoring[f.From] {
+			f.Ack = false
+			missed = append(missed, f)
+		}
+	}
+	h.mu.Unlock()
+
+	for _, f := range missed {
+		chatter.Send(f)
+	}
+}
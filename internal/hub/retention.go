@@ -0,0 +1,218 @@
+package hub
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"go-chat-app/internal/protocol"
+)
+
+// How long a room keeps its messages: cfg.Retention, unless a moderator
+// set something else for the room with /retention or the admin API did.
+// Every retentionInterval the reaper takes what's too old or too many out
+// of the history and the store, and tells the room they're gone, so a
+// public room can forget by the hour while a private one keeps everything.
+// Pins are copies the room chose to keep and stay.
+
+const retentionInterval = time.Minute
+
+// ######################################################################
+// struct: Retention
+// ######################################################################
+// A zero field doesn't limit, so the zero value keeps everything.
+type Retention struct {
+	MaxAge   time.Duration `json:"max_age,omitempty"`
+	MaxCount int           `json:"max_count,omitempty"`
+}
+
+func (r Retention) String() string {
+	switch {
+	case r.MaxAge > 0 && r.MaxCount > 0:
+		return fmt.Sprintf("the last %d messages, for %s", r.MaxCount, r.MaxAge)
+	case r.MaxAge > 0:
+		return fmt.Sprintf("messages for %s", r.MaxAge)
+	case r.MaxCount > 0:
+		return fmt.Sprintf("the last %d messages", r.MaxCount)
+	}
+	return "everything"
+}
+
+// Whether f goes, being the n-th newest message of its room.
+func (r Retention) drops(f protocol.Frame, n int, now time.Time) bool {
+	if r.MaxCount > 0 && n > r.MaxCount {
+		return true
+	}
+	return r.MaxAge > 0 && !f.SentAt.IsZero() && now.Sub(f.SentAt) > r.MaxAge
+}
+
+// Caller holds the mutex.
+func (h *Hub) retentionLocked(room *Room) Retention {
+	if room.retention != nil {
+		return *room.retention
+	}
+	return h.cfg.Retention
+}
+
+// ######################################################################
+// function: SetRoomRetention()
+// ######################################################################
+// Gives the room its own retention, nil goes back to cfg.Retention. What
+// the new one doesn't keep is gone right away. Returns what applies now.
+func (h *Hub) SetRoomRetention(name string, r *Retention, by string) Retention {
+	h.mu.Lock()
+	room, _ := h.getRoom(name)
+	room.retention = r
+	if err := h.saveRoomsLocked(); err != nil {
+		log.Printf("Error persisting rooms: %v", err)
+	}
+	now := h.retentionLocked(room)
+	h.mu.Unlock()
+
+	h.broadcastRoom(room, protocol.Systemf(room.name, "%s changed what #%s keeps: %s", by, room.name, now.String()), nil)
+	h.emit(Event{Type: EventModeration, Action: "retention", Room: room.name, User: by, Text: now.String()})
+	h.Audit(AuditEntry{Actor: by, Action: "retention", Room: room.name, Reason: now.String()})
+	h.reapRoom(context.Background(), room)
+	return now
+}
+
+// ######################################################################
+// function: retentionLoop()
+// ######################################################################
+func (h *Hub) retentionLoop(ctx context.Context) {
+	ticker := time.NewTicker(retentionInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		h.mu.Lock()
+		rooms := make([]*Room, 0, len(h.rooms))
+		for _, room := range h.rooms {
+			rooms = append(rooms, room)
+		}
+		h.mu.Unlock()
+		for _, room := range rooms {
+			h.reapRoom(ctx, room)
+		}
+	}
+}
+
+// ######################################################################
+// function: reapRoom()
+// ######################################################################
+// Takes out what the room's retention doesn't keep. Clients are told
+// about what they could have been shown, the in-memory history. Returns
+// how many messages went.
+func (h *Hub) reapRoom(ctx context.Context, room *Room) int {
+	now := time.Now()
+	h.mu.Lock()
+	r := h.retentionLocked(room)
+	if r == (Retention{}) {
+		h.mu.Unlock()
+		return 0
+	}
+	var shown []int64
+	kept := room.history[:0:0]
+	for i, f := range room.history {
+		if r.drops(f, len(room.history)-i, now) {
+			shown = append(shown, f.ID)
+		} else {
+			kept = append(kept, f)
+		}
+	}
+	if len(shown) > 0 {
+		room.history = kept
+	}
+	h.mu.Unlock()
+
+	gone := make(map[int64]bool)
+	for _, id := range shown {
+		gone[id] = true
+	}
+	if h.cfg.HistorySize > 0 {
+		done := h.storageOp(ctx, "load", messagesDoc)
+		stored, err := h.cfg.Store.Messages(room.name, 0)
+		done(err)
+		if err != nil {
+			log.Printf("Error loading the history of #%s for retention: %v", room.name, err)
+		}
+		for i, f := range stored {
+			if !r.drops(f, len(stored)-i, now) {
+				continue
+			}
+			done := h.storageOp(ctx, "delete", messagesDoc)
+			err := h.cfg.Store.DeleteMessage(f.ID)
+			done(err)
+			if err != nil {
+				log.Printf("Error deleting message %d for retention: %v", f.ID, err)
+				continue
+			}
+			gone[f.ID] = true
+		}
+	}
+
+	for _, id := range shown {
+		h.broadcastRoom(room, protocol.Frame{Type: protocol.FrameDeleted, Room: room.name, ID: id}, nil)
+	}
+	if len(gone) > 0 {
+		log.Printf("Retention took %d messages out of #%s", len(gone), room.name)
+		h.emit(Event{Type: EventModeration, Action: "retention_prune", Room: room.name, Text: strconv.Itoa(len(gone))})
+	}
+	return len(gone)
+}
+
+// ######################################################################
+// function: cmdRetention()
+// ######################################################################
+// /retention shows what the room keeps, moderators change it with
+// /retention age <duration>, count <n>, off or default. A 0 lifts that
+// limit, off keeps everything.
+func (h *Hub) cmdRetention(chatter *Chatter, args string) bool {
+	room := chatter.room
+	fields := strings.Fields(args)
+	h.mu.Lock()
+	r := h.retentionLocked(room)
+	h.mu.Unlock()
+	if len(fields) == 0 {
+		chatter.SendSystem("#%s keeps %s.", room.name, r.String())
+		return false
+	}
+	if !h.isModerator(chatter, room) {
+		chatter.SendError(protocol.CodeNotPermitted, "Only moderators can change what the room keeps.")
+		return false
+	}
+
+	usage := func() bool {
+		chatter.SendError(protocol.CodeInvalid, "Usage: /retention [age <duration>|count <n>|off|default]")
+		return false
+	}
+	switch {
+	case fields[0] == "default" && len(fields) == 1:
+		h.SetRoomRetention(room.name, nil, chatter.Username)
+		return false
+	case fields[0] == "off" && len(fields) == 1:
+		r = Retention{}
+	case fields[0] == "age" && len(fields) == 2:
+		d, err := time.ParseDuration(fields[1])
+		if err != nil || d < 0 {
+			return usage()
+		}
+		r.MaxAge = d
+	case fields[0] == "count" && len(fields) == 2:
+		n, err := strconv.Atoi(fields[1])
+		if err != nil || n < 0 {
+			return usage()
+		}
+		r.MaxCount = n
+	default:
+		return usage()
+	}
+	h.SetRoomRetention(room.name, &r, chatter.Username)
+	return false
+}
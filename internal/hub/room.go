@@ -0,0 +1,516 @@
+package hub
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"log"
+	"sort"
+	"time"
+
+	"go-chat-app/internal/i18n"
+	"go-chat-app/internal/protocol"
+)
+
+const DefaultRoom = "lobby"
+
+// ######################################################################
+// struct: Room
+// ######################################################################
+// All fields are guarded by the hub mutex.
+type Room struct {
+	name       string
+	members    map[*Chatter]bool
+	moderators map[*Chatter]bool
+	slowMode   time.Duration // minimum time between messages per chatter, 0 = off
+	meta       protocol.RoomMeta
+	topic      string
+
+	passwordHash string               // hex sha256 of salt+password, "" = no password
+	passwordSalt string               // hex
+	inviteOnly   bool                 // only invite tokens get in
+	invites      map[string]time.Time // invite token -> expiry
+	accounts     map[string]bool      // accounts that got in while it was locked, for /api/sync
+
+	history []protocol.Frame // last cfg.HistorySize messages, oldest first
+	mail    *MailList        // digest mailing list, nil = none
+	pins    []protocol.Frame // pinned messages, oldest pin first
+	banner  *protocol.Banner // nil = none
+	spam    *SpamRules       // nil = cfg.Spam
+
+	retention *Retention // nil = cfg.Retention
+
+	watchers map[chan protocol.Frame]bool // read-only viewers, see embed.go, true = bridges that get every frame
+}
+
+const inviteTTL = 24 * time.Hour
+
+var (
+	errWrongPassword = errors.New("wrong room password")
+	errInviteOnly    = errors.New("room is invite only")
+)
+
+// ######################################################################
+// struct: roomRecord
+// ######################################################################
+// What survives a restart for each room, stored in rooms.json.
+type roomRecord struct {
+	Meta  protocol.RoomMeta `json:"meta"`
+	Topic string            `json:"topic,omitempty"`
+
+	PasswordHash string               `json:"password_hash,omitempty"`
+	PasswordSalt string               `json:"password_salt,omitempty"`
+	InviteOnly   bool                 `json:"invite_only,omitempty"`
+	Invites      map[string]time.Time `json:"invites,omitempty"`
+	Accounts     []string             `json:"accounts,omitempty"`
+
+	Mail   *MailList        `json:"mail,omitempty"`
+	Pins   []protocol.Frame `json:"pins,omitempty"`
+	Banner *protocol.Banner `json:"banner,omitempty"`
+	Spam   *SpamRules       `json:"spam,omitempty"`
+
+	Retention *Retention `json:"retention,omitempty"`
+}
+
+const roomsFile = "rooms.json"
+
+// ######################################################################
+// function: getRoom()
+// ######################################################################
+// Returns the named room, creating it if needed. Caller holds the mutex.
+func (h *Hub) getRoom(name string) (*Room, bool) {
+	room, ok := h.rooms[name]
+	if !ok {
+		room = &Room{
+			name:       name,
+			members:    make(map[*Chatter]bool),
+			moderators: make(map[*Chatter]bool),
+			invites:    make(map[string]time.Time),
+			accounts:   make(map[string]bool),
+			watchers:   make(map[chan protocol.Frame]bool),
+		}
+		h.rooms[name] = room
+	}
+	return room, !ok
+}
+
+// ######################################################################
+// function: joinRoom()
+// ######################################################################
+// Moves the chatter into the named room. Whoever creates a room moderates it,
+// and key becomes the password of a newly created room. For existing rooms
+// key has to be the room password or an invite token, if the room needs one.
+func (h *Hub) joinRoom(chatter *Chatter, name, key string) (*Room, error) {
+	h.mu.Lock()
+	if room, ok := h.rooms[name]; ok {
+		if err := h.checkAccessLocked(chatter, room, key); err != nil {
+			h.mu.Unlock()
+			return nil, err
+		}
+	}
+	h.leaveRoomLocked(chatter)
+	room, created := h.getRoom(name)
+	room.members[chatter] = true
+	h.countsDirty.Store(true)
+	if created && name != DefaultRoom {
+		room.moderators[chatter] = true
+		if key != "" {
+			room.setPasswordLocked(key)
+			if err := h.saveRoomsLocked(); err != nil {
+				log.Printf("Error persisting rooms: %v", err)
+			}
+		}
+	}
+	if chatter.account != "" && !room.publicLocked() && !room.accounts[chatter.account] {
+		room.accounts[chatter.account] = true
+		if err := h.saveRoomsLocked(); err != nil {
+			log.Printf("Error persisting rooms: %v", err)
+		}
+	}
+	chatter.room = room
+	h.mu.Unlock()
+
+	h.greetRoom(chatter, room)
+	return room, nil
+}
+
+// ######################################################################
+// function: greetRoom()
+// ######################################################################
+// Sends the room's topic, banner, pins and welcome text to a new member and
+// tells the others, unless the member is there on another device already.
+func (h *Hub) greetRoom(chatter *Chatter, room *Room) {
+	h.mu.Lock()
+	welcome, topic := room.meta.Welcome, room.topic
+	again := room.otherDeviceLocked(chatter)
+	h.mu.Unlock()
+
+	if topic != "" {
+		chatter.Send(protocol.Frame{Type: protocol.FrameTopic, Room: room.name, Text: topic})
+	}
+	h.sendBanner(chatter, room, false)
+	h.sendPins(chatter, room)
+	if welcome != "" {
+		chatter.Send(protocol.Frame{Type: protocol.FrameSystem, Room: room.name, Text: welcome})
+	}
+	h.sendRoomCall(chatter, room)
+	if again {
+		return // already here on another device
+	}
+	h.broadcastRoom(room, protocol.Systemf(room.name, "%s joined #%s.", chatter.Username, room.name), chatter)
+	h.emit(Event{Type: EventJoin, Room: room.name, User: chatter.Username})
+}
+
+// ######################################################################
+// function: checkAccessLocked()
+// ######################################################################
+// Caller holds the mutex.
+func (h *Hub) checkAccessLocked(chatter *Chatter, room *Room, key string) error {
+	if chatter.admin {
+		return nil
+	}
+	if expiry, ok := room.invites[key]; ok && time.Now().Before(expiry) {
+		return nil
+	}
+	if room.inviteOnly {
+		return errInviteOnly
+	}
+	if room.passwordHash == "" {
+		return nil
+	}
+	if subtle.ConstantTimeCompare([]byte(hashRoomPassword(room.passwordSalt, key)), []byte(room.passwordHash)) != 1 {
+		return errWrongPassword
+	}
+	return nil
+}
+
+// ######################################################################
+// function: setPasswordLocked()
+// ######################################################################
+// Empty password removes it. Who got in with the old one has to again.
+// Caller holds the mutex.
+func (room *Room) setPasswordLocked(password string) {
+	clear(room.accounts)
+	if password == "" {
+		room.passwordHash, room.passwordSalt = "", ""
+		return
+	}
+	room.passwordSalt = randomToken(16)
+	room.passwordHash = hashRoomPassword(room.passwordSalt, password)
+}
+
+// accounts, sorted so rooms.json doesn't change for nothing
+func (room *Room) accountList() []string {
+	list := make([]string, 0, len(room.accounts))
+	for account := range room.accounts {
+		list = append(list, account)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func hashRoomPassword(salt, password string) string {
+	sum := sha256.Sum256([]byte(salt + password))
+	return hex.EncodeToString(sum[:])
+}
+
+// ######################################################################
+// function: randomToken()
+// ######################################################################
+func randomToken(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err) // crypto/rand never fails on supported platforms
+	}
+	return hex.EncodeToString(b)
+}
+
+// ######################################################################
+// function: setRoomPassword()
+// ######################################################################
+func (h *Hub) setRoomPassword(room *Room, password string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	room.setPasswordLocked(password)
+	if err := h.saveRoomsLocked(); err != nil {
+		log.Printf("Error persisting rooms: %v", err)
+	}
+}
+
+// ######################################################################
+// function: setInviteOnly()
+// ######################################################################
+func (h *Hub) setInviteOnly(room *Room, on bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	room.inviteOnly = on
+	if on {
+		clear(room.accounts) // in with an invite from now on
+	}
+	if err := h.saveRoomsLocked(); err != nil {
+		log.Printf("Error persisting rooms: %v", err)
+	}
+}
+
+// ######################################################################
+// function: createInvite()
+// ######################################################################
+// Returns a token that lets its holder into the room for inviteTTL.
+func (h *Hub) createInvite(room *Room) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	for token, expiry := range room.invites {
+		if now.After(expiry) {
+			delete(room.invites, token)
+		}
+	}
+	token := randomToken(12)
+	room.invites[token] = now.Add(inviteTTL)
+	if err := h.saveRoomsLocked(); err != nil {
+		log.Printf("Error persisting rooms: %v", err)
+	}
+	return token
+}
+
+// ######################################################################
+// function: leaveRoomLocked()
+// ######################################################################
+// Removes the chatter from its current room. Caller holds the mutex.
+func (h *Hub) leaveRoomLocked(chatter *Chatter) {
+	if chatter.room == nil {
+		return
+	}
+	h.removeMemberLocked(chatter.room, chatter)
+	chatter.room = nil
+}
+
+// ######################################################################
+// function: removeMemberLocked()
+// ######################################################################
+// Drops the chatter from the room's member list but leaves chatter.room
+// alone, which only the chatter's own goroutine may change. Empty rooms
+// with nothing worth keeping go away. Caller holds the mutex.
+func (h *Hub) removeMemberLocked(room *Room, chatter *Chatter) {
+	delete(room.members, chatter)
+	delete(room.moderators, chatter)
+	h.countsDirty.Store(true)
+	if room.disposableLocked() {
+		delete(h.rooms, room.name)
+	}
+}
+
+// ######################################################################
+// function: disposableLocked()
+// ######################################################################
+// True for rooms nobody is in, watching or needs kept. Caller holds the mutex.
+func (room *Room) disposableLocked() bool {
+	return len(room.members) == 0 && len(room.watchers) == 0 && room.name != DefaultRoom && !room.persistent()
+}
+
+// ######################################################################
+// function: persistent()
+// ######################################################################
+// Rooms with state worth saving stick around when empty. Caller holds the mutex.
+func (room *Room) persistent() bool {
+	return !room.meta.IsZero() || room.topic != "" || room.passwordHash != "" || room.inviteOnly || room.mail != nil || len(room.pins) > 0 || room.banner != nil || room.spam != nil || room.retention != nil
+}
+
+// ######################################################################
+// function: setTopic()
+// ######################################################################
+func (h *Hub) setTopic(room *Room, topic string, by *Chatter) {
+	h.mu.Lock()
+	room.topic = topic
+	if err := h.saveRoomsLocked(); err != nil {
+		log.Printf("Error persisting rooms: %v", err)
+	}
+	h.mu.Unlock()
+
+	h.broadcastRoom(room, protocol.Frame{Type: protocol.FrameTopicChanged, Room: room.name, From: by.Username, Text: topic}, nil)
+	h.emit(Event{Type: EventModeration, Action: "topic", Room: room.name, User: by.Username, Text: topic})
+}
+
+// ######################################################################
+// function: updateRoomMeta()
+// ######################################################################
+// Applies update to the room's metadata, persists it and tells the members.
+func (h *Hub) updateRoomMeta(room *Room, update func(*protocol.RoomMeta)) protocol.RoomMeta {
+	h.mu.Lock()
+	update(&room.meta)
+	meta := room.meta
+	if err := h.saveRoomsLocked(); err != nil {
+		log.Printf("Error persisting rooms: %v", err)
+	}
+	h.mu.Unlock()
+
+	h.broadcastRoom(room, protocol.Frame{Type: protocol.FrameRoomUpdated, Room: room.name, Meta: &meta}, nil)
+	return meta
+}
+
+// ######################################################################
+// function: setPolicy()
+// ######################################################################
+// Members get the new policy in a room_updated frame, like any meta change.
+func (h *Hub) setPolicy(room *Room, feature string, on bool) error {
+	if !new(protocol.RoomPolicy).Set(feature, on) {
+		return errNoFeature
+	}
+	h.updateRoomMeta(room, func(m *protocol.RoomMeta) { m.Policy.Set(feature, on) })
+	return nil
+}
+
+// ######################################################################
+// function: sendPolicy()
+// ######################################################################
+func (h *Hub) sendPolicy(chatter *Chatter) {
+	h.mu.Lock()
+	policy := chatter.room.meta.Policy
+	h.mu.Unlock()
+	state := func(feature string) i18n.Localized {
+		if policy.Allows(feature) {
+			return "on"
+		}
+		return "off"
+	}
+	chatter.SendSystem("Policy in #%s: reactions %s, uploads %s, link previews %s",
+		chatter.room.name, state(protocol.FeatureReactions), state(protocol.FeatureUploads), state(protocol.FeatureLinkPreviews))
+}
+
+// ######################################################################
+// function: saveRoomsLocked()
+// ######################################################################
+// Caller holds the mutex.
+func (h *Hub) saveRoomsLocked() error {
+	records := make(map[string]roomRecord)
+	for name, room := range h.rooms {
+		if room.persistent() {
+			records[name] = roomRecord{
+				Meta:         room.meta,
+				Topic:        room.topic,
+				PasswordHash: room.passwordHash,
+				PasswordSalt: room.passwordSalt,
+				InviteOnly:   room.inviteOnly,
+				Invites:      room.invites,
+				Accounts:     room.accountList(),
+				Mail:         room.mail,
+				Pins:         room.pins,
+				Banner:       room.banner,
+				Spam:         room.spam,
+				Retention:    room.retention,
+			}
+		}
+	}
+	return h.saveJSON(roomsFile, records)
+}
+
+// ######################################################################
+// function: loadRooms()
+// ######################################################################
+func (h *Hub) loadRooms() {
+	var records map[string]roomRecord
+	if err := h.loadJSON(roomsFile, &records); err != nil {
+		log.Printf("Error loading rooms: %v", err)
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for name, record := range records {
+		room, _ := h.getRoom(name)
+		room.meta = record.Meta
+		room.topic = record.Topic
+		room.passwordHash = record.PasswordHash
+		room.passwordSalt = record.PasswordSalt
+		room.inviteOnly = record.InviteOnly
+		room.mail = record.Mail
+		room.pins = record.Pins
+		room.banner = record.Banner
+		room.spam = record.Spam
+		room.retention = record.Retention
+		for _, p := range record.Pins {
+			h.bumpMessageID(p.ID) // never hand out an ID a pin already has
+		}
+		for token, expiry := range record.Invites {
+			room.invites[token] = expiry
+		}
+		for _, account := range record.Accounts {
+			room.accounts[account] = true
+		}
+	}
+}
+
+// ######################################################################
+// function: isModerator()
+// ######################################################################
+func (h *Hub) isModerator(chatter *Chatter, room *Room) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return chatter.admin || room.moderators[chatter]
+}
+
+// ######################################################################
+// function: setSlowMode()
+// ######################################################################
+func (h *Hub) setSlowMode(room *Room, d time.Duration) {
+	h.mu.Lock()
+	room.slowMode = d
+	h.mu.Unlock()
+
+	f := protocol.Systemf(room.name, "Slow mode is off in #%s.", room.name)
+	if d > 0 {
+		f = protocol.Systemf(room.name, "Slow mode is on in #%s: one message every %s.", room.name, d)
+	}
+	h.broadcastRoom(room, f, nil)
+	h.emit(Event{Type: EventModeration, Action: "slow_mode", Room: room.name, Text: d.String()})
+}
+
+// ######################################################################
+// function: slowModeWait()
+// ######################################################################
+// Returns how long the chatter has to wait before posting in its room again,
+// and records the post if it is allowed.
+func (h *Hub) slowModeWait(chatter *Chatter) time.Duration {
+	h.mu.Lock()
+	slowMode := chatter.room.slowMode
+	h.mu.Unlock()
+
+	now := time.Now()
+	if wait := chatter.lastMessage.Add(slowMode).Sub(now); slowMode > 0 && wait > 0 {
+		return wait
+	}
+	chatter.lastMessage = now
+	return 0
+}
+
+// ######################################################################
+// function: broadcastRoom()
+// ######################################################################
+// Sends the frame to everyone in the room except sender (nil = everyone).
+// Returns how many it went out to.
+func (h *Hub) broadcastRoom(room *Room, f protocol.Frame, sender *Chatter) int {
+	if f.SentAt.IsZero() {
+		f.SentAt = time.Now() // the same ts for every member
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	room.notifyWatchersLocked(f)
+	h.recordChangeLocked(f)
+	deliveries := make([]delivery, 0, len(room.members))
+	for chatter := range room.members {
+		if chatter != sender {
+			if f.Type == protocol.FrameMessage && (!chatter.wantsMessageLocked(f) || chatter.ignoring[f.From]) {
+				continue
+			}
+			out := f
+			// background tabs get their timers throttled, which would skew the latencies
+			if f.Type == protocol.FrameMessage && f.ID != 0 && chatter.activelyViewingLocked() {
+				out.Ack = h.sampleAck(chatter, room.name, f.ID)
+			}
+			deliveries = append(deliveries, delivery{chatter, out})
+		}
+	}
+	h.deliverLocked(deliveries)
+	return len(deliveries)
+}
@@ -0,0 +1,198 @@
+package hub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"go-chat-app/internal/markdown"
+	"go-chat-app/internal/protocol"
+)
+
+const (
+	scheduledFile    = "scheduled.json"
+	maxScheduleAhead = 30 * 24 * time.Hour
+	maxScheduledPer  = 10 // pending messages per sender
+)
+
+var (
+	errScheduleRange = fmt.Errorf("messages can be scheduled up to %s ahead", maxScheduleAhead)
+	errScheduleFull  = fmt.Errorf("you already have %d scheduled messages", maxScheduledPer)
+)
+
+// ######################################################################
+// struct: ScheduledMessage
+// ######################################################################
+// Owner is who scheduled it, see clientIDOwner, and IP where from, both
+// "" for the admin API. From is only the name it goes out under, guests
+// can take anyone's.
+type ScheduledMessage struct {
+	ID    string    `json:"id"`
+	Room  string    `json:"room"`
+	From  string    `json:"from"`
+	Owner string    `json:"owner,omitempty"`
+	IP    string    `json:"ip,omitempty"`
+	Text  string    `json:"text"`
+	At    time.Time `json:"at"`
+}
+
+// ######################################################################
+// function: Schedule()
+// ######################################################################
+func (h *Hub) Schedule(room, from, owner, ip, text string, at time.Time) (ScheduledMessage, error) {
+	if at.Before(time.Now()) || time.Until(at) > maxScheduleAhead {
+		return ScheduledMessage{}, errScheduleRange
+	}
+	h.scheduleMu.Lock()
+	defer h.scheduleMu.Unlock()
+
+	pending := 0
+	for _, m := range h.scheduled {
+		if m.Owner == owner && (owner != "" || m.From == from) {
+			pending++
+		}
+	}
+	if pending >= maxScheduledPer {
+		return ScheduledMessage{}, errScheduleFull
+	}
+
+	m := ScheduledMessage{ID: randomToken(6), Room: room, From: from, Owner: owner, IP: ip, Text: text, At: at}
+	h.scheduled[m.ID] = m
+	if err := h.saveJSON(scheduledFile, h.scheduled); err != nil {
+		log.Printf("Error persisting scheduled messages: %v", err)
+	}
+	return m, nil
+}
+
+// ######################################################################
+// function: Unschedule()
+// ######################################################################
+func (h *Hub) Unschedule(id string) bool {
+	h.scheduleMu.Lock()
+	defer h.scheduleMu.Unlock()
+	if _, ok := h.scheduled[id]; !ok {
+		return false
+	}
+	delete(h.scheduled, id)
+	if err := h.saveJSON(scheduledFile, h.scheduled); err != nil {
+		log.Printf("Error persisting scheduled messages: %v", err)
+	}
+	return true
+}
+
+// ######################################################################
+// function: ScheduledMessages()
+// ######################################################################
+// Everything pending, soonest first.
+func (h *Hub) ScheduledMessages() []ScheduledMessage {
+	h.scheduleMu.Lock()
+	list := make([]ScheduledMessage, 0, len(h.scheduled))
+	for _, m := range h.scheduled {
+		list = append(list, m)
+	}
+	h.scheduleMu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].At.Before(list[j].At) })
+	return list
+}
+
+// ######################################################################
+// function: loadScheduled()
+// ######################################################################
+// Messages that came due while the server was down go out on the first tick.
+func (h *Hub) loadScheduled() {
+	h.scheduleMu.Lock()
+	defer h.scheduleMu.Unlock()
+	if err := h.loadJSON(scheduledFile, &h.scheduled); err != nil {
+		log.Printf("Error loading scheduled messages: %v", err)
+	}
+	if h.scheduled == nil {
+		h.scheduled = make(map[string]ScheduledMessage)
+	}
+}
+
+// ######################################################################
+// function: scheduleLoop()
+// ######################################################################
+func (h *Hub) scheduleLoop(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		h.runRecurring(now)
+		var due []ScheduledMessage
+
+		h.scheduleMu.Lock()
+		for id, m := range h.scheduled {
+			if !m.At.After(now) {
+				due = append(due, m)
+				delete(h.scheduled, id)
+			}
+		}
+		if len(due) > 0 {
+			if err := h.saveJSON(scheduledFile, h.scheduled); err != nil {
+				log.Printf("Error persisting scheduled messages: %v", err)
+			}
+		}
+		h.scheduleMu.Unlock()
+
+		sort.Slice(due, func(i, j int) bool { return due[i].At.Before(due[j].At) })
+		for _, m := range due {
+			h.postScheduled(m)
+		}
+	}
+}
+
+// ######################################################################
+// function: postScheduled()
+// ######################################################################
+// Posts m, unless whoever scheduled it is shadow banned by now: then only
+// their devices in the room see it, like the rest of what they write.
+func (h *Hub) postScheduled(m ScheduledMessage) {
+	h.mu.Lock()
+	room, _ := h.getRoom(m.Room)
+	h.mu.Unlock()
+	account := ""
+	if strings.HasPrefix(m.Owner, "account:") {
+		account = strings.TrimPrefix(m.Owner, "account:")
+	}
+	if m.Owner == "" || !h.shadowBannedAs(m.Room, m.IP, account) {
+		h.postExternal(room, m.From, m.Text)
+		return
+	}
+
+	f := protocol.Frame{Type: protocol.FrameMessage, ID: h.nextMessageID(), Room: room.name, From: m.From, Color: derivedColor(strings.ToLower(m.From)), Text: m.Text, HTML: markdown.Render(m.Text), SentAt: time.Now()}
+	h.mu.Lock()
+	var to []*Chatter
+	for _, c := range h.chatters.all() {
+		if c.room == room && c.ownerLocked() == m.Owner {
+			to = append(to, c)
+		}
+	}
+	h.mu.Unlock()
+	for _, c := range to {
+		c.Send(f)
+	}
+}
+
+// ######################################################################
+// function: parseSchedule()
+// ######################################################################
+// "10m hello later" after /schedule -> 10m, "hello later"
+func parseSchedule(args string) (time.Duration, string, error) {
+	durText, text, _ := strings.Cut(args, " ")
+	d, err := time.ParseDuration(durText)
+	text = strings.TrimSpace(text)
+	if err != nil || d <= 0 || text == "" {
+		return 0, "", errors.New("Usage: /schedule <duration, e.g. 90s or 2h> <text>")
+	}
+	return d, text, nil
+}
@@ -0,0 +1,218 @@
+package hub
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"go-chat-app/internal/client"
+	"go-chat-app/internal/i18n"
+	"go-chat-app/internal/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+// ######################################################################
+// function: Serve()
+// ######################################################################
+// Runs a freshly upgraded client until it disconnects. sid is the session
+// id it had before a server restart or a dropped connection and lastID the
+// last message it got, room and key where it wants to be. account is who
+// the client logged in as, the zero Account for guests.
+func (h *Hub) Serve(c *client.Client, sid, roomName, key string, account Account, lastID int64) {
+	// Create a new chatter and add it to the registry
+	c.SID = randomToken(16)
+	c.Username = h.guestName()
+	c.SetBackpressure(h.cfg.SendBuffer, h.cfg.SlowClients)
+	now := time.Now()
+	chatter := &Chatter{Client: c, presence: presenceOnline, id: h.lastConnID.Add(1), connected: now, lastActivity: now}
+	h.chatters.add(chatter)
+	h.countsDirty.Store(true)
+
+	// Clients coming back after a server restart or a network blip get their
+	// old session back
+	session, resumed := h.claimSession(sid)
+	if !resumed {
+		session, resumed = h.takeOverSession(sid)
+	}
+	if resumed {
+		h.mu.Lock()
+		chatter.SID = sid
+		chatter.Username = session.Username
+		chatter.strikes = session.Strikes
+		h.mu.Unlock()
+	}
+	if account.ID != "" {
+		h.signIn(chatter, account) // the account's name wins over a resumed one
+	}
+	h.mu.Lock()
+	hello := protocol.Frame{Type: protocol.FrameSession, Token: chatter.SID, From: chatter.Username}
+	h.mu.Unlock()
+	chatter.Send(hello)
+
+	h.sendMOTD(chatter)
+	if resumed {
+		room := h.rejoinRoom(chatter, session.Room, session.Moderator)
+		if lastID > 0 {
+			h.sendMissed(chatter, room, lastID)
+		}
+	} else {
+		// Reconnecting clients pass their room (and password or invite) along
+		roomName = strings.ToLower(roomName)
+		if roomName == "" {
+			roomName = DefaultRoom
+		}
+		if _, err := h.joinRoom(chatter, roomName, key); err != nil {
+			chatter.SendError(errorCode(err), "Could not join #%s: %s", roomName, i18n.Tr(chatter.Locale(), err.Error()))
+			h.joinRoom(chatter, DefaultRoom, "")
+		}
+	}
+	h.sendRooms(chatter)
+	h.sendEmoji(chatter)
+	if account.ID != "" {
+		h.deliverOffline(chatter, account.ID)
+	}
+	// defer deleting the chatter til end of function
+	defer func() {
+		h.chargeDisconnect(chatter)
+		h.mu.Lock()
+		h.removeChatterLocked(chatter)
+		h.mu.Unlock()
+	}()
+
+	dropped := false
+	for {
+		messageType, bytemessage, err := chatter.Read()
+		if errors.Is(err, websocket.ErrReadLimit) {
+			// way over the limit, the connection is already closed with 1009
+			log.Printf("Dropping %s (%s): frame over the read limit", chatter.Username, chatter.IP)
+			break
+		}
+		if err != nil {
+			log.Println("Read error: ", err)
+			dropped = true // not a /q or a kick, the client may be back
+			break
+		}
+		if limit := h.cfg.MaxMessageSize; limit > 0 && len(bytemessage) > limit {
+			chatter.SendError(protocol.CodeTooLarge, "Message too large (%d bytes), the limit is %d.", len(bytemessage), limit)
+			if h.strike(chatter, ruleTooLarge) {
+				break
+			}
+			continue
+		}
+		if h.throttled(chatter) {
+			time.Sleep(throttleDelay) // over the bandwidth cap
+		}
+
+		// HANDLE THE MESSAGE
+		if messageType == websocket.TextMessage {
+			if !utf8.Valid(bytemessage) {
+				chatter.SendError(protocol.CodeInvalid, "Messages must be valid UTF-8.")
+				continue
+			}
+			if h.handleMessage(chatter, bytemessage) {
+				break
+			}
+		} else if messageType == websocket.BinaryMessage && chatter.Binary() {
+			cf, ok := protocol.ParseClientFrameProto(bytemessage)
+			if !ok {
+				chatter.SendError(protocol.CodeInvalid, "Could not decode that frame.")
+				continue
+			}
+			if !utf8.ValidString(cf.Text) {
+				chatter.SendError(protocol.CodeInvalid, "Messages must be valid UTF-8.")
+				continue
+			}
+			if h.handleClientFrame(chatter, cf) {
+				break
+			}
+		} else if messageType == websocket.BinaryMessage {
+			h.broadcastRoom(chatter.room, protocol.Systemf(chatter.room.name, "%s has entered a binary message. For shame!", chatter.Username), nil)
+			fmt.Printf("User %s has entered a binary message. For shame!\n", chatter.Username)
+			if h.strike(chatter, ruleBinary) {
+				break
+			}
+		}
+	}
+
+	// Once the loop exits, the client has disconnected
+	if dropped {
+		h.parkSession(chatter)
+	}
+	h.leaveCalls(chatter, nil)
+	h.mu.Lock()
+	replaced := chatter.replaced
+	stays := chatter.room != nil && chatter.room.otherDeviceLocked(chatter)
+	h.mu.Unlock()
+	if room := chatter.room; room != nil && !replaced && !stays {
+		h.broadcastRoom(room, protocol.Systemf(room.name, "%s has left the chat.", chatter.Username), chatter)
+		h.broadcastRoom(room, protocol.Frame{Type: protocol.FramePresence, Room: room.name, From: chatter.Username, Text: presenceOffline, Profile: h.profileOf(chatter), Color: h.colorOf(chatter)}, chatter)
+		h.emit(Event{Type: EventLeave, Room: room.name, User: chatter.Username})
+	}
+}
+
+// ######################################################################
+// function: handleClientFrame()
+// ######################################################################
+// A structured frame, JSON or protobuf. Returns true if the connection
+// should be closed.
+func (h *Hub) handleClientFrame(chatter *Chatter, cf protocol.ClientFrame) bool {
+	if cf.Type != protocol.ClientAck && cf.Type != protocol.ClientHeartbeat && cf.Type != protocol.ClientHello {
+		h.noteActivity(chatter)
+	}
+	switch cf.Type {
+	case protocol.ClientAck:
+		h.receiveAck(chatter, cf.ID)
+	case protocol.ClientMessage:
+		post := Post{Text: cf.Text, ReplyTo: cf.ReplyTo, Quote: cf.Quote, TTL: time.Duration(cf.TTLMs) * time.Millisecond, ClientID: cf.ClientID}
+		return h.postMessage(chatter, post)
+	case protocol.ClientHeartbeat:
+		h.heartbeat(chatter, cf.State, cf.BatterySaver)
+	case protocol.ClientReact:
+		if err := h.toggleReaction(chatter, cf.ID, cf.Text); err != nil {
+			chatter.fail(err)
+		}
+	case protocol.ClientVote:
+		if err := h.Vote(chatter, cf.ID, cf.Option); err != nil {
+			chatter.fail(err)
+		}
+	case protocol.ClientSubscribe:
+		if err := h.subscribe(chatter, cf.Commands, cf.Patterns); err != nil {
+			chatter.fail(err)
+		}
+	case protocol.ClientEncrypted, protocol.ClientKeyExchange:
+		h.relayEncrypted(chatter, cf)
+	case protocol.ClientMarkRead:
+		if err := h.markRead(chatter, cf.Room, cf.ID); err != nil {
+			chatter.fail(err)
+		}
+	case protocol.ClientCallJoin, protocol.ClientCallOffer, protocol.ClientCallAnswer, protocol.ClientCallICE, protocol.ClientCallHangup:
+		if err := h.handleCall(chatter, cf); err != nil {
+			chatter.fail(err)
+		}
+	case protocol.ClientHello:
+		// nothing to do, it only told the upgrade this isn't a legacy client
+	}
+	return false
+}
+
+// ######################################################################
+// function: handleMessage()
+// ######################################################################
+// Handles one text message: a JSON client frame, a slash command or a chat
+// line. Returns true if the connection should be closed.
+func (h *Hub) handleMessage(chatter *Chatter, bytemessage []byte) bool {
+	message := string(bytemessage)
+
+	if cf, ok := protocol.ParseClientFrame(bytemessage); ok {
+		return h.handleClientFrame(chatter, cf)
+	}
+	h.noteActivity(chatter)
+	if handled, closing := h.runCommand(chatter, message); handled {
+		return closing
+	}
+	return h.postMessage(chatter, Post{Text: message}) // true = struck out
+}
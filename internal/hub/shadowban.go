@@ -0,0 +1,352 @@
+package hub
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"go-chat-app/internal/protocol"
+)
+
+// A shadow banned user's chat lines and private messages look sent to
+// them and go nowhere else: not to the room, not into history, the store,
+// mentions or webhooks. Someone who doesn't know can keep at it without
+// an audience instead of coming back with a new name after a kick.
+//
+// Accounts are banned by account, guests by address, since they can pick
+// any name. Admin bans reach everything they write. Making a room makes
+// you its moderator, so a moderator's ban only covers their room, is kept
+// apart from the admin ones and only shows names, not addresses.
+
+const (
+	shadowBansFile     = "shadowbans.json"
+	roomShadowBansFile = "roomshadowbans.json"
+)
+
+var (
+	errShadowNobody  = errors.New("nobody by that name is registered or online")
+	errNoShadowBan   = errors.New("no shadow ban by that name")
+	errShadowNotHere = errors.New("moderators can only shadow ban someone in their room")
+	errShadowNotOurs = errors.New("only admins can lift a shadow ban someone else placed")
+)
+
+// ######################################################################
+// struct: ShadowBan
+// ######################################################################
+// Keyed "account:<id>" or "ip:<address>". Owner is who placed it, see
+// clientIDOwner, "" for the admin API.
+type ShadowBan struct {
+	Name  string    `json:"name"` // what they were called when banned
+	By    string    `json:"by"`
+	Owner string    `json:"owner,omitempty"`
+	Since time.Time `json:"since"`
+}
+
+// ######################################################################
+// function: shadowKeys()
+// ######################################################################
+// The account called name, or else the addresses of the guests online
+// with that name.
+func (h *Hub) shadowKeys(name string) ([]string, error) {
+	var keys []string
+	if account, ok := h.accountNamed(name); ok {
+		keys = append(keys, "account:"+account)
+	} else {
+		seen := make(map[string]bool)
+		for _, chatter := range h.findChatters(name) {
+			if !seen[chatter.IP] {
+				seen[chatter.IP] = true
+				keys = append(keys, "ip:"+chatter.IP)
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errShadowNobody
+	}
+	return keys, nil
+}
+
+// ######################################################################
+// function: ShadowBanUser()
+// ######################################################################
+// Shadow bans the user called name everywhere. Returns the keys it banned.
+func (h *Hub) ShadowBanUser(name, by string) ([]string, error) {
+	return h.shadowBan("", name, by, "")
+}
+
+// room "" bans everywhere, owner is who did it.
+func (h *Hub) shadowBan(room, name, by, owner string) ([]string, error) {
+	keys, err := h.shadowKeys(name)
+	if err != nil {
+		return nil, err
+	}
+
+	h.shadowMu.Lock()
+	bans := h.shadowBans
+	if room != "" {
+		if h.roomShadowBans[room] == nil {
+			h.roomShadowBans[room] = make(map[string]ShadowBan)
+		}
+		bans = h.roomShadowBans[room]
+	}
+	for _, key := range keys {
+		bans[key] = ShadowBan{Name: name, By: by, Owner: owner, Since: time.Now()}
+	}
+	h.saveShadowBansLocked(room != "")
+	h.shadowMu.Unlock()
+
+	target := name
+	if room != "" {
+		target += " in #" + room
+	}
+	log.Printf("%s shadow banned %s", by, target)
+	h.Audit(AuditEntry{Actor: by, Action: "shadow_ban", Target: target})
+	return keys, nil
+}
+
+// ######################################################################
+// function: LiftShadowBan()
+// ######################################################################
+// Lifts the shadow ban with that key, or every one of the user called
+// that.
+func (h *Hub) LiftShadowBan(keyOrName, by string) error {
+	return h.liftShadowBan("", keyOrName, by, "")
+}
+
+// room "" lifts admin bans. With an owner only that owner's bans go, and
+// it is errShadowNotOurs if there are only someone else's.
+func (h *Hub) liftShadowBan(room, keyOrName, by, owner string) error {
+	h.shadowMu.Lock()
+	bans := h.shadowBans
+	if room != "" {
+		bans = h.roomShadowBans[room]
+	}
+	lifted, theirs := "", false
+	for key, ban := range bans {
+		if key != keyOrName && ban.Name != keyOrName {
+			continue
+		}
+		if owner != "" && ban.Owner != owner {
+			theirs = true
+			continue
+		}
+		delete(bans, key)
+		lifted = ban.Name
+	}
+	if lifted != "" {
+		h.saveShadowBansLocked(room != "")
+	}
+	h.shadowMu.Unlock()
+
+	if lifted == "" {
+		if theirs {
+			return errShadowNotOurs
+		}
+		return errNoShadowBan
+	}
+	target := lifted
+	if room != "" {
+		target += " in #" + room
+	}
+	h.Audit(AuditEntry{Actor: by, Action: "lift_shadow_ban", Target: target})
+	return nil
+}
+
+// ######################################################################
+// function: ShadowBans()
+// ######################################################################
+// The admin bans, moderators' bans are in roomShadowBans.
+func (h *Hub) ShadowBans() map[string]ShadowBan {
+	h.shadowMu.Lock()
+	defer h.shadowMu.Unlock()
+	bans := make(map[string]ShadowBan, len(h.shadowBans))
+	for key, ban := range h.shadowBans {
+		bans[key] = ban
+	}
+	return bans
+}
+
+// Names shadow banned in room by its moderators, sorted.
+func (h *Hub) roomShadowBanNames(room string) []string {
+	h.shadowMu.Lock()
+	seen := make(map[string]bool)
+	var names []string
+	for _, ban := range h.roomShadowBans[room] {
+		if !seen[ban.Name] {
+			seen[ban.Name] = true
+			names = append(names, ban.Name)
+		}
+	}
+	h.shadowMu.Unlock()
+	sort.Strings(names)
+	return names
+}
+
+// ######################################################################
+// function: shadowBanned()
+// ######################################################################
+// Whether what chatter writes outside rooms goes nowhere.
+func (h *Hub) shadowBanned(chatter *Chatter) bool {
+	return h.shadowBannedIn(chatter, "")
+}
+
+// Same for room, where its moderators' bans count too.
+func (h *Hub) shadowBannedIn(chatter *Chatter, room string) bool {
+	h.mu.Lock()
+	account := chatter.account
+	h.mu.Unlock()
+	return h.shadowBannedAs(room, chatter.IP, account)
+}
+
+// By address and account ("" for guests).
+func (h *Hub) shadowBannedAs(room, ip, account string) bool {
+	h.shadowMu.Lock()
+	defer h.shadowMu.Unlock()
+	for _, bans := range []map[string]ShadowBan{h.shadowBans, h.roomShadowBans[room]} {
+		if _, ok := bans["ip:"+ip]; ok {
+			return true
+		}
+		if _, ok := bans["account:"+account]; ok && account != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// ######################################################################
+// function: echoShadow()
+// ######################################################################
+// What a shadow banned chatter's line looks like to them: sent, to their
+// devices in the room like the real thing.
+func (h *Hub) echoShadow(chatter *Chatter, f protocol.Frame) {
+	h.mu.Lock()
+	var to []*Chatter
+	for _, c := range h.devicesLocked(chatter) {
+		if c == chatter || (c.room != nil && c.room.name == f.Room) {
+			to = append(to, c)
+		}
+	}
+	h.mu.Unlock()
+	for _, c := range to {
+		c.Send(f)
+	}
+}
+
+// ######################################################################
+// function: cmdShadowBan()
+// ######################################################################
+// /shadowban lists them, /shadowban <user> bans and /unshadowban <user>
+// lifts it. Admins ban everywhere and see the keys, moderators ban someone
+// in their room for that room only, see names only and lift only their own.
+func (h *Hub) cmdShadowBan(chatter *Chatter, name string) bool {
+	admin := h.allowed(chatter, permAdmin)
+	room := chatter.room.name
+	if name == "" {
+		var names []string
+		if admin {
+			for key, ban := range h.ShadowBans() {
+				names = append(names, ban.Name+" ("+key+")")
+			}
+			sort.Strings(names)
+		}
+		for _, banned := range h.roomShadowBanNames(room) {
+			names = append(names, banned+" (#"+room+")")
+		}
+		if len(names) == 0 {
+			chatter.SendSystem("Nobody is shadow banned.")
+			return false
+		}
+		chatter.SendSystem("Shadow banned: %s", strings.Join(names, ", "))
+		return false
+	}
+	if admin {
+		if _, err := h.ShadowBanUser(name, chatter.Username); err != nil {
+			chatter.fail(err)
+			return false
+		}
+		chatter.SendSystem("%s is shadow banned, nobody else sees what they write now.", name)
+		return false
+	}
+	if !h.inRoomWith(chatter, name) {
+		chatter.fail(errShadowNotHere)
+		return false
+	}
+	if _, err := h.shadowBan(room, name, chatter.Username, h.clientIDOwner(chatter)); err != nil {
+		chatter.fail(err)
+		return false
+	}
+	chatter.SendSystem("%s is shadow banned in #%s, nobody else here sees what they write now.", name, room)
+	return false
+}
+
+func (h *Hub) cmdUnshadowBan(chatter *Chatter, name string) bool {
+	room := chatter.room.name
+	var err error
+	if h.allowed(chatter, permAdmin) {
+		err = h.LiftShadowBan(name, chatter.Username)
+		if inRoom := h.liftShadowBan(room, name, chatter.Username, ""); inRoom == nil {
+			err = nil // one or the other will do
+		}
+	} else {
+		err = h.liftShadowBan(room, name, chatter.Username, h.clientIDOwner(chatter))
+	}
+	if err != nil {
+		chatter.fail(err)
+		return false
+	}
+	chatter.SendSystem("%s is no longer shadow banned.", name)
+	return false
+}
+
+// Whether someone called name is in chatter's room
+func (h *Hub) inRoomWith(chatter *Chatter, name string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, c := range h.chatters.all() {
+		if c.Username == name && c.room != nil && c.room == chatter.room {
+			return true
+		}
+	}
+	return false
+}
+
+// ######################################################################
+// function: loadShadowBans()
+// ######################################################################
+func (h *Hub) loadShadowBans() {
+	bans := make(map[string]ShadowBan)
+	err := h.loadJSON(shadowBansFile, &bans)
+	roomBans := make(map[string]map[string]ShadowBan)
+	roomErr := h.loadJSON(roomShadowBansFile, &roomBans)
+	h.shadowMu.Lock()
+	defer h.shadowMu.Unlock()
+	if err != nil {
+		log.Printf("Error loading shadow bans: %v", err)
+		if h.shadowBans == nil {
+			h.shadowBans = make(map[string]ShadowBan)
+		}
+	} else {
+		h.shadowBans = bans
+	}
+	if roomErr != nil {
+		log.Printf("Error loading room shadow bans: %v", roomErr)
+		if h.roomShadowBans == nil {
+			h.roomShadowBans = make(map[string]map[string]ShadowBan)
+		}
+	} else {
+		h.roomShadowBans = roomBans
+	}
+}
+
+// The admin bans, or the moderators' ones. Caller holds shadowMu.
+func (h *Hub) saveShadowBansLocked(rooms bool) {
+	file, bans := shadowBansFile, any(h.shadowBans)
+	if rooms {
+		file, bans = roomShadowBansFile, h.roomShadowBans
+	}
+	if err := h.saveJSON(file, bans); err != nil {
+		log.Printf("Error persisting shadow bans: %v", err)
+	}
+}
@@ -0,0 +1,195 @@
+package hub
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+const snapshotFile = "snapshot.json"
+
+// ######################################################################
+// struct: Snapshot
+// ######################################################################
+// Volatile hub state written periodically, so a restarted server can put
+// reconnecting clients back where they were instead of starting empty.
+// Durable room state (meta, topic, passwords) lives in rooms.json.
+type Snapshot struct {
+	TakenAt       time.Time                  `json:"taken_at"`
+	LastMessageID int64                      `json:"last_message_id"`
+	Rooms         map[string]snapshotRoom    `json:"rooms"`
+	Sessions      map[string]snapshotSession `json:"sessions"` // by session id
+}
+
+type snapshotRoom struct {
+	SlowMode time.Duration `json:"slow_mode,omitempty"`
+}
+
+type snapshotSession struct {
+	Username  string `json:"username"`
+	Room      string `json:"room"`
+	Moderator bool   `json:"moderator,omitempty"`
+	Strikes   int    `json:"strikes,omitempty"`
+
+	expires time.Time // when an unclaimed session is dropped
+}
+
+// ######################################################################
+// function: takeSnapshot()
+// ######################################################################
+func (h *Hub) takeSnapshot() Snapshot {
+	snap := Snapshot{
+		TakenAt:       time.Now(),
+		LastMessageID: h.lastMessageID.Load(),
+		Rooms:         make(map[string]snapshotRoom),
+		Sessions:      make(map[string]snapshotSession),
+	}
+
+	h.mu.Lock()
+	for name, room := range h.rooms {
+		if room.slowMode > 0 {
+			snap.Rooms[name] = snapshotRoom{SlowMode: room.slowMode}
+		}
+	}
+	for _, chatter := range h.chatters.all() {
+		if chatter.room == nil {
+			continue
+		}
+		snap.Sessions[chatter.SID] = snapshotSession{
+			Username:  chatter.Username,
+			Room:      chatter.room.name,
+			Moderator: chatter.room.moderators[chatter],
+			Strikes:   chatter.strikes,
+		}
+	}
+	h.mu.Unlock()
+
+	// Clients that have not come back since the last restart are still owed their spot
+	h.restoredMu.Lock()
+	for sid, session := range h.restored {
+		if _, ok := snap.Sessions[sid]; !ok {
+			snap.Sessions[sid] = session
+		}
+	}
+	h.restoredMu.Unlock()
+	return snap
+}
+
+// ######################################################################
+// function: saveSnapshot()
+// ######################################################################
+func (h *Hub) saveSnapshot() {
+	if err := h.saveJSON(snapshotFile, h.takeSnapshot()); err != nil {
+		log.Printf("Error writing snapshot: %v", err)
+	}
+}
+
+// ######################################################################
+// function: snapshotLoop()
+// ######################################################################
+func (h *Hub) snapshotLoop(ctx context.Context) {
+	ticker := time.NewTicker(h.cfg.SnapshotInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		h.saveSnapshot()
+	}
+}
+
+// ######################################################################
+// function: restoreSnapshot()
+// ######################################################################
+// Recreates rooms from the last snapshot and holds on to its sessions for
+// SnapshotGrace, so clients reconnecting with their session id get them back.
+func (h *Hub) restoreSnapshot() {
+	var snap Snapshot
+	if err := h.loadJSON(snapshotFile, &snap); err != nil {
+		log.Printf("Error loading snapshot: %v", err)
+		return
+	}
+	h.bumpMessageID(snap.LastMessageID)
+	if snap.TakenAt.IsZero() || time.Since(snap.TakenAt) > h.cfg.SnapshotGrace {
+		return // too old to be worth restoring
+	}
+
+	h.mu.Lock()
+	for name, sr := range snap.Rooms {
+		room, _ := h.getRoom(name)
+		room.slowMode = sr.SlowMode
+	}
+	h.mu.Unlock()
+
+	h.restoredMu.Lock()
+	expires := time.Now().Add(h.cfg.SnapshotGrace)
+	for sid, session := range snap.Sessions {
+		session.expires = expires
+		h.restored[sid] = session
+		h.bumpGuest(session.Username)
+	}
+	h.restoredMu.Unlock()
+	log.Printf("Restored snapshot from %s: %d rooms, %d sessions", snap.TakenAt.Format(time.RFC3339), len(snap.Rooms), len(snap.Sessions))
+
+	time.AfterFunc(h.cfg.SnapshotGrace, h.expireRestored)
+}
+
+// ######################################################################
+// function: expireRestored()
+// ######################################################################
+// Drops sessions that never came back, and the empty rooms they were holding.
+func (h *Hub) expireRestored() {
+	now := time.Now()
+	h.restoredMu.Lock()
+	for sid, session := range h.restored {
+		if !now.Before(session.expires) {
+			delete(h.restored, sid)
+		}
+	}
+	h.restoredMu.Unlock()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for name, room := range h.rooms {
+		if room.disposableLocked() {
+			delete(h.rooms, name)
+		}
+	}
+}
+
+// ######################################################################
+// function: claimSession()
+// ######################################################################
+// Hands a restored session to the reconnecting client, at most once.
+func (h *Hub) claimSession(sid string) (snapshotSession, bool) {
+	h.restoredMu.Lock()
+	defer h.restoredMu.Unlock()
+	session, ok := h.restored[sid]
+	if ok {
+		delete(h.restored, sid)
+	}
+	return session, ok && time.Now().Before(session.expires)
+}
+
+// ######################################################################
+// function: rejoinRoom()
+// ######################################################################
+// Puts a restored chatter back in its room without the access checks
+// it already passed before the restart.
+func (h *Hub) rejoinRoom(chatter *Chatter, name string, moderator bool) *Room {
+	h.mu.Lock()
+	h.leaveRoomLocked(chatter)
+	room, _ := h.getRoom(name)
+	room.members[chatter] = true
+	h.countsDirty.Store(true)
+	if moderator {
+		room.moderators[chatter] = true
+	}
+	chatter.room = room
+	h.mu.Unlock()
+
+	h.greetRoom(chatter, room)
+	return room
+}
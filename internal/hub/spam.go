@@ -0,0 +1,242 @@
+package hub
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"go-chat-app/internal/protocol"
+)
+
+// Spam is a chat line repeated too often, mostly capitals or full of
+// @mentions. The first time gets a warning, the second a minute of not
+// being able to post, and every time after that a strike, until the
+// chatter has behaved for spamForget. The rules are cfg.Spam unless a
+// moderator set others for the room with /spam.
+
+const (
+	ruleSpam       = "spam"
+	spamMute       = time.Minute
+	spamForget     = 10 * time.Minute
+	minCapsLetters = 12 // shorter lines may shout, "OK" and "LOL" aren't spam
+)
+
+// ######################################################################
+// struct: SpamRules
+// ######################################################################
+// A zero field isn't checked, so the zero value checks nothing.
+type SpamRules struct {
+	Repeats     int           `json:"repeats,omitempty"`      // the same line this many times...
+	Window      time.Duration `json:"window,omitempty"`       // ...within this is spam
+	CapsPercent int           `json:"caps_percent,omitempty"` // more capitals than this, of the letters
+	Mentions    int           `json:"mentions,omitempty"`     // more @mentions than this in a line
+}
+
+func (r SpamRules) String() string {
+	var rules []string
+	if r.Repeats > 0 && r.Window > 0 {
+		rules = append(rules, fmt.Sprintf("%d repeats in %s", r.Repeats, r.Window))
+	}
+	if r.CapsPercent > 0 {
+		rules = append(rules, fmt.Sprintf("over %d%% capitals", r.CapsPercent))
+	}
+	if r.Mentions > 0 {
+		rules = append(rules, fmt.Sprintf("over %d mentions", r.Mentions))
+	}
+	if len(rules) == 0 {
+		return "off"
+	}
+	return strings.Join(rules, ", ")
+}
+
+// What the chatter posted lately and how it's been behaving. Only the
+// chatter's own goroutine posts for it, so no locking.
+type spamState struct {
+	lines       []spamLine
+	offenses    int
+	lastOffense time.Time
+	mutedUntil  time.Time
+}
+
+type spamLine struct {
+	room string
+	text string // normalized, see spamKey
+	at   time.Time
+}
+
+// ######################################################################
+// type: spamFilter
+// ######################################################################
+// The MessageFilter for it. Lines from bridges and webhooks aren't checked,
+// there is nobody to warn.
+type spamFilter struct{ h *Hub }
+
+func (f spamFilter) Filter(m *Message) Verdict {
+	chatter := m.chatter
+	if chatter == nil {
+		return Verdict{}
+	}
+	h := f.h
+	h.mu.Lock()
+	rules := h.cfg.Spam
+	if chatter.room != nil && chatter.room.spam != nil {
+		rules = *chatter.room.spam
+	}
+	h.mu.Unlock()
+
+	s := &chatter.spam
+	now := time.Now()
+	if now.Before(s.mutedUntil) {
+		return Verdict{Reject: true, Notice: fmt.Sprintf("You can post again in %ds.", int(s.mutedUntil.Sub(now).Seconds()+0.5))}
+	}
+	if s.offenses > 0 && now.Sub(s.lastOffense) >= spamForget {
+		s.offenses = 0
+	}
+
+	why := spamReason(rules, s, m.Room, m.Text, now)
+	if why == "" {
+		return Verdict{}
+	}
+	s.offenses++
+	s.lastOffense = now
+	switch s.offenses {
+	case 1:
+		return Verdict{Reject: true, Notice: "That looks like spam (" + why + "), it wasn't sent. Keep it up and you'll be muted."}
+	case 2:
+		s.mutedUntil = now.Add(spamMute)
+		return Verdict{Reject: true, Notice: fmt.Sprintf("Still spam (%s). You can't post for %s.", why, spamMute)}
+	}
+	return Verdict{Rule: ruleSpam}
+}
+
+// What rule the line breaks, "" if none. Remembers it for the repeat
+// count either way, which is per room like duplicates are.
+func spamReason(rules SpamRules, s *spamState, room, text string, now time.Time) string {
+	kept := s.lines[:0]
+	for _, l := range s.lines {
+		if now.Sub(l.at) < rules.Window {
+			kept = append(kept, l)
+		}
+	}
+	s.lines = kept
+	if rules.Repeats > 0 && rules.Window > 0 {
+		key := spamKey(text)
+		s.lines = append(s.lines, spamLine{room, key, now})
+		repeats := 0
+		for _, l := range s.lines {
+			if l.room == room && l.text == key {
+				repeats++
+			}
+		}
+		if repeats >= rules.Repeats {
+			return "the same message again and again"
+		}
+	}
+	if rules.CapsPercent > 0 {
+		letters, upper := 0, 0
+		for _, r := range text {
+			if unicode.IsLetter(r) {
+				letters++
+				if unicode.IsUpper(r) {
+					upper++
+				}
+			}
+		}
+		if letters >= minCapsLetters && upper*100 > rules.CapsPercent*letters {
+			return "too many capitals"
+		}
+	}
+	if rules.Mentions > 0 {
+		mentions := 0
+		for _, word := range strings.Fields(text) {
+			if len(word) > 1 && strings.HasPrefix(word, "@") {
+				mentions++
+			}
+		}
+		if mentions > rules.Mentions {
+			return "too many mentions"
+		}
+	}
+	return ""
+}
+
+// Near duplicates count as the same line: case, punctuation and spacing
+// don't matter.
+func spamKey(text string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}), " ")
+}
+
+// ######################################################################
+// function: cmdSpam()
+// ######################################################################
+// /spam shows the room's rules, moderators change them with
+// /spam repeats <n> <seconds>, caps <percent>, mentions <n>, off or
+// default. A 0 turns that check off.
+func (h *Hub) cmdSpam(chatter *Chatter, args string) bool {
+	room := chatter.room
+	fields := strings.Fields(args)
+	if len(fields) == 0 {
+		h.mu.Lock()
+		rules := h.cfg.Spam
+		if room.spam != nil {
+			rules = *room.spam
+		}
+		h.mu.Unlock()
+		chatter.SendSystem("Spam rules in #%s: %s", room.name, rules.String())
+		return false
+	}
+	if !h.isModerator(chatter, room) {
+		chatter.SendError(protocol.CodeNotPermitted, "Only moderators can change the spam rules.")
+		return false
+	}
+
+	usage := func() bool {
+		chatter.SendError(protocol.CodeInvalid, "Usage: /spam [repeats <n> <seconds>|caps <percent>|mentions <n>|off|default]")
+		return false
+	}
+	var numbers []int
+	for _, field := range fields[1:] {
+		n, err := strconv.Atoi(field)
+		if err != nil || n < 0 {
+			return usage()
+		}
+		numbers = append(numbers, n)
+	}
+
+	h.mu.Lock()
+	rules := h.cfg.Spam
+	if room.spam != nil {
+		rules = *room.spam
+	}
+	switch {
+	case fields[0] == "off" && len(numbers) == 0:
+		rules = SpamRules{}
+	case fields[0] == "repeats" && len(numbers) == 2:
+		rules.Repeats, rules.Window = numbers[0], time.Duration(numbers[1])*time.Second
+	case fields[0] == "caps" && len(numbers) == 1 && numbers[0] <= 100:
+		rules.CapsPercent = numbers[0]
+	case fields[0] == "mentions" && len(numbers) == 1:
+		rules.Mentions = numbers[0]
+	case fields[0] != "default" || len(numbers) != 0:
+		h.mu.Unlock()
+		return usage()
+	}
+	if fields[0] == "default" {
+		room.spam, rules = nil, h.cfg.Spam
+	} else {
+		room.spam = &rules
+	}
+	if err := h.saveRoomsLocked(); err != nil {
+		log.Printf("Error persisting rooms: %v", err)
+	}
+	h.mu.Unlock()
+
+	h.broadcastRoom(room, protocol.Systemf(room.name, "%s changed the spam rules in #%s: %s", chatter.Username, room.name, rules.String()), nil)
+	h.emit(Event{Type: EventModeration, Action: "spam_rules", Room: room.name, User: chatter.Username, Text: rules.String()})
+	return false
+}
@@ -0,0 +1,37 @@
+package hub
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSpamReason(t *testing.T) {
+	rules := SpamRules{Repeats: 3, Window: time.Minute, CapsPercent: 80, Mentions: 2}
+	now := time.Now()
+	var s spamState
+
+	tests := []struct {
+		room, text string
+		after      time.Duration
+		want       string
+	}{
+		{"lobby", "Buy cheap stuff!", 0, ""},
+		{"lobby", "buy  CHEAP stuff", time.Second, ""},
+		{"other", "buy cheap stuff", 2 * time.Second, ""}, // repeats are per room
+		{"lobby", "buy cheap stuff...", 3 * time.Second, "the same message again and again"},
+		{"lobby", "buy cheap stuff", 2 * time.Minute, ""}, // the others are out of the window
+		{"lobby", "OK LOL", 0, ""},
+		{"lobby", "THIS IS VERY IMPORTANT, read!", 0, "too many capitals"},
+		{"lobby", "@kari @ola look", 0, ""},
+		{"lobby", "@kari @ola @per look", 0, "too many mentions"},
+		{"lobby", "an email@example.com and @ alone", 0, ""},
+	}
+	for _, tt := range tests {
+		if got := spamReason(rules, &s, tt.room, tt.text, now.Add(tt.after)); got != tt.want {
+			t.Errorf("%q = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+	if got := spamReason(SpamRules{}, &s, "lobby", "@a @b @c @d SHOUTING REALLY LOUDLY", now); got != "" {
+		t.Errorf("zero rules found %q", got)
+	}
+}
@@ -0,0 +1,170 @@
+package hub
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// State lives in the store, JSON files in the data dir unless a database
+// is configured (see internal/store). These are the knobs and numbers for
+// it so a slow disk or database shows up in the metrics instead of as a
+// mysteriously sluggish hub, since most saves happen with a hub mutex held.
+
+// Upper bounds (seconds) of the storage latency histogram buckets
+var storageBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+type storageKey struct {
+	op   string // "load" or "save"
+	file string
+}
+
+// ######################################################################
+// struct: storageStats
+// ######################################################################
+type storageStats struct {
+	count      int64
+	errors     int64
+	slow       int64
+	latencySum float64
+	buckets    []int64 // cumulative per storageBuckets entry
+}
+
+// ######################################################################
+// struct: storageMetrics
+// ######################################################################
+// The pool caps how many reads and writes hit the data dir at once, nil
+// means no cap.
+type storageMetrics struct {
+	pool chan struct{}
+
+	mu    sync.Mutex
+	stats map[storageKey]*storageStats
+}
+
+func newStorageMetrics(poolSize int) *storageMetrics {
+	m := &storageMetrics{stats: make(map[storageKey]*storageStats)}
+	if poolSize > 0 {
+		m.pool = make(chan struct{}, poolSize)
+	}
+	return m
+}
+
+// ######################################################################
+// function: storageOp()
+// ######################################################################
+// Starts the clock and waits for a pool slot. Call the returned func with
+// the outcome when done. The span is a child of whatever ctx carries.
+//
+// The wait may happen with the hub mutex (or another hub lock) held: every
+// saveJSON from a *Locked saver does, saveRoomsLocked, saveAccountsLocked,
+// saveShadowBansLocked and the like, and appendAuditLocked under auditMu.
+// That is only safe because nothing between storageOp and done takes a hub
+// lock, a slot is held for the I/O alone. So a full pool holds such a
+// caller up for the I/O queued ahead of it and can't deadlock. Keep it so:
+// do the locking before storageOp or after done.
+func (h *Hub) storageOp(ctx context.Context, op, file string) func(error) {
+	m := h.storage
+	attrs := metric.WithAttributes(attribute.String("chat.storage.op", op), attribute.String("chat.storage.file", file))
+	ctx, span := tracer.Start(ctx, "storage."+op, trace.WithAttributes(attribute.String("chat.storage.file", file)))
+	start := time.Now()
+	if m.pool != nil {
+		m.pool <- struct{}{}
+	}
+	return func(err error) {
+		took := time.Since(start)
+		if m.pool != nil {
+			<-m.pool
+		}
+		storageDuration.Record(ctx, took.Seconds(), attrs)
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+		slow := h.cfg.StorageSlow > 0 && took >= h.cfg.StorageSlow
+		if slow {
+			log.Printf("Slow storage %s of %s: %v", op, file, took.Round(time.Millisecond))
+		}
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		key := storageKey{op, file}
+		stats, ok := m.stats[key]
+		if !ok {
+			stats = &storageStats{buckets: make([]int64, len(storageBuckets))}
+			m.stats[key] = stats
+		}
+		stats.count++
+		if err != nil {
+			stats.errors++
+		}
+		if slow {
+			stats.slow++
+		}
+		seconds := took.Seconds()
+		stats.latencySum += seconds
+		for i, le := range storageBuckets {
+			if seconds <= le {
+				stats.buckets[i]++
+			}
+		}
+	}
+}
+
+// ######################################################################
+// function: writeStorageMetrics()
+// ######################################################################
+// Prometheus text format, one series per operation and file.
+func (h *Hub) writeStorageMetrics(w io.Writer) {
+	m := h.storage
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]storageKey, 0, len(m.stats))
+	for key := range m.stats {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].file != keys[j].file {
+			return keys[i].file < keys[j].file
+		}
+		return keys[i].op < keys[j].op
+	})
+
+	fmt.Fprintln(w, "# HELP chat_storage_pool_in_use Storage operations running right now.")
+	fmt.Fprintln(w, "# TYPE chat_storage_pool_in_use gauge")
+	fmt.Fprintf(w, "chat_storage_pool_in_use %d\n", len(m.pool))
+	fmt.Fprintln(w, "# HELP chat_storage_pool_size Storage operations allowed at once, 0 = unlimited.")
+	fmt.Fprintln(w, "# TYPE chat_storage_pool_size gauge")
+	fmt.Fprintf(w, "chat_storage_pool_size %d\n", cap(m.pool))
+	fmt.Fprintln(w, "# HELP chat_storage_errors_total Failed loads and saves.")
+	fmt.Fprintln(w, "# TYPE chat_storage_errors_total counter")
+	for _, key := range keys {
+		fmt.Fprintf(w, "chat_storage_errors_total{op=%q,file=%q} %d\n", key.op, key.file, m.stats[key].errors)
+	}
+	fmt.Fprintln(w, "# HELP chat_storage_slow_total Loads and saves slower than the slow threshold.")
+	fmt.Fprintln(w, "# TYPE chat_storage_slow_total counter")
+	for _, key := range keys {
+		fmt.Fprintf(w, "chat_storage_slow_total{op=%q,file=%q} %d\n", key.op, key.file, m.stats[key].slow)
+	}
+	fmt.Fprintln(w, "# HELP chat_storage_latency_seconds Time per load or save, waiting for the pool included.")
+	fmt.Fprintln(w, "# TYPE chat_storage_latency_seconds histogram")
+	for _, key := range keys {
+		stats := m.stats[key]
+		for i, le := range storageBuckets {
+			fmt.Fprintf(w, "chat_storage_latency_seconds_bucket{op=%q,file=%q,le=\"%g\"} %d\n", key.op, key.file, le, stats.buckets[i])
+		}
+		fmt.Fprintf(w, "chat_storage_latency_seconds_bucket{op=%q,file=%q,le=\"+Inf\"} %d\n", key.op, key.file, stats.count)
+		fmt.Fprintf(w, "chat_storage_latency_seconds_sum{op=%q,file=%q} %g\n", key.op, key.file, stats.latencySum)
+		fmt.Fprintf(w, "chat_storage_latency_seconds_count{op=%q,file=%q} %d\n", key.op, key.file, stats.count)
+	}
+}
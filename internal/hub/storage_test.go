@@ -0,0 +1,79 @@
+package hub
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStorageMetrics(t *testing.T) {
+	dir := t.TempDir()
+	h := New(Config{DataDir: dir, StorageSlow: time.Nanosecond}) // everything is slow
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	h.saveJSON("test.json", map[string]int{"a": 1})
+	h.saveJSON("test.json", map[string]int{"a": 2})
+	var v map[string]int
+	if err := h.loadJSON("test.json", &v); err != nil || v["a"] != 2 {
+		t.Fatalf("loaded %v %v", v, err)
+	}
+	os.WriteFile(filepath.Join(dir, "broken.json"), []byte("{"), 0o600)
+	if err := h.loadJSON("broken.json", &v); err == nil {
+		t.Fatal("loading broken JSON worked")
+	}
+
+	var metrics bytes.Buffer
+	h.writeStorageMetrics(&metrics)
+	for _, want := range []string{
+		`chat_storage_latency_seconds_count{op="save",file="test.json"} 2`,
+		`chat_storage_latency_seconds_count{op="load",file="test.json"} 1`,
+		`chat_storage_errors_total{op="load",file="test.json"} 0`,
+		`chat_storage_errors_total{op="load",file="broken.json"} 1`,
+		`chat_storage_slow_total{op="save",file="test.json"} 2`,
+		`chat_storage_latency_seconds_bucket{op="save",file="test.json",le="+Inf"} 2`,
+		"chat_storage_pool_size 0",
+	} {
+		if !strings.Contains(metrics.String(), want) {
+			t.Errorf("no %s in\n%s", want, metrics.String())
+		}
+	}
+	if n := strings.Count(logged.String(), "Slow storage save of test.json"); n != 2 {
+		t.Errorf("%d slow saves logged:\n%s", n, logged.String())
+	}
+}
+
+func TestStoragePool(t *testing.T) {
+	h := New(Config{DataDir: t.TempDir(), StoragePool: 1})
+	done := h.storageOp(context.Background(), "save", "held.json")
+
+	// the only slot is taken, so the next save waits for it
+	saved := make(chan error)
+	go func() { saved <- h.saveJSON("test.json", 1) }()
+	select {
+	case <-saved:
+		t.Fatal("saved while the pool was full")
+	case <-time.After(50 * time.Millisecond):
+	}
+	var metrics bytes.Buffer
+	h.writeStorageMetrics(&metrics)
+	if !strings.Contains(metrics.String(), "chat_storage_pool_in_use 1\n") {
+		t.Errorf("pool use not in\n%s", metrics.String())
+	}
+
+	done(nil)
+	select {
+	case err := <-saved:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("save never got the slot")
+	}
+}
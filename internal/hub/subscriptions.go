@@ -0,0 +1,105 @@
+package hub
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"go-chat-app/internal/protocol"
+)
+
+const (
+	maxSubscribedCommands = 50
+	maxSubscribedPatterns = 10
+	maxPatternLen         = 200
+)
+
+// ######################################################################
+// struct: subscription
+// ######################################################################
+// What a bot wants to hear. A chatter with a subscription only gets the
+// chat lines in its room that match it, plus its own, instead of the whole
+// firehose. Everything else (joins, topics, whispers to it) still arrives.
+type subscription struct {
+	commands map[string]bool // lower case, without the !
+	patterns []*regexp.Regexp
+}
+
+// ######################################################################
+// function: newSubscription()
+// ######################################################################
+// nil if both lists are empty, which means everything again.
+func newSubscription(commands, patterns []string) (*subscription, error) {
+	if len(commands) == 0 && len(patterns) == 0 {
+		return nil, nil
+	}
+	if len(commands) > maxSubscribedCommands || len(patterns) > maxSubscribedPatterns {
+		return nil, fmt.Errorf("at most %d commands and %d patterns", maxSubscribedCommands, maxSubscribedPatterns)
+	}
+	s := &subscription{commands: make(map[string]bool)}
+	for _, c := range commands {
+		c = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(c), "!"))
+		if c != "" {
+			s.commands[c] = true
+		}
+	}
+	for _, p := range patterns {
+		if len(p) > maxPatternLen {
+			return nil, fmt.Errorf("patterns can be at most %d bytes", maxPatternLen)
+		}
+		re, err := regexp.Compile(p) // RE2, so no pattern can stall the hub
+		if err != nil {
+			return nil, fmt.Errorf("bad pattern %q: %v", p, err)
+		}
+		s.patterns = append(s.patterns, re)
+	}
+	return s, nil
+}
+
+// ######################################################################
+// function: matches()
+// ######################################################################
+func (s *subscription) matches(text string) bool {
+	if first, _, _ := strings.Cut(text, " "); strings.HasPrefix(first, "!") && s.commands[strings.ToLower(first[1:])] {
+		return true
+	}
+	for _, re := range s.patterns {
+		if re.MatchString(text) {
+			return true
+		}
+	}
+	return false
+}
+
+// ######################################################################
+// function: wantsMessageLocked()
+// ######################################################################
+// Own messages are echoed by postMessage, names aren't unique so they can't
+// be told apart here. Caller holds the mutex.
+func (c *Chatter) wantsMessageLocked(f protocol.Frame) bool {
+	return c.subscription == nil || c.subscription.matches(f.Text)
+}
+
+// ######################################################################
+// function: subscribe()
+// ######################################################################
+func (h *Hub) subscribe(chatter *Chatter, commands, patterns []string) error {
+	commands, err := h.botSubscription(chatter, commands, patterns)
+	if err != nil {
+		return err
+	}
+	s, err := newSubscription(commands, patterns)
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	chatter.subscription = s
+	h.mu.Unlock()
+
+	if s == nil {
+		chatter.SendSystem("Subscription removed, you get every message again.")
+	} else {
+		chatter.SendSystem("Subscribed to %d commands and %d patterns.", len(s.commands), len(s.patterns))
+	}
+	return nil
+}
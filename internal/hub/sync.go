@@ -0,0 +1,177 @@
+package hub
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"go-chat-app/internal/protocol"
+)
+
+// How many room changes are kept for clients catching up. The log is
+// trimmed in chunks so it isn't copied on every message.
+const (
+	maxChanges  = 10000
+	changeSlack = maxChanges / 4
+)
+
+// Frame types that change what a client has stored for a room. Polls and
+// previews update messages that went out already, there is no editing
+// messages otherwise.
+var syncFrames = map[string]bool{
+	protocol.FrameMessage:  true,
+	protocol.FrameDeleted:  true,
+	protocol.FrameReaction: true,
+	protocol.FramePoll:     true,
+	protocol.FramePreview:  true,
+}
+
+var ErrBadCursor = errors.New("invalid cursor")
+
+type change struct {
+	seq     int64
+	frame   protocol.Frame
+	account string // only for this account's syncs, "" = for the room
+}
+
+// ######################################################################
+// struct: SyncResult
+// ######################################################################
+// Reset means the cursor is too old, or from before a restart: reload the
+// rooms' history and sync from Cursor on. More means there is another page.
+type SyncResult struct {
+	Cursor  string           `json:"cursor"`
+	Reset   bool             `json:"reset,omitempty"`
+	More    bool             `json:"more,omitempty"`
+	Changes []protocol.Frame `json:"changes"`
+}
+
+// A cursor is "<epoch>.<seq>". The log only lives in memory and seqs start
+// over with every start, so the epoch tells cursors from an earlier run
+// apart from ones that happen to be in range.
+func (h *Hub) cursor(seq int64) string {
+	return h.changeEpoch + "." + strconv.FormatInt(seq, 10)
+}
+
+// ######################################################################
+// function: recordChangeLocked()
+// ######################################################################
+// Caller holds the mutex.
+func (h *Hub) recordChangeLocked(f protocol.Frame) {
+	if !syncFrames[f.Type] || f.TTLMs > 0 {
+		return // self-destructing messages are never stored, don't sync them either
+	}
+	f.Ack = false
+	h.appendChangeLocked(change{frame: f})
+}
+
+// ######################################################################
+// function: recordReadLocked()
+// ######################################################################
+// A read marker of account moved, for its other devices to catch up on.
+// Caller holds the mutex.
+func (h *Hub) recordReadLocked(account, room string, id int64) {
+	h.appendChangeLocked(change{frame: protocol.Frame{Type: protocol.FrameRead, Room: room, ID: id}, account: account})
+}
+
+// Caller holds the mutex.
+func (h *Hub) appendChangeLocked(c change) {
+	h.changeSeq++
+	c.seq = h.changeSeq
+	h.changes = append(h.changes, c)
+	if len(h.changes) > maxChanges+changeSlack {
+		h.changes = append(h.changes[:0:0], h.changes[len(h.changes)-maxChanges:]...)
+	}
+}
+
+// ######################################################################
+// function: Sync()
+// ######################################################################
+// Everything that changed in the given rooms after cursor since ("" for
+// the start), oldest first, at most limit of them. No rooms means every
+// room. account ("" for guests) gets the locked rooms it is in or got
+// into before, and its own read markers, everyone else only open rooms.
+func (h *Hub) Sync(since, account string, rooms []string, limit int) (SyncResult, error) {
+	var seq int64
+	epoch := h.changeEpoch
+	if since != "" {
+		e, n, found := strings.Cut(since, ".")
+		if !found {
+			e, n = "", since // a bare number, from before cursors had epochs
+		}
+		var err error
+		if seq, err = strconv.ParseInt(n, 10, 64); err != nil || seq < 0 {
+			return SyncResult{}, ErrBadCursor
+		}
+		epoch = e
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	res := SyncResult{Cursor: h.cursor(h.changeSeq), Changes: []protocol.Frame{}}
+
+	first := h.changeSeq + 1 // seq of h.changes[0], seqs have no gaps
+	if len(h.changes) > 0 {
+		first = h.changes[0].seq
+	}
+	if epoch != h.changeEpoch || seq > h.changeSeq || seq+1 < first {
+		res.Reset = true
+		return res, nil
+	}
+
+	wanted := make(map[string]bool)
+	for _, name := range rooms {
+		wanted[name] = true
+	}
+	visible := make(map[*Room]bool)
+	for _, c := range h.changes[seq+1-first:] {
+		room, ok := h.rooms[c.frame.Room]
+		if !ok || (len(wanted) > 0 && !wanted[room.name]) {
+			continue
+		}
+		if c.account != "" {
+			if c.account != account {
+				continue
+			}
+		} else {
+			allowed, seen := visible[room]
+			if !seen {
+				allowed = room.publicLocked() || room.belongsLocked(account)
+				visible[room] = allowed
+			}
+			if !allowed {
+				continue
+			}
+		}
+		if limit > 0 && len(res.Changes) == limit {
+			res.More = true
+			break
+		}
+		res.Changes = append(res.Changes, c.frame)
+		res.Cursor = h.cursor(c.seq)
+	}
+	if !res.More {
+		res.Cursor = h.cursor(h.changeSeq) // nothing for these rooms in the rest
+	}
+	return res, nil
+}
+
+// ######################################################################
+// function: belongsLocked()
+// ######################################################################
+// Whether account got into the room, or is in it on some device right now.
+// Caller holds the mutex.
+func (room *Room) belongsLocked(account string) bool {
+	if account == "" {
+		return false
+	}
+	if room.accounts[account] {
+		return true
+	}
+	for c := range room.members {
+		if c.account == account {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,70 @@
+package hub
+
+import (
+	"context"
+	"log"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// OpenTelemetry instruments, see internal/telemetry. They do nothing unless
+// an exporter is set up, so they're always there.
+
+var tracer = otel.Tracer("go-chat-app/internal/hub")
+
+var (
+	messageDuration  metric.Float64Histogram // receipt of a chat line to the end of its fan-out
+	fanoutRecipients metric.Int64Histogram   // deliveries per broadcast
+	storageDuration  metric.Float64Histogram // per load or save, like chat_storage_latency_seconds
+	eventsDropped    metric.Int64Counter     // events an exporter was too slow for
+)
+
+func init() {
+	meter := otel.Meter("go-chat-app/internal/hub")
+	var errs [4]error
+	messageDuration, errs[0] = meter.Float64Histogram("chat.message.duration",
+		metric.WithUnit("s"), metric.WithDescription("Time from receiving a chat line to having handed it to every member of the room."))
+	fanoutRecipients, errs[1] = meter.Int64Histogram("chat.fanout.recipients",
+		metric.WithUnit("{recipient}"), metric.WithDescription("Connections a broadcast went out to."))
+	storageDuration, errs[2] = meter.Float64Histogram("chat.storage.duration",
+		metric.WithUnit("s"), metric.WithDescription("Time per load or save of the store, waiting for the pool included."))
+	eventsDropped, errs[3] = meter.Int64Counter("chat.events.dropped",
+		metric.WithUnit("{event}"), metric.WithDescription("Events an exporter fell too far behind to get."))
+	for _, err := range errs {
+		if err != nil {
+			log.Printf("Error creating telemetry instrument: %v", err)
+		}
+	}
+}
+
+// ######################################################################
+// function: observe()
+// ######################################################################
+// Gauges read straight off the hub when the exporter asks. Call the
+// returned func to stop.
+func (h *Hub) observe() func() {
+	meter := otel.Meter("go-chat-app/internal/hub")
+	connections, err := meter.Int64ObservableGauge("chat.connections",
+		metric.WithUnit("{connection}"), metric.WithDescription("Open client connections."))
+	if err != nil {
+		log.Printf("Error creating telemetry instrument: %v", err)
+		return func() {}
+	}
+	messages, err := meter.Int64ObservableCounter("chat.messages",
+		metric.WithUnit("{message}"), metric.WithDescription("Chat lines posted since start."))
+	if err != nil {
+		log.Printf("Error creating telemetry instrument: %v", err)
+		return func() {}
+	}
+	reg, err := meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		o.ObserveInt64(connections, int64(h.chatters.len()))
+		o.ObserveInt64(messages, h.posted.Load())
+		return nil
+	}, connections, messages)
+	if err != nil {
+		log.Printf("Error registering telemetry callback: %v", err)
+		return func() {}
+	}
+	return func() { reg.Unregister() }
+}
@@ -0,0 +1,168 @@
+package hub
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"go-chat-app/internal/protocol"
+)
+
+// A transcript is a room's history between two times, from the store and
+// what's in memory. /export hands moderators a link to download one, the
+// link is good for exportTTL and only for that room and range. Admins get
+// them straight from the admin API.
+
+const exportTTL = 15 * time.Minute
+
+// Transcript formats
+const (
+	TranscriptJSON = "json"
+	TranscriptCSV  = "csv"
+	TranscriptText = "text"
+)
+
+var (
+	ErrExportToken = errors.New("that export link is invalid or has expired")
+	errExportRange = errors.New("dates are YYYY-MM-DD or RFC 3339, and from comes before to")
+)
+
+type exportToken struct {
+	room     string
+	format   string
+	from, to time.Time
+	expires  time.Time
+}
+
+// ######################################################################
+// function: Transcript()
+// ######################################################################
+// Messages of room sent in [from, to), oldest first. A zero time doesn't
+// limit.
+func (h *Hub) Transcript(room string, from, to time.Time) ([]protocol.Frame, error) {
+	h.mu.Lock()
+	r, ok := h.rooms[room]
+	if !ok {
+		h.mu.Unlock()
+		return nil, ErrNoRoom
+	}
+	recent := r.recentLocked(0)
+	h.mu.Unlock()
+
+	byID := make(map[int64]protocol.Frame)
+	if h.cfg.HistorySize > 0 {
+		done := h.storageOp(context.Background(), "load", messagesDoc)
+		stored, err := h.cfg.Store.Messages(room, 0)
+		done(err)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range stored {
+			byID[f.ID] = f
+		}
+	}
+	for _, f := range recent {
+		byID[f.ID] = f // newer reactions than the store, maybe
+	}
+
+	var messages []protocol.Frame
+	for _, f := range byID {
+		if (from.IsZero() || !f.SentAt.Before(from)) && (to.IsZero() || f.SentAt.Before(to)) {
+			messages = append(messages, f)
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool { return messages[i].ID < messages[j].ID })
+	return messages, nil
+}
+
+// ######################################################################
+// function: ParseTranscriptRange()
+// ######################################################################
+// from and to as "2024-05-01" or RFC 3339, either may be "". A date as to
+// means up to the end of that day.
+func ParseTranscriptRange(from, to string) (time.Time, time.Time, error) {
+	parse := func(s string, end bool) (time.Time, error) {
+		if s == "" {
+			return time.Time{}, nil
+		}
+		if day, err := time.Parse(time.DateOnly, s); err == nil {
+			if end {
+				day = day.AddDate(0, 0, 1)
+			}
+			return day, nil
+		}
+		return time.Parse(time.RFC3339, s)
+	}
+	start, err := parse(from, false)
+	if err != nil {
+		return time.Time{}, time.Time{}, errExportRange
+	}
+	end, err := parse(to, true)
+	if err != nil || (!start.IsZero() && !end.IsZero() && !start.Before(end)) {
+		return time.Time{}, time.Time{}, errExportRange
+	}
+	return start, end, nil
+}
+
+// ######################################################################
+// function: ExportTranscript()
+// ######################################################################
+// The transcript an /export link is for, and its room and format.
+func (h *Hub) ExportTranscript(token string) (room, format string, messages []protocol.Frame, err error) {
+	h.exportMu.Lock()
+	et, ok := h.exports[token]
+	h.exportMu.Unlock()
+	if !ok || time.Now().After(et.expires) {
+		return "", "", nil, ErrExportToken
+	}
+	messages, err = h.Transcript(et.room, et.from, et.to)
+	return et.room, et.format, messages, err
+}
+
+// ######################################################################
+// function: cmdExport()
+// ######################################################################
+// /export [json|csv|text] [from] [to] links a download of the room's
+// transcript, plain text if no format is given.
+func (h *Hub) cmdExport(chatter *Chatter, args string) bool {
+	fields := strings.Fields(args)
+	format := TranscriptText
+	if len(fields) > 0 {
+		switch fields[0] {
+		case TranscriptJSON, TranscriptCSV, TranscriptText:
+			format, fields = fields[0], fields[1:]
+		}
+	}
+	if len(fields) > 2 {
+		chatter.SendError(protocol.CodeInvalid, "Usage: /export [json|csv|text] [from] [to]")
+		return false
+	}
+	fields = append(fields, "", "")
+	from, to, err := ParseTranscriptRange(fields[0], fields[1])
+	if err != nil {
+		chatter.SendError(protocol.CodeInvalid, "Dates are YYYY-MM-DD or RFC 3339, and from comes before to.")
+		return false
+	}
+
+	room := chatter.room.name
+	token := randomToken(16)
+	now := time.Now()
+	h.exportMu.Lock()
+	for t, old := range h.exports {
+		if now.After(old.expires) {
+			delete(h.exports, t)
+		}
+	}
+	h.exports[token] = exportToken{room: room, format: format, from: from, to: to, expires: now.Add(exportTTL)}
+	h.exportMu.Unlock()
+
+	link := strings.TrimSuffix(h.cfg.PublicURL, "/") + "/api/export?token=" + url.QueryEscape(token)
+	log.Printf("%s exported the transcript of #%s", chatter.Username, room)
+	h.Audit(AuditEntry{Actor: chatter.Username, Action: "export", Room: room, IP: chatter.IP})
+	chatter.SendSystem("Transcript of #%s, for the next %s: %s", room, exportTTL, link)
+	return false
+}
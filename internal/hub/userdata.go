@@ -0,0 +1,259 @@
+package hub
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go-chat-app/internal/protocol"
+)
+
+// ######################################################################
+// struct: DataExport
+// ######################################################################
+// Everything the server keeps about an account. Messages are attributed by
+// name, which the account owns, so they are the ones still in room history
+// and pins under that name.
+type DataExport struct {
+	Exported  time.Time          `json:"exported"`
+	Account   Account            `json:"account"`
+	Messages  []protocol.Frame   `json:"messages"`
+	Pins      []protocol.Frame   `json:"pins"`
+	Missed    []protocol.Frame   `json:"missed"` // queued while signed out
+	Scheduled []ScheduledMessage `json:"scheduled"`
+	Ignored   []string           `json:"ignored"`
+	ReadMarks map[string]int64   `json:"read_marks"` // room -> last read message ID
+}
+
+// ######################################################################
+// function: ExportData()
+// ######################################################################
+func (h *Hub) ExportData(id string) (DataExport, error) {
+	a, ok := h.Account(id)
+	if !ok {
+		return DataExport{}, ErrNoAccount
+	}
+	export := DataExport{
+		Exported:  time.Now(),
+		Account:   a,
+		Messages:  []protocol.Frame{},
+		Pins:      []protocol.Frame{},
+		Missed:    []protocol.Frame{},
+		Scheduled: []ScheduledMessage{},
+		Ignored:   []string{},
+		ReadMarks: map[string]int64{},
+	}
+
+	h.mu.Lock()
+	for _, room := range h.rooms {
+		for _, f := range room.history {
+			if f.From == a.Name {
+				export.Messages = append(export.Messages, f)
+			}
+		}
+		for _, f := range room.pins {
+			if f.From == a.Name {
+				export.Pins = append(export.Pins, f)
+			}
+		}
+	}
+	h.mu.Unlock()
+
+	h.offlineMu.Lock()
+	export.Missed = append(export.Missed, h.offline[id]...)
+	h.offlineMu.Unlock()
+
+	h.ignoresMu.Lock()
+	export.Ignored = append(export.Ignored, h.ignores[id]...)
+	h.ignoresMu.Unlock()
+
+	h.readMarksMu.Lock()
+	for room, last := range h.readMarks[id] {
+		export.ReadMarks[room] = last
+	}
+	h.readMarksMu.Unlock()
+
+	h.scheduleMu.Lock()
+	for _, m := range h.scheduled {
+		if m.From == a.Name {
+			export.Scheduled = append(export.Scheduled, m)
+		}
+	}
+	h.scheduleMu.Unlock()
+	return export, nil
+}
+
+// ######################################################################
+// function: DeleteAccount()
+// ######################################################################
+// Forgets the account, its ignore list and read markers and scrubs its messages, pins,
+// reactions, queued and scheduled messages. Rooms get a deleted frame for every message that
+// goes, the account's connections are closed. There are no uploads kept on
+// the server to remove.
+func (h *Hub) DeleteAccount(id string) error {
+	h.accountsMu.Lock()
+	a, ok := h.accounts[id]
+	if !ok {
+		h.accountsMu.Unlock()
+		return ErrNoAccount
+	}
+	name := a.Name
+	for _, ident := range a.Identities {
+		delete(h.identities, ident.key())
+	}
+	for token, lt := range h.logins {
+		if lt.account == id {
+			delete(h.logins, token)
+		}
+	}
+	for token, lt := range h.linkTokens {
+		if lt.account == id {
+			delete(h.linkTokens, token)
+		}
+	}
+	for token, mt := range h.mailTokens {
+		if mt.account == id {
+			delete(h.mailTokens, token)
+		}
+	}
+	delete(h.accounts, id)
+	h.saveAccountsLocked()
+	h.accountsMu.Unlock()
+
+	h.ignoresMu.Lock()
+	delete(h.ignores, id)
+	h.saveIgnoresLocked()
+	h.ignoresMu.Unlock()
+
+	h.readMarksMu.Lock()
+	delete(h.readMarks, id)
+	h.saveReadMarksLocked()
+	h.readMarksMu.Unlock()
+
+	h.scrubOffline(id, name)
+	h.scheduleMu.Lock()
+	for key, m := range h.scheduled {
+		if m.From == name {
+			delete(h.scheduled, key)
+		}
+	}
+	if err := h.saveJSON(scheduledFile, h.scheduled); err != nil {
+		log.Printf("Error persisting scheduled messages: %v", err)
+	}
+	h.scheduleMu.Unlock()
+
+	redacted, unreacted := h.scrubRooms(name)
+	done := h.storageOp(context.Background(), "delete", messagesDoc)
+	err := h.cfg.Store.DeleteMessagesFrom(name)
+	done(err)
+	if err != nil {
+		log.Printf("Error deleting stored messages of %s: %v", name, err)
+	}
+	for _, f := range unreacted {
+		h.storeMessage(context.Background(), f)
+	}
+	for room, ids := range redacted {
+		for _, msgID := range ids {
+			h.broadcastRoom(room, protocol.Frame{Type: protocol.FrameDeleted, Room: room.name, ID: msgID}, nil)
+		}
+	}
+
+	for _, chatter := range h.accountChatters(id) {
+		h.mu.Lock()
+		chatter.kicked = true // the session belongs to an account that is gone
+		chatter.account = ""
+		h.mu.Unlock()
+		chatter.SendSystem("Your account has been deleted.")
+		chatter.Close()
+	}
+	log.Printf("Deleted account %s (%s)", id, name)
+	h.Audit(AuditEntry{Actor: name, Action: "delete_account", Target: id})
+	return nil
+}
+
+// Drops the account's queue and what it sent to everyone else's.
+func (h *Hub) scrubOffline(id, name string) {
+	h.offlineMu.Lock()
+	defer h.offlineMu.Unlock()
+	delete(h.offline, id)
+	for account, queue := range h.offline {
+		kept := queue[:0]
+		for _, f := range queue {
+			if f.From != name {
+				kept = append(kept, f)
+			}
+		}
+		if len(kept) == 0 {
+			delete(h.offline, account)
+		} else {
+			h.offline[account] = kept
+		}
+	}
+	h.saveOfflineLocked()
+}
+
+// Takes name's messages out of every room's history and pins, and its
+// reactions off everyone else's. Returns the IDs that went, by room, and
+// copies of the messages that lost reactions.
+func (h *Hub) scrubRooms(name string) (map[*Room][]int64, []protocol.Frame) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	redacted := make(map[*Room][]int64)
+	var unreacted []protocol.Frame
+	pinsChanged := false
+	for _, room := range h.rooms {
+		gone := make(map[int64]bool)
+		history := room.history[:0]
+		for _, f := range room.history {
+			if f.From == name {
+				gone[f.ID] = true
+				redacted[room] = append(redacted[room], f.ID)
+				continue
+			}
+			changed := false
+			for emoji, who := range f.Reactions {
+				kept := who[:0:0] // the old slice may be out in a frame
+				for _, n := range who {
+					if n != name {
+						kept = append(kept, n)
+					}
+				}
+				changed = changed || len(kept) < len(who)
+				if len(kept) == 0 {
+					delete(f.Reactions, emoji)
+				} else {
+					f.Reactions[emoji] = kept
+				}
+			}
+			if changed {
+				stored := f
+				stored.Reactions = make(map[string][]string, len(f.Reactions))
+				for emoji, who := range f.Reactions {
+					stored.Reactions[emoji] = who
+				}
+				unreacted = append(unreacted, stored)
+			}
+			history = append(history, f)
+		}
+		room.history = history
+
+		pins := room.pins[:0]
+		for _, f := range room.pins {
+			if f.From != name {
+				pins = append(pins, f)
+				continue
+			}
+			pinsChanged = true
+			if !gone[f.ID] {
+				redacted[room] = append(redacted[room], f.ID)
+			}
+		}
+		room.pins = pins
+	}
+	if pinsChanged {
+		if err := h.saveRoomsLocked(); err != nil {
+			log.Printf("Error persisting rooms: %v", err)
+		}
+	}
+	return redacted, unreacted
+}
@@ -0,0 +1,76 @@
+package hub
+
+import (
+	"go-chat-app/internal/protocol"
+)
+
+// Frame types a read-only viewer gets to see
+var watcherFrames = map[string]bool{
+	protocol.FrameMessage:      true,
+	protocol.FrameDeleted:      true,
+	protocol.FrameTopicChanged: true,
+}
+
+// ######################################################################
+// function: PublicRoom()
+// ######################################################################
+// True if the room exists and anyone may read it.
+func (h *Hub) PublicRoom(name string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	room, ok := h.rooms[name]
+	return ok && room.publicLocked()
+}
+
+func (room *Room) publicLocked() bool {
+	return room.passwordHash == "" && !room.inviteOnly
+}
+
+// ######################################################################
+// function: Watch()
+// ######################################################################
+// Subscribes a read-only viewer to a public room. Returns the frames to
+// follow, the topic and last backlog messages to start with, and a func
+// to call when the viewer goes away. False if the room is not public.
+func (h *Hub) Watch(name string, backlog int) (<-chan protocol.Frame, []protocol.Frame, func(), bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	room, ok := h.rooms[name]
+	if !ok || !room.publicLocked() {
+		return nil, nil, nil, false
+	}
+
+	frames := make(chan protocol.Frame, 64)
+	room.watchers[frames] = false
+	recent := room.recentLocked(backlog)
+	if room.topic != "" {
+		recent = append([]protocol.Frame{{Type: protocol.FrameTopicChanged, Room: room.name, Text: room.topic}}, recent...)
+	}
+	stop := func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(room.watchers, frames)
+		if room.disposableLocked() {
+			delete(h.rooms, room.name)
+		}
+	}
+	return frames, recent, stop, true
+}
+
+// ######################################################################
+// function: notifyWatchersLocked()
+// ######################################################################
+// Hands the frame to read-only viewers of the room. A viewer that can't
+// keep up misses frames rather than holding up the broadcast.
+// Caller holds the mutex.
+func (room *Room) notifyWatchersLocked(f protocol.Frame) {
+	for ch, everything := range room.watchers {
+		if !everything && !watcherFrames[f.Type] {
+			continue
+		}
+		select {
+		case ch <- f:
+		default:
+		}
+	}
+}
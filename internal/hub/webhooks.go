@@ -0,0 +1,286 @@
+package hub
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+const webhooksFile = "webhooks.json"
+
+// Event types a webhook can ask for
+const (
+	EventMessage    = "message"    // chat line posted
+	EventJoin       = "join"       // someone entered a room
+	EventLeave      = "leave"      // someone left a room or disconnected
+	EventModeration = "moderation" // strikes, kicks, bans, slow mode, topic changes
+	EventBan        = "ban"        // an IP was banned, by automod or an admin
+	EventRename     = "rename"     // someone changed their name, from user to text
+)
+
+var (
+	errWebhookURL   = errors.New("webhook url must be http or https")
+	errWebhookEvent = fmt.Errorf("unknown event type, use %s, %s, %s, %s, %s or %s", EventMessage, EventJoin, EventLeave, EventModeration, EventBan, EventRename)
+)
+
+var webhookClient = &http.Client{Timeout: 5 * time.Second}
+
+// A failed delivery is tried again after 1s, 2s, 4s and 8s, then dropped.
+const (
+	webhookAttempts = 5
+	webhookBackoff  = time.Second
+)
+
+// ######################################################################
+// struct: Webhook
+// ######################################################################
+// An URL that gets events POSTed to it as JSON. Empty Events or Rooms mean
+// all of them. Filtering happens here, so a hook for #ops moderation never
+// sees a single chat line. Every POST is signed with Secret, see sign().
+type Webhook struct {
+	ID      string    `json:"id"`
+	URL     string    `json:"url"`
+	Secret  string    `json:"secret"`
+	Events  []string  `json:"events,omitempty"`
+	Rooms   []string  `json:"rooms,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+func (w Webhook) wants(ev Event) bool {
+	if len(w.Events) > 0 && !slices.Contains(w.Events, ev.Type) &&
+		!(ev.Type == EventBan && slices.Contains(w.Events, EventModeration)) { // bans were moderation events before they got their own
+		return false
+	}
+	// events without a room only go to hooks that didn't pick rooms
+	return len(w.Rooms) == 0 || (ev.Room != "" && slices.Contains(w.Rooms, ev.Room))
+}
+
+// ######################################################################
+// struct: Event
+// ######################################################################
+// What a webhook gets. Action says which kind of moderation it was, for
+// bans who did it ("automod" or "admin").
+type Event struct {
+	Type   string    `json:"type"`
+	Action string    `json:"action,omitempty"`
+	Room   string    `json:"room,omitempty"`
+	User   string    `json:"user,omitempty"`
+	Text   string    `json:"text,omitempty"`
+	ID     int64     `json:"id,omitempty"` // message ID
+	IP     string    `json:"ip,omitempty"`
+	Until  time.Time `json:"until,omitempty"`
+	At     time.Time `json:"at"`
+
+	Trace trace.SpanContext `json:"-"` // what it happened in, for exporters to link to
+}
+
+// ######################################################################
+// function: AddWebhook()
+// ######################################################################
+func (h *Hub) AddWebhook(w Webhook) (Webhook, error) {
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return Webhook{}, errWebhookURL
+	}
+	for _, typ := range w.Events {
+		if typ != EventMessage && typ != EventJoin && typ != EventLeave && typ != EventModeration && typ != EventBan && typ != EventRename {
+			return Webhook{}, errWebhookEvent
+		}
+	}
+	w.ID = randomToken(6)
+	w.Secret = randomToken(32)
+	w.Created = time.Now()
+
+	h.webhooksMu.Lock()
+	defer h.webhooksMu.Unlock()
+	h.webhooks[w.ID] = w
+	h.saveWebhooksLocked()
+	return w, nil
+}
+
+// ######################################################################
+// function: RemoveWebhook()
+// ######################################################################
+func (h *Hub) RemoveWebhook(id string) bool {
+	h.webhooksMu.Lock()
+	defer h.webhooksMu.Unlock()
+	if _, ok := h.webhooks[id]; !ok {
+		return false
+	}
+	delete(h.webhooks, id)
+	h.saveWebhooksLocked()
+	return true
+}
+
+// ######################################################################
+// function: Webhooks()
+// ######################################################################
+// Every webhook, oldest first.
+func (h *Hub) Webhooks() []Webhook {
+	h.webhooksMu.Lock()
+	list := make([]Webhook, 0, len(h.webhooks))
+	for _, w := range h.webhooks {
+		list = append(list, w)
+	}
+	h.webhooksMu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	return list
+}
+
+// ######################################################################
+// function: Events()
+// ######################################################################
+// Every event the webhooks could get, for exporters like Kafka. One that
+// falls behind misses events, they're logged. Call the returned func to
+// stop.
+func (h *Hub) Events() (<-chan Event, func()) {
+	events := make(chan Event, 1024)
+	h.webhooksMu.Lock()
+	if h.taps == nil {
+		h.taps = make(map[chan Event]bool)
+	}
+	h.taps[events] = true
+	h.webhooksMu.Unlock()
+	stop := func() {
+		h.webhooksMu.Lock()
+		delete(h.taps, events)
+		h.webhooksMu.Unlock()
+	}
+	return events, stop
+}
+
+// ######################################################################
+// function: emit()
+// ######################################################################
+// Hands ev to every webhook that wants it. Delivery happens in the
+// background, a slow receiver never holds up the chat.
+func (h *Hub) emit(ev Event) {
+	ev.At = time.Now()
+	h.webhooksMu.Lock()
+	for tap := range h.taps {
+		select {
+		case tap <- ev:
+		default:
+			eventsDropped.Add(context.Background(), 1)
+			log.Printf("Error exporting %s event: exporter is behind, dropped", ev.Type)
+		}
+	}
+	var targets []Webhook
+	for _, w := range h.webhooks {
+		if w.wants(ev) {
+			targets = append(targets, w)
+		}
+	}
+	h.webhooksMu.Unlock()
+	if len(targets) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(ev)
+	if err != nil {
+		log.Printf("Error encoding webhook event: %v", err)
+		return
+	}
+	delivery := randomToken(8)
+	for _, w := range targets {
+		go deliverWebhook(w, delivery, body)
+	}
+}
+
+// Tries until the receiver takes it, a 4xx other than 429 means it never
+// will. The delivery ID stays the same across tries so receivers can drop
+// repeats.
+func deliverWebhook(w Webhook, delivery string, body []byte) {
+	backoff := webhookBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := postWebhook(w, delivery, body)
+		if err == nil {
+			return
+		}
+		if !retry || attempt == webhookAttempts {
+			log.Printf("Error delivering webhook to %s, giving up after %d tries: %v", w.URL, attempt, err)
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func postWebhook(w Webhook, delivery string, body []byte) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Chat-Delivery", delivery)
+	req.Header.Set("X-Chat-Timestamp", ts)
+	req.Header.Set("X-Chat-Signature", "sha256="+signWebhook(w.Secret, ts, body))
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests, errors.New(resp.Status)
+	}
+	return false, nil
+}
+
+// ######################################################################
+// function: signWebhook()
+// ######################################################################
+// Hex HMAC-SHA256 over "<timestamp>.<body>" with the hook's secret. The
+// timestamp is in there so a captured request can't be replayed later.
+func signWebhook(secret, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ######################################################################
+// function: loadWebhooks()
+// ######################################################################
+func (h *Hub) loadWebhooks() {
+	h.webhooksMu.Lock()
+	defer h.webhooksMu.Unlock()
+	if err := h.loadJSON(webhooksFile, &h.webhooks); err != nil {
+		log.Printf("Error loading webhooks: %v", err)
+	}
+	if h.webhooks == nil {
+		h.webhooks = make(map[string]Webhook)
+	}
+	changed := false
+	for id, w := range h.webhooks {
+		if w.Secret == "" { // added before deliveries were signed
+			w.Secret = randomToken(32)
+			h.webhooks[id] = w
+			changed = true
+		}
+	}
+	if changed {
+		h.saveWebhooksLocked()
+	}
+}
+
+// Caller holds webhooksMu.
+func (h *Hub) saveWebhooksLocked() {
+	if err := h.saveJSON(webhooksFile, h.webhooks); err != nil {
+		log.Printf("Error persisting webhooks: %v", err)
+	}
+}
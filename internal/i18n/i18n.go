@@ -0,0 +1,246 @@
+// Package i18n translates server text. English format strings are the keys.
+package i18n
+
+import (
+	"fmt"
+	"strings"
+)
+
+// English is the source language: the format strings in the code are the
+// catalog keys, and a locale without an entry falls back to them.
+const Default = "en"
+
+var Locales = []string{"en", "no"}
+
+var catalogs = map[string]map[string]string{
+	"en": {},
+	"no": {
+		// welcome
+		"Welcome to kihle's tempChat.\nChange username with: /u <your_username>\nLeave/clear chat with: /q\nAll commands: /help": "Velkommen til kihle's tempChat.\nBytt brukernavn med: /u <ditt_brukernavn>\nForlat/clear chat med: /q\nAlle kommandoer: /help",
+
+		// rooms
+		"%s joined #%s.":                           "%s ble med i #%s.",
+		"%s left #%s.":                             "%s forlot #%s.",
+		"%s has left the chat.":                    "%s har forlatt chatten.",
+		"You are now in #%s":                       "Du er nå i #%s",
+		"You are already in #%s":                   "Du er allerede i #%s",
+		"Could not join #%s: %s":                   "Kunne ikke bli med i #%s: %s",
+		"Usage: /join <room> [password or invite]": "Bruk: /join <rom> [passord eller invitasjon]",
+		"wrong room password":                      "feil passord for rommet",
+		"room is invite only":                      "rommet krever invitasjon",
+		"#%s invite only: %s":                      "#%s kun med invitasjon: %s",
+		"on":                                       "på",
+		"off":                                      "av",
+		"Room password updated.":                   "Passordet for rommet er oppdatert.",
+		"Invite sent to %s":                        "Invitasjon sendt til %s",
+		"Usage: /msg <user> <text>":                "Bruk: /msg <bruker> <tekst>",
+		"%s is offline and gets your message when they are back.": "%s er frakoblet og får meldingen når de er tilbake.",
+		"No user named %s is online.":                             "Ingen bruker med navnet %s er pålogget.",
+		"%s invited you to #%s. Join with: /join %s %s":           "%s inviterte deg til #%s. Bli med med: /join %s %s",
+
+		// moderation
+		"Only moderators can change slow mode.":                      "Bare moderatorer kan endre treg modus.",
+		"Only moderators can change the topic.":                      "Bare moderatorer kan endre emnet.",
+		"Only moderators can lock a room, and the lobby stays open.": "Bare moderatorer kan låse et rom, og lobbyen forblir åpen.",
+		"Only moderators can invite.":                                "Bare moderatorer kan invitere.",
+		"Only moderators can pin messages.":                          "Bare moderatorer kan feste meldinger.",
+		"Only moderators can change the banner.":                     "Bare moderatorer kan endre banneret.",
+		"Only moderators can edit the room.":                         "Bare moderatorer kan redigere rommet.",
+		"Only admins can make announcements.":                        "Bare administratorer kan sende kunngjøringer.",
+		"Wrong admin token.":                                         "Feil administratornøkkel.",
+		"You are now a moderator in every room.":                     "Du er nå moderator i alle rom.",
+		"Slow mode is off in #%s.":                                   "Treg modus er av i #%s.",
+		"Slow mode is on in #%s: one message every %s.":              "Treg modus er på i #%s: én melding hvert %s.",
+		"Slow mode is on, wait %ds before your next message.":        "Treg modus er på, vent %ds før neste melding.",
+		"Usage: /slowmode <seconds> (0 turns it off)":                "Bruk: /slowmode <sekunder> (0 slår det av)",
+		"%s has entered a binary message. For shame!":                "%s sendte en binærmelding. Skam deg!",
+
+		// messages
+		"Username set to %s":                                        "Brukernavn satt til %s",
+		"the message you are replying to does not exist":            "meldingen du svarer på finnes ikke",
+		"no such message in this room":                              "meldingen finnes ikke i dette rommet",
+		"message is already pinned":                                 "meldingen er allerede festet",
+		"message is not pinned":                                     "meldingen er ikke festet",
+		"a room can have at most 50 pins":                           "et rom kan ha maks 50 festede meldinger",
+		"a reaction is a single emoji or :shortcode:":               "en reaksjon er én emoji eller :kortkode:",
+		"a banner needs some text":                                  "et banner trenger litt tekst",
+		"a banner can be at most 500 characters":                    "et banner kan være maks 500 tegn",
+		"banner level is info, warning or incident":                 "bannernivået er info, warning eller incident",
+		"Subscription removed, you get every message again.":        "Abonnementet er fjernet, du får alle meldinger igjen.",
+		"Subscribed to %d commands and %d patterns.":                "Abonnerer på %d kommandoer og %d mønstre.",
+		"duplicate message":                                         "duplisert melding",
+		"client_id is too long":                                     "client_id er for lang",
+		"there is no message with that ID yet":                      "det finnes ingen melding med den ID-en ennå",
+		"that name is registered, log in to use it":                 "det navnet er registrert, logg inn for å bruke det",
+		"You were kicked by an admin.":                              "Du ble kastet ut av en administrator.",
+		"You can change your name again in %s.":                     "Du kan bytte navn igjen om %s.",
+		"You have used up today's bandwidth.":                       "Du har brukt opp dagens båndbredde.",
+		"Your account has been deleted.":                            "Kontoen din er slettet.",
+		"Could not decode that frame.":                              "Kunne ikke lese den rammen.",
+		"Message too large (%d bytes), the limit is %d.":            "Meldingen er for stor (%d byte), grensen er %d.",
+		"Messages must be valid UTF-8.":                             "Meldinger må være gyldig UTF-8.",
+		"reactions are turned off in this room":                     "reaksjoner er slått av i dette rommet",
+		"unknown feature, use reactions, uploads or link_previews":  "ukjent funksjon, bruk reactions, uploads eller link_previews",
+		"Only moderators can change the room policy.":               "Bare moderatorer kan endre reglene for rommet.",
+		"Usage: /policy <reactions|uploads|link_previews> <on|off>": "Bruk: /policy <reactions|uploads|link_previews> <on|off>",
+		"%s turned %s %s in #%s.":                                   "%s slo %[3]s %[2]s i #%[4]s.",
+		"Policy in #%s: reactions %s, uploads %s, link previews %s": "Regler i #%s: reaksjoner %s, opplastinger %s, lenkeforhåndsvisning %s",
+		"self-destruct time must be between 1s and 1h0m0s":          "selvdestruksjonstiden må være mellom 1s og 1h0m0s",
+		"Usage: %s <message id>":                                    "Bruk: %s <meldings-id>",
+		"Usage: /react <message id> <emoji>":                        "Bruk: /react <meldings-id> <emoji>",
+		"Usage: /reply <message id> <text>":                         "Bruk: /reply <meldings-id> <tekst>",
+		"Usage: /whisper-ttl <duration, e.g. 30s> <text>":           "Bruk: /whisper-ttl <varighet, f.eks. 30s> <tekst>",
+		"Usage: /meta <description|icon|welcome|tags> <value>":      "Bruk: /meta <description|icon|welcome|tags> <verdi>",
+
+		// commands
+		"Unknown command /%s, see /help.":                           "Ukjent kommando /%s, se /help.",
+		"Commands:":                                                 "Kommandoer:",
+		"List the commands you can use":                             "Vis kommandoene du kan bruke",
+		"Change your name":                                          "Bytt navn",
+		"Change the language of server messages":                    "Bytt språk på meldinger fra serveren",
+		"Switch to another room":                                    "Bytt til et annet rom",
+		"Send a private message":                                    "Send en privat melding",
+		"Reply to a message in a thread":                            "Svar på en melding i en tråd",
+		"Send a message that deletes itself":                        "Send en melding som sletter seg selv",
+		"Add or remove a reaction":                                  "Legg til eller fjern en reaksjon",
+		"Show the room topic, moderators can change it":             "Vis emnet for rommet, moderatorer kan endre det",
+		"Show the room banner, moderators can change it":            "Vis banneret for rommet, moderatorer kan endre det",
+		"Show the room policy, moderators can change it":            "Vis reglene for rommet, moderatorer kan endre dem",
+		"Post a message later":                                      "Send en melding senere",
+		"Cancel a scheduled message":                                "Avbryt en planlagt melding",
+		"Only get messages starting with these !commands, for bots": "Få bare meldinger som starter med disse !kommandoene, for botter",
+		"Get every message again":                                   "Få alle meldinger igjen",
+		"Become a moderator in every room":                          "Bli moderator i alle rom",
+		"Leave the chat":                                            "Forlat chatten",
+		"Set the time between messages, 0 turns it off":             "Sett tiden mellom meldinger, 0 slår det av",
+		"Lock the room with a password":                             "Lås rommet med et passord",
+		"Only let invited users in":                                 "Slipp bare inn inviterte brukere",
+		"Invite a user to this room":                                "Inviter en bruker til dette rommet",
+		"Pin a message":                                             "Fest en melding",
+		"Unpin a message":                                           "Løsne en melding",
+		"Edit the room's directory entry":                           "Rediger rommets oppføring i katalogen",
+		"Announce something in every room":                          "Kunngjør noe i alle rom",
+
+		// profiles
+		"Show who someone is and where they are": "Vis hvem noen er og hvor de er",
+		"Usage: /whois <user>":                   "Bruk: /whois <bruker>",
+		"No user named %s.":                      "Ingen bruker med navnet %s.",
+		"%s is a guest.":                         "%s er gjest.",
+		"%s is %s.":                              "%s er %s.",
+		"Bio: %s":                                "Om meg: %s",
+		"Avatar: %s":                             "Profilbilde: %s",
+		"%s has been a member since %s.":         "%s har vært medlem siden %s.",
+		"%s is offline.":                         "%s er frakoblet.",
+		"%s is %s in %s.":                        "%s er %s i %s.",
+		"active":                                 "aktiv",
+		"away":                                   "borte",
+		"online":                                 "pålogget",
+		"idle":                                   "inaktiv",
+		"Mark yourself away":                     "Merk deg som borte",
+		"Mark yourself available again":          "Merk deg som tilgjengelig igjen",
+		"Set the status others see next to your name": "Sett statusen andre ser ved navnet ditt",
+		"You are marked as away.":                     "Du er merket som borte.",
+		"You are no longer marked as away.":           "Du er ikke lenger merket som borte.",
+		"Your status: %s":                             "Statusen din: %s",
+		"Status updated.":                             "Statusen er oppdatert.",
+		"Status: %s":                                  "Status: %s",
+		"a status is a single line":                   "en status er én linje",
+		"a status can be at most 100 characters":      "en status kan være på maks 100 tegn",
+
+		// ignoring
+		"Stop seeing someone's messages, or list who you ignore":     "Slutt å se meldingene til noen, eller vis hvem du ignorerer",
+		"See someone's messages again":                               "Se meldingene til noen igjen",
+		"You are ignoring %s.":                                       "Du ignorerer %s.",
+		"You are not ignoring anyone.":                               "Du ignorerer ingen.",
+		"You no longer see messages from %s. Undo with /unignore %s": "Du ser ikke lenger meldinger fra %s. Angre med /unignore %s",
+		"You see messages from %s again.":                            "Du ser meldinger fra %s igjen.",
+		"Usage: /unignore <user>":                                    "Bruk: /unignore <bruker>",
+		"you can't ignore yourself":                                  "du kan ikke ignorere deg selv",
+		"you can ignore at most 100 users":                           "du kan ignorere maks 100 brukere",
+
+		// scheduling
+		"Usage: /schedule <duration, e.g. 90s or 2h> <text>":             "Bruk: /schedule <varighet, f.eks. 90s eller 2h> <tekst>",
+		"Message %s scheduled for %s in #%s. Cancel with /unschedule %s": "Melding %s planlagt til %s i #%s. Avbryt med /unschedule %s",
+		"No scheduled message %s of yours.":                              "Du har ingen planlagt melding %s.",
+		"Scheduled message %s cancelled.":                                "Planlagt melding %s er avbrutt.",
+		"messages can be scheduled up to 720h0m0s ahead":                 "meldinger kan planlegges inntil 720h0m0s frem i tid",
+		"you already have 10 scheduled messages":                         "du har allerede 10 planlagte meldinger",
+
+		// language
+		"Language set to %s": "Språk satt til %s",
+		"Usage: /lang <%s>":  "Bruk: /lang <%s>",
+
+		// bots
+		"Bot commands:":        "Botkommandoer:",
+		"!%s - answered by %s": "!%s - besvares av %s",
+		"bots can only subscribe to the commands they were granted": "botter kan bare abonnere på kommandoene de har fått",
+		"bots can't subscribe to patterns":                          "botter kan ikke abonnere på mønstre",
+
+		// bridges
+		"%s joined #%s on %s.": "%s ble med i #%s på %s.",
+		"%s left #%s on %s.":   "%s forlot #%s på %s.",
+
+		// encrypted messages
+		"Encrypted messages need a recipient and a payload.": "Krypterte meldinger trenger en mottaker og en nyttelast.",
+		"That payload is too big.":                           "Den nyttelasten er for stor.",
+	},
+}
+
+// ######################################################################
+// function: Tr()
+// ######################################################################
+// Translates format into locale and fills in args like fmt.Sprintf.
+func Tr(locale, format string, args ...any) string {
+	if t, ok := catalogs[locale][format]; ok {
+		format = t
+	}
+	if len(args) == 0 {
+		return format
+	}
+	// args are shared by every recipient of a broadcast, so translate a copy
+	translated := make([]any, len(args))
+	for i, arg := range args {
+		if l, ok := arg.(Localized); ok {
+			arg = Tr(locale, string(l))
+		}
+		translated[i] = arg
+	}
+	return fmt.Sprintf(format, translated...)
+}
+
+// ######################################################################
+// function: Supported()
+// ######################################################################
+// Maps a language tag like "nb-NO" to one of our locales, "" if none fits.
+func Supported(tag string) string {
+	lang := strings.SplitN(strings.ToLower(strings.TrimSpace(tag)), "-", 2)[0]
+	switch lang {
+	case "no", "nb", "nn":
+		return "no"
+	case "en":
+		return "en"
+	}
+	return ""
+}
+
+// ######################################################################
+// function: Negotiate()
+// ######################################################################
+// An explicit ?lang= wins, then the browser's Accept-Language, then English.
+func Negotiate(lang, acceptLanguage string) string {
+	if locale := Supported(lang); locale != "" {
+		return locale
+	}
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		if locale := Supported(strings.SplitN(part, ";", 2)[0]); locale != "" {
+			return locale
+		}
+	}
+	return Default
+}
+
+// ######################################################################
+// type: Localized
+// ######################################################################
+// A message argument that is itself translated for each recipient.
+type Localized string
@@ -0,0 +1,244 @@
+// Package kafka exports chat events (messages, joins, leaves, moderation
+// and bans) to a Kafka topic for analytics and compliance archiving.
+//
+// Every event is one JSON record, keyed by room so a room's events stay in
+// order on one partition:
+//
+//	{"schema":1,"id":"3f9c2a1b-42","type":"message","room":"lobby",
+//	 "user":"kari","text":"hei","message_id":17,"at":"2024-04-05T19:34:38.901Z"}
+//
+// Fields are only ever added to a schema version. Renaming or dropping one
+// bumps Schema. Records of chat lines carry a W3C traceparent header, so a
+// consumer's trace can continue the one of the message.
+package kafka
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"go-chat-app/internal/hub"
+
+	kafkago "github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Schema is the version of Record, consumers should check it
+const Schema = 1
+
+// Events written per batch at most
+const batchSize = 100
+
+var tracer = otel.Tracer("go-chat-app/internal/kafka")
+
+var published, _ = otel.Meter("go-chat-app/internal/kafka").Int64Counter("chat.kafka.events",
+	metric.WithUnit("{event}"), metric.WithDescription("Events written to Kafka, by outcome."))
+
+// ######################################################################
+// struct: Config
+// ######################################################################
+type Config struct {
+	Brokers []string `json:"brokers"` // host:port of one or more brokers
+	Topic   string   `json:"topic"`
+}
+
+// ######################################################################
+// function: Validate()
+// ######################################################################
+func (cfg Config) Validate() error {
+	switch {
+	case len(cfg.Brokers) == 0:
+		return errors.New("kafka: brokers are required")
+	case cfg.Topic == "":
+		return errors.New("kafka: topic is required")
+	}
+	return nil
+}
+
+// ######################################################################
+// struct: Record
+// ######################################################################
+// What goes on the topic. It's its own type, not hub.Event, so changes in
+// the hub don't change the schema by accident.
+type Record struct {
+	Schema    int        `json:"schema"`
+	ID        string     `json:"id"`               // unique per event, for dropping repeats
+	Type      string     `json:"type"`             // message, join, leave, moderation or ban
+	Action    string     `json:"action,omitempty"` // kick, mute, delete... for moderation
+	Room      string     `json:"room,omitempty"`
+	User      string     `json:"user,omitempty"`
+	Text      string     `json:"text,omitempty"`
+	MessageID int64      `json:"message_id,omitempty"`
+	IP        string     `json:"ip,omitempty"`
+	Until     *time.Time `json:"until,omitempty"` // end of a ban or mute
+	At        time.Time  `json:"at"`
+}
+
+// ######################################################################
+// interface: Hub
+// ######################################################################
+// The part of the chat hub the exporter uses.
+type Hub interface {
+	Events() (<-chan hub.Event, func())
+}
+
+// ######################################################################
+// struct: Exporter
+// ######################################################################
+type Exporter struct {
+	hub    Hub
+	topic  string
+	writer *kafkago.Writer
+	prefix string // ID prefix, unique per run
+	seq    atomic.Int64
+}
+
+// ######################################################################
+// function: New()
+// ######################################################################
+func New(cfg Config, hub Hub) *Exporter {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return &Exporter{
+		hub:   hub,
+		topic: cfg.Topic,
+		writer: &kafkago.Writer{
+			Addr:         kafkago.TCP(cfg.Brokers...),
+			Topic:        cfg.Topic,
+			Balancer:     &kafkago.Hash{},
+			RequiredAcks: kafkago.RequireAll,
+			BatchSize:    batchSize,
+			BatchTimeout: 100 * time.Millisecond,
+		},
+		prefix: hex.EncodeToString(b),
+	}
+}
+
+// ######################################################################
+// function: Run()
+// ######################################################################
+// Publishes events until ctx is done, then flushes what's left. Each batch
+// is a span linked to the spans the events happened in.
+func (e *Exporter) Run(ctx context.Context) {
+	events, stop := e.hub.Events()
+	defer stop()
+	defer func() {
+		if err := e.writer.Close(); err != nil {
+			log.Printf("Error closing Kafka writer: %v", err)
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			// Whatever is already queued, with a little time to get it out
+			flush, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			e.write(flush, drain(events, nil))
+			cancel()
+			return
+		case ev := <-events:
+			e.write(ctx, drain(events, []hub.Event{ev}))
+		}
+	}
+}
+
+// Adds whatever else is waiting, up to a batch
+func drain(events <-chan hub.Event, batch []hub.Event) []hub.Event {
+	for len(batch) < batchSize {
+		select {
+		case ev := <-events:
+			batch = append(batch, ev)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+// The writer retries on its own, what still fails is lost
+func (e *Exporter) write(ctx context.Context, batch []hub.Event) {
+	if len(batch) == 0 {
+		return
+	}
+	var links []trace.Link
+	for _, ev := range batch {
+		if ev.Trace.IsValid() {
+			links = append(links, trace.Link{SpanContext: ev.Trace})
+		}
+	}
+	ctx, span := tracer.Start(ctx, "kafka.publish", trace.WithSpanKind(trace.SpanKindProducer), trace.WithLinks(links...),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "kafka"),
+			attribute.String("messaging.destination.name", e.topic),
+			attribute.Int("messaging.batch.message_count", len(batch)),
+		))
+	defer span.End()
+
+	msgs := make([]kafkago.Message, len(batch))
+	for i, ev := range batch {
+		msgs[i] = e.message(ev)
+	}
+	outcome := "ok"
+	if err := e.writer.WriteMessages(ctx, msgs...); err != nil {
+		outcome = "failed"
+		span.SetStatus(codes.Error, err.Error())
+		log.Printf("Error exporting %d events to Kafka: %v", len(batch), err)
+	}
+	published.Add(ctx, int64(len(batch)), metric.WithAttributes(attribute.String("outcome", outcome)))
+}
+
+// ######################################################################
+// function: message()
+// ######################################################################
+func (e *Exporter) message(ev hub.Event) kafkago.Message {
+	rec := newRecord(ev)
+	rec.ID = e.prefix + "-" + strconv.FormatInt(e.seq.Add(1), 10)
+	value, _ := json.Marshal(rec) // nothing in it that can fail
+	key := rec.Room
+	if key == "" {
+		key = rec.User
+	}
+	m := kafkago.Message{Key: []byte(key), Value: value, Time: rec.At}
+	if ev.Trace.IsValid() {
+		carrier := propagation.MapCarrier{}
+		otel.GetTextMapPropagator().Inject(trace.ContextWithSpanContext(context.Background(), ev.Trace), carrier)
+		for k, v := range carrier {
+			m.Headers = append(m.Headers, kafkago.Header{Key: k, Value: []byte(v)})
+		}
+	}
+	return m
+}
+
+// ######################################################################
+// function: newRecord()
+// ######################################################################
+// ev in the topic's schema, without an ID.
+func newRecord(ev hub.Event) Record {
+	rec := Record{
+		Schema:    Schema,
+		Type:      ev.Type,
+		Action:    ev.Action,
+		Room:      ev.Room,
+		User:      ev.User,
+		Text:      ev.Text,
+		MessageID: ev.ID,
+		IP:        ev.IP,
+		At:        ev.At.UTC(),
+	}
+	if !ev.Until.IsZero() {
+		until := ev.Until.UTC()
+		rec.Until = &until
+	}
+	return rec
+}
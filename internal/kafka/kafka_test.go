@@ -0,0 +1,39 @@
+package kafka
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"go-chat-app/internal/hub"
+)
+
+// Downstream consumers depend on these names, changing them is a new Schema
+func TestRecordSchema(t *testing.T) {
+	e := New(Config{Brokers: []string{"localhost:9092"}, Topic: "chat"}, nil)
+	at := time.UnixMilli(1712345678901)
+	m := e.message(hub.Event{Type: hub.EventMessage, Room: "lobby", User: "kari", Text: "hei", ID: 17, At: at})
+	if string(m.Key) != "lobby" {
+		t.Errorf("key %q, want the room", m.Key)
+	}
+	var got map[string]any
+	if err := json.Unmarshal(m.Value, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{"schema": 1.0, "id": e.prefix + "-1", "type": "message", "room": "lobby",
+		"user": "kari", "text": "hei", "message_id": 17.0, "at": "2024-04-05T19:34:38.901Z"}
+	if len(got) != len(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %v, want %v", k, got[k], v)
+		}
+	}
+
+	m = e.message(hub.Event{Type: hub.EventBan, User: "ola", IP: "10.0.0.1", Until: at, At: at})
+	json.Unmarshal(m.Value, &got)
+	if string(m.Key) != "ola" || got["until"] != "2024-04-05T19:34:38.901Z" || got["id"] != e.prefix+"-2" {
+		t.Errorf("ban went out as %s %s", m.Key, m.Value)
+	}
+}
@@ -0,0 +1,102 @@
+// Package markdown renders the bit of Markdown chat lines can use, **bold**,
+// *italics*, `code`, ```code blocks``` and links, as HTML that is safe to
+// put in a page as it is.
+//
+// None of the text ends up in the HTML unescaped: the text is escaped and
+// only tags made here go around it. Links only go to http, https and
+// mailto URLs, so a javascript: link stays text.
+package markdown
+
+import (
+	"html"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	codeRE = regexp.MustCompile("(?s)```(?:[a-z0-9]*\n)?(.*?)```|`([^`\n]+)`")
+	linkRE = regexp.MustCompile(`\[([^\]\n]+)\]\(([^)\s]+)\)`)
+	urlRE  = regexp.MustCompile(`https?://[^\s<>"]+`)
+
+	// on escaped text, a bit stricter than CommonMark: no spaces just inside
+	// the markers, and _ only around whole words so snake_case stays
+	strongRE      = regexp.MustCompile(`\*\*([^\s*](?:[^\n]*?[^\s*])?)\*\*`)
+	strongUnderRE = regexp.MustCompile(`(^|\W)__([^\s_](?:[^\n]*?[^\s_])?)__(\W|$)`)
+	emRE          = regexp.MustCompile(`\*([^\s*](?:[^\n*]*?[^\s*])?)\*`)
+	emUnderRE     = regexp.MustCompile(`(^|\W)_([^\s_](?:[^\n_]*?[^\s_])?)_(\W|$)`)
+)
+
+// Link attributes: a new tab, no referrer and nothing for search engines
+const linkAttrs = ` rel="nofollow noopener noreferrer" target="_blank"`
+
+// ######################################################################
+// function: Render()
+// ######################################################################
+// The HTML for text. Plain text comes out escaped, with <br> for line
+// breaks.
+func Render(text string) string {
+	// code, links and URLs are cut out for placeholders first, so the
+	// emphasis markers in them stay as they are
+	var pieces []string
+	hold := func(piece string) string {
+		pieces = append(pieces, piece)
+		return "\x00" + strconv.Itoa(len(pieces)-1) + "\x00"
+	}
+	s := strings.ReplaceAll(text, "\x00", "")
+	s = codeRE.ReplaceAllStringFunc(s, func(m string) string {
+		sub := codeRE.FindStringSubmatch(m)
+		if strings.HasPrefix(m, "```") {
+			return hold("<pre><code>" + html.EscapeString(sub[1]) + "</code></pre>")
+		}
+		return hold("<code>" + html.EscapeString(sub[2]) + "</code>")
+	})
+	s = linkRE.ReplaceAllStringFunc(s, func(m string) string {
+		sub := linkRE.FindStringSubmatch(m)
+		if !safeURL(sub[2]) {
+			return m
+		}
+		return hold(`<a href="` + html.EscapeString(sub[2]) + `"` + linkAttrs + ">" + emphasis(html.EscapeString(sub[1])) + "</a>")
+	})
+	s = urlRE.ReplaceAllStringFunc(s, func(m string) string {
+		link := strings.TrimRight(m, ".,;:!?)'")
+		if !safeURL(link) {
+			return m
+		}
+		escaped := html.EscapeString(link)
+		return hold(`<a href="` + escaped + `"` + linkAttrs + ">" + escaped + "</a>" + html.EscapeString(m[len(link):]))
+	})
+
+	s = emphasis(html.EscapeString(s))
+	s = strings.ReplaceAll(s, "\n", "<br>")
+	// last first: a link's text can hold code
+	for i := len(pieces) - 1; i >= 0; i-- {
+		s = strings.Replace(s, "\x00"+strconv.Itoa(i)+"\x00", pieces[i], 1)
+	}
+	return s
+}
+
+// Bold and italics in escaped text
+func emphasis(s string) string {
+	s = strongRE.ReplaceAllString(s, "<strong>$1</strong>")
+	s = strongUnderRE.ReplaceAllString(s, "$1<strong>$2</strong>$3")
+	s = emRE.ReplaceAllString(s, "<em>$1</em>")
+	s = emUnderRE.ReplaceAllString(s, "$1<em>$2</em>$3")
+	return s
+}
+
+// Only absolute links to web pages and mail addresses
+func safeURL(link string) bool {
+	u, err := url.Parse(link)
+	if err != nil {
+		return false
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https":
+		return u.Host != ""
+	case "mailto":
+		return u.Opaque != ""
+	}
+	return false
+}
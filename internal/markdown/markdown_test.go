@@ -0,0 +1,28 @@
+package markdown
+
+import "testing"
+
+func TestRender(t *testing.T) {
+	const attrs = ` rel="nofollow noopener noreferrer" target="_blank"`
+	tests := []struct{ in, want string }{
+		{"plain & simple", "plain &amp; simple"},
+		{"**bold** and *italic* and _also_", "<strong>bold</strong> and <em>italic</em> and <em>also</em>"},
+		{"__strong__ stays snake_case_name", "<strong>strong</strong> stays snake_case_name"},
+		{"2 * 3 * 4 and ** loose **", "2 * 3 * 4 and ** loose **"},
+		{"run `rm -rf *tmp*` <b>now</b>", "run <code>rm -rf *tmp*</code> &lt;b&gt;now&lt;/b&gt;"},
+		{"```go\nif a < b {\n}\n```", "<pre><code>if a &lt; b {\n}\n</code></pre>"},
+		{"line one\nline two", "line one<br>line two"},
+		{"[the *docs*](https://example.com/a?b=1&c=2)", `<a href="https://example.com/a?b=1&amp;c=2"` + attrs + `>the <em>docs</em></a>`},
+		{"see https://example.com/x_y_z.", `see <a href="https://example.com/x_y_z"` + attrs + `>https://example.com/x_y_z</a>.`},
+		{"[click](javascript:alert(1))", "[click](javascript:alert(1))"},
+		{`[x](https://e.com/"onmouseover="alert(1))`, `<a href="https://e.com/&#34;onmouseover=&#34;alert(1"` + attrs + `>x</a>)`},
+		{"<script>alert('hi')</script>", "&lt;script&gt;alert(&#39;hi&#39;)&lt;/script&gt;"},
+		{"[`code` link](mailto:kari@example.com)", `<a href="mailto:kari@example.com"` + attrs + `><code>code</code> link</a>`},
+		{"nul\x00\x000\x00", "nul0"},
+	}
+	for _, tt := range tests {
+		if got := Render(tt.in); got != tt.want {
+			t.Errorf("Render(%q)\n got %q\nwant %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,470 @@
+// Package matrix bridges chat rooms to Matrix rooms as an application
+// service. Every chat user in a bridged room gets a puppet on the Matrix
+// side, @<prefix><name>:<domain>, that joins, talks and leaves for them,
+// and Matrix users show up in chat as "name (matrix)".
+//
+// The homeserver needs a registration file that points at the chat server
+// and claims the puppets, with the same tokens as the Config:
+//
+//	id: chat
+//	url: https://chat.example.org
+//	as_token: <as_token>
+//	hs_token: <hs_token>
+//	sender_localpart: chatbridge
+//	namespaces:
+//	  users:
+//	    - exclusive: true
+//	      regex: "@chat_.*:example.org"
+//
+// The sender has to be invited to the Matrix rooms, after that it invites
+// the puppets itself.
+package matrix
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go-chat-app/internal/protocol"
+)
+
+// How chat users are told apart from Matrix users in chat
+const Suffix = " (matrix)"
+
+// Transaction IDs remembered, the homeserver retries until it gets a 200
+const maxTransactions = 1000
+
+// ######################################################################
+// struct: Config
+// ######################################################################
+type Config struct {
+	Homeserver      string            `json:"homeserver"`       // client API base URL, https://matrix.example.org
+	Domain          string            `json:"domain"`           // server name in user IDs, example.org
+	ASToken         string            `json:"as_token"`         // we send this to the homeserver
+	HSToken         string            `json:"hs_token"`         // the homeserver sends us this
+	SenderLocalpart string            `json:"sender_localpart"` // the bridge's own user
+	UserPrefix      string            `json:"user_prefix"`      // localpart prefix of the puppets, "" = chat_
+	Rooms           map[string]string `json:"rooms"`            // chat room -> Matrix room ID
+}
+
+// ######################################################################
+// function: Validate()
+// ######################################################################
+func (cfg Config) Validate() error {
+	switch {
+	case cfg.Homeserver == "" || cfg.Domain == "":
+		return errors.New("matrix: homeserver and domain are required")
+	case cfg.ASToken == "" || cfg.HSToken == "":
+		return errors.New("matrix: as_token and hs_token are required")
+	case cfg.SenderLocalpart == "":
+		return errors.New("matrix: sender_localpart is required")
+	}
+	seen := make(map[string]string)
+	for room, id := range cfg.Rooms {
+		if other, ok := seen[id]; ok {
+			return fmt.Errorf("matrix: %s is bridged to both #%s and #%s", id, other, room)
+		}
+		seen[id] = room
+	}
+	return nil
+}
+
+// ######################################################################
+// interface: Hub
+// ######################################################################
+// The parts of the chat hub the bridge uses.
+type Hub interface {
+	Follow(room string) (<-chan protocol.Frame, func())
+	Members(room string) []string
+	Relay(room, from, text string) error
+	RelayPresence(room, who, network string, joined bool)
+}
+
+// ######################################################################
+// struct: Bridge
+// ######################################################################
+// Serve it under /_matrix/app/ for the homeserver and Run it for the other
+// direction.
+type Bridge struct {
+	cfg     Config
+	hub     Hub
+	client  *http.Client
+	byID    map[string]string // Matrix room ID -> chat room
+	txnBase int64
+	txnSeq  atomic.Int64
+
+	mu         sync.Mutex
+	registered map[string]bool // puppets with an account and display name
+	txns       map[string]bool
+	txnOrder   []string
+}
+
+// ######################################################################
+// function: New()
+// ######################################################################
+func New(cfg Config, hub Hub) *Bridge {
+	if cfg.UserPrefix == "" {
+		cfg.UserPrefix = "chat_"
+	}
+	cfg.Homeserver = strings.TrimRight(cfg.Homeserver, "/")
+	b := &Bridge{
+		cfg:        cfg,
+		hub:        hub,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		byID:       make(map[string]string),
+		txnBase:    time.Now().UnixNano(),
+		registered: make(map[string]bool),
+		txns:       make(map[string]bool),
+	}
+	for room, id := range cfg.Rooms {
+		b.byID[id] = room
+	}
+	return b
+}
+
+// ######################################################################
+// function: Run()
+// ######################################################################
+// Mirrors the chat side of every bridged room into Matrix until ctx is
+// done.
+func (b *Bridge) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for room, id := range b.cfg.Rooms {
+		wg.Add(1)
+		go func(room, id string) {
+			defer wg.Done()
+			b.mirror(ctx, room, id)
+		}(room, id)
+	}
+	wg.Wait()
+}
+
+// One chat room into its Matrix room
+func (b *Bridge) mirror(ctx context.Context, room, id string) {
+	frames, stop := b.hub.Follow(room)
+	defer stop()
+
+	if err := b.call(ctx, "POST", "/join/"+url.PathEscape(id), "", struct{}{}); err != nil {
+		log.Printf("Error joining Matrix room %s: %v", id, err)
+	}
+	for _, name := range b.hub.Members(room) {
+		b.join(ctx, id, name)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case f := <-frames:
+			switch f.Type {
+			case protocol.FrameMessage:
+				if f.From == "" || strings.HasSuffix(f.From, Suffix) {
+					continue // ours, or nobody to puppet
+				}
+				b.send(ctx, id, f.From, f.Text)
+
+			case protocol.FrameRename:
+				b.leave(ctx, id, f.From)
+				b.join(ctx, id, f.Text)
+
+			case protocol.FrameSystem:
+				if len(f.Args) == 0 {
+					continue
+				}
+				name, _ := f.Args[0].(string)
+				switch f.Format {
+				case "%s joined #%s.":
+					b.join(ctx, id, name)
+				case "%s left #%s.", "%s has left the chat.":
+					b.leave(ctx, id, name)
+				}
+			}
+		}
+	}
+}
+
+// ######################################################################
+// function: puppet()
+// ######################################################################
+// The Matrix user ID standing in for a chat user. Anything a localpart
+// can't hold is written as =xx, like the spec's own mapping.
+func (b *Bridge) puppet(name string) string {
+	var local strings.Builder
+	local.WriteString(b.cfg.UserPrefix)
+	for _, c := range []byte(name) {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '.', c == '-', c == '/':
+			local.WriteByte(c)
+		case c == '_':
+			local.WriteString("__")
+		case c >= 'A' && c <= 'Z':
+			local.WriteByte('_')
+			local.WriteByte(c + 'a' - 'A')
+		default:
+			fmt.Fprintf(&local, "=%02x", c)
+		}
+	}
+	return "@" + local.String() + ":" + b.cfg.Domain
+}
+
+// Makes sure the puppet exists and is called name
+func (b *Bridge) register(ctx context.Context, name string) string {
+	user := b.puppet(name)
+	b.mu.Lock()
+	done := b.registered[user]
+	b.mu.Unlock()
+	if done {
+		return user
+	}
+	local := strings.TrimPrefix(strings.TrimSuffix(user, ":"+b.cfg.Domain), "@")
+	err := b.call(ctx, "POST", "/register", "", map[string]string{"type": "m.login.application_service", "username": local})
+	if err != nil && !isErrcode(err, "M_USER_IN_USE") {
+		log.Printf("Error registering Matrix puppet %s: %v", user, err)
+		return user
+	}
+	if err := b.call(ctx, "PUT", "/profile/"+url.PathEscape(user)+"/displayname", user, map[string]string{"displayname": name}); err != nil {
+		log.Printf("Error naming Matrix puppet %s: %v", user, err)
+	}
+	b.mu.Lock()
+	b.registered[user] = true
+	b.mu.Unlock()
+	return user
+}
+
+func (b *Bridge) join(ctx context.Context, id, name string) {
+	if name == "" {
+		return
+	}
+	user := b.register(ctx, name)
+	err := b.call(ctx, "POST", "/join/"+url.PathEscape(id), user, struct{}{})
+	if isErrcode(err, "M_FORBIDDEN") {
+		// not invited yet, the bridge's own user can do that
+		if err = b.call(ctx, "POST", "/rooms/"+url.PathEscape(id)+"/invite", "", map[string]string{"user_id": user}); err == nil {
+			err = b.call(ctx, "POST", "/join/"+url.PathEscape(id), user, struct{}{})
+		}
+	}
+	if err != nil {
+		log.Printf("Error joining %s to Matrix room %s: %v", user, id, err)
+	}
+}
+
+func (b *Bridge) leave(ctx context.Context, id, name string) {
+	if name == "" {
+		return
+	}
+	if err := b.call(ctx, "POST", "/rooms/"+url.PathEscape(id)+"/leave", b.puppet(name), struct{}{}); err != nil {
+		log.Printf("Error leaving Matrix room %s: %v", id, err)
+	}
+}
+
+func (b *Bridge) send(ctx context.Context, id, name, text string) {
+	user := b.register(ctx, name)
+	txn := fmt.Sprintf("%d.%d", b.txnBase, b.txnSeq.Add(1))
+	path := "/rooms/" + url.PathEscape(id) + "/send/m.room.message/" + txn
+	err := b.call(ctx, "PUT", path, user, map[string]string{"msgtype": "m.text", "body": text})
+	if isErrcode(err, "M_FORBIDDEN") {
+		// the puppet isn't in the room, after a restart of the homeserver say
+		b.join(ctx, id, name)
+		err = b.call(ctx, "PUT", path, user, map[string]string{"msgtype": "m.text", "body": text})
+	}
+	if err != nil {
+		log.Printf("Error sending to Matrix room %s: %v", id, err)
+	}
+}
+
+// ######################################################################
+// struct: matrixError
+// ######################################################################
+// What the client API answers on failure.
+type matrixError struct {
+	Status  int    `json:"-"`
+	Errcode string `json:"errcode"`
+	Message string `json:"error"`
+}
+
+func (e *matrixError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Status, e.Errcode, e.Message)
+}
+
+func isErrcode(err error, code string) bool {
+	var me *matrixError
+	return errors.As(err, &me) && me.Errcode == code
+}
+
+// ######################################################################
+// function: call()
+// ######################################################################
+// A client API request with the appservice token, as user ("" = the
+// bridge's own user).
+func (b *Bridge) call(ctx context.Context, method, path, user string, body any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	target := b.cfg.Homeserver + "/_matrix/client/v3" + path
+	if user != "" {
+		target += "?user_id=" + url.QueryEscape(user)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+b.cfg.ASToken)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	me := &matrixError{Status: resp.StatusCode}
+	json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(me)
+	return me
+}
+
+// ######################################################################
+// struct: event
+// ######################################################################
+// The bits of a room event the bridge looks at.
+type event struct {
+	Type     string `json:"type"`
+	RoomID   string `json:"room_id"`
+	Sender   string `json:"sender"`
+	StateKey string `json:"state_key"`
+	Content  struct {
+		MsgType     string `json:"msgtype"`
+		Body        string `json:"body"`
+		Membership  string `json:"membership"`
+		DisplayName string `json:"displayname"`
+	} `json:"content"`
+	Unsigned struct {
+		PrevContent struct {
+			Membership string `json:"membership"`
+		} `json:"prev_content"`
+	} `json:"unsigned"`
+}
+
+// ######################################################################
+// function: ServeHTTP()
+// ######################################################################
+// The appservice API the homeserver pushes events to.
+func (b *Bridge) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("access_token")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if token != b.cfg.HSToken {
+		writeError(w, http.StatusForbidden, "M_FORBIDDEN", "bad hs_token")
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/_matrix/app/v1")
+	switch {
+	case strings.HasPrefix(path, "/transactions/") && r.Method == http.MethodPut:
+		b.handleTransaction(w, r, strings.TrimPrefix(path, "/transactions/"))
+	case path == "/ping" && r.Method == http.MethodPost:
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}"))
+	default:
+		// we don't make users or rooms on demand
+		writeError(w, http.StatusNotFound, "M_NOT_FOUND", "not found")
+	}
+}
+
+func (b *Bridge) handleTransaction(w http.ResponseWriter, r *http.Request, txn string) {
+	var body struct {
+		Events []event `json:"events"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "M_NOT_JSON", "bad transaction")
+		return
+	}
+	if b.seen(txn) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}"))
+		return
+	}
+	for _, ev := range body.Events {
+		b.handleEvent(ev)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte("{}"))
+}
+
+// True if the transaction was handled before, otherwise remembers it
+func (b *Bridge) seen(txn string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.txns[txn] {
+		return true
+	}
+	b.txns[txn] = true
+	b.txnOrder = append(b.txnOrder, txn)
+	if len(b.txnOrder) > maxTransactions {
+		delete(b.txns, b.txnOrder[0])
+		b.txnOrder = b.txnOrder[1:]
+	}
+	return false
+}
+
+func (b *Bridge) handleEvent(ev event) {
+	room, ok := b.byID[ev.RoomID]
+	if !ok {
+		return
+	}
+	switch ev.Type {
+	case "m.room.message":
+		if b.ours(ev.Sender) {
+			return
+		}
+		text := ev.Content.Body
+		if ev.Content.MsgType == "m.emote" {
+			text = "* " + localpart(ev.Sender) + " " + text
+		} else if ev.Content.MsgType != "m.text" && ev.Content.MsgType != "m.notice" {
+			return // images and files stay on Matrix
+		}
+		if err := b.hub.Relay(room, localpart(ev.Sender)+Suffix, text); err != nil {
+			log.Printf("Error relaying from Matrix room %s: %v", ev.RoomID, err)
+		}
+
+	case "m.room.member":
+		if b.ours(ev.StateKey) {
+			return
+		}
+		was, is := ev.Unsigned.PrevContent.Membership == "join", ev.Content.Membership == "join"
+		if was != is {
+			b.hub.RelayPresence(room, localpart(ev.StateKey), "Matrix", is)
+		}
+	}
+}
+
+// True for the bridge's own user and its puppets
+func (b *Bridge) ours(user string) bool {
+	return user == "@"+b.cfg.SenderLocalpart+":"+b.cfg.Domain ||
+		strings.HasPrefix(user, "@"+b.cfg.UserPrefix) && strings.HasSuffix(user, ":"+b.cfg.Domain)
+}
+
+// @bob:example.org -> bob
+func localpart(user string) string {
+	local, _, _ := strings.Cut(strings.TrimPrefix(user, "@"), ":")
+	return local
+}
+
+func writeError(w http.ResponseWriter, status int, code, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(matrixError{Errcode: code, Message: msg})
+}
@@ -0,0 +1,414 @@
+// Package preview fetches the OpenGraph metadata of links posted in chat,
+// for clients to show as link cards.
+//
+// The server fetches the pages, not the clients, so a link can't be used to
+// find out who reads a room. That makes the server the one fetching
+// whatever URL somebody types, so fetches only ever go to public addresses
+// on the default ports: the address is checked when the connection is
+// made, after DNS, so a name that resolves to 127.0.0.1 or the cloud
+// metadata service gets nowhere, redirects included.
+package preview
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"go-chat-app/internal/protocol"
+
+	"golang.org/x/net/html"
+)
+
+const (
+	fetchTimeout = 5 * time.Second
+	maxRedirects = 3
+	maxBody      = 512 << 10 // the <head> is all we read, it's near the top
+	maxTitle     = 200       // runes
+	maxDesc      = 300
+
+	cacheSize = 1024
+	cacheTTL  = time.Hour
+	missTTL   = 10 * time.Minute // pages without a preview, or that failed
+)
+
+var (
+	errScheme    = errors.New("only http and https links get previews")
+	errPort      = errors.New("only links on the default port get previews")
+	errBlocked   = errors.New("domain is blocklisted")
+	errAddress   = errors.New("address is not public")
+	errNotHTML   = errors.New("not an HTML page")
+	errRedirects = errors.New("too many redirects")
+)
+
+// ######################################################################
+// struct: Config
+// ######################################################################
+type Config struct {
+	Blocklist []string `json:"blocklist"` // domains never fetched, their subdomains neither
+
+	// Fetch from private and loopback addresses and any port too, for
+	// intranets where every link is internal anyway. Never on a server open
+	// to the internet.
+	AllowPrivate bool `json:"allow_private"`
+}
+
+// ######################################################################
+// struct: Fetcher
+// ######################################################################
+type Fetcher struct {
+	blocklist    Domains
+	allowPrivate bool
+	client       *http.Client
+
+	mu    sync.Mutex
+	cache map[string]entry
+}
+
+type entry struct {
+	preview *protocol.LinkPreview // nil = none
+	expires time.Time
+}
+
+// ######################################################################
+// function: New()
+// ######################################################################
+func New(cfg Config) *Fetcher {
+	f := &Fetcher{blocklist: ParseDomains(cfg.Blocklist), allowPrivate: cfg.AllowPrivate, cache: make(map[string]entry)}
+	dialer := &net.Dialer{Timeout: fetchTimeout, Control: f.checkDial}
+	f.client = &http.Client{
+		Timeout: fetchTimeout,
+		Transport: &http.Transport{
+			Proxy:                 nil, // a proxy would dial for us, past checkDial
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   fetchTimeout,
+			ResponseHeaderTimeout: fetchTimeout,
+			MaxIdleConns:          10,
+			IdleConnTimeout:       30 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > maxRedirects {
+				return errRedirects
+			}
+			return f.checkURL(req.URL)
+		},
+	}
+	return f
+}
+
+// ######################################################################
+// function: FindURL()
+// ######################################################################
+// The first http or https link in text, "" if there is none.
+func FindURL(text string) string {
+	for _, link := range FindURLs(text) {
+		if !strings.HasPrefix(strings.ToLower(link), "www.") {
+			return link
+		}
+	}
+	return ""
+}
+
+// ######################################################################
+// function: FindURLs()
+// ######################################################################
+// The links in text: http and https URLs, and www. names without a
+// scheme. Punctuation right after one is taken to be the sentence's, and
+// so is a closing parenthesis unless the link opened it.
+func FindURLs(text string) []string {
+	links := linkPattern.FindAllString(text, -1)
+	for i, link := range links {
+		for link != "" {
+			last := link[len(link)-1]
+			if !strings.ContainsRune(".,;:!?'\"]}", rune(last)) &&
+				(last != ')' || strings.Count(link, "(") >= strings.Count(link, ")")) {
+				break
+			}
+			link = link[:len(link)-1]
+		}
+		links[i] = link
+	}
+	return links
+}
+
+var linkPattern = regexp.MustCompile(`(?i)\b(?:https?://|www\.)[^\s<>"]+`)
+
+// ######################################################################
+// function: Host()
+// ######################################################################
+// The host a link found by FindURLs points to, lowercased.
+func Host(link string) string {
+	if strings.HasPrefix(strings.ToLower(link), "www.") {
+		link = "http://" + link
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// ######################################################################
+// type: Domains
+// ######################################################################
+// A block- or allowlist of domains. A domain covers its subdomains too.
+type Domains []string
+
+// ######################################################################
+// function: ParseDomains()
+// ######################################################################
+// Lowercases the domains and drops blanks and dots around them.
+func ParseDomains(list []string) Domains {
+	var d Domains
+	for _, domain := range list {
+		if domain = strings.Trim(strings.ToLower(strings.TrimSpace(domain)), "."); domain != "" {
+			d = append(d, domain)
+		}
+	}
+	return d
+}
+
+// ######################################################################
+// function: Match()
+// ######################################################################
+// Whether host is one of the domains, or under one of them.
+func (d Domains) Match(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, domain := range d {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// ######################################################################
+// function: Cached()
+// ######################################################################
+// The preview of link if it was fetched lately, ok is false if it has to
+// be fetched. A nil preview with ok set means the page has none.
+func (f *Fetcher) Cached(link string) (p *protocol.LinkPreview, ok bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	e, ok := f.cache[link]
+	if !ok || time.Now().After(e.expires) {
+		return nil, false
+	}
+	return e.preview, true
+}
+
+// ######################################################################
+// function: Fetch()
+// ######################################################################
+// Fetches the page and caches what it found. nil if it has no title or
+// description, or couldn't be fetched.
+func (f *Fetcher) Fetch(ctx context.Context, link string) (*protocol.LinkPreview, error) {
+	p, err := f.fetch(ctx, link)
+	ttl := cacheTTL
+	if p == nil {
+		ttl = missTTL
+	}
+	f.mu.Lock()
+	f.storeLocked(link, entry{preview: p, expires: time.Now().Add(ttl)})
+	f.mu.Unlock()
+	return p, err
+}
+
+// Expired entries go first, then whatever
+func (f *Fetcher) storeLocked(link string, e entry) {
+	if len(f.cache) >= cacheSize {
+		now := time.Now()
+		for k, old := range f.cache {
+			if now.After(old.expires) {
+				delete(f.cache, k)
+			}
+		}
+		for k := range f.cache {
+			if len(f.cache) < cacheSize {
+				break
+			}
+			delete(f.cache, k)
+		}
+	}
+	f.cache[link] = e
+}
+
+func (f *Fetcher) fetch(ctx context.Context, link string) (*protocol.LinkPreview, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.checkURL(u); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "go-chat-app link preview")
+	req.Header.Set("Accept", "text/html")
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %s", resp.Status)
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return nil, errNotHTML
+	}
+	p := parse(io.LimitReader(resp.Body, maxBody), resp.Request.URL)
+	if p == nil {
+		return nil, nil
+	}
+	p.URL = link
+	return p, nil
+}
+
+// ######################################################################
+// function: checkURL()
+// ######################################################################
+// What can be told before dialing, the address is checkDial's.
+func (f *Fetcher) checkURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errScheme
+	}
+	if port := u.Port(); !f.allowPrivate && port != "" && port != "80" && port != "443" {
+		return errPort
+	}
+	if f.blocklist.Match(u.Hostname()) {
+		return errBlocked
+	}
+	return nil
+}
+
+// ######################################################################
+// function: checkDial()
+// ######################################################################
+// Runs for every connection, with the address DNS gave us.
+func (f *Fetcher) checkDial(network, address string, _ syscall.RawConn) error {
+	if f.allowPrivate {
+		return nil
+	}
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !public(addrPort.Addr()) {
+		return fmt.Errorf("%s: %w", address, errAddress)
+	}
+	return nil
+}
+
+// Shared address space for carrier NAT, not covered by IsPrivate
+var carrierNAT = netip.MustParsePrefix("100.64.0.0/10")
+
+func public(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !carrierNAT.Contains(ip) &&
+		!(ip.Is4() && ip.As4()[0] == 0)
+}
+
+// ######################################################################
+// function: parse()
+// ######################################################################
+// og: tags from the <head>, falling back on <title> and the description
+// meta tag.
+func parse(r io.Reader, base *url.URL) *protocol.LinkPreview {
+	var p protocol.LinkPreview
+	var title, desc string
+	z := html.NewTokenizer(r)
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return finish(&p, title, desc, base)
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			switch string(name) {
+			case "body":
+				return finish(&p, title, desc, base)
+			case "title":
+				if z.Next() == html.TextToken && title == "" {
+					title = string(z.Text())
+				}
+			case "meta":
+				if !hasAttr {
+					continue
+				}
+				var key, content string
+				for more := true; more; {
+					var k, v []byte
+					k, v, more = z.TagAttr()
+					switch string(k) {
+					case "property", "name":
+						key = strings.ToLower(string(v))
+					case "content":
+						content = string(v)
+					}
+				}
+				switch key {
+				case "og:title":
+					p.Title = content
+				case "og:description":
+					p.Description = content
+				case "og:image":
+					p.Image = content
+				case "og:site_name":
+					p.SiteName = content
+				case "description":
+					desc = content
+				}
+			}
+		case html.EndTagToken:
+			if name, _ := z.TagName(); string(name) == "head" {
+				return finish(&p, title, desc, base)
+			}
+		}
+	}
+}
+
+func finish(p *protocol.LinkPreview, title, desc string, base *url.URL) *protocol.LinkPreview {
+	if p.Title == "" {
+		p.Title = title
+	}
+	if p.Description == "" {
+		p.Description = desc
+	}
+	p.Title = clean(p.Title, maxTitle)
+	p.Description = clean(p.Description, maxDesc)
+	p.SiteName = clean(p.SiteName, maxTitle)
+	if p.Title == "" && p.Description == "" {
+		return nil
+	}
+	if p.Image != "" {
+		// relative images are relative to the page, and only web ones are any use
+		img, err := base.Parse(p.Image)
+		if err != nil || (img.Scheme != "http" && img.Scheme != "https") {
+			p.Image = ""
+		} else {
+			p.Image = img.String()
+		}
+	}
+	return p
+}
+
+// Collapsed whitespace, valid UTF-8 and at most n runes
+func clean(s string, n int) string {
+	s = strings.Join(strings.Fields(strings.ToValidUTF8(s, "")), " ")
+	if utf8.RuneCountInString(s) > n {
+		s = string([]rune(s)[:n-1]) + "…"
+	}
+	return s
+}
@@ -0,0 +1,131 @@
+package preview
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+const page = `<!doctype html><html><head>
+<title>Fallback title</title>
+<meta property="og:title" content="Fjords &amp; fells">
+<meta name="description" content="  A   trip
+ north ">
+<meta property="og:image" content="/img/fjord.jpg">
+<meta property="og:site_name" content="Travel">
+</head><body><meta property="og:title" content="not this"></body></html>`
+
+func TestFetch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/article":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write([]byte(page))
+		case "/moved":
+			http.Redirect(w, r, "/article", http.StatusFound)
+		default:
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte("hello"))
+		}
+	}))
+	defer srv.Close()
+
+	f := New(Config{AllowPrivate: true})
+	p, err := f.Fetch(context.Background(), srv.URL+"/moved")
+	if err != nil || p == nil {
+		t.Fatalf("fetch: %v %v", p, err)
+	}
+	if p.Title != "Fjords & fells" || p.Description != "A trip north" || p.SiteName != "Travel" ||
+		p.Image != srv.URL+"/img/fjord.jpg" || p.URL != srv.URL+"/moved" {
+		t.Errorf("got %+v", p)
+	}
+	if cached, ok := f.Cached(srv.URL + "/moved"); !ok || cached != p {
+		t.Errorf("not cached: %v %v", cached, ok)
+	}
+	if p, err := f.Fetch(context.Background(), srv.URL+"/plain"); p != nil || !errors.Is(err, errNotHTML) {
+		t.Errorf("plain text: %v %v", p, err)
+	}
+	if p, ok := f.Cached(srv.URL + "/plain"); !ok || p != nil {
+		t.Errorf("miss not cached: %v %v", p, ok)
+	}
+
+	// the same server is off limits without AllowPrivate
+	strict := New(Config{})
+	if _, err := strict.Fetch(context.Background(), srv.URL+"/article"); !errors.Is(err, errPort) {
+		t.Errorf("odd port: %v", err)
+	}
+	if _, err := strict.Fetch(context.Background(), "http://localhost/article"); !errors.Is(err, errAddress) {
+		t.Errorf("loopback: %v", err)
+	}
+}
+
+func TestBlocklist(t *testing.T) {
+	f := New(Config{Blocklist: []string{"Tracker.example", " ads.example. "}})
+	for host, want := range map[string]bool{
+		"tracker.example":     true,
+		"cdn.tracker.example": true,
+		"ADS.example":         true,
+		"nottracker.example":  false,
+		"example":             false,
+	} {
+		if got := f.blocklist.Match(host); got != want {
+			t.Errorf("Match(%q) = %v", host, got)
+		}
+	}
+	if _, err := f.Fetch(context.Background(), "https://cdn.tracker.example/x"); !errors.Is(err, errBlocked) {
+		t.Errorf("fetched a blocked domain: %v", err)
+	}
+	if _, err := f.Fetch(context.Background(), "file:///etc/passwd"); !errors.Is(err, errScheme) {
+		t.Errorf("file URL: %v", err)
+	}
+}
+
+func TestPublic(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"93.184.216.34":        true,
+		"2606:2800:220:1::":    true,
+		"127.0.0.1":            false,
+		"10.1.2.3":             false,
+		"192.168.0.1":          false,
+		"169.254.169.254":      false, // cloud metadata
+		"100.64.0.1":           false,
+		"0.0.0.0":              false,
+		"::1":                  false,
+		"fd00::1":              false,
+		"::ffff:127.0.0.1":     false,
+		"fe80::1":              false,
+		"224.0.0.1":            false,
+		"::ffff:93.184.216.34": true,
+	} {
+		if got := public(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("public(%s) = %v", addr, got)
+		}
+	}
+}
+
+func TestFindURL(t *testing.T) {
+	for text, want := range map[string]string{
+		"look at https://example.com/a?b=c, nice":     "https://example.com/a?b=c",
+		"(see http://example.com/wiki/Go_(language))": "http://example.com/wiki/Go_(language)",
+		"HTTPS://EXAMPLE.COM.":                        "HTTPS://EXAMPLE.COM",
+		"no links here, ftp://example.com":            "",
+		"www.example.com and https://example.org":     "https://example.org",
+	} {
+		if got := FindURL(text); got != want {
+			t.Errorf("FindURL(%q) = %q, want %q", text, got, want)
+		}
+	}
+}
+
+func TestFindURLs(t *testing.T) {
+	links := FindURLs("try www.Example.com/x, or (https://cdn.example.org:8443/y).")
+	if len(links) != 2 || links[0] != "www.Example.com/x" || links[1] != "https://cdn.example.org:8443/y" {
+		t.Fatalf("got %q", links)
+	}
+	if Host(links[0]) != "www.example.com" || Host(links[1]) != "cdn.example.org" {
+		t.Errorf("hosts %q %q", Host(links[0]), Host(links[1]))
+	}
+}
@@ -0,0 +1,134 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Subprotocols a client can ask for on the upgrade with Sec-WebSocket-Protocol.
+// Clients that ask for none of them get chat.v1, which is what every client
+// spoke before there was a version.
+const (
+	SubprotocolV1    = "chat.v1"
+	SubprotocolV2    = "chat.v2"    // v1 plus the untranslated key on server text
+	SubprotocolProto = "chat.proto" // binary frames with the v2 fields, see frame.proto
+)
+
+// Everything the server speaks, for the upgrader. The client's order wins.
+var Subprotocols = []string{SubprotocolProto, SubprotocolV2, SubprotocolV1}
+
+// ######################################################################
+// struct: Codec
+// ######################################################################
+// How frames go out on one connection, picked on the upgrade. Only the
+// legacy handshake changes it later, before the client is being served.
+type Codec struct {
+	Subprotocol string // as negotiated, "" if the client asked for nothing
+	Version     int
+	Binary      bool
+	Legacy      bool // plain text lines, for clients from before JSON frames
+}
+
+// ######################################################################
+// function: LegacyCodec()
+// ######################################################################
+// The line protocol the first web client spoke: "name: text" for messages,
+// "UC<n>" for the user count and bare text for everything else.
+func LegacyCodec() Codec {
+	return Codec{Legacy: true}
+}
+
+// ######################################################################
+// function: CodecFor()
+// ######################################################################
+// The codec for a negotiated subprotocol. Anything unknown is chat.v1, the
+// upgrader never picks one we didn't list anyway.
+func CodecFor(subprotocol string) Codec {
+	switch subprotocol {
+	case SubprotocolV2:
+		return Codec{Subprotocol: subprotocol, Version: 2}
+	case SubprotocolProto:
+		return Codec{Subprotocol: subprotocol, Version: 2, Binary: true}
+	}
+	return Codec{Subprotocol: subprotocol, Version: 1}
+}
+
+// ######################################################################
+// function: Encode()
+// ######################################################################
+// The frame as a WebSocket message payload, text already translated. nil
+// means the frame has nothing to say in this codec.
+func (c Codec) Encode(f Frame) ([]byte, error) {
+	if c.Legacy {
+		return encodeLegacy(f), nil
+	}
+	if c.Version >= 2 {
+		f.Key = f.Format
+	}
+	f = Stamp(f)
+	if c.Binary {
+		return f.MarshalProto(), nil
+	}
+	return json.Marshal(f)
+}
+
+// ######################################################################
+// function: Stamp()
+// ######################################################################
+// Fills in ts, from SentAt or now for frames nobody dated. Messages nested
+// in the frame only get one if they know when they were posted.
+func Stamp(f Frame) Frame {
+	if f.TS == 0 {
+		if f.SentAt.IsZero() {
+			f.TS = time.Now().UnixMilli()
+		} else {
+			f.TS = f.SentAt.UnixMilli()
+		}
+	}
+	f.Messages = stampAll(f.Messages)
+	f.Pins = stampAll(f.Pins)
+	return f
+}
+
+func stampAll(frames []Frame) []Frame {
+	if len(frames) == 0 {
+		return frames
+	}
+	out := make([]Frame, len(frames)) // the caller's are shared with history
+	for i, f := range frames {
+		if f.TS == 0 && !f.SentAt.IsZero() {
+			f.TS = f.SentAt.UnixMilli()
+		}
+		out[i] = f
+	}
+	return out
+}
+
+// ######################################################################
+// function: Name()
+// ######################################################################
+// For stats and logs.
+func (c Codec) Name() string {
+	if c.Legacy {
+		return "legacy"
+	}
+	if c.Subprotocol == "" {
+		return SubprotocolV1
+	}
+	return c.Subprotocol
+}
+
+func encodeLegacy(f Frame) []byte {
+	switch {
+	case f.Type == FrameUserCount:
+		return []byte(fmt.Sprintf("UC%d", f.Count))
+	case f.Type == FrameMessage:
+		return []byte(f.From + ": " + f.Text)
+	case f.Type == FrameRename:
+		return []byte(f.From + " is now known as " + f.Text)
+	case f.Text != "":
+		return []byte(f.Text)
+	}
+	return nil // sessions, pins, presence, ... only make sense to newer clients
+}
@@ -0,0 +1,379 @@
+// Package protocol has the frames that go over the WebSocket in both directions.
+package protocol
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Frame types sent from the server to clients
+const (
+	FrameMessage      = "message"       // chat line from a user
+	FrameSystem       = "system"        // server notice (welcome, joins, leaves, ...)
+	FrameUserCount    = "user_count"    // number of connected users
+	FrameStrike       = "strike"        // moderation strike DM to a single user
+	FrameSlowMode     = "slow_mode"     // message rejected, wait_ms until the next one is allowed
+	FrameError        = "error"         // something the client asked for failed, code says what
+	FrameRoomUpdated  = "room_updated"  // room metadata changed
+	FrameTopic        = "topic"         // current topic, sent on join
+	FrameTopicChanged = "topic_changed" // a moderator changed the topic
+	FrameInvite       = "invite"        // invite token for a locked room
+	FrameSession      = "session"       // session id to pass as ?sid= when reconnecting, and who you are
+	FramePins         = "pins"          // all pinned messages of a room, sent on join
+	FramePinned       = "pinned"        // a moderator pinned a message
+	FrameUnpinned     = "unpinned"      // a moderator unpinned message ID
+	FrameReaction     = "reaction"      // reaction on message ID changed, count is the new total
+	FrameMOTD         = "motd"          // message of the day, sent on connect
+	FrameAnnouncement = "announcement"  // server wide announcement from an admin
+	FrameDeleted      = "deleted"       // message ID is gone, clients should remove it
+	FramePresence     = "presence"      // presence of from changed to text
+	FrameBanner       = "banner"        // room banner, on join and when it changes, no banner = cleared
+	FrameDirect       = "direct"        // private message, to the recipient and back to the sender
+	FrameRefresh      = "refresh"       // new web client deployed, reload after wait_ms
+	FrameRename       = "rename"        // from is now called text
+	FrameAck          = "ack"           // the message sent with client_id was posted as id
+	FrameMention      = "mention"       // a chat line in another room mentioned you, as on message
+	FramePreview      = "preview"       // link preview for message ID, when it wasn't ready as it went out
+	FrameRooms        = "rooms"         // on connect: members per room in rooms, unread messages per room in unread
+	FramePoll         = "poll"          // poll ID, posted or with new results, text is the question
+	FrameEmoji        = "emoji"         // the custom emoji catalog, on connect and when it changes
+	FrameRead         = "read"          // in /api/sync: everything in room up to ID was read, on some device
+
+	FrameMissedMessages = "missed_messages" // direct messages and mentions queued while signed out
+
+	// End to end encryption between two users, the server only relays the payload
+	FrameEncrypted   = "encrypted"    // private message, payload is ciphertext only the clients can read
+	FrameKeyExchange = "key_exchange" // key material from from, for setting up the encryption
+
+	// WebRTC calls, the server only relays the signaling, see hub/calls.go
+	FrameCall       = "call"        // call presence: from joined or left (text), members is who is in it now
+	FrameCallOffer  = "call_offer"  // SDP offer from from in payload, a ring if you aren't in the call yet
+	FrameCallAnswer = "call_answer" // SDP answer from from in payload
+	FrameCallICE    = "call_ice"    // ICE candidate from from in payload
+)
+
+// Codes on error frames, for clients to act on without parsing the text.
+// A code never changes meaning, new failures get new numbers.
+const (
+	CodeInvalid         = 1  // malformed frame, bad arguments, usage
+	CodeUnknownCommand  = 2  // no such slash command
+	CodeNotPermitted    = 3  // not a moderator, wrong password, invite only, turned off in the room
+	CodeRateLimited     = 4  // too fast, too often or over the bandwidth cap
+	CodeNameTaken       = 5  // the name belongs to someone else
+	CodeRoomNotFound    = 6  // no such room
+	CodeUserNotFound    = 7  // nobody by that name, or not online
+	CodeMessageNotFound = 8  // no message with that ID
+	CodeTooLarge        = 9  // frame or text over the size limit
+	CodeLimitReached    = 10 // too many pins, ignores, scheduled messages...
+)
+
+// Close code sent to clients running a version we no longer accept
+// (4000-4999 is the application range, 426 mirrors HTTP Upgrade Required)
+const CloseUpgradeRequired = 4426
+
+// ######################################################################
+// struct: Frame
+// ######################################################################
+// Everything the server writes to a client is a JSON encoded Frame.
+type Frame struct {
+	Type     string         `json:"type"`
+	ID       int64          `json:"id,omitempty"`       // server assigned message ID
+	ReplyTo  int64          `json:"reply_to,omitempty"` // parent message ID for threaded replies
+	TTLMs    int64          `json:"ttl_ms,omitempty"`   // self-destructing message, a deleted frame follows
+	Ack      bool           `json:"ack,omitempty"`      // client should reply with an ack frame
+	Room     string         `json:"room,omitempty"`
+	From     string         `json:"from,omitempty"`
+	Color    string         `json:"color,omitempty"` // on message, direct and presence: from's display color, #rrggbb
+	Text     string         `json:"text,omitempty"`
+	HTML     string         `json:"html,omitempty"` // on message and direct, text rendered from Markdown, safe to show as is
+	Count    int            `json:"count,omitempty"`
+	Rooms    map[string]int `json:"rooms,omitempty"` // members per room, on user_count and rooms
+	WaitMs   int64          `json:"wait_ms,omitempty"`
+	Code     int            `json:"code,omitempty"` // on error, one of the Code constants
+	Strike   *StrikeNotice  `json:"strike,omitempty"`
+	Meta     *RoomMeta      `json:"meta,omitempty"`
+	Token    string         `json:"token,omitempty"`
+	Pins     []Frame        `json:"pins,omitempty"`
+	Banner   *Banner        `json:"banner,omitempty"`
+	Messages []Frame        `json:"messages,omitempty"` // on missed_messages
+	Profile  *Profile       `json:"profile,omitempty"`  // on presence, for signed in users
+	Preview  *LinkPreview   `json:"preview,omitempty"`  // on message and preview, for the first link in it
+	Poll     *Poll          `json:"poll,omitempty"`     // on poll
+	Quote    *Quote         `json:"quote,omitempty"`    // on message, what it quotes as it was then
+	Emoji    []Emoji        `json:"emoji,omitempty"`    // on emoji the catalog, on message the custom ones in text
+
+	// on presence: "available" or "away", and the status line (or away reason)
+	Availability string `json:"availability,omitempty"`
+	Status       string `json:"status,omitempty"`
+
+	Reactions map[string][]string `json:"reactions,omitempty"` // emoji -> who reacted, on history
+
+	// on encrypted and key_exchange: who it is for, and the opaque payload
+	To      string `json:"to,omitempty"`
+	Payload string `json:"payload,omitempty"`
+
+	ClientID string `json:"client_id,omitempty"` // on ack, as the client sent it
+
+	Unread map[string]int `json:"unread,omitempty"` // on rooms, messages since the last mark_read per room
+
+	// on call and the relayed call_ frames: the call's ID, and on call who is in it
+	Call    string   `json:"call,omitempty"`
+	Members []string `json:"members,omitempty"`
+
+	// The English format of translated server text, so bots can match on it
+	// whatever the locale. chat.v2 and up, see Codec.
+	Key string `json:"key,omitempty"`
+
+	// Server time in unix millis, when a message was posted or an event
+	// happened. Set from SentAt by the codec, clients go by this and not
+	// their own clock.
+	TS int64 `json:"ts,omitempty"`
+
+	SentAt time.Time `json:"-"` // when a chat message was posted (or the event happened), goes out as ts
+
+	// Server text that gets translated for each recipient into Text, see i18n.Tr()
+	Format string `json:"-"`
+	Args   []any  `json:"-"`
+}
+
+// ######################################################################
+// function: Systemf()
+// ######################################################################
+// A system frame for room that every recipient gets in their own language.
+func Systemf(room string, format string, args ...any) Frame {
+	return Frame{Type: FrameSystem, Room: room, Format: format, Args: args}
+}
+
+// ######################################################################
+// struct: StrikeNotice
+// ######################################################################
+// Machine readable part of the strike DM, the localized text goes in Frame.Text.
+type StrikeNotice struct {
+	Rule       string `json:"rule"`
+	Strikes    int    `json:"strikes"`
+	MaxStrikes int    `json:"max_strikes"`
+	Next       string `json:"next"` // consequence of the next strike: "warning", "kick" or "ban"
+	Banned     bool   `json:"banned,omitempty"`
+}
+
+// ######################################################################
+// struct: RoomMeta
+// ######################################################################
+// Editable room details shown in the room directory.
+type RoomMeta struct {
+	Description string     `json:"description,omitempty"`
+	Tags        []string   `json:"tags,omitempty"`
+	Icon        string     `json:"icon,omitempty"`    // emoji or image URL
+	Welcome     string     `json:"welcome,omitempty"` // sent to everyone joining the room
+	Policy      RoomPolicy `json:"policy"`
+}
+
+func (m RoomMeta) IsZero() bool {
+	return m.Description == "" && len(m.Tags) == 0 && m.Icon == "" && m.Welcome == "" && m.Policy == RoomPolicy{}
+}
+
+// Banner levels, clients pick the colour
+const (
+	BannerInfo     = "info"
+	BannerWarning  = "warning"
+	BannerIncident = "incident"
+)
+
+// ######################################################################
+// struct: Banner
+// ######################################################################
+// Sticky notice above a room's messages, for rules or an ongoing incident.
+// Unlike pins it isn't a message, there is at most one and it has no ID.
+type Banner struct {
+	Text  string    `json:"text"`
+	Level string    `json:"level"`
+	SetBy string    `json:"set_by,omitempty"`
+	SetAt time.Time `json:"set_at"`
+}
+
+// ######################################################################
+// struct: LinkPreview
+// ######################################################################
+// OpenGraph data of a linked page, fetched by the server so clients don't
+// tell every site who is reading the chat. Image is a URL the client
+// fetches itself, if it wants to.
+type LinkPreview struct {
+	URL         string `json:"url"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	Image       string `json:"image,omitempty"`
+	SiteName    string `json:"site_name,omitempty"`
+}
+
+// ######################################################################
+// struct: Poll
+// ######################################################################
+// A poll and how the votes stand. Votes are counted, not who cast them.
+type Poll struct {
+	Question string       `json:"question"`
+	Options  []PollOption `json:"options"`
+	Closes   int64        `json:"closes,omitempty"` // unix millis, when it closes by itself
+	Closed   bool         `json:"closed,omitempty"`
+}
+
+type PollOption struct {
+	Text  string `json:"text"`
+	Votes int    `json:"votes"`
+}
+
+// ######################################################################
+// struct: Quote
+// ######################################################################
+// A copy of the quoted message taken when the quote was posted, so clients
+// can show it without having the original.
+type Quote struct {
+	ID   int64  `json:"id"`
+	From string `json:"from"`
+	Text string `json:"text"`
+	TS   int64  `json:"ts,omitempty"` // unix millis, when the quoted message was posted
+}
+
+// ######################################################################
+// struct: Emoji
+// ######################################################################
+// A custom emoji: clients show the image at URL (relative to the server)
+// for :name: in text.
+type Emoji struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+// ######################################################################
+// struct: Profile
+// ######################################################################
+// What a signed in user tells about themselves. Joined is when the account
+// was created, Bot is set by the server.
+type Profile struct {
+	DisplayName string    `json:"display_name,omitempty"`
+	AvatarURL   string    `json:"avatar_url,omitempty"`
+	Bio         string    `json:"bio,omitempty"`
+	Joined      time.Time `json:"joined"`
+	Bot         bool      `json:"bot,omitempty"` // a bot account, see the bot package
+}
+
+// Room features a policy can switch off
+const (
+	FeatureReactions    = "reactions"
+	FeatureUploads      = "uploads"
+	FeatureLinkPreviews = "link_previews"
+)
+
+// ######################################################################
+// struct: RoomPolicy
+// ######################################################################
+// Features switched off in a room. Clients hide the UI for them, the server
+// refuses them either way. The zero value allows everything.
+type RoomPolicy struct {
+	NoReactions    bool `json:"no_reactions,omitempty"`
+	NoUploads      bool `json:"no_uploads,omitempty"`
+	NoLinkPreviews bool `json:"no_link_previews,omitempty"`
+}
+
+// ######################################################################
+// function: Allows()
+// ######################################################################
+func (p RoomPolicy) Allows(feature string) bool {
+	switch feature {
+	case FeatureReactions:
+		return !p.NoReactions
+	case FeatureUploads:
+		return !p.NoUploads
+	case FeatureLinkPreviews:
+		return !p.NoLinkPreviews
+	}
+	return true
+}
+
+// ######################################################################
+// function: Set()
+// ######################################################################
+// Turns a feature on or off, false if there is no such feature.
+func (p *RoomPolicy) Set(feature string, on bool) bool {
+	switch feature {
+	case FeatureReactions:
+		p.NoReactions = !on
+	case FeatureUploads:
+		p.NoUploads = !on
+	case FeatureLinkPreviews:
+		p.NoLinkPreviews = !on
+	default:
+		return false
+	}
+	return true
+}
+
+// Client frame types, for clients that send JSON instead of plain text
+const (
+	ClientAck       = "ack"       // receipt of a frame that had ack set
+	ClientMessage   = "message"   // chat line, optionally a reply_to another message
+	ClientReact     = "react"     // toggle reaction text on message id
+	ClientHeartbeat = "heartbeat" // app state: state "focused" or "background", battery_saver
+	ClientSubscribe = "subscribe" // only get chat lines matching commands or patterns, both empty = everything
+	ClientHello     = "hello"     // first frame of a JSON client, see chat/legacy.go
+	ClientMarkRead  = "mark_read" // read everything up to message id in room (default the current one)
+	ClientVote      = "vote"      // vote for option (1 is the first) of poll id, again to change it
+
+	ClientEncrypted   = "encrypted"    // end to end encrypted private message with payload for to
+	ClientKeyExchange = "key_exchange" // key material in payload for to
+
+	// WebRTC call signaling, payload is passed on untouched
+	ClientCallJoin   = "call_join"   // join the call of room (default the current one), starting it if there is none
+	ClientCallOffer  = "call_offer"  // SDP offer for to in call, no call = ring to in a new private call
+	ClientCallAnswer = "call_answer" // SDP answer for to in call, answering a ring joins the call
+	ClientCallICE    = "call_ice"    // ICE candidate for to in call
+	ClientCallHangup = "call_hangup" // leave call, or turn down its ring
+)
+
+// ######################################################################
+// struct: ClientFrame
+// ######################################################################
+type ClientFrame struct {
+	Type    string `json:"type"`
+	ID      int64  `json:"id,omitempty"`
+	Text    string `json:"text,omitempty"`
+	ReplyTo int64  `json:"reply_to,omitempty"`
+	TTLMs   int64  `json:"ttl_ms,omitempty"`
+
+	State        string `json:"state,omitempty"`
+	BatterySaver bool   `json:"battery_saver,omitempty"`
+
+	Commands []string `json:"commands,omitempty"` // "weather" matches lines starting with !weather
+	Patterns []string `json:"patterns,omitempty"` // regular expressions
+
+	To      string `json:"to,omitempty"`      // recipient of encrypted and key_exchange
+	Payload string `json:"payload,omitempty"` // opaque to the server, base64 by convention
+
+	// Made up by the client for a message, which then gets an ack with the
+	// server's ID. A resend with the same one after a reconnect is only
+	// acked again, not posted twice.
+	ClientID string `json:"client_id,omitempty"`
+
+	Room string `json:"room,omitempty"` // on mark_read and call_join
+	Call string `json:"call,omitempty"` // on the call_ frames but call_join
+
+	Option int   `json:"option,omitempty"` // on vote
+	Quote  int64 `json:"quote,omitempty"`  // on message, ID of a message in the room to quote
+}
+
+// ######################################################################
+// function: ParseClientFrame()
+// ######################################################################
+// Anything that is not a JSON object with a known type is a plain chat line.
+func ParseClientFrame(data []byte) (ClientFrame, bool) {
+	var cf ClientFrame
+	if len(data) == 0 || data[0] != '{' || json.Unmarshal(data, &cf) != nil {
+		return cf, false
+	}
+	switch cf.Type {
+	case ClientAck, ClientMessage, ClientReact, ClientHeartbeat, ClientSubscribe, ClientHello,
+		ClientEncrypted, ClientKeyExchange, ClientMarkRead, ClientVote,
+		ClientCallJoin, ClientCallOffer, ClientCallAnswer, ClientCallICE, ClientCallHangup:
+		return cf, true
+	}
+	return cf, false
+}
@@ -0,0 +1,570 @@
+package protocol
+
+import (
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The encoders below follow frame.proto by hand, which keeps the hot path
+// free of reflection and codegen. proto3 rules: zero values are left out.
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendInt(b []byte, num protowire.Number, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(v))
+}
+
+func appendBool(b []byte, num protowire.Number, v bool) []byte {
+	if !v {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, 1)
+}
+
+func appendMessage(b []byte, num protowire.Number, msg []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, msg)
+}
+
+// ######################################################################
+// function: MarshalProto()
+// ######################################################################
+func (f Frame) MarshalProto() []byte {
+	return f.appendProto(nil)
+}
+
+func (f Frame) appendProto(b []byte) []byte {
+	b = appendString(b, 1, f.Type)
+	b = appendInt(b, 2, f.ID)
+	b = appendInt(b, 3, f.ReplyTo)
+	b = appendInt(b, 4, f.TTLMs)
+	b = appendBool(b, 5, f.Ack)
+	b = appendString(b, 6, f.Room)
+	b = appendString(b, 7, f.From)
+	b = appendString(b, 8, f.Text)
+	b = appendInt(b, 9, int64(f.Count))
+	b = appendInt(b, 10, f.WaitMs)
+	if s := f.Strike; s != nil {
+		var m []byte
+		m = appendString(m, 1, s.Rule)
+		m = appendInt(m, 2, int64(s.Strikes))
+		m = appendInt(m, 3, int64(s.MaxStrikes))
+		m = appendString(m, 4, s.Next)
+		m = appendBool(m, 5, s.Banned)
+		b = appendMessage(b, 11, m)
+	}
+	if meta := f.Meta; meta != nil {
+		var m []byte
+		m = appendString(m, 1, meta.Description)
+		for _, tag := range meta.Tags {
+			m = protowire.AppendTag(m, 2, protowire.BytesType)
+			m = protowire.AppendString(m, tag)
+		}
+		m = appendString(m, 3, meta.Icon)
+		m = appendString(m, 4, meta.Welcome)
+		if meta.Policy != (RoomPolicy{}) {
+			var p []byte
+			p = appendBool(p, 1, meta.Policy.NoReactions)
+			p = appendBool(p, 2, meta.Policy.NoUploads)
+			p = appendBool(p, 3, meta.Policy.NoLinkPreviews)
+			m = appendMessage(m, 5, p)
+		}
+		b = appendMessage(b, 12, m)
+	}
+	b = appendString(b, 13, f.Token)
+	for _, pin := range f.Pins {
+		b = appendMessage(b, 14, pin.appendProto(nil))
+	}
+	for emoji, users := range f.Reactions {
+		var list []byte
+		for _, u := range users {
+			list = protowire.AppendTag(list, 1, protowire.BytesType)
+			list = protowire.AppendString(list, u)
+		}
+		var entry []byte
+		entry = appendString(entry, 1, emoji)
+		entry = appendMessage(entry, 2, list)
+		b = appendMessage(b, 15, entry)
+	}
+	for room, n := range f.Rooms {
+		var entry []byte
+		entry = appendString(entry, 1, room)
+		entry = appendInt(entry, 2, int64(n))
+		b = appendMessage(b, 16, entry)
+	}
+	b = appendString(b, 17, f.Key)
+	if banner := f.Banner; banner != nil {
+		var m []byte
+		m = appendString(m, 1, banner.Text)
+		m = appendString(m, 2, banner.Level)
+		m = appendString(m, 3, banner.SetBy)
+		if !banner.SetAt.IsZero() {
+			m = appendInt(m, 4, banner.SetAt.UnixMilli())
+		}
+		b = appendMessage(b, 18, m)
+	}
+	for _, msg := range f.Messages {
+		b = appendMessage(b, 19, msg.appendProto(nil))
+	}
+	if p := f.Profile; p != nil {
+		var m []byte
+		m = appendString(m, 1, p.DisplayName)
+		m = appendString(m, 2, p.AvatarURL)
+		m = appendString(m, 3, p.Bio)
+		if !p.Joined.IsZero() {
+			m = appendInt(m, 4, p.Joined.UnixMilli())
+		}
+		m = appendBool(m, 5, p.Bot)
+		b = appendMessage(b, 20, m)
+	}
+	b = appendString(b, 21, f.Availability)
+	b = appendString(b, 22, f.Status)
+	b = appendString(b, 23, f.To)
+	b = appendString(b, 24, f.Payload)
+	b = appendInt(b, 25, f.TS)
+	b = appendString(b, 26, f.ClientID)
+	for room, n := range f.Unread {
+		var entry []byte
+		entry = appendString(entry, 1, room)
+		entry = appendInt(entry, 2, int64(n))
+		b = appendMessage(b, 27, entry)
+	}
+	b = appendInt(b, 28, int64(f.Code))
+	b = appendString(b, 29, f.Call)
+	for _, m := range f.Members {
+		b = protowire.AppendTag(b, 30, protowire.BytesType)
+		b = protowire.AppendString(b, m)
+	}
+	if p := f.Preview; p != nil {
+		var m []byte
+		m = appendString(m, 1, p.URL)
+		m = appendString(m, 2, p.Title)
+		m = appendString(m, 3, p.Description)
+		m = appendString(m, 4, p.Image)
+		m = appendString(m, 5, p.SiteName)
+		b = appendMessage(b, 31, m)
+	}
+	if p := f.Poll; p != nil {
+		var m []byte
+		m = appendString(m, 1, p.Question)
+		for _, o := range p.Options {
+			var opt []byte
+			opt = appendString(opt, 1, o.Text)
+			opt = appendInt(opt, 2, int64(o.Votes))
+			m = appendMessage(m, 2, opt)
+		}
+		m = appendInt(m, 3, p.Closes)
+		m = appendBool(m, 4, p.Closed)
+		b = appendMessage(b, 32, m)
+	}
+	if q := f.Quote; q != nil {
+		var m []byte
+		m = appendInt(m, 1, q.ID)
+		m = appendString(m, 2, q.From)
+		m = appendString(m, 3, q.Text)
+		m = appendInt(m, 4, q.TS)
+		b = appendMessage(b, 33, m)
+	}
+	b = appendString(b, 35, f.HTML)
+	b = appendString(b, 36, f.Color)
+	for _, e := range f.Emoji {
+		var m []byte
+		m = appendString(m, 1, e.Name)
+		m = appendString(m, 2, e.URL)
+		b = appendMessage(b, 34, m)
+	}
+	return b
+}
+
+// ######################################################################
+// function: walkProto()
+// ######################################################################
+// Calls field for every field in b with its bytes (length delimited) or
+// its value (varint). Fields of other wire types are skipped.
+func walkProto(b []byte, field func(num protowire.Number, v []byte, x uint64)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		var v []byte
+		var x uint64
+		switch typ {
+		case protowire.VarintType:
+			x, n = protowire.ConsumeVarint(b)
+		case protowire.BytesType:
+			v, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		field(num, v, x)
+	}
+	return nil
+}
+
+// ######################################################################
+// function: UnmarshalFrameProto()
+// ######################################################################
+// For clients and tests, the server only ever encodes frames.
+func UnmarshalFrameProto(b []byte) (Frame, error) {
+	var f Frame
+	var errs []error
+	check := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	err := walkProto(b, func(num protowire.Number, v []byte, x uint64) {
+		switch num {
+		case 1:
+			f.Type = string(v)
+		case 2:
+			f.ID = int64(x)
+		case 3:
+			f.ReplyTo = int64(x)
+		case 4:
+			f.TTLMs = int64(x)
+		case 5:
+			f.Ack = x != 0
+		case 6:
+			f.Room = string(v)
+		case 7:
+			f.From = string(v)
+		case 8:
+			f.Text = string(v)
+		case 9:
+			f.Count = int(x)
+		case 10:
+			f.WaitMs = int64(x)
+		case 11:
+			s := &StrikeNotice{}
+			check(walkProto(v, func(num protowire.Number, v []byte, x uint64) {
+				switch num {
+				case 1:
+					s.Rule = string(v)
+				case 2:
+					s.Strikes = int(x)
+				case 3:
+					s.MaxStrikes = int(x)
+				case 4:
+					s.Next = string(v)
+				case 5:
+					s.Banned = x != 0
+				}
+			}))
+			f.Strike = s
+		case 12:
+			m := &RoomMeta{}
+			check(walkProto(v, func(num protowire.Number, v []byte, x uint64) {
+				switch num {
+				case 1:
+					m.Description = string(v)
+				case 2:
+					m.Tags = append(m.Tags, string(v))
+				case 3:
+					m.Icon = string(v)
+				case 4:
+					m.Welcome = string(v)
+				case 5:
+					check(walkProto(v, func(num protowire.Number, v []byte, x uint64) {
+						switch num {
+						case 1:
+							m.Policy.NoReactions = x != 0
+						case 2:
+							m.Policy.NoUploads = x != 0
+						case 3:
+							m.Policy.NoLinkPreviews = x != 0
+						}
+					}))
+				}
+			}))
+			f.Meta = m
+		case 13:
+			f.Token = string(v)
+		case 14:
+			pin, err := UnmarshalFrameProto(v)
+			check(err)
+			f.Pins = append(f.Pins, pin)
+		case 15:
+			var emoji string
+			var users []string
+			check(walkProto(v, func(num protowire.Number, v []byte, x uint64) {
+				switch num {
+				case 1:
+					emoji = string(v)
+				case 2:
+					check(walkProto(v, func(num protowire.Number, v []byte, x uint64) {
+						if num == 1 {
+							users = append(users, string(v))
+						}
+					}))
+				}
+			}))
+			if f.Reactions == nil {
+				f.Reactions = make(map[string][]string)
+			}
+			f.Reactions[emoji] = users
+		case 16:
+			var room string
+			var n int
+			check(walkProto(v, func(num protowire.Number, v []byte, x uint64) {
+				switch num {
+				case 1:
+					room = string(v)
+				case 2:
+					n = int(x)
+				}
+			}))
+			if f.Rooms == nil {
+				f.Rooms = make(map[string]int)
+			}
+			f.Rooms[room] = n
+		case 17:
+			f.Key = string(v)
+		case 18:
+			banner := &Banner{}
+			check(walkProto(v, func(num protowire.Number, v []byte, x uint64) {
+				switch num {
+				case 1:
+					banner.Text = string(v)
+				case 2:
+					banner.Level = string(v)
+				case 3:
+					banner.SetBy = string(v)
+				case 4:
+					banner.SetAt = time.UnixMilli(int64(x))
+				}
+			}))
+			f.Banner = banner
+		case 19:
+			msg, err := UnmarshalFrameProto(v)
+			check(err)
+			f.Messages = append(f.Messages, msg)
+		case 20:
+			p := &Profile{}
+			check(walkProto(v, func(num protowire.Number, v []byte, x uint64) {
+				switch num {
+				case 1:
+					p.DisplayName = string(v)
+				case 2:
+					p.AvatarURL = string(v)
+				case 3:
+					p.Bio = string(v)
+				case 4:
+					p.Joined = time.UnixMilli(int64(x))
+				case 5:
+					p.Bot = x != 0
+				}
+			}))
+			f.Profile = p
+		case 21:
+			f.Availability = string(v)
+		case 22:
+			f.Status = string(v)
+		case 23:
+			f.To = string(v)
+		case 24:
+			f.Payload = string(v)
+		case 25:
+			f.TS = int64(x)
+		case 26:
+			f.ClientID = string(v)
+		case 27:
+			var room string
+			var n int
+			check(walkProto(v, func(num protowire.Number, v []byte, x uint64) {
+				switch num {
+				case 1:
+					room = string(v)
+				case 2:
+					n = int(x)
+				}
+			}))
+			if f.Unread == nil {
+				f.Unread = make(map[string]int)
+			}
+			f.Unread[room] = n
+		case 28:
+			f.Code = int(x)
+		case 29:
+			f.Call = string(v)
+		case 30:
+			f.Members = append(f.Members, string(v))
+		case 31:
+			p := &LinkPreview{}
+			check(walkProto(v, func(num protowire.Number, v []byte, x uint64) {
+				switch num {
+				case 1:
+					p.URL = string(v)
+				case 2:
+					p.Title = string(v)
+				case 3:
+					p.Description = string(v)
+				case 4:
+					p.Image = string(v)
+				case 5:
+					p.SiteName = string(v)
+				}
+			}))
+			f.Preview = p
+		case 32:
+			p := &Poll{}
+			check(walkProto(v, func(num protowire.Number, v []byte, x uint64) {
+				switch num {
+				case 1:
+					p.Question = string(v)
+				case 2:
+					var o PollOption
+					check(walkProto(v, func(num protowire.Number, v []byte, x uint64) {
+						switch num {
+						case 1:
+							o.Text = string(v)
+						case 2:
+							o.Votes = int(x)
+						}
+					}))
+					p.Options = append(p.Options, o)
+				case 3:
+					p.Closes = int64(x)
+				case 4:
+					p.Closed = x != 0
+				}
+			}))
+			f.Poll = p
+		case 33:
+			q := &Quote{}
+			check(walkProto(v, func(num protowire.Number, v []byte, x uint64) {
+				switch num {
+				case 1:
+					q.ID = int64(x)
+				case 2:
+					q.From = string(v)
+				case 3:
+					q.Text = string(v)
+				case 4:
+					q.TS = int64(x)
+				}
+			}))
+			f.Quote = q
+		case 35:
+			f.HTML = string(v)
+		case 36:
+			f.Color = string(v)
+		case 34:
+			var e Emoji
+			check(walkProto(v, func(num protowire.Number, v []byte, x uint64) {
+				switch num {
+				case 1:
+					e.Name = string(v)
+				case 2:
+					e.URL = string(v)
+				}
+			}))
+			f.Emoji = append(f.Emoji, e)
+		}
+	})
+	if err == nil && len(errs) > 0 {
+		err = errs[0]
+	}
+	return f, err
+}
+
+// ######################################################################
+// function: MarshalProto()
+// ######################################################################
+func (cf ClientFrame) MarshalProto() []byte {
+	var b []byte
+	b = appendString(b, 1, cf.Type)
+	b = appendInt(b, 2, cf.ID)
+	b = appendString(b, 3, cf.Text)
+	b = appendInt(b, 4, cf.ReplyTo)
+	b = appendInt(b, 5, cf.TTLMs)
+	b = appendString(b, 6, cf.State)
+	b = appendBool(b, 7, cf.BatterySaver)
+	for _, c := range cf.Commands {
+		b = protowire.AppendTag(b, 8, protowire.BytesType)
+		b = protowire.AppendString(b, c)
+	}
+	for _, p := range cf.Patterns {
+		b = protowire.AppendTag(b, 9, protowire.BytesType)
+		b = protowire.AppendString(b, p)
+	}
+	b = appendString(b, 10, cf.To)
+	b = appendString(b, 11, cf.Payload)
+	b = appendString(b, 12, cf.ClientID)
+	b = appendString(b, 13, cf.Room)
+	b = appendString(b, 14, cf.Call)
+	b = appendInt(b, 15, int64(cf.Option))
+	b = appendInt(b, 16, cf.Quote)
+	return b
+}
+
+// ######################################################################
+// function: ParseClientFrameProto()
+// ######################################################################
+// The binary counterpart of ParseClientFrame.
+func ParseClientFrameProto(b []byte) (ClientFrame, bool) {
+	var cf ClientFrame
+	err := walkProto(b, func(num protowire.Number, v []byte, x uint64) {
+		switch num {
+		case 1:
+			cf.Type = string(v)
+		case 2:
+			cf.ID = int64(x)
+		case 3:
+			cf.Text = string(v)
+		case 4:
+			cf.ReplyTo = int64(x)
+		case 5:
+			cf.TTLMs = int64(x)
+		case 6:
+			cf.State = string(v)
+		case 7:
+			cf.BatterySaver = x != 0
+		case 8:
+			cf.Commands = append(cf.Commands, string(v))
+		case 9:
+			cf.Patterns = append(cf.Patterns, string(v))
+		case 10:
+			cf.To = string(v)
+		case 11:
+			cf.Payload = string(v)
+		case 12:
+			cf.ClientID = string(v)
+		case 13:
+			cf.Room = string(v)
+		case 14:
+			cf.Call = string(v)
+		case 15:
+			cf.Option = int(x)
+		case 16:
+			cf.Quote = int64(x)
+		}
+	})
+	if err != nil {
+		return cf, false
+	}
+	switch cf.Type {
+	case ClientAck, ClientMessage, ClientReact, ClientHeartbeat, ClientSubscribe, ClientEncrypted, ClientKeyExchange,
+		ClientMarkRead, ClientVote, ClientCallJoin, ClientCallOffer, ClientCallAnswer, ClientCallICE, ClientCallHangup:
+		return cf, true
+	}
+	return cf, false
+}
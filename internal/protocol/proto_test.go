@@ -0,0 +1,98 @@
+package protocol
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFrameProtoRoundTrip(t *testing.T) {
+	frames := []Frame{
+		{Type: FrameUserCount, Count: 3, Rooms: map[string]int{"lobby": 2, "dev": 1}},
+		{Type: FrameMessage, ID: 42, ReplyTo: 7, TTLMs: 5000, Ack: true, Room: "dev", From: "kari", Text: "hei 👋",
+			Reactions: map[string][]string{"👍": {"ola", "kari"}}, TS: 1712345678901},
+		{Type: FrameStrike, Text: "watch it", Strike: &StrikeNotice{Rule: "spam", Strikes: 2, MaxStrikes: 3, Next: "ban"}},
+		{Type: FrameRoomUpdated, Room: "dev", Meta: &RoomMeta{Description: "d", Tags: []string{"go", "chat"}, Policy: RoomPolicy{NoUploads: true}}},
+		{Type: FramePins, Room: "dev", Pins: []Frame{{Type: FrameMessage, ID: 1, Text: "pinned"}}},
+		{Type: FrameMissedMessages, Messages: []Frame{{Type: FrameDirect, ID: 2, From: "ola", Text: "ring meg"}}},
+		{Type: FrameSlowMode, WaitMs: 1500, Token: "abc"},
+		{Type: FrameSystem, Text: "Brukernavn satt til kari", Key: "Username set to %s"},
+		{Type: FrameBanner, Room: "ops", Banner: &Banner{Text: "db down", Level: BannerIncident, SetBy: "kari", SetAt: time.UnixMilli(1712345678901)}},
+		{Type: FramePresence, Room: "dev", From: "kari", Text: "online", Profile: &Profile{DisplayName: "Kari N.", Bio: "ops", Joined: time.UnixMilli(1712345678901), Bot: true},
+			Availability: "away", Status: "lunch"},
+		{Type: FrameEncrypted, ID: 43, From: "kari", To: "ola", Payload: "c2VjcmV0"},
+		{Type: FrameAck, ID: 44, Room: "dev", ClientID: "k-1"},
+		{Type: FrameRooms, Rooms: map[string]int{"lobby": 2, "dev": 1}, Unread: map[string]int{"lobby": 0, "dev": 7}},
+		{Type: FrameError, Code: CodeRoomNotFound, Text: "no such room"},
+		{Type: FrameCall, Room: "dev", From: "kari", Text: "joined", Call: "#dev", Members: []string{"kari", "ola"}},
+		{Type: FramePreview, ID: 7, Room: "dev", Preview: &LinkPreview{URL: "https://example.com/", Title: "Example", SiteName: "Example"}},
+		{Type: FrameMessage, ID: 9, Room: "dev", From: "ola", Color: "#0c8599", Text: "*agreed*", HTML: "<em>agreed</em>", Quote: &Quote{ID: 3, From: "kari", Text: "ship it", TS: 1712345678901}},
+		{Type: FrameEmoji, Emoji: []Emoji{{Name: "party", URL: "/emoji/party?v=1a2b"}, {Name: "shipit", URL: "/emoji/shipit?v=3c4d"}}},
+		{Type: FramePoll, ID: 8, Room: "dev", From: "kari", Text: "Lunch?", Poll: &Poll{Question: "Lunch?", Options: []PollOption{{Text: "pizza", Votes: 2}, {Text: "sushi"}}, Closes: 1712345678901}},
+	}
+	for _, f := range frames {
+		got, err := UnmarshalFrameProto(f.MarshalProto())
+		if err != nil {
+			t.Fatalf("%s: %v", f.Type, err)
+		}
+		if !reflect.DeepEqual(got, f) {
+			t.Errorf("round trip changed the frame:\n got %+v\nwant %+v", got, f)
+		}
+	}
+}
+
+func TestStamp(t *testing.T) {
+	posted := time.UnixMilli(1712345678901)
+	history := []Frame{{Type: FrameMessage, ID: 1, SentAt: posted}, {Type: FrameMessage, ID: 2}}
+	f := Stamp(Frame{Type: FrameMissedMessages, Messages: history})
+	if f.TS < time.Now().Add(-time.Minute).UnixMilli() {
+		t.Errorf("undated frame got ts %d, want about now", f.TS)
+	}
+	if f.Messages[0].TS != posted.UnixMilli() || f.Messages[1].TS != 0 {
+		t.Errorf("nested ts %d and %d", f.Messages[0].TS, f.Messages[1].TS)
+	}
+	if history[0].TS != 0 {
+		t.Error("stamping changed the caller's messages")
+	}
+	if f := Stamp(Frame{Type: FrameMessage, SentAt: posted}); f.TS != posted.UnixMilli() {
+		t.Errorf("message ts %d, want when it was posted", f.TS)
+	}
+}
+
+func TestClientFrameProto(t *testing.T) {
+	cf := ClientFrame{Type: ClientSubscribe, Commands: []string{"weather", "deploy"}, Patterns: []string{"(?i)incident"}}
+	got, ok := ParseClientFrameProto(cf.MarshalProto())
+	if !ok || !reflect.DeepEqual(got, cf) {
+		t.Errorf("got %+v, %v", got, ok)
+	}
+	cf = ClientFrame{Type: ClientMessage, Text: "hei", ClientID: "k-1"}
+	if got, ok := ParseClientFrameProto(cf.MarshalProto()); !ok || !reflect.DeepEqual(got, cf) {
+		t.Errorf("message: got %+v, %v", got, ok)
+	}
+	cf = ClientFrame{Type: ClientMessage, Text: "agreed", Quote: 3}
+	if got, ok := ParseClientFrameProto(cf.MarshalProto()); !ok || !reflect.DeepEqual(got, cf) {
+		t.Errorf("quote: got %+v, %v", got, ok)
+	}
+	cf = ClientFrame{Type: ClientVote, ID: 8, Option: 2}
+	if got, ok := ParseClientFrameProto(cf.MarshalProto()); !ok || !reflect.DeepEqual(got, cf) {
+		t.Errorf("vote: got %+v, %v", got, ok)
+	}
+	cf = ClientFrame{Type: ClientMarkRead, ID: 44, Room: "dev"}
+	if got, ok := ParseClientFrameProto(cf.MarshalProto()); !ok || !reflect.DeepEqual(got, cf) {
+		t.Errorf("mark read: got %+v, %v", got, ok)
+	}
+	cf = ClientFrame{Type: ClientCallICE, To: "ola", Call: "#dev", Payload: `{"candidate":"candidate:1 1 udp 2122260223 10.0.0.2 54321 typ host"}`}
+	if got, ok := ParseClientFrameProto(cf.MarshalProto()); !ok || !reflect.DeepEqual(got, cf) {
+		t.Errorf("call ice: got %+v, %v", got, ok)
+	}
+	cf = ClientFrame{Type: ClientKeyExchange, To: "ola", Payload: "cHVibGlj"}
+	if got, ok := ParseClientFrameProto(cf.MarshalProto()); !ok || !reflect.DeepEqual(got, cf) {
+		t.Errorf("key exchange: got %+v, %v", got, ok)
+	}
+	if _, ok := ParseClientFrameProto(ClientFrame{Type: "nope"}.MarshalProto()); ok {
+		t.Error("unknown type accepted")
+	}
+	if _, ok := ParseClientFrameProto([]byte{0x0a, 0xff}); ok {
+		t.Error("truncated frame accepted")
+	}
+}
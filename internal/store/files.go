@@ -0,0 +1,64 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"go-chat-app/internal/protocol"
+)
+
+// ######################################################################
+// struct: Files
+// ######################################################################
+// Every document is a JSON file in the directory. Messages aren't kept,
+// history lives in memory only, as it always did with the data dir.
+type Files struct {
+	dir string
+}
+
+func NewFiles(dir string) *Files {
+	return &Files{dir: dir}
+}
+
+// ######################################################################
+// function: Load()
+// ######################################################################
+func (s *Files) Load(name string, v any) error {
+	data, err := os.ReadFile(filepath.Join(s.dir, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// ######################################################################
+// function: Save()
+// ######################################################################
+// Writes via a temp file so a crash never leaves half a file.
+func (s *Files) Save(name string, v any) error {
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.dir, name)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *Files) SaveMessage(protocol.Frame) error               { return nil }
+func (s *Files) DeleteMessage(int64) error                      { return nil }
+func (s *Files) DeleteMessagesFrom(string) error                { return nil }
+func (s *Files) Messages(string, int) ([]protocol.Frame, error) { return nil, nil }
+func (s *Files) Close() error                                   { return nil }
@@ -0,0 +1,128 @@
+package store
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+
+	"go-chat-app/internal/protocol"
+)
+
+// ######################################################################
+// struct: Memory
+// ######################################################################
+// Keeps everything as JSON in maps, so what comes back out is a copy just
+// like with the other stores.
+type Memory struct {
+	mu       sync.Mutex
+	docs     map[string][]byte
+	messages map[int64]memoryMessage
+}
+
+type memoryMessage struct {
+	room, from string
+	data       []byte
+}
+
+func NewMemory() *Memory {
+	return &Memory{docs: make(map[string][]byte), messages: make(map[int64]memoryMessage)}
+}
+
+// ######################################################################
+// function: Load()
+// ######################################################################
+func (s *Memory) Load(name string, v any) error {
+	s.mu.Lock()
+	data, ok := s.docs[name]
+	s.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
+
+// ######################################################################
+// function: Save()
+// ######################################################################
+func (s *Memory) Save(name string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.docs[name] = data
+	s.mu.Unlock()
+	return nil
+}
+
+// ######################################################################
+// function: SaveMessage()
+// ######################################################################
+func (s *Memory) SaveMessage(f protocol.Frame) error {
+	data, err := encodeMessage(f)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.messages[f.ID] = memoryMessage{room: f.Room, from: f.From, data: data}
+	s.mu.Unlock()
+	return nil
+}
+
+// ######################################################################
+// function: DeleteMessage()
+// ######################################################################
+func (s *Memory) DeleteMessage(id int64) error {
+	s.mu.Lock()
+	delete(s.messages, id)
+	s.mu.Unlock()
+	return nil
+}
+
+// ######################################################################
+// function: DeleteMessagesFrom()
+// ######################################################################
+func (s *Memory) DeleteMessagesFrom(name string) error {
+	s.mu.Lock()
+	for id, m := range s.messages {
+		if m.from == name {
+			delete(s.messages, id)
+		}
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+// ######################################################################
+// function: Messages()
+// ######################################################################
+func (s *Memory) Messages(room string, limit int) ([]protocol.Frame, error) {
+	s.mu.Lock()
+	var ids []int64
+	for id, m := range s.messages {
+		if m.room == room {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	if limit > 0 && len(ids) > limit {
+		ids = ids[len(ids)-limit:]
+	}
+	rows := make([][]byte, len(ids))
+	for i, id := range ids {
+		rows[i] = s.messages[id].data
+	}
+	s.mu.Unlock()
+
+	list := make([]protocol.Frame, 0, len(rows))
+	for _, data := range rows {
+		f, err := decodeMessage(data)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, f)
+	}
+	return list, nil
+}
+
+func (s *Memory) Close() error { return nil }
@@ -0,0 +1,188 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+
+	"go-chat-app/internal/protocol"
+
+	_ "github.com/jackc/pgx/v5/stdlib" // "pgx"
+	_ "modernc.org/sqlite"             // "sqlite", no cgo needed
+)
+
+// ######################################################################
+// struct: dialect
+// ######################################################################
+// What differs between the SQL databases. Both keep documents and messages
+// as JSON, the tables are the same.
+type dialect struct {
+	driver string   // database/sql driver name
+	setup  []string // run on every open, schema and settings
+	conns  int      // max open connections, 0 = unlimited
+
+	loadDoc, saveDoc           string
+	saveMessage, deleteMessage string
+	deleteFrom                 string // by sender
+	recentMessages             string // room, limit
+}
+
+var sqlite = dialect{
+	driver: "sqlite",
+	setup: []string{
+		`PRAGMA journal_mode = WAL`,
+		`PRAGMA busy_timeout = 5000`,
+		`CREATE TABLE IF NOT EXISTS documents (name TEXT PRIMARY KEY, data TEXT NOT NULL)`,
+		`CREATE TABLE IF NOT EXISTS messages (id INTEGER PRIMARY KEY, room TEXT NOT NULL, sender TEXT NOT NULL, data TEXT NOT NULL)`,
+		`CREATE INDEX IF NOT EXISTS messages_room ON messages (room, id)`,
+		`CREATE INDEX IF NOT EXISTS messages_sender ON messages (sender)`,
+	},
+	conns: 1, // one writer at a time anyway, this saves on busy errors
+
+	loadDoc:        `SELECT data FROM documents WHERE name = ?`,
+	saveDoc:        `INSERT INTO documents (name, data) VALUES (?, ?) ON CONFLICT (name) DO UPDATE SET data = excluded.data`,
+	saveMessage:    `INSERT INTO messages (id, room, sender, data) VALUES (?, ?, ?, ?) ON CONFLICT (id) DO UPDATE SET room = excluded.room, sender = excluded.sender, data = excluded.data`,
+	deleteMessage:  `DELETE FROM messages WHERE id = ?`,
+	deleteFrom:     `DELETE FROM messages WHERE sender = ?`,
+	recentMessages: `SELECT data FROM (SELECT id, data FROM messages WHERE room = ? ORDER BY id DESC LIMIT ?) AS recent ORDER BY id`,
+}
+
+var postgres = dialect{
+	driver: "pgx",
+	setup: []string{
+		`CREATE TABLE IF NOT EXISTS documents (name TEXT PRIMARY KEY, data JSONB NOT NULL)`,
+		`CREATE TABLE IF NOT EXISTS messages (id BIGINT PRIMARY KEY, room TEXT NOT NULL, sender TEXT NOT NULL, data JSONB NOT NULL)`,
+		`CREATE INDEX IF NOT EXISTS messages_room ON messages (room, id)`,
+		`CREATE INDEX IF NOT EXISTS messages_sender ON messages (sender)`,
+	},
+
+	loadDoc:        `SELECT data FROM documents WHERE name = $1`,
+	saveDoc:        `INSERT INTO documents (name, data) VALUES ($1, $2) ON CONFLICT (name) DO UPDATE SET data = excluded.data`,
+	saveMessage:    `INSERT INTO messages (id, room, sender, data) VALUES ($1, $2, $3, $4) ON CONFLICT (id) DO UPDATE SET room = excluded.room, sender = excluded.sender, data = excluded.data`,
+	deleteMessage:  `DELETE FROM messages WHERE id = $1`,
+	deleteFrom:     `DELETE FROM messages WHERE sender = $1`,
+	recentMessages: `SELECT data FROM (SELECT id, data FROM messages WHERE room = $1 ORDER BY id DESC LIMIT $2) AS recent ORDER BY id`,
+}
+
+// ######################################################################
+// struct: SQL
+// ######################################################################
+// SQLite or Postgres through database/sql.
+type SQL struct {
+	db *sql.DB
+	d  dialect
+}
+
+func openSQL(d dialect, dsn string) (*SQL, error) {
+	if dsn == "" {
+		return nil, fmt.Errorf("the %s store needs a dsn", d.driver)
+	}
+	db, err := sql.Open(d.driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if d.conns > 0 {
+		db.SetMaxOpenConns(d.conns)
+	}
+	for _, stmt := range d.setup {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("setting up the %s store: %w", d.driver, err)
+		}
+	}
+	return &SQL{db: db, d: d}, nil
+}
+
+// ######################################################################
+// function: Load()
+// ######################################################################
+func (s *SQL) Load(name string, v any) error {
+	var data []byte
+	err := s.db.QueryRow(s.d.loadDoc, name).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// ######################################################################
+// function: Save()
+// ######################################################################
+func (s *SQL) Save(name string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(s.d.saveDoc, name, string(data))
+	return err
+}
+
+// ######################################################################
+// function: SaveMessage()
+// ######################################################################
+func (s *SQL) SaveMessage(f protocol.Frame) error {
+	data, err := encodeMessage(f)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(s.d.saveMessage, f.ID, f.Room, f.From, string(data))
+	return err
+}
+
+// ######################################################################
+// function: DeleteMessage()
+// ######################################################################
+func (s *SQL) DeleteMessage(id int64) error {
+	_, err := s.db.Exec(s.d.deleteMessage, id)
+	return err
+}
+
+// ######################################################################
+// function: DeleteMessagesFrom()
+// ######################################################################
+func (s *SQL) DeleteMessagesFrom(name string) error {
+	_, err := s.db.Exec(s.d.deleteFrom, name)
+	return err
+}
+
+// ######################################################################
+// function: Messages()
+// ######################################################################
+func (s *SQL) Messages(room string, limit int) ([]protocol.Frame, error) {
+	if limit <= 0 {
+		limit = math.MaxInt32
+	}
+	rows, err := s.db.Query(s.d.recentMessages, room, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []protocol.Frame
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		f, err := decodeMessage(data)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, f)
+	}
+	return list, rows.Err()
+}
+
+// Ping is for readiness checks, see hub.Ready
+func (s *SQL) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *SQL) Close() error {
+	return s.db.Close()
+}
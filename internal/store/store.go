@@ -0,0 +1,83 @@
+// Package store is where the hub keeps what has to survive a restart.
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"go-chat-app/internal/protocol"
+)
+
+// Drivers for Open
+const (
+	DriverFiles    = "files"    // JSON files in a directory, the dsn
+	DriverMemory   = "memory"   // nothing survives a restart, for tests and throwaway servers
+	DriverSQLite   = "sqlite"   // database file at the dsn
+	DriverPostgres = "postgres" // connection URL or key=value string as the dsn
+)
+
+var ErrUnknownDriver = errors.New("unknown store driver, use files, memory, sqlite or postgres")
+
+// ######################################################################
+// interface: Store
+// ######################################################################
+// Users (accounts.json), rooms (rooms.json), bans (bans.json) and the rest
+// of the hub's state are documents it loads whole on start and saves whole
+// when they change. Room history is kept message by message so it doesn't
+// have to be rewritten on every chat line.
+type Store interface {
+	// Load reads document name into v. A document that was never saved is
+	// not an error, v is left alone.
+	Load(name string, v any) error
+	Save(name string, v any) error
+
+	// SaveMessage stores a chat line, or replaces the one with its ID
+	// (reactions changed).
+	SaveMessage(f protocol.Frame) error
+	DeleteMessage(id int64) error
+	// DeleteMessagesFrom takes out everything name posted, for deleted
+	// accounts.
+	DeleteMessagesFrom(name string) error
+	// Messages is the last limit messages of room, oldest first.
+	Messages(room string, limit int) ([]protocol.Frame, error)
+
+	Close() error
+}
+
+// ######################################################################
+// function: Open()
+// ######################################################################
+func Open(driver, dsn string) (Store, error) {
+	switch driver {
+	case DriverFiles, "":
+		return NewFiles(dsn), nil
+	case DriverMemory:
+		return NewMemory(), nil
+	case DriverSQLite:
+		return openSQL(sqlite, dsn)
+	case DriverPostgres:
+		return openSQL(postgres, dsn)
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnknownDriver, driver)
+}
+
+// The frame's ts goes into the JSON, which SentAt doesn't
+func encodeMessage(f protocol.Frame) ([]byte, error) {
+	if f.TS == 0 && !f.SentAt.IsZero() {
+		f.TS = f.SentAt.UnixMilli()
+	}
+	return json.Marshal(f)
+}
+
+func decodeMessage(data []byte) (protocol.Frame, error) {
+	var f protocol.Frame
+	if err := json.Unmarshal(data, &f); err != nil {
+		return f, err
+	}
+	if f.TS != 0 {
+		f.SentAt, f.TS = time.UnixMilli(f.TS), 0
+	}
+	return f, nil
+}
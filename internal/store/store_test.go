@@ -0,0 +1,89 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"go-chat-app/internal/protocol"
+)
+
+// Postgres only runs with CHAT_TEST_POSTGRES set to a DSN of a scratch database
+func stores(t *testing.T) map[string]Store {
+	t.Helper()
+	list := map[string]Store{"memory": NewMemory()}
+	sqlite, err := Open(DriverSQLite, filepath.Join(t.TempDir(), "chat.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	list["sqlite"] = sqlite
+	if dsn := os.Getenv("CHAT_TEST_POSTGRES"); dsn != "" {
+		pg, err := Open(DriverPostgres, dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pg.(*SQL).db.Exec(`DELETE FROM documents; DELETE FROM messages`)
+		list["postgres"] = pg
+	}
+	for _, s := range list {
+		t.Cleanup(func() { s.Close() })
+	}
+	return list
+}
+
+func TestDocuments(t *testing.T) {
+	list := stores(t)
+	list["files"] = NewFiles(t.TempDir())
+	for name, s := range list {
+		bans := map[string]time.Time{"10.0.0.1": time.UnixMilli(1712345678901).UTC()}
+		var got map[string]time.Time
+		if err := s.Load("bans.json", &got); err != nil || got != nil {
+			t.Errorf("%s: never saved gave %v, %v", name, got, err)
+		}
+		if err := s.Save("bans.json", bans); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		delete(bans, "10.0.0.1")
+		bans["10.0.0.2"] = time.UnixMilli(1712345678902).UTC()
+		if err := s.Save("bans.json", bans); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err := s.Load("bans.json", &got); err != nil || !reflect.DeepEqual(got, bans) {
+			t.Errorf("%s: loaded %v, %v, want %v", name, got, err, bans)
+		}
+	}
+}
+
+func TestMessages(t *testing.T) {
+	for name, s := range stores(t) {
+		posted := time.UnixMilli(1712345678901)
+		for id := int64(1); id <= 5; id++ {
+			room := "lobby"
+			if id == 3 {
+				room = "dev"
+			}
+			s.SaveMessage(protocol.Frame{Type: protocol.FrameMessage, ID: id, Room: room, From: "kari", Text: "hei", SentAt: posted})
+		}
+		s.SaveMessage(protocol.Frame{Type: protocol.FrameMessage, ID: 4, Room: "lobby", From: "kari", Text: "hei",
+			SentAt: posted, Reactions: map[string][]string{"👍": {"ola"}}})
+		if err := s.DeleteMessage(5); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		got, err := s.Messages("lobby", 2)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(got) != 2 || got[0].ID != 2 || got[1].ID != 4 {
+			t.Fatalf("%s: got %+v, want messages 2 and 4", name, got)
+		}
+		if !got[1].SentAt.Equal(posted) || got[1].TS != 0 || len(got[1].Reactions["👍"]) != 1 {
+			t.Errorf("%s: message came back as %+v", name, got[1])
+		}
+		if all, _ := s.Messages("lobby", 0); len(all) != 3 {
+			t.Errorf("%s: %d in lobby, want 3", name, len(all))
+		}
+	}
+}
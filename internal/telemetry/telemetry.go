@@ -0,0 +1,92 @@
+// Package telemetry sends traces and metrics to an OpenTelemetry collector
+// over OTLP/HTTP. The hub and the server instrument themselves through the
+// global otel API, which does nothing until Start installs real providers.
+//
+// A chat line shows up as one trace: the chat.message span from receipt,
+// with children for the fan-out to the room, the store and the Kafka
+// export. The upgrade of each connection is a trace of its own.
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// What we show up as unless OTEL_SERVICE_NAME says otherwise
+const serviceName = "go-chat-app"
+
+// How often metrics are pushed to the collector
+const metricInterval = 30 * time.Second
+
+// ######################################################################
+// function: Start()
+// ######################################################################
+// Exports to the collector at endpoint, its base URL like
+// http://localhost:4318. Traces go to /v1/traces and metrics to
+// /v1/metrics under it, plain HTTP unless the scheme is https. Call the
+// returned func on the way down to flush what's still buffered.
+func Start(ctx context.Context, endpoint string) (func(context.Context) error, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("telemetry: %q is not an http(s) URL", endpoint)
+	}
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", serviceName)),
+		resource.WithFromEnv(), // OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES
+		resource.WithTelemetrySDK(),
+		resource.WithHost(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("telemetry: %w", err)
+	}
+
+	traceOpts := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(u.Host),
+		otlptracehttp.WithURLPath(path.Join("/", u.Path, "v1/traces")),
+	}
+	metricOpts := []otlpmetrichttp.Option{
+		otlpmetrichttp.WithEndpoint(u.Host),
+		otlpmetrichttp.WithURLPath(path.Join("/", u.Path, "v1/metrics")),
+	}
+	if u.Scheme == "http" {
+		traceOpts = append(traceOpts, otlptracehttp.WithInsecure())
+		metricOpts = append(metricOpts, otlpmetrichttp.WithInsecure())
+	}
+	traces, err := otlptracehttp.New(ctx, traceOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("telemetry: %w", err)
+	}
+	metrics, err := otlpmetrichttp.New(ctx, metricOpts...)
+	if err != nil {
+		traces.Shutdown(ctx)
+		return nil, fmt.Errorf("telemetry: %w", err)
+	}
+
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(traces), sdktrace.WithResource(res))
+	mp := sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(metrics, sdkmetric.WithInterval(metricInterval))),
+		sdkmetric.WithResource(res),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetMeterProvider(mp)
+	// traceparent from clients and proxies in front of us
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	shutdown := func(ctx context.Context) error {
+		return errors.Join(tp.Shutdown(ctx), mp.Shutdown(ctx))
+	}
+	return shutdown, nil
+}
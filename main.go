@@ -1,148 +1,208 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
-	"net/http"
+	"os"
+	"os/signal"
 	"strings"
-	"sync"
+	"syscall"
+	"time"
+	_ "time/tzdata" // recurring announcements need zones even where the OS has none
 
-	"github.com/gorilla/websocket"
+	"go-chat-app/chat"
+	"go-chat-app/internal/client"
+	"go-chat-app/internal/store"
 )
 
 // ######################################################################
-// struct: Chatter
+// function: loadConfig()
 // ######################################################################
-type Chatter struct {
-	conn     *websocket.Conn
-	username string
-	// strikes int
-}
-
-var (
-	chatters = make(map[*Chatter]bool)
-	mutex    = &sync.Mutex{}
-	count    = 0
-)
-
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	// Add CheckOrigin function if necessary for CORS
-	CheckOrigin: func(r *http.Request) bool { return true },
-}
-
-// ######################################################################
-// function: handleConnection()
-// ######################################################################
-func handleConnection(w http.ResponseWriter, r *http.Request) {
-	ws, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Println("Upgrade error: ", err)
-		return
+func loadConfig() (chat.Config, error) {
+	cfg := chat.DefaultConfig()
+	var configFile, publicDir, storeDriver, storeDSN string
+	flag.StringVar(&configFile, "config", "", "JSON config file with listeners, origins and rate limits, reread on SIGHUP")
+	var listeners []chat.ListenerConfig
+	flag.Func("listen", "address to serve on, host:port or unix:<socket path>, repeat for more (default :6969, replaces the config file's listeners)", func(v string) error {
+		l, err := chat.ParseListen(v)
+		listeners = append(listeners, l)
+		return err
+	})
+	flag.StringVar(&publicDir, "public", "", "serve the web client from this directory instead of the built in one, for development")
+	flag.StringVar(&cfg.DataDir, "data", cfg.DataDir, "directory for persisted state")
+	flag.StringVar(&storeDriver, "store", store.DriverFiles, "where state and room history are kept: files (in -data), memory, sqlite or postgres")
+	flag.StringVar(&storeDSN, "store-dsn", os.Getenv("CHAT_STORE_DSN"), "database file for sqlite, connection string for postgres")
+	flag.StringVar(&cfg.OTLPEndpoint, "otlp-endpoint", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "OpenTelemetry collector to send traces and metrics to over OTLP/HTTP, e.g. http://localhost:4318 (empty = off)")
+	flag.StringVar(&cfg.AdminToken, "admin-token", os.Getenv("CHAT_ADMIN_TOKEN"), "bearer token for the admin API")
+	flag.StringVar(&cfg.PublicURL, "public-url", "", "base URL browsers reach the server on, for OAuth redirects")
+	oauth := map[string]*chat.OAuthApp{"github": {}, "google": {}}
+	for provider, app := range oauth {
+		flag.StringVar(&app.ClientID, provider+"-client-id", "", "OAuth2 client id for signing in with "+provider)
+		flag.StringVar(&app.ClientSecret, provider+"-client-secret", os.Getenv("CHAT_"+strings.ToUpper(provider)+"_CLIENT_SECRET"), "OAuth2 client secret for "+provider)
 	}
-	defer ws.Close()
-
-	// Create a new chatter and add to the chatters map
-	chatter := &Chatter{conn: ws, username: "Ballz"}
-	mutex.Lock()
-	chatters[chatter] = true
-	count++
-	broadcastUserCount() // Broadcast user count after new connection
-	mutex.Unlock()
-
-	ws.WriteMessage(websocket.TextMessage, []byte("Velkommen til kihle's tempChat.\n"))
-	ws.WriteMessage(websocket.TextMessage, []byte("Bytt brukernavn med: /u <ditt_brukernavn>\n"))
-	ws.WriteMessage(websocket.TextMessage, []byte("Forlat/clear chat med: /q\n"))
-	// defer closing connection and deleting chatters til end of function
-	defer func() {
-		mutex.Lock()
-		delete(chatters, chatter)
-		count--
-		broadcastUserCount() // Broadcast user count after lost connection
-		mutex.Unlock()
-	}()
-
-	for {
-		messageType, bytemessage, err := ws.ReadMessage()
-		if err != nil {
-			log.Println("Read error: ", err)
-			break
+	flag.Func("challenge", "what guests must pass before connecting: pow, hcaptcha or turnstile (default none)", func(v string) error {
+		switch v {
+		case chat.ChallengePoW, chat.ChallengeHCaptcha, chat.ChallengeTurnstile:
+			cfg.Challenge = v
+			return nil
 		}
-
-		// HANDLE THE MESSAGE
-		// For example, broadcast the message to other connected clients
-		// Make sure to handle different types of messages (text, binary, etc.)
-		if messageType == websocket.TextMessage {
-			message := string(bytemessage)
-
-			if strings.HasPrefix(message, "/u ") {
-				// Set the username
-				chatter.username = strings.TrimSpace(strings.TrimPrefix(message, "/u "))
-				ws.WriteMessage(websocket.TextMessage, []byte("Username set to "+chatter.username+"\n"))
-
-			} else if strings.HasPrefix(message, "/q") {
-				fmt.Printf("User %s has disconnected.\n", chatter.username)
-				break // exit the loop to close the connection
-
-			} else {
-				// Broadcast the message
-				broadcast(fmt.Sprintf("%s: %s", chatter.username, message), chatter)
-				ws.WriteMessage(websocket.TextMessage, []byte(chatter.username+": "+message+"\n"))
+		return errors.New("want pow, hcaptcha or turnstile")
+	})
+	flag.StringVar(&cfg.ChallengeSiteKey, "challenge-site-key", "", "hCaptcha or Turnstile site key")
+	flag.StringVar(&cfg.ChallengeSecret, "challenge-secret", os.Getenv("CHAT_CHALLENGE_SECRET"), "hCaptcha or Turnstile secret key")
+	flag.IntVar(&cfg.PowDifficulty, "pow-difficulty", cfg.PowDifficulty, "leading zero bits a -challenge pow proof needs, every one more doubles the work")
+	flag.BoolVar(&cfg.BehindProxy, "behind-proxy", false, "use X-Forwarded-For from a proxy on a loopback or private address to find the client IP, see -trusted-proxies for others")
+	flag.Func("trusted-proxies", "addresses and CIDR ranges of reverse proxies whose X-Forwarded-For and X-Real-IP are believed, comma separated, e.g. 10.0.0.0/8,127.0.0.1; replaces -behind-proxy's loopback and private addresses", func(v string) (err error) {
+		cfg.TrustedProxies, err = chat.ParseTrustedProxies(v)
+		return err
+	})
+	flag.IntVar(&cfg.MaxConnsPerIP, "max-conns-per-ip", cfg.MaxConnsPerIP, "max simultaneous connections per IP (0 = unlimited)")
+	flag.BoolVar(&cfg.Compression, "compression", false, "negotiate permessage-deflate with clients")
+	flag.IntVar(&cfg.CompressionLevel, "compression-level", cfg.CompressionLevel, "deflate level, 1 (fastest) to 9 (smallest)")
+	flag.IntVar(&cfg.CompressionMinSize, "compression-min-size", cfg.CompressionMinSize, "only compress frames at least this many bytes")
+	flag.IntVar(&cfg.SendBuffer, "send-buffer", cfg.SendBuffer, "frames queued for a client before -slow-clients kicks in")
+	flag.Func("slow-clients", "what to do when a client's send buffer is full: disconnect (default), drop_oldest or drop_newest", func(v string) error {
+		switch v {
+		case client.Disconnect, client.DropOldest, client.DropNewest:
+			cfg.SlowClients = v
+			return nil
+		}
+		return errors.New("want disconnect, drop_oldest or drop_newest")
+	})
+	flag.IntVar(&cfg.FanoutWorkers, "fanout-workers", 0, "goroutines delivering broadcasts to big rooms (0 = one per CPU)")
+	flag.StringVar(&cfg.WordList, "wordlist", "", "file with banned words, one per line")
+	flag.IntVar(&cfg.MaxMessage, "max-message", cfg.MaxMessage, "biggest frame in bytes a client may send")
+	flag.Func("block-domain", "domain links in messages may not point to, comma separated or repeated", func(v string) error {
+		cfg.LinkBlocklist = append(cfg.LinkBlocklist, strings.Split(v, ",")...)
+		return nil
+	})
+	flag.Func("allow-domain", "only allow links to this domain, comma separated or repeated", func(v string) error {
+		cfg.LinkAllowlist = append(cfg.LinkAllowlist, strings.Split(v, ",")...)
+		return nil
+	})
+	flag.BoolVar(&cfg.StripLinks, "strip-links", false, "take links to blocked domains out of messages instead of refusing them with a strike")
+	flag.IntVar(&cfg.Spam.Repeats, "spam-repeats", cfg.Spam.Repeats, "the same message this many times within -spam-window is spam (0 = not checked)")
+	flag.DurationVar(&cfg.Spam.Window, "spam-window", cfg.Spam.Window, "window for -spam-repeats")
+	flag.IntVar(&cfg.Spam.CapsPercent, "spam-caps", cfg.Spam.CapsPercent, "messages with more than this percent capitals are spam (0 = not checked)")
+	flag.IntVar(&cfg.Spam.Mentions, "spam-mentions", cfg.Spam.Mentions, "messages with more @mentions than this are spam (0 = not checked)")
+	flag.IntVar(&cfg.MaxStrikes, "max-strikes", cfg.MaxStrikes, "strikes before a user is kicked")
+	flag.DurationVar(&cfg.StrikeBan, "strike-ban", cfg.StrikeBan, "IP ban on the last strike (0 = kick only)")
+	flag.Float64Var(&cfg.AckSampleRate, "ack-sample-rate", cfg.AckSampleRate, "fraction of broadcast deliveries sampled for delivery SLOs")
+	flag.DurationVar(&cfg.AckTimeout, "ack-timeout", cfg.AckTimeout, "sampled deliveries not acked by then count as lost")
+	flag.DurationVar(&cfg.SnapshotInterval, "snapshot-interval", cfg.SnapshotInterval, "how often to snapshot hub state")
+	flag.DurationVar(&cfg.SnapshotGrace, "snapshot-grace", cfg.SnapshotGrace, "how long a restored session is kept for its client")
+	flag.DurationVar(&cfg.ResumeWindow, "resume-window", cfg.ResumeWindow, "how long a client whose connection dropped can resume its session (0 = off)")
+	flag.DurationVar(&cfg.LoginTTL, "login-ttl", cfg.LoginTTL, "how long a login stays good before signing in again")
+	flag.IntVar(&cfg.HistorySize, "history", cfg.HistorySize, "messages kept in memory per room")
+	flag.DurationVar(&cfg.Retention.MaxAge, "retention-age", 0, "delete messages older than this from rooms that don't set their own retention (0 = keep)")
+	flag.IntVar(&cfg.Retention.MaxCount, "retention-count", 0, "keep only this many messages per room that doesn't set its own retention (0 = all)")
+	flag.StringVar(&cfg.SMTPAddr, "smtp", cfg.SMTPAddr, "SMTP server for room digests, address checks and password resets")
+	flag.StringVar(&cfg.MailFrom, "mail-from", "", "sender of address checks and password resets (empty = noreply@ the -public-url host)")
+	flag.StringVar(&cfg.SMTPUser, "smtp-user", "", "SMTP username (empty = no auth)")
+	flag.StringVar(&cfg.SMTPPassword, "smtp-password", os.Getenv("CHAT_SMTP_PASSWORD"), "SMTP password")
+	flag.StringVar(&cfg.MailIngest, "mail-ingest", "", "listen address for digest replies over SMTP, e.g. :2525")
+	flag.StringVar(&cfg.IRCAddr, "irc", "", "listen address for the IRC gateway, e.g. :6667")
+	flag.StringVar(&cfg.MOTDFile, "motd", "", "file with the message of the day")
+	flag.DurationVar(&cfg.HeartbeatTimeout, "heartbeat-timeout", cfg.HeartbeatTimeout, "presence goes idle without an app heartbeat for this long")
+	flag.DurationVar(&cfg.AutoAway, "auto-away", cfg.AutoAway, "mark users away after this long without chatting (0 = never)")
+	flag.DurationVar(&cfg.UserCountInterval, "user-count-interval", cfg.UserCountInterval, "coalesce user count updates, sending at most one per interval")
+	flag.DurationVar(&cfg.DuplicateWindow, "duplicate-window", cfg.DuplicateWindow, "refuse the same message from the same user in the same room within this (0 = allow)")
+	flag.DurationVar(&cfg.RenameCooldown, "rename-cooldown", cfg.RenameCooldown, "time a connection has to wait between renames (0 = none, the first rename is always allowed)")
+	flag.Int64Var(&cfg.BandwidthCap, "bandwidth-cap", 0, "bytes a user may send and receive per day (0 = unlimited)")
+	flag.BoolVar(&cfg.BandwidthDisconnect, "bandwidth-disconnect", false, "disconnect users over the bandwidth cap instead of throttling them")
+	flag.IntVar(&cfg.StoragePool, "storage-pool", cfg.StoragePool, "loads and saves of the store running at once (0 = unlimited)")
+	flag.DurationVar(&cfg.StorageSlow, "storage-slow", cfg.StorageSlow, "log loads and saves of the store slower than this (0 = never)")
+	flag.IntVar(&cfg.MaxEmbedsPerIP, "max-embeds-per-ip", cfg.MaxEmbedsPerIP, "open embed streams allowed per IP")
+	flag.DurationVar(&cfg.LegacyWait, "legacy-wait", cfg.LegacyWait, "how long to wait for a client's JSON hello before falling back to plain text lines (0 = no fallback)")
+	flag.Func("legacy-until", "date (YYYY-MM-DD, UTC) from which plain text clients are refused", func(v string) error {
+		until, err := time.Parse(time.DateOnly, v)
+		cfg.LegacyUntil = until
+		return err
+	})
+	flag.Func("block-version", "client version to refuse, comma separated or repeated", func(v string) error {
+		if cfg.BlockedVersions == nil {
+			cfg.BlockedVersions = make(map[string]bool)
+		}
+		for _, version := range strings.Split(v, ",") {
+			if version = strings.TrimSpace(version); version != "" {
+				cfg.BlockedVersions[version] = true
 			}
-		} else if messageType == websocket.BinaryMessage {
-			broadcast(fmt.Sprintf("%s has entered a binary message. For shame!", chatter.username), nil)
-			fmt.Printf("User %s has entered a binary message. For shame!\n", chatter.username)
 		}
-
+		return nil
+	})
+	flag.Parse()
+	if (cfg.Challenge == chat.ChallengeHCaptcha || cfg.Challenge == chat.ChallengeTurnstile) && (cfg.ChallengeSiteKey == "" || cfg.ChallengeSecret == "") {
+		return cfg, fmt.Errorf("-challenge %s needs -challenge-site-key and -challenge-secret", cfg.Challenge)
+	}
+	for provider, app := range oauth {
+		if app.ClientID != "" {
+			if cfg.OAuth == nil {
+				cfg.OAuth = make(map[string]chat.OAuthApp)
+			}
+			cfg.OAuth[provider] = *app
+		}
 	}
 
-	// Once the loop exits, the client has disconnected
-	broadcast(fmt.Sprintf("%s has left the chat.", chatter.username), nil)
-}
-
-// ######################################################################
-// function: broadcastUserCount()
-// ######################################################################
-func broadcastUserCount() {
-	message := fmt.Sprintf("UC%d", count)
-	for chatter := range chatters {
-		err := chatter.conn.WriteMessage(websocket.TextMessage, []byte(message))
+	if storeDriver != store.DriverFiles {
+		s, err := store.Open(storeDriver, storeDSN)
 		if err != nil {
-			log.Printf("Error broadcasting user count: %v", err)
-			continue
+			return cfg, err
 		}
+		cfg.Store = s
 	}
-}
 
-// ######################################################################
-// function: broadcast()
-// ######################################################################
-func broadcast(message string, sender *Chatter) {
-	mutex.Lock()
-	defer mutex.Unlock()
-	for chatter := range chatters {
-		if sender == nil || chatter != sender {
-			err := chatter.conn.WriteMessage(websocket.TextMessage, []byte(message))
-			if err != nil {
-				log.Printf("Error: %v", err)
-				continue
-			}
-		}
+	cfg.Public = publicFS()
+	if publicDir != "" {
+		cfg.Public = os.DirFS(publicDir)
+	}
+
+	fileConfig, err := chat.LoadFileConfig(configFile)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.ConfigFile = configFile
+	cfg.Listeners = fileConfig.Listeners
+	if len(listeners) > 0 {
+		cfg.Listeners = listeners
 	}
+	cfg.Matrix = fileConfig.Matrix
+	cfg.Kafka = fileConfig.Kafka
+	cfg.LinkPreviews = fileConfig.LinkPreviews
+	cfg.AllowedOrigins = fileConfig.AllowedOrigins
+	cfg.RateLimits = fileConfig.RateLimits
+	return cfg, nil
 }
 
 // ######################################################################
 // function: main()
 // ######################################################################
 func main() {
-	// Set up WebSocket route
-	http.HandleFunc("/ws", handleConnection)
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatalf("Config error: %v", err)
+	}
+
+	// SIGINT/SIGTERM stop the server, which writes a last snapshot on the way down
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	// Serve static files from a directory
-	fs := http.FileServer(http.Dir("public"))
-	http.Handle("/", fs)
+	srv := chat.New(cfg)
 
-	fmt.Printf("WebSocket server started on port 6969\n")
-	log.Fatal(http.ListenAndServe(":6969", nil))
+	// SIGHUP reloads the config file, word list, MOTD and ban lists
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := srv.Reload("SIGHUP"); err != nil {
+				log.Printf("Error reloading config, keeping the old one: %v", err)
+			}
+		}
+	}()
+
+	if err := srv.Run(ctx); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// The web client is built into the binary, -public serves it from disk
+// instead while working on it.
+//
+//go:embed public
+var embedded embed.FS
+
+// ######################################################################
+// function: publicFS()
+// ######################################################################
+func publicFS() fs.FS {
+	public, err := fs.Sub(embedded, "public")
+	if err != nil {
+		panic(err) // can't happen, the directory is checked at build time
+	}
+	return public
+}